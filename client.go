@@ -0,0 +1,181 @@
+package cloak
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
+
+// ClientConfig is the config of a client, as in ckclient.json. LocalHost and LocalPort aren't listened on, and are
+// optional
+type ClientConfig = client.RawConfig
+
+var ErrClientClosed = errors.New("client closed")
+
+// Client opens streams to the server in sessions it makes as they're needed. It's safe for concurrent use
+type Client struct {
+	remote client.RemoteConnConfig
+	auth   client.AuthInfo
+	dialer common.Dialer
+
+	// ctx is cancelled when the client is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// m is held while a session is made, so that only one is
+	m    sync.Mutex
+	sesh *mux.Session
+}
+
+// Dial makes a client with config and its first session, which it keeps trying to make until ctx is done. With a
+// NumConn of 0, each stream has a session of its own, and there's none for Dial to make
+func Dial(ctx context.Context, config ClientConfig) (*Client, error) {
+	if config.LocalHost == "" {
+		config.LocalHost = "127.0.0.1"
+	}
+	if config.LocalPort == "" {
+		config.LocalPort = "1984"
+	}
+	if config.RemotePort == "" {
+		config.RemotePort = "443"
+	}
+	_, remote, auth, err := config.SplitConfigs(common.RealWorldState)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		remote: remote,
+		auth:   auth,
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	// the addresses of RemoteHost are raced in IPv6 and IPv4, as they are by ck-client
+	bound := client.MakeBoundDialer(&net.Dialer{KeepAlive: remote.KeepAlive}, remote.Binding)
+	c.dialer = client.MakeHappyEyeballs(bound, remote.PreferIPv4, remote.Resolver)
+	if remote.Endpoints != nil {
+		go remote.Endpoints.Watch(c.ctx, c.dialer)
+	}
+
+	if c.perConnection() {
+		return c, nil
+	}
+	sesh, err := c.makeSession(ctx)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.sesh = sesh
+	return c, nil
+}
+
+func (c *Client) perConnection() bool { return c.remote.NumConn == 0 }
+
+// makeSession makes a session, giving up once ctx is done or the client is closed
+func (c *Client) makeSession(ctx context.Context) (*mux.Session, error) {
+	seshCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+	sesh := client.MakeSession(seshCtx, c.remote, c.auth, c.dialer, false)
+	if sesh.IsClosed() {
+		if c.ctx.Err() != nil {
+			return nil, ErrClientClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, mux.ErrBrokenSession
+	}
+	return sesh, nil
+}
+
+// session returns the session that streams are opened in, making a new one with ctx if it has closed or its server is
+// draining
+func (c *Client) session(ctx context.Context) (*mux.Session, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.sesh.IsClosed() || c.sesh.IsDraining() {
+		sesh, err := c.makeSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.sesh = sesh
+	}
+	return c.sesh, nil
+}
+
+// open opens a stream with openStream, in a session of its own if NumConn is 0. A session that has to be made is given
+// up on once ctx is done
+func (c *Client) open(ctx context.Context, openStream func(*mux.Session) (client.ConnWithReadFromTimeout, error)) (net.Conn, error) {
+	if c.ctx.Err() != nil {
+		return nil, ErrClientClosed
+	}
+	if !c.perConnection() {
+		sesh, err := c.session(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stream, err := openStream(sesh)
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+	sesh, err := c.makeSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := openStream(sesh)
+	if err != nil {
+		sesh.Close()
+		return nil, err
+	}
+	return &client.CloseSessionAfterCloseStream{ConnWithReadFromTimeout: stream, Session: sesh}, nil
+}
+
+// OpenStream opens a stream that the server relays to ProxyMethod
+func (c *Client) OpenStream() (net.Conn, error) {
+	return c.OpenStreamContext(context.Background())
+}
+
+// OpenStreamContext is OpenStream that gives up on making a session for the stream once ctx is done
+func (c *Client) OpenStreamContext(ctx context.Context) (net.Conn, error) {
+	return c.open(ctx, func(sesh *mux.Session) (client.ConnWithReadFromTimeout, error) {
+		return sesh.OpenStream()
+	})
+}
+
+// DialTarget opens a stream that the server connects to address, which must be a host:port. ProxyMethod must be a
+// "direct" proxy method on the server
+func (c *Client) DialTarget(network, address string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, address)
+}
+
+// DialContext is DialTarget that gives up on making a session for the stream once ctx is done
+func (c *Client) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	return c.open(ctx, func(sesh *mux.Session) (client.ConnWithReadFromTimeout, error) {
+		return client.OpenTargetStream(address, sesh, nil, false)
+	})
+}
+
+// Close closes the client and its session, along with the streams open in it. Streams with sessions of their own are
+// left to be closed by themselves
+func (c *Client) Close() error {
+	c.cancel()
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.sesh != nil && !c.sesh.IsClosed() {
+		return c.sesh.Close()
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package cloak
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var bypassUID = [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+var publicKey, _ = base64.StdEncoding.DecodeString("7f7TuKrs264VNSgMno8PkDlyhGhVuOSR8JHLE6H4Ljc=")
+var privateKey, _ = base64.StdEncoding.DecodeString("SMWeC6VuZF8S/id65VuFQFlfa7hTEJBpL6wWhqPP100=")
+
+func listenEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestClientServer(t *testing.T) {
+	echoL := listenEcho(t)
+	defer echoL.Close()
+
+	s, err := NewServer(ServerConfig{
+		ProxyBook:    map[string][]string{"tcp": {"tcp", echoL.Addr().String()}},
+		BypassUID:    [][]byte{bypassUID[:]},
+		RedirAddr:    echoL.Addr().String(),
+		PrivateKey:   privateKey,
+		DatabasePath: filepath.Join(t.TempDir(), "userinfo.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(l) }()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	for _, numConn := range []int{2, 0} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		c, err := Dial(ctx, ClientConfig{
+			ServerName:       "www.example.com",
+			ProxyMethod:      "tcp",
+			EncryptionMethod: "aes-gcm",
+			UID:              bypassUID[:],
+			PublicKey:        publicKey,
+			NumConn:          numConn,
+			RemoteHost:       host,
+			RemotePort:       port,
+		})
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := c.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		want := []byte("hello")
+		conn.Write(want)
+		got := make([]byte, len(want))
+		if _, err = io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("NumConn %v: expecting %s echoed, got %s", numConn, want, got)
+		}
+		conn.Close()
+		c.Close()
+		if _, err = c.OpenStream(); err != ErrClientClosed {
+			t.Errorf("NumConn %v: expecting ErrClientClosed after closing, got %v", numConn, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-served; err != ErrServerClosed {
+		t.Errorf("expecting ErrServerClosed from Serve, got %v", err)
+	}
+}
+
+func TestDialGivesUp(t *testing.T) {
+	dial := func(t *testing.T, addr net.Addr) {
+		host, port, _ := net.SplitHostPort(addr.String())
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := Dial(ctx, ClientConfig{
+			ServerName:       "www.example.com",
+			ProxyMethod:      "tcp",
+			EncryptionMethod: "plain",
+			UID:              bypassUID[:],
+			PublicKey:        publicKey,
+			NumConn:          1,
+			RemoteHost:       host,
+			RemotePort:       port,
+		})
+		if err != context.DeadlineExceeded {
+			t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("kept trying for %v after the context was done", elapsed)
+		}
+	}
+
+	t.Run("nothing listening", func(t *testing.T) {
+		// nothing listens on it once it's closed
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		dial(t, l.Addr())
+	})
+	t.Run("handshake unanswered", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				// what's sent is read and never answered
+				go io.Copy(io.Discard, conn)
+			}
+		}()
+		dial(t, l.Addr())
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+var version string
+
+// firstWriteConn keeps what's first written to it
+type firstWriteConn struct {
+	net.Conn
+	first []byte
+}
+
+func (c *firstWriteConn) Write(b []byte) (int, error) {
+	if c.first == nil {
+		c.first = append([]byte{}, b...)
+	}
+	return c.Conn.Write(b)
+}
+
+// captureCloakHello makes a Cloak connection to addr as in the client configuration config, and returns what was
+// first sent on it, which a scanner watching it could replay
+func captureCloakHello(config string, addr string) ([]byte, error) {
+	rawConfig, err := client.ParseConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	_, remoteConfig, authInfo, err := rawConfig.SplitConfigs(common.RealWorldState)
+	if err != nil {
+		return nil, err
+	}
+	var sessionId [4]byte
+	common.CryptoRandRead(sessionId[:])
+	authInfo.SessionId = binary.BigEndian.Uint32(sessionId[:])
+
+	rawConn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn := &firstWriteConn{Conn: rawConn}
+	transport := remoteConfig.TransportMaker()
+	defer transport.Close()
+	if _, err := transport.Handshake(conn, authInfo); err != nil {
+		return nil, fmt.Errorf("failed to make a Cloak connection: %v", err)
+	}
+	return conn.first, nil
+}
+
+func main() {
+	var serverAddr, decoyAddr, sni, config string
+	var rounds int
+	var timeout, tolerance time.Duration
+	flag.StringVar(&serverAddr, "s", "", "the ip:port of the ck-server to audit")
+	flag.StringVar(&decoyAddr, "r", "", "the ip:port of the cover site to compare the server with, the SNI on the port of the server by default")
+	flag.StringVar(&sni, "sni", "", "the domain of the cover site, the ServerName of the client configuration or the host of the server by default")
+	flag.StringVar(&config, "c", "", "the configuration file of a client of the server, to replay the ClientHello of a Cloak connection it makes")
+	flag.IntVar(&rounds, "n", 3, "how many times each probe is sent")
+	flag.DurationVar(&timeout, "timeout", 10*time.Second, "how long a probe is waited on for the connection to end")
+	flag.DurationVar(&tolerance, "tolerance", 100*time.Millisecond, "how far apart the server and the cover site can answer before it's told")
+	askVersion := flag.Bool("v", false, "Print the version number")
+	printUsage := flag.Bool("h", false, "Print this message")
+	flag.Parse()
+
+	if *askVersion {
+		fmt.Printf("ck-audit %s", version)
+		return
+	}
+	if *printUsage || serverAddr == "" {
+		flag.Usage()
+		return
+	}
+
+	serverHost, serverPort, err := net.SplitHostPort(serverAddr)
+	if err != nil {
+		log.Fatalf("bad server address: %v", err)
+	}
+	var cloakHello []byte
+	if config != "" {
+		cloakHello, err = captureCloakHello(config, serverAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if sni == "" {
+			if rawConfig, err := client.ParseConfig(config); err == nil {
+				sni = rawConfig.ServerName
+			}
+		}
+	}
+	if sni == "" {
+		sni = serverHost
+	}
+	if decoyAddr == "" {
+		decoyAddr = net.JoinHostPort(sni, serverPort)
+	}
+
+	probes, err := makeProbes(sni, rand.Read, cloakHello)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("Probing %v against %v as %v, %v times each", serverAddr, decoyAddr, sni, rounds)
+
+	dialer := &net.Dialer{Timeout: timeout}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROBE\tSERVER\tCOVER SITE\tSERVER TIME\tCOVER SITE TIME\tVERDICT")
+	distinguishable := false
+	for _, p := range probes {
+		var server, decoy []outcome
+		for i := 0; i < rounds; i++ {
+			// the two are probed in turn so that a change of the network in between is felt by both
+			o, err := runProbe(dialer, serverAddr, p, timeout)
+			if err != nil {
+				log.Fatalf("failed to connect to the server: %v", err)
+			}
+			server = append(server, o)
+			o, err = runProbe(dialer, decoyAddr, p, timeout)
+			if err != nil {
+				log.Fatalf("failed to connect to the cover site: %v", err)
+			}
+			decoy = append(decoy, o)
+		}
+		v := compare(p.name, server, decoy, tolerance)
+		result := "indistinguishable"
+		if len(v.reasons) != 0 {
+			distinguishable = true
+			result = fmt.Sprint(v.reasons)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", v.probe, v.serverKind, v.decoyKind,
+			v.serverTiming.Round(time.Millisecond), v.decoyTiming.Round(time.Millisecond), result)
+	}
+	w.Flush()
+	if distinguishable {
+		os.Exit(1)
+	}
+}
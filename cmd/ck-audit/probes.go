@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// how much of a response is kept to tell what it is
+const keptResponse = 64
+
+// a probe is something a scanner sends to a suspected proxy server to see whether it answers unlike the site it
+// claims to be
+type probe struct {
+	name string
+	// send sends the probe on conn, and returns the connection its response is read from
+	send func(conn net.Conn) (net.Conn, error)
+}
+
+// sendBytes makes a probe that sends data as it is, or nothing if it's empty
+func sendBytes(name string, data []byte) probe {
+	return probe{name: name, send: func(conn net.Conn) (net.Conn, error) {
+		if len(data) == 0 {
+			return conn, nil
+		}
+		_, err := conn.Write(data)
+		return conn, err
+	}}
+}
+
+// makeClientHello makes the ClientHello of an ordinary TLS client to sni
+func makeClientHello(sni string) ([]byte, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: sni, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		return nil, err
+	}
+	hello := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:5])))
+	copy(hello, header)
+	if _, err := io.ReadFull(server, hello[5:]); err != nil {
+		return nil, err
+	}
+	return hello, nil
+}
+
+// makeProbes makes the probes of GFW-style scanners against a server whose cover site is sni. randRead fills the
+// random bytes sent, and cloakHello is a ClientHello of a Cloak client that's already been sent, which is replayed
+// if it isn't nil
+func makeProbes(sni string, randRead func([]byte) (int, error), cloakHello []byte) ([]probe, error) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		_, _ = randRead(b)
+		return b
+	}
+	hello, err := makeClientHello(sni)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make a ClientHello: %v", err)
+	}
+	// the session ID of the ClientHello, which follows the record and handshake headers, the version and the random,
+	// is flipped as if the hidden data in it were wrong
+	corrupt := append([]byte{}, hello...)
+	for i := 5 + 4 + 2 + 32 + 1; i < 5+4+2+32+1+32 && i < len(corrupt); i++ {
+		corrupt[i] ^= 0xff
+	}
+
+	probes := []probe{
+		sendBytes("nothing", nil),
+		sendBytes("1 random byte", random(1)),
+		sendBytes("16 random bytes", random(16)),
+		sendBytes("517 random bytes", random(517)),
+		sendBytes("2048 random bytes", random(2048)),
+		sendBytes("TLS record header only", hello[:5]),
+		sendBytes("truncated ClientHello", hello[:len(hello)/2]),
+		sendBytes("corrupt ClientHello", corrupt),
+		sendBytes("HTTP GET", []byte("GET / HTTP/1.1\r\nHost: "+sni+"\r\n\r\n")),
+		{name: "TLS in TLS", send: func(conn net.Conn) (net.Conn, error) {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: sni, InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+			if err := tlsConn.Handshake(); err != nil {
+				return nil, err
+			}
+			_, err := tlsConn.Write(hello)
+			return tlsConn, err
+		}},
+	}
+	if cloakHello != nil {
+		probes = append(probes, sendBytes("replayed Cloak ClientHello", cloakHello))
+	}
+	return probes, nil
+}
+
+// outcome is how a server answered a probe
+type outcome struct {
+	// what the probe failed on before it's answered, which is then all there is to it
+	sendErr error
+	// the first keptResponse bytes of the response, and how long the response is in all
+	response []byte
+	length   int
+	// how the connection ended: "EOF", "reset", "timeout" or the error
+	end string
+	// how long the TCP handshake took, and how long after it the first byte of the response came and the
+	// connection ended
+	connect   time.Duration
+	firstByte time.Duration
+	ended     time.Duration
+}
+
+// runProbe connects to addr with dialer, sends p and reads the response until the connection ends or timeout passes
+func runProbe(dialer *net.Dialer, addr string, p probe, timeout time.Duration) (o outcome, err error) {
+	start := time.Now()
+	rawConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return o, err
+	}
+	defer rawConn.Close()
+	o.connect = time.Since(start)
+	start = time.Now()
+	_ = rawConn.SetDeadline(start.Add(timeout))
+	conn, err := p.send(rawConn)
+	if err != nil {
+		o.sendErr = err
+		o.ended = time.Since(start)
+		return o, nil
+	}
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if o.length == 0 {
+				o.firstByte = time.Since(start)
+			}
+			if len(o.response) < keptResponse {
+				o.response = append(o.response, buf[:min(n, keptResponse-len(o.response))]...)
+			}
+			o.length += n
+		}
+		if err != nil {
+			o.ended = time.Since(start)
+			o.end = describeEnd(err)
+			return o, nil
+		}
+	}
+}
+
+func describeEnd(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, io.EOF):
+		return "EOF"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr):
+		// without the addresses, which differ between any two servers
+		return opErr.Err.Error()
+	default:
+		return err.Error()
+	}
+}
+
+// describeResponse tells what kind of a response is, without what differs between any two of its kind, such as the
+// random of a ServerHello or the date of an HTTP response
+func describeResponse(response []byte) string {
+	switch {
+	case len(response) == 0:
+		return "nothing"
+	case len(response) >= 7 && response[0] == 0x15:
+		return fmt.Sprintf("TLS alert %v", response[6])
+	case response[0] == 0x15:
+		return "TLS alert"
+	case response[0] == 0x16:
+		return "TLS handshake"
+	case bytes.HasPrefix(response, []byte("HTTP/")):
+		statusLine, _, _ := strings.Cut(string(response), "\r\n")
+		if fields := strings.Fields(statusLine); len(fields) >= 2 {
+			return "HTTP " + fields[1]
+		}
+		return "HTTP"
+	default:
+		return "data"
+	}
+}
+
+// kind tells what happened to the probe, as what it's compared to another server's by
+func (o outcome) kind() string {
+	if o.sendErr != nil {
+		return "failed: " + describeEnd(o.sendErr)
+	}
+	return describeResponse(o.response) + ", then " + o.end
+}
+
+// elapsed is how long the server took to answer, or to end the connection if it didn't
+func (o outcome) elapsed() time.Duration {
+	if o.length > 0 {
+		return o.firstByte
+	}
+	return o.ended
+}
+
+// verdict compares the outcomes of a probe against the server with those against the decoy
+type verdict struct {
+	probe        string
+	serverKind   string
+	decoyKind    string
+	serverTiming time.Duration
+	decoyTiming  time.Duration
+	// what tells the server apart from the decoy, empty if nothing does
+	reasons []string
+}
+
+// mostCommonKind is the kind most of outcomes are of
+func mostCommonKind(outcomes []outcome) string {
+	counts := make(map[string]int)
+	best := ""
+	for _, o := range outcomes {
+		counts[o.kind()]++
+		if counts[o.kind()] > counts[best] || (counts[o.kind()] == counts[best] && o.kind() < best) {
+			best = o.kind()
+		}
+	}
+	return best
+}
+
+// medianElapsed is the median of how long the outcomes take, less how long their TCP handshakes took so that the
+// round trip to either server is left out
+func medianElapsed(outcomes []outcome) time.Duration {
+	var elapsed []time.Duration
+	for _, o := range outcomes {
+		if o.end == "timeout" {
+			continue
+		}
+		elapsed = append(elapsed, max(o.elapsed()-o.connect, 0))
+	}
+	if len(elapsed) == 0 {
+		return 0
+	}
+	sort.Slice(elapsed, func(i, j int) bool { return elapsed[i] < elapsed[j] })
+	return elapsed[len(elapsed)/2]
+}
+
+// compare tells whether the outcomes of a probe against the server can be told apart from those against the decoy,
+// by what kind they are or by how long they take to answer if that differs by more than tolerance
+func compare(name string, server []outcome, decoy []outcome, tolerance time.Duration) verdict {
+	v := verdict{
+		probe:        name,
+		serverKind:   mostCommonKind(server),
+		decoyKind:    mostCommonKind(decoy),
+		serverTiming: medianElapsed(server),
+		decoyTiming:  medianElapsed(decoy),
+	}
+	if v.serverKind != v.decoyKind {
+		v.reasons = append(v.reasons, "answers differently")
+	}
+	if delta := v.serverTiming - v.decoyTiming; delta > tolerance || delta < -tolerance {
+		v.reasons = append(v.reasons, fmt.Sprintf("answers %v apart", delta.Round(time.Millisecond)))
+	}
+	return v
+}
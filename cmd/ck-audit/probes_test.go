@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveEach accepts connections on l and answers each with respond
+func serveEach(l net.Listener, respond func(conn net.Conn)) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			respond(conn)
+		}()
+	}
+}
+
+func listen(t *testing.T, respond func(conn net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go serveEach(l, respond)
+	return l.Addr().String()
+}
+
+func TestMakeProbes(t *testing.T) {
+	zeros := func(b []byte) (int, error) { return len(b), nil }
+	probes, err := makeProbes("www.example.com", zeros, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withReplay, err := makeProbes("www.example.com", zeros, []byte{0x16, 0x03, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(withReplay) != len(probes)+1 {
+		t.Errorf("expecting the Cloak ClientHello to be replayed in one more probe")
+	}
+	names := make(map[string]bool)
+	for _, p := range withReplay {
+		if names[p.name] {
+			t.Errorf("%v is probed twice", p.name)
+		}
+		names[p.name] = true
+	}
+}
+
+func TestMakeClientHello(t *testing.T) {
+	hello, err := makeClientHello("www.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello[0] != 0x16 || hello[5] != 0x01 {
+		t.Errorf("expecting a ClientHello, got % x", hello[:6])
+	}
+	if !bytes.Contains(hello, []byte("www.example.com")) {
+		t.Error("expecting the SNI to be in the ClientHello")
+	}
+}
+
+func TestDescribeResponse(t *testing.T) {
+	for response, expected := range map[string]string{
+		"":                                    "nothing",
+		"\x15\x03\x03\x00\x02\x02\x28":        "TLS alert 40",
+		"\x16\x03\x03\x00\x7a\x02":            "TLS handshake",
+		"HTTP/1.1 400 Bad Request\r\nDate: x": "HTTP 400",
+		"SSH-2.0-OpenSSH":                     "data",
+	} {
+		if kind := describeResponse([]byte(response)); kind != expected {
+			t.Errorf("%q: expecting %v, got %v", response, expected, kind)
+		}
+	}
+}
+
+func TestRunProbe(t *testing.T) {
+	dialer := &net.Dialer{Timeout: time.Second}
+	http400 := listen(t, func(conn net.Conn) {
+		buf := make([]byte, 1024)
+		conn.Read(buf)
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	})
+	silent := listen(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	slow := listen(t, func(conn net.Conn) {
+		buf := make([]byte, 1024)
+		conn.Read(buf)
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	})
+	get := sendBytes("HTTP GET", []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+
+	run := func(addr string) []outcome {
+		var outcomes []outcome
+		for i := 0; i < 3; i++ {
+			o, err := runProbe(dialer, addr, get, 500*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outcomes = append(outcomes, o)
+		}
+		return outcomes
+	}
+	answered, unanswered, late := run(http400), run(silent), run(slow)
+	if kind := answered[0].kind(); kind != "HTTP 400, then EOF" {
+		t.Errorf("expecting HTTP 400 then EOF, got %v", kind)
+	}
+	if kind := unanswered[0].kind(); kind != "nothing, then timeout" {
+		t.Errorf("expecting a timeout, got %v", kind)
+	}
+
+	if v := compare("HTTP GET", answered, run(http400), 100*time.Millisecond); len(v.reasons) != 0 {
+		t.Errorf("expecting the same server to be indistinguishable, got %v", v.reasons)
+	}
+	if v := compare("HTTP GET", answered, unanswered, 100*time.Millisecond); len(v.reasons) == 0 {
+		t.Error("expecting a server that doesn't answer to be told apart")
+	}
+	if v := compare("HTTP GET", late, answered, 100*time.Millisecond); len(v.reasons) != 1 {
+		t.Errorf("expecting a server that answers late to be told apart by timing only, got %v", v.reasons)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// ck-client bench [-c config] [-proxy method] [-n streams] [-t seconds] [-handshakes n] [-discard] connects to the
+// server as ck-client would, and measures how long its handshakes take, then loads streams of one session to a proxy
+// method of "echo" or "discard" on the server for a while, reporting the throughput and the round trips on the way.
+// Running it with different EncryptionMethod and NumConn shows which does best on a given path
+
+// runBenchCommand runs ck-client bench with the arguments after "bench", writing the report to out
+func runBenchCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	config := flags.String("c", "ckclient.json", "config: path to the configuration file or options seperated with semicolons")
+	remoteHost := flags.String("s", "", "remoteHost: IP of your proxy server")
+	remotePort := flags.String("p", "443", "remotePort: proxy port, should be 443")
+	proxyMethod := flags.String("proxy", "", "proxy: the name of an echo or discard entry in server's ProxyBook")
+	streams := flags.Int("n", 4, "the number of streams loaded at once")
+	seconds := flags.Int("t", 10, "how long, in seconds, the streams are loaded")
+	handshakes := flags.Int("handshakes", 5, "the number of handshakes timed")
+	var overrides common.ConfigFlags
+	flags.Var(&overrides, "set", "set: a field of the configuration as Field=value, e.g. EncryptionMethod=aes-gcm. Can be given many times")
+	discard := flags.Bool("discard", false, "the proxy method is discard, so nothing is echoed back and round trips can't be timed")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v bench [-c config] [-proxy method] [-n streams] [-t seconds] [-handshakes n] [-discard] [-set Field=value]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *streams < 1 || *seconds < 1 {
+		return fmt.Errorf("there must be at least one stream loaded for at least a second")
+	}
+
+	rawConfig, err := client.ParseConfig(*config)
+	if err != nil {
+		return err
+	}
+	if err = rawConfig.Override(overrides); err != nil {
+		return err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "s":
+			rawConfig.RemoteHost = *remoteHost
+		case "p":
+			rawConfig.RemotePort = *remotePort
+		case "proxy":
+			rawConfig.ProxyMethod = *proxyMethod
+		}
+	})
+	if rawConfig.RemotePort == "" {
+		rawConfig.RemotePort = *remotePort
+	}
+	// nothing is listened on
+	if rawConfig.LocalHost == "" {
+		rawConfig.LocalHost = "127.0.0.1"
+	}
+	if rawConfig.LocalPort == "" {
+		rawConfig.LocalPort = "1984"
+	}
+	_, remoteConfig, authInfo, err := rawConfig.SplitConfigs(common.RealWorldState)
+	if err != nil {
+		return err
+	}
+	if authInfo.Unordered {
+		return fmt.Errorf("the proxy method must be over TCP")
+	}
+	// the streams share one session, rather than each having its own
+	if remoteConfig.NumConn < 1 {
+		remoteConfig.NumConn = 1
+	}
+
+	bound := client.MakeBoundDialer(&net.Dialer{Control: protector, KeepAlive: remoteConfig.KeepAlive},
+		remoteConfig.Binding)
+	d := client.MakeHappyEyeballs(bound, remoteConfig.PreferIPv4, remoteConfig.Resolver)
+
+	// an interrupt while connecting gives up, rather than leaving the bench to be killed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report := client.BenchReport{Streams: *streams, Duration: time.Duration(*seconds) * time.Second}
+	report.Handshakes, err = client.MeasureHandshakes(ctx, remoteConfig, authInfo, d, *handshakes)
+	if err != nil {
+		return err
+	}
+
+	sesh := client.MakeSession(ctx, remoteConfig, authInfo, d, false)
+	defer sesh.Close()
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	open := func() (net.Conn, error) {
+		stream, err := sesh.OpenStream()
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	}
+	report.Bytes, report.RTTs, err = client.MeasureThroughput(open, *streams, report.Duration, !*discard)
+	if err != nil {
+		return err
+	}
+
+	writeBenchReport(out, report, rawConfig.EncryptionMethod, remoteConfig.NumConn)
+	return nil
+}
+
+func writeBenchReport(out io.Writer, report client.BenchReport, encryptionMethod string, numConn int) {
+	fmt.Fprintf(out, "EncryptionMethod %v, NumConn %v, %v streams for %v\n", encryptionMethod, numConn, report.Streams, report.Duration)
+	if len(report.Handshakes) != 0 {
+		fmt.Fprintf(out, "Handshake: p50 %v, p90 %v, max %v (%v)\n",
+			client.Percentile(report.Handshakes, 50).Round(time.Microsecond),
+			client.Percentile(report.Handshakes, 90).Round(time.Microsecond),
+			client.Percentile(report.Handshakes, 100).Round(time.Microsecond),
+			len(report.Handshakes))
+	}
+	fmt.Fprintf(out, "Throughput: %.2f Mbit/s (%v bytes)\n", report.Throughput()/1e6, report.Bytes)
+	if len(report.RTTs) != 0 {
+		fmt.Fprintf(out, "RTT under load: p50 %v, p90 %v, p99 %v, max %v (%v)\n",
+			client.Percentile(report.RTTs, 50).Round(time.Microsecond),
+			client.Percentile(report.RTTs, 90).Round(time.Microsecond),
+			client.Percentile(report.RTTs, 99).Round(time.Microsecond),
+			client.Percentile(report.RTTs, 100).Round(time.Microsecond),
+			len(report.RTTs))
+	}
+}
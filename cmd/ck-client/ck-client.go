@@ -3,12 +3,17 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"flag"
 	"fmt"
+	"io"
 	"github.com/cbeuw/Cloak/internal/common"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/cbeuw/Cloak/internal/client"
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
@@ -18,6 +23,39 @@ import (
 var version string
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runServiceCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fingerprint" {
+		if err := runFingerprintCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBenchCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if runAsService(run) {
+		return
+	}
+	run()
+}
+
+// printConfigHelp writes the fields of the configuration, their environment variables and how they're written to w
+func printConfigHelp(w io.Writer) {
+	fmt.Fprintln(w, "Each field is read from the configuration file, then its environment variable, then -set Field=value,")
+	fmt.Fprintln(w, "then the flags for particular fields like -s. The configuration file is skipped if -c is empty.")
+	fmt.Fprintln(w)
+	common.WriteConfigHelp(w, &client.RawConfig{}, client.EnvPrefix)
+}
+
+func run() {
 	// Should be 127.0.0.1 to listen to a proxy client on this machine
 	var localHost string
 	// port used by proxy clients to communicate with cloak client
@@ -32,6 +70,9 @@ func main() {
 	var b64AdminUID string
 	var vpnMode bool
 	var tcpFastOpen bool
+	var ptMode bool
+	var validate bool
+	var overrides common.ConfigFlags
 
 	log_init()
 
@@ -49,9 +90,14 @@ func main() {
 		flag.StringVar(&remoteHost, "s", "", "remoteHost: IP of your proxy server")
 		flag.StringVar(&remotePort, "p", "443", "remotePort: proxy port, should be 443")
 		flag.BoolVar(&udp, "u", false, "udp: set this flag if the underlying proxy is using UDP protocol")
-		flag.StringVar(&config, "c", "ckclient.json", "config: path to the configuration file or options seperated with semicolons")
+		flag.StringVar(&config, "c", "ckclient.json", "config: path to the configuration file in JSON, YAML (.yaml or .yml) or TOML (.toml), or options seperated with semicolons")
+		flag.Var(&overrides, "set", "set: a field of the configuration as Field=value, over the configuration file and environment variables. Can be given many times")
+		helpConfig := flag.Bool("help-config", false, "Print the fields of the configuration and their environment variables")
+		flag.BoolVar(&validate, "validate", false, "validate: check the configuration, including its keys, then exit")
+		importSource := flag.String("import", "", "import: write a share of a server, as a cloak:// or ss:// link, a file or \"clipboard\", to the configuration file of -c, then exit")
 		flag.StringVar(&proxyMethod, "proxy", "", "proxy: the proxy method's name. It must match exactly with the corresponding entry in server's ProxyBook")
 		flag.StringVar(&b64AdminUID, "a", "", "adminUID: enter the adminUID to serve the admin api")
+		flag.BoolVar(&ptMode, "pt", false, "pt: run as a Tor pluggable transport. This is implied if launched by Tor")
 		askVersion := flag.Bool("v", false, "Print the version number")
 		printUsage := flag.Bool("h", false, "Print this message")
 
@@ -69,7 +115,22 @@ func main() {
 			return
 		}
 
-		log.Info("Starting standalone mode")
+		if *helpConfig {
+			printConfigHelp(os.Stdout)
+			return
+		}
+
+		if *importSource != "" {
+			if err := importShare(*importSource, config, os.Stdout); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+
+		ptMode = ptMode || os.Getenv("TOR_PT_MANAGED_TRANSPORT_VER") != ""
+		if !ptMode {
+			log.Info("Starting standalone mode")
+		}
 	}
 
 	lvl, err := log.ParseLevel(*verbosity)
@@ -78,10 +139,24 @@ func main() {
 	}
 	log.SetLevel(lvl)
 
+	if ptMode {
+		var configSet bool
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "c" {
+				configSet = true
+			}
+		})
+		startPT(config, configSet)
+		return
+	}
+
 	rawConfig, err := client.ParseConfig(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err = rawConfig.Override(overrides); err != nil {
+		log.Fatal(err)
+	}
 
 	if ssPluginMode {
 		rawConfig.ProxyMethod = "shadowsocks"
@@ -135,6 +210,10 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if validate {
+		fmt.Println("The configuration is valid")
+		return
+	}
 
 	var adminUID []byte
 	if b64AdminUID != "" {
@@ -146,7 +225,16 @@ func main() {
 
 	var seshMaker func() *mux.Session
 
-	d := &net.Dialer{Control: protector, KeepAlive: remoteConfig.KeepAlive}
+	// cancelled on exit, so that the sessions being made give up
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the addresses of RemoteHost are raced in IPv6 and IPv4
+	bound := client.MakeBoundDialer(&net.Dialer{Control: protector, KeepAlive: remoteConfig.KeepAlive},
+		remoteConfig.Binding)
+	d := client.MakeHappyEyeballs(bound, remoteConfig.PreferIPv4, remoteConfig.Resolver)
+	if remoteConfig.Endpoints != nil {
+		go remoteConfig.Endpoints.Watch(ctx, d)
+	}
 
 	if adminUID != nil {
 		log.Infof("API base is %v", localConfig.LocalAddr)
@@ -154,7 +242,7 @@ func main() {
 		remoteConfig.NumConn = 1
 
 		seshMaker = func() *mux.Session {
-			return client.MakeSession(remoteConfig, authInfo, d, true)
+			return client.MakeSession(ctx, remoteConfig, authInfo, d, true)
 		}
 	} else {
 		var network string
@@ -165,10 +253,41 @@ func main() {
 		}
 		log.Infof("Listening on %v %v for %v client", network, localConfig.LocalAddr, authInfo.ProxyMethod)
 		seshMaker = func() *mux.Session {
-			return client.MakeSession(remoteConfig, authInfo, d, false)
+			return client.MakeSession(ctx, remoteConfig, authInfo, d, false)
+		}
+		if remoteConfig.WarmSessions > 0 {
+			log.Infof("Keeping %v sessions ready ahead of demand", remoteConfig.WarmSessions)
+			seshMaker = client.NewSessionPool(remoteConfig.WarmSessions, seshMaker).Get
+		}
+	}
+
+	if remoteConfig.Quota != nil && adminUID == nil {
+		go func() {
+			log.Fatal(http.ListenAndServe(localConfig.QuotaAddr, client.QuotaHandler(remoteConfig.Quota)))
+		}()
+		log.Infof("Serving the quota on %v", localConfig.QuotaAddr)
+	}
+	if remoteConfig.Stats != nil && adminUID == nil {
+		statsListener, err := client.ListenStats(localConfig.StatsAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		go func() {
+			log.Fatal(http.Serve(statsListener, client.StatsHandler(remoteConfig.Stats)))
+		}()
+		log.Infof("Serving the stats on %v", localConfig.StatsAddr)
 	}
 
+	// the keys of the sessions are wiped before exiting
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		cancel()
+		common.WipeSecrets()
+		os.Exit(0)
+	}()
+
 	useSessionPerConnection := remoteConfig.NumConn == 0
 
 	if authInfo.Unordered {
@@ -177,12 +296,46 @@ func main() {
 			return net.ListenUDP("udp", udpAddr)
 		}
 
-		client.RouteUDP(acceptor, localConfig.Timeout, seshMaker, useSessionPerConnection)
+		client.RouteUDP(acceptor, localConfig.UDPTimeout, seshMaker, useSessionPerConnection)
+	} else if localConfig.LocalProxy == "tun" && adminUID == nil {
+		dev, err := client.OpenTUN(localConfig.TUNName, localConfig.TUNNet, localConfig.TUNMTU)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("Routing what goes to %v through %v", localConfig.TUNName, authInfo.ProxyMethod)
+		log.Fatal(client.ServeTUN(dev, localConfig.TUNNet, localConfig.Timeout, localConfig.UDPTimeout, seshMaker, useSessionPerConnection))
 	} else {
-		listener, err := net.Listen("tcp", localConfig.LocalAddr)
+		var listener net.Listener
+		if localConfig.LocalProxy == "tproxy" && adminUID == nil {
+			listener, err = client.ListenTransparent(localConfig.LocalAddr)
+		} else {
+			listener, err = net.Listen("tcp", localConfig.LocalAddr)
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
+		if (ssPluginMode || localConfig.UDPRelay) && localConfig.LocalProxy == "" && adminUID == nil {
+			// Shadowsocks sends its UDP relay to the plugin on the same port
+			acceptor := func() (*net.UDPConn, error) {
+				udpAddr, _ := net.ResolveUDPAddr("udp", localConfig.LocalAddr)
+				return net.ListenUDP("udp", udpAddr)
+			}
+			log.Infof("Listening on UDP %v for the UDP relay of %v client", localConfig.LocalAddr, authInfo.ProxyMethod)
+			go client.RouteUDPOverTCP(acceptor, localConfig.UDPTimeout, seshMaker, useSessionPerConnection)
+		}
+		if adminUID == nil {
+			switch localConfig.LocalProxy {
+			case "socks5":
+				log.Infof("Serving SOCKS5 on %v", localConfig.LocalAddr)
+				log.Fatal(client.ServeSOCKS5(listener, localConfig.Timeout, seshMaker, useSessionPerConnection))
+			case "http":
+				log.Infof("Serving HTTP proxy on %v", localConfig.LocalAddr)
+				log.Fatal(client.ServeHTTPProxy(listener, localConfig.Timeout, seshMaker, useSessionPerConnection))
+			case "redirect", "tproxy":
+				log.Infof("Serving %v connections on %v", localConfig.LocalProxy, localConfig.LocalAddr)
+				log.Fatal(client.ServeTransparent(listener, localConfig.LocalProxy == "tproxy", localConfig.Timeout, seshMaker, useSessionPerConnection))
+			}
+		}
 		client.RouteTCP(listener, localConfig.Timeout, seshMaker, useSessionPerConnection)
 	}
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// ck-client fingerprint [-c config] makes the ClientHello that ck-client would connect with, sending it to a listener
+// on the loopback rather than the server, and checks that its JA3 matches that of the browser it's meant to look like
+
+var errDetectableFingerprint = errors.New("the ClientHello can be told apart from the browser's")
+
+// runFingerprintCommand runs ck-client fingerprint with the arguments after "fingerprint", writing the fingerprints
+// to out
+func runFingerprintCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("fingerprint", flag.ContinueOnError)
+	config := flags.String("c", "ckclient.json", "config: path to the configuration file or options seperated with semicolons")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %v fingerprint [-c config]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	rawConfig, err := client.ParseConfig(*config)
+	if err != nil {
+		return err
+	}
+	// nothing is connected to, so the addresses only need to be valid
+	if rawConfig.RemoteHost == "" {
+		rawConfig.RemoteHost = "127.0.0.1"
+	}
+	if rawConfig.RemotePort == "" {
+		rawConfig.RemotePort = "443"
+	}
+	if rawConfig.LocalHost == "" {
+		rawConfig.LocalHost = "127.0.0.1"
+	}
+	if rawConfig.LocalPort == "" {
+		rawConfig.LocalPort = "1984"
+	}
+	_, remoteConfig, authInfo, err := rawConfig.SplitConfigs(common.RealWorldState)
+	if err != nil {
+		return err
+	}
+
+	report, err := client.CheckFingerprint(*rawConfig, remoteConfig, authInfo)
+	if err != nil {
+		return err
+	}
+	for _, note := range report.Notes {
+		log.Warn(note)
+	}
+	fmt.Fprintf(out, "JA3:  %v %v\n", report.Got.JA3Hash(), report.Got.JA3())
+	fmt.Fprintf(out, "JA3N: %v %v\n", report.Got.JA3NHash(), report.Got.JA3N())
+	fmt.Fprintf(out, "JA3N of %v: %v %v\n", report.Browser, report.Want.JA3NHash(), report.Want.JA3N())
+	if len(report.Warnings) != 0 {
+		for _, warning := range report.Warnings {
+			log.Warn(warning)
+		}
+		return errDetectableFingerprint
+	}
+	fmt.Fprintf(out, "The ClientHello looks like %v's\n", report.Browser)
+	return nil
+}
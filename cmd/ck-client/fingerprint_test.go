@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunFingerprintCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ck_fingerprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "ckclient.json")
+	err = ioutil.WriteFile(config, []byte(`{
+		"ServerName": "www.bing.com",
+		"ProxyMethod": "shadowsocks",
+		"EncryptionMethod": "plain",
+		"UID": "5nneblJy6lniPJfr81LuYQ==",
+		"PublicKey": "IYoUzkle/T/kriE+Ufdm7AHQtIeGnBWbhhlTbmDpUUI=",
+		"NumConn": 1,
+		"BrowserSig": "firefox"
+	}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := runFingerprintCommand([]string{"-c", config}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "JA3N of firefox") || !strings.Contains(out.String(), "looks like firefox's") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if err := runFingerprintCommand([]string{"-c", filepath.Join(dir, "missing.json")}, &out); err == nil {
+		t.Error("expecting an error for a config that doesn't exist")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// ck-client -import <uri|file|clipboard> [-c config] reads a share of a server, such as a cloak:// link or an ss://
+// link with Cloak as its plugin, and writes it to config as a configuration file of ck-client. It's for GUIs to set up
+// a server with one tap
+
+// readShare reads the share in source, which is "clipboard" for the clipboard, "-" for stdin, a path to a file, or
+// the share itself
+func readShare(source string) (string, error) {
+	switch source {
+	case "clipboard":
+		return readClipboard()
+	case "-":
+		content, err := ioutil.ReadAll(os.Stdin)
+		return string(content), err
+	}
+	if strings.Contains(source, "://") || strings.HasPrefix(strings.TrimSpace(source), "{") {
+		return source, nil
+	}
+	content, err := ioutil.ReadFile(source)
+	return string(content), err
+}
+
+// clipboardCommands are the commands that print the clipboard, tried in turn
+var clipboardCommands = map[string][][]string{
+	"darwin":  {{"pbpaste"}},
+	"windows": {{"powershell", "-NoProfile", "-Command", "Get-Clipboard"}},
+	"linux":   {{"wl-paste", "--no-newline"}, {"xclip", "-out", "-selection", "clipboard"}, {"xsel", "--output", "--clipboard"}},
+}
+
+func readClipboard() (string, error) {
+	commands, ok := clipboardCommands[runtime.GOOS]
+	if !ok {
+		commands = clipboardCommands["linux"]
+	}
+	for _, command := range commands {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(command[0], command[1:]...).Output()
+		if err != nil {
+			return "", fmt.Errorf("failed to read the clipboard with %v: %v", command[0], err)
+		}
+		return string(out), nil
+	}
+	return "", errors.New("no program to read the clipboard with is found")
+}
+
+// importShare writes the share in source to the configuration file at path, which mustn't exist yet. It's
+// written in JSON, which is also YAML
+func importShare(source string, path string, out io.Writer) error {
+	share, err := readShare(source)
+	if err != nil {
+		return err
+	}
+	raw, name, err := client.ImportShare(share)
+	if err != nil {
+		return err
+	}
+	content, err := client.MarshalConfig(raw)
+	if err != nil {
+		return err
+	}
+	if common.ConfigFormat(path) == "toml" {
+		return errors.New("the configuration is written in JSON, which can't be a .toml file")
+	}
+
+	// it's only checked, so the addresses that can be left to the commandline only need to be valid
+	check := *raw
+	if check.LocalHost == "" {
+		check.LocalHost = "127.0.0.1"
+	}
+	if check.LocalPort == "" {
+		check.LocalPort = "1984"
+	}
+	if _, _, _, err = check.SplitConfigs(common.RealWorldState); err != nil {
+		log.Warnf("The imported configuration is incomplete: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%v already exists", path)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(content, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if name == "" {
+		name = raw.RemoteHost
+	}
+	fmt.Fprintf(out, "Imported %v into %v\n", name, path)
+	return nil
+}
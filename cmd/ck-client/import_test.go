@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/client"
+)
+
+func TestImportShare(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ck-client-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ckclient.json")
+
+	var out bytes.Buffer
+	if err = importShare("cloak://192.0.2.1:8443?ServerName=www.bing.com#home", path, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "home") {
+		t.Errorf("expecting the name of the server to be printed, got %v", out.String())
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expecting the configuration to be 0600, got %v", info.Mode().Perm())
+	}
+	raw, err := client.ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.RemoteHost != "192.0.2.1" || raw.RemotePort != "8443" || raw.ServerName != "www.bing.com" {
+		t.Errorf("the configuration isn't what was imported: %+v", raw)
+	}
+
+	if err = importShare("cloak://192.0.2.2", path, &out); err == nil {
+		t.Error("an existing configuration shouldn't be overwritten")
+	}
+
+	sharePath := filepath.Join(dir, "share.txt")
+	if err = ioutil.WriteFile(sharePath, []byte("cloak://192.0.2.3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fromFile := filepath.Join(dir, "fromfile.yaml")
+	if err = importShare(sharePath, fromFile, &out); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = client.ParseConfig(fromFile); err != nil || raw.RemoteHost != "192.0.2.3" {
+		t.Errorf("the share in a file isn't imported: %v %+v", err, raw)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// startPT runs ck-client as a managed client transport of Tor. Tor reads our stdout, so logs must go to stderr.
+// The bridge lines' arguments are applied on the config file, if there is one
+func startPT(config string, withConfig bool) {
+	env, err := client.ParsePTClientEnv(os.Getenv, os.Stdout)
+	if err == client.ErrPTNotLaunched {
+		log.Fatal("-pt is set but ck-client isn't launched by Tor")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var base client.RawConfig
+	if withConfig {
+		raw, err := client.ParseConfig(config)
+		if err != nil {
+			client.PTMethodError(os.Stdout, err)
+			log.Fatal(err)
+		}
+		base = *raw
+	}
+	binding, err := base.SocketBinding()
+	if err != nil {
+		client.PTMethodError(os.Stdout, err)
+		log.Fatal(err)
+	}
+	var resolver *client.Resolver
+	if base.ResolverURL != "" {
+		resolver, err = client.MakeResolver(base.ResolverURL, common.RealWorldState)
+		if err != nil {
+			client.PTMethodError(os.Stdout, err)
+			log.Fatal(err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		client.PTMethodError(os.Stdout, err)
+		log.Fatal(err)
+	}
+	client.PTMethodReady(os.Stdout, listener.Addr())
+	log.Infof("Serving Tor on %v", listener.Addr())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if env.ExitOnStdinClose {
+		go func() {
+			io.Copy(ioutil.Discard, os.Stdin)
+			log.Info("Tor has closed stdin, exiting")
+			cancel()
+		}()
+	}
+
+	bound := client.MakeBoundDialer(&net.Dialer{Control: protector}, binding)
+	dialer := client.MakeHappyEyeballs(bound, base.PreferIPv4, resolver)
+	if err = client.ServePT(ctx, listener, base, dialer, common.RealWorldState); ctx.Err() == nil {
+		log.Fatal(err)
+	}
+}
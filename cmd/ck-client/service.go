@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ck-client service install [ck-client options] registers ck-client to be run with those options by the OS's service
+// manager, as a Windows service or a launchd daemon on macOS, which restarts it if it crashes. The service is then
+// controlled with ck-client service start, stop and uninstall
+
+const serviceName = "ck-client"
+const serviceDescription = "Cloak client"
+
+var errNoServiceManager = errors.New("ck-client service is only supported on Windows and macOS")
+
+func serviceUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %v service install [ck-client options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %v service uninstall|start|stop\n", os.Args[0])
+}
+
+// runServiceCommand runs ck-client service with the arguments after "service"
+func runServiceCommand(args []string) error {
+	if len(args) == 0 {
+		serviceUsage()
+		return errors.New("no service command given")
+	}
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		options, err := serviceArgs(args[1:])
+		if err != nil {
+			return err
+		}
+		return installService(exe, options)
+	case "uninstall":
+		return uninstallService()
+	case "start":
+		return startService()
+	case "stop":
+		return stopService()
+	default:
+		serviceUsage()
+		return fmt.Errorf("unknown service command %v", args[0])
+	}
+}
+
+// serviceArgs returns the options to run the service with. The service isn't started in the current directory, so
+// the path of the config file is made absolute
+func serviceArgs(args []string) ([]string, error) {
+	options := append([]string(nil), args...)
+	absolute := func(config string) (string, error) {
+		// options separated with semicolons aren't a path
+		if strings.Contains(config, ";") && strings.Contains(config, "=") {
+			return config, nil
+		}
+		return filepath.Abs(config)
+	}
+	configSet := false
+	for i := 0; i < len(options); i++ {
+		var err error
+		switch {
+		case options[i] == "-c" || options[i] == "--c":
+			if i+1 == len(options) {
+				return nil, errors.New("-c needs a value")
+			}
+			i++
+			options[i], err = absolute(options[i])
+			configSet = true
+		case strings.HasPrefix(options[i], "-c=") || strings.HasPrefix(options[i], "--c="):
+			flagName := options[i][:strings.Index(options[i], "=")+1]
+			var config string
+			config, err = absolute(strings.TrimPrefix(options[i], flagName))
+			options[i] = flagName + config
+			configSet = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !configSet {
+		// the default of -c is relative too
+		config, err := filepath.Abs("ckclient.json")
+		if err != nil {
+			return nil, err
+		}
+		options = append([]string{"-c", config}, options...)
+	}
+	return options, nil
+}
+
+const launchdLabel = "com.github.cbeuw.ck-client"
+
+// launchdPlist returns the launchd property list of a daemon that runs ck-client with options, and is restarted
+// if it exits other than successfully
+func launchdPlist(exe string, options []string, logPath string) []byte {
+	var b bytes.Buffer
+	escaped := func(s string) string {
+		var e bytes.Buffer
+		_ = xml.EscapeText(&e, []byte(s))
+		return e.String()
+	}
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + launchdLabel + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+	for _, arg := range append([]string{exe}, options...) {
+		b.WriteString("\t\t<string>" + escaped(arg) + "</string>\n")
+	}
+	b.WriteString(`	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>` + escaped(logPath) + `</string>
+	<key>StandardErrorPath</key>
+	<string>` + escaped(logPath) + `</string>
+</dict>
+</plist>
+`)
+	return b.Bytes()
+}
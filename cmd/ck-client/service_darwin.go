@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// the daemon is a system one, so installing and controlling it needs root
+const launchdPlistPath = "/Library/LaunchDaemons/" + launchdLabel + ".plist"
+const launchdLogPath = "/Library/Logs/ck-client.log"
+
+func launchctl(args ...string) error {
+	out, err := exec.Command("launchctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl %v: %v: %s", args[0], err, out)
+	}
+	return nil
+}
+
+func installService(exe string, options []string) error {
+	if _, err := os.Stat(launchdPlistPath); err == nil {
+		return fmt.Errorf("%v already exists, uninstall the service first", launchdPlistPath)
+	}
+	if err := ioutil.WriteFile(launchdPlistPath, launchdPlist(exe, options, launchdLogPath), 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Installed %v, logging to %v\n", launchdPlistPath, launchdLogPath)
+	return nil
+}
+
+func uninstallService() error {
+	// it may not be loaded
+	_ = launchctl("unload", "-w", launchdPlistPath)
+	return os.Remove(launchdPlistPath)
+}
+
+func startService() error {
+	return launchctl("load", "-w", launchdPlistPath)
+}
+
+// stopService unloads the daemon, since launchd would otherwise start it again
+func stopService() error {
+	return launchctl("unload", "-w", launchdPlistPath)
+}
+
+// runAsService is for Windows, where the service manager starts the service differently
+func runAsService(func()) bool {
+	return false
+}
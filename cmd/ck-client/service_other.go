@@ -0,0 +1,13 @@
+//go:build !windows && !darwin
+// +build !windows,!darwin
+
+package main
+
+func installService(string, []string) error { return errNoServiceManager }
+func uninstallService() error               { return errNoServiceManager }
+func startService() error                   { return errNoServiceManager }
+func stopService() error                    { return errNoServiceManager }
+
+func runAsService(func()) bool {
+	return false
+}
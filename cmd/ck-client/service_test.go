@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/xml"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestServiceArgs(t *testing.T) {
+	abs, _ := filepath.Abs("ckclient.json")
+	for _, c := range []struct {
+		args     []string
+		expected []string
+	}{
+		{nil, []string{"-c", abs}},
+		{[]string{"-s", "1.2.3.4"}, []string{"-c", abs, "-s", "1.2.3.4"}},
+		{[]string{"-c", "ckclient.json", "-s", "1.2.3.4"}, []string{"-c", abs, "-s", "1.2.3.4"}},
+		{[]string{"-c=ckclient.json"}, []string{"-c=" + abs}},
+		{[]string{"--c", abs}, []string{"--c", abs}},
+		{[]string{"-c", "UID=abc;ServerName=www.bing.com"}, []string{"-c", "UID=abc;ServerName=www.bing.com"}},
+	} {
+		options, err := serviceArgs(c.args)
+		if err != nil {
+			t.Errorf("%v: %v", c.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(options, c.expected) {
+			t.Errorf("%v: expecting %v, got %v", c.args, c.expected, options)
+		}
+	}
+
+	if _, err := serviceArgs([]string{"-s", "1.2.3.4", "-c"}); err == nil {
+		t.Error("expecting an error for -c without a value")
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	plist := launchdPlist("/usr/local/bin/ck-client", []string{"-c", "/etc/ck&client.json"}, "/Library/Logs/ck-client.log")
+	var parsed struct {
+		Keys    []string `xml:"dict>key"`
+		Strings []string `xml:"dict>string"`
+		Args    []string `xml:"dict>array>string"`
+	}
+	if err := xml.Unmarshal(plist, &parsed); err != nil {
+		t.Fatalf("plist isn't valid XML: %v\n%s", err, plist)
+	}
+	expectedArgs := []string{"/usr/local/bin/ck-client", "-c", "/etc/ck&client.json"}
+	if !reflect.DeepEqual(parsed.Args, expectedArgs) {
+		t.Errorf("expecting ProgramArguments %v, got %v", expectedArgs, parsed.Args)
+	}
+	if parsed.Strings[0] != launchdLabel {
+		t.Errorf("expecting the label %v, got %v", launchdLabel, parsed.Strings[0])
+	}
+	if !strings.Contains(string(plist), "<key>SuccessfulExit</key>\n\t\t<false/>") {
+		t.Error("daemon isn't restarted on crashing")
+	}
+}
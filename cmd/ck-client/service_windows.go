@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// how long the service waits before being restarted after crashing, and after how long without crashes the
+// count of crashes is reset
+const serviceRestartDelay = 5 * time.Second
+const serviceResetPeriod = 24 * time.Hour
+
+const serviceStopTimeout = 10 * time.Second
+
+func installService(exe string, options []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %v already exists, uninstall it first", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: serviceDescription,
+		Description: "Cloak client, run as " + exe,
+		StartType:   mgr.StartAutomatic,
+	}, options...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: serviceRestartDelay}
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, uint32(serviceResetPeriod.Seconds()))
+	if err == nil {
+		err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	}
+	if err != nil {
+		s.Delete()
+		return err
+	}
+	fmt.Printf("Installed service %v, logging to the Application event log\n", serviceName)
+	return nil
+}
+
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %v isn't installed: %v", serviceName, err)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(serviceName)
+}
+
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %v isn't installed: %v", serviceName, err)
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %v isn't installed: %v", serviceName, err)
+	}
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %v didn't stop in %v", serviceName, serviceStopTimeout)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eventLogHook sends the logs to the event log, since a service has nowhere else to write them
+type eventLogHook struct {
+	elog *eventlog.Log
+}
+
+func (hook eventLogHook) Levels() []log.Level { return log.AllLevels }
+
+func (hook eventLogHook) Fire(entry *log.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel, log.ErrorLevel:
+		return hook.elog.Error(1, msg)
+	case log.WarnLevel:
+		return hook.elog.Warning(1, msg)
+	default:
+		return hook.elog.Info(1, msg)
+	}
+}
+
+type serviceHandler struct {
+	run func()
+}
+
+// Execute runs ck-client until the service is stopped. If ck-client exits on an error, the service manager
+// restarts it
+func (h serviceHandler) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	go h.run()
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			changes <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			log.Info("Stopping the service")
+			changes <- svc.Status{State: svc.StopPending}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// runAsService runs ck-client as a service if it's been started by the service manager, and returns whether it has
+func runAsService(run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err == nil {
+		defer elog.Close()
+		log.AddHook(eventLogHook{elog})
+		log.SetOutput(ioutil.Discard)
+	}
+	if err = svc.Run(serviceName, serviceHandler{run}); err != nil {
+		log.Fatalf("Failed to run as a service: %v", err)
+	}
+	return true
+}
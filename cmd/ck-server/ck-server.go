@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/server"
 	log "github.com/sirupsen/logrus"
@@ -10,8 +11,10 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 )
 
 var version string
@@ -28,8 +31,116 @@ func parseBindAddr(bindAddrs []string) ([]net.Addr, error) {
 	return addrs, nil
 }
 
+// bindNetwork is the network to listen on addr in. A port alone, or a host name, is listened on in both IPv4 and IPv6,
+// while an IP address is listened on in its own version only, so that "0.0.0.0:443" and "[::]:443" can be listened on
+// side by side
+func bindNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// completeBindAddr sets BindAddr to the standard ports if it's empty, and adds the address Shadowsocks wants us to
+// listen on in plugin mode
+func completeBindAddr(raw *server.RawConfig, pluginMode bool, getenv func(string) string) error {
+	bindAddr, err := parseBindAddr(raw.BindAddr)
+	if err != nil {
+		return fmt.Errorf("unable to parse BindAddr: %v", err)
+	}
+	if !pluginMode {
+		if len(bindAddr) == 0 {
+			raw.BindAddr = []string{":443", ":80"}
+		}
+		return nil
+	}
+
+	ssRemoteHost := getenv("SS_REMOTE_HOST")
+	ssRemotePort := getenv("SS_REMOTE_PORT")
+	var ssBind string
+	// When listening on an IPv6 and IPv4, SS gives REMOTE_HOST as e.g. ::|0.0.0.0
+	v4nv6 := len(strings.Split(ssRemoteHost, "|")) == 2
+	if v4nv6 {
+		ssBind = ":" + ssRemotePort
+	} else {
+		ssBind = net.JoinHostPort(ssRemoteHost, ssRemotePort)
+	}
+	ssBindAddr, err := net.ResolveTCPAddr("tcp", ssBind)
+	if err != nil {
+		return fmt.Errorf("unable to resolve bind address provided by SS: %v", err)
+	}
+
+	shouldAppend := true
+	for i, addr := range bindAddr {
+		if addr.String() == ssBindAddr.String() {
+			shouldAppend = false
+		}
+		if addr.String() == ":"+ssRemotePort { // already listening on all interfaces
+			shouldAppend = false
+		}
+		if addr.String() == "0.0.0.0:"+ssRemotePort || addr.String() == "[::]:"+ssRemotePort {
+			// if config listens on one ip version but ss wants to listen on both,
+			// listen on both
+			if ssBindAddr.String() == ":"+ssRemotePort {
+				shouldAppend = true
+				if transports, ok := raw.BindTransports[raw.BindAddr[i]]; ok {
+					raw.BindTransports[ssBindAddr.String()] = transports
+				}
+				if knock, ok := raw.BindKnocks[raw.BindAddr[i]]; ok {
+					raw.BindKnocks[ssBindAddr.String()] = knock
+				}
+				raw.BindAddr[i] = ssBindAddr.String()
+			}
+		}
+	}
+	if shouldAppend {
+		raw.BindAddr = append(raw.BindAddr, ssBindAddr.String())
+	}
+	return nil
+}
+
+// printConfigHelp writes the fields of the configuration, their environment variables and how they're written to w
+func printConfigHelp(w io.Writer) {
+	fmt.Fprintln(w, "Each field is read from the configuration file, then its environment variable, then -set Field=value.")
+	fmt.Fprintln(w, "The configuration file is skipped if -c is empty.")
+	fmt.Fprintln(w)
+	common.WriteConfigHelp(w, &server.RawConfig{}, server.EnvPrefix)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeysCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := runUserCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "drain" {
+		if err := runDrainCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var config string
+	var migrateDB string
+	var validate bool
+	var noSandbox bool
+	var overrides common.ConfigFlags
 
 	var pluginMode bool
 
@@ -37,12 +148,17 @@ func main() {
 		pluginMode = true
 		config = os.Getenv("SS_PLUGIN_OPTIONS")
 	} else {
-		flag.StringVar(&config, "c", "server.json", "config: path to the configuration file or its content")
+		flag.StringVar(&config, "c", "server.json", "config: path to the configuration file in JSON, YAML (.yaml or .yml) or TOML (.toml), or its content in JSON")
+		flag.Var(&overrides, "set", "Set a field of the configuration as Field=value, over the configuration file and environment variables. Can be given many times")
+		helpConfig := flag.Bool("help-config", false, "Print the fields of the configuration and their environment variables")
+		flag.BoolVar(&validate, "validate", false, "Check the configuration, including its keys and ProxyBook, then exit")
+		flag.BoolVar(&noSandbox, "no-sandbox", false, "Don't restrict the files ck-server can open and the syscalls it can make once it has started")
 		askVersion := flag.Bool("v", false, "Print the version number")
 		printUsage := flag.Bool("h", false, "Print this message")
 
 		genUID := flag.Bool("u", false, "Generate a UID")
-		genKeyPair := flag.Bool("k", false, "Generate a pair of public and private key, output in the format of pubkey,pvkey")
+		genKeyPair := flag.Bool("k", false, "Generate a pair of public and private key, output in the format of pubkey,pvkey. See also ck-server keys")
+		flag.StringVar(&migrateDB, "migrate-db", "", "Copy the users of the userinfo.db at DatabasePath into the MySQL, PostgreSQL or SQLite database at this DatabaseURL, then exit")
 
 		pprofAddr := flag.String("d", "", "debug use: ip:port to be listened by pprof profiler")
 		verbosity := flag.String("verbosity", "info", "verbosity level")
@@ -57,6 +173,10 @@ func main() {
 			flag.Usage()
 			return
 		}
+		if *helpConfig {
+			printConfigHelp(os.Stdout)
+			return
+		}
 		if *genUID {
 			fmt.Println(generateUID())
 			return
@@ -85,62 +205,64 @@ func main() {
 		log.Infof("Starting standalone mode")
 	}
 
-	raw, err := server.ParseConfig(config)
+	// loadConfig is also called when the configuration is reloaded
+	loadConfig := func() (server.RawConfig, error) {
+		raw, err := server.ParseConfig(config)
+		if err != nil {
+			return raw, err
+		}
+		if err = raw.Override(overrides); err != nil {
+			return raw, err
+		}
+		// when cloak is started as a shadowsocks plugin
+		if pluginMode {
+			ssLocalHost := os.Getenv("SS_LOCAL_HOST")
+			ssLocalPort := os.Getenv("SS_LOCAL_PORT")
+			raw.ProxyBook["shadowsocks"] = []string{"tcp", net.JoinHostPort(ssLocalHost, ssLocalPort)}
+		}
+		err = completeBindAddr(&raw, pluginMode, os.Getenv)
+		return raw, err
+	}
+
+	raw, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Configuration file error: %v", err)
 	}
 
-	bindAddr, err := parseBindAddr(raw.BindAddr)
-	if err != nil {
-		err = fmt.Errorf("unable to parse BindAddr: %v", err)
+	if validate {
+		if err = server.ValidateConfig(raw); err != nil {
+			log.Fatalf("Configuration error: %v", err)
+		}
+		fmt.Println("The configuration is valid")
 		return
 	}
-	if !pluginMode && len(bindAddr) == 0 {
-		https, _ := net.ResolveTCPAddr("tcp", ":443")
-		http, _ := net.ResolveTCPAddr("tcp", ":80")
-		bindAddr = []net.Addr{https, http}
-	}
-
-	// when cloak is started as a shadowsocks plugin
-	if pluginMode {
-		ssLocalHost := os.Getenv("SS_LOCAL_HOST")
-		ssLocalPort := os.Getenv("SS_LOCAL_PORT")
-		raw.ProxyBook["shadowsocks"] = []string{"tcp", net.JoinHostPort(ssLocalHost, ssLocalPort)}
-
-		ssRemoteHost := os.Getenv("SS_REMOTE_HOST")
-		ssRemotePort := os.Getenv("SS_REMOTE_PORT")
-		var ssBind string
-		// When listening on an IPv6 and IPv4, SS gives REMOTE_HOST as e.g. ::|0.0.0.0
-		v4nv6 := len(strings.Split(ssRemoteHost, "|")) == 2
-		if v4nv6 {
-			ssBind = ":" + ssRemotePort
-		} else {
-			ssBind = net.JoinHostPort(ssRemoteHost, ssRemotePort)
-		}
-		ssBindAddr, err := net.ResolveTCPAddr("tcp", ssBind)
-		if err != nil {
-			log.Fatalf("unable to resolve bind address provided by SS: %v", err)
+
+	if migrateDB != "" {
+		if err = migrateDatabase(raw.DatabasePath, migrateDB); err != nil {
+			log.Fatalf("Failed to migrate the user database: %v", err)
 		}
+		return
+	}
 
-		shouldAppend := true
-		for i, addr := range bindAddr {
-			if addr.String() == ssBindAddr.String() {
-				shouldAppend = false
-			}
-			if addr.String() == ":"+ssRemotePort { // already listening on all interfaces
-				shouldAppend = false
-			}
-			if addr.String() == "0.0.0.0:"+ssRemotePort || addr.String() == "[::]:"+ssRemotePort {
-				// if config listens on one ip version but ss wants to listen on both,
-				// listen on both
-				if ssBindAddr.String() == ":"+ssRemotePort {
-					shouldAppend = true
-					bindAddr[i] = ssBindAddr
-				}
-			}
+	notifier, err := makeSDNotifier(os.Getenv, os.Getpid())
+	if err != nil {
+		log.Fatal(err)
+	}
+	activated, activatedNames, err := systemdListeners(os.Getenv, os.Getpid())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var chroot string
+	if raw.Chroot {
+		if chroot, err = enterStateDir(&raw); err != nil {
+			log.Fatal(err)
 		}
-		if shouldAppend {
-			bindAddr = append(bindAddr, ssBindAddr)
+	}
+
+	if raw.StateDir != "" {
+		if err = lockStateDir(raw.StateDir); err != nil {
+			log.Fatal(err)
 		}
 	}
 
@@ -148,22 +270,113 @@ func main() {
 	if err != nil {
 		log.Fatalf("unable to initialise server state: %v", err)
 	}
+	sta.ConfigSource = loadConfig
+
+	// everything is listened on before privileges are dropped
+	if sta.AdminAPIAddr != "" {
+		adminListener, err := server.ListenAdminAPI(sta)
+		if err != nil {
+			log.Fatalf("unable to listen for the admin API: %v", err)
+		}
+		go func() {
+			log.Fatal(http.Serve(adminListener, server.AdminAPIHandler(sta)))
+		}()
+		log.Infof("Admin API listening on %v", sta.AdminAPIAddr)
+	}
 
-	listen := func(bindAddr net.Addr) {
-		listener, err := net.Listen("tcp", bindAddr.String())
-		log.Infof("Listening on %v", bindAddr)
+	if raw.MetricsAddr != "" {
+		metricsListener, err := net.Listen("tcp", raw.MetricsAddr)
 		if err != nil {
+			log.Fatalf("unable to listen for metrics: %v", err)
+		}
+		go func() {
+			log.Fatal(http.Serve(metricsListener, server.MetricsHandler(sta)))
+		}()
+		log.Infof("Metrics listening on %v", raw.MetricsAddr)
+	}
+
+	if raw.KnockAddr != "" {
+		knockConn, err := net.ListenPacket("udp", raw.KnockAddr)
+		if err != nil {
+			log.Fatalf("unable to listen for knocks: %v", err)
+		}
+		go sta.ServeKnocks(knockConn)
+		log.Infof("Receiving knocks on %v", raw.KnockAddr)
+	}
+
+	if raw.DNSAddr != "" {
+		dnsConn, err := net.ListenPacket("udp", raw.DNSAddr)
+		if err != nil {
+			log.Fatalf("unable to listen for DNS queries: %v", err)
+		}
+		go sta.ServeDNS(dnsConn)
+		log.Infof("Serving %v as its name server on %v", sta.DNSDomain, raw.DNSAddr)
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			log.Info("Reloading configuration")
+			notifier.send("RELOADING=1")
+			err := sta.ReloadConfig()
+			notifier.send("READY=1")
+			if err != nil {
+				log.Errorf("Failed to reload configuration, keeping the current one: %v", err)
+				continue
+			}
+			log.Info("Configuration reloaded")
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// the sockets from systemd are listened on instead of BindAddr
+	if len(activated) != 0 {
+		for i, listener := range activated {
+			log.Infof("Listening on %v from systemd socket %v", listener.Addr(), activatedNames[i])
+			go server.Serve(listener, sta)
+		}
+	} else {
+		sta.Listeners = server.MakeListenerSupervisor(sta, func(addr string) (net.Listener, error) {
+			return net.Listen(bindNetwork(addr), addr)
+		})
+		if err = sta.Listeners.Update(raw); err != nil {
 			log.Fatal(err)
 		}
-		server.Serve(listener, sta)
 	}
 
-	for i, addr := range bindAddr {
-		if i != len(bindAddr)-1 {
-			go listen(addr)
-		} else {
-			listen(addr)
+	if raw.RunAs != "" {
+		if err = dropPrivileges(raw.RunAs, chroot); err != nil {
+			log.Fatalf("unable to drop privileges: %v", err)
 		}
+		log.Infof("Running as %v", raw.RunAs)
 	}
+	if !noSandbox {
+		sandbox(sandboxPathsOf(raw, config))
+	}
+
+	notifier.send("READY=1")
+	go notifier.watchdog()
 
+	select {
+	case <-stop:
+		notifier.send("STOPPING=1")
+		if sta.DrainTimeout > 0 {
+			// a second signal stops right away
+			select {
+			case <-sta.Drain(sta.DrainTimeout, sta.DrainNotify):
+			case <-stop:
+			}
+		}
+	case <-sta.Drained():
+		// drained through the admin API
+		notifier.send("STOPPING=1")
+	}
+	// so that handshakes seen in the last few minutes can't be replayed after restarting
+	if err := sta.SaveReplayCache(); err != nil {
+		log.Errorf("Failed to save replay cache: %v", err)
+	}
+	common.WipeSecrets()
 }
@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/server"
+)
 
 func TestParseBindAddr(t *testing.T) {
 	t.Run("port only", func(t *testing.T) {
@@ -50,3 +56,86 @@ func TestParseBindAddr(t *testing.T) {
 		}
 	})
 }
+
+func TestBindNetwork(t *testing.T) {
+	networks := map[string]string{
+		":443":              "tcp",
+		"localhost:443":     "tcp",
+		"0.0.0.0:443":       "tcp4",
+		"192.168.1.123:443": "tcp4",
+		"[::]:443":          "tcp6",
+		"[2001:db8::1]:443": "tcp6",
+	}
+	for addr, network := range networks {
+		if got := bindNetwork(addr); got != network {
+			t.Errorf("%v: expecting %v, got %v", addr, network, got)
+		}
+	}
+
+	// IPv4 and IPv6 can be listened on separately on the same port
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 isn't available: %v", err)
+	} else {
+		l.Close()
+	}
+	l4, err := net.Listen(bindNetwork("127.0.0.1:0"), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l4.Close()
+	_, port, _ := net.SplitHostPort(l4.Addr().String())
+	l6, err := net.Listen(bindNetwork("[::]:"+port), "[::]:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l6.Close()
+}
+
+func TestCompleteBindAddr(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+	t.Run("default", func(t *testing.T) {
+		raw := server.RawConfig{}
+		if err := completeBindAddr(&raw, false, env(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(raw.BindAddr, []string{":443", ":80"}) {
+			t.Errorf("unexpected default BindAddr %v", raw.BindAddr)
+		}
+	})
+	t.Run("bad address", func(t *testing.T) {
+		raw := server.RawConfig{BindAddr: []string{"not an address"}}
+		if err := completeBindAddr(&raw, false, env(nil)); err == nil {
+			t.Error("expecting an error for a bad BindAddr")
+		}
+	})
+	t.Run("plugin mode", func(t *testing.T) {
+		raw := server.RawConfig{BindAddr: []string{":80"}}
+		if err := completeBindAddr(&raw, true, env(map[string]string{"SS_REMOTE_HOST": "0.0.0.0", "SS_REMOTE_PORT": "8388"})); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(raw.BindAddr, []string{":80", "0.0.0.0:8388"}) {
+			t.Errorf("unexpected BindAddr %v", raw.BindAddr)
+		}
+	})
+	t.Run("plugin mode on both ip versions", func(t *testing.T) {
+		raw := server.RawConfig{
+			BindAddr:       []string{"0.0.0.0:8388"},
+			BindTransports: map[string][]string{"0.0.0.0:8388": {"TLS"}},
+			BindKnocks:     map[string]string{"0.0.0.0:8388": "reset"},
+		}
+		if err := completeBindAddr(&raw, true, env(map[string]string{"SS_REMOTE_HOST": "::|0.0.0.0", "SS_REMOTE_PORT": "8388"})); err != nil {
+			t.Fatal(err)
+		}
+		if raw.BindAddr[0] != ":8388" {
+			t.Errorf("expecting the address of both ip versions, got %v", raw.BindAddr)
+		}
+		if !reflect.DeepEqual(raw.BindTransports[":8388"], []string{"TLS"}) {
+			t.Errorf("transports not carried over: %v", raw.BindTransports)
+		}
+		if raw.BindKnocks[":8388"] != "reset" {
+			t.Errorf("knock not carried over: %v", raw.BindKnocks)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+// ck-server drain asks the running ck-server, through the admin API, to stop taking new sessions and exit once the
+// ones it has have ended, so that it can be taken out from behind a load balancer without dropping connections
+
+const drainUsage = `Usage: %v drain [-c config] [-timeout seconds] [-notify] [-wait]
+
+`
+
+// how often -wait asks how far draining has gone
+const drainWaitInterval = time.Second
+
+// runDrainCommand runs ck-server drain with the arguments after "drain", writing how far draining has gone to out
+func runDrainCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("drain", flag.ContinueOnError)
+	config := flags.String("c", "server.json", "config: path to the configuration file, or empty to take it from the environment")
+	timeout := flags.Int("timeout", -1, "how many seconds sessions are waited for before they're closed, DrainTimeout of the configuration if it's negative")
+	notify := flags.Bool("notify", false, "Tell clients to make new sessions elsewhere, DrainNotify of the configuration if it's not given")
+	wait := flags.Bool("wait", false, "Wait until all sessions have ended or been closed")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, drainUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	raw, err := server.ParseConfig(*config)
+	if err != nil {
+		return err
+	}
+	if raw.AdminAPIAddr == "" {
+		return errors.New("AdminAPIAddr must be set to drain ck-server")
+	}
+	api, err := makeAdminAPIStore(raw)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Timeout *int  `json:",omitempty"`
+		Notify  *bool `json:",omitempty"`
+	}
+	if *timeout >= 0 {
+		req.Timeout = timeout
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "notify" {
+			req.Notify = notify
+		}
+	})
+	var status server.DrainStatus
+	if err = api.do("POST", "/drain", req, &status); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Draining, %v sessions left\n", status.Sessions)
+	for *wait && !status.Drained {
+		time.Sleep(drainWaitInterval)
+		left := status.Sessions
+		if err = api.do("GET", "/drain", nil, &status); err != nil {
+			// it exits once it's drained
+			fmt.Fprintln(out, "ck-server has stopped")
+			return nil
+		}
+		if status.Sessions != left {
+			fmt.Fprintf(out, "%v sessions left\n", status.Sessions)
+		}
+	}
+	if status.Drained {
+		fmt.Fprintln(out, "Drained")
+	}
+	return nil
+}
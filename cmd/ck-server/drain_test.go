@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+func TestRunDrainCommand(t *testing.T) {
+	var requested map[string]interface{}
+	polls := 0
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/drain" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == "POST" {
+			requested = nil
+			json.NewDecoder(r.Body).Decode(&requested)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(server.DrainStatus{Draining: true, Sessions: 2})
+			return
+		}
+		polls++
+		json.NewEncoder(w).Encode(server.DrainStatus{Draining: true, Drained: polls > 1, Sessions: 2 - polls})
+	}))
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "ck_drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "ckserver.json")
+	if err = ioutil.WriteFile(config, []byte(`{"AdminAPIAddr": "`+api.Listener.Addr().String()+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err = runDrainCommand([]string{"-c", config}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(requested) != 0 {
+		t.Errorf("expecting the configuration's to be used, got %v", requested)
+	}
+
+	out.Reset()
+	if err = runDrainCommand([]string{"-c", config, "-timeout", "30", "-notify", "-wait"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if requested["Timeout"] != float64(30) || requested["Notify"] != true {
+		t.Errorf("unexpected request %v", requested)
+	}
+	if !strings.Contains(out.String(), "1 sessions left") || !strings.HasSuffix(out.String(), "Drained\n") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
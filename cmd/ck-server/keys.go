@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+// ck-server keys gen|rotate|uri manages the static keypair of the server and hands out what clients need to connect
+// to it as cloak:// links, in text or as QR codes
+
+const keysUsage = `Usage: %v keys <command> [options]
+
+Commands:
+  gen                  print a new keypair as pubkey,pvkey, as -k does
+  rotate [-c config]   replace the PrivateKey of the configuration file with a new one
+  uri [-c config] -host host [-port port] [-sni ServerName] [-transport transport] [-proxy method] [-uid UID]
+      [-name name] [-set Field=value] [-qr ansi|png] [-o file]
+                       print a cloak:// link to the server, or its QR code
+`
+
+// runKeysCommand runs ck-server keys with the arguments after "keys", writing what's asked for to out
+func runKeysCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+		return errors.New("a command is needed")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("keys "+command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	switch command {
+	case "gen":
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		pub, pv := generateKeyPair()
+		fmt.Fprintf(out, "%v,%v\n", pub, pv)
+		return nil
+	case "rotate":
+		config := flags.String("c", "server.json", "config: path to the configuration file")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		pub, previous, err := rotateKeyPair(*config)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "PublicKey: %v\n", pub)
+		fmt.Fprintln(out, "Restart ck-server for the new key to take effect, and give clients the new PublicKey")
+		fmt.Fprintf(out, "To keep accepting clients that still have the old PublicKey, add %v to PreviousPrivateKeys\n", previous)
+		return nil
+	case "uri":
+		return runURICommand(flags, args[1:], out)
+	default:
+		fmt.Fprintf(os.Stderr, keysUsage, os.Args[0])
+		return fmt.Errorf("unknown command %v", command)
+	}
+}
+
+// publicKeyOf is the public key of the PrivateKey of raw, in base64
+func publicKeyOf(raw server.RawConfig) (string, error) {
+	if len(raw.PrivateKey) != 32 {
+		return "", fmt.Errorf("PrivateKey must be 32 bytes, got %v", len(raw.PrivateKey))
+	}
+	var pv [32]byte
+	copy(pv[:], raw.PrivateKey)
+	return base64.StdEncoding.EncodeToString(ecdh.Marshal(ecdh.PublicKey(&pv))), nil
+}
+
+// rotateKeyPair replaces the PrivateKey of the configuration file at path with a new one, returning the new public
+// key and the private key it replaced. The key is replaced where it's written, so the file is otherwise left as it
+// is, whatever its format
+func rotateKeyPair(path string) (pub string, previous string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", err
+	}
+	raw, err := server.ParseConfig(path)
+	if err != nil {
+		return "", "", err
+	}
+	if len(raw.PrivateKey) == 0 {
+		return "", "", fmt.Errorf("%v has no PrivateKey to replace", path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	previous = base64.StdEncoding.EncodeToString(raw.PrivateKey)
+	old := []byte(previous)
+	if n := bytes.Count(content, old); n != 1 {
+		return "", "", fmt.Errorf("the PrivateKey in %v must be written once in standard base64 to be replaced", path)
+	}
+	pub, pv := generateKeyPair()
+	content = bytes.Replace(content, old, []byte(pv), 1)
+
+	// the file is replaced in one go, so that it's never left half written
+	err = common.WriteFileAtomic(path, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return pub, previous, nil
+}
+
+// runURICommand runs ck-server keys uri
+func runURICommand(flags *flag.FlagSet, args []string, out io.Writer) error {
+	config := flags.String("c", "server.json", "config: path to the configuration file, or empty to take it from the environment")
+	host := flags.String("host", "", "the host name or IP that clients connect to")
+	port := flags.String("port", "", "the port that clients connect to, that of the first BindAddr by default")
+	sni := flags.String("sni", "", "the ServerName of clients, the host name of RedirAddr by default")
+	transport := flags.String("transport", "direct", "the Transport of clients")
+	proxyMethod := flags.String("proxy", "", "the ProxyMethod of clients")
+	b64UID := flags.String("uid", "", "the UID of the user the link is for, which is left out if empty")
+	name := flags.String("name", "", "a name for the server that's for people to read")
+	qr := flags.String("qr", "", "print the link as a QR code, either ansi for a terminal or png")
+	output := flags.String("o", "", "the file to write a PNG QR code to")
+	var fields common.ConfigFlags
+	flags.Var(&fields, "set", "Set another field of the client's configuration in the link as Field=value. Can be given many times")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *host == "" {
+		return errors.New("-host must be set")
+	}
+
+	raw, err := server.ParseConfig(*config)
+	if err != nil {
+		return err
+	}
+	pub, err := publicKeyOf(raw)
+	if err != nil {
+		return err
+	}
+	link := common.ShareLink{RemoteHost: *host, RemotePort: *port, Name: *name, Fields: map[string]string{}}
+	if link.RemotePort == "" {
+		link.RemotePort = "443"
+		if len(raw.BindAddr) != 0 {
+			if _, bindPort, err := net.SplitHostPort(raw.BindAddr[0]); err == nil {
+				link.RemotePort = bindPort
+			}
+		}
+	}
+	serverName := *sni
+	if serverName == "" {
+		serverName = redirHostName(raw.RedirAddr)
+	}
+	if serverName == "" {
+		return errors.New("-sni must be set as RedirAddr has no host name")
+	}
+	for field, value := range fields {
+		link.Fields[field] = value
+	}
+	link.Fields["PublicKey"] = pub
+	link.Fields["ServerName"] = serverName
+	link.Fields["Transport"] = *transport
+	if *proxyMethod != "" {
+		link.Fields["ProxyMethod"] = *proxyMethod
+	}
+	if *b64UID != "" {
+		UID, err := parseUID(*b64UID)
+		if err != nil {
+			return err
+		}
+		link.Fields["UID"] = b64(UID)
+	}
+
+	switch *qr {
+	case "":
+		fmt.Fprintln(out, link)
+		return nil
+	case "ansi":
+		return common.WriteQRCode(out, link.String(), false, 0)
+	case "png":
+		if *output == "" {
+			return errors.New("-o must be set for a PNG")
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		if err = common.WriteQRCode(f, link.String(), true, 512); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	default:
+		return fmt.Errorf("unknown QR code format %v", *qr)
+	}
+}
+
+// redirHostName is the host name of redirAddr, or an empty string if it's an IP
+func redirHostName(redirAddr string) string {
+	host, _, err := net.SplitHostPort(redirAddr)
+	if err != nil {
+		host = redirAddr
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
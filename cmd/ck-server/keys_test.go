@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+const testPrivateKey = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="
+
+func TestRotateKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ck_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"ckserver.json": `{
+	"PrivateKey": "` + testPrivateKey + `",
+	"RedirAddr": "www.bing.com"
+}`,
+		"ckserver.yaml": "# the key\nPrivateKey: " + testPrivateKey + "\nRedirAddr: www.bing.com\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pub, previous, err := rotateKeyPair(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		raw, err := server.ParseConfig(path)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, _ := publicKeyOf(raw); got != pub {
+			t.Errorf("%v: the public key %v doesn't match the new private key", name, pub)
+		}
+		if previous != testPrivateKey {
+			t.Errorf("%v: expecting the replaced key %v, got %v", name, testPrivateKey, previous)
+		}
+		if raw.RedirAddr != "www.bing.com" {
+			t.Errorf("%v: the rest of the configuration is lost", name)
+		}
+		if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+			t.Errorf("%v: the mode is changed to %v", name, info.Mode())
+		}
+	}
+
+	path := filepath.Join(dir, "nokey.json")
+	ioutil.WriteFile(path, []byte(`{"RedirAddr": "www.bing.com"}`), 0600)
+	if _, _, err = rotateKeyPair(path); err == nil {
+		t.Error("expecting an error without a PrivateKey")
+	}
+}
+
+func TestRunKeysCommand_URI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ck_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "ckserver.json")
+	err = ioutil.WriteFile(config, []byte(`{"PrivateKey": "`+testPrivateKey+`", "RedirAddr": "www.bing.com:443", "BindAddr": [":8443"]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = runKeysCommand([]string{"uri", "-c", config, "-host", "203.0.113.1", "-proxy", "shadowsocks",
+		"-uid", "5nneblJy6lniPJfr81LuYQ==", "-name", "home", "-set", "NumConn=2"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := strings.TrimSpace(out.String())
+	if !strings.HasPrefix(uri, "cloak://203.0.113.1:8443?") || !strings.HasSuffix(uri, "#home") {
+		t.Errorf("unexpected link %v", uri)
+	}
+
+	raw, err := client.ParseConfig(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverRaw, _ := server.ParseConfig(config)
+	pub, _ := publicKeyOf(serverRaw)
+	if raw.RemoteHost != "203.0.113.1" || raw.RemotePort != "8443" || raw.ServerName != "www.bing.com" ||
+		raw.ProxyMethod != "shadowsocks" || raw.Transport != "direct" || raw.NumConn != 2 || len(raw.UID) != 16 {
+		t.Errorf("wrong client configuration %+v", raw)
+	}
+	if string(raw.PublicKey) == "" || b64(raw.PublicKey) != pub {
+		t.Errorf("expecting PublicKey %v, got %v", pub, b64(raw.PublicKey))
+	}
+
+	out.Reset()
+	if err = runKeysCommand([]string{"uri", "-c", config, "-host", "203.0.113.1", "-qr", "ansi"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "\033[40m") {
+		t.Error("no QR code is printed")
+	}
+
+	png := filepath.Join(dir, "link.png")
+	if err = runKeysCommand([]string{"uri", "-c", config, "-host", "203.0.113.1", "-qr", "png", "-o", png}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(png); !bytes.HasPrefix(content, []byte("\x89PNG")) {
+		t.Error("no PNG is written")
+	}
+
+	if err = runKeysCommand([]string{"uri", "-c", config}, &out); err == nil {
+		t.Error("expecting an error without -host")
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrateDatabase copies the users of the userinfo.db at dbPath into the database at databaseURL
+func migrateDatabase(dbPath string, databaseURL string) error {
+	local, err := usermanager.MakeLocalManager(dbPath, common.RealWorldState)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	backend, err := usermanager.OpenBackend(databaseURL)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	n, err := usermanager.MigrateUsers(local, backend)
+	if err != nil {
+		return err
+	}
+	log.Infof("Migrated %v users from %v", n, dbPath)
+	return nil
+}
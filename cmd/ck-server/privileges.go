@@ -0,0 +1,71 @@
+package main
+
+// ck-server can be started as root to listen on ports below 1024, such as 443, and then run as RunAs for the rest of
+// its lifetime. Privileges are dropped once everything has been listened on and the user database, the certificates
+// and the replay cache have been opened. On Linux, it keeps the capability to bind ports below 1024, so that BindAddr
+// can still be changed by reloading, where the Go runtime allows it, i.e. when ck-server is built without cgo.
+//
+// With Chroot, ck-server is also confined to StateDir. It moves into StateDir before starting, so that relative paths
+// in the configuration are taken from StateDir both before and after chrooting, and whatever is read or written after
+// starting, such as the configuration file when reloading, TLSCert and ReplayCachePath, has to be in it
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+var errNotRoot = errors.New("RunAs needs ck-server to be started as root")
+
+// lookupRunAs returns the uid, gid and supplementary groups of runAs, which is user or user:group, by name or by
+// number. The group is the primary one of user if it isn't given
+func lookupRunAs(runAs string) (uid int, gid int, groups []int, err error) {
+	userName, groupName, hasGroup := strings.Cut(runAs, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return 0, 0, nil, fmt.Errorf("unable to find user %v of RunAs", userName)
+		}
+	}
+	uid, _ = strconv.Atoi(u.Uid)
+	gid, _ = strconv.Atoi(u.Gid)
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return 0, 0, nil, fmt.Errorf("unable to find group %v of RunAs", groupName)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	groupIds, _ := u.GroupIds()
+	for _, id := range groupIds {
+		if n, err := strconv.Atoi(id); err == nil {
+			groups = append(groups, n)
+		}
+	}
+	return uid, gid, groups, nil
+}
+
+// enterStateDir moves into StateDir for Chroot, and makes StateDir of raw relative to it. It returns the absolute
+// path of StateDir to chroot into
+func enterStateDir(raw *server.RawConfig) (string, error) {
+	if raw.StateDir == "" || raw.RunAs == "" {
+		return "", errors.New("Chroot needs StateDir and RunAs")
+	}
+	dir, err := filepath.Abs(raw.StateDir)
+	if err != nil {
+		return "", err
+	}
+	if err = os.Chdir(dir); err != nil {
+		return "", fmt.Errorf("unable to move into StateDir: %v", err)
+	}
+	raw.StateDir = "."
+	return dir, nil
+}
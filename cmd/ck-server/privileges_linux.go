@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges chroots into chroot unless it's empty, then runs as runAs, keeping only the capability to bind
+// ports below 1024 if it can
+func dropPrivileges(runAs string, chroot string) error {
+	if os.Geteuid() != 0 {
+		return errNotRoot
+	}
+	uid, gid, groups, err := lookupRunAs(runAs)
+	if err != nil {
+		return err
+	}
+	if chroot != "" {
+		if err = syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("unable to chroot into %v: %v", chroot, err)
+		}
+		if err = syscall.Chdir("/"); err != nil {
+			return err
+		}
+	}
+
+	// the capabilities are kept through setuid, and are set on every thread, only if the runtime can make syscalls
+	// on all of them, which it can't with cgo
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 1, 0)
+	keepCaps := errno == 0
+
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("unable to set groups: %v", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("unable to set gid: %v", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("unable to set uid: %v", err)
+	}
+
+	if keepCaps {
+		header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+		data := [2]unix.CapUserData{{
+			Effective: 1 << unix.CAP_NET_BIND_SERVICE,
+			Permitted: 1 << unix.CAP_NET_BIND_SERVICE,
+		}}
+		_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+		keepCaps = errno == 0
+		syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_KEEPCAPS, 0, 0)
+	}
+	if !keepCaps {
+		log.Warn("BindAddr with ports below 1024 can't be listened on when reloading, as the capability to isn't kept")
+	}
+	return nil
+}
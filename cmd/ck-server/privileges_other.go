@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func dropPrivileges(string, string) error {
+	return errors.New("RunAs and Chroot are only supported on Linux")
+}
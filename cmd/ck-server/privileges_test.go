@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+func TestLookupRunAs(t *testing.T) {
+	for _, runAs := range []string{"root", "0", "root:0"} {
+		uid, gid, _, err := lookupRunAs(runAs)
+		if err != nil {
+			t.Errorf("%v: %v", runAs, err)
+			continue
+		}
+		if uid != 0 || gid != 0 {
+			t.Errorf("%v: expecting uid and gid 0, got %v and %v", runAs, uid, gid)
+		}
+	}
+	for _, runAs := range []string{"no-such-user-of-cloak", "root:no-such-group-of-cloak"} {
+		if _, _, _, err := lookupRunAs(runAs); err == nil {
+			t.Errorf("expecting an error for %v", runAs)
+		}
+	}
+}
+
+func TestEnterStateDir(t *testing.T) {
+	if _, err := enterStateDir(&server.RawConfig{RunAs: "nobody"}); err == nil {
+		t.Error("expecting an error without StateDir")
+	}
+
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	stateDir := t.TempDir()
+	raw := server.RawConfig{RunAs: "nobody", StateDir: stateDir}
+	dir, err := enterStateDir(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir != stateDir || raw.StateDir != "." {
+		t.Errorf("expecting to chroot into %v with StateDir ., got %v with %v", stateDir, dir, raw.StateDir)
+	}
+	if now, _ := os.Getwd(); filepath.Clean(now) != stateDir {
+		t.Errorf("expecting to be in %v, got %v", stateDir, now)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// Once ck-server has started, and dropped its privileges if it's been told to, it sandboxes itself, so that whoever
+// manages to exploit the parsing of what comes from the network can do as little as possible with it. Where the
+// kernel supports it, Landlock limits the files it can open to those it reads or writes after starting, and a seccomp
+// filter only allows the syscalls that it needs, so that others such as execve, ptrace and mount fail with EPERM.
+// Either is skipped with a warning if the kernel can't install it, but ck-server exits if there's no allowlist of
+// syscalls for its architecture. The sandbox can be turned off with -no-sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/server"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+// sandboxPaths are the files and directories ck-server opens after starting
+type sandboxPaths struct {
+	// only read
+	read []string
+	// read, written, created and removed in
+	write []string
+}
+
+// the system files that resolving names and verifying certificates read
+var systemReadPaths = []string{"/etc", "/usr/share/ca-certificates", "/usr/share/zoneinfo", "/usr/lib/ssl", "/usr/local/share/ca-certificates"}
+
+// sandboxPathsOf returns the paths that ck-server with raw, from the configuration file at config, needs after it has
+// started. What doesn't exist is left out
+func sandboxPathsOf(raw server.RawConfig, config string) sandboxPaths {
+	var paths sandboxPaths
+	read := func(path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err == nil {
+			paths.read = append(paths.read, path)
+		}
+	}
+	// the directory of a file that's written, as files are written to a temporary file which is renamed over them
+	write := func(path string, isDir bool) {
+		if path == "" {
+			return
+		}
+		if !isDir {
+			path = filepath.Dir(path)
+		}
+		if _, err := os.Stat(path); err == nil {
+			paths.write = append(paths.write, path)
+		}
+	}
+
+	for _, path := range systemReadPaths {
+		read(path)
+	}
+	// it's the configuration itself rather than a path in plugin mode, or with JSON in -c
+	if !strings.HasPrefix(strings.TrimSpace(config), "{") {
+		read(config)
+	}
+	read(raw.TLSCert)
+	read(raw.TLSKey)
+	for _, path := range raw.GeoIPDatabases {
+		read(path)
+	}
+	if !strings.HasPrefix(raw.WebRoot, "http://") && !strings.HasPrefix(raw.WebRoot, "https://") {
+		read(raw.WebRoot)
+	}
+	write(raw.StateDir, true)
+	write(raw.ReplayCachePath, false)
+	write(raw.UsageLedgerPath, false)
+	databases := []server.RawConfig{raw}
+	for _, tenant := range raw.Tenants {
+		databases = append(databases, server.RawConfig{DatabasePath: tenant.DatabasePath, DatabaseURL: tenant.DatabaseURL, AuthWebhook: tenant.AuthWebhook})
+	}
+	for _, db := range databases {
+		if db.DatabaseURL != "" {
+			// SQLite writes its journal next to the database
+			write(usermanager.SQLitePath(db.DatabaseURL), false)
+		} else if db.AuthWebhook == "" {
+			write(db.DatabasePath, false)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// the syscalls that ck-server, the Go runtime and libc make once it has started, on every architecture. Every other
+// syscall fails with EPERM in the sandbox
+var allowedSyscalls = []uintptr{
+	// files
+	unix.SYS_READ, unix.SYS_WRITE, unix.SYS_READV, unix.SYS_WRITEV, unix.SYS_PREAD64, unix.SYS_PWRITE64,
+	unix.SYS_OPENAT, unix.SYS_CLOSE, unix.SYS_LSEEK, unix.SYS_FSTAT, unix.SYS_STATX, unix.SYS_FSTATFS,
+	unix.SYS_GETDENTS64, unix.SYS_READLINKAT, unix.SYS_FCNTL, unix.SYS_FSYNC, unix.SYS_FDATASYNC, unix.SYS_FTRUNCATE,
+	unix.SYS_FALLOCATE, unix.SYS_RENAMEAT2, unix.SYS_UNLINKAT, unix.SYS_MKDIRAT, unix.SYS_FCHMOD, unix.SYS_FCHMODAT,
+	unix.SYS_FCHOWN, unix.SYS_UTIMENSAT, unix.SYS_FLOCK, unix.SYS_GETCWD, unix.SYS_FACCESSAT, unix.SYS_FACCESSAT2,
+	unix.SYS_DUP, unix.SYS_DUP3, unix.SYS_PIPE2, unix.SYS_SPLICE, unix.SYS_SENDFILE, unix.SYS_COPY_FILE_RANGE,
+	// memory
+	unix.SYS_BRK, unix.SYS_MUNMAP, unix.SYS_MREMAP, unix.SYS_MPROTECT, unix.SYS_MADVISE, unix.SYS_MINCORE,
+	unix.SYS_MLOCK, unix.SYS_MUNLOCK,
+	// threads, signals and time
+	unix.SYS_CLONE, unix.SYS_CLONE3, unix.SYS_EXIT, unix.SYS_EXIT_GROUP, unix.SYS_FUTEX, unix.SYS_SET_TID_ADDRESS,
+	unix.SYS_SET_ROBUST_LIST, unix.SYS_RSEQ, unix.SYS_SCHED_YIELD, unix.SYS_SCHED_GETAFFINITY, unix.SYS_GETTID,
+	unix.SYS_GETPID, unix.SYS_TGKILL, unix.SYS_RT_SIGACTION, unix.SYS_RT_SIGPROCMASK, unix.SYS_RT_SIGRETURN,
+	unix.SYS_SIGALTSTACK, unix.SYS_RESTART_SYSCALL, unix.SYS_NANOSLEEP, unix.SYS_CLOCK_NANOSLEEP,
+	unix.SYS_CLOCK_GETTIME, unix.SYS_CLOCK_GETRES, unix.SYS_GETTIMEOFDAY, unix.SYS_TIMER_CREATE,
+	unix.SYS_TIMER_SETTIME, unix.SYS_TIMER_DELETE, unix.SYS_SETITIMER,
+	// polling
+	unix.SYS_EPOLL_CREATE1, unix.SYS_EPOLL_CTL, unix.SYS_EPOLL_PWAIT, unix.SYS_EPOLL_PWAIT2, unix.SYS_EVENTFD2,
+	unix.SYS_PPOLL, unix.SYS_PSELECT6,
+	// sockets
+	unix.SYS_SOCKET, unix.SYS_SOCKETPAIR, unix.SYS_BIND, unix.SYS_LISTEN, unix.SYS_ACCEPT4, unix.SYS_CONNECT,
+	unix.SYS_GETSOCKNAME, unix.SYS_GETPEERNAME, unix.SYS_SETSOCKOPT, unix.SYS_GETSOCKOPT, unix.SYS_SENDTO,
+	unix.SYS_RECVFROM, unix.SYS_SENDMSG, unix.SYS_RECVMSG, unix.SYS_SENDMMSG, unix.SYS_RECVMMSG, unix.SYS_SHUTDOWN,
+	// the rest
+	unix.SYS_GETRANDOM, unix.SYS_UNAME, unix.SYS_SYSINFO, unix.SYS_PRLIMIT64, unix.SYS_GETUID, unix.SYS_GETEUID,
+	unix.SYS_GETGID, unix.SYS_GETEGID,
+}
+
+// the syscalls that are only allowed on some architectures, and the AUDIT_ARCH_ of GOARCH, which the filter checks so
+// that syscalls can't be made by the numbers of another, are in sandbox_linux_$GOARCH.go. auditArch is zero where
+// there's no allowlist for GOARCH
+var errArchUnsupported = errors.New("there's no allowlist of syscalls for this architecture")
+
+// the first syscall number of the x32 ABI of amd64, which is denied as a whole
+const x32SyscallBit = 0x40000000
+
+func sandbox(paths sandboxPaths) {
+	if err := restrictFiles(paths); err != nil {
+		log.Warnf("files aren't sandboxed: %v", err)
+	}
+	if err := filterSyscalls(); err == errArchUnsupported {
+		log.Fatalf("syscalls can't be sandboxed on %v. Run ck-server with -no-sandbox to run it without the sandbox", runtime.GOARCH)
+	} else if err != nil {
+		log.Warnf("syscalls aren't sandboxed: %v", err)
+	}
+}
+
+// landlockFileAccess is every access to files of each Landlock ABI, from 1
+var landlockFileAccess = []uint64{
+	1<<13 - 1,
+	1<<14 - 1,
+	1<<15 - 1,
+}
+
+// restrictFiles lets ck-server only open paths with Landlock
+func restrictFiles(paths sandboxPaths) error {
+	abi, _, errno := syscall.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return fmt.Errorf("Landlock isn't supported: %v", errno)
+	}
+	handled := landlockFileAccess[min(int(abi), len(landlockFileAccess))-1]
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := syscall.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("unable to create Landlock ruleset: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+
+	const readFile = unix.LANDLOCK_ACCESS_FS_READ_FILE
+	const readDir = unix.LANDLOCK_ACCESS_FS_READ_DIR
+	addRule := func(path string, access uint64) error {
+		pathFd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(pathFd)
+		var stat unix.Stat_t
+		if err = unix.Fstat(pathFd, &stat); err != nil {
+			return err
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			// only what's done to a file itself can be allowed on it
+			access &= readFile | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access & handled, Parent_fd: int32(pathFd)}
+		_, _, errno := syscall.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+	for _, path := range paths.read {
+		if err := addRule(path, readFile|readDir); err != nil {
+			return fmt.Errorf("unable to allow reading %v: %v", path, err)
+		}
+	}
+	for _, path := range paths.write {
+		if err := addRule(path, handled&^unix.LANDLOCK_ACCESS_FS_EXECUTE); err != nil {
+			return fmt.Errorf("unable to allow writing in %v: %v", path, err)
+		}
+	}
+
+	// every thread of the runtime is restricted, which it can't do with cgo
+	if _, _, errno = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		return fmt.Errorf("unable to set no_new_privs: %v", errno)
+	}
+	if _, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("unable to restrict threads: %v", errno)
+	}
+	return nil
+}
+
+// seccompFilter returns the BPF program that only allows allowedSyscalls and archSyscalls to the syscalls of arch
+func seccompFilter(arch uint32) []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter { return unix.SockFilter{Code: code, K: k} }
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	deny := stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM))
+	filter := []unix.SockFilter{
+		// the offsets of arch and nr in struct seccomp_data
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+		deny,
+	}
+	allow := stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW)
+	for _, nr := range append(allowedSyscalls, archSyscalls...) {
+		filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1), allow)
+	}
+	return append(filter, deny)
+}
+
+// filterSyscalls installs seccompFilter on every thread
+func filterSyscalls() error {
+	if auditArch == 0 {
+		return errArchUnsupported
+	}
+	filter := seccompFilter(auditArch)
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is set on the other threads along with the filter
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("unable to set no_new_privs: %v", err)
+	}
+	_, _, errno := syscall.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("unable to install seccomp filter: %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const auditArch uint32 = unix.AUDIT_ARCH_X86_64
+
+// the syscalls that the Go runtime or libc make on amd64 besides allowedSyscalls
+var archSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_READLINK, unix.SYS_RENAME, unix.SYS_RENAMEAT, unix.SYS_UNLINK,
+	unix.SYS_MKDIR, unix.SYS_ACCESS, unix.SYS_DUP2, unix.SYS_PIPE,
+	unix.SYS_NEWFSTATAT, unix.SYS_MMAP, unix.SYS_ARCH_PRCTL, unix.SYS_GETRLIMIT, unix.SYS_EPOLL_WAIT, unix.SYS_POLL,
+	unix.SYS_SELECT, unix.SYS_ACCEPT,
+}
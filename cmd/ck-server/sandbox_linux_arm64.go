@@ -0,0 +1,10 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const auditArch uint32 = unix.AUDIT_ARCH_AARCH64
+
+// the syscalls that the Go runtime or libc make on arm64 besides allowedSyscalls
+var archSyscalls = []uintptr{
+	unix.SYS_NEWFSTATAT, unix.SYS_RENAMEAT, unix.SYS_MMAP, unix.SYS_GETRLIMIT, unix.SYS_ACCEPT,
+}
@@ -0,0 +1,14 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const auditArch uint32 = unix.AUDIT_ARCH_PPC64LE
+
+// the syscalls that the Go runtime or libc make on ppc64le besides allowedSyscalls
+var archSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_READLINK, unix.SYS_RENAME, unix.SYS_RENAMEAT, unix.SYS_UNLINK,
+	unix.SYS_MKDIR, unix.SYS_ACCESS, unix.SYS_DUP2, unix.SYS_PIPE,
+	unix.SYS_NEWFSTATAT, unix.SYS_FSTATFS64, unix.SYS__LLSEEK, unix.SYS_MMAP, unix.SYS_SIGRETURN, unix.SYS_UGETRLIMIT,
+	unix.SYS_GETRLIMIT, unix.SYS_EPOLL_WAIT, unix.SYS_POLL, unix.SYS_SELECT, unix.SYS__NEWSELECT, unix.SYS_SOCKETCALL,
+	unix.SYS_ACCEPT, unix.SYS_SEND, unix.SYS_RECV,
+}
@@ -0,0 +1,10 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+const auditArch uint32 = unix.AUDIT_ARCH_RISCV64
+
+// the syscalls that the Go runtime or libc make on riscv64 besides allowedSyscalls
+var archSyscalls = []uintptr{
+	unix.SYS_NEWFSTATAT, unix.SYS_MMAP, unix.SYS_GETRLIMIT, unix.SYS_ACCEPT,
+}
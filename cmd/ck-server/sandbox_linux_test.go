@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSandbox sandboxes a child of the test, as the sandbox can't be lifted
+func TestSandbox(t *testing.T) {
+	if dir := os.Getenv("CK_SANDBOX_TEST_DIR"); dir != "" {
+		// Landlock can't restrict every thread when built with cgo
+		filesErr := restrictFiles(sandboxPaths{write: []string{dir}})
+		if err := filterSyscalls(); err != nil {
+			t.Skipf("seccomp isn't available: %v", err)
+		}
+		if err := syscall.Exec("/bin/true", []string{"true"}, nil); !errors.Is(err, syscall.EPERM) {
+			t.Errorf("expecting execve to be denied, got %v", err)
+		}
+		// what isn't allowed is denied, even if it's harmless
+		if _, err := syscall.Getpgid(0); !errors.Is(err, syscall.EPERM) {
+			t.Errorf("expecting getpgid to be denied, got %v", err)
+		}
+		// what ck-server does once it has started still works
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("expecting to listen, got %v", err)
+		}
+		defer l.Close()
+		go func() {
+			if conn, err := l.Accept(); err == nil {
+				conn.Write([]byte("ok"))
+				conn.Close()
+			}
+		}()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("expecting to connect, got %v", err)
+		}
+		if b, err := io.ReadAll(conn); err != nil || string(b) != "ok" {
+			t.Errorf("expecting to read ok, got %q, %v", b, err)
+		}
+		conn.Close()
+		time.Sleep(10 * time.Millisecond)
+		if err := os.WriteFile(filepath.Join(dir, "allowed"), []byte("ok"), 0600); err != nil {
+			t.Errorf("expecting to write in the allowed directory, got %v", err)
+		}
+		if _, err := os.ReadFile(os.Getenv("CK_SANDBOX_TEST_DENIED")); filesErr == nil && !errors.Is(err, syscall.EACCES) {
+			t.Errorf("expecting reading a file outside the allowed paths to be denied, got %v", err)
+		}
+		return
+	}
+
+	denied := filepath.Join(t.TempDir(), "denied")
+	os.WriteFile(denied, []byte("secret"), 0600)
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$")
+	cmd.Env = append(os.Environ(), "CK_SANDBOX_TEST_DIR="+t.TempDir(), "CK_SANDBOX_TEST_DENIED="+denied)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+}
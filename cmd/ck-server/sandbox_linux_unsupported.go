@@ -0,0 +1,9 @@
+//go:build linux && !amd64 && !386 && !arm && !arm64 && !riscv64 && !ppc64le && !s390x
+// +build linux,!amd64,!386,!arm,!arm64,!riscv64,!ppc64le,!s390x
+
+package main
+
+// there's no allowlist of syscalls for GOARCH, so ck-server only runs here with -no-sandbox
+const auditArch uint32 = 0
+
+var archSyscalls []uintptr
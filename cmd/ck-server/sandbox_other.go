@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import log "github.com/sirupsen/logrus"
+
+func sandbox(sandboxPaths) {
+	log.Debug("ck-server isn't sandboxed on this platform")
+}
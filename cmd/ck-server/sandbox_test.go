@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+func TestSandboxPathsOf(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "server.json")
+	os.WriteFile(config, []byte("{}"), 0600)
+	dbDir := filepath.Join(dir, "db")
+	os.Mkdir(dbDir, 0700)
+	ledgerDir := filepath.Join(dir, "usage")
+	os.Mkdir(ledgerDir, 0700)
+	raw := server.RawConfig{
+		DatabasePath:    filepath.Join(dbDir, "userinfo.db"),
+		ReplayCachePath: filepath.Join(dir, "replay"),
+		UsageLedgerPath: filepath.Join(ledgerDir, "usage.csv"),
+		TLSCert:         filepath.Join(dir, "missing.crt"),
+		WebRoot:         "https://example.com",
+		Tenants:         map[string]server.TenantConfig{"tenant.example.com": {DatabaseURL: "sqlite://" + filepath.Join(dir, "tenant.db")}},
+	}
+	paths := sandboxPathsOf(raw, config)
+
+	contains := func(list []string, path string) bool {
+		for _, p := range list {
+			if p == path {
+				return true
+			}
+		}
+		return false
+	}
+	if !contains(paths.read, config) {
+		t.Error("the configuration file can't be read again")
+	}
+	if contains(paths.read, raw.TLSCert) || contains(paths.read, raw.WebRoot) {
+		t.Error("a path that doesn't exist is allowed")
+	}
+	if !contains(paths.write, dbDir) || !contains(paths.write, dir) || !contains(paths.write, ledgerDir) {
+		t.Errorf("expecting the directories of the databases, the replay cache and the usage ledger to be written, got %v", paths.write)
+	}
+	if contains(sandboxPathsOf(raw, `{"RedirAddr":"example.com"}`).read, `{"RedirAddr":"example.com"}`) {
+		t.Error("the configuration in JSON is taken as a path")
+	}
+}
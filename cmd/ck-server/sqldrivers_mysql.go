@@ -0,0 +1,8 @@
+//go:build mysql
+// +build mysql
+
+package main
+
+// the driver of a MySQL DatabaseURL. ck-server needs to be built with the mysql tag to have it, after adding
+// the module with go get github.com/go-sql-driver/mysql
+import _ "github.com/go-sql-driver/mysql"
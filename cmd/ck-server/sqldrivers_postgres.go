@@ -0,0 +1,8 @@
+//go:build postgres
+// +build postgres
+
+package main
+
+// the driver of a PostgreSQL DatabaseURL. ck-server needs to be built with the postgres tag to have it, after adding
+// the module with go get github.com/lib/pq
+import _ "github.com/lib/pq"
@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+// the driver of a SQLite DatabaseURL. ck-server needs to be built with the sqlite tag to have it, after adding
+// the module with go get modernc.org/sqlite
+import _ "modernc.org/sqlite"
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// the file in StateDir that a running ck-server holds a lock on, so that no other uses the same StateDir
+const stateDirLockName = "ck-server.lock"
+
+// held for as long as ck-server runs, as the lock goes with it
+var stateDirLock *os.File
+
+// lockStateDir makes StateDir if it doesn't exist, and locks it for this ck-server
+func lockStateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("unable to make StateDir: %v", err)
+	}
+	lock, err := common.LockFile(filepath.Join(dir, stateDirLockName))
+	if errors.Is(err, common.ErrLocked) {
+		return fmt.Errorf("StateDir %v is in use by another ck-server", dir)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to lock StateDir: %v", err)
+	}
+	stateDirLock = lock
+	return nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLockStateDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "state")
+	if err := lockStateDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer stateDirLock.Close()
+	if err := lockStateDir(dir); err == nil {
+		t.Error("StateDir is locked by a second ck-server")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+// ck-server can be run by systemd as a Type=notify service, optionally with socket activation and a watchdog.
+// With socket activation, systemd holds the listening sockets so that connections made while ck-server restarts
+// wait for it instead of being refused. See sd_listen_fds(3) and sd_notify(3) for the protocol.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the first file descriptor passed by systemd
+const sdListenFdsStart = 3
+
+// systemdListeners returns the listeners passed by systemd's socket activation, and their names. They're empty if
+// ck-server isn't socket activated
+func systemdListeners(getenv func(string) string, pid int) ([]net.Listener, []string, error) {
+	if getenv("LISTEN_PID") == "" {
+		return nil, nil, nil
+	}
+	listenPid, err := strconv.Atoi(getenv("LISTEN_PID"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad LISTEN_PID: %v", err)
+	}
+	// the sockets were passed to another process, which started this one
+	if listenPid != pid {
+		return nil, nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, nil, fmt.Errorf("bad LISTEN_FDS %q", getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if getenv("LISTEN_FDNAMES") != "" {
+		names = strings.Split(getenv("LISTEN_FDNAMES"), ":")
+	}
+	var files []*os.File
+	var fileNames []string
+	for i := 0; i < n; i++ {
+		fd := sdListenFdsStart + i
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+		fileNames = append(fileNames, name)
+	}
+	listeners, err := listenersFromFiles(files)
+	if err != nil {
+		return nil, nil, err
+	}
+	return listeners, fileNames, nil
+}
+
+// listenersFromFiles makes listeners of the files of sockets, and closes the files
+func listenersFromFiles(files []*os.File) ([]net.Listener, error) {
+	var listeners []net.Listener
+	var err error
+	for _, f := range files {
+		// the listener has its own duplicate of the file descriptor
+		var listener net.Listener
+		if err == nil {
+			listener, err = net.FileListener(f)
+			if err != nil {
+				err = fmt.Errorf("socket %v from systemd isn't a stream listener: %v", f.Name(), err)
+			} else {
+				listeners = append(listeners, listener)
+			}
+		}
+		f.Close()
+	}
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// sdNotifier sends the state of ck-server to systemd. It does nothing if ck-server isn't run by systemd with
+// Type=notify
+type sdNotifier struct {
+	socket string
+	// how often systemd wants to be pinged, 0 if it doesn't
+	watchdogInterval time.Duration
+}
+
+func makeSDNotifier(getenv func(string) string, pid int) (*sdNotifier, error) {
+	notifier := &sdNotifier{socket: getenv("NOTIFY_SOCKET")}
+	// an abstract socket
+	if strings.HasPrefix(notifier.socket, "@") {
+		notifier.socket = "\x00" + notifier.socket[1:]
+	}
+
+	if usec := getenv("WATCHDOG_USEC"); usec != "" {
+		if watchdogPid := getenv("WATCHDOG_PID"); watchdogPid != "" && watchdogPid != strconv.Itoa(pid) {
+			return notifier, nil
+		}
+		n, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("bad WATCHDOG_USEC %q", usec)
+		}
+		notifier.watchdogInterval = time.Duration(n) * time.Microsecond
+	}
+	return notifier, nil
+}
+
+var errNoNotifySocket = errors.New("NOTIFY_SOCKET isn't set")
+
+// notify sends state, e.g. READY=1, to systemd
+func (notifier *sdNotifier) notify(state string) error {
+	if notifier.socket == "" {
+		return errNoNotifySocket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: notifier.socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// send sends state to systemd, if ck-server is run by it
+func (notifier *sdNotifier) send(state string) {
+	if err := notifier.notify(state); err != nil && err != errNoNotifySocket {
+		log.Warnf("Failed to notify systemd of %v: %v", state, err)
+	}
+}
+
+// watchdog pings systemd at half of the interval it wants, forever. It returns at once if there's no watchdog
+func (notifier *sdNotifier) watchdog() {
+	if notifier.watchdogInterval == 0 || notifier.socket == "" {
+		return
+	}
+	ticker := time.NewTicker(notifier.watchdogInterval / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := notifier.notify("WATCHDOG=1"); err != nil {
+			log.Warnf("Failed to ping the systemd watchdog: %v", err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func envOf(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestSystemdListeners(t *testing.T) {
+	t.Run("not activated", func(t *testing.T) {
+		listeners, _, err := systemdListeners(envOf(nil), 100)
+		if err != nil || len(listeners) != 0 {
+			t.Errorf("unexpected listeners %v or error %v", listeners, err)
+		}
+	})
+	t.Run("for another process", func(t *testing.T) {
+		listeners, _, err := systemdListeners(envOf(map[string]string{"LISTEN_PID": "99", "LISTEN_FDS": "1"}), 100)
+		if err != nil || len(listeners) != 0 {
+			t.Errorf("unexpected listeners %v or error %v", listeners, err)
+		}
+	})
+	t.Run("bad env", func(t *testing.T) {
+		for _, env := range []map[string]string{
+			{"LISTEN_PID": "abc", "LISTEN_FDS": "1"},
+			{"LISTEN_PID": "100", "LISTEN_FDS": "abc"},
+			{"LISTEN_PID": "100", "LISTEN_FDS": "-1"},
+		} {
+			if _, _, err := systemdListeners(envOf(env), 100); err == nil {
+				t.Errorf("expecting an error for %v", env)
+			}
+		}
+	})
+	t.Run("not a listener", func(t *testing.T) {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := listenersFromFiles([]*os.File{f}); err == nil {
+			t.Error("expecting an error for a file that isn't a socket")
+		}
+	})
+	t.Run("from files", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners, err := listenersFromFiles([]*os.File{f})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listeners[0].Close()
+		if listeners[0].Addr().String() != l.Addr().String() {
+			t.Errorf("expecting a listener on %v, got %v", l.Addr(), listeners[0].Addr())
+		}
+		go func() {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := listeners[0].Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+}
+
+func TestSDNotifier(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	systemd, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer systemd.Close()
+	received := func() string {
+		_ = systemd.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 64)
+		n, err := systemd.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	t.Run("notify", func(t *testing.T) {
+		notifier, err := makeSDNotifier(envOf(map[string]string{"NOTIFY_SOCKET": socket}), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notifier.send("READY=1")
+		if state := received(); state != "READY=1" {
+			t.Errorf("expecting READY=1, got %v", state)
+		}
+	})
+	t.Run("watchdog", func(t *testing.T) {
+		notifier, err := makeSDNotifier(envOf(map[string]string{"NOTIFY_SOCKET": socket, "WATCHDOG_USEC": "20000"}), 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if notifier.watchdogInterval != 20*time.Millisecond {
+			t.Errorf("expecting a watchdog interval of 20ms, got %v", notifier.watchdogInterval)
+		}
+		go notifier.watchdog()
+		if state := received(); state != "WATCHDOG=1" {
+			t.Errorf("expecting WATCHDOG=1, got %v", state)
+		}
+	})
+	t.Run("watchdog for another process", func(t *testing.T) {
+		notifier, _ := makeSDNotifier(envOf(map[string]string{"WATCHDOG_USEC": "20000", "WATCHDOG_PID": "99"}), 100)
+		if notifier.watchdogInterval != 0 {
+			t.Error("watchdog enabled for another process")
+		}
+		if _, err := makeSDNotifier(envOf(map[string]string{"WATCHDOG_USEC": "abc"}), 100); err == nil {
+			t.Error("expecting an error for a bad WATCHDOG_USEC")
+		}
+	})
+	t.Run("not run by systemd", func(t *testing.T) {
+		notifier, _ := makeSDNotifier(envOf(nil), os.Getpid())
+		if err := notifier.notify("READY=1"); err != errNoNotifySocket {
+			t.Errorf("expecting error %v, got %v", errNoNotifySocket, err)
+		}
+		// returns at once
+		notifier.watchdog()
+	})
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// ck-server user add|del|list|set-credit|set-expiry|set-limits manages the users subject to bandwidth and credit controls. If
+// AdminAPIAddr is set and ck-server is listening on it, the users are managed through the admin API, so that the
+// changes apply to its active users right away. Otherwise the user database is opened directly
+
+// userStore is where ck-server user reads and writes users, which a usermanager.UserManager is
+type userStore interface {
+	ListAllUsers() ([]usermanager.UserInfo, error)
+	GetUserInfo(UID []byte) (usermanager.UserInfo, error)
+	WriteUserInfo(usermanager.UserInfo) error
+	DeleteUser(UID []byte) error
+}
+
+const userUsage = `Usage: %v user <command> [-c config] [-direct] [options]
+
+Commands:
+  add [-uid UID] -up-rate n -down-rate n -up-credit n -down-credit n -expiry time [-sessions n] [-source-ips n]
+      [-proxy methods]
+  del <UID>
+  list [-json]
+  set-credit [-up n] [-down n] [-add] <UID>
+  set-expiry <UID> <time>
+  set-limits [-sessions n] [-source-ips n] <UID>
+
+Options come before the UID.
+Sizes are in bytes, or with a suffix of K, M, G or T. Rates are per second. A time is a date (2006-01-02), an
+RFC 3339 time, a unix timestamp, or a duration from now like +30d or +12h.
+`
+
+// runUserCommand runs ck-server user with the arguments after "user", writing what's asked for to out
+func runUserCommand(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, userUsage, os.Args[0])
+		return errors.New("a command is needed")
+	}
+	command := args[0]
+	flags := flag.NewFlagSet("user "+command, flag.ContinueOnError)
+	config := flags.String("c", "server.json", "config: path to the configuration file, or empty to take it from the environment")
+	direct := flags.Bool("direct", false, "Open the user database directly, even if ck-server is listening on AdminAPIAddr")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, userUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	var run func(store userStore) error
+	switch command {
+	case "add":
+		b64UID := flags.String("uid", "", "the UID of the user, a new one is made if it's empty")
+		sessions := flags.Int("sessions", 4, "the number of sessions the user can have at once")
+		sourceIPs := flags.Int("source-ips", 0, "the number of IP addresses the user's sessions can be from at once, any number if it's 0")
+		upRate := flags.String("up-rate", "", "the upload rate in bytes per second")
+		downRate := flags.String("down-rate", "", "the download rate in bytes per second")
+		upCredit := flags.String("up-credit", "", "the upload credit in bytes")
+		downCredit := flags.String("down-credit", "", "the download credit in bytes")
+		expiry := flags.String("expiry", "", "when the user expires")
+		proxyMethods := flags.String("proxy", "", "the comma separated ProxyBook entries the user can use, any of them if it's empty")
+		run = func(store userStore) error {
+			uinfo := usermanager.UserInfo{SessionsCap: int32(*sessions), MaxSourceIPs: int32(*sourceIPs)}
+			var err error
+			if *b64UID == "" {
+				*b64UID = generateUID()
+			}
+			if uinfo.UID, err = parseUID(*b64UID); err != nil {
+				return err
+			}
+			for _, size := range []struct {
+				name  string
+				value string
+				to    *int64
+			}{
+				{"up-rate", *upRate, &uinfo.UpRate},
+				{"down-rate", *downRate, &uinfo.DownRate},
+				{"up-credit", *upCredit, &uinfo.UpCredit},
+				{"down-credit", *downCredit, &uinfo.DownCredit},
+			} {
+				if size.value == "" {
+					return fmt.Errorf("-%v must be set", size.name)
+				}
+				if *size.to, err = parseSize(size.value); err != nil {
+					return fmt.Errorf("bad -%v: %v", size.name, err)
+				}
+			}
+			if *expiry == "" {
+				return errors.New("-expiry must be set")
+			}
+			if uinfo.ExpiryTime, err = parseExpiry(*expiry, time.Now()); err != nil {
+				return err
+			}
+			for _, method := range strings.Split(*proxyMethods, ",") {
+				if method = strings.TrimSpace(method); method != "" {
+					uinfo.ProxyMethods = append(uinfo.ProxyMethods, method)
+				}
+			}
+			if _, err = store.GetUserInfo(uinfo.UID); err == nil {
+				return fmt.Errorf("user %v already exists", b64(uinfo.UID))
+			} else if err != usermanager.ErrUserNotFound {
+				return err
+			}
+			if err = store.WriteUserInfo(uinfo); err != nil {
+				return err
+			}
+			fmt.Fprintln(out, b64(uinfo.UID))
+			return nil
+		}
+	case "del":
+		run = func(store userStore) error {
+			UID, err := parseUID(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			if _, err = store.GetUserInfo(UID); err != nil {
+				return err
+			}
+			return store.DeleteUser(UID)
+		}
+	case "list":
+		asJSON := flags.Bool("json", false, "Print the users in JSON")
+		run = func(store userStore) error {
+			uinfos, err := store.ListAllUsers()
+			if err != nil {
+				return err
+			}
+			if *asJSON {
+				if uinfos == nil {
+					uinfos = []usermanager.UserInfo{}
+				}
+				enc := json.NewEncoder(out)
+				enc.SetIndent("", "  ")
+				return enc.Encode(uinfos)
+			}
+			writeUsers(out, uinfos)
+			return nil
+		}
+	case "set-credit":
+		up := flags.String("up", "", "the upload credit in bytes")
+		down := flags.String("down", "", "the download credit in bytes")
+		add := flags.Bool("add", false, "Add to the credit the user has left, rather than replace it")
+		run = func(store userStore) error {
+			UID, err := parseUID(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			if *up == "" && *down == "" {
+				return errors.New("-up or -down must be set")
+			}
+			uinfo, err := store.GetUserInfo(UID)
+			if err != nil {
+				return err
+			}
+			for _, credit := range []struct {
+				name  string
+				value string
+				to    *int64
+			}{{"up", *up, &uinfo.UpCredit}, {"down", *down, &uinfo.DownCredit}} {
+				if credit.value == "" {
+					continue
+				}
+				size, err := parseSize(credit.value)
+				if err != nil {
+					return fmt.Errorf("bad -%v: %v", credit.name, err)
+				}
+				if *add {
+					*credit.to += size
+				} else {
+					*credit.to = size
+				}
+			}
+			return store.WriteUserInfo(uinfo)
+		}
+	case "set-expiry":
+		run = func(store userStore) error {
+			UID, err := parseUID(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			if flags.NArg() < 2 {
+				return errors.New("the time the user expires is needed")
+			}
+			expiry, err := parseExpiry(flags.Arg(1), time.Now())
+			if err != nil {
+				return err
+			}
+			uinfo, err := store.GetUserInfo(UID)
+			if err != nil {
+				return err
+			}
+			uinfo.ExpiryTime = expiry
+			return store.WriteUserInfo(uinfo)
+		}
+	case "set-limits":
+		sessions := flags.Int("sessions", -1, "the number of sessions the user can have at once")
+		sourceIPs := flags.Int("source-ips", -1, "the number of IP addresses the user's sessions can be from at once, any number if it's 0")
+		run = func(store userStore) error {
+			UID, err := parseUID(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			if *sessions < 0 && *sourceIPs < 0 {
+				return errors.New("-sessions or -source-ips must be set")
+			}
+			uinfo, err := store.GetUserInfo(UID)
+			if err != nil {
+				return err
+			}
+			if *sessions >= 0 {
+				uinfo.SessionsCap = int32(*sessions)
+			}
+			if *sourceIPs >= 0 {
+				uinfo.MaxSourceIPs = int32(*sourceIPs)
+			}
+			return store.WriteUserInfo(uinfo)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, userUsage, os.Args[0])
+		return fmt.Errorf("unknown command %v", command)
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	raw, err := server.ParseConfig(*config)
+	if err != nil {
+		return err
+	}
+	store, closeStore, err := openUserStore(raw, *direct)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	return run(store)
+}
+
+// openUserStore returns the admin API of the running ck-server if it's listening on AdminAPIAddr and direct isn't set,
+// and the user database otherwise, along with what closes it
+func openUserStore(raw server.RawConfig, direct bool) (userStore, func(), error) {
+	if raw.AdminAPIAddr != "" && !direct {
+		store, err := makeAdminAPIStore(raw)
+		if err != nil {
+			return nil, nil, err
+		}
+		conn, err := store.dial(context.Background())
+		if err == nil {
+			conn.Close()
+			return store, func() {}, nil
+		}
+		log.Infof("ck-server isn't listening on %v, opening the user database directly", raw.AdminAPIAddr)
+	}
+	manager, err := server.OpenUserManager(raw, common.RealWorldState)
+	if err != nil {
+		return nil, nil, err
+	}
+	return manager, func() {
+		if closer, ok := manager.(io.Closer); ok {
+			closer.Close()
+		}
+	}, nil
+}
+
+// adminAPIStore manages users through the admin API v2 of a running ck-server
+type adminAPIStore struct {
+	client *http.Client
+	// the scheme and host of AdminAPIAddr
+	base  string
+	token string
+	dial  func(ctx context.Context) (net.Conn, error)
+}
+
+func makeAdminAPIStore(raw server.RawConfig) (*adminAPIStore, error) {
+	network, addr := "tcp", raw.AdminAPIAddr
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	store := &adminAPIStore{base: "http://" + raw.AdminAPIAddr, token: raw.AdminAPIToken}
+	if network == "unix" {
+		// the host doesn't matter as it's not what's connected to
+		store.base = "http://unix"
+	}
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+	store.dial = func(ctx context.Context) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) { return store.dial(ctx) },
+	}
+	if raw.AdminAPICert != "" {
+		pinned, err := readCertificate(raw.AdminAPICert)
+		if err != nil {
+			return nil, err
+		}
+		store.base = "https" + strings.TrimPrefix(store.base, "http")
+		// the certificate is the one in AdminAPICert, whatever it's issued for
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: true,
+			VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+				if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+					return errors.New("the admin API's certificate isn't the one in AdminAPICert")
+				}
+				return nil
+			},
+		}
+	}
+	store.client = &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	return store, nil
+}
+
+// readCertificate reads the first certificate in the PEM file at path, in DER
+func readCertificate(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no certificate in %v", path)
+		}
+		if block.Type == "CERTIFICATE" {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// do sends a request to the admin API and decodes what it returns into v, unless v is nil
+func (s *adminAPIStore) do(method string, path string, body interface{}, v interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, s.base+"/v2"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return usermanager.ErrUserNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		var apiErr struct{ Error string }
+		if json.NewDecoder(resp.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+			apiErr.Error = resp.Status
+		}
+		return fmt.Errorf("admin API: %v", apiErr.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (s *adminAPIStore) ListAllUsers() (uinfos []usermanager.UserInfo, err error) {
+	err = s.do("GET", "/users", nil, &uinfos)
+	return
+}
+
+func (s *adminAPIStore) GetUserInfo(UID []byte) (uinfo usermanager.UserInfo, err error) {
+	err = s.do("GET", "/users/"+base64.URLEncoding.EncodeToString(UID), nil, &uinfo)
+	return
+}
+
+func (s *adminAPIStore) WriteUserInfo(uinfo usermanager.UserInfo) error {
+	return s.do("PUT", "/users/"+base64.URLEncoding.EncodeToString(uinfo.UID), uinfo, nil)
+}
+
+func (s *adminAPIStore) DeleteUser(UID []byte) error {
+	return s.do("DELETE", "/users/"+base64.URLEncoding.EncodeToString(UID), nil, nil)
+}
+
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// parseUID takes a UID in either standard or URL safe base64
+func parseUID(b64UID string) ([]byte, error) {
+	if b64UID == "" {
+		return nil, errors.New("a UID is needed")
+	}
+	UID, err := base64.StdEncoding.DecodeString(b64UID)
+	if err != nil {
+		UID, err = base64.URLEncoding.DecodeString(b64UID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("UID %v isn't in base64", b64UID)
+	}
+	if len(UID) != 16 {
+		return nil, fmt.Errorf("UID must be 16 bytes, got %v", len(UID))
+	}
+	return UID, nil
+}
+
+var sizeUnits = map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+
+// parseSize takes a number of bytes, optionally with a suffix of K, M, G or T in powers of 1024, e.g. 10G
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(s), "B"))
+	if s == "" {
+		return 0, errors.New("empty size")
+	}
+	unit := int64(1)
+	if u, ok := sizeUnits[s[len(s)-1]]; ok {
+		unit = u
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%v isn't a size", s)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// formatSize writes n bytes with the largest suffix of parseSize it has at least one of
+func formatSize(n int64) string {
+	for _, suffix := range []byte("TGMK") {
+		if unit := sizeUnits[suffix]; n >= unit {
+			return fmt.Sprintf("%.4g%c", float64(n)/float64(unit), suffix)
+		}
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// parseExpiry takes a date, an RFC 3339 time, a unix timestamp or a duration after now prefixed with +, in which d is
+// a day, and returns it as a unix timestamp
+func parseExpiry(s string, now time.Time) (int64, error) {
+	if strings.HasPrefix(s, "+") {
+		s = s[1:]
+		if strings.HasSuffix(s, "d") {
+			days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+			if err != nil {
+				return 0, fmt.Errorf("bad expiry +%v", s)
+			}
+			return now.Add(time.Duration(days) * 24 * time.Hour).Unix(), nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("bad expiry +%v", s)
+		}
+		return now.Add(d).Unix(), nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Unix(), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.Unix(), nil
+	}
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return unix, nil
+	}
+	return 0, fmt.Errorf("bad expiry %v", s)
+}
+
+func writeUsers(out io.Writer, uinfos []usermanager.UserInfo) {
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UID\tSESSIONS\tSOURCE IPS\tUP RATE\tDOWN RATE\tUP CREDIT\tDOWN CREDIT\tEXPIRY\tPROXY METHODS")
+	for _, uinfo := range uinfos {
+		proxyMethods := strings.Join(uinfo.ProxyMethods, ",")
+		if proxyMethods == "" {
+			proxyMethods = "*"
+		}
+		sourceIPs := "*"
+		if uinfo.MaxSourceIPs > 0 {
+			sourceIPs = strconv.Itoa(int(uinfo.MaxSourceIPs))
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v/s\t%v/s\t%v\t%v\t%v\t%v\n", b64(uinfo.UID), uinfo.SessionsCap, sourceIPs,
+			formatSize(uinfo.UpRate), formatSize(uinfo.DownRate), formatSize(uinfo.UpCredit), formatSize(uinfo.DownCredit),
+			time.Unix(uinfo.ExpiryTime, 0).UTC().Format(time.RFC3339), proxyMethods)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/server"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{"1024": 1024, "10K": 10240, "1.5m": 1572864, "2G": 2 << 30, "1TB": 1 << 40} {
+		got, err := parseSize(s)
+		if err != nil || got != want {
+			t.Errorf("%v: expecting %v, got %v %v", s, want, got, err)
+		}
+		if back, _ := parseSize(formatSize(got)); back != got {
+			t.Errorf("%v is formatted as %v", got, formatSize(got))
+		}
+	}
+	for _, s := range []string{"", "K", "-1", "ten"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("expecting an error for %q", s)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	for s, want := range map[string]int64{
+		"+30d":                 now.Unix() + 30*24*3600,
+		"+12h":                 now.Unix() + 12*3600,
+		"2030-01-02":           1893542400,
+		"2030-01-02T00:00:00Z": 1893542400,
+		"1893542400":           1893542400,
+	} {
+		got, err := parseExpiry(s, now)
+		if err != nil || got != want {
+			t.Errorf("%v: expecting %v, got %v %v", s, want, got, err)
+		}
+	}
+	for _, s := range []string{"+d", "+soon", "tomorrow"} {
+		if _, err := parseExpiry(s, now); err == nil {
+			t.Errorf("expecting an error for %q", s)
+		}
+	}
+}
+
+func TestRunUserCommand_Direct(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ck_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "ckserver.json")
+	if err = ioutil.WriteFile(config, []byte(`{"DatabasePath": "`+filepath.Join(dir, "userinfo.db")+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := runUserCommand(append(args[:1:1], append([]string{"-c", config}, args[1:]...)...), &out)
+		return out.String(), err
+	}
+
+	UID := "5nneblJy6lniPJfr81LuYQ=="
+	if _, err = run("add", "-uid", UID, "-up-rate", "1M", "-down-rate", "2M", "-up-credit", "10G", "-down-credit", "20G", "-expiry", "2030-01-02", "-proxy", "shadowsocks"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run("add", "-uid", UID, "-up-rate", "1M", "-down-rate", "2M", "-up-credit", "10G", "-down-credit", "20G", "-expiry", "+1d"); err == nil {
+		t.Error("expecting an error adding an existing user")
+	}
+	if _, err = run("add", "-up-rate", "1M"); err == nil {
+		t.Error("expecting an error without the credits and expiry")
+	}
+	if _, err = run("set-credit", "-up", "1G", "-add", UID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run("set-expiry", UID, "1893628800"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run("set-limits", "-source-ips", "2", UID); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run("list", "-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uinfos []usermanager.UserInfo
+	if err = json.Unmarshal([]byte(out), &uinfos); err != nil {
+		t.Fatal(err)
+	}
+	if len(uinfos) != 1 || uinfos[0].UpCredit != 11<<30 || uinfos[0].DownCredit != 20<<30 || uinfos[0].UpRate != 1<<20 ||
+		uinfos[0].ExpiryTime != 1893628800 || len(uinfos[0].ProxyMethods) != 1 || uinfos[0].SessionsCap != 4 ||
+		uinfos[0].MaxSourceIPs != 2 {
+		t.Errorf("wrong users %+v", uinfos)
+	}
+	if out, _ = run("list"); !strings.Contains(out, UID) || !strings.Contains(out, "11G") {
+		t.Errorf("unexpected list %q", out)
+	}
+
+	if _, err = run("del", UID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run("del", UID); err != usermanager.ErrUserNotFound {
+		t.Errorf("expecting ErrUserNotFound, got %v", err)
+	}
+	if _, err = run("rename", UID); err == nil {
+		t.Error("expecting an error for an unknown command")
+	}
+}
+
+func TestAdminAPIStore(t *testing.T) {
+	users := map[string]usermanager.UserInfo{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(struct{ Error string }{"invalid token"})
+			return
+		}
+		b64UID := strings.TrimPrefix(r.URL.Path, "/v2/users/")
+		switch {
+		case r.URL.Path == "/v2/users":
+			var uinfos []usermanager.UserInfo
+			for _, uinfo := range users {
+				uinfos = append(uinfos, uinfo)
+			}
+			json.NewEncoder(w).Encode(uinfos)
+		case r.Method == "PUT":
+			var uinfo usermanager.UserInfo
+			json.NewDecoder(r.Body).Decode(&uinfo)
+			users[b64UID] = uinfo
+			json.NewEncoder(w).Encode(uinfo)
+		case r.Method == "GET" || r.Method == "DELETE":
+			uinfo, ok := users[b64UID]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == "DELETE" {
+				delete(users, b64UID)
+			}
+			json.NewEncoder(w).Encode(uinfo)
+		}
+	}))
+	defer api.Close()
+	addr := api.Listener.Addr().String()
+
+	store, closeStore, err := openUserStore(server.RawConfig{AdminAPIAddr: addr, AdminAPIToken: "token"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+	if _, ok := store.(*adminAPIStore); !ok {
+		t.Fatalf("expecting the admin API to be used, got %T", store)
+	}
+
+	UID := make([]byte, 16)
+	UID[0] = 0xfb
+	if _, err = store.GetUserInfo(UID); err != usermanager.ErrUserNotFound {
+		t.Errorf("expecting ErrUserNotFound, got %v", err)
+	}
+	if err = store.WriteUserInfo(usermanager.UserInfo{UID: UID, UpCredit: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if uinfo, err := store.GetUserInfo(UID); err != nil || uinfo.UpCredit != 10 {
+		t.Errorf("wrong user %+v %v", uinfo, err)
+	}
+	if uinfos, err := store.ListAllUsers(); err != nil || len(uinfos) != 1 {
+		t.Errorf("wrong users %+v %v", uinfos, err)
+	}
+	if err = store.DeleteUser(UID); err != nil || len(users) != 0 {
+		t.Errorf("user isn't deleted: %v", err)
+	}
+
+	badToken, _, _ := openUserStore(server.RawConfig{AdminAPIAddr: addr, AdminAPIToken: "wrong"}, false)
+	if _, err = badToken.ListAllUsers(); err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Errorf("expecting an error of the invalid token, got %v", err)
+	}
+
+	// nothing listens here, so the user database is opened instead
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := listener.Addr().String()
+	listener.Close()
+	dir, err := ioutil.TempDir("", "ck_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, closeLocal, err := openUserStore(server.RawConfig{AdminAPIAddr: closed, DatabasePath: filepath.Join(dir, "userinfo.db")}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeLocal()
+	if _, ok := local.(*adminAPIStore); ok {
+		t.Error("the admin API is used when nothing listens on it")
+	}
+}
@@ -0,0 +1,18 @@
+// Package cloak lets other Go programs, such as the proxy servers and clients Cloak is a plugin of, embed Cloak's
+// client and server instead of running ck-client and ck-server alongside them.
+//
+// A Client is made with Dial from the same config as ckclient.json, and opens streams in its sessions that are
+// relayed by the server to ProxyMethod, or to a target of their own with a "direct" ProxyMethod:
+//
+//	c, err := cloak.Dial(ctx, cloak.ClientConfig{...})
+//	conn, err := c.OpenStream()
+//
+// A Server is made with NewServer from the same config as ckserver.json, and serves the listeners it's given:
+//
+//	s, err := cloak.NewServer(cloak.ServerConfig{...})
+//	err = s.Serve(l)
+//
+// What's listened on by ck-client and ck-server themselves, i.e. LocalHost:LocalPort, BindAddr, the admin API and the
+// like, isn't listened on by either of them. They log with logrus, whose standard logger the embedding program
+// configures
+package cloak
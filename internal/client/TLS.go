@@ -1,10 +1,16 @@
 package client
 
 import (
+	"bytes"
+	"crypto/mlkem"
 	"encoding/binary"
+	"errors"
 	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net"
+	"sync/atomic"
 )
 
 const appDataMaxLength = 16401
@@ -13,11 +19,127 @@ type clientHelloFields struct {
 	random         []byte
 	sessionId      []byte
 	x25519KeyShare []byte
-	sni            []byte
+	serverName     string
+	// if not nil, the encrypted_client_hello extension pretends to carry innerServerName encrypted with this config,
+	// and serverName is the public name of the config. Only Parrot supports it
+	echConfig       *echConfig
+	innerServerName string
+	// if not nil, the ML-KEM-768 encapsulation key in the X25519MLKEM768 key share. Only Parrot supports it
+	mlkemKeyShare []byte
+	// if not nil, the ClientHello looks like it resumes a session with this ticket. Only Parrot supports it
+	psk *pskOffer
 }
 
+// pskOffer is what goes into the pre_shared_key extension of a ClientHello that resumes a session. There's no session
+// to resume, as the tickets we're issued are random bytes, so they're all made up
+type pskOffer struct {
+	identity      []byte
+	obfuscatedAge uint32
+	binder        []byte
+}
+
+// makePSKOffer makes up an offer of a ticket of ticketLength, as issued by a TLS 1.3 server with a SHA-256 cipher
+// suite. The obfuscated age of a real ticket is offset by the random ticket_age_add of the server
+func makePSKOffer(randSource io.Reader, ticketLength int) *pskOffer {
+	offer := &pskOffer{
+		identity: make([]byte, ticketLength),
+		binder:   make([]byte, 32),
+	}
+	common.RandRead(randSource, offer.identity)
+	common.RandRead(randSource, offer.binder)
+	age := make([]byte, 4)
+	common.RandRead(randSource, age)
+	offer.obfuscatedAge = binary.BigEndian.Uint32(age)
+	return offer
+}
+
+// sessionTickets is shared by the connections to a server, and remembers if we've been issued tickets by it so that
+// later handshakes can look like they resume with them
+type sessionTickets struct {
+	// the length of the tickets the server issues
+	length int
+	issued atomic.Bool
+}
+
+var pskKeyExchangeModesExtensionType = [2]byte{0x00, 0x2d}
+var pskExtensionType = [2]byte{0x00, 0x29}
+var paddingExtensionType = [2]byte{0x00, 0x15}
+
+// addPSKExtension appends a pre_shared_key extension with offer to the extensions of clientHello, which has to be the
+// last one, along with psk_key_exchange_modes if clientHello doesn't have it. The padding extension is shortened by as
+// much as the ClientHello has grown if it can be, as the padding is worked out with the pre_shared_key in it
+func addPSKExtension(clientHello []byte, offer *pskOffer) (ret []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed ClientHello")
+		}
+	}()
+	// handshake header, version and random
+	pointer := 4 + 2 + 32
+	pointer += 1 + int(clientHello[pointer])                           // session id
+	pointer += 2 + int(binary.BigEndian.Uint16(clientHello[pointer:])) // cipher suites
+	pointer += 1 + int(clientHello[pointer])                           // compression methods
+	extensionsLength := int(binary.BigEndian.Uint16(clientHello[pointer:]))
+	head := clientHello[:pointer]
+	extensions := clientHello[pointer+2 : pointer+2+extensionsLength]
+
+	identities := make([]byte, 2+len(offer.identity)+4)
+	binary.BigEndian.PutUint16(identities[0:2], uint16(len(offer.identity)))
+	copy(identities[2:], offer.identity)
+	binary.BigEndian.PutUint32(identities[2+len(offer.identity):], offer.obfuscatedAge)
+	binders := append([]byte{byte(len(offer.binder))}, offer.binder...)
+	var psk []byte
+	psk = binary.BigEndian.AppendUint16(psk, uint16(len(identities)))
+	psk = append(psk, identities...)
+	psk = binary.BigEndian.AppendUint16(psk, uint16(len(binders)))
+	psk = append(psk, binders...)
+	pskExtension := addExtRec(pskExtensionType[:], psk)
+
+	var kept []byte
+	hasModes := false
+	paddingLength := -1
+	for i := 0; i < len(extensions); {
+		typ := [2]byte{extensions[i], extensions[i+1]}
+		length := int(binary.BigEndian.Uint16(extensions[i+2 : i+4]))
+		data := extensions[i+4 : i+4+length]
+		i += 4 + length
+		switch typ {
+		case pskKeyExchangeModesExtensionType:
+			hasModes = true
+		case paddingExtensionType:
+			// it goes right before pre_shared_key
+			paddingLength = length
+			continue
+		}
+		kept = append(kept, addExtRec(typ[:], data)...)
+	}
+	added := len(pskExtension)
+	if !hasModes {
+		// psk_dhe_ke
+		modes := addExtRec(pskKeyExchangeModesExtensionType[:], []byte{0x01, 0x01})
+		kept = append(kept, modes...)
+		added += len(modes)
+	}
+	if paddingLength >= 0 {
+		kept = append(kept, addExtRec(paddingExtensionType[:], make([]byte, max(0, paddingLength-added)))...)
+	}
+	kept = append(kept, pskExtension...)
+
+	ret = append(append([]byte{}, head...), 0, 0)
+	binary.BigEndian.PutUint16(ret[len(ret)-2:], uint16(len(kept)))
+	ret = append(ret, kept...)
+	length := len(ret) - 4
+	ret[1], ret[2], ret[3] = byte(length>>16), byte(length>>8), byte(length)
+	return ret, nil
+}
+
+var x25519MLKEM768Group = []byte{0x11, 0xec}
+
+var errECHUnsupported = errors.New("this ClientHello doesn't support ECH")
+var errResumptionUnsupported = errors.New("this ClientHello doesn't support resumption")
+
 type browser interface {
-	composeClientHello(clientHelloFields) []byte
+	composeClientHello(clientHelloFields) ([]byte, error)
 }
 
 func makeServerName(serverName string) []byte {
@@ -51,20 +173,60 @@ func genStegClientHello(ai authenticationPayload, serverName string) (ret client
 	ret.random = ai.randPubKey[:]
 	ret.sessionId = ai.ciphertextWithTag[0:32]
 	ret.x25519KeyShare = ai.ciphertextWithTag[32:64]
-	ret.sni = makeServerName(serverName)
+	ret.serverName = serverName
 	return
 }
 
 type DirectTLS struct {
 	*common.TLSConn
 	browser browser
+	// the ECHConfig of the ServerName if one is known. Without one, ECH is GREASEd if the browser does it
+	echConfig *echConfig
+	// whether the browser sends an X25519MLKEM768 key share, in which case the server is offered a hybrid key
+	// exchange with our ML-KEM key in it
+	postQuantum bool
+	// if not nil, handshakes after the first one with the server look like they resume with a ticket it issued
+	tickets *sessionTickets
+
+	// with early data, the server's reply is read in the background and closed once it has been. Reads wait for it
+	serverFlight    chan struct{}
+	serverFlightErr error
 }
 
+var errEarlyDataRejected = errors.New("server didn't take the early session key")
+
 // NewClientTransport handles the TLS handshake for a given conn and returns the sessionKey
-// if the server proceed with Cloak authentication
+// if the server proceed with Cloak authentication. With early data, it returns as soon as the ClientHello is sent, with
+// the early session key to send frames under, and the server's reply is read before anything else
 func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	var mlkemKey *mlkem.DecapsulationKey768
+	if tls.postQuantum {
+		mlkemKey, err = ecdh.GenerateMLKEMKey(authInfo.WorldState.Rand)
+		if err != nil {
+			return
+		}
+		// the early session key can't wait for the server's ML-KEM ciphertext, so with early data the key share is
+		// only sent for the look of the browser, and the server replies with x25519
+		authInfo.PostQuantum = !authInfo.EarlyData
+	}
 	payload, sharedSecret := makeAuthenticationPayload(authInfo)
-	chOnly := tls.browser.composeClientHello(genStegClientHello(payload, authInfo.MockDomain))
+	fields := genStegClientHello(payload, authInfo.MockDomain)
+	if mlkemKey != nil {
+		fields.mlkemKeyShare = mlkemKey.EncapsulationKey().Bytes()
+	}
+	if tls.tickets != nil && tls.tickets.issued.Load() {
+		fields.psk = makePSKOffer(authInfo.WorldState.Rand, tls.tickets.length)
+	}
+	if tls.echConfig != nil {
+		// the real server name only appears in the encrypted ClientHelloInner
+		fields.echConfig = tls.echConfig
+		fields.innerServerName = authInfo.MockDomain
+		fields.serverName = tls.echConfig.publicName
+	}
+	chOnly, err := tls.browser.composeClientHello(fields)
+	if err != nil {
+		return
+	}
 	chWithRecordLayer := common.AddRecordLayer(chOnly, common.Handshake, common.VersionTLS11)
 	_, err = rawConn.Write(chWithRecordLayer)
 	if err != nil {
@@ -73,14 +235,88 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 	log.Trace("client hello sent successfully")
 	tls.TLSConn = &common.TLSConn{Conn: rawConn}
 
-	buf := make([]byte, 1024)
+	if authInfo.EarlyData {
+		sessionKey = common.EarlySessionKey(sharedSecret[:])
+		tls.serverFlight = make(chan struct{})
+		go func() {
+			defer close(tls.serverFlight)
+			var sk [32]byte
+			sk, tls.serverFlightErr = tls.readServerFlight(sharedSecret, mlkemKey)
+			if tls.serverFlightErr == nil && sk != sessionKey {
+				tls.serverFlightErr = errEarlyDataRejected
+			}
+			if tls.serverFlightErr != nil {
+				log.Errorf("Failed to read the server's reply to early data: %v", tls.serverFlightErr)
+			}
+		}()
+		return
+	}
+	return tls.readServerFlight(sharedSecret, mlkemKey)
+}
+
+var errBadServerHello = errors.New("malformed ServerHello")
+
+// findServerKeyShare returns the group and the key exchange of the key_share extension of serverHello. Servers that
+// don't follow the extension order of the cover site always put it first
+func findServerKeyShare(serverHello []byte) (group []byte, keyExchange []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errBadServerHello
+		}
+	}()
+	// so that reading past the end panics even if there's room in the buffer
+	serverHello = serverHello[:len(serverHello):len(serverHello)]
+	// handshake header, version, random, session id, cipher suite and compression method
+	pointer := 4 + 2 + 32
+	pointer += 1 + int(serverHello[pointer])
+	pointer += 2 + 1
+	extensionsEnd := pointer + 2 + int(binary.BigEndian.Uint16(serverHello[pointer:]))
+	pointer += 2
+	for pointer < extensionsEnd {
+		typ := serverHello[pointer : pointer+2]
+		length := int(binary.BigEndian.Uint16(serverHello[pointer+2 : pointer+4]))
+		data := serverHello[pointer+4 : pointer+4+length]
+		pointer += 4 + length
+		if bytes.Equal(typ, []byte{0x00, 0x33}) {
+			keyExchangeLength := int(binary.BigEndian.Uint16(data[2:4]))
+			return data[0:2], data[4 : 4+keyExchangeLength], nil
+		}
+	}
+	return nil, nil, errBadServerHello
+}
+
+// readServerFlight reads the ServerHello, ChangeCipherSpec and the encrypted handshake records after it, and returns
+// the session key in the ServerHello
+func (tls *DirectTLS) readServerFlight(sharedSecret [32]byte, mlkemKey *mlkem.DecapsulationKey768) (sessionKey [32]byte, err error) {
+	buf := make([]byte, appDataMaxLength)
 	log.Trace("waiting for ServerHello")
-	_, err = tls.Read(buf)
+	n, err := tls.TLSConn.Read(buf)
 	if err != nil {
 		return
 	}
-
-	encrypted := append(buf[6:38], buf[84:116]...)
+	// the encrypted session key is in the random and the x25519 key share of the ServerHello. If the server has taken
+	// the hybrid key exchange, the key share is X25519MLKEM768, whose x25519 part follows the ML-KEM ciphertext
+	group, keyExchange, err := findServerKeyShare(buf[:n])
+	if err != nil {
+		return
+	}
+	if mlkemKey != nil && len(keyExchange) == ecdh.MLKEMCiphertextSize+32 && bytes.Equal(group, x25519MLKEM768Group) {
+		var mlkemSecret []byte
+		mlkemSecret, err = mlkemKey.Decapsulate(keyExchange[:ecdh.MLKEMCiphertextSize])
+		if err != nil {
+			return
+		}
+		sharedSecret = ecdh.HybridSharedSecret(sharedSecret[:], mlkemSecret)
+		keyExchange = keyExchange[ecdh.MLKEMCiphertextSize:]
+		log.Trace("server has taken the hybrid key exchange")
+	}
+	if len(keyExchange) != 32 {
+		err = errBadServerHello
+		return
+	}
+	encrypted := make([]byte, 0, 64)
+	encrypted = append(encrypted, buf[6:38]...)
+	encrypted = append(encrypted, keyExchange...)
 	nonce := encrypted[0:12]
 	ciphertextWithTag := encrypted[12:60]
 	sessionKeySlice, err := common.AESGCMDecrypt(nonce, sharedSecret[:], ciphertextWithTag)
@@ -89,13 +325,37 @@ func (tls *DirectTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 	}
 	copy(sessionKey[:], sessionKeySlice)
 
-	for i := 0; i < 2; i++ {
-		// ChangeCipherSpec and EncryptedCert (in the format of application data)
-		_, err = tls.Read(buf)
+	// the last 4 bytes of the key share tell us how many encrypted handshake records follow. Servers that don't
+	// send this hint always send one such record
+	numRecords := 1
+	for n := 1; n <= common.MaxTranscriptRecords; n++ {
+		if bytes.Equal(encrypted[60:64], common.RecordCountHint(sharedSecret[:], n)) {
+			numRecords = n
+			break
+		}
+	}
+	log.Tracef("expecting %v encrypted handshake records", numRecords)
+
+	// ChangeCipherSpec and the encrypted handshake records (in the format of application data), which include the
+	// session tickets
+	for i := 0; i < 1+numRecords; i++ {
+		_, err = tls.TLSConn.Read(buf)
 		if err != nil {
 			return
 		}
 	}
+	if tls.tickets != nil {
+		tls.tickets.issued.Store(true)
+	}
 	return sessionKey, nil
+}
 
+func (tls *DirectTLS) Read(buf []byte) (n int, err error) {
+	if tls.serverFlight != nil {
+		<-tls.serverFlight
+		if tls.serverFlightErr != nil {
+			return 0, tls.serverFlightErr
+		}
+	}
+	return tls.TLSConn.Read(buf)
 }
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"testing"
 )
@@ -41,3 +42,101 @@ func TestMakeServerName(t *testing.T) {
 		}
 	}
 }
+
+func TestAddPSKExtension(t *testing.T) {
+	// handshake header, version, random, session id, one cipher suite, null compression, then the extensions
+	hello := func(extensions ...[]byte) []byte {
+		ch := append([]byte{0x01, 0, 0, 0, 0x03, 0x03}, make([]byte, 32)...)
+		ch = append(ch, 0, 0x00, 0x02, 0x13, 0x01, 0x01, 0x00)
+		joined := bytes.Join(extensions, nil)
+		ch = binary.BigEndian.AppendUint16(ch, uint16(len(joined)))
+		ch = append(ch, joined...)
+		length := len(ch) - 4
+		ch[1], ch[2], ch[3] = byte(length>>16), byte(length>>8), byte(length)
+		return ch
+	}
+	offer := &pskOffer{identity: bytes.Repeat([]byte{0xaa}, 160), obfuscatedAge: 0x01020304, binder: bytes.Repeat([]byte{0xbb}, 32)}
+	sni := addExtRec([]byte{0x00, 0x00}, makeServerName("www.example.com"))
+	modes := addExtRec(pskKeyExchangeModesExtensionType[:], []byte{0x01, 0x01})
+
+	t.Run("modes added", func(t *testing.T) {
+		ch, err := addPSKExtension(hello(sni), offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(ch[1])<<16|int(ch[2])<<8|int(ch[3]) != len(ch)-4 {
+			t.Errorf("wrong length %x", ch[1:4])
+		}
+		if !bytes.Contains(ch, append(sni, modes...)) {
+			t.Error("psk_key_exchange_modes not added after the other extensions")
+		}
+		psk := ch[len(ch)-4-2-2-160-4-2-1-32:]
+		if !bytes.Equal(psk[:4], []byte{0x00, 0x29, 0x00, 0xcb}) {
+			t.Errorf("pre_shared_key isn't the last extension: %x", psk[:4])
+		}
+		if !bytes.Contains(psk, []byte{0xaa, 0x01, 0x02, 0x03, 0x04, 0x00, 0x21, 0x20, 0xbb}) {
+			t.Error("obfuscated ticket age or binder not found")
+		}
+	})
+	t.Run("padding shortened", func(t *testing.T) {
+		padding := addExtRec(paddingExtensionType[:], make([]byte, 300))
+		original := hello(sni, padding, modes)
+		ch, err := addPSKExtension(original, offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ch) != len(original) {
+			t.Errorf("expecting the length to stay at %v, got %v", len(original), len(ch))
+		}
+		if !bytes.Contains(ch, append(modes, paddingExtensionType[:]...)) {
+			t.Error("padding isn't moved to right before pre_shared_key")
+		}
+	})
+	t.Run("malformed", func(t *testing.T) {
+		if _, err := addPSKExtension([]byte{0x01, 0, 0, 0}, offer); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func TestFindServerKeyShare(t *testing.T) {
+	// handshake header, version, random, session id of 32 bytes, cipher suite and null compression
+	serverHello := func(extensions ...[]byte) []byte {
+		sh := append([]byte{0x02, 0, 0, 0, 0x03, 0x03}, make([]byte, 32)...)
+		sh = append(sh, 0x20)
+		sh = append(sh, make([]byte, 32)...)
+		sh = append(sh, 0x13, 0x02, 0x00)
+		joined := bytes.Join(extensions, nil)
+		sh = binary.BigEndian.AppendUint16(sh, uint16(len(joined)))
+		return append(sh, joined...)
+	}
+	keyExchange := bytes.Repeat([]byte{0x47}, 32)
+	keyShare := addExtRec([]byte{0x00, 0x33}, append([]byte{0x00, 0x1d, 0x00, 0x20}, keyExchange...))
+	supportedVersions := addExtRec([]byte{0x00, 0x2b}, []byte{0x03, 0x04})
+
+	for name, sh := range map[string][]byte{
+		"key share first":  serverHello(keyShare, supportedVersions),
+		"key share second": serverHello(supportedVersions, keyShare),
+	} {
+		t.Run(name, func(t *testing.T) {
+			group, got, err := findServerKeyShare(sh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(group, []byte{0x00, 0x1d}) || !bytes.Equal(got, keyExchange) {
+				t.Errorf("expecting an x25519 key share of %x, got %x of %x", keyExchange, got, group)
+			}
+		})
+	}
+	t.Run("no key share", func(t *testing.T) {
+		if _, _, err := findServerKeyShare(serverHello(supportedVersions)); err != errBadServerHello {
+			t.Errorf("expecting %v, got %v", errBadServerHello, err)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		sh := serverHello(supportedVersions, keyShare)
+		if _, _, err := findServerKeyShare(sh[:len(sh)-10]); err != errBadServerHello {
+			t.Errorf("expecting %v, got %v", errBadServerHello, err)
+		}
+	})
+}
@@ -2,12 +2,36 @@ package client
 
 import (
 	"encoding/binary"
+	"time"
+
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/ecdh"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
+
+const (
+	UNORDERED_FLAG    = 0x01 // 0000 0001
+	TRANSCRIPT_FLAG   = 0x02 // 0000 0010
+	POST_QUANTUM_FLAG = 0x04 // 0000 0100
+	MULTIPATH_FLAG    = 0x08 // 0000 1000
+	DUPLICATE_FLAG    = 0x10 // 0001 0000
+	RESUMABLE_FLAG    = 0x20 // 0010 0000
+	// the client reads why its session is closed from the closing frame
+	CLOSE_REASONS_FLAG = 0x40 // 0100 0000
+	// the client sends frames under the early session key right after its ClientHello
+	EARLY_DATA_FLAG = 0x80 // 1000 0000
 )
 
+// in the second byte of flags
 const (
-	UNORDERED_FLAG = 0x01 // 0000 0001
+	// the client finds the key share of the ServerHello among extensions in any order
+	EXTENSION_ORDER_FLAG = 0x01 // 0000 0001
+	// the client opens new sessions elsewhere when its server says it's draining
+	DRAIN_FLAG = 0x02 // 0000 0010
+	// the client takes C_WINDOW frames and limits what it sends by them
+	FLOW_CONTROL_FLAG = 0x04 // 0000 0100
+	// the client compresses the frames of its streams, and wants those sent to it compressed
+	COMPRESSION_FLAG = 0x08 // 0000 1000
 )
 
 type authenticationPayload struct {
@@ -20,11 +44,11 @@ type authenticationPayload struct {
 func makeAuthenticationPayload(authInfo AuthInfo) (ret authenticationPayload, sharedSecret [32]byte) {
 	/*
 		Authentication data:
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
-		|  _UID_   | _Proxy Method_ | _Encryption Method_ | _Timestamp_ | _Session Id_ | _Flag_ | _reserved_ |
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
-		| 16 bytes | 12 bytes       | 1 byte              | 8 bytes     | 4 bytes      | 1 byte | 6 bytes    |
-		+----------+----------------+---------------------+-------------+--------------+--------+------------+
+		+----------+----------------+---------------------+-------------+--------------+--------+--------------+-------------+-------------------+----------+------------+
+		|  _UID_   | _Proxy Method_ | _Encryption Method_ | _Timestamp_ | _Session Id_ | _Flag_ | _FEC Shards_ | _Heartbeat_ | _Traffic Profile_ | _Flag 2_ | _Version_  |
+		+----------+----------------+---------------------+-------------+--------------+--------+--------------+-------------+-------------------+----------+------------+
+		| 16 bytes | 12 bytes       | 1 byte              | 8 bytes     | 4 bytes      | 1 byte | 2 bytes      | 1 byte      | 1 byte            | 1 byte   | 1 byte     |
+		+----------+----------------+---------------------+-------------+--------------+--------+--------------+-------------+-------------------+----------+------------+
 	*/
 	ephPv, ephPub, _ := ecdh.GenerateKey(authInfo.WorldState.Rand)
 	copy(ret.randPubKey[:], ecdh.Marshal(ephPub))
@@ -39,6 +63,42 @@ func makeAuthenticationPayload(authInfo AuthInfo) (ret authenticationPayload, sh
 	if authInfo.Unordered {
 		plaintext[41] |= UNORDERED_FLAG
 	}
+	// we read as many encrypted handshake records as the server's record count hint tells us
+	plaintext[41] |= TRANSCRIPT_FLAG
+	if authInfo.PostQuantum {
+		plaintext[41] |= POST_QUANTUM_FLAG
+	}
+	if authInfo.Multipath {
+		plaintext[41] |= MULTIPATH_FLAG
+	}
+	if authInfo.Duplicate {
+		plaintext[41] |= DUPLICATE_FLAG
+	}
+	if authInfo.Resumable {
+		plaintext[41] |= RESUMABLE_FLAG
+	}
+	if authInfo.CloseReasons {
+		plaintext[41] |= CLOSE_REASONS_FLAG
+	}
+	if authInfo.EarlyData {
+		plaintext[41] |= EARLY_DATA_FLAG
+	}
+	plaintext[42] = byte(authInfo.FECDataShards)
+	plaintext[43] = byte(authInfo.FECParityShards)
+	// in seconds
+	plaintext[44] = byte(authInfo.Heartbeat / time.Second)
+	plaintext[45] = authInfo.TrafficProfile
+	// we look for the key share of the ServerHello wherever it is
+	plaintext[46] |= EXTENSION_ORDER_FLAG
+	// and take a C_DRAIN frame
+	plaintext[46] |= DRAIN_FLAG
+	// and C_WINDOW frames
+	plaintext[46] |= FLOW_CONTROL_FLAG
+	if authInfo.Compression {
+		plaintext[46] |= COMPRESSION_FLAG
+	}
+	// so that the server tells us what it has
+	plaintext[47] = mux.ProtocolVersion
 
 	copy(sharedSecret[:], ecdh.GenerateSharedSecret(ephPv, authInfo.ServerPubKey))
 	ciphertextWithTag, _ := common.AESGCMEncrypt(ret.randPubKey[:12], sharedSecret[:], plaintext)
@@ -50,9 +50,9 @@ func TestMakeAuthenticationPayload(t *testing.T) {
 					0x5a, 0x53, 0xc5, 0xed, 0xaf, 0xdb, 0x10, 0x98,
 					0x83, 0x96, 0x81, 0xa6, 0xfc, 0xa2, 0x1e, 0xb0,
 					0x89, 0xb2, 0x29, 0x71, 0x7e, 0x45, 0x97, 0x54,
-					0x11, 0x7d, 0x9b, 0x92, 0xbb, 0xd6, 0xce, 0x37,
-					0x3b, 0xb8, 0x8b, 0xfb, 0xb6, 0x40, 0xf0, 0x2c,
-					0x6c, 0x55, 0xb9, 0xfc, 0x5d, 0x34, 0x89, 0x41},
+					0x11, 0x7f, 0x9b, 0x92, 0xbb, 0xd6, 0xc9, 0x36,
+					0x6f, 0x1f, 0xd7, 0x9e, 0x7e, 0xb6, 0x8c, 0x8a,
+					0x13, 0xe7, 0x97, 0xe9, 0x06, 0x4b, 0x46, 0x31},
 			},
 			[32]byte{
 				0xc7, 0xc6, 0x9b, 0xbe, 0xec, 0xf8, 0x35, 0x55,
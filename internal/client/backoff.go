@@ -0,0 +1,69 @@
+package client
+
+// When a connection to the server can't be made, it's tried again after a delay that doubles with every failure in a
+// row, from minReconnectDelay up to ReconnectMaxDelay, so that a server that's down or rebooting isn't hammered. Each
+// delay is taken at random from the upper half of what it would be, so that clients that lost the server at the same
+// time don't all come back at once. The failures are counted across all connections of all sessions, which back off
+// together, and start over once any connection is made
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay        = time.Second
+	defaultReconnectMaxDelay = 60 * time.Second
+)
+
+// Backoff is the delay before connecting again, shared by all connections to the server
+type Backoff struct {
+	max time.Duration
+	// a random number in [0, n)
+	rand func(n int64) int64
+
+	m        sync.Mutex
+	failures int
+}
+
+// MakeBackoff makes a Backoff whose delays are at most max
+func MakeBackoff(max time.Duration) *Backoff {
+	return &Backoff{max: max, rand: rand.Int63n}
+}
+
+// failed counts a failure to connect, returning how long to wait before trying again
+func (b *Backoff) failed() time.Duration {
+	b.m.Lock()
+	defer b.m.Unlock()
+	delay := minReconnectDelay
+	for i := 0; i < b.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	} else {
+		b.failures++
+	}
+	return delay/2 + time.Duration(b.rand(int64(delay/2)+1))
+}
+
+// succeeded starts the delays over
+func (b *Backoff) succeeded() {
+	b.m.Lock()
+	b.failures = 0
+	b.m.Unlock()
+}
+
+// wait sleeps for delay, returning early with false once ctx is done
+func wait(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := MakeBackoff(10 * time.Second)
+	// the longest delay each time
+	b.rand = func(n int64) int64 { return n - 1 }
+	for i, expected := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		if delay := b.failed(); delay != expected*time.Second {
+			t.Errorf("failure %v: expecting %v, got %v", i+1, expected*time.Second, delay)
+		}
+	}
+
+	b.succeeded()
+	// the shortest delay
+	b.rand = func(n int64) int64 { return 0 }
+	if delay := b.failed(); delay != minReconnectDelay/2 {
+		t.Errorf("expecting the delays to start over at %v, got %v", minReconnectDelay/2, delay)
+	}
+
+	b.rand = MakeBackoff(0).rand
+	for i := 0; i < 3; i++ {
+		b.failed()
+	}
+	for i := 0; i < 100; i++ {
+		if delay := b.failed(); delay < 5*time.Second || delay > 10*time.Second {
+			t.Fatalf("delay %v is outside of the upper half of the cap", delay)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	if !wait(context.Background(), 10*time.Millisecond) {
+		t.Error("gave up without being told to")
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if wait(ctx, time.Minute) {
+		t.Error("didn't give up")
+	}
+	if time.Since(start) > time.Second {
+		t.Error("waited too long after giving up")
+	}
+}
@@ -0,0 +1,195 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how much is written to a stream at a time while it's loaded
+	benchChunkSize = 16 * 1024
+	// how often the round trip is timed while the streams are loaded
+	benchRTTInterval = 100 * time.Millisecond
+)
+
+// BenchReport is what ck-client bench has measured of a server
+type BenchReport struct {
+	// how long each handshake took after the TCP connection was made
+	Handshakes []time.Duration
+	// the number of streams loaded at once, and for how long
+	Streams  int
+	Duration time.Duration
+	// how much got through the streams, which is what was echoed back to us if echo is set and what we sent otherwise
+	Bytes int64
+	// the round trips of a small message on a stream of its own while the others were loaded, only if echo is set
+	RTTs []time.Duration
+}
+
+// Throughput is in bits per second
+func (r BenchReport) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * 8 / r.Duration.Seconds()
+}
+
+// Percentile returns the pth percentile of durations, 0 if there are none
+func Percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// MeasureHandshakes makes n connections to the server one after another, and times the handshake of each. The
+// sessions they open on the server are left to be closed with the connections. It gives up once ctx is done
+func MeasureHandshakes(ctx context.Context, connConfig RemoteConnConfig, authInfo AuthInfo, dialer common.Dialer, n int) ([]time.Duration, error) {
+	var handshakes []time.Duration
+	for i := 0; i < n; i++ {
+		var sessionId [4]byte
+		common.CryptoRandRead(sessionId[:])
+		authInfo.SessionId = binary.BigEndian.Uint32(sessionId[:])
+		remoteConn, err := common.DialContext(ctx, dialer, "tcp", connConfig.RemoteAddr)
+		if err != nil {
+			return handshakes, fmt.Errorf("failed to connect to %v: %v", connConfig.RemoteAddr, err)
+		}
+		transportConn := connConfig.TransportMaker()
+		start := time.Now()
+		_, err = handshake(ctx, transportConn, remoteConn, authInfo)
+		elapsed := time.Since(start)
+		transportConn.Close()
+		if err != nil {
+			return handshakes, fmt.Errorf("failed to handshake: %v", err)
+		}
+		handshakes = append(handshakes, elapsed)
+	}
+	return handshakes, nil
+}
+
+// MeasureThroughput loads streams opened with open for duration, writing to each as fast as it takes. If echo is
+// set, what's read back is counted and the round trip is timed on one more stream all the while. Otherwise what's
+// written is
+func MeasureThroughput(open func() (net.Conn, error), streams int, duration time.Duration, echo bool) (bytes int64, rtts []time.Duration, err error) {
+	if streams < 1 {
+		return 0, nil, errors.New("there must be at least one stream")
+	}
+	var conns []net.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for i := 0; i < streams; i++ {
+		conn, err := open()
+		if err != nil {
+			return 0, nil, err
+		}
+		conns = append(conns, conn)
+	}
+	var rttConn net.Conn
+	if echo {
+		rttConn, err = open()
+		if err != nil {
+			return 0, nil, err
+		}
+		conns = append(conns, rttConn)
+	}
+
+	chunk := make([]byte, benchChunkSize)
+	common.CryptoRandRead(chunk)
+	var counted int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, conn := range conns[:streams] {
+		conn := conn
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				n, err := conn.Write(chunk)
+				if !echo {
+					atomic.AddInt64(&counted, int64(n))
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+		if echo {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, benchChunkSize)
+				for {
+					n, err := conn.Read(buf)
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					atomic.AddInt64(&counted, int64(n))
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}
+
+	deadline := time.Now().Add(duration)
+	if echo {
+		rtts, err = timeRoundTrips(rttConn, deadline)
+		if err != nil {
+			log.Warnf("Failed to time the round trip: %v", err)
+		}
+	}
+	time.Sleep(time.Until(deadline))
+	bytes = atomic.LoadInt64(&counted)
+	close(stop)
+	for _, conn := range conns {
+		conn.Close()
+	}
+	wg.Wait()
+	return bytes, rtts, nil
+}
+
+// timeRoundTrips sends a counter on conn every benchRTTInterval until deadline, timing how long it takes to come back
+func timeRoundTrips(conn net.Conn, deadline time.Time) (rtts []time.Duration, err error) {
+	sent := make([]byte, 8)
+	got := make([]byte, 8)
+	for seq := uint64(0); time.Now().Add(benchRTTInterval).Before(deadline); seq++ {
+		binary.BigEndian.PutUint64(sent, seq)
+		start := time.Now()
+		if _, err := conn.Write(sent); err != nil {
+			return rtts, err
+		}
+		if _, err := io.ReadFull(conn, got); err != nil {
+			return rtts, err
+		}
+		rtts = append(rtts, time.Since(start))
+		if binary.BigEndian.Uint64(got) != seq {
+			return rtts, errors.New("the echo doesn't match what was sent")
+		}
+		time.Sleep(time.Until(start.Add(benchRTTInterval)))
+	}
+	return rtts, nil
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	durations := []time.Duration{5, 1, 4, 2, 3}
+	for p, want := range map[float64]time.Duration{0: 1, 50: 3, 100: 5} {
+		if got := Percentile(durations, p); got != want {
+			t.Errorf("percentile %v: expecting %v, got %v", p, want, got)
+		}
+	}
+	if Percentile(nil, 50) != 0 {
+		t.Error("percentile of nothing isn't 0")
+	}
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	listen := func(echo bool) func() (net.Conn, error) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				if echo {
+					go io.Copy(conn, conn)
+				} else {
+					go io.Copy(io.Discard, conn)
+				}
+			}
+		}()
+		return func() (net.Conn, error) { return net.Dial("tcp", listener.Addr().String()) }
+	}
+
+	t.Run("echo", func(t *testing.T) {
+		bytes, rtts, err := MeasureThroughput(listen(true), 2, 500*time.Millisecond, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes == 0 {
+			t.Error("nothing was echoed back")
+		}
+		if len(rtts) == 0 {
+			t.Error("no round trip was timed")
+		}
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		bytes, rtts, err := MeasureThroughput(listen(false), 2, 300*time.Millisecond, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes == 0 {
+			t.Error("nothing was sent")
+		}
+		if len(rtts) != 0 {
+			t.Error("round trips were timed without echo")
+		}
+	})
+
+	if _, _, err := MeasureThroughput(listen(true), 0, time.Second, true); err == nil {
+		t.Error("no stream is accepted")
+	}
+}
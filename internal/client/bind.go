@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// SocketBinding is what the sockets of the connections to the server are bound to, so that they can be routed apart
+// from other traffic, such as that of a VPN which Cloak is under
+type SocketBinding struct {
+	// the name of the network interface to send through, empty for whichever the routes lead to
+	Interface string
+	// the address to connect from, nil for any
+	SourceIP net.IP
+	// the firewall mark (SO_MARK) of the sockets for policy routing, 0 for none. It's only supported on Linux
+	FwMark int
+}
+
+// BoundDialer makes connections whose sockets are bound as in its SocketBinding
+type BoundDialer struct {
+	dialer   net.Dialer
+	sourceIP net.IP
+}
+
+func MakeBoundDialer(dialer *net.Dialer, binding SocketBinding) *BoundDialer {
+	b := &BoundDialer{dialer: *dialer, sourceIP: binding.SourceIP}
+	if binding.Interface == "" && binding.FwMark == 0 {
+		return b
+	}
+	control := dialer.Control
+	b.dialer.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var bindErr error
+		err := c.Control(func(fd uintptr) { bindErr = bindSocket(fd, network, binding) })
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+	return b
+}
+
+func (b *BoundDialer) Dial(network, address string) (net.Conn, error) {
+	return b.DialContext(context.Background(), network, address)
+}
+
+func (b *BoundDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if b.sourceIP == nil {
+		return b.dialer.DialContext(ctx, network, address)
+	}
+	// the address to connect from has to be of the network
+	d := b.dialer
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		d.LocalAddr = &net.TCPAddr{IP: b.sourceIP}
+	case "udp", "udp4", "udp6":
+		d.LocalAddr = &net.UDPAddr{IP: b.sourceIP}
+	}
+	return d.DialContext(ctx, network, address)
+}
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+var errFwMarkUnsupported = errors.New("FwMark is only supported on Linux")
+
+func checkSocketBinding(binding SocketBinding) error {
+	if binding.FwMark != 0 {
+		return errFwMarkUnsupported
+	}
+	return nil
+}
+
+// bindSocket binds the socket fd to the interface of binding with IP_BOUND_IF, or IPV6_BOUND_IF if it's IPv6
+func bindSocket(fd uintptr, network string, binding SocketBinding) error {
+	if binding.Interface == "" {
+		return nil
+	}
+	iface, err := net.InterfaceByName(binding.Interface)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_BOUND_IF, iface.Index)
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, iface.Index)
+}
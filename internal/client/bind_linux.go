@@ -0,0 +1,21 @@
+package client
+
+import "syscall"
+
+func checkSocketBinding(SocketBinding) error { return nil }
+
+// bindSocket binds the socket fd to the interface of binding with SO_BINDTODEVICE, and marks it with SO_MARK. Both need
+// CAP_NET_RAW or CAP_NET_ADMIN
+func bindSocket(fd uintptr, _ string, binding SocketBinding) error {
+	if binding.Interface != "" {
+		if err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, binding.Interface); err != nil {
+			return err
+		}
+	}
+	if binding.FwMark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, binding.FwMark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package client
+
+import "errors"
+
+var errSocketBindingUnsupported = errors.New("Interface is only supported on Linux and macOS, and FwMark on Linux")
+
+func checkSocketBinding(binding SocketBinding) error {
+	if binding.Interface != "" || binding.FwMark != 0 {
+		return errSocketBindingUnsupported
+	}
+	return nil
+}
+
+func bindSocket(uintptr, string, SocketBinding) error { return errSocketBindingUnsupported }
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func TestBoundDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	t.Run("source IP", func(t *testing.T) {
+		d := MakeBoundDialer(&net.Dialer{}, SocketBinding{SourceIP: net.ParseIP("127.0.0.2")})
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Skipf("127.0.0.2 can't be connected from: %v", err)
+		}
+		defer conn.Close()
+		if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+			t.Errorf("expecting the connection to be from 127.0.0.2, got %v", ip)
+		}
+
+		udpConn, err := d.Dial("udp", "127.0.0.1:9")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer udpConn.Close()
+		if ip := udpConn.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+			t.Errorf("expecting UDP to be from 127.0.0.2, got %v", ip)
+		}
+	})
+	t.Run("the dialer's own control", func(t *testing.T) {
+		errControl := errors.New("control")
+		d := MakeBoundDialer(&net.Dialer{Control: func(string, string, syscall.RawConn) error { return errControl }},
+			SocketBinding{FwMark: 1})
+		if _, err := d.Dial("tcp", l.Addr().String()); !errors.Is(err, errControl) {
+			t.Errorf("expecting %v, got %v", errControl, err)
+		}
+	})
+	t.Run("interface and mark", func(t *testing.T) {
+		if runtime.GOOS != "linux" {
+			t.Skip("only on Linux")
+		}
+		d := MakeBoundDialer(&net.Dialer{}, SocketBinding{Interface: "lo", FwMark: 42})
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if errors.Is(err, os.ErrPermission) {
+			t.Skipf("not permitted to bind sockets: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		d = MakeBoundDialer(&net.Dialer{}, SocketBinding{Interface: "nonexistent0"})
+		if _, err := d.Dial("tcp", l.Addr().String()); err == nil {
+			t.Error("expecting binding to a nonexistent interface to fail")
+		}
+	})
+}
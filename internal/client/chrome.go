@@ -79,7 +79,16 @@ func (c *Chrome) composeExtensions(sni []byte, keyShare []byte) []byte {
 	return ret
 }
 
-func (c *Chrome) composeClientHello(hd clientHelloFields) (ch []byte) {
+func (c *Chrome) composeClientHello(hd clientHelloFields) (ch []byte, err error) {
+	if hd.echConfig != nil {
+		return nil, errECHUnsupported
+	}
+	if hd.psk != nil {
+		return nil, errResumptionUnsupported
+	}
+	if hd.mlkemKeyShare != nil {
+		return nil, errNoMLKEMKeyShare
+	}
 	var clientHello [12][]byte
 	clientHello[0] = []byte{0x01}             // handshake type
 	clientHello[1] = []byte{0x00, 0x01, 0xfc} // length 508
@@ -92,12 +101,12 @@ func (c *Chrome) composeClientHello(hd clientHelloFields) (ch []byte) {
 	clientHello[7] = append(makeGREASE(), cipherSuites...) // cipher suites
 	clientHello[8] = []byte{0x01}                          // compression methods length 1
 	clientHello[9] = []byte{0x00}                          // compression methods
-	clientHello[11] = c.composeExtensions(hd.sni, hd.x25519KeyShare)
+	clientHello[11] = c.composeExtensions(makeServerName(hd.serverName), hd.x25519KeyShare)
 	clientHello[10] = []byte{0x00, 0x00} // extensions length 401
 	binary.BigEndian.PutUint16(clientHello[10], uint16(len(clientHello[11])))
 	var ret []byte
 	for _, c := range clientHello {
 		ret = append(ret, c...)
 	}
-	return ret
+	return ret, nil
 }
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"runtime"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/cpu"
+)
+
+// hasAESHardware is whether AES-GCM is done with instructions of the CPU, as crypto/aes and crypto/cipher do it where
+// there are instructions for both AES and the carry-less multiplication of GHASH. Without them, which is the case for
+// many phones and routers, ChaCha20-Poly1305 is several times faster. Apple's ARM64 CPUs all have them, but don't
+// tell x/sys/cpu
+var hasAESHardware = cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ ||
+	cpu.ARM64.HasAES && cpu.ARM64.HasPMULL ||
+	runtime.GOARCH == "arm64" && (runtime.GOOS == "darwin" || runtime.GOOS == "ios") ||
+	cpu.S390X.HasAES && cpu.S390X.HasAESGCM ||
+	runtime.GOARCH == "ppc64" || runtime.GOARCH == "ppc64le"
+
+// autoEncryptionMethod is the encryption method of EncryptionMethod "auto": aes-gcm if hasAES, or chacha20-poly1305
+func autoEncryptionMethod(hasAES bool) byte {
+	if hasAES {
+		log.Info("EncryptionMethod auto is aes-gcm, as AES is done in hardware")
+		return mux.E_METHOD_AES_GCM
+	}
+	log.Info("EncryptionMethod auto is chacha20-poly1305, as AES isn't done in hardware")
+	return mux.E_METHOD_CHACHA20_POLY1305
+}
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"encoding/binary"
 	"github.com/cbeuw/Cloak/internal/common"
 	"net"
@@ -12,7 +13,19 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func MakeSession(connConfig RemoteConnConfig, authInfo AuthInfo, dialer common.Dialer, isAdmin bool) *mux.Session {
+// handshake makes the handshake of transport on remoteConn, which is closed to cut it short once ctx is done
+func handshake(ctx context.Context, transport Transport, remoteConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	stop := context.AfterFunc(ctx, func() { remoteConn.Close() })
+	sessionKey, err = transport.Handshake(remoteConn, authInfo)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// MakeSession makes a session with the server, which keeps trying to make its connections until they're made or ctx
+// is done, in which case the session it returns is closed. ctx has no say over the session once it's made
+func MakeSession(ctx context.Context, connConfig RemoteConnConfig, authInfo AuthInfo, dialer common.Dialer, isAdmin bool) *mux.Session {
 	log.Info("Attempting to start a new session")
 	//TODO: let caller set this
 	if !isAdmin {
@@ -31,56 +44,170 @@ func MakeSession(connConfig RemoteConnConfig, authInfo AuthInfo, dialer common.D
 		numConn = 1
 	}
 
-	connsCh := make(chan net.Conn, numConn)
-	var _sessionKey atomic.Value
-	var wg sync.WaitGroup
-	for i := 0; i < numConn; i++ {
-		wg.Add(1)
-		go func() {
-		makeconn:
-			remoteConn, err := dialer.Dial("tcp", connConfig.RemoteAddr)
+	// the connections are spread across the addresses of multipath
+	remoteAddrs := connConfig.RemoteAddrs
+	if len(remoteAddrs) == 0 {
+		remoteAddrs = []string{connConfig.RemoteAddr}
+	}
+
+	backoff := connConfig.Backoff
+	if backoff == nil {
+		backoff = MakeBackoff(defaultReconnectMaxDelay)
+	}
+	// retry waits before connecting to remoteAddr again, returning false if ctx is done meanwhile
+	retry := func(ctx context.Context, remoteAddr string) bool {
+		delay := backoff.failed()
+		log.Infof("Connecting to %v again in %v", remoteAddr, delay.Round(time.Millisecond))
+		if connConfig.ReconnectResolve && connConfig.Resolver != nil {
+			host, _, _ := net.SplitHostPort(remoteAddr)
+			connConfig.Resolver.expire(host)
+		}
+		return wait(ctx, delay)
+	}
+
+	// dial keeps trying to make a connection to the address next gives until it succeeds or ctx is done, returning
+	// the address the connection is made to
+	dial := func(ctx context.Context, next func() string, authInfo AuthInfo) (net.Conn, [32]byte, string, bool) {
+		for ctx.Err() == nil {
+			remoteAddr := next()
+			if connConfig.KnockPort != "" {
+				if err := knock(ctx, dialer, remoteAddr, connConfig.KnockPort, authInfo); err != nil {
+					log.Warnf("Failed to knock on %v: %v", remoteAddr, err)
+				}
+			}
+			start := time.Now()
+			remoteConn, err := common.DialContext(ctx, dialer, "tcp", remoteAddr)
 			if err != nil {
-				log.Errorf("Failed to establish new connections to remote: %v", err)
-				// TODO increase the interval if failed multiple times
-				time.Sleep(time.Second * 3)
-				goto makeconn
+				if ctx.Err() != nil {
+					break
+				}
+				log.Errorf("Failed to establish new connections to %v: %v", remoteAddr, err)
+				connConfig.Endpoints.failed(remoteAddr)
+				retry(ctx, remoteAddr)
+				continue
 			}
+			rtt := time.Since(start)
 
 			transportConn := connConfig.TransportMaker()
-			sk, err := transportConn.Handshake(remoteConn, authInfo)
+			sk, err := handshake(ctx, transportConn, remoteConn, authInfo)
 			if err != nil {
 				transportConn.Close()
+				if ctx.Err() != nil {
+					break
+				}
 				log.Errorf("Failed to prepare connection to remote: %v", err)
-				time.Sleep(time.Second * 3)
-				goto makeconn
+				connConfig.Endpoints.failed(remoteAddr)
+				retry(ctx, remoteAddr)
+				continue
+			}
+			backoff.succeeded()
+			connConfig.Endpoints.succeeded(remoteAddr, rtt)
+			connConfig.Stats.connected(remoteAddr)
+			return transportConn, sk, remoteAddr, true
+		}
+		return nil, [32]byte{}, "", false
+	}
+	// addrOf gives the address the ith connection of the session is made to
+	addrOf := func(i int) func() string {
+		if connConfig.Endpoints != nil {
+			return connConfig.Endpoints.pick
+		}
+		remoteAddr := remoteAddrs[i%len(remoteAddrs)]
+		return func() string { return remoteAddr }
+	}
+	connsCh := make(chan net.Conn, numConn)
+	var _sessionKey atomic.Value
+	var wg sync.WaitGroup
+	for i := 0; i < numConn; i++ {
+		wg.Add(1)
+		next := addrOf(i)
+		go func() {
+			conn, sk, _, ok := dial(ctx, next, authInfo)
+			if ok {
+				_sessionKey.Store(sk)
 			}
-			_sessionKey.Store(sk)
-			connsCh <- transportConn
+			connsCh <- conn
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 	log.Debug("All underlying connections established")
 
-	sessionKey := _sessionKey.Load().([32]byte)
+	// no connection has been made if ctx is done
+	sessionKey, _ := _sessionKey.Load().([32]byte)
 	obfuscator, err := mux.MakeObfuscator(authInfo.EncryptionMethod, sessionKey)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	seshConfig := mux.SessionConfig{
-		Obfuscator:   obfuscator,
-		Valve:        nil,
-		Unordered:    authInfo.Unordered,
-		MaxFrameSize: appDataMaxLength,
+		Obfuscator:          obfuscator,
+		Valve:               connConfig.Valve,
+		Unordered:           authInfo.Unordered,
+		Multipath:           authInfo.Multipath,
+		Duplicate:           authInfo.Duplicate,
+		ResumeGrace:         connConfig.ResumeGrace,
+		FECDataShards:       authInfo.FECDataShards,
+		FECParityShards:     authInfo.FECParityShards,
+		Heartbeat:           authInfo.Heartbeat,
+		TrafficProfile:      authInfo.TrafficProfile,
+		RecordSizing:        connConfig.RecordSizing,
+		CloseReasons:        authInfo.CloseReasons,
+		StreamWindow:        connConfig.StreamWindow,
+		SessionWindow:       connConfig.SessionWindow,
+		Compression:         authInfo.Compression,
+		UnreliableDatagrams: connConfig.UnreliableDatagrams,
+		Rekeys:              connConfig.RekeyInterval > 0,
+		RekeyInterval:       connConfig.RekeyInterval,
+		LearnsCapabilities:  true,
+		MaxFrameSize:        appDataMaxLength,
 	}
-	sesh := mux.MakeSession(authInfo.SessionId, seshConfig)
+	var sesh *mux.Session
+	if connConfig.ResumeGrace > 0 {
+		var redials uint32
+		// the session already has its key, which the early session key of a new handshake wouldn't be
+		redialAuth := authInfo
+		redialAuth.EarlyData = false
+		seshConfig.Redial = func() {
+			next := addrOf(int(atomic.AddUint32(&redials, 1)))
+			conn, sk, remoteAddr, ok := dial(sesh.Context(), next, redialAuth)
+			if !ok {
+				return
+			}
+			// a server that has since forgotten the session makes a new one, with a new key
+			if sk != sessionKey {
+				conn.Close()
+				log.Warnf("Session %v has expired on the server and can't be resumed", authInfo.SessionId)
+				sesh.SetTerminalMsg("session expired on the server")
+				sesh.Close()
+				return
+			}
+			log.Infof("Reconnected to %v for session %v", remoteAddr, authInfo.SessionId)
+			sesh.AddConnection(conn)
+		}
+	}
+	sesh = mux.MakeSession(authInfo.SessionId, seshConfig)
 
 	for i := 0; i < numConn; i++ {
-		conn := <-connsCh
-		sesh.AddConnection(conn)
+		if conn := <-connsCh; conn != nil {
+			sesh.AddConnection(conn)
+		}
+	}
+	if ctx.Err() != nil {
+		log.Infof("Gave up on session %v: %v", authInfo.SessionId, ctx.Err())
+		sesh.Close()
+		return sesh
 	}
 
 	log.Infof("Session %v established", authInfo.SessionId)
+	if !isAdmin {
+		connConfig.Stats.track(sesh)
+	}
+	if connConfig.Quota != nil && !isAdmin {
+		go connConfig.Quota.watch(sesh)
+	}
+	if connConfig.ServerListPath != "" && !isAdmin {
+		go fetchServerList(sesh, connConfig.ServerListPath)
+	}
 	return sesh
 }
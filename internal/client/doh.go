@@ -0,0 +1,369 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	utls "github.com/refraction-networking/utls"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/http2"
+)
+
+const (
+	// how long a query waits for its answer
+	dohQueryTimeout = 10 * time.Second
+	// after this many failed queries in a row, the connection is given up
+	maxDoHFailures = 5
+	// without anything to send or receive, the server is polled less and less often down to every dohMaxPoll
+	dohMinPoll = 50 * time.Millisecond
+	dohMaxPoll = 2 * time.Second
+	// the most that's kept of what's to be sent before writes wait
+	dohSendBuffer = 64 * 1024
+)
+
+// DoH carries the Cloak connection in DNS queries under domain, sent over DNS over HTTPS to a public resolver on
+// remoteDomainPort that passes them on to the Cloak server as the name server of domain. It's slow, but it gets
+// through wherever the resolver can be reached. The resolver's certificate is verified, as it's a real one
+type DoH struct {
+	*common.TLSConn
+	remoteDomainPort string
+	path             string
+	domain           string
+	helloID          utls.ClientHelloID
+	// the certificate of the resolver is verified against the system's roots if nil
+	rootCAs *x509.CertPool
+}
+
+func (d *DoH) Close() error {
+	if d.TLSConn == nil {
+		return nil
+	}
+	return d.TLSConn.Close()
+}
+
+func (d *DoH) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	var conn *dohConn
+	defer func() {
+		if err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			rawConn.Close()
+		}
+	}()
+	resolverName, _, err := net.SplitHostPort(d.remoteDomainPort)
+	if err != nil {
+		return
+	}
+	uconn := utls.UClient(rawConn, &utls.Config{
+		ServerName: resolverName,
+		RootCAs:    d.rootCAs,
+	}, d.helloID)
+	err = uconn.Handshake()
+	if err != nil {
+		return
+	}
+	if proto := uconn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		return sessionKey, fmt.Errorf("resolver negotiated %q instead of HTTP/2", proto)
+	}
+	cc, err := (&http2.Transport{}).NewClientConn(uconn)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to start HTTP/2: %v", err)
+	}
+
+	conn = newDoHConn(func(query []byte) ([]byte, error) { return d.exchange(cc, query) }, d.domain,
+		rawConn.LocalAddr(), rawConn.RemoteAddr())
+	conn.onClose = func() { uconn.Close() }
+
+	payload, sharedSecret := makeAuthenticationPayload(authInfo)
+	_, err = conn.Write(append(payload.randPubKey[:], payload.ciphertextWithTag[:]...))
+	if err != nil {
+		return
+	}
+
+	// reply: [12 bytes nonce][32 bytes encrypted session key][16 bytes authentication tag]
+	reply := make([]byte, 60)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to read reply: %v", err)
+	}
+	sessionKeySlice, err := common.AESGCMDecrypt(reply[:12], sharedSecret[:], reply[12:])
+	if err != nil {
+		return
+	}
+	copy(sessionKey[:], sessionKeySlice)
+	// the conversation is a byte stream, so each frame is put in a record of its own
+	d.TLSConn = &common.TLSConn{Conn: conn}
+	return
+}
+
+// exchange sends a query to the resolver on cc, and returns its answer
+func (d *DoH) exchange(cc *http2.ClientConn, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dohQueryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+d.remoteDomainPort+d.path, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver answered with status %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// dohConn is a conversation of queries with the Cloak server as a net.Conn, writing what's sent in the queries and
+// reading what's in the answers. One goroutine makes the queries, one at a time
+type dohConn struct {
+	exchange func(query []byte) ([]byte, error)
+	domain   string
+	// the most data a query can carry
+	maxData      int
+	conversation [8]byte
+	nonce        uint32
+	local        net.Addr
+	remote       net.Addr
+	// called once the conversation has ended
+	onClose func()
+
+	m sync.Mutex
+	// signalled when there's more received, less to be sent or the conversation is closed
+	cond     *sync.Cond
+	sending  []byte
+	received []byte
+	closed   bool
+	// why the conversation has ended if the server ended it, io.EOF if it closed it
+	err error
+	// woken when there's more to be sent or the conversation is closed
+	wake chan struct{}
+}
+
+func newDoHConn(exchange func(query []byte) ([]byte, error), domain string, local net.Addr, remote net.Addr) *dohConn {
+	c := &dohConn{
+		exchange: exchange,
+		domain:   domain,
+		maxData:  common.MaxDNSQueryData(domain),
+		local:    local,
+		remote:   remote,
+		wake:     make(chan struct{}, 1),
+	}
+	c.cond = sync.NewCond(&c.m)
+	common.CryptoRandRead(c.conversation[:])
+	go c.converse()
+	return c
+}
+
+func (c *dohConn) Read(buf []byte) (int, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for len(c.received) == 0 && c.err == nil && !c.closed {
+		c.cond.Wait()
+	}
+	if len(c.received) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		return 0, net.ErrClosed
+	}
+	n := copy(buf, c.received)
+	c.received = c.received[n:]
+	return n, nil
+}
+
+func (c *dohConn) Write(data []byte) (int, error) {
+	c.m.Lock()
+	for len(c.sending) >= dohSendBuffer && c.err == nil && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		c.m.Unlock()
+		return 0, net.ErrClosed
+	}
+	if c.err != nil {
+		c.m.Unlock()
+		return 0, c.err
+	}
+	c.sending = append(c.sending, data...)
+	c.m.Unlock()
+	c.poke()
+	return len(data), nil
+}
+
+func (c *dohConn) Close() error {
+	c.m.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.m.Unlock()
+	c.poke()
+	return nil
+}
+
+func (c *dohConn) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *dohConn) LocalAddr() net.Addr              { return c.local }
+func (c *dohConn) RemoteAddr() net.Addr             { return c.remote }
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
+
+// end records why the conversation has ended
+func (c *dohConn) end(err error) {
+	c.m.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.m.Unlock()
+}
+
+// converse makes the queries of the conversation until either side closes it
+func (c *dohConn) converse() {
+	defer func() {
+		if c.onClose != nil {
+			c.onClose()
+		}
+	}()
+	// the chunk that the server hasn't acknowledged, nil if there isn't one
+	var inFlight []byte
+	var sendSeq, nextSeq uint16
+	poll := dohMinPoll
+	failures := 0
+	for {
+		c.m.Lock()
+		closing := c.closed
+		if inFlight == nil && len(c.sending) != 0 {
+			n := min(c.maxData, len(c.sending))
+			inFlight = append([]byte{}, c.sending[:n]...)
+			c.sending = c.sending[n:]
+			c.cond.Broadcast()
+		}
+		c.m.Unlock()
+
+		packet := common.DNSPacket{Seq: sendSeq, Ack: nextSeq, Data: inFlight}
+		if closing {
+			// the server is told once, and forgets the conversation after a while if it doesn't hear
+			packet.Flags |= common.DNS_FLAG_CLOSE
+			packet.Data = nil
+			_, _ = c.query(packet)
+			return
+		}
+		reply, err := c.query(packet)
+		if err != nil {
+			failures++
+			log.Debugf("DNS query failed: %v", err)
+			if failures >= maxDoHFailures {
+				c.end(fmt.Errorf("DNS queries keep failing: %w", err))
+				return
+			}
+			c.sleep(poll)
+			continue
+		}
+		failures = 0
+
+		progress := false
+		if inFlight != nil && reply.Ack == sendSeq+1 {
+			inFlight = nil
+			sendSeq++
+			progress = true
+		}
+		if len(reply.Data) != 0 && reply.Seq == nextSeq {
+			c.m.Lock()
+			c.received = append(c.received, reply.Data...)
+			c.cond.Broadcast()
+			c.m.Unlock()
+			nextSeq++
+			progress = true
+		}
+		if reply.Flags&common.DNS_FLAG_CLOSE != 0 {
+			c.end(io.EOF)
+			return
+		}
+
+		c.m.Lock()
+		pending := inFlight != nil || len(c.sending) != 0
+		c.m.Unlock()
+		if progress || pending {
+			poll = dohMinPoll
+			if progress {
+				continue
+			}
+		}
+		c.sleep(poll)
+		poll = min(poll*2, dohMaxPoll)
+	}
+}
+
+// sleep waits for d, or until there's something to send
+func (c *dohConn) sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.wake:
+	}
+}
+
+var errBadAnswer = errors.New("no answer of the DNS tunnel")
+
+// query sends packet in a query, and returns the packet of its answer
+func (c *dohConn) query(packet common.DNSPacket) (common.DNSPacket, error) {
+	c.nonce++
+	name, err := dnsmessage.NewName(common.MarshalDNSQuery(c.conversation, c.nonce, packet, c.domain))
+	if err != nil {
+		return common.DNSPacket{}, err
+	}
+	msg := dnsmessage.Message{
+		// the ID is 0 in DNS over HTTPS, as in RFC 8484
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return common.DNSPacket{}, err
+	}
+	raw, err := c.exchange(query)
+	if err != nil {
+		return common.DNSPacket{}, err
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(raw); err != nil {
+		return common.DNSPacket{}, err
+	}
+	if answer.RCode != dnsmessage.RCodeSuccess {
+		return common.DNSPacket{}, fmt.Errorf("resolver answered with %v", answer.RCode)
+	}
+	for _, resource := range answer.Answers {
+		txt, ok := resource.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			continue
+		}
+		var content []byte
+		for _, s := range txt.TXT {
+			content = append(content, s...)
+		}
+		return common.UnmarshalDNSAnswer(content)
+	}
+	return common.DNSPacket{}, errBadAnswer
+}
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeNameServer answers the queries of a conversation like the Cloak server, sending what serve returns for each
+// chunk it receives
+type fakeNameServer struct {
+	domain string
+	serve  func(chunk []byte) []byte
+
+	m        sync.Mutex
+	nextSeq  uint16
+	sendSeq  uint16
+	inFlight []byte
+	sending  []byte
+	closed   bool
+}
+
+func (s *fakeNameServer) answer(query []byte) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	_, packet, err := common.UnmarshalDNSQuery(msg.Questions[0].Name.String(), s.domain)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	if packet.Flags&common.DNS_FLAG_CLOSE != 0 {
+		s.closed = true
+	}
+	if len(packet.Data) != 0 && packet.Seq == s.nextSeq {
+		s.nextSeq++
+		s.sending = append(s.sending, s.serve(packet.Data)...)
+	}
+	if s.inFlight != nil && packet.Ack == s.sendSeq+1 {
+		s.inFlight = nil
+		s.sendSeq++
+	}
+	if s.inFlight == nil && len(s.sending) != 0 {
+		n := min(300, len(s.sending))
+		s.inFlight, s.sending = s.sending[:n], s.sending[n:]
+	}
+	reply := common.DNSPacket{Seq: s.sendSeq, Ack: s.nextSeq, Data: s.inFlight}
+	s.m.Unlock()
+
+	answer := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true},
+		Questions: msg.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+			Body:   &dnsmessage.TXTResource{TXT: []string{string(common.MarshalDNSAnswer(reply)[:3]), string(common.MarshalDNSAnswer(reply)[3:])}},
+		}},
+	}
+	return answer.Pack()
+}
+
+func (s *fakeNameServer) isClosed() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.closed
+}
+
+func echo(chunk []byte) []byte { return append([]byte{}, chunk...) }
+
+func TestDoHConn(t *testing.T) {
+	server := &fakeNameServer{domain: "t.example.com", serve: echo}
+	var calls int
+	var callsM sync.Mutex
+	errDropped := errors.New("dropped")
+	// a resolver that drops queries, drops answers and repeats queries
+	exchange := func(query []byte) ([]byte, error) {
+		callsM.Lock()
+		calls++
+		call := calls
+		callsM.Unlock()
+		switch {
+		case call%3 == 0:
+			return nil, errDropped
+		case call%5 == 0:
+			server.answer(query)
+			return nil, errDropped
+		case call%7 == 0:
+			server.answer(query)
+		}
+		return server.answer(query)
+	}
+	conn := newDoHConn(exchange, server.domain, nil, nil)
+
+	sent := make([]byte, 3000)
+	rand.Read(sent)
+	go conn.Write(sent)
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Error("what's received isn't what's sent")
+	}
+
+	conn.Close()
+	if _, err := conn.Write([]byte("late")); err == nil {
+		t.Error("expecting writes to fail once closed")
+	}
+
+	t.Run("closed by the server", func(t *testing.T) {
+		conn := newDoHConn(func(query []byte) ([]byte, error) {
+			answer := dnsmessage.Message{
+				Header:    dnsmessage.Header{Response: true},
+				Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName("x."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET}},
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("x."), Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+					Body:   &dnsmessage.TXTResource{TXT: []string{string(common.MarshalDNSAnswer(common.DNSPacket{Flags: common.DNS_FLAG_CLOSE}))}},
+				}},
+			}
+			return answer.Pack()
+		}, server.domain, nil, nil)
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("expecting %v, got %v", io.EOF, err)
+		}
+	})
+	t.Run("unreachable resolver", func(t *testing.T) {
+		conn := newDoHConn(func([]byte) ([]byte, error) { return nil, errDropped }, server.domain, nil, nil)
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, errDropped) {
+			t.Errorf("expecting %v, got %v", errDropped, err)
+		}
+	})
+}
+
+func TestDoHHandshake(t *testing.T) {
+	staticPv, staticPub, _ := ecdh.GenerateKey(rand.Reader)
+	var sessionKey [32]byte
+	common.CryptoRandRead(sessionKey[:])
+	authInfo := AuthInfo{
+		UID:          make([]byte, 16),
+		ProxyMethod:  "shadowsocks",
+		ServerPubKey: staticPub,
+		MockDomain:   "www.example.com",
+		WorldState:   common.RealWorldState,
+	}
+
+	// the Cloak server replies to the authentication data with sessionKey, then echoes
+	var hidden []byte
+	nameServer := &fakeNameServer{domain: "t.example.com", serve: func(chunk []byte) []byte {
+		if len(hidden) == 96 {
+			return echo(chunk)
+		}
+		hidden = append(hidden, chunk...)
+		if len(hidden) < 96 {
+			return nil
+		}
+		ephPub, _ := ecdh.Unmarshal(hidden[:32])
+		sharedSecret := ecdh.GenerateSharedSecret(staticPv, ephPub)
+		nonce := make([]byte, 12)
+		encryptedKey, _ := common.AESGCMEncrypt(nonce, sharedSecret, sessionKey[:])
+		return append(nonce, encryptedKey...)
+	}}
+	resolver := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.NotFound(w, r)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		answer, err := nameServer.answer(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answer)
+	}))
+	resolver.EnableHTTP2 = true
+	resolver.StartTLS()
+	defer resolver.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(resolver.Certificate())
+
+	rawConn, err := net.Dial("tcp", resolver.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &DoH{
+		remoteDomainPort: resolver.Listener.Addr().String(),
+		path:             "/dns-query",
+		domain:           nameServer.domain,
+		helloID:          common.Parrots["chrome"],
+		rootCAs:          pool,
+	}
+	key, err := transport.Handshake(rawConn, authInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != sessionKey {
+		t.Error("session key isn't received")
+	}
+
+	if _, err := transport.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := transport.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Errorf("expecting hello back, got %q, %v", buf[:n], err)
+	}
+	transport.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for !nameServer.isClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("the server isn't told of the close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
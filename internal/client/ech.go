@@ -0,0 +1,151 @@
+// Encrypted ClientHello (draft-ietf-tls-esni), as sent by browsers to sites that have published an ECHConfig
+
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	echConfigVersion = 0xfe0d
+
+	hpkeKemX25519            = 0x0020
+	hpkeKdfHKDFSHA256        = 0x0001
+	hpkeAeadAES128GCM        = 0x0001
+	hpkeAeadChaCha20Poly1305 = 0x0003
+
+	hpkeX25519PublicKeyLen = 32
+)
+
+// echConfig is what we need from the ECHConfig of a site in order to compose an ECH extension for it
+type echConfig struct {
+	configId   byte
+	kdfId      uint16
+	aeadId     uint16
+	maxNameLen int
+	publicName string
+}
+
+var errNoSupportedECHConfig = errors.New("no ECHConfig with a supported version, HPKE suite and extensions")
+var errBadECHConfigList = errors.New("malformed ECHConfigList")
+
+// echReader reads the fields of an ECHConfigList from its front, checking that each is within what's left of it
+type echReader []byte
+
+// read returns the next n bytes
+func (r *echReader) read(n int) ([]byte, bool) {
+	if n < 0 || len(*r) < n {
+		return nil, false
+	}
+	ret := (*r)[:n:n]
+	*r = (*r)[n:]
+	return ret, true
+}
+
+// readInt reads an unsigned big endian integer of n bytes, up to 4
+func (r *echReader) readInt(n int) (int, bool) {
+	b, ok := r.read(n)
+	if !ok {
+		return 0, false
+	}
+	ret := 0
+	for _, x := range b {
+		ret = ret<<8 | int(x)
+	}
+	return ret, true
+}
+
+// readVector reads a field prefixed by its length of lenBytes bytes
+func (r *echReader) readVector(lenBytes int) (echReader, bool) {
+	length, ok := r.readInt(lenBytes)
+	if !ok {
+		return nil, false
+	}
+	return r.read(length)
+}
+
+// parseECHConfigList parses an ECHConfigList, which is the "ech" parameter in the HTTPS DNS record of a site,
+// and returns the first ECHConfig that a browser would use
+func parseECHConfigList(input []byte) (*echConfig, error) {
+	r := echReader(input)
+	list, ok := r.readVector(2)
+	if !ok || len(r) != 0 {
+		return nil, fmt.Errorf("%w: list length", errBadECHConfigList)
+	}
+	for len(list) > 0 {
+		version, ok1 := list.readInt(2)
+		contents, ok2 := list.readVector(2)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: ECHConfig", errBadECHConfigList)
+		}
+		if version != echConfigVersion {
+			continue
+		}
+		config, err := parseECHConfigContents(contents)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			return config, nil
+		}
+	}
+	return nil, errNoSupportedECHConfig
+}
+
+// parseECHConfigContents returns nil if the config uses a KEM or cipher suites that we can't pretend to use, or if
+// it has a mandatory extension, which clients must skip the config for if they don't understand it (draft-ietf-tls-esni-13
+// section 4.2). We don't understand any extension
+func parseECHConfigContents(contents echReader) (*echConfig, error) {
+	ret := &echConfig{}
+	configId, ok1 := contents.readInt(1)
+	kemId, ok2 := contents.readInt(2)
+	publicKey, ok3 := contents.readVector(2)
+	cipherSuites, ok4 := contents.readVector(2)
+	maxNameLen, ok5 := contents.readInt(1)
+	publicName, ok6 := contents.readVector(1)
+	extensions, ok7 := contents.readVector(2)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 || !ok7 {
+		return nil, fmt.Errorf("%w: ECHConfigContents", errBadECHConfigList)
+	}
+	ret.configId = byte(configId)
+	ret.maxNameLen = maxNameLen
+	ret.publicName = string(publicName)
+
+	for len(extensions) > 0 {
+		extType, ok1 := extensions.readInt(2)
+		_, ok2 := extensions.readVector(2)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("%w: ECHConfig extension", errBadECHConfigList)
+		}
+		if extType&0x8000 != 0 {
+			// the high bit of the type marks an extension as mandatory
+			return nil, nil
+		}
+	}
+
+	if kemId != hpkeKemX25519 || len(publicKey) != hpkeX25519PublicKeyLen || len(publicName) == 0 {
+		return nil, nil
+	}
+	for len(cipherSuites) >= 4 {
+		kdfId, _ := cipherSuites.readInt(2)
+		aeadId, _ := cipherSuites.readInt(2)
+		if kdfId == hpkeKdfHKDFSHA256 && (aeadId == hpkeAeadAES128GCM || aeadId == hpkeAeadChaCha20Poly1305) {
+			ret.kdfId, ret.aeadId = uint16(kdfId), uint16(aeadId)
+			return ret, nil
+		}
+	}
+	return nil, nil
+}
+
+// paddedInnerLen is the length of an EncodedClientHelloInner of encodedLen bytes carrying a server name of
+// serverNameLen bytes, after it's padded as recommended by draft-ietf-tls-esni-13 section 6.1.3 so that the length
+// doesn't reveal the server name. This is also what BoringSSL, and therefore Chrome, does
+func (config *echConfig) paddedInnerLen(encodedLen int, serverNameLen int) int {
+	var paddingLen int
+	if serverNameLen < config.maxNameLen {
+		paddingLen = config.maxNameLen - serverNameLen
+	}
+	paddingLen += 31 - ((encodedLen + paddingLen - 1) % 32)
+	return encodedLen + paddingLen
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestParseECHConfigList(t *testing.T) {
+	t.Run("first supported config", func(t *testing.T) {
+		// an unknown version followed by a draft-13 config of cloudflare-ech.com
+		list, _ := hex.DecodeString("0050fe090003616263fe0d00452a00200020000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f000800010001000100030012636c6f7564666c6172652d6563682e636f6d0000")
+		config, err := parseECHConfigList(list)
+		if err != nil {
+			t.Fatalf("expecting no error, got %v", err)
+		}
+		if config.configId != 0x2a {
+			t.Errorf("expecting config id 0x2a, got %x", config.configId)
+		}
+		if config.kdfId != hpkeKdfHKDFSHA256 || config.aeadId != hpkeAeadAES128GCM {
+			t.Errorf("unexpected cipher suite %x %x", config.kdfId, config.aeadId)
+		}
+		if config.publicName != "cloudflare-ech.com" {
+			t.Errorf("expecting public name cloudflare-ech.com, got %v", config.publicName)
+		}
+	})
+	t.Run("no supported config", func(t *testing.T) {
+		list, _ := hex.DecodeString("0007fe090003616263")
+		_, err := parseECHConfigList(list)
+		if err != errNoSupportedECHConfig {
+			t.Errorf("expecting %v, got %v", errNoSupportedECHConfig, err)
+		}
+	})
+	t.Run("mandatory extension", func(t *testing.T) {
+		// the draft-13 config above with an extension of type 0xfe01
+		list, _ := hex.DecodeString("0054fe090003616263fe0d00492a00200020000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f000800010001000100030012636c6f7564666c6172652d6563682e636f6d0004fe010000")
+		_, err := parseECHConfigList(list)
+		if err != errNoSupportedECHConfig {
+			t.Errorf("expecting %v, got %v", errNoSupportedECHConfig, err)
+		}
+	})
+	t.Run("optional extension", func(t *testing.T) {
+		list, _ := hex.DecodeString("0054fe090003616263fe0d00492a00200020000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f000800010001000100030012636c6f7564666c6172652d6563682e636f6d000400010000")
+		_, err := parseECHConfigList(list)
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		for _, s := range []string{
+			"",
+			"00",
+			"0050fe090003616263fe0d00452a0020002000010203",
+			// the length of the list matches, but not that of the config in it
+			"0010fe090003616263fe0d00452a00200020",
+			// the length of the config matches, but not that of its public key
+			"0010fe090003616263fe0d00052a00200020",
+		} {
+			list, _ := hex.DecodeString(s)
+			_, err := parseECHConfigList(list)
+			if !errors.Is(err, errBadECHConfigList) {
+				t.Errorf("%v: expecting %v, got %v", s, errBadECHConfigList, err)
+			}
+		}
+	})
+}
+
+func TestPaddedInnerLen(t *testing.T) {
+	config := &echConfig{maxNameLen: 64}
+	// 49 bytes to pad the name up to 64 bytes, then 7 more to round 249 up to a multiple of 32
+	if l := config.paddedInnerLen(200, 15); l != 256 {
+		t.Errorf("expecting 256, got %v", l)
+	}
+	// a name longer than maxNameLen is only rounded up
+	if l := config.paddedInnerLen(200, 80); l != 224 {
+		t.Errorf("expecting 224, got %v", l)
+	}
+}
@@ -0,0 +1,101 @@
+package client
+
+// With a CDN in front of the server, any of its edges can carry the connections, and how fast each is from where the
+// client is varies a lot. Given the IPs of the edges, or the ranges they're in, the client connects to them directly,
+// as endpoints of RemotePort, while the connections still ask for RemoteHost of the CDN. They're measured by how long
+// they take to connect to and to complete a TLS handshake with, which the CDN answers itself
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	utls "github.com/refraction-networking/utls"
+)
+
+// the most edges taken at random out of each range
+const maxEdgesPerRange = 16
+
+// parseEdges returns the host:port of port of each edge IP in raw, and of up to maxEdgesPerRange IPs picked at random
+// out of each CIDR range in it
+func parseEdges(raw []string, port string, randSource io.Reader) ([]string, error) {
+	var addrs []string
+	seen := make(map[string]bool)
+	add := func(ip net.IP) {
+		addr := net.JoinHostPort(ip.String(), port)
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, s := range raw {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("bad edge IP %v", s)
+			}
+			add(ip)
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad edge range %v: %v", s, err)
+		}
+		for _, ip := range sampleRange(ipNet, maxEdgesPerRange, randSource) {
+			add(ip)
+		}
+	}
+	return addrs, nil
+}
+
+// sampleRange returns every address of ipNet apart from the network address if there are at most n of them, or else n
+// of them picked at random
+func sampleRange(ipNet *net.IPNet, n int, randSource io.Reader) []net.IP {
+	ones, bits := ipNet.Mask.Size()
+	hostBits := bits - ones
+	var ips []net.IP
+	if hostBits < 31 && 1<<uint(hostBits) <= n+1 {
+		ip := ipNet.IP
+		for i := 1; i < 1<<uint(hostBits); i++ {
+			ip = nextIP(ip)
+			ips = append(ips, ip)
+		}
+		return ips
+	}
+	seen := make(map[string]bool)
+	for len(ips) < n {
+		ip := make(net.IP, len(ipNet.IP))
+		common.RandRead(randSource, ip)
+		for i := range ip {
+			ip[i] = ipNet.IP[i] | ip[i]&^ipNet.Mask[i]
+		}
+		if ip.Equal(ipNet.IP) || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// tlsProbe makes a probe of Endpoints that completes a TLS handshake for serverName
+func tlsProbe(serverName string) func(net.Conn) error {
+	return func(conn net.Conn) error {
+		uconn := utls.UClient(conn, &utls.Config{ServerName: serverName, InsecureSkipVerify: true}, utls.HelloChrome_Auto)
+		return uconn.Handshake()
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestParseEdges(t *testing.T) {
+	addrs, err := parseEdges([]string{"104.16.1.1", "2606:4700::1", "104.16.1.1", "104.16.2.0/30"}, "443", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"104.16.1.1:443", "[2606:4700::1]:443", "104.16.2.1:443", "104.16.2.2:443", "104.16.2.3:443"}
+	if len(addrs) != len(expected) {
+		t.Fatalf("expecting %v, got %v", expected, addrs)
+	}
+	for i := range expected {
+		if addrs[i] != expected[i] {
+			t.Errorf("expecting %v, got %v", expected[i], addrs[i])
+		}
+	}
+
+	_, ipNet, _ := net.ParseCIDR("172.64.0.0/13")
+	addrs, err = parseEdges([]string{ipNet.String()}, "443", rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != maxEdgesPerRange {
+		t.Errorf("expecting %v edges out of a large range, got %v", maxEdgesPerRange, len(addrs))
+	}
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); !ipNet.Contains(ip) || ip.Equal(ipNet.IP) {
+			t.Errorf("%v isn't a host in %v", addr, ipNet)
+		}
+	}
+
+	for _, s := range []string{"cdn.com", "104.16.1.1/33", "104.16.1"} {
+		if _, err := parseEdges([]string{s}, "443", rand.Reader); err == nil {
+			t.Errorf("%v: expecting an error", s)
+		}
+	}
+}
+
+func TestTLSProbe(t *testing.T) {
+	edge := httptest.NewTLSServer(http.NotFoundHandler())
+	defer edge.Close()
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	es, err := MakeEndpoints(edge.Listener.Addr().String(), []string{plain.Listener.Addr().String()}, time.Hour,
+		common.WorldState{Now: time.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.probe = tlsProbe("cdn.com")
+	es.check(context.Background(), &net.Dialer{})
+	if e := es.find(edge.Listener.Addr().String()); e.rtt == 0 || e.failures != 0 {
+		t.Errorf("the edge that completes the TLS handshake isn't measured: %+v", e)
+	}
+	if e := es.find(plain.Listener.Addr().String()); e.failures != 1 {
+		t.Errorf("the endpoint that doesn't speak TLS didn't fail: %+v", e)
+	}
+}
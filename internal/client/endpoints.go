@@ -0,0 +1,251 @@
+package client
+
+// With Endpoints, the server can be reached on more than one address, e.g. on several hosts or on alternative ports
+// of RemoteHost, of which connections are made to the best. How good an endpoint is is measured by how long it takes
+// to connect to, divided by its weight, and whether the handshakes made through it succeed. An endpoint that fails
+// is left alone for a while, and the client switches to the best of the rest. Apart from what the connections of the
+// sessions tell, the endpoints can be checked every HealthCheckInterval by connecting to each of them
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckInterval = 30 * time.Second
+	// how long an endpoint that has failed is left alone before it's tried again
+	endpointRetryAfter = 30 * time.Second
+	// how much better another endpoint must be to be switched to from one that works, so that the client doesn't
+	// flap between endpoints that are about as good
+	endpointSwitchMargin = 0.8
+	// how long a health check has to probe an endpoint once it's connected to it
+	probeTimeout = 10 * time.Second
+)
+
+// Endpoints are the addresses the server can be reached on, in the order they're preferred in when nothing is known
+// of them
+type Endpoints struct {
+	endpoints []endpoint
+	// how often the endpoints are checked, 0 if they aren't
+	interval time.Duration
+	// what's done on the connection of a health check once it's made, and measured along with connecting. nil if
+	// connecting is all there is to it
+	probe func(net.Conn) error
+	now   func() time.Time
+
+	m sync.Mutex
+	// the index of the endpoint connections are made to
+	current int
+}
+
+type endpoint struct {
+	addr   string
+	weight int
+	// the smoothed time it takes to connect, 0 until it's measured
+	rtt time.Duration
+	// failures in a row, and when the last one was
+	failures int
+	failedAt time.Time
+}
+
+// parseEndpoint parses host:port, or :port for a port of remoteHost, followed by an optional @weight
+func parseEndpoint(s string, remoteHost string) (addr string, weight int, err error) {
+	weight = 1
+	if i := strings.LastIndexByte(s, '@'); i != -1 {
+		weight, err = strconv.Atoi(s[i+1:])
+		if err != nil || weight <= 0 {
+			return "", 0, fmt.Errorf("bad weight of endpoint %v", s)
+		}
+		s = s[:i]
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad endpoint %v: %v", s, err)
+	}
+	if host == "" {
+		host = remoteHost
+	}
+	return net.JoinHostPort(host, port), weight, nil
+}
+
+// MakeEndpoints makes Endpoints of remoteAddr, with a weight of 1, followed by the endpoints of raw, which are parsed
+// by parseEndpoint. They're checked every interval unless it's 0
+func MakeEndpoints(remoteAddr string, raw []string, interval time.Duration, worldState common.WorldState) (*Endpoints, error) {
+	remoteHost, _, _ := net.SplitHostPort(remoteAddr)
+	es := &Endpoints{
+		endpoints: []endpoint{{addr: remoteAddr, weight: 1}},
+		interval:  interval,
+		now:       worldState.Now,
+	}
+	seen := map[string]bool{remoteAddr: true}
+	for _, s := range raw {
+		addr, weight, err := parseEndpoint(s, remoteHost)
+		if err != nil {
+			return nil, err
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("endpoint %v is given more than once", addr)
+		}
+		seen[addr] = true
+		es.endpoints = append(es.endpoints, endpoint{addr: addr, weight: weight})
+	}
+	return es, nil
+}
+
+func (es *Endpoints) healthy(e *endpoint) bool {
+	return e.failures == 0 || es.now().Sub(e.failedAt) >= endpointRetryAfter
+}
+
+// score is how long it takes to connect to e for its weight, lower being better
+func (e *endpoint) score() float64 {
+	return float64(e.rtt) / float64(e.weight)
+}
+
+// better is whether e is better than other by margin. An endpoint that has been measured is better than one that
+// hasn't, and of two that haven't, the one with the greater weight is
+func (e *endpoint) better(other *endpoint, margin float64) bool {
+	switch {
+	case e.rtt == 0 && other.rtt == 0:
+		return e.weight > other.weight
+	case e.rtt == 0:
+		return false
+	case other.rtt == 0:
+		return true
+	default:
+		return e.score() < other.score()*margin
+	}
+}
+
+// pick returns the address of the best endpoint, switching to it if it's clearly better than the current one or if
+// the current one isn't healthy
+func (es *Endpoints) pick() string {
+	es.m.Lock()
+	defer es.m.Unlock()
+	best := -1
+	for i := range es.endpoints {
+		e := &es.endpoints[i]
+		if es.healthy(e) && (best == -1 || e.better(&es.endpoints[best], 1)) {
+			best = i
+		}
+	}
+	if best == -1 {
+		// none is healthy, so the one that has been left alone the longest is tried
+		for i := range es.endpoints {
+			if best == -1 || es.endpoints[i].failedAt.Before(es.endpoints[best].failedAt) {
+				best = i
+			}
+		}
+	}
+	cur := &es.endpoints[es.current]
+	if best != es.current && (!es.healthy(cur) || es.endpoints[best].better(cur, endpointSwitchMargin)) {
+		log.Infof("Switching from endpoint %v to %v", cur.addr, es.endpoints[best].addr)
+		es.current = best
+	}
+	return es.endpoints[es.current].addr
+}
+
+func (es *Endpoints) find(addr string) *endpoint {
+	for i := range es.endpoints {
+		if es.endpoints[i].addr == addr {
+			return &es.endpoints[i]
+		}
+	}
+	return nil
+}
+
+// measured records that connecting to addr took rtt
+func (es *Endpoints) measured(addr string, rtt time.Duration) {
+	es.m.Lock()
+	defer es.m.Unlock()
+	e := es.find(addr)
+	if e == nil {
+		return
+	}
+	if rtt <= 0 {
+		rtt = 1
+	}
+	if e.rtt == 0 {
+		e.rtt = rtt
+	} else {
+		e.rtt = (7*e.rtt + rtt) / 8
+	}
+}
+
+// succeeded records that a connection was made to addr, with a handshake, after rtt. Nothing is recorded on nil
+func (es *Endpoints) succeeded(addr string, rtt time.Duration) {
+	if es == nil {
+		return
+	}
+	es.measured(addr, rtt)
+	es.m.Lock()
+	defer es.m.Unlock()
+	if e := es.find(addr); e != nil {
+		e.failures = 0
+	}
+}
+
+// failed records that a connection, or its handshake, couldn't be made to addr. Nothing is recorded on nil
+func (es *Endpoints) failed(addr string) {
+	if es == nil {
+		return
+	}
+	es.m.Lock()
+	defer es.m.Unlock()
+	if e := es.find(addr); e != nil {
+		e.failures++
+		e.failedAt = es.now()
+	}
+}
+
+// check connects to every endpoint at once, and probes them, measuring how long each takes
+func (es *Endpoints) check(ctx context.Context, dialer common.Dialer) {
+	var wg sync.WaitGroup
+	for _, e := range es.endpoints {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			start := time.Now()
+			conn, err := common.DialContext(ctx, dialer, "tcp", addr)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Debugf("Health check of endpoint %v failed: %v", addr, err)
+				es.failed(addr)
+				return
+			}
+			defer conn.Close()
+			if es.probe != nil {
+				conn.SetDeadline(time.Now().Add(probeTimeout))
+				if err = es.probe(conn); err != nil {
+					log.Debugf("Health check of endpoint %v failed: %v", addr, err)
+					es.failed(addr)
+					return
+				}
+			}
+			es.measured(addr, time.Since(start))
+		}(e.addr)
+	}
+	wg.Wait()
+}
+
+// Watch checks the endpoints every interval until ctx is done, returning straight away if they aren't checked
+func (es *Endpoints) Watch(ctx context.Context, dialer common.Dialer) {
+	if es.interval <= 0 {
+		return
+	}
+	for ctx.Err() == nil {
+		es.check(ctx, dialer)
+		if !wait(ctx, es.interval) {
+			return
+		}
+	}
+}
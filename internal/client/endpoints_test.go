@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	for s, expected := range map[string]struct {
+		addr   string
+		weight int
+	}{
+		"backup.com:443": {"backup.com:443", 1},
+		":8443":          {"example.com:8443", 1},
+		"[::1]:443@3":    {"[::1]:443", 3},
+		"10.0.0.1:443@1": {"10.0.0.1:443", 1},
+		":8443@2":        {"example.com:8443", 2},
+	} {
+		addr, weight, err := parseEndpoint(s, "example.com")
+		if err != nil {
+			t.Errorf("%v: %v", s, err)
+			continue
+		}
+		if addr != expected.addr || weight != expected.weight {
+			t.Errorf("%v: expecting %v@%v, got %v@%v", s, expected.addr, expected.weight, addr, weight)
+		}
+	}
+	for _, s := range []string{"backup.com", "backup.com:443@0", "backup.com:443@x", ""} {
+		if _, _, err := parseEndpoint(s, "example.com"); err == nil {
+			t.Errorf("%v: expecting an error", s)
+		}
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	now := time.Unix(10, 0)
+	makeEndpoints := func(t *testing.T, raw ...string) *Endpoints {
+		es, err := MakeEndpoints("a:443", raw, 0, common.WorldState{Now: func() time.Time { return now }})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return es
+	}
+
+	t.Run("in order until measured", func(t *testing.T) {
+		es := makeEndpoints(t, "b:443", "c:443")
+		if addr := es.pick(); addr != "a:443" {
+			t.Errorf("expecting the first endpoint, got %v", addr)
+		}
+		es.succeeded("c:443", 50*time.Millisecond)
+		if addr := es.pick(); addr != "c:443" {
+			t.Errorf("expecting the measured endpoint, got %v", addr)
+		}
+	})
+
+	t.Run("weight", func(t *testing.T) {
+		es := makeEndpoints(t, "b:443@4")
+		if addr := es.pick(); addr != "b:443" {
+			t.Errorf("expecting the heavier endpoint, got %v", addr)
+		}
+		es.succeeded("a:443", 50*time.Millisecond)
+		es.succeeded("b:443", 150*time.Millisecond)
+		if addr := es.pick(); addr != "b:443" {
+			t.Errorf("expecting the heavier endpoint for its weight, got %v", addr)
+		}
+	})
+
+	t.Run("hysteresis", func(t *testing.T) {
+		es := makeEndpoints(t, "b:443")
+		es.succeeded("a:443", 100*time.Millisecond)
+		es.succeeded("b:443", 90*time.Millisecond)
+		if addr := es.pick(); addr != "a:443" {
+			t.Errorf("switched to an endpoint that's only slightly better: %v", addr)
+		}
+		for i := 0; i < 20; i++ {
+			es.measured("b:443", 10*time.Millisecond)
+		}
+		if addr := es.pick(); addr != "b:443" {
+			t.Errorf("didn't switch to a much better endpoint: %v", addr)
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		es := makeEndpoints(t, "b:443", ":8443")
+		es.failed("a:443")
+		if addr := es.pick(); addr != "b:443" {
+			t.Errorf("expecting the next endpoint after a failure, got %v", addr)
+		}
+		es.failed("b:443")
+		if addr := es.pick(); addr != "a:8443" {
+			t.Errorf("expecting the alternative port, got %v", addr)
+		}
+
+		now = now.Add(time.Second)
+		es.failed("a:8443")
+		if addr := es.pick(); addr != "a:443" {
+			t.Errorf("expecting the endpoint that failed the longest ago when none is healthy, got %v", addr)
+		}
+
+		now = now.Add(endpointRetryAfter)
+		es.succeeded("b:443", 10*time.Millisecond)
+		if addr := es.pick(); addr != "b:443" {
+			t.Errorf("expecting the endpoint that works again, got %v", addr)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		if _, err := MakeEndpoints("a:443", []string{"b:443", "b:443@2"}, 0, common.WorldState{Now: time.Now}); err == nil {
+			t.Error("expecting an error for an endpoint given twice")
+		}
+	})
+}
+
+func TestEndpoints_Watch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// nothing listens on the port of a listener that's been closed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	es, err := MakeEndpoints(closed.Addr().String(), []string{l.Addr().String()}, time.Hour, common.WorldState{Now: time.Now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan struct{})
+	go func() {
+		es.Watch(ctx, &net.Dialer{})
+		close(watched)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for es.pick() != l.Addr().String() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expecting the endpoint that's listening, got %v", es.pick())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-watched
+}
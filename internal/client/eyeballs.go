@@ -0,0 +1,214 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+const (
+	// how long the answer of the preferred family is waited for once the other has come, as in RFC 8305 section 3
+	resolutionDelay = 50 * time.Millisecond
+	// how long a connection attempt has on its own before the next is started, as in RFC 8305 section 5
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+var ErrNoAddress = errors.New("no address to connect to")
+
+// HappyEyeballs is a Dialer that looks up both the IPv6 and IPv4 addresses of a host, and races connections to them
+// as in RFC 8305, so that the server is reached on whichever works on dual-stack and single-stack networks alike.
+// Addresses that are already IPs are dialled as they are. Host names are looked up with the system's resolver, or
+// resolver if it isn't nil
+type HappyEyeballs struct {
+	dialer common.Dialer
+	// IPv4 addresses are tried ahead of IPv6 ones
+	preferIPv4 bool
+	lookupIP   func(ctx context.Context, network string, host string) ([]net.IP, error)
+}
+
+func MakeHappyEyeballs(dialer common.Dialer, preferIPv4 bool, resolver *Resolver) *HappyEyeballs {
+	h := &HappyEyeballs{
+		dialer:     dialer,
+		preferIPv4: preferIPv4,
+		lookupIP:   net.DefaultResolver.LookupIP,
+	}
+	if resolver != nil {
+		h.lookupIP = func(ctx context.Context, network string, host string) ([]net.IP, error) {
+			return resolver.LookupIP(ctx, dialer, network, host)
+		}
+	}
+	return h
+}
+
+func (h *HappyEyeballs) Dial(network, address string) (net.Conn, error) {
+	return h.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial that gives up once ctx is done
+func (h *HappyEyeballs) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return common.DialContext(ctx, h.dialer, network, address)
+	}
+	switch network {
+	case "tcp":
+		return h.race(ctx, host, port)
+	case "udp":
+		// there's no handshake to race, so it's sent to the first address the host has
+		ips, err := h.lookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		preferred, other := h.split(ips)
+		ips = append(preferred, other...)
+		if len(ips) == 0 {
+			return nil, ErrNoAddress
+		}
+		return common.DialContext(ctx, h.dialer, network, net.JoinHostPort(ips[0].String(), port))
+	default:
+		return common.DialContext(ctx, h.dialer, network, address)
+	}
+}
+
+// split sorts ips into those of the preferred family and the others, keeping their order
+func (h *HappyEyeballs) split(ips []net.IP) (preferred []net.IP, other []net.IP) {
+	for _, ip := range ips {
+		if (ip.To4() != nil) == h.preferIPv4 {
+			preferred = append(preferred, ip)
+		} else {
+			other = append(other, ip)
+		}
+	}
+	return
+}
+
+type lookupAnswer struct {
+	preferred bool
+	ips       []net.IP
+	err       error
+}
+
+type dialAttempt struct {
+	conn net.Conn
+	err  error
+}
+
+// race looks up the IPv6 and IPv4 addresses of host at once, and connects to them in turn, alternating between the
+// families from the preferred one. A connection attempt is started every connectionAttemptDelay, or as soon as the
+// last one fails, and the first to succeed is returned. It gives up once ctx is done
+func (h *HappyEyeballs) race(ctx context.Context, host string, port string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	preferredNetwork, otherNetwork := "ip6", "ip4"
+	if h.preferIPv4 {
+		preferredNetwork, otherNetwork = otherNetwork, preferredNetwork
+	}
+	answers := make(chan lookupAnswer, 2)
+	for _, network := range []string{preferredNetwork, otherNetwork} {
+		network := network
+		go func() {
+			ips, err := h.lookupIP(ctx, network, host)
+			answers <- lookupAnswer{preferred: network == preferredNetwork, ips: ips, err: err}
+		}()
+	}
+
+	attempts := make(chan dialAttempt)
+	var preferred, other []net.IP
+	lastWasPreferred := false
+	lookups := 2
+	running := 0
+	// attempts are started once the preferred family has answered, or the other has and resolutionDelay has passed
+	ready := false
+	var resolutionTimer <-chan time.Time
+	// whether the next attempt can be started without waiting for the last
+	canStart := true
+	var attemptTimer <-chan time.Time
+	// why connecting failed, or failing that why looking up failed
+	var dialErr, lookupErr error
+	for {
+		if ready && canStart && len(preferred)+len(other) != 0 {
+			var ip net.IP
+			if len(preferred) != 0 && (!lastWasPreferred || len(other) == 0) {
+				ip, preferred = preferred[0], preferred[1:]
+				lastWasPreferred = true
+			} else {
+				ip, other = other[0], other[1:]
+				lastWasPreferred = false
+			}
+			running++
+			go func() {
+				conn, err := h.dial(ctx, net.JoinHostPort(ip.String(), port))
+				attempts <- dialAttempt{conn: conn, err: err}
+			}()
+			canStart = false
+			attemptTimer = time.After(connectionAttemptDelay)
+		}
+		if lookups == 0 && running == 0 && len(preferred)+len(other) == 0 {
+			switch {
+			case dialErr != nil:
+				return nil, dialErr
+			case lookupErr != nil:
+				return nil, lookupErr
+			default:
+				return nil, ErrNoAddress
+			}
+		}
+
+		select {
+		case answer := <-answers:
+			lookups--
+			if answer.err != nil {
+				if lookupErr == nil {
+					lookupErr = answer.err
+				}
+			} else if answer.preferred {
+				preferred = append(preferred, answer.ips...)
+			} else {
+				other = append(other, answer.ips...)
+			}
+			if answer.preferred || lookups == 0 {
+				ready = true
+			} else if !ready {
+				resolutionTimer = time.After(resolutionDelay)
+			}
+		case <-resolutionTimer:
+			ready = true
+		case <-attemptTimer:
+			canStart = true
+		case <-ctx.Done():
+			go abandon(attempts, running)
+			return nil, ctx.Err()
+		case attempt := <-attempts:
+			running--
+			if attempt.err == nil {
+				go abandon(attempts, running)
+				return attempt.conn, nil
+			}
+			if dialErr == nil {
+				dialErr = attempt.err
+			}
+			canStart = true
+		}
+	}
+}
+
+// abandon waits for the attempts still running, and closes the connections they make anyway
+func abandon(attempts <-chan dialAttempt, running int) {
+	for ; running > 0; running-- {
+		if late := <-attempts; late.conn != nil {
+			late.conn.Close()
+		}
+	}
+}
+
+// dial connects to address over TCP, and gives up once ctx is done
+func (h *HappyEyeballs) dial(ctx context.Context, address string) (net.Conn, error) {
+	return common.DialContext(ctx, h.dialer, "tcp", address)
+}
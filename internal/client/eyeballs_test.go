@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeEyeballsDialer connects to the addresses in ok, fails to connect to those in fail, and hangs on the others
+// until it's given up
+type fakeEyeballsDialer struct {
+	ok   map[string]bool
+	fail map[string]bool
+
+	m      sync.Mutex
+	dialed []string
+}
+
+var errRefused = errors.New("connection refused")
+
+func (d *fakeEyeballsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *fakeEyeballsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.m.Lock()
+	d.dialed = append(d.dialed, network+" "+address)
+	d.m.Unlock()
+	switch {
+	case d.ok[address]:
+		conn, _ := net.Pipe()
+		return conn, nil
+	case d.fail[address]:
+		return nil, errRefused
+	default:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+}
+
+func (d *fakeEyeballsDialer) history() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return append([]string{}, d.dialed...)
+}
+
+func fakeLookup(v6 []string, v4 []string) func(context.Context, string, string) ([]net.IP, error) {
+	parse := func(ips []string) ([]net.IP, error) {
+		if len(ips) == 0 {
+			return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+		}
+		var parsed []net.IP
+		for _, ip := range ips {
+			parsed = append(parsed, net.ParseIP(ip))
+		}
+		return parsed, nil
+	}
+	return func(_ context.Context, network string, _ string) ([]net.IP, error) {
+		switch network {
+		case "ip6":
+			return parse(v6)
+		case "ip4":
+			return parse(v4)
+		default:
+			return parse(append(append([]string{}, v4...), v6...))
+		}
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	t.Run("IPv6 hangs", func(t *testing.T) {
+		d := &fakeEyeballsDialer{ok: map[string]bool{"192.0.2.1:443": true}}
+		h := MakeHappyEyeballs(d, false, nil)
+		h.lookupIP = fakeLookup([]string{"2001:db8::1"}, []string{"192.0.2.1"})
+		conn, err := h.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		expected := []string{"tcp [2001:db8::1]:443", "tcp 192.0.2.1:443"}
+		if dialed := d.history(); !reflect.DeepEqual(dialed, expected) {
+			t.Errorf("expecting %v to be dialled, got %v", expected, dialed)
+		}
+	})
+	t.Run("prefer IPv4", func(t *testing.T) {
+		d := &fakeEyeballsDialer{ok: map[string]bool{"192.0.2.1:443": true, "[2001:db8::1]:443": true}}
+		h := MakeHappyEyeballs(d, true, nil)
+		h.lookupIP = fakeLookup([]string{"2001:db8::1"}, []string{"192.0.2.1"})
+		conn, err := h.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if dialed := d.history(); dialed[0] != "tcp 192.0.2.1:443" {
+			t.Errorf("expecting IPv4 to be dialled first, got %v", dialed)
+		}
+	})
+	t.Run("IPv6 only", func(t *testing.T) {
+		d := &fakeEyeballsDialer{
+			ok:   map[string]bool{"[2001:db8::2]:443": true},
+			fail: map[string]bool{"[2001:db8::1]:443": true},
+		}
+		h := MakeHappyEyeballs(d, true, nil)
+		h.lookupIP = fakeLookup([]string{"2001:db8::1", "2001:db8::2"}, nil)
+		conn, err := h.Dial("tcp", "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+	t.Run("all fail", func(t *testing.T) {
+		d := &fakeEyeballsDialer{fail: map[string]bool{"[2001:db8::1]:443": true, "192.0.2.1:443": true}}
+		h := MakeHappyEyeballs(d, false, nil)
+		h.lookupIP = fakeLookup([]string{"2001:db8::1"}, []string{"192.0.2.1"})
+		if _, err := h.Dial("tcp", "example.com:443"); !errors.Is(err, errRefused) {
+			t.Errorf("expecting %v, got %v", errRefused, err)
+		}
+	})
+	t.Run("no addresses", func(t *testing.T) {
+		h := MakeHappyEyeballs(&fakeEyeballsDialer{}, false, nil)
+		h.lookupIP = fakeLookup(nil, nil)
+		var dnsErr *net.DNSError
+		if _, err := h.Dial("tcp", "example.com:443"); !errors.As(err, &dnsErr) {
+			t.Errorf("expecting a DNS error, got %v", err)
+		}
+	})
+	t.Run("IP", func(t *testing.T) {
+		d := &fakeEyeballsDialer{ok: map[string]bool{"192.0.2.1:443": true}}
+		h := MakeHappyEyeballs(d, false, nil)
+		h.lookupIP = nil
+		conn, err := h.Dial("tcp", "192.0.2.1:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+	t.Run("UDP", func(t *testing.T) {
+		d := &fakeEyeballsDialer{ok: map[string]bool{"[2001:db8::1]:62201": true}}
+		h := MakeHappyEyeballs(d, false, nil)
+		h.lookupIP = fakeLookup([]string{"2001:db8::1"}, []string{"192.0.2.1"})
+		conn, err := h.Dial("udp", "example.com:62201")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		expected := []string{"udp [2001:db8::1]:62201"}
+		if dialed := d.history(); !reflect.DeepEqual(dialed, expected) {
+			t.Errorf("expecting %v to be dialled, got %v", expected, dialed)
+		}
+	})
+}
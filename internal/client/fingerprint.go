@@ -0,0 +1,123 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	utls "github.com/refraction-networking/utls"
+)
+
+// FingerprintReport is how the ClientHello that a config makes compares with that of the browser it's meant to
+// look like
+type FingerprintReport struct {
+	// the name of the browser
+	Browser string
+	Got     common.Fingerprint
+	// the fingerprint of the browser's uTLS preset
+	Want common.Fingerprint
+	// what makes the ClientHello stand out, empty if nothing does
+	Warnings []string
+	// what in the config isn't taken as it may be meant, though it doesn't make the ClientHello stand out
+	Notes []string
+}
+
+// fingerprintTarget returns the browser whose uTLS preset the ClientHello of raw's transport is made with, and notes
+// on how BrowserSig is taken
+func fingerprintTarget(raw RawConfig) (name string, helloID utls.ClientHelloID, notes []string) {
+	switch strings.ToLower(raw.Transport) {
+	case "cdn", "grpc":
+		if raw.BrowserSig != "" && strings.ToLower(raw.BrowserSig) != "chrome" {
+			notes = append(notes, fmt.Sprintf("BrowserSig %v is ignored with Transport %v, which always looks like chrome", raw.BrowserSig, raw.Transport))
+		}
+		return "chrome", utls.HelloChrome_Auto, notes
+	}
+	name = strings.ToLower(raw.BrowserSig)
+	helloID, ok := common.Parrots[name]
+	if !ok {
+		if name != "" {
+			notes = append(notes, fmt.Sprintf("BrowserSig %v is unknown, chrome is used instead", raw.BrowserSig))
+		}
+		name, helloID = "chrome", common.Parrots["chrome"]
+	}
+	return name, helloID, notes
+}
+
+// captureClientHello makes a connection of transport to a listener on the loopback, which takes its ClientHello
+// and hangs up. It returns the ClientHello without the record layer
+func captureClientHello(transport Transport, authInfo AuthInfo) ([]byte, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	serverConn, err := l.Accept()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	handshakeDone := make(chan struct{})
+	go func() {
+		// it fails once we hang up
+		_, _ = transport.Handshake(conn, authInfo)
+		close(handshakeDone)
+	}()
+	defer func() {
+		serverConn.Close()
+		conn.Close()
+		<-handshakeDone
+	}()
+
+	_ = serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(serverConn, header); err != nil {
+		return nil, fmt.Errorf("failed to read the ClientHello: %v", err)
+	}
+	if header[0] != common.Handshake {
+		return nil, errors.New("the transport doesn't start with a TLS handshake")
+	}
+	ch := make([]byte, binary.BigEndian.Uint16(header[3:5]))
+	if _, err = io.ReadFull(serverConn, ch); err != nil {
+		return nil, fmt.Errorf("failed to read the ClientHello: %v", err)
+	}
+	return ch, nil
+}
+
+// CheckFingerprint compares the ClientHello that remote's transport sends with that of the uTLS preset of the
+// browser it's meant to look like, which is made with the same server name
+func CheckFingerprint(raw RawConfig, remote RemoteConnConfig, authInfo AuthInfo) (report FingerprintReport, err error) {
+	var helloID utls.ClientHelloID
+	report.Browser, helloID, report.Notes = fingerprintTarget(raw)
+
+	ch, err := captureClientHello(remote.TransportMaker(), authInfo)
+	if err != nil {
+		return
+	}
+	var serverName string
+	report.Got, serverName, err = common.ParseFingerprint(ch)
+	if err != nil {
+		return
+	}
+
+	uconn := utls.UClient(&net.TCPConn{}, &utls.Config{ServerName: serverName}, helloID)
+	if err = uconn.BuildHandshakeState(); err != nil {
+		return
+	}
+	report.Want, _, err = common.ParseFingerprint(uconn.HandshakeState.Hello.Raw)
+	if err != nil {
+		return
+	}
+	for _, diff := range report.Got.Differences(report.Want) {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("unlike %v, the ClientHello's %v", report.Browser, diff))
+	}
+	return
+}
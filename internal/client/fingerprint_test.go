@@ -0,0 +1,52 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestCheckFingerprint(t *testing.T) {
+	worldState := common.WorldOfTime(time.Now())
+	for _, c := range []struct {
+		name       string
+		transport  string
+		browserSig string
+		browser    string
+		notes      int
+	}{
+		{"direct chrome", "direct", "chrome", "chrome", 0},
+		{"direct firefox", "direct", "firefox", "firefox", 0},
+		{"direct safari", "direct", "safari", "safari", 0},
+		{"realtls firefox", "realtls", "firefox", "firefox", 0},
+		{"unknown browser", "direct", "netscape", "chrome", 1},
+		{"cdn ignores BrowserSig", "cdn", "firefox", "chrome", 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			raw := validRawConfig()
+			raw.Transport = c.transport
+			raw.BrowserSig = c.browserSig
+			_, remote, auth, err := raw.SplitConfigs(worldState)
+			if err != nil {
+				t.Fatal(err)
+			}
+			report, err := CheckFingerprint(raw, remote, auth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Browser != c.browser {
+				t.Errorf("expecting the ClientHello to be compared with %v, got %v", c.browser, report.Browser)
+			}
+			if len(report.Warnings) != 0 {
+				t.Errorf("the ClientHello stands out: %v", report.Warnings)
+			}
+			if len(report.Notes) != c.notes {
+				t.Errorf("expecting %v notes, got %v", c.notes, report.Notes)
+			}
+			if report.Got.JA3NHash() != report.Want.JA3NHash() {
+				t.Errorf("expecting JA3N %v, got %v", report.Want.JA3N(), report.Got.JA3N())
+			}
+		})
+	}
+}
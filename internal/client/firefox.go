@@ -51,7 +51,16 @@ func (f *Firefox) composeExtensions(SNI []byte, keyShare []byte) []byte {
 	return ret
 }
 
-func (f *Firefox) composeClientHello(hd clientHelloFields) (ch []byte) {
+func (f *Firefox) composeClientHello(hd clientHelloFields) (ch []byte, err error) {
+	if hd.echConfig != nil {
+		return nil, errECHUnsupported
+	}
+	if hd.psk != nil {
+		return nil, errResumptionUnsupported
+	}
+	if hd.mlkemKeyShare != nil {
+		return nil, errNoMLKEMKeyShare
+	}
 	var clientHello [12][]byte
 	clientHello[0] = []byte{0x01}             // handshake type
 	clientHello[1] = []byte{0x00, 0x01, 0xfc} // length 508
@@ -65,7 +74,7 @@ func (f *Firefox) composeClientHello(hd clientHelloFields) (ch []byte) {
 	clientHello[8] = []byte{0x01} // compression methods length 1
 	clientHello[9] = []byte{0x00} // compression methods
 
-	clientHello[11] = f.composeExtensions(hd.sni, hd.x25519KeyShare)
+	clientHello[11] = f.composeExtensions(makeServerName(hd.serverName), hd.x25519KeyShare)
 	clientHello[10] = []byte{0x00, 0x00} // extensions length
 	binary.BigEndian.PutUint16(clientHello[10], uint16(len(clientHello[11])))
 
@@ -73,5 +82,5 @@ func (f *Firefox) composeClientHello(hd clientHelloFields) (ch []byte) {
 	for _, c := range clientHello {
 		ret = append(ret, c...)
 	}
-	return ret
+	return ret, nil
 }
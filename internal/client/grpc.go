@@ -0,0 +1,116 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+	"net/http"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// GRPCOverTLS carries the Cloak connection as a bidirectional gRPC stream to a CDN, which passes it on to the Cloak
+// server over HTTP/2
+type GRPCOverTLS struct {
+	*common.GRPCConn
+	cdnDomainPort string
+	path          string
+	// the authority of the request is one of these for each connection, or cdnDomainPort if there are none
+	hosts []string
+}
+
+// h2ClientStream writes to the request body and reads from the response body of an HTTP/2 stream
+type h2ClientStream struct {
+	io.ReadCloser
+	reqBody *io.PipeWriter
+	conn    net.Conn
+}
+
+func (s *h2ClientStream) Write(data []byte) (int, error) { return s.reqBody.Write(data) }
+
+func (s *h2ClientStream) Close() error {
+	s.reqBody.Close()
+	s.ReadCloser.Close()
+	return s.conn.Close()
+}
+
+func (g *GRPCOverTLS) Close() error {
+	if g.GRPCConn == nil {
+		return nil
+	}
+	return g.GRPCConn.Close()
+}
+
+func (g *GRPCOverTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	defer func() {
+		if err != nil && g.GRPCConn == nil {
+			rawConn.Close()
+		}
+	}()
+	utlsConfig := &utls.Config{
+		ServerName:         authInfo.MockDomain,
+		InsecureSkipVerify: true,
+	}
+	uconn := utls.UClient(rawConn, utlsConfig, utls.HelloChrome_Auto)
+	err = uconn.Handshake()
+	if err != nil {
+		return
+	}
+	if proto := uconn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		return sessionKey, fmt.Errorf("CDN negotiated %q instead of HTTP/2", proto)
+	}
+
+	cc, err := (&http2.Transport{}).NewClientConn(uconn)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to start HTTP/2: %v", err)
+	}
+
+	payload, sharedSecret := makeAuthenticationPayload(authInfo)
+	reqBodyR, reqBodyW := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "https://"+pickOne(g.hosts, g.cdnDomainPort)+g.path, reqBodyR)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to make gRPC request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("hidden", base64.StdEncoding.EncodeToString(append(payload.randPubKey[:], payload.ciphertextWithTag[:]...)))
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		reqBodyW.Close()
+		return sessionKey, fmt.Errorf("failed to handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		reqBodyW.Close()
+		resp.Body.Close()
+		return sessionKey, fmt.Errorf("gRPC request failed with status %v", resp.Status)
+	}
+
+	g.GRPCConn = &common.GRPCConn{
+		Stream: &h2ClientStream{ReadCloser: resp.Body, reqBody: reqBodyW, conn: uconn},
+		Local:  rawConn.LocalAddr(),
+		Remote: rawConn.RemoteAddr(),
+	}
+
+	buf := make([]byte, 128)
+	n, err := g.Read(buf)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to read reply: %v", err)
+	}
+
+	if n != 60 {
+		return sessionKey, errors.New("reply must be 60 bytes")
+	}
+
+	reply := buf[:60]
+	sessionKeySlice, err := common.AESGCMDecrypt(reply[:12], sharedSecret[:], reply[12:])
+	if err != nil {
+		return
+	}
+	copy(sessionKey[:], sessionKeySlice)
+
+	return
+}
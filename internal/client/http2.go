@@ -0,0 +1,95 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+	"net/http"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+// HTTP2OverTLS carries the Cloak connection in the bodies of a long-lived POST request over HTTP/2, either to a CDN
+// that passes it on to the Cloak server or to a Cloak server that holds a real certificate
+type HTTP2OverTLS struct {
+	*common.TLSConn
+	remoteDomainPort string
+	path             string
+	// the authority of the request is one of these for each connection, or remoteDomainPort if there are none
+	hosts   []string
+	helloID utls.ClientHelloID
+}
+
+func (h *HTTP2OverTLS) Close() error {
+	if h.TLSConn == nil {
+		return nil
+	}
+	return h.TLSConn.Close()
+}
+
+func (h *HTTP2OverTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	var stream *h2ClientStream
+	defer func() {
+		if err != nil {
+			if stream != nil {
+				stream.Close()
+			} else {
+				rawConn.Close()
+			}
+		}
+	}()
+	uconn := utls.UClient(rawConn, &utls.Config{
+		ServerName:         authInfo.MockDomain,
+		InsecureSkipVerify: true,
+	}, h.helloID)
+	err = uconn.Handshake()
+	if err != nil {
+		return
+	}
+	if proto := uconn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		return sessionKey, fmt.Errorf("server negotiated %q instead of HTTP/2", proto)
+	}
+
+	cc, err := (&http2.Transport{}).NewClientConn(uconn)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to start HTTP/2: %v", err)
+	}
+
+	payload, sharedSecret := makeAuthenticationPayload(authInfo)
+	reqBodyR, reqBodyW := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, "https://"+pickOne(h.hosts, h.remoteDomainPort)+h.path, reqBodyR)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to make HTTP/2 request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	token := base64.RawURLEncoding.EncodeToString(append(payload.randPubKey[:], payload.ciphertextWithTag[:]...))
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		reqBodyW.Close()
+		return sessionKey, fmt.Errorf("failed to handshake: %v", err)
+	}
+	stream = &h2ClientStream{ReadCloser: resp.Body, reqBody: reqBodyW, conn: uconn}
+	if resp.StatusCode != http.StatusOK {
+		return sessionKey, fmt.Errorf("HTTP/2 request failed with status %v", resp.Status)
+	}
+	conn := &common.StreamConn{Stream: stream, Local: rawConn.LocalAddr(), Remote: rawConn.RemoteAddr()}
+
+	// reply: [12 bytes nonce][32 bytes encrypted session key][16 bytes authentication tag]
+	reply := make([]byte, 60)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to read reply: %v", err)
+	}
+	sessionKeySlice, err := common.AESGCMDecrypt(reply[:12], sharedSecret[:], reply[12:])
+	if err != nil {
+		return
+	}
+	copy(sessionKey[:], sessionKeySlice)
+	// the bodies don't keep the boundaries of writes, so each frame is put in a record of its own
+	h.TLSConn = &common.TLSConn{Conn: conn}
+	return
+}
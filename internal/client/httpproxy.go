@@ -0,0 +1,123 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// An HTTP proxy server (RFC 9110) for LocalProxy. A CONNECT request becomes a stream to its authority. A request with
+// an absolute URI becomes a stream to the URI's host, on which it's sent in origin form, and the connection from the
+// client is closed after the response, as the next request may well be to another host
+
+// bufferedConn is a net.Conn whose reads have been buffered by r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+// headers that are for the proxy itself, rather than the origin server
+var hopByHopHeaders = []string{"Proxy-Connection", "Proxy-Authorization", "Keep-Alive"}
+
+// httpProxyError tells the client that its request failed and closes the connection
+func httpProxyError(conn net.Conn, status int) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+	conn.Close()
+}
+
+// httpProxyTarget is the host:port that req is to be sent to
+func httpProxyTarget(req *http.Request) (string, error) {
+	if req.Method == http.MethodConnect {
+		if _, _, err := net.SplitHostPort(req.Host); err != nil {
+			return "", err
+		}
+		return req.Host, nil
+	}
+	if !req.URL.IsAbs() {
+		return "", fmt.Errorf("%v isn't an absolute URI", req.RequestURI)
+	}
+	if req.URL.Scheme != "http" {
+		return "", fmt.Errorf("unsupported scheme %v", req.URL.Scheme)
+	}
+	port := req.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(req.URL.Hostname(), port), nil
+}
+
+// ServeHTTPProxy serves HTTP proxy clients on listener. It returns when listener fails to accept
+func ServeHTTPProxy(listener net.Listener, streamTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) error {
+	var sesh *mux.Session
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !useSessionPerConnection && !reusable(sesh) {
+			sesh = newSeshFunc()
+		}
+		connectionSession := sesh
+		go func() {
+			r := bufio.NewReader(localConn)
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				log.Errorf("Failed to read HTTP proxy request: %v", err)
+				httpProxyError(localConn, http.StatusBadRequest)
+				return
+			}
+			target, err := httpProxyTarget(req)
+			if err != nil {
+				log.Errorf("bad HTTP proxy request: %v", err)
+				httpProxyError(localConn, http.StatusBadRequest)
+				return
+			}
+			stream, err := OpenTargetStream(target, connectionSession, newSeshFunc, useSessionPerConnection)
+			if err != nil {
+				log.Errorf("Failed to open stream to %v: %v", target, err)
+				httpProxyError(localConn, http.StatusBadGateway)
+				return
+			}
+
+			if req.Method == http.MethodConnect {
+				// like SOCKS5, the reply can't wait for the server to connect
+				if _, err = fmt.Fprint(localConn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+					localConn.Close()
+					stream.Close()
+					return
+				}
+				pipeLocal(&bufferedConn{Conn: localConn, r: r}, stream, streamTimeout)
+				return
+			}
+
+			for _, h := range hopByHopHeaders {
+				req.Header.Del(h)
+			}
+			for _, h := range strings.Split(req.Header.Get("Connection"), ",") {
+				if h = strings.TrimSpace(h); h != "" {
+					req.Header.Del(h)
+				}
+			}
+			req.Header.Del("Connection")
+			req.Close = true
+			go func() {
+				if err := req.Write(stream); err != nil {
+					log.Tracef("copying HTTP proxy client to stream: %v", err)
+					stream.Close()
+				}
+			}()
+			if _, err = common.Copy(localConn, stream); err != nil {
+				log.Tracef("copying stream to HTTP proxy client: %v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPProxyTarget(t *testing.T) {
+	for request, target := range map[string]string{
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n":           "example.com:443",
+		"GET http://example.com/index.html HTTP/1.1\r\nHost: example.com\r\n\r\n":     "example.com:80",
+		"GET http://[2001:db8::1]:8080/ HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n": "[2001:db8::1]:8080",
+		// can't be proxied
+		"GET /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n":          "",
+		"GET https://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n": "",
+		"CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n":      "",
+	} {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(request)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := httpProxyTarget(req)
+		if target == "" {
+			if err == nil {
+				t.Errorf("%q is proxied to %v", request, got)
+			}
+			continue
+		}
+		if err != nil || got != target {
+			t.Errorf("expecting %q to be proxied to %v, got %v, %v", request, target, got, err)
+		}
+	}
+}
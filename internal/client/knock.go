@@ -0,0 +1,48 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+)
+
+// makeKnock makes the packet that admits the address it's sent from to the server's listeners that are gated by
+// knocks
+func makeKnock(authInfo AuthInfo) []byte {
+	/*
+		Knock:
+		+--------------+--------------------------------------------+
+		| _randPubKey_ | _UID_ and _Timestamp_, encrypted           |
+		+--------------+--------------------------------------------+
+		| 32 bytes     | 16 bytes and 8 bytes, followed by the tag  |
+		+--------------+--------------------------------------------+
+	*/
+	ephPv, ephPub, _ := ecdh.GenerateKey(authInfo.WorldState.Rand)
+	randPubKey := ecdh.Marshal(ephPub)
+
+	plaintext := make([]byte, 24)
+	copy(plaintext, authInfo.UID)
+	binary.BigEndian.PutUint64(plaintext[16:24], uint64(authInfo.WorldState.Now().Unix()))
+
+	sharedSecret := ecdh.GenerateSharedSecret(ephPv, authInfo.ServerPubKey)
+	ciphertextWithTag, _ := common.AESGCMEncrypt(randPubKey[:12], sharedSecret, plaintext)
+	return append(append([]byte{}, randPubKey...), ciphertextWithTag...)
+}
+
+// knock sends a knock over UDP to knockPort of the host of remoteAddr, before connecting to remoteAddr
+func knock(ctx context.Context, dialer common.Dialer, remoteAddr string, knockPort string, authInfo AuthInfo) error {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := common.DialContext(ctx, dialer, "udp", net.JoinHostPort(host, knockPort))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(makeKnock(authInfo))
+	return err
+}
@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+)
+
+func TestMakeKnock(t *testing.T) {
+	serverPv, serverPub, _ := ecdh.GenerateKey(common.RealWorldState.Rand)
+	UID := []byte("0123456789abcdef")
+	authInfo := AuthInfo{
+		UID:          UID,
+		ServerPubKey: serverPub,
+		WorldState:   common.WorldOfTime(time.Unix(1600000000, 0)),
+	}
+	knock := makeKnock(authInfo)
+	if len(knock) != 72 {
+		t.Fatalf("expecting a 72 byte knock, got %v bytes", len(knock))
+	}
+
+	ephPub, _ := ecdh.Unmarshal(knock[:32])
+	plaintext, err := common.AESGCMDecrypt(knock[:12], ecdh.GenerateSharedSecret(serverPv, ephPub), knock[32:])
+	if err != nil {
+		t.Fatalf("failed to decrypt the knock with the server's key: %v", err)
+	}
+	if !bytes.Equal(plaintext[:16], UID) {
+		t.Errorf("expecting UID %x, got %x", UID, plaintext[:16])
+	}
+	if timestamp := binary.BigEndian.Uint64(plaintext[16:]); timestamp != 1600000000 {
+		t.Errorf("expecting timestamp 1600000000, got %v", timestamp)
+	}
+
+	if bytes.Equal(makeKnock(authInfo)[:32], knock[:32]) {
+		t.Error("knocks aren't made with a new key each time")
+	}
+}
+
+func TestKnock(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+
+	_, serverPub, _ := ecdh.GenerateKey(common.RealWorldState.Rand)
+	authInfo := AuthInfo{
+		UID:          []byte("0123456789abcdef"),
+		ServerPubKey: serverPub,
+		WorldState:   common.RealWorldState,
+	}
+	// the knock goes to the host of the server address, on the knock port
+	if err := knock(context.Background(), &net.Dialer{}, "127.0.0.1:443", port, authInfo); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 72 {
+		t.Errorf("expecting a 72 byte knock, got %v bytes", n)
+	}
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// With LocalProxy, ck-client is a proxy server itself rather than a tunnel for one in front of it, and ProxyMethod
+// must be a "direct" proxy method on the server. The target of each of its connections is sent at the start of the
+// connection's stream, so that ck-server knows where to connect it
+
+// openLocalStream opens a stream with openStream on sesh, or on a session of its own if useSessionPerConnection
+func openLocalStream(sesh *mux.Session, newSeshFunc func() *mux.Session, useSessionPerConnection bool, openStream func(*mux.Session) (*mux.Stream, error)) (ConnWithReadFromTimeout, error) {
+	if !useSessionPerConnection {
+		return openStream(sesh)
+	}
+	connectionSession := newSeshFunc()
+	stream, err := openStream(connectionSession)
+	if err != nil {
+		connectionSession.Close()
+		return nil, err
+	}
+	return &CloseSessionAfterCloseStream{
+		ConnWithReadFromTimeout: stream,
+		Session:                 connectionSession,
+	}, nil
+}
+
+// the ports of targets whose streams are interactive, i.e. SSH, remote desktops and VNC, so that they aren't held up
+// by downloads on the same session
+var interactivePorts = map[string]bool{"22": true, "3389": true, "5900": true}
+
+// targetPriority is the mux.PRIORITY_ constant of the stream to target
+func targetPriority(target string) uint8 {
+	if _, port, err := net.SplitHostPort(target); err == nil && interactivePorts[port] {
+		return mux.PRIORITY_INTERACTIVE
+	}
+	return mux.PRIORITY_NORMAL
+}
+
+// OpenTargetStream opens a stream with openLocalStream that starts with target, with the priority of target
+func OpenTargetStream(target string, sesh *mux.Session, newSeshFunc func() *mux.Session, useSessionPerConnection bool) (ConnWithReadFromTimeout, error) {
+	header, err := common.MarshalTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	priority := targetPriority(target)
+	stream, err := openLocalStream(sesh, newSeshFunc, useSessionPerConnection, func(sesh *mux.Session) (*mux.Stream, error) {
+		return sesh.OpenStreamWithPriority(priority)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = stream.Write(header); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+// pipeLocal copies between a local connection and its stream until either is closed
+func pipeLocal(localConn net.Conn, stream ConnWithReadFromTimeout, streamTimeout time.Duration) {
+	stream.SetReadFromTimeout(streamTimeout) // if localConn hasn't sent anything to stream to a period of time, stream closes
+	go func() {
+		if _, err := common.Copy(localConn, stream); err != nil {
+			log.Tracef("copying stream to local proxy client: %v", err)
+		}
+	}()
+	if _, err := common.Copy(stream, localConn); err != nil {
+		log.Tracef("copying local proxy client to stream: %v", err)
+	}
+}
+
+// ServeSOCKS5 serves SOCKS5 clients on listener. Each CONNECT gets a stream, and each UDP ASSOCIATE a datagram
+// stream, which lasts as long as the TCP connection it was requested on. It returns when listener fails to accept
+func ServeSOCKS5(listener net.Listener, streamTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) error {
+	var sesh *mux.Session
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !useSessionPerConnection && !reusable(sesh) {
+			sesh = newSeshFunc()
+		}
+		connectionSession := sesh
+		go func() {
+			req, err := socksHandshake(localConn)
+			if err != nil {
+				log.Errorf("SOCKS handshake failed: %v", err)
+				localConn.Close()
+				return
+			}
+			if req.command == socksCmdUDPAssociate {
+				serveSocksUDP(localConn, func() (ConnWithReadFromTimeout, error) {
+					return openLocalStream(connectionSession, newSeshFunc, useSessionPerConnection, (*mux.Session).OpenDatagramStream)
+				})
+				return
+			}
+
+			stream, err := OpenTargetStream(req.target, connectionSession, newSeshFunc, useSessionPerConnection)
+			if err != nil {
+				log.Errorf("Failed to open stream to %v: %v", req.target, err)
+				socksReply(localConn, socksRepFailure)
+				localConn.Close()
+				return
+			}
+			// the reply can't wait for the server to connect, so the connection only fails by being closed
+			if err = socksReply(localConn, socksRepSucceeded); err != nil {
+				localConn.Close()
+				stream.Close()
+				return
+			}
+			pipeLocal(localConn, stream, streamTimeout)
+		}()
+	}
+}
+
+// serveSocksUDP relays the datagrams of a UDP ASSOCIATE on ctrlConn, from a UDP socket on the same address as
+// ctrlConn, until ctrlConn or the stream is closed. Only datagrams from the host of the SOCKS client are relayed, and
+// the first of them sets the address that datagrams are returned to
+func serveSocksUDP(ctrlConn net.Conn, openStream func() (ConnWithReadFromTimeout, error)) {
+	defer ctrlConn.Close()
+	localAddr, ok1 := ctrlConn.LocalAddr().(*net.TCPAddr)
+	remoteAddr, ok2 := ctrlConn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		socksReply(ctrlConn, socksRepFailure)
+		return
+	}
+	clientIP := remoteAddr.IP
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		log.Errorf("Failed to open UDP socket for SOCKS client: %v", err)
+		socksReply(ctrlConn, socksRepFailure)
+		return
+	}
+	defer udpConn.Close()
+	stream, err := openStream()
+	if err != nil {
+		log.Errorf("Failed to open stream: %v", err)
+		socksReply(ctrlConn, socksRepFailure)
+		return
+	}
+	defer stream.Close()
+	if err = socksReplyBound(ctrlConn, udpConn.LocalAddr().String()); err != nil {
+		return
+	}
+
+	var clientAddrM sync.Mutex
+	var clientAddr *net.UDPAddr
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				log.Tracef("copying stream to SOCKS client: %v", err)
+				ctrlConn.Close()
+				return
+			}
+			clientAddrM.Lock()
+			addr := clientAddr
+			clientAddrM.Unlock()
+			if addr == nil {
+				continue
+			}
+			if _, err = udpConn.WriteToUDP(packSocksDatagram(buf[:n]), addr); err != nil {
+				log.Tracef("copying stream to SOCKS client: %v", err)
+			}
+		}
+	}()
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				log.Tracef("copying SOCKS client to stream: %v", err)
+				ctrlConn.Close()
+				return
+			}
+			if !from.IP.Equal(clientIP) {
+				continue
+			}
+			clientAddrM.Lock()
+			if clientAddr == nil {
+				clientAddr = from
+			}
+			clientAddrM.Unlock()
+			datagram, err := unpackSocksDatagram(buf[:n])
+			if err != nil {
+				log.Tracef("dropping datagram from SOCKS client: %v", err)
+				continue
+			}
+			if _, err = stream.Write(datagram); err != nil {
+				log.Tracef("copying SOCKS client to stream: %v", err)
+				ctrlConn.Close()
+				return
+			}
+		}
+	}()
+
+	// the association ends with the TCP connection, on which nothing else is sent
+	io.Copy(io.Discard, ctrlConn)
+}
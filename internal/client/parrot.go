@@ -0,0 +1,128 @@
+// ClientHellos generated by uTLS from its fingerprint presets of real browsers
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// Parrot builds the ClientHello of a real browser using uTLS's fingerprint presets. GREASE values, extension
+// ordering, ALPN, ECH and padding are left to uTLS. Only the random, the session id and the x25519 key share are
+// overwritten with the steganographic fields, and the ML-KEM part of the X25519MLKEM768 key share with our own key
+type Parrot struct {
+	helloID utls.ClientHelloID
+}
+
+var errNoX25519KeyShare = errors.New("fingerprint doesn't have an x25519 key share")
+var errNoMLKEMKeyShare = errors.New("fingerprint doesn't have an X25519MLKEM768 key share")
+var errNoECH = errors.New("fingerprint doesn't send an encrypted_client_hello extension")
+
+func (p *Parrot) buildClientHello(hd clientHelloFields) ([]byte, error) {
+	// uTLS is only used to build the ClientHello. The handshake is never carried out with it, so the conn is a dummy
+	uconn := utls.UClient(&net.TCPConn{}, &utls.Config{ServerName: hd.serverName}, p.helloID)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	if err := uconn.SetClientRandom(hd.random); err != nil {
+		return nil, err
+	}
+	uconn.HandshakeState.Hello.SessionId = make([]byte, len(hd.sessionId))
+	copy(uconn.HandshakeState.Hello.SessionId, hd.sessionId)
+
+	var keyShare, hybridKeyShare *utls.KeyShare
+	for _, ext := range uconn.Extensions {
+		ksExt, ok := ext.(*utls.KeyShareExtension)
+		if !ok {
+			continue
+		}
+		for i := range ksExt.KeyShares {
+			switch ksExt.KeyShares[i].Group {
+			case utls.X25519:
+				keyShare = &ksExt.KeyShares[i]
+			case utls.X25519MLKEM768:
+				hybridKeyShare = &ksExt.KeyShares[i]
+			}
+		}
+	}
+	if keyShare == nil || len(keyShare.Data) != len(hd.x25519KeyShare) {
+		return nil, errNoX25519KeyShare
+	}
+	copy(keyShare.Data, hd.x25519KeyShare)
+	if hd.mlkemKeyShare != nil {
+		// the ML-KEM part comes first. The x25519 part, which is never used, is left as uTLS made it
+		if hybridKeyShare == nil || len(hybridKeyShare.Data) != len(hd.mlkemKeyShare)+32 {
+			return nil, errNoMLKEMKeyShare
+		}
+		copy(hybridKeyShare.Data, hd.mlkemKeyShare)
+	}
+
+	if hd.echConfig != nil {
+		if err := setECHConfig(uconn, hd.echConfig, hd.innerServerName); err != nil {
+			return nil, err
+		}
+	}
+
+	// the preset has already been applied, so this only re-marshals the ClientHello with our fields
+	if err := uconn.BuildHandshakeState(); err != nil {
+		return nil, err
+	}
+	if hd.psk != nil {
+		// uTLS only makes a pre_shared_key extension out of a real session
+		return addPSKExtension(uconn.HandshakeState.Hello.Raw, hd.psk)
+	}
+	return uconn.HandshakeState.Hello.Raw, nil
+}
+
+// setECHConfig replaces the GREASE ECH extension of the preset with one that looks like it's made with config. Like
+// GREASE, the enc and payload are random bytes rather than a real HPKE encryption of a ClientHelloInner. The only one
+// able to tell the difference is the client-facing server of the decoy site, which never sees our ClientHello unless
+// it's replayed by a prober, and even then it can't be distinguished from a ClientHello made with a stale ECHConfig
+func setECHConfig(uconn *utls.UConn, config *echConfig, innerServerName string) error {
+	echIndex := -1
+	numShared := 0
+	for i, ext := range uconn.Extensions {
+		switch ext.(type) {
+		case *utls.GREASEEncryptedClientHelloExtension:
+			echIndex = i
+		case *utls.SNIExtension, *utls.UtlsPaddingExtension:
+		default:
+			numShared++
+		}
+	}
+	if echIndex == -1 {
+		return errNoECH
+	}
+
+	// The EncodedClientHelloInner (draft-ietf-tls-esni-13 section 5.1) has the legacy_version, random, an empty
+	// legacy_session_id, the cipher suites and the compression methods of the ClientHelloOuter. Every extension that's
+	// the same in both is referenced by its type in an ech_outer_extensions extension, leaving only server_name and
+	// the inner type of encrypted_client_hello in full. Padding is done by paddedInnerLen instead of an extension
+	hello := uconn.HandshakeState.Hello
+	encodedLen := 2 + 32 + 1 + 2 + 2*len(hello.CipherSuites) + 1 + len(hello.CompressionMethods)
+	encodedLen += 2                                    // extensions length
+	encodedLen += 4 + 1 + 2*numShared                  // ech_outer_extensions
+	encodedLen += 4 + 1                                // encrypted_client_hello
+	encodedLen += 4 + 2 + 1 + 2 + len(innerServerName) // server_name
+	payloadLen := config.paddedInnerLen(encodedLen, len(innerServerName))
+
+	uconn.Extensions[echIndex] = &utls.GREASEEncryptedClientHelloExtension{
+		CandidateCipherSuites: []utls.HPKESymmetricCipherSuite{{KdfId: config.kdfId, AeadId: config.aeadId}},
+		CandidateConfigIds:    []uint8{config.configId},
+		CandidatePayloadLens:  []uint16{uint16(payloadLen)},
+	}
+	return nil
+}
+
+// composeClientHello doesn't fall back to a handcrafted fingerprint if uTLS fails, as that would change our
+// fingerprint from one connection to the next
+func (p *Parrot) composeClientHello(hd clientHelloFields) ([]byte, error) {
+	ch, err := p.buildClientHello(hd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build %v ClientHello with uTLS: %v", p.helloID.Client, err)
+	}
+	return ch, nil
+}
@@ -0,0 +1,215 @@
+package client
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestParrotComposeClientHello(t *testing.T) {
+	var payload authenticationPayload
+	common.CryptoRandRead(payload.randPubKey[:])
+	common.CryptoRandRead(payload.ciphertextWithTag[:])
+	fields := genStegClientHello(payload, "www.example.com")
+
+	ids := map[string]utls.ClientHelloID{
+		"chrome":  utls.HelloChrome_Auto,
+		"firefox": utls.HelloFirefox_Auto,
+		"safari":  utls.HelloSafari_Auto,
+	}
+	for name, id := range ids {
+		t.Run(name, func(t *testing.T) {
+			p := &Parrot{helloID: id}
+			ch, err := p.buildClientHello(fields)
+			if err != nil {
+				t.Fatalf("failed to build ClientHello: %v", err)
+			}
+			if ch[0] != 0x01 {
+				t.Errorf("expecting handshake type ClientHello, got %x", ch[0])
+			}
+			// 1 byte handshake type, 3 bytes length, 2 bytes client version
+			if !bytes.Equal(ch[6:38], fields.random) {
+				t.Errorf("random not embedded: %x", ch[6:38])
+			}
+			if ch[38] != 32 || !bytes.Equal(ch[39:71], fields.sessionId) {
+				t.Errorf("session id not embedded: %x", ch[38:71])
+			}
+			if !bytes.Contains(ch, fields.x25519KeyShare) {
+				t.Error("x25519 key share not embedded")
+			}
+			if !bytes.Contains(ch, []byte("www.example.com")) {
+				t.Error("server name not found")
+			}
+		})
+	}
+}
+
+// findExtension returns the data of the extension of typ in a ClientHello
+func findExtension(ch []byte, typ uint16) []byte {
+	pointer := 4 + 2 + 32
+	pointer += 1 + int(ch[pointer])
+	pointer += 2 + int(binary.BigEndian.Uint16(ch[pointer:pointer+2]))
+	pointer += 1 + int(ch[pointer])
+	pointer += 2
+	for pointer+4 <= len(ch) {
+		extType := binary.BigEndian.Uint16(ch[pointer : pointer+2])
+		extLen := int(binary.BigEndian.Uint16(ch[pointer+2 : pointer+4]))
+		if extType == typ {
+			return ch[pointer+4 : pointer+4+extLen]
+		}
+		pointer += 4 + extLen
+	}
+	return nil
+}
+
+func TestParrotECH(t *testing.T) {
+	var payload authenticationPayload
+	common.CryptoRandRead(payload.randPubKey[:])
+	common.CryptoRandRead(payload.ciphertextWithTag[:])
+	config := &echConfig{
+		configId:   0x2a,
+		kdfId:      hpkeKdfHKDFSHA256,
+		aeadId:     hpkeAeadChaCha20Poly1305,
+		maxNameLen: 64,
+		publicName: "cloudflare-ech.com",
+	}
+
+	t.Run("GREASE", func(t *testing.T) {
+		fields := genStegClientHello(payload, "www.example.com")
+		for _, id := range []utls.ClientHelloID{utls.HelloChrome_Auto, utls.HelloFirefox_Auto} {
+			ch, err := (&Parrot{helloID: id}).buildClientHello(fields)
+			if err != nil {
+				t.Fatalf("failed to build ClientHello: %v", err)
+			}
+			if findExtension(ch, 0xfe0d) == nil {
+				t.Errorf("%v: encrypted_client_hello extension not found", id.Client)
+			}
+		}
+	})
+	t.Run("with config", func(t *testing.T) {
+		fields := genStegClientHello(payload, config.publicName)
+		fields.echConfig = config
+		fields.innerServerName = "www.example.com"
+		ch, err := (&Parrot{helloID: utls.HelloChrome_Auto}).buildClientHello(fields)
+		if err != nil {
+			t.Fatalf("failed to build ClientHello: %v", err)
+		}
+		if bytes.Contains(ch, []byte(fields.innerServerName)) {
+			t.Error("inner server name is in the clear")
+		}
+		if !bytes.Contains(ch, fields.x25519KeyShare) {
+			t.Error("x25519 key share not embedded")
+		}
+		ech := findExtension(ch, 0xfe0d)
+		if ech == nil {
+			t.Fatal("encrypted_client_hello extension not found")
+		}
+		// type, kdf, aead, config id, enc and payload
+		if aeadId := binary.BigEndian.Uint16(ech[3:5]); aeadId != config.aeadId {
+			t.Errorf("expecting aead %x, got %x", config.aeadId, aeadId)
+		}
+		if ech[5] != config.configId {
+			t.Errorf("expecting config id %x, got %x", config.configId, ech[5])
+		}
+		encLen := int(binary.BigEndian.Uint16(ech[6:8]))
+		payloadLen := int(binary.BigEndian.Uint16(ech[8+encLen : 10+encLen]))
+		// padded to a multiple of 32 bytes, plus the 16 bytes AEAD tag
+		if (payloadLen-16)%32 != 0 {
+			t.Errorf("payload length %v isn't padded", payloadLen)
+		}
+	})
+	t.Run("unsupported", func(t *testing.T) {
+		fields := genStegClientHello(payload, config.publicName)
+		fields.echConfig = config
+		fields.innerServerName = "www.example.com"
+		_, err := (&Parrot{helloID: utls.HelloSafari_Auto}).buildClientHello(fields)
+		if err != errNoECH {
+			t.Errorf("expecting %v, got %v", errNoECH, err)
+		}
+	})
+}
+
+func TestParrotMLKEMKeyShare(t *testing.T) {
+	var payload authenticationPayload
+	common.CryptoRandRead(payload.randPubKey[:])
+	common.CryptoRandRead(payload.ciphertextWithTag[:])
+	fields := genStegClientHello(payload, "www.example.com")
+	mlkemKey, err := ecdh.GenerateMLKEMKey(crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields.mlkemKeyShare = mlkemKey.EncapsulationKey().Bytes()
+
+	t.Run("chrome", func(t *testing.T) {
+		p := &Parrot{helloID: utls.HelloChrome_Auto}
+		ch, err := p.buildClientHello(fields)
+		if err != nil {
+			t.Fatalf("failed to build ClientHello: %v", err)
+		}
+		keyShares := findExtension(ch, 0x0033)
+		// client_shares length, then group and key exchange length of the first (hybrid) share after GREASE
+		hybrid := bytes.Index(keyShares, []byte{0x11, 0xec, 0x04, 0xc0})
+		if hybrid == -1 {
+			t.Fatal("no X25519MLKEM768 key share of 1216 bytes")
+		}
+		if !bytes.Equal(keyShares[hybrid+4:hybrid+4+ecdh.MLKEMEncapsulationKeySize], fields.mlkemKeyShare) {
+			t.Error("ML-KEM key not embedded in the X25519MLKEM768 key share")
+		}
+		if !bytes.Contains(keyShares, fields.x25519KeyShare) {
+			t.Error("x25519 key share not embedded")
+		}
+	})
+	t.Run("no hybrid key share", func(t *testing.T) {
+		for _, id := range []utls.ClientHelloID{utls.HelloFirefox_Auto, utls.HelloSafari_Auto} {
+			p := &Parrot{helloID: id}
+			_, err := p.buildClientHello(fields)
+			if err != errNoMLKEMKeyShare {
+				t.Errorf("%v: expecting %v, got %v", id.Client, errNoMLKEMKeyShare, err)
+			}
+		}
+	})
+}
+
+func TestParrotPSK(t *testing.T) {
+	var payload authenticationPayload
+	common.CryptoRandRead(payload.randPubKey[:])
+	common.CryptoRandRead(payload.ciphertextWithTag[:])
+	fields := genStegClientHello(payload, "www.example.com")
+	fields.psk = makePSKOffer(crand.Reader, 200)
+
+	for name, id := range map[string]utls.ClientHelloID{"chrome": utls.HelloChrome_Auto, "firefox": utls.HelloFirefox_Auto} {
+		t.Run(name, func(t *testing.T) {
+			ch, err := (&Parrot{helloID: id}).buildClientHello(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int(ch[1])<<16|int(ch[2])<<8|int(ch[3]) != len(ch)-4 {
+				t.Errorf("wrong length %x", ch[1:4])
+			}
+			if !bytes.Equal(ch[6:38], fields.random) || !bytes.Contains(ch, fields.x25519KeyShare) {
+				t.Error("steganographic fields not embedded")
+			}
+			if findExtension(ch, 0x002d) == nil {
+				t.Error("no psk_key_exchange_modes")
+			}
+			psk := findExtension(ch, 0x0029)
+			if psk == nil {
+				t.Fatal("no pre_shared_key")
+			}
+			if !bytes.HasSuffix(ch, psk) {
+				t.Error("pre_shared_key isn't the last extension")
+			}
+			if binary.BigEndian.Uint16(psk[0:2]) != 2+200+4 || !bytes.Equal(psk[4:204], fields.psk.identity) {
+				t.Errorf("ticket not in the identities: %x", psk[:8])
+			}
+			if psk[210] != 32 || !bytes.Equal(psk[211:], fields.psk.binder) {
+				t.Errorf("binder not in the binders: %x", psk[208:211])
+			}
+		})
+	}
+}
@@ -1,9 +1,11 @@
 package client
 
 import (
+	"errors"
 	"github.com/cbeuw/Cloak/internal/common"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
@@ -27,36 +29,80 @@ func (s *CloseSessionAfterCloseStream) Close() error {
 	return s.Session.Close()
 }
 
-func RouteUDP(bindFunc func() (*net.UDPConn, error), streamTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) {
+// RouteUDP carries the datagrams from each UDP source in a stream of its own. The mapping of a source to its stream is
+// dropped, and the stream closed, once nothing has been relayed either way for udpTimeout, like in a NAT. It never
+// expires if udpTimeout is 0
+func RouteUDP(bindFunc func() (*net.UDPConn, error), udpTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) {
+	routeUDP(bindFunc, udpTimeout, newSeshFunc, useSessionPerConnection, (*mux.Session).OpenStream)
+}
+
+// RouteUDPOverTCP is RouteUDP for ordered sessions. Each UDP source gets a datagram stream, so that UDP can be carried
+// by the same sessions as TCP, e.g. for the UDP relay of Shadowsocks in plugin mode
+func RouteUDPOverTCP(bindFunc func() (*net.UDPConn, error), udpTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) {
+	routeUDP(bindFunc, udpTimeout, newSeshFunc, useSessionPerConnection, (*mux.Session).OpenDatagramStream)
+}
+
+// udpMapping is the stream of a UDP source
+type udpMapping struct {
+	stream ConnWithReadFromTimeout
+	// nil if the mapping never expires
+	expiry *time.Timer
+}
+
+func (m *udpMapping) touch(udpTimeout time.Duration) {
+	if m.expiry != nil {
+		m.expiry.Reset(udpTimeout)
+	}
+}
+
+func routeUDP(bindFunc func() (*net.UDPConn, error), udpTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool, openStream func(*mux.Session) (*mux.Stream, error)) {
 	var sesh *mux.Session
 	localConn, err := bindFunc()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	streams := make(map[string]ConnWithReadFromTimeout)
+	var mappingsM sync.Mutex
+	mappings := make(map[string]*udpMapping)
+	// drop removes the mapping of a source if it's still m, and closes its stream
+	drop := func(source string, m *udpMapping) {
+		mappingsM.Lock()
+		if mappings[source] == m {
+			delete(mappings, source)
+		}
+		mappingsM.Unlock()
+		if m.expiry != nil {
+			m.expiry.Stop()
+		}
+		m.stream.Close()
+	}
 
 	data := make([]byte, 8192)
 	for {
 		i, addr, err := localConn.ReadFrom(data)
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Errorf("Failed to read first packet from proxy client: %v", err)
 			continue
 		}
 
-		if !useSessionPerConnection && (sesh == nil || sesh.IsClosed()) {
+		if !useSessionPerConnection && !reusable(sesh) {
 			sesh = newSeshFunc()
 		}
 
-		var stream ConnWithReadFromTimeout
-		stream, ok := streams[addr.String()]
+		source := addr.String()
+		mappingsM.Lock()
+		mapping, ok := mappings[source]
+		mappingsM.Unlock()
 		if !ok {
 			connectionSession := sesh
 			if useSessionPerConnection {
 				connectionSession = newSeshFunc()
 			}
 
-			stream, err = connectionSession.OpenStream()
+			var stream ConnWithReadFromTimeout
+			stream, err = openStream(connectionSession)
 			if err != nil {
 				log.Errorf("Failed to open stream: %v", err)
 				if useSessionPerConnection {
@@ -72,33 +118,44 @@ func RouteUDP(bindFunc func() (*net.UDPConn, error), streamTimeout time.Duration
 				}
 			}
 
-			streams[addr.String()] = stream
+			m := &udpMapping{stream: stream}
+			if udpTimeout > 0 {
+				m.expiry = time.AfterFunc(udpTimeout, func() {
+					log.Tracef("UDP mapping of %v expired", source)
+					drop(source, m)
+				})
+			}
+			mapping = m
+			mappingsM.Lock()
+			mappings[source] = mapping
+			mappingsM.Unlock()
 			proxyAddr := addr
 			go func() {
 				buf := make([]byte, 8192)
 				for {
-					n, err := stream.Read(buf)
+					n, err := m.stream.Read(buf)
 					if err != nil {
 						log.Tracef("copying stream to proxy client: %v", err)
-						stream.Close()
+						drop(source, m)
 						return
 					}
+					m.touch(udpTimeout)
 
 					_, err = localConn.WriteTo(buf[:n], proxyAddr)
 					if err != nil {
 						log.Tracef("copying stream to proxy client: %v", err)
-						stream.Close()
+						drop(source, m)
 						return
 					}
 				}
 			}()
 		}
 
-		_, err = stream.Write(data[:i])
+		mapping.touch(udpTimeout)
+		_, err = mapping.stream.Write(data[:i])
 		if err != nil {
 			log.Tracef("copying proxy client to stream: %v", err)
-			delete(streams, addr.String())
-			stream.Close()
+			drop(source, mapping)
 			continue
 		}
 	}
@@ -108,11 +165,13 @@ func RouteTCP(listener net.Listener, streamTimeout time.Duration, newSeshFunc fu
 	var sesh *mux.Session
 	for {
 		localConn, err := listener.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Fatal(err)
 			continue
 		}
-		if !useSessionPerConnection && (sesh == nil || sesh.IsClosed()) {
+		if !useSessionPerConnection && !reusable(sesh) {
 			sesh = newSeshFunc()
 		}
 		go func() {
@@ -0,0 +1,54 @@
+package client
+
+import (
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionPool keeps a number of sessions established ahead of demand, so that a new session doesn't wait for its
+// connections to be made and handshaken, e.g. for every local connection without multiplexing, or the first one
+// after the last session has closed. A session that's taken is replaced in the background
+type SessionPool struct {
+	makeSession func() *mux.Session
+	ready       chan *mux.Session
+}
+
+// NewSessionPool starts making size sessions with makeSession
+func NewSessionPool(size int, makeSession func() *mux.Session) *SessionPool {
+	p := &SessionPool{
+		makeSession: makeSession,
+		ready:       make(chan *mux.Session, size),
+	}
+	for i := 0; i < size; i++ {
+		go p.fill()
+	}
+	return p
+}
+
+func (p *SessionPool) fill() {
+	p.ready <- p.makeSession()
+}
+
+// Get returns a session that's ready, or makes one as it would be without the pool if none is
+func (p *SessionPool) Get() *mux.Session {
+	for {
+		select {
+		case sesh := <-p.ready:
+			go p.fill()
+			// the server or the network may have closed it while it waited, or the server may be going away
+			if !reusable(sesh) {
+				log.Debug("discarding a warm session that has closed or is draining")
+				continue
+			}
+			return sesh
+		default:
+			log.Debug("no warm session is ready")
+			return p.makeSession()
+		}
+	}
+}
+
+// reusable is whether new streams can be opened on sesh, i.e. it's open and its server isn't draining
+func reusable(sesh *mux.Session) bool {
+	return sesh != nil && !sesh.IsClosed() && !sesh.IsDraining()
+}
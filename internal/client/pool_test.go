@@ -0,0 +1,66 @@
+package client
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
+
+func TestSessionPool(t *testing.T) {
+	obfuscator, _ := mux.MakeObfuscator(mux.E_METHOD_PLAIN, [32]byte{})
+	var made atomic.Int32
+	makeSession := func() *mux.Session {
+		made.Add(1)
+		return mux.MakeSession(uint32(made.Load()), mux.SessionConfig{Obfuscator: obfuscator})
+	}
+	waitForMade := func(n int32) {
+		deadline := time.Now().Add(3 * time.Second)
+		for made.Load() < n && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if made.Load() < n {
+			t.Fatalf("expecting %v sessions made, got %v", n, made.Load())
+		}
+	}
+
+	pool := NewSessionPool(2, makeSession)
+	waitForMade(2)
+	// give the sessions time to land in the pool
+	time.Sleep(10 * time.Millisecond)
+
+	t.Run("ready", func(t *testing.T) {
+		sesh := pool.Get()
+		if sesh.IsClosed() {
+			t.Error("got a closed session")
+		}
+		// it's replaced
+		waitForMade(3)
+		time.Sleep(10 * time.Millisecond)
+		if made.Load() != 3 {
+			t.Errorf("expecting 3 sessions made, got %v", made.Load())
+		}
+	})
+
+	t.Run("closed while waiting", func(t *testing.T) {
+		for _, sesh := range []*mux.Session{<-pool.ready, <-pool.ready} {
+			sesh.Close()
+			pool.ready <- sesh
+		}
+		if sesh := pool.Get(); sesh.IsClosed() {
+			t.Error("got a session that has closed")
+		}
+	})
+
+	t.Run("none ready", func(t *testing.T) {
+		empty := &SessionPool{makeSession: makeSession, ready: make(chan *mux.Session, 1)}
+		before := made.Load()
+		if sesh := empty.Get(); sesh == nil || sesh.IsClosed() {
+			t.Error("expecting a new session")
+		}
+		if made.Load() <= before {
+			t.Error("no session made when none is ready")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// Cloak as a managed client transport of Tor (pt-spec.txt). Tor tells us what it wants in TOR_PT_* environment
+// variables, we tell it where our SOCKS5 server is on stdout, and it connects to the bridge through our SOCKS5 server
+// with the bridge line's arguments as the SOCKS username and password, e.g.
+//
+//	Bridge cloak 203.0.113.1:443 UID=...;PublicKey=...;ServerName=www.bing.com;ProxyMethod=tor
+
+const PTMethodName = "cloak"
+
+// PTEnv is what we need from the environment variables set by Tor
+type PTEnv struct {
+	ExitOnStdinClose bool
+}
+
+var ErrPTNotLaunched = errors.New("not launched by Tor as a pluggable transport")
+var ErrPTNotRequested = errors.New("Tor doesn't want the cloak transport")
+
+// ParsePTClientEnv reads the environment variables of a managed client transport through getenv and does the version
+// negotiation with Tor on out. Other errors that Tor must be told about are also written to out
+func ParsePTClientEnv(getenv func(string) string, out io.Writer) (env PTEnv, err error) {
+	versions := getenv("TOR_PT_MANAGED_TRANSPORT_VER")
+	if versions == "" {
+		return env, ErrPTNotLaunched
+	}
+	supported := false
+	for _, v := range strings.Split(versions, ",") {
+		if v == "1" {
+			supported = true
+		}
+	}
+	if !supported {
+		fmt.Fprintln(out, "VERSION-ERROR no-version")
+		return env, fmt.Errorf("unsupported PT versions %v", versions)
+	}
+	fmt.Fprintln(out, "VERSION 1")
+
+	transports := getenv("TOR_PT_CLIENT_TRANSPORTS")
+	if transports == "" {
+		fmt.Fprintln(out, "ENV-ERROR no TOR_PT_CLIENT_TRANSPORTS")
+		return env, errors.New("TOR_PT_CLIENT_TRANSPORTS is empty")
+	}
+	if getenv("TOR_PT_PROXY") != "" {
+		fmt.Fprintln(out, "PROXY-ERROR upstream proxies aren't supported")
+		return env, errors.New("TOR_PT_PROXY isn't supported")
+	}
+	requested := false
+	for _, t := range strings.Split(transports, ",") {
+		if t == PTMethodName || t == "*" {
+			requested = true
+		}
+	}
+	if !requested {
+		fmt.Fprintln(out, "CMETHODS DONE")
+		return env, ErrPTNotRequested
+	}
+
+	env.ExitOnStdinClose = getenv("TOR_PT_EXIT_ON_STDIN_CLOSE") == "1"
+	return env, nil
+}
+
+// PTMethodReady tells Tor that the SOCKS5 server of the cloak transport is listening on addr
+func PTMethodReady(out io.Writer, addr net.Addr) {
+	fmt.Fprintf(out, "CMETHOD %v socks5 %v\n", PTMethodName, addr)
+	fmt.Fprintln(out, "CMETHODS DONE")
+}
+
+// PTMethodError tells Tor that the cloak transport can't be launched
+func PTMethodError(out io.Writer, err error) {
+	fmt.Fprintf(out, "CMETHOD-ERROR %v %v\n", PTMethodName, err)
+	fmt.Fprintln(out, "CMETHODS DONE")
+}
+
+// ptArgs joins the SOCKS username and password back into the bridge line arguments. Tor splits arguments longer than
+// 255 bytes into the password, and sets the password to a single NUL if it isn't needed
+func ptArgs(req socksRequest) string {
+	if req.password == "\x00" {
+		return req.username
+	}
+	return req.username + req.password
+}
+
+// bridgeConfig is base overridden by the arguments of a bridge, connecting to target
+func bridgeConfig(base RawConfig, args string, target string) (raw RawConfig, err error) {
+	raw = base
+	if args != "" {
+		err = json.Unmarshal(ssvToJson(args), &raw)
+		if err != nil {
+			return raw, fmt.Errorf("malformed bridge arguments: %v", err)
+		}
+	}
+	raw.RemoteHost, raw.RemotePort, err = net.SplitHostPort(target)
+	return
+}
+
+// ptBridges keeps one session per bridge. Making a session blocks until the bridge is reached, so each bridge has
+// its own lock
+type ptBridges struct {
+	sync.Mutex
+	bridges map[string]*ptBridge
+}
+
+type ptBridge struct {
+	sync.Mutex
+	sesh *mux.Session
+}
+
+func (b *ptBridges) get(key string, makeSession func() *mux.Session) *mux.Session {
+	b.Lock()
+	bridge := b.bridges[key]
+	if bridge == nil {
+		bridge = &ptBridge{}
+		b.bridges[key] = bridge
+	}
+	b.Unlock()
+
+	bridge.Lock()
+	defer bridge.Unlock()
+	if !reusable(bridge.sesh) {
+		bridge.sesh = makeSession()
+	}
+	return bridge.sesh
+}
+
+// ServePT serves the SOCKS5 connections from Tor on listener. base is the config that the arguments of each bridge
+// line are applied on. It returns when listener fails to accept, or with ctx.Err() once ctx is done, which closes
+// listener and gives up on the sessions being made
+func ServePT(ctx context.Context, listener net.Listener, base RawConfig, dialer common.Dialer, worldState common.WorldState) error {
+	base.LocalHost, base.LocalPort, _ = net.SplitHostPort(listener.Addr().String())
+	bridges := &ptBridges{bridges: make(map[string]*ptBridge)}
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			req, err := socksHandshake(localConn)
+			if err != nil {
+				log.Errorf("SOCKS handshake with Tor failed: %v", err)
+				localConn.Close()
+				return
+			}
+			if req.command != socksCmdConnect {
+				// bridges are only ever connected to
+				log.Errorf("SOCKS handshake with Tor failed: %v: %v", ErrSocksCommand, req.command)
+				socksReply(localConn, socksRepCmdUnsupp)
+				localConn.Close()
+				return
+			}
+			args := ptArgs(req)
+			raw, err := bridgeConfig(base, args, req.target)
+			var local LocalConnConfig
+			var remote RemoteConnConfig
+			var auth AuthInfo
+			if err == nil {
+				local, remote, auth, err = raw.SplitConfigs(worldState)
+			}
+			if err != nil {
+				log.Errorf("bad config for bridge %v: %v", req.target, err)
+				socksReply(localConn, socksRepFailure)
+				localConn.Close()
+				return
+			}
+
+			sesh := bridges.get(args+"@"+req.target, func() *mux.Session {
+				return MakeSession(ctx, remote, auth, dialer, false)
+			})
+			stream, err := sesh.OpenStream()
+			if err != nil {
+				log.Errorf("Failed to open stream: %v", err)
+				socksReply(localConn, socksRepFailure)
+				localConn.Close()
+				return
+			}
+			if err = socksReply(localConn, socksRepSucceeded); err != nil {
+				localConn.Close()
+				stream.Close()
+				return
+			}
+
+			stream.SetReadFromTimeout(local.Timeout)
+			go func() {
+				if _, err := common.Copy(localConn, stream); err != nil {
+					log.Tracef("copying stream to Tor: %v", err)
+				}
+			}()
+			if _, err = common.Copy(stream, localConn); err != nil {
+				log.Tracef("copying Tor to stream: %v", err)
+			}
+		}()
+	}
+}
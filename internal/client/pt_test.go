@@ -0,0 +1,85 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParsePTClientEnv(t *testing.T) {
+	getenv := func(env map[string]string) func(string) string {
+		return func(key string) string { return env[key] }
+	}
+
+	t.Run("launched by Tor", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		env, err := ParsePTClientEnv(getenv(map[string]string{
+			"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+			"TOR_PT_CLIENT_TRANSPORTS":     "obfs4,cloak",
+			"TOR_PT_EXIT_ON_STDIN_CLOSE":   "1",
+		}), out)
+		if err != nil {
+			t.Fatalf("expecting no error, got %v", err)
+		}
+		if !env.ExitOnStdinClose {
+			t.Error("TOR_PT_EXIT_ON_STDIN_CLOSE not read")
+		}
+		if out.String() != "VERSION 1\n" {
+			t.Errorf("unexpected output %q", out.String())
+		}
+	})
+	t.Run("not launched by Tor", func(t *testing.T) {
+		_, err := ParsePTClientEnv(getenv(nil), &bytes.Buffer{})
+		if err != ErrPTNotLaunched {
+			t.Errorf("expecting %v, got %v", ErrPTNotLaunched, err)
+		}
+	})
+	t.Run("unsupported version", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		_, err := ParsePTClientEnv(getenv(map[string]string{
+			"TOR_PT_MANAGED_TRANSPORT_VER": "2",
+			"TOR_PT_CLIENT_TRANSPORTS":     "cloak",
+		}), out)
+		if err == nil || out.String() != "VERSION-ERROR no-version\n" {
+			t.Errorf("unexpected error %v and output %q", err, out.String())
+		}
+	})
+	t.Run("upstream proxy", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		_, err := ParsePTClientEnv(getenv(map[string]string{
+			"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+			"TOR_PT_CLIENT_TRANSPORTS":     "cloak",
+			"TOR_PT_PROXY":                 "socks5://127.0.0.1:9050",
+		}), out)
+		if err == nil || !bytes.HasPrefix(out.Bytes(), []byte("VERSION 1\nPROXY-ERROR ")) {
+			t.Errorf("unexpected error %v and output %q", err, out.String())
+		}
+	})
+	t.Run("other transports", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		_, err := ParsePTClientEnv(getenv(map[string]string{
+			"TOR_PT_MANAGED_TRANSPORT_VER": "1",
+			"TOR_PT_CLIENT_TRANSPORTS":     "obfs4",
+		}), out)
+		if err != ErrPTNotRequested || out.String() != "VERSION 1\nCMETHODS DONE\n" {
+			t.Errorf("unexpected error %v and output %q", err, out.String())
+		}
+	})
+}
+
+func TestBridgeConfig(t *testing.T) {
+	base := RawConfig{ServerName: "www.bing.com", ProxyMethod: "shadowsocks", NumConn: 4}
+	args := ptArgs(socksRequest{username: "ProxyMethod=tor;NumConn=", password: "2;UID=AAECAwQFBgcICQoLDA0ODw=="})
+	raw, err := bridgeConfig(base, args, "203.0.113.1:443")
+	if err != nil {
+		t.Fatalf("expecting no error, got %v", err)
+	}
+	if raw.ServerName != "www.bing.com" || raw.ProxyMethod != "tor" || raw.NumConn != 2 || len(raw.UID) != 16 {
+		t.Errorf("bridge arguments not applied: %+v", raw)
+	}
+	if raw.RemoteHost != "203.0.113.1" || raw.RemotePort != "443" {
+		t.Errorf("unexpected remote %v %v", raw.RemoteHost, raw.RemotePort)
+	}
+	if base.ProxyMethod != "shadowsocks" {
+		t.Error("base config modified")
+	}
+}
@@ -0,0 +1,97 @@
+package client
+
+// With QuotaAddr, a session asks the server for what its user has left on a control stream, and the answer is
+// served on QuotaAddr in JSON for GUI clients to display, so that a user can see its quota without an account on the
+// admin panel. The server also warns on the stream when the credit is running low.
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// how often a session asks for its quota
+var quotaQueryInterval = 30 * time.Second
+
+// QuotaWatcher keeps what the server last said the user has left
+type QuotaWatcher struct {
+	m     sync.Mutex
+	quota common.Quota
+	known bool
+}
+
+// Quota returns what the user has left as of the last time the server said so. It's false if the server hasn't yet
+func (qw *QuotaWatcher) Quota() (common.Quota, bool) {
+	qw.m.Lock()
+	defer qw.m.Unlock()
+	return qw.quota, qw.known
+}
+
+func (qw *QuotaWatcher) set(quota common.Quota) {
+	qw.m.Lock()
+	qw.quota = quota
+	qw.known = true
+	qw.m.Unlock()
+}
+
+// watch keeps asking the server for the quota on a control stream of sesh until it's closed
+func (qw *QuotaWatcher) watch(sesh *mux.Session) {
+	stream, err := sesh.OpenControlStream()
+	if err != nil {
+		log.Debugf("failed to open the control stream: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	go func() {
+		query, _ := json.Marshal(common.ControlMessage{Type: common.MSG_QUERY_QUOTA})
+		for {
+			if _, err := stream.Write(query); err != nil {
+				return
+			}
+			time.Sleep(quotaQueryInterval)
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := stream.Read(buf)
+		if err != nil {
+			return
+		}
+		var msg common.ControlMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil || msg.Quota == nil {
+			log.Debugf("malformed control message: %s", buf[:n])
+			continue
+		}
+		switch msg.Type {
+		case common.MSG_LOW_CREDIT:
+			log.Warnf("credit is running low: %v bytes up and %v bytes down left", msg.Quota.UpCredit, msg.Quota.DownCredit)
+			fallthrough
+		case common.MSG_QUOTA:
+			qw.set(*msg.Quota)
+		default:
+			log.Debugf("unknown control message %v", msg.Type)
+		}
+	}
+}
+
+// QuotaHandler serves the quota as qw last knows it on /quota
+func QuotaHandler(qw *QuotaWatcher) http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/quota", func(w http.ResponseWriter, r *http.Request) {
+		quota, ok := qw.Quota()
+		if !ok {
+			http.Error(w, "quota not yet known", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(quota)
+	})
+	return serveMux
+}
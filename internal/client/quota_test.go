@@ -0,0 +1,84 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/connutil"
+)
+
+func TestQuotaWatcher(t *testing.T) {
+	obfuscator, _ := mux.MakeObfuscator(mux.E_METHOD_PLAIN, [32]byte{})
+	clientSession := mux.MakeSession(1, mux.SessionConfig{Obfuscator: obfuscator})
+	serverSession := mux.MakeSession(1, mux.SessionConfig{Obfuscator: obfuscator})
+	defer clientSession.Close()
+	c, s := connutil.AsyncPipe()
+	clientSession.AddConnection(&common.TLSConn{Conn: c})
+	serverSession.AddConnection(&common.TLSConn{Conn: s})
+
+	qw := &QuotaWatcher{}
+	handler := QuotaHandler(qw)
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quota", nil))
+		return rec
+	}
+	if rec := get(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expecting %v before the server answers, got %v", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	go qw.watch(clientSession)
+	stream, err := serverSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stream.(*mux.Stream).IsControl() {
+		t.Fatal("quota isn't asked for on a control stream")
+	}
+	buf := make([]byte, 1024)
+	n, err := stream.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query common.ControlMessage
+	if err := json.Unmarshal(buf[:n], &query); err != nil || query.Type != common.MSG_QUERY_QUOTA {
+		t.Fatalf("unexpected query %s", buf[:n])
+	}
+
+	for _, msg := range []common.ControlMessage{
+		{Type: common.MSG_QUOTA, Quota: &common.Quota{UpCredit: 1000, DownCredit: 2000, ExpiryTime: 3000}},
+		{Type: common.MSG_LOW_CREDIT, Quota: &common.Quota{UpCredit: 10, DownCredit: 2000, ExpiryTime: 3000}},
+	} {
+		reply, _ := json.Marshal(msg)
+		if _, err := stream.Write(reply); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(time.Second)
+		for {
+			if quota, ok := qw.Quota(); ok && quota == *msg.Quota {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%v isn't taken", msg.Type)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	rec := get()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expecting %v, got %v", http.StatusOK, rec.Code)
+	}
+	var served common.Quota
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if served.UpCredit != 10 {
+		t.Errorf("expecting 10 of up credit served, got %v", served.UpCredit)
+	}
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// RealTLS completes a real TLS handshake with a Cloak server that holds a genuine certificate of ServerName, then
+// authenticates inside the encrypted channel
+type RealTLS struct {
+	*common.TLSConn
+	helloID utls.ClientHelloID
+	// the certificate of the server is verified against the system's roots if nil
+	rootCAs *x509.CertPool
+}
+
+func (r *RealTLS) Close() error {
+	if r.TLSConn == nil {
+		return nil
+	}
+	return r.TLSConn.Close()
+}
+
+func (r *RealTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
+	defer func() {
+		if err != nil {
+			rawConn.Close()
+		}
+	}()
+	uconn := utls.UClient(rawConn, &utls.Config{
+		ServerName: authInfo.MockDomain,
+		RootCAs:    r.rootCAs,
+	}, r.helloID)
+	err = uconn.Handshake()
+	if err != nil {
+		return
+	}
+
+	// the authentication data is the same as the hidden data of gRPC mode, in the first application data record
+	payload, sharedSecret := makeAuthenticationPayload(authInfo)
+	_, err = uconn.Write(append(payload.randPubKey[:], payload.ciphertextWithTag[:]...))
+	if err != nil {
+		return
+	}
+
+	// reply: [12 bytes nonce][32 bytes encrypted session key][16 bytes authentication tag]
+	reply := make([]byte, 60)
+	_, err = io.ReadFull(uconn, reply)
+	if err != nil {
+		return sessionKey, fmt.Errorf("failed to read reply: %v", err)
+	}
+	sessionKeySlice, err := common.AESGCMDecrypt(reply[:12], sharedSecret[:], reply[12:])
+	if err != nil {
+		return
+	}
+	copy(sessionKey[:], sessionKeySlice)
+	// TLS doesn't keep the boundaries of writes, so each frame is put in a record of its own inside the encrypted
+	// channel
+	r.TLSConn = &common.TLSConn{Conn: uconn}
+	return
+}
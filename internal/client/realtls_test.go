@@ -0,0 +1,87 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"github.com/cbeuw/Cloak/internal/test"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRealTLSHandshake(t *testing.T) {
+	cert, pool := test.SelfSignedCert(t)
+	staticPv, staticPub, _ := ecdh.GenerateKey(rand.Reader)
+	var sessionKey [32]byte
+	common.CryptoRandRead(sessionKey[:])
+	authInfo := AuthInfo{
+		UID:          make([]byte, 16),
+		ProxyMethod:  "shadowsocks",
+		ServerPubKey: staticPub,
+		MockDomain:   "www.example.com",
+		WorldState:   common.RealWorldState,
+	}
+
+	// serve is a Cloak server in real TLS mode that replies with sessionKey
+	serve := func(conn net.Conn) {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		defer tlsConn.Close()
+		hidden := make([]byte, 96)
+		if _, err := io.ReadFull(tlsConn, hidden); err != nil {
+			return
+		}
+		ephPub, _ := ecdh.Unmarshal(hidden[:32])
+		sharedSecret := ecdh.GenerateSharedSecret(staticPv, ephPub)
+		nonce := make([]byte, 12)
+		encryptedKey, _ := common.AESGCMEncrypt(nonce, sharedSecret, sessionKey[:])
+		tlsConn.Write(append(nonce, encryptedKey...))
+		io.Copy(io.Discard, tlsConn)
+	}
+
+	// net.Pipe isn't used as its writes block until they're read, which deadlocks with session tickets
+	dialServer := func(t *testing.T) net.Conn {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			conn, err := l.Accept()
+			l.Close()
+			if err == nil {
+				serve(conn)
+			}
+		}()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	t.Run("trusted certificate", func(t *testing.T) {
+		clientConn := dialServer(t)
+		transport := &RealTLS{helloID: common.Parrots["chrome"], rootCAs: pool}
+		key, err := transport.Handshake(clientConn, authInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer transport.Close()
+		if key != sessionKey {
+			t.Error("session key isn't received")
+		}
+	})
+
+	t.Run("untrusted certificate", func(t *testing.T) {
+		clientConn := dialServer(t)
+		transport := &RealTLS{helloID: common.Parrots["chrome"]}
+		_, err := transport.Handshake(clientConn, authInfo)
+		if err == nil {
+			t.Error("handshake succeeds with a certificate that isn't trusted")
+		}
+		if transport.Close() != nil {
+			t.Error("failed to close a transport that hasn't handshaken")
+		}
+	})
+}
@@ -0,0 +1,282 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// how long a lookup through the resolver has
+	resolverTimeout = 10 * time.Second
+	// answers are cached for at least this long, however short their TTL is
+	minResolverTTL = 60 * time.Second
+)
+
+var ErrResolverURL = errors.New("ResolverURL must be https:// for DNS over HTTPS or tls:// for DNS over TLS")
+
+// Resolver looks up the addresses of the server through DNS over HTTPS or DNS over TLS, so that poisoned or blocked
+// DNS can't keep the client from finding it. Answers are cached for their TTL, and the last one of each host is
+// pinned: it's still used after it's expired whenever the resolver can't be reached
+type Resolver struct {
+	// DNS over HTTPS if it's https, DNS over TLS if it's tls
+	url *url.URL
+	now func() time.Time
+	// the certificate of the resolver is verified against the system's roots if nil
+	rootCAs *x509.CertPool
+
+	m     sync.Mutex
+	cache map[resolverKey]resolverAnswer
+}
+
+type resolverKey struct {
+	qtype dnsmessage.Type
+	host  string
+}
+
+type resolverAnswer struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// MakeResolver makes a Resolver of rawURL, e.g. https://1.1.1.1/dns-query or tls://dns.quad9.net
+func MakeResolver(rawURL string, worldState common.WorldState) (*Resolver, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ResolverURL: %v", err)
+	}
+	switch u.Scheme {
+	case "https":
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+	case "tls":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "853")
+		}
+	default:
+		return nil, ErrResolverURL
+	}
+	if u.Hostname() == "" {
+		return nil, ErrResolverURL
+	}
+	return &Resolver{
+		url:   u,
+		now:   worldState.Now,
+		cache: make(map[resolverKey]resolverAnswer),
+	}, nil
+}
+
+// LookupIP looks up the IPv6 addresses of host if network is ip6, the IPv4 ones if it's ip4, and both if it's ip,
+// connecting to the resolver with dialer
+func (r *Resolver) LookupIP(ctx context.Context, dialer common.Dialer, network string, host string) ([]net.IP, error) {
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	default:
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	}
+	var ips []net.IP
+	var firstErr error
+	for _, qtype := range qtypes {
+		answer, err := r.lookup(ctx, dialer, qtype, host)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		ips = append(ips, answer...)
+	}
+	if len(ips) == 0 {
+		return nil, firstErr
+	}
+	return ips, nil
+}
+
+// expire has the answers for host looked up again when they're next used. They're still kept for when the resolver
+// can't be reached
+func (r *Resolver) expire(host string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	r.m.Lock()
+	defer r.m.Unlock()
+	for key, answer := range r.cache {
+		if key.host == host {
+			answer.expires = time.Time{}
+			r.cache[key] = answer
+		}
+	}
+}
+
+// lookup returns the addresses of host of qtype, from the cache if they haven't expired
+func (r *Resolver) lookup(ctx context.Context, dialer common.Dialer, qtype dnsmessage.Type, host string) ([]net.IP, error) {
+	key := resolverKey{qtype: qtype, host: strings.ToLower(strings.TrimSuffix(host, "."))}
+	r.m.Lock()
+	cached, ok := r.cache[key]
+	r.m.Unlock()
+	if ok && r.now().Before(cached.expires) {
+		return cached.ips, nil
+	}
+
+	ips, ttl, err := r.query(ctx, dialer, qtype, key.host)
+	if err != nil {
+		// the resolver saying there's no such host is an answer, while failing to reach it isn't
+		var dnsErr *net.DNSError
+		if ok && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+			log.Warnf("Failed to look up %v through %v, using the addresses it had: %v", host, r.url.Host, err)
+			return cached.ips, nil
+		}
+		return nil, err
+	}
+	r.m.Lock()
+	r.cache[key] = resolverAnswer{ips: ips, expires: r.now().Add(max(ttl, minResolverTTL))}
+	r.m.Unlock()
+	return ips, nil
+}
+
+// query asks the resolver for the addresses of host of qtype, and returns them with the shortest TTL among them
+func (r *Resolver) query(ctx context.Context, dialer common.Dialer, qtype dnsmessage.Type, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	msg := dnsmessage.Message{
+		// the ID is 0 in DNS over HTTPS, as in RFC 8484
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var raw []byte
+	if r.url.Scheme == "https" {
+		raw, err = r.exchangeHTTPS(ctx, dialer, query)
+	} else {
+		raw, err = r.exchangeTLS(ctx, dialer, query)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query %v: %v", r.url.Host, err)
+	}
+
+	var answer dnsmessage.Message
+	if err := answer.Unpack(raw); err != nil {
+		return nil, 0, err
+	}
+	notFound := &net.DNSError{Err: "no such host", Name: host, Server: r.url.Host, IsNotFound: true}
+	switch answer.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, notFound
+	default:
+		return nil, 0, fmt.Errorf("%v answered with %v", r.url.Host, answer.RCode)
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	for _, resource := range answer.Answers {
+		var ip net.IP
+		switch body := resource.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = body.A[:]
+		case *dnsmessage.AAAAResource:
+			ip = body.AAAA[:]
+		default:
+			continue
+		}
+		if resource.Header.Type != qtype {
+			continue
+		}
+		resourceTTL := time.Duration(resource.Header.TTL) * time.Second
+		if len(ips) == 0 || resourceTTL < ttl {
+			ttl = resourceTTL
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, 0, notFound
+	}
+	return ips, ttl, nil
+}
+
+// dialResolver connects to the resolver over TCP
+func (r *Resolver) dialResolver(ctx context.Context, dialer common.Dialer, address string) (net.Conn, error) {
+	return common.DialContext(ctx, dialer, "tcp", address)
+}
+
+// exchangeHTTPS sends query in a POST to the URL of the resolver, as in RFC 8484
+func (r *Resolver) exchangeHTTPS(ctx context.Context, dialer common.Dialer, query []byte) ([]byte, error) {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return r.dialResolver(ctx, dialer, address)
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: r.rootCAs},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url.String(), bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// exchangeTLS sends query prefixed by its length in TLS to the resolver, as in RFC 7858
+func (r *Resolver) exchangeTLS(ctx context.Context, dialer common.Dialer, query []byte) ([]byte, error) {
+	rawConn, err := r.dialResolver(ctx, dialer, r.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, &tls.Config{ServerName: r.url.Hostname(), RootCAs: r.rootCAs})
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// answerLookup answers a query for server.example.com with 192.0.2.1 and 2001:db8::1, for 5 minutes, and says other
+// hosts don't exist
+func answerLookup(t *testing.T, query []byte) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("bad query: %v", err)
+		return nil
+	}
+	question := msg.Questions[0]
+	msg.Header.Response = true
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: 300}
+	switch {
+	case question.Name.String() != "server.example.com.":
+		msg.RCode = dnsmessage.RCodeNameError
+	case question.Type == dnsmessage.TypeA:
+		msg.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}}
+	case question.Type == dnsmessage.TypeAAAA:
+		aaaa := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+		msg.Answers = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.AAAAResource{AAAA: aaaa}}}
+	}
+	answer, err := msg.Pack()
+	if err != nil {
+		t.Errorf("failed to pack the answer: %v", err)
+	}
+	return answer
+}
+
+func TestMakeResolver(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	good := map[string]string{
+		"https://1.1.1.1/dns-query":     "https://1.1.1.1/dns-query",
+		"https://dns.google":            "https://dns.google/dns-query",
+		"tls://dns.quad9.net":           "tls://dns.quad9.net:853",
+		"tls://[2620:fe::fe]:853":       "tls://[2620:fe::fe]:853",
+		"https://doh.example.com:8443/": "https://doh.example.com:8443/",
+	}
+	for rawURL, expected := range good {
+		r, err := MakeResolver(rawURL, worldState)
+		if err != nil {
+			t.Errorf("%v: %v", rawURL, err)
+			continue
+		}
+		if r.url.String() != expected {
+			t.Errorf("%v: expecting %v, got %v", rawURL, expected, r.url)
+		}
+	}
+	for _, rawURL := range []string{"udp://1.1.1.1", "1.1.1.1", "https:///dns-query"} {
+		if _, err := MakeResolver(rawURL, worldState); err == nil {
+			t.Errorf("expecting an error for %v", rawURL)
+		}
+	}
+}
+
+func TestResolver_LookupIP(t *testing.T) {
+	var queries int32
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("unexpected request %v %v", r.Method, r.Header)
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(answerLookup(t, query))
+	}))
+	defer doh.Close()
+
+	now := time.Unix(10, 0)
+	worldState := common.WorldState{Now: func() time.Time { return now }}
+	r, err := MakeResolver(doh.URL+"/dns-query", worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.rootCAs = x509.NewCertPool()
+	r.rootCAs.AddCert(doh.Certificate())
+	dialer := &net.Dialer{}
+
+	ips, err := r.LookupIP(context.Background(), dialer, "ip", "server.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1").To4()}
+	if !reflect.DeepEqual(ips, expected) {
+		t.Errorf("expecting %v, got %v", expected, ips)
+	}
+
+	t.Run("cached", func(t *testing.T) {
+		before := atomic.LoadInt32(&queries)
+		if _, err := r.LookupIP(context.Background(), dialer, "ip4", "Server.example.com."); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&queries) != before {
+			t.Error("asked the resolver again before the TTL has passed")
+		}
+		now = now.Add(301 * time.Second)
+		if _, err := r.LookupIP(context.Background(), dialer, "ip4", "server.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&queries) != before+1 {
+			t.Error("didn't ask the resolver after the TTL has passed")
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		before := atomic.LoadInt32(&queries)
+		r.expire("SERVER.example.com.")
+		if _, err := r.LookupIP(context.Background(), dialer, "ip4", "server.example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if atomic.LoadInt32(&queries) != before+1 {
+			t.Error("didn't ask the resolver after the answer was expired")
+		}
+	})
+	t.Run("no such host", func(t *testing.T) {
+		_, err := r.LookupIP(context.Background(), dialer, "ip6", "elsewhere.example.com")
+		if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+			t.Errorf("expecting the host not to be found, got %v", err)
+		}
+	})
+	t.Run("pinned", func(t *testing.T) {
+		doh.Close()
+		now = now.Add(time.Hour)
+		ips, err := r.LookupIP(context.Background(), dialer, "ip6", "server.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ips, expected[:1]) {
+			t.Errorf("expecting %v, got %v", expected[:1], ips)
+		}
+		if _, err := r.LookupIP(context.Background(), dialer, "ip6", "other.example.com"); err == nil {
+			t.Error("expecting an error for a host never looked up")
+		}
+	})
+}
+
+func TestResolver_LookupIP_TLS(t *testing.T) {
+	cert := httptest.NewTLSServer(http.NotFoundHandler())
+	cert.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cert.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				answer := answerLookup(t, query)
+				binary.BigEndian.PutUint16(length[:], uint16(len(answer)))
+				conn.Write(append(length[:], answer...))
+			}()
+		}
+	}()
+
+	r, err := MakeResolver("tls://"+l.Addr().String(), common.WorldOfTime(time.Unix(10, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.rootCAs = x509.NewCertPool()
+	r.rootCAs.AddCert(cert.Certificate())
+	ips, err := r.LookupIP(context.Background(), &net.Dialer{}, "ip4", "server.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []net.IP{net.ParseIP("192.0.2.1").To4()}; !reflect.DeepEqual(ips, expected) {
+		t.Errorf("expecting %v, got %v", expected, ips)
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+// With ServerListPath, a session asks the server on a control stream for the addresses of the servers the user can
+// connect to, which are in the ServerList of the server, and writes them to ServerListPath in JSON. A client that
+// can only get through in DoH mode can be given them to move on to.
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// how long the server has to answer, as older ones don't
+const serverListTimeout = 60 * time.Second
+
+// fetchServerList asks the server for the server list on a control stream of sesh, and writes it to path
+func fetchServerList(sesh *mux.Session, path string) {
+	stream, err := sesh.OpenControlStream()
+	if err != nil {
+		log.Debugf("failed to open the control stream: %v", err)
+		return
+	}
+	defer stream.Close()
+
+	query, _ := json.Marshal(common.ControlMessage{Type: common.MSG_QUERY_SERVERS})
+	if _, err := stream.Write(query); err != nil {
+		return
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(serverListTimeout))
+	buf := make([]byte, 65536)
+	for {
+		n, err := stream.Read(buf)
+		if err != nil {
+			log.Debugf("server list isn't received: %v", err)
+			return
+		}
+		var msg common.ControlMessage
+		if err := json.Unmarshal(buf[:n], &msg); err != nil || msg.Type != common.MSG_SERVERS {
+			continue
+		}
+		if len(msg.Servers) == 0 {
+			log.Debug("the server knows of no servers to tell")
+			return
+		}
+		if err := writeServerList(path, msg.Servers); err != nil {
+			log.Errorf("Failed to write the server list: %v", err)
+			return
+		}
+		log.Infof("Wrote %v servers to %v", len(msg.Servers), path)
+		return
+	}
+}
+
+// writeServerList replaces path with servers in one go, so that nothing reading it sees half of them
+func writeServerList(path string, servers []string) error {
+	content, err := json.MarshalIndent(servers, "", "  ")
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
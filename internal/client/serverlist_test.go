@@ -0,0 +1,72 @@
+package client
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/connutil"
+)
+
+func TestFetchServerList(t *testing.T) {
+	obfuscator, _ := mux.MakeObfuscator(mux.E_METHOD_PLAIN, [32]byte{})
+	clientSession := mux.MakeSession(1, mux.SessionConfig{Obfuscator: obfuscator})
+	serverSession := mux.MakeSession(1, mux.SessionConfig{Obfuscator: obfuscator})
+	defer clientSession.Close()
+	c, s := connutil.AsyncPipe()
+	clientSession.AddConnection(&common.TLSConn{Conn: c})
+	serverSession.AddConnection(&common.TLSConn{Conn: s})
+
+	path := filepath.Join(t.TempDir(), "servers.json")
+	done := make(chan struct{})
+	go func() {
+		fetchServerList(clientSession, path)
+		close(done)
+	}()
+	stream, err := serverSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stream.(*mux.Stream).IsControl() {
+		t.Fatal("server list isn't asked for on a control stream")
+	}
+	buf := make([]byte, 1024)
+	n, err := stream.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var query common.ControlMessage
+	if err := json.Unmarshal(buf[:n], &query); err != nil || query.Type != common.MSG_QUERY_SERVERS {
+		t.Fatalf("unexpected query %s", buf[:n])
+	}
+
+	servers := []string{"203.0.113.1:443", "cloak.example.com:443"}
+	for _, msg := range []common.ControlMessage{
+		// other messages on the stream are passed over
+		{Type: common.MSG_LOW_CREDIT, Quota: &common.Quota{UpCredit: 10}},
+		{Type: common.MSG_SERVERS, Servers: servers},
+	} {
+		reply, _ := json.Marshal(msg)
+		if _, err := stream.Write(reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("server list isn't written")
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []string
+	if err := json.Unmarshal(content, &written); err != nil || len(written) != 2 || written[0] != servers[0] {
+		t.Errorf("unexpected server list %s", content)
+	}
+}
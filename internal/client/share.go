@@ -0,0 +1,192 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// Servers are shared with clients in a few formats, which ImportShare takes:
+//
+//   - a cloak:// link, as made by ck-server keys uri
+//   - an ss:// link of Shadowsocks in SIP002, whose plugin is Cloak, e.g.
+//     ss://YWVzLTI1Ni1nY206cGFzcw@203.0.113.1:443/?plugin=ck-client%3BUID%3D...%3BPublicKey%3D...#name
+//   - a Shadowsocks server in JSON, with plugin and plugin_opts, or a list of them in SIP008, of which the first with
+//     Cloak as its plugin is taken
+//   - a configuration of ck-client in JSON
+//
+// The options of the plugin are those of ck-client as a Shadowsocks plugin, and the ProxyMethod is shadowsocks unless
+// they say otherwise
+
+// shadowsocksServer is a server in the JSON of Shadowsocks, and of SIP008
+type shadowsocksServer struct {
+	Remarks    string          `json:"remarks"`
+	Server     string          `json:"server"`
+	ServerPort json.RawMessage `json:"server_port"`
+	Plugin     string          `json:"plugin"`
+	PluginOpts string          `json:"plugin_opts"`
+}
+
+// ImportShare makes a configuration out of a share of a server, also returning the server's name if the share has
+// one
+func ImportShare(share string) (raw *RawConfig, name string, err error) {
+	share = strings.TrimSpace(share)
+	lower := strings.ToLower(share)
+	switch {
+	case strings.HasPrefix(lower, common.ShareLinkScheme+"://"):
+		link, err := common.ParseShareLink(share)
+		if err != nil {
+			return nil, "", err
+		}
+		raw, err = RawConfigFromShareLink(link)
+		return raw, link.Name, err
+	case strings.HasPrefix(lower, "ss://"):
+		return importSIP002(share)
+	case strings.HasPrefix(share, "{"):
+		return importJSON([]byte(share))
+	default:
+		return nil, "", errors.New("the share is neither a cloak:// or ss:// link nor JSON")
+	}
+}
+
+// importSIP002 takes an ss:// link in SIP002. The method and password of Shadowsocks in its user info are for
+// Shadowsocks, not Cloak, so they're left alone
+func importSIP002(share string) (*RawConfig, string, error) {
+	u, err := url.Parse(share)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return nil, "", errors.New("the ss:// link has no host and port, and a link in the legacy format has no plugin")
+	}
+	raw, err := fromShadowsocks(u.Hostname(), u.Port(), u.Query().Get("plugin"))
+	return raw, u.Fragment, err
+}
+
+func importJSON(content []byte) (*RawConfig, string, error) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(content, &keys); err != nil {
+		return nil, "", err
+	}
+	if list, ok := keys["servers"]; ok {
+		var servers []shadowsocksServer
+		if err := json.Unmarshal(list, &servers); err != nil {
+			return nil, "", err
+		}
+		for _, server := range servers {
+			if isCloakPlugin(server.Plugin) {
+				return server.rawConfig()
+			}
+		}
+		return nil, "", errors.New("no server in the list has Cloak as its plugin")
+	}
+	if _, ok := keys["server"]; ok {
+		var server shadowsocksServer
+		if err := json.Unmarshal(content, &server); err != nil {
+			return nil, "", err
+		}
+		return server.rawConfig()
+	}
+	raw := new(RawConfig)
+	if err := common.DecodeConfig(content, "json", raw); err != nil {
+		return nil, "", err
+	}
+	return raw, "", nil
+}
+
+func (server shadowsocksServer) rawConfig() (*RawConfig, string, error) {
+	// server_port is a number in SIP008, but it's sometimes a string
+	var port interface{}
+	if err := json.Unmarshal(server.ServerPort, &port); err != nil {
+		return nil, "", fmt.Errorf("bad server_port: %v", err)
+	}
+	plugin := server.Plugin
+	if server.PluginOpts != "" {
+		plugin += ";" + server.PluginOpts
+	}
+	raw, err := fromShadowsocks(server.Server, fmt.Sprint(port), plugin)
+	return raw, server.Remarks, err
+}
+
+// isCloakPlugin is whether the plugin of Shadowsocks, by its name or path, is Cloak
+func isCloakPlugin(plugin string) bool {
+	name := strings.ToLower(plugin)
+	if i := strings.LastIndexAny(name, `/\`); i != -1 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSuffix(name, ".exe")
+	return name == "ck-client" || name == "cloak"
+}
+
+// fromShadowsocks makes the configuration of Cloak as the plugin of a Shadowsocks server at host and port, where
+// plugin is the name of the plugin followed by its options, separated by semicolons
+func fromShadowsocks(host string, port string, plugin string) (*RawConfig, error) {
+	fields := splitPluginOptions(plugin)
+	if len(fields) == 0 || !isCloakPlugin(fields[0]) {
+		return nil, errors.New("the server doesn't have Cloak as its plugin")
+	}
+	if _, err := strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("bad port %v", port)
+	}
+	options := make(map[string]string)
+	for _, option := range fields[1:] {
+		if option == "" {
+			continue
+		}
+		sp := strings.SplitN(option, "=", 2)
+		if len(sp) != 2 {
+			return nil, fmt.Errorf("bad plugin option %v", option)
+		}
+		options[sp[0]] = sp[1]
+	}
+	raw := &RawConfig{ProxyMethod: "shadowsocks"}
+	if err := raw.Override(options); err != nil {
+		return nil, fmt.Errorf("bad plugin options: %v", err)
+	}
+	raw.RemoteHost = strings.Trim(host, "[]")
+	raw.RemotePort = port
+	return raw, nil
+}
+
+// splitPluginOptions splits the options of a Shadowsocks plugin on the semicolons that aren't escaped with a
+// backslash, unescaping them
+func splitPluginOptions(s string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			i++
+			field.WriteByte(s[i])
+		case s[i] == ';':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(s[i])
+		}
+	}
+	if field.Len() != 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// MarshalConfig writes raw in the JSON of a configuration file, leaving out the fields that aren't set
+func MarshalConfig(raw *RawConfig) ([]byte, error) {
+	fields := make(map[string]interface{})
+	v := reflect.ValueOf(raw).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.IsZero() || ((f.Kind() == reflect.Slice || f.Kind() == reflect.Map) && f.Len() == 0) {
+			continue
+		}
+		fields[v.Type().Field(i).Name] = f.Interface()
+	}
+	return json.MarshalIndent(fields, "", "  ")
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+const (
+	shareUID = "iGAO85zysIyR4c09CyZSLdNhtP/ckcYu7nIPI082AHA="
+	sharePub = "IYoUzkle/T/kriE+Ufdm7AHQtIeGnBWbhhlTbmDpUUI="
+)
+
+func TestImportShare_SIP002(t *testing.T) {
+	// the plugin options escape the semicolon in ServerName
+	plugin := "ck-client;UID=" + shareUID + ";PublicKey=" + sharePub + `;ServerName=www.bing.com\;x;NumConn=2`
+	link := "ss://YWVzLTI1Ni1nY206cGFzcw@203.0.113.1:8443/?plugin=" + url.QueryEscape(plugin) + "#my%20server"
+	raw, name, err := ImportShare(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "my server" {
+		t.Errorf("expecting name my server, got %v", name)
+	}
+	if raw.RemoteHost != "203.0.113.1" || raw.RemotePort != "8443" {
+		t.Errorf("expecting 203.0.113.1:8443, got %v:%v", raw.RemoteHost, raw.RemotePort)
+	}
+	if raw.ProxyMethod != "shadowsocks" {
+		t.Errorf("expecting ProxyMethod shadowsocks, got %v", raw.ProxyMethod)
+	}
+	if raw.ServerName != "www.bing.com;x" {
+		t.Errorf("expecting the escaped semicolon to be kept, got %v", raw.ServerName)
+	}
+	if raw.NumConn != 2 {
+		t.Errorf("expecting NumConn 2, got %v", raw.NumConn)
+	}
+	if len(raw.UID) == 0 || len(raw.PublicKey) == 0 {
+		t.Errorf("expecting the UID and PublicKey to be decoded")
+	}
+
+	if _, _, err = ImportShare("ss://YWVzLTI1Ni1nY206cGFzcw@203.0.113.1:8443/?plugin=v2ray-plugin%3Bmode%3Dwebsocket"); err == nil {
+		t.Error("a link with another plugin should fail")
+	}
+}
+
+func TestImportShare_SIP008(t *testing.T) {
+	sip008 := `{"version":1,"servers":[
+		{"server":"198.51.100.1","server_port":443,"method":"aes-256-gcm","password":"pass"},
+		{"remarks":"cloaked","server":"198.51.100.2","server_port":"443","plugin":"/usr/bin/ck-client","plugin_opts":"PublicKey=` + sharePub + `;ServerName=www.bing.com;ProxyMethod=ss"}
+	]}`
+	raw, name, err := ImportShare(sip008)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "cloaked" || raw.RemoteHost != "198.51.100.2" || raw.RemotePort != "443" {
+		t.Errorf("the server with Cloak as its plugin isn't taken: %v %v:%v", name, raw.RemoteHost, raw.RemotePort)
+	}
+	if raw.ProxyMethod != "ss" {
+		t.Errorf("expecting the plugin's ProxyMethod, got %v", raw.ProxyMethod)
+	}
+
+	single := `{"server":"198.51.100.3","server_port":8388,"plugin":"ck-client.exe","plugin_opts":"ServerName=www.bing.com"}`
+	raw, _, err = ImportShare(single)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.RemoteHost != "198.51.100.3" || raw.RemotePort != "8388" || raw.ServerName != "www.bing.com" {
+		t.Errorf("the single server isn't imported: %+v", raw)
+	}
+}
+
+func TestImportShare_Config(t *testing.T) {
+	raw, _, err := ImportShare(`{"ServerName":"www.bing.com","RemoteHost":"192.0.2.1"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.ServerName != "www.bing.com" || raw.RemoteHost != "192.0.2.1" {
+		t.Errorf("the configuration isn't imported: %+v", raw)
+	}
+	if _, _, err = ImportShare(`{"ServerNam":"www.bing.com"}`); err == nil {
+		t.Error("an unknown field should fail")
+	}
+	if _, _, err = ImportShare("vmess://abc"); err == nil {
+		t.Error("an unknown share should fail")
+	}
+}
+
+func TestMarshalConfig(t *testing.T) {
+	raw, _, err := ImportShare("cloak://192.0.2.1:8443?ServerName=www.bing.com&NumConn=4#name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := MarshalConfig(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(content, &fields); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"RemoteHost": "192.0.2.1", "RemotePort": "8443", "ServerName": "www.bing.com", "NumConn": float64(4)}
+	for field, value := range expected {
+		if fields[field] != value {
+			t.Errorf("expecting %v to be %v, got %v", field, value, fields[field])
+		}
+	}
+	if _, ok := fields["UDP"]; ok {
+		t.Error("fields that aren't set should be left out")
+	}
+
+	again, _, err := ImportShare(string(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content2, _ := MarshalConfig(again)
+	if !bytes.Equal(content, content2) {
+		t.Errorf("the written configuration doesn't read back the same: %s vs %s", content, content2)
+	}
+}
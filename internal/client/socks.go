@@ -0,0 +1,163 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+)
+
+// A minimal SOCKS5 server (RFC 1928) that does CONNECT and UDP ASSOCIATE. Username/password authentication (RFC 1929)
+// is accepted without checking, as that is how Tor passes the per-bridge arguments of a pluggable transport
+
+const (
+	socksVersion         = 0x05
+	socksAuthNone        = 0x00
+	socksAuthUserPass    = 0x02
+	socksAuthNoAccept    = 0xff
+	socksUserPassVer     = 0x01
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+	socksRepSucceeded    = 0x00
+	socksRepFailure      = 0x01
+	socksRepCmdUnsupp    = 0x07
+	socksRepAtypUnsupp   = 0x08
+)
+
+var ErrSocksVersion = errors.New("not SOCKS5")
+var ErrSocksCommand = errors.New("unsupported SOCKS command")
+
+// socksRequest is the CONNECT or UDP ASSOCIATE request of a SOCKS5 client. username and password are empty if the
+// client didn't authenticate
+type socksRequest struct {
+	command  byte
+	target   string
+	username string
+	password string
+}
+
+// socksHandshake negotiates the authentication method and reads the request from conn. If the request can't be
+// served, a failure reply is sent; otherwise the caller must call socksReply once it knows the outcome
+func socksHandshake(conn io.ReadWriter) (req socksRequest, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	if header[0] != socksVersion {
+		err = ErrSocksVersion
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	method := byte(socksAuthNoAccept)
+	for _, m := range methods {
+		if m == socksAuthUserPass {
+			method = m
+			break
+		}
+		if m == socksAuthNone {
+			method = m
+		}
+	}
+	if _, err = conn.Write([]byte{socksVersion, method}); err != nil {
+		return
+	}
+	switch method {
+	case socksAuthNoAccept:
+		err = errors.New("no acceptable SOCKS authentication method")
+		return
+	case socksAuthUserPass:
+		req.username, req.password, err = readUserPass(conn)
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write([]byte{socksUserPassVer, 0x00}); err != nil {
+			return
+		}
+	}
+
+	var reqHeader [3]byte
+	if _, err = io.ReadFull(conn, reqHeader[:]); err != nil {
+		return
+	}
+	if reqHeader[0] != socksVersion {
+		err = ErrSocksVersion
+		return
+	}
+	req.command = reqHeader[1]
+	if req.command != socksCmdConnect && req.command != socksCmdUDPAssociate {
+		socksReply(conn, socksRepCmdUnsupp)
+		err = fmt.Errorf("%w: %v", ErrSocksCommand, req.command)
+		return
+	}
+	req.target, err = common.ReadTarget(conn)
+	if errors.Is(err, common.ErrAddrType) {
+		socksReply(conn, socksRepAtypUnsupp)
+	}
+	return
+}
+
+func readUserPass(conn io.Reader) (username, password string, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return
+	}
+	if header[0] != socksUserPassVer {
+		err = errors.New("bad SOCKS username/password version")
+		return
+	}
+	user := make([]byte, header[1])
+	if _, err = io.ReadFull(conn, user); err != nil {
+		return
+	}
+	var l [1]byte
+	if _, err = io.ReadFull(conn, l[:]); err != nil {
+		return
+	}
+	pass := make([]byte, l[0])
+	if _, err = io.ReadFull(conn, pass); err != nil {
+		return
+	}
+	return string(user), string(pass), nil
+}
+
+// socksReply sends the reply to a request. The bound address is always reported as 0.0.0.0:0 since streams don't
+// have one
+func socksReply(conn io.Writer, rep byte) error {
+	_, err := conn.Write([]byte{socksVersion, rep, 0x00, common.AddrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyBound sends the successful reply to a UDP ASSOCIATE request, with the address that the client is to send
+// its datagrams to
+func socksReplyBound(conn io.Writer, bound string) error {
+	addr, err := common.MarshalTarget(bound)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append([]byte{socksVersion, socksRepSucceeded, 0x00}, addr...))
+	return err
+}
+
+// Each datagram relayed by UDP ASSOCIATE starts with RSV(2) | FRAG | ATYP | ADDR | PORT. Past RSV and FRAG, that's a
+// datagram of a "direct" datagram stream
+
+var errSocksFragment = errors.New("fragmented SOCKS datagrams aren't supported")
+
+// unpackSocksDatagram strips RSV and FRAG from a datagram from the client
+func unpackSocksDatagram(datagram []byte) ([]byte, error) {
+	if len(datagram) < 3 {
+		return nil, errors.New("SOCKS datagram is too short")
+	}
+	if datagram[2] != 0 {
+		return nil, errSocksFragment
+	}
+	return datagram[3:], nil
+}
+
+// packSocksDatagram prepends RSV and FRAG to a datagram to the client
+func packSocksDatagram(datagram []byte) []byte {
+	return append([]byte{0, 0, 0}, datagram...)
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func socksConn(in []byte) (io.ReadWriter, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(in), out}, out
+}
+
+func TestSocksHandshake(t *testing.T) {
+	t.Run("username and password with domain", func(t *testing.T) {
+		in := []byte{0x05, 0x02, 0x00, 0x02}
+		in = append(in, 0x01, 0x04, 'U', 'I', 'D', '=', 0x01, 0x00)
+		in = append(in, 0x05, 0x01, 0x00, 0x03, 0x0b)
+		in = append(in, []byte("example.com")...)
+		in = append(in, 0x01, 0xbb)
+		conn, out := socksConn(in)
+
+		req, err := socksHandshake(conn)
+		if err != nil {
+			t.Fatalf("expecting no error, got %v", err)
+		}
+		if req.target != "example.com:443" {
+			t.Errorf("expecting target example.com:443, got %v", req.target)
+		}
+		if req.username != "UID=" || req.password != "\x00" {
+			t.Errorf("unexpected username %q and password %q", req.username, req.password)
+		}
+		if !bytes.Equal(out.Bytes(), []byte{0x05, 0x02, 0x01, 0x00}) {
+			t.Errorf("unexpected replies %x", out.Bytes())
+		}
+	})
+	t.Run("no authentication with IPv4", func(t *testing.T) {
+		in := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 203, 0, 113, 1, 0x00, 0x50}
+		conn, _ := socksConn(in)
+
+		req, err := socksHandshake(conn)
+		if err != nil {
+			t.Fatalf("expecting no error, got %v", err)
+		}
+		if req.target != net.JoinHostPort("203.0.113.1", "80") {
+			t.Errorf("expecting target 203.0.113.1:80, got %v", req.target)
+		}
+	})
+	t.Run("bind", func(t *testing.T) {
+		in := []byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01, 203, 0, 113, 1, 0x00, 0x50}
+		conn, out := socksConn(in)
+
+		_, err := socksHandshake(conn)
+		if !errors.Is(err, ErrSocksCommand) {
+			t.Errorf("expecting %v, got %v", ErrSocksCommand, err)
+		}
+		if reply := out.Bytes(); len(reply) != 12 || reply[3] != socksRepCmdUnsupp {
+			t.Errorf("unexpected replies %x", reply)
+		}
+	})
+	t.Run("UDP associate", func(t *testing.T) {
+		in := []byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+		conn, _ := socksConn(in)
+
+		req, err := socksHandshake(conn)
+		if err != nil {
+			t.Fatalf("expecting no error, got %v", err)
+		}
+		if req.command != socksCmdUDPAssociate {
+			t.Errorf("expecting UDP ASSOCIATE, got command %v", req.command)
+		}
+	})
+	t.Run("unsupported address type", func(t *testing.T) {
+		in := []byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x02, 0, 0}
+		conn, out := socksConn(in)
+
+		_, err := socksHandshake(conn)
+		if err == nil {
+			t.Error("expecting error")
+		}
+		if reply := out.Bytes(); len(reply) != 12 || reply[3] != socksRepAtypUnsupp {
+			t.Errorf("unexpected replies %x", reply)
+		}
+	})
+	t.Run("SOCKS4", func(t *testing.T) {
+		conn, _ := socksConn([]byte{0x04, 0x01})
+		_, err := socksHandshake(conn)
+		if err != ErrSocksVersion {
+			t.Errorf("expecting %v, got %v", ErrSocksVersion, err)
+		}
+	})
+}
+
+func TestSocksDatagram(t *testing.T) {
+	datagram := []byte{0x01, 203, 0, 113, 1, 0x00, 0x35, 'h', 'i'}
+	unpacked, err := unpackSocksDatagram(packSocksDatagram(datagram))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unpacked, datagram) {
+		t.Errorf("expecting %x, got %x", datagram, unpacked)
+	}
+	if _, err = unpackSocksDatagram(append([]byte{0, 0, 1}, datagram...)); err != errSocksFragment {
+		t.Errorf("expecting %v, got %v", errSocksFragment, err)
+	}
+}
+
+func TestSocksReplyBound(t *testing.T) {
+	out := &bytes.Buffer{}
+	if err := socksReplyBound(out, "127.0.0.1:1080"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), []byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0x04, 0x38}) {
+		t.Errorf("unexpected reply %x", out.Bytes())
+	}
+}
@@ -2,11 +2,14 @@ package client
 
 import (
 	"crypto"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,23 +34,133 @@ type RawConfig struct {
 	RemotePort       string // jsonOptional
 
 	// defaults set in SplitConfigs
-	UDP           bool   // nullable
-	BrowserSig    string // nullable
-	Transport     string // nullable
-	StreamTimeout int    // nullable
-	KeepAlive     int    // nullable
+	UDP            bool              // nullable
+	UDPRelay       bool              // nullable
+	UDPTimeout     int               // nullable
+	Multipath      string            // nullable
+	MultipathAddrs []string          // nullable
+	ResumeGrace    int               // nullable
+	KnockPort      string            // nullable
+	PreferIPv4     bool              // nullable
+	ResolverURL    string            // nullable
+	Interface      string            // nullable
+	SourceIP       string            // nullable
+	FwMark         int               // nullable
+	WarmSessions   int               // nullable
+	EarlyData      bool              // nullable
+	SessionTickets bool              // nullable
+	FECShards      string            // nullable
+	Heartbeat      int               // nullable
+	TrafficProfile string            // nullable
+	RecordSizing   string            // nullable
+	QuotaAddr      string            // nullable
+	StatsAddr      string            // nullable
+	ServerListPath string            // nullable
+	LocalProxy     string            // nullable
+	TUNName        string            // nullable
+	TUNAddr        string            // nullable
+	TUNMTU         int               // nullable
+	BrowserSig     string            // nullable
+	Transport      string            // nullable
+	StreamTimeout  int               // nullable
+	KeepAlive      int               // nullable
+	ECHConfig      []byte            // nullable
+	FrontingHost   string            // nullable
+	FrontingHosts  []string          // nullable
+	GRPCPath       string            // only required in gRPC mode
+	H2Path         string            // only required in HTTP/2 mode
+	DoHDomain      string            // only required in DoH mode
+	DoHPath        string            // nullable
+	WSPath         string            // nullable
+	WSHeaders      map[string]string // nullable
+	WSUserAgents   []string          // nullable
+
+	// in seconds, the longest to wait before connecting to the server again after failing to
+	ReconnectMaxDelay int  // nullable
+	ReconnectResolve  bool // nullable
+
+	// other addresses of the server, host:port or :port of RemoteHost, each optionally followed by @weight
+	Endpoints           []string // nullable
+	HealthCheckInterval int      // nullable
+	// IPs, or CIDR ranges, of the edges of the CDN RemoteHost is on
+	CDNEdges []string // nullable
+
+	// in bytes, how much the server can send on each stream, and on all of them, that hasn't been read yet
+	StreamWindow  int // nullable
+	SessionWindow int // nullable
+
+	// whether what's sent on streams both ways is compressed, if the server agrees for ProxyMethod
+	Compression bool // nullable
+
+	// whether the datagrams of UDP in TCP mode can be dropped rather than held up
+	UnreliableUDP bool // nullable
+
+	// in seconds, how often the keys that sessions encrypt with are moved on from, if the server supports it
+	RekeyInterval int // nullable
 }
 
 type RemoteConnConfig struct {
-	NumConn        int
-	KeepAlive      time.Duration
-	RemoteAddr     string
+	NumConn    int
+	KeepAlive  time.Duration
+	RemoteAddr string
+	// RemoteAddr followed by the other server addresses of multipath, which the connections are spread across
+	RemoteAddrs []string
+	// how long a session waits to be resumed on new connections after losing all of them. 0 if it's not resumable
+	ResumeGrace time.Duration
+	// whether the IPv4 addresses of RemoteHost are tried ahead of its IPv6 ones
+	PreferIPv4 bool
+	// what RemoteHost is looked up with, nil for the system's resolver
+	Resolver *Resolver
+	// RemoteAddr followed by the other addresses of the server, of which connections are made to the best. nil if
+	// there are none
+	Endpoints *Endpoints
+	// the windows of flow control of each session, 0 if what the server sends isn't limited
+	StreamWindow  int
+	SessionWindow int
+	// whether the datagram streams of sessions are unreliable
+	UnreliableDatagrams bool
+	// how often sessions are rekeyed, 0 if they aren't
+	RekeyInterval time.Duration
+	// how long to wait before connecting again after failing to
+	Backoff *Backoff
+	// whether RemoteHost is looked up through Resolver afresh when connecting again, rather than from its cache
+	ReconnectResolve bool
+	// what the sockets of the connections to the server are bound to
+	Binding SocketBinding
+	// the UDP port of the server a knock is sent to before each connection, empty if the server isn't knocked on
+	KnockPort string
+	// the number of sessions kept established ahead of demand, 0 if they're only made when needed
+	WarmSessions int
+	// how the frames of streams are sized into records, one of the mux.RECORD_SIZING_ constants
+	RecordSizing byte
+	// what the sessions hear from the server of the user's quota, nil if they don't ask
+	Quota *QuotaWatcher
+	// where the sessions write the server list they're told of, empty if they don't ask
+	ServerListPath string
+	// what the traffic of the sessions is counted by, nil if it isn't counted
+	Valve mux.Valve
+	// what the sessions are counted in for StatsAddr, nil if they aren't
+	Stats          *Stats
 	TransportMaker func() Transport
 }
 
 type LocalConnConfig struct {
 	LocalAddr string
 	Timeout   time.Duration
+	// whether to also listen for UDP on LocalAddr in TCP mode, carried over datagram streams
+	UDPRelay bool
+	// how long the stream of a UDP source lasts without datagrams either way
+	UDPTimeout time.Duration
+	// the kind of proxy server to be on LocalAddr for a "direct" ProxyMethod, empty to pass everything through as is
+	LocalProxy string
+	// the TUN device of LocalProxy "tun"
+	TUNName string
+	TUNNet  *net.IPNet
+	TUNMTU  int
+	// where the quota is served over HTTP, empty if it isn't
+	QuotaAddr string
+	// where the stats are served over HTTP, empty if they aren't
+	StatsAddr string
 }
 
 type AuthInfo struct {
@@ -59,6 +172,30 @@ type AuthInfo struct {
 	ServerPubKey     crypto.PublicKey
 	MockDomain       string
 	WorldState       common.WorldState
+	// whether the ClientHello offers the server an ML-KEM-768 key to make the key exchange hybrid. It's set by the
+	// transport
+	PostQuantum bool
+	// whether the session's frames are spread across its connections by their latency, and whether each one is
+	// sent on all of them
+	Multipath bool
+	Duplicate bool
+	// whether the session is to be kept by the server for a while after losing all its connections
+	Resumable bool
+	// the number of frames in each block of forward error correction, and of parity frames sent after it. 0 if
+	// there's no FEC
+	FECDataShards   int
+	FECParityShards int
+	// how often the session's connections carry heartbeats both ways. 0 if they don't
+	Heartbeat time.Duration
+	// what the traffic of the session is shaped after both ways
+	TrafficProfile byte
+	// whether the server is to say why it closes the session
+	CloseReasons bool
+	// whether frames are sent under the early session key right after the ClientHello, rather than after the
+	// server's reply. It's only taken up by DirectTLS
+	EarlyData bool
+	// whether frames of streams are compressed
+	Compression bool
 }
 
 // semi-colon separated value. This is for Android plugin options
@@ -77,7 +214,7 @@ func ssvToJson(ssv string) (ret []byte) {
 		r = strings.Replace(r, `\;`, `;`, -1)
 		return r
 	}
-	unquoted := []string{"NumConn", "StreamTimeout", "KeepAlive", "UDP"}
+	unquoted := []string{"NumConn", "StreamTimeout", "KeepAlive", "UDP", "UDPRelay", "UDPTimeout", "TUNMTU", "ResumeGrace", "Heartbeat", "WarmSessions", "ReconnectMaxDelay", "ReconnectResolve", "HealthCheckInterval", "StreamWindow", "SessionWindow", "EarlyData", "SessionTickets", "Compression", "UnreliableUDP", "RekeyInterval"}
 	lines := strings.Split(unescape(ssv), ";")
 	ret = []byte("{")
 	for _, ln := range lines {
@@ -100,26 +237,81 @@ func ssvToJson(ssv string) (ret []byte) {
 	return ret
 }
 
+// EnvPrefix is what the environment variables of the fields of RawConfig start with
+const EnvPrefix = "CK_CLIENT_"
+
+// Override sets the fields of raw in values by name, each written as common.ConfigFields describes
+func (raw *RawConfig) Override(values map[string]string) error {
+	return common.OverrideConfig(raw, values, nil)
+}
+
+// RawConfigFromShareLink makes the configuration that link describes
+func RawConfigFromShareLink(link common.ShareLink) (*RawConfig, error) {
+	raw := new(RawConfig)
+	if err := raw.Override(link.Fields); err != nil {
+		return nil, fmt.Errorf("bad %v:// link: %v", common.ShareLinkScheme, err)
+	}
+	raw.RemoteHost = link.RemoteHost
+	raw.RemotePort = link.RemotePort
+	return raw, nil
+}
+
+// ParseConfig reads the configuration from conf, which is either a path to a JSON, YAML or TOML file, by its
+// extension, options separated with semicolons, or a cloak:// link, then sets the fields that have an environment variable of
+// CK_CLIENT_ and the upper case field name. Nothing is read if conf is empty, so that the configuration can be
+// entirely in the environment
 func ParseConfig(conf string) (raw *RawConfig, err error) {
+	raw = new(RawConfig)
 	var content []byte
-	// Checking if it's a path to json or a ssv string
-	if strings.Contains(conf, ";") && strings.Contains(conf, "=") {
+	format := "json"
+	// Checking if it's a share link, a ssv string or a path
+	if strings.HasPrefix(strings.ToLower(conf), common.ShareLinkScheme+"://") {
+		var link common.ShareLink
+		if link, err = common.ParseShareLink(conf); err != nil {
+			return
+		}
+		if raw, err = RawConfigFromShareLink(link); err != nil {
+			return
+		}
+	} else if strings.Contains(conf, ";") && strings.Contains(conf, "=") {
 		content = ssvToJson(conf)
-	} else {
+	} else if conf != "" {
 		content, err = ioutil.ReadFile(conf)
 		if err != nil {
 			return
 		}
+		format = common.ConfigFormat(conf)
 	}
 
-	raw = new(RawConfig)
-	err = json.Unmarshal(content, &raw)
-	if err != nil {
+	if content != nil {
+		err = common.DecodeConfig(content, format, raw)
+		if err != nil {
+			return
+		}
+	}
+	if err = raw.Override(common.ConfigEnv(raw, EnvPrefix, os.LookupEnv)); err != nil {
+		err = fmt.Errorf("failed to read configuration from the environment: %v", err)
 		return
 	}
 	return
 }
 
+// SocketBinding is what Interface, SourceIP and FwMark bind the sockets of the connections to the server to
+func (raw *RawConfig) SocketBinding() (binding SocketBinding, err error) {
+	binding.Interface = raw.Interface
+	if raw.SourceIP != "" {
+		binding.SourceIP = net.ParseIP(raw.SourceIP)
+		if binding.SourceIP == nil {
+			return binding, fmt.Errorf("SourceIP %v isn't an IP address", raw.SourceIP)
+		}
+	}
+	if raw.FwMark < 0 {
+		return binding, errors.New("FwMark can't be negative")
+	}
+	binding.FwMark = raw.FwMark
+	return binding, checkSocketBinding(binding)
+}
+
 func (raw *RawConfig) SplitConfigs(worldState common.WorldState) (local LocalConnConfig, remote RemoteConnConfig, auth AuthInfo, err error) {
 	nullErr := func(field string) (local LocalConnConfig, remote RemoteConnConfig, auth AuthInfo, err error) {
 		err = fmt.Errorf("%v cannot be empty", field)
@@ -139,11 +331,19 @@ func (raw *RawConfig) SplitConfigs(worldState common.WorldState) (local LocalCon
 	if len(raw.UID) == 0 {
 		return nullErr("UID")
 	}
+	if len(raw.UID) != 16 {
+		err = fmt.Errorf("UID must be 16 bytes, got %v", len(raw.UID))
+		return
+	}
 
 	// static public key
 	if len(raw.PublicKey) == 0 {
 		return nullErr("PublicKey")
 	}
+	if len(raw.PublicKey) != 32 {
+		err = fmt.Errorf("PublicKey must be 32 bytes, got %v", len(raw.PublicKey))
+		return
+	}
 	pub, ok := ecdh.Unmarshal(raw.PublicKey)
 	if !ok {
 		err = fmt.Errorf("failed to unmarshal Public key")
@@ -160,6 +360,12 @@ func (raw *RawConfig) SplitConfigs(worldState common.WorldState) (local LocalCon
 		auth.EncryptionMethod = mux.E_METHOD_AES_GCM
 	case "chacha20-poly1305":
 		auth.EncryptionMethod = mux.E_METHOD_CHACHA20_POLY1305
+	case "xchacha20-poly1305":
+		auth.EncryptionMethod = mux.E_METHOD_XCHACHA20_POLY1305
+	case "aes-128-gcm":
+		auth.EncryptionMethod = mux.E_METHOD_AES_128_GCM
+	case "auto":
+		auth.EncryptionMethod = autoEncryptionMethod(hasAESHardware)
 	default:
 		err = fmt.Errorf("unknown encryption method %v", raw.EncryptionMethod)
 		return
@@ -176,30 +382,342 @@ func (raw *RawConfig) SplitConfigs(worldState common.WorldState) (local LocalCon
 		raw.NumConn = 0
 	}
 	remote.NumConn = raw.NumConn
+	if raw.WarmSessions < 0 {
+		err = errors.New("WarmSessions can't be negative")
+		return
+	}
+	remote.WarmSessions = raw.WarmSessions
+	if raw.ReconnectMaxDelay < 0 {
+		err = errors.New("ReconnectMaxDelay can't be negative")
+		return
+	}
+	if raw.ReconnectMaxDelay == 0 {
+		remote.Backoff = MakeBackoff(defaultReconnectMaxDelay)
+	} else {
+		remote.Backoff = MakeBackoff(max(time.Duration(raw.ReconnectMaxDelay)*time.Second, minReconnectDelay))
+	}
+	remote.ReconnectResolve = raw.ReconnectResolve
+	remote.StreamWindow = flowWindow(raw.StreamWindow, mux.DefaultStreamWindow)
+	remote.SessionWindow = flowWindow(raw.SessionWindow, mux.DefaultSessionWindow)
+	remote.UnreliableDatagrams = raw.UnreliableUDP
+
+	switch strings.ToLower(raw.Multipath) {
+	case "":
+		auth.Multipath = len(raw.MultipathAddrs) != 0
+	case "stripe":
+		auth.Multipath = true
+	case "duplicate":
+		auth.Multipath, auth.Duplicate = true, true
+	default:
+		err = fmt.Errorf("unknown Multipath %v", raw.Multipath)
+		return
+	}
+	remote.RemoteAddrs = []string{remote.RemoteAddr}
+	for _, addr := range raw.MultipathAddrs {
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			err = fmt.Errorf("bad address %v in MultipathAddrs: %v", addr, err)
+			return
+		}
+		remote.RemoteAddrs = append(remote.RemoteAddrs, addr)
+	}
+	edges, err := parseEdges(raw.CDNEdges, raw.RemotePort, worldState.Rand)
+	if err != nil {
+		return
+	}
+	if len(raw.Endpoints) != 0 || len(edges) != 0 {
+		if len(raw.MultipathAddrs) != 0 {
+			err = errors.New("Endpoints and CDNEdges can't be used with MultipathAddrs")
+			return
+		}
+		if raw.HealthCheckInterval < 0 {
+			err = errors.New("HealthCheckInterval can't be negative")
+			return
+		}
+		interval := defaultHealthCheckInterval
+		if raw.HealthCheckInterval > 0 {
+			interval = time.Duration(raw.HealthCheckInterval) * time.Second
+		}
+		remote.Endpoints, err = MakeEndpoints(remote.RemoteAddr, append(raw.Endpoints[:len(raw.Endpoints):len(raw.Endpoints)], edges...), interval, worldState)
+		if err != nil {
+			return
+		}
+	}
+	if len(edges) != 0 {
+		switch strings.ToLower(raw.Transport) {
+		case "cdn", "grpc", "h2":
+		default:
+			err = fmt.Errorf("CDNEdges can't be used with Transport %v", raw.Transport)
+			return
+		}
+		remote.Endpoints.probe = tlsProbe(raw.ServerName)
+	}
+	if auth.Multipath && remote.NumConn < len(remote.RemoteAddrs) {
+		err = fmt.Errorf("NumConn must be at least %v to have a connection to every address of Multipath", len(remote.RemoteAddrs))
+		return
+	}
+	if raw.ResumeGrace < 0 {
+		err = errors.New("ResumeGrace can't be negative")
+		return
+	}
+	if raw.ResumeGrace > 0 {
+		if raw.UDP {
+			err = errors.New("ResumeGrace can't be used with UDP")
+			return
+		}
+		remote.ResumeGrace = time.Duration(raw.ResumeGrace) * time.Second
+		auth.Resumable = true
+	}
+	if raw.RekeyInterval < 0 {
+		err = errors.New("RekeyInterval can't be negative")
+		return
+	}
+	if raw.RekeyInterval > 0 {
+		remote.RekeyInterval = time.Duration(raw.RekeyInterval) * time.Second
+		if remote.RekeyInterval < mux.MinRekeyInterval {
+			err = fmt.Errorf("RekeyInterval must be at least %v seconds", int(mux.MinRekeyInterval/time.Second))
+			return
+		}
+		// what a resumable session retains to send again is sealed with the keys of when it was first sent
+		if remote.ResumeGrace > 0 {
+			err = errors.New("RekeyInterval can't be used with ResumeGrace")
+			return
+		}
+		if auth.EncryptionMethod == mux.E_METHOD_PLAIN {
+			err = errors.New("RekeyInterval can't be used with EncryptionMethod plain")
+			return
+		}
+	}
+	if raw.KnockPort != "" {
+		if port, parseErr := strconv.Atoi(raw.KnockPort); parseErr != nil || port <= 0 || port > 65535 {
+			err = fmt.Errorf("bad KnockPort %v", raw.KnockPort)
+			return
+		}
+		remote.KnockPort = raw.KnockPort
+	}
+	if raw.Heartbeat < 0 || raw.Heartbeat > 255 {
+		err = errors.New("Heartbeat must be between 0 and 255 seconds")
+		return
+	}
+	auth.Heartbeat = time.Duration(raw.Heartbeat) * time.Second
+	auth.CloseReasons = true
+	auth.Compression = raw.Compression
+	if raw.EarlyData {
+		// every connection of a session would have its own early session key
+		if remote.NumConn > 1 || auth.Multipath {
+			err = errors.New("EarlyData can't be used with more than one connection per session")
+			return
+		}
+		switch strings.ToLower(raw.Transport) {
+		case "", "direct":
+		default:
+			err = fmt.Errorf("EarlyData can't be used with Transport %v", raw.Transport)
+			return
+		}
+		auth.EarlyData = true
+	}
+	switch strings.ToLower(raw.TrafficProfile) {
+	case "", "none":
+		auth.TrafficProfile = mux.PROFILE_NONE
+	case "browsing":
+		auth.TrafficProfile = mux.PROFILE_BROWSING
+	case "streaming":
+		auth.TrafficProfile = mux.PROFILE_STREAMING
+	default:
+		err = fmt.Errorf("unknown TrafficProfile %v", raw.TrafficProfile)
+		return
+	}
+	if raw.FECShards != "" {
+		_, err = fmt.Sscanf(raw.FECShards, "%d:%d", &auth.FECDataShards, &auth.FECParityShards)
+		if err != nil || auth.FECDataShards < 1 || auth.FECDataShards > mux.MaxFECShards ||
+			auth.FECParityShards < 1 || auth.FECParityShards > mux.MaxFECShards {
+			err = fmt.Errorf("FECShards %v isn't data:parity of 1 to %v each", raw.FECShards, mux.MaxFECShards)
+			return
+		}
+	}
+
+	switch strings.ToLower(raw.RecordSizing) {
+	case "", "full":
+		remote.RecordSizing = mux.RECORD_SIZING_FULL
+	case "dynamic":
+		remote.RecordSizing = mux.RECORD_SIZING_DYNAMIC
+	default:
+		err = fmt.Errorf("unknown RecordSizing %v", raw.RecordSizing)
+		return
+	}
+	switch strings.ToLower(raw.Transport) {
+	case "cdn", "grpc", "h2", "realtls", "doh":
+		// the records are made by the TLS library, which already sizes them dynamically
+		if remote.RecordSizing != mux.RECORD_SIZING_FULL {
+			err = fmt.Errorf("RecordSizing can't be set with Transport %v", raw.Transport)
+			return
+		}
+		if raw.SessionTickets {
+			err = fmt.Errorf("SessionTickets can't be used with Transport %v", raw.Transport)
+			return
+		}
+	}
+
+	// in the modes through a CDN, the Host of each connection is picked from these, while the SNI is ServerName
+	var frontingHosts []string
+	for _, host := range append([]string{raw.FrontingHost}, raw.FrontingHosts...) {
+		if host != "" {
+			frontingHosts = append(frontingHosts, host)
+		}
+	}
+	if len(frontingHosts) != 0 {
+		switch strings.ToLower(raw.Transport) {
+		case "cdn", "grpc", "h2":
+		default:
+			err = fmt.Errorf("FrontingHost can't be used with Transport %v", raw.Transport)
+			return
+		}
+	}
 
 	// Transport and (if TLS mode), browser
 	switch strings.ToLower(raw.Transport) {
 	case "cdn":
+		if raw.WSPath == "" {
+			raw.WSPath = "/"
+		}
+		if !strings.HasPrefix(raw.WSPath, "/") {
+			err = fmt.Errorf("WSPath %v doesn't start with /", raw.WSPath)
+			return
+		}
+		header := http.Header{}
+		for k, v := range raw.WSHeaders {
+			if !isAllowedWSHeader(k) {
+				err = fmt.Errorf("WSHeaders can't set %v", k)
+				return
+			}
+			if len(frontingHosts) != 0 && http.CanonicalHeaderKey(k) == "Host" {
+				err = errors.New("WSHeaders can't set Host with FrontingHost")
+				return
+			}
+			header.Set(k, v)
+		}
 		remote.TransportMaker = func() Transport {
 			return &WSOverTLS{
 				cdnDomainPort: remote.RemoteAddr,
+				path:          raw.WSPath,
+				hosts:         frontingHosts,
+				header:        header,
+				userAgents:    raw.WSUserAgents,
+			}
+		}
+	case "grpc":
+		if raw.GRPCPath == "" {
+			return nullErr("GRPCPath")
+		}
+		remote.TransportMaker = func() Transport {
+			return &GRPCOverTLS{
+				cdnDomainPort: remote.RemoteAddr,
+				path:          raw.GRPCPath,
+				hosts:         frontingHosts,
+			}
+		}
+	case "h2":
+		if raw.H2Path == "" {
+			return nullErr("H2Path")
+		}
+		if !strings.HasPrefix(raw.H2Path, "/") {
+			err = fmt.Errorf("H2Path %v doesn't start with /", raw.H2Path)
+			return
+		}
+		helloID, ok := common.Parrots[strings.ToLower(raw.BrowserSig)]
+		if !ok {
+			helloID = common.Parrots["chrome"]
+		}
+		remote.TransportMaker = func() Transport {
+			return &HTTP2OverTLS{
+				remoteDomainPort: remote.RemoteAddr,
+				path:             raw.H2Path,
+				hosts:            frontingHosts,
+				helloID:          helloID,
+			}
+		}
+	case "doh":
+		if raw.DoHDomain == "" {
+			return nullErr("DoHDomain")
+		}
+		if common.MaxDNSQueryData(raw.DoHDomain) < 1 {
+			err = fmt.Errorf("DoHDomain %v is too long", raw.DoHDomain)
+			return
+		}
+		if raw.DoHPath == "" {
+			raw.DoHPath = "/dns-query"
+		}
+		if !strings.HasPrefix(raw.DoHPath, "/") {
+			err = fmt.Errorf("DoHPath %v doesn't start with /", raw.DoHPath)
+			return
+		}
+		helloID, ok := common.Parrots[strings.ToLower(raw.BrowserSig)]
+		if !ok {
+			helloID = common.Parrots["chrome"]
+		}
+		remote.TransportMaker = func() Transport {
+			return &DoH{
+				remoteDomainPort: remote.RemoteAddr,
+				path:             raw.DoHPath,
+				domain:           raw.DoHDomain,
+				helloID:          helloID,
 			}
 		}
+	case "realtls":
+		helloID, ok := common.Parrots[strings.ToLower(raw.BrowserSig)]
+		if !ok {
+			helloID = common.Parrots["chrome"]
+		}
+		remote.TransportMaker = func() Transport {
+			return &RealTLS{helloID: helloID}
+		}
 	case "direct":
 		fallthrough
 	default:
-		var browser browser
-		switch strings.ToLower(raw.BrowserSig) {
-		case "firefox":
-			browser = &Firefox{}
-		case "chrome":
-			fallthrough
-		default:
-			browser = &Chrome{}
+		helloID, ok := common.Parrots[strings.ToLower(raw.BrowserSig)]
+		if !ok {
+			helloID = common.Parrots["chrome"]
+		}
+		var browser browser = &Parrot{helloID: helloID}
+		var echConf *echConfig
+		if len(raw.ECHConfig) != 0 {
+			echConf, err = parseECHConfigList(raw.ECHConfig)
+			if err != nil {
+				err = fmt.Errorf("failed to parse ECHConfig: %v", err)
+				return
+			}
+			// fail now rather than on every connection if the browser doesn't send ECH
+			_, err = browser.composeClientHello(clientHelloFields{
+				random:          make([]byte, 32),
+				sessionId:       make([]byte, 32),
+				x25519KeyShare:  make([]byte, 32),
+				serverName:      echConf.publicName,
+				echConfig:       echConf,
+				innerServerName: raw.ServerName,
+			})
+			if err != nil {
+				err = fmt.Errorf("ECHConfig can't be used with BrowserSig %v: %v", raw.BrowserSig, err)
+				return
+			}
+		}
+		// the key exchange is made hybrid with ML-KEM if the browser sends an X25519MLKEM768 key share
+		_, pqErr := browser.composeClientHello(clientHelloFields{
+			random:         make([]byte, 32),
+			sessionId:      make([]byte, 32),
+			x25519KeyShare: make([]byte, 32),
+			serverName:     raw.ServerName,
+			mlkemKeyShare:  make([]byte, ecdh.MLKEMEncapsulationKeySize),
+		})
+		postQuantum := pqErr == nil
+		var tickets *sessionTickets
+		if raw.SessionTickets {
+			tickets = &sessionTickets{length: common.SessionTicketLength(ecdh.Marshal(auth.ServerPubKey))}
 		}
 		remote.TransportMaker = func() Transport {
 			return &DirectTLS{
-				browser: browser,
+				browser:     browser,
+				echConfig:   echConf,
+				postQuantum: postQuantum,
+				tickets:     tickets,
 			}
 		}
 	}
@@ -224,6 +742,99 @@ func (raw *RawConfig) SplitConfigs(worldState common.WorldState) (local LocalCon
 	} else {
 		local.Timeout = time.Duration(raw.StreamTimeout) * time.Second
 	}
+	local.UDPRelay = raw.UDPRelay
+	if raw.QuotaAddr != "" {
+		if _, _, err = net.SplitHostPort(raw.QuotaAddr); err != nil {
+			err = fmt.Errorf("bad QuotaAddr: %v", err)
+			return
+		}
+		local.QuotaAddr = raw.QuotaAddr
+		remote.Quota = &QuotaWatcher{}
+	}
+	if raw.StatsAddr != "" {
+		if !strings.HasPrefix(raw.StatsAddr, "unix:") {
+			if _, _, err = net.SplitHostPort(raw.StatsAddr); err != nil {
+				err = fmt.Errorf("bad StatsAddr: %v", err)
+				return
+			}
+		}
+		local.StatsAddr = raw.StatsAddr
+		valve := &mux.CountingValve{}
+		remote.Valve = valve
+		remote.Stats = MakeStats(valve)
+	}
+	remote.ServerListPath = raw.ServerListPath
+	remote.PreferIPv4 = raw.PreferIPv4
+	remote.Binding, err = raw.SocketBinding()
+	if err != nil {
+		return
+	}
+	if raw.ResolverURL != "" {
+		remote.Resolver, err = MakeResolver(raw.ResolverURL, worldState)
+		if err != nil {
+			return
+		}
+	}
+	if raw.UDPTimeout < 0 {
+		err = errors.New("UDPTimeout can't be negative")
+		return
+	}
+	if raw.UDPTimeout == 0 {
+		local.UDPTimeout = 60 * time.Second
+	} else {
+		local.UDPTimeout = time.Duration(raw.UDPTimeout) * time.Second
+	}
+	switch strings.ToLower(raw.LocalProxy) {
+	case "":
+	case "socks5", "http", "redirect", "tproxy", "tun":
+		if raw.UDP {
+			err = errors.New("LocalProxy can't be used with UDP")
+			return
+		}
+		local.LocalProxy = strings.ToLower(raw.LocalProxy)
+	default:
+		err = fmt.Errorf("unknown LocalProxy %v", raw.LocalProxy)
+		return
+	}
+	if local.LocalProxy == "tun" {
+		local.TUNName = raw.TUNName
+		if local.TUNName == "" {
+			local.TUNName = "cloak0"
+		}
+		if raw.TUNAddr == "" {
+			raw.TUNAddr = "198.18.0.1/16"
+		}
+		var ip net.IP
+		ip, local.TUNNet, err = net.ParseCIDR(raw.TUNAddr)
+		if err != nil {
+			err = fmt.Errorf("failed to parse TUNAddr: %v", err)
+			return
+		}
+		local.TUNNet.IP = ip.To4()
+		if _, err = tunNATAddr(local.TUNNet); err != nil {
+			return
+		}
+		local.TUNMTU = raw.TUNMTU
+		if local.TUNMTU == 0 {
+			local.TUNMTU = 1500
+		}
+		if local.TUNMTU < 576 || local.TUNMTU > 65535 {
+			err = fmt.Errorf("bad TUNMTU %v", raw.TUNMTU)
+			return
+		}
+	}
 
 	return
 }
+
+// flowWindow is the window of flow control configured as raw, which is def if it's 0 and not limited if it's negative
+func flowWindow(raw int, def int) int {
+	switch {
+	case raw == 0:
+		return def
+	case raw < 0:
+		return 0
+	default:
+		return raw
+	}
+}
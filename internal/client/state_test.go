@@ -2,7 +2,17 @@ package client
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
 
 func TestSSVtoJson(t *testing.T) {
@@ -18,3 +28,669 @@ func TestSSVtoJson(t *testing.T) {
 	}
 
 }
+
+func TestIsAllowedWSHeader(t *testing.T) {
+	for _, key := range []string{"Cookie", "user-agent", "Origin", "Host"} {
+		if !isAllowedWSHeader(key) {
+			t.Errorf("%v should be allowed", key)
+		}
+	}
+	for _, key := range []string{"Upgrade", "connection", "Sec-WebSocket-Key", "hidden"} {
+		if isAllowedWSHeader(key) {
+			t.Errorf("%v shouldn't be allowed", key)
+		}
+	}
+}
+
+func validRawConfig() RawConfig {
+	pub, _ := base64.StdEncoding.DecodeString("IYoUzkle/T/kriE+Ufdm7AHQtIeGnBWbhhlTbmDpUUI=")
+	return RawConfig{
+		ServerName:       "www.bing.com",
+		ProxyMethod:      "shadowsocks",
+		EncryptionMethod: "plain",
+		UID:              make([]byte, 16),
+		PublicKey:        pub,
+		NumConn:          4,
+		LocalHost:        "127.0.0.1",
+		LocalPort:        "1984",
+		RemoteHost:       "192.0.2.1",
+		RemotePort:       "443",
+	}
+}
+
+func TestSplitConfigs_Multipath(t *testing.T) {
+	raw := validRawConfig
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	t.Run("addresses imply stripe", func(t *testing.T) {
+		config := raw()
+		config.MultipathAddrs = []string{"192.0.2.2:443", "192.0.2.3:8443"}
+		_, remote, auth, err := config.SplitConfigs(worldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !auth.Multipath || auth.Duplicate {
+			t.Errorf("expecting stripe, got Multipath %v Duplicate %v", auth.Multipath, auth.Duplicate)
+		}
+		expected := []string{"192.0.2.1:443", "192.0.2.2:443", "192.0.2.3:8443"}
+		if fmt.Sprint(remote.RemoteAddrs) != fmt.Sprint(expected) {
+			t.Errorf("expecting addresses %v, got %v", expected, remote.RemoteAddrs)
+		}
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		config := raw()
+		config.Multipath = "duplicate"
+		_, _, auth, err := config.SplitConfigs(worldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !auth.Multipath || !auth.Duplicate {
+			t.Errorf("expecting duplicate, got Multipath %v Duplicate %v", auth.Multipath, auth.Duplicate)
+		}
+	})
+
+	t.Run("bad", func(t *testing.T) {
+		for name, modify := range map[string]func(*RawConfig){
+			"unknown policy":  func(c *RawConfig) { c.Multipath = "broadcast" },
+			"bad address":     func(c *RawConfig) { c.MultipathAddrs = []string{"192.0.2.2"} },
+			"too few NumConn": func(c *RawConfig) { c.NumConn = 1; c.MultipathAddrs = []string{"192.0.2.2:443"} },
+		} {
+			config := raw()
+			modify(&config)
+			if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+				t.Errorf("%v: expecting an error", name)
+			}
+		}
+	})
+}
+
+func TestSplitConfigs_ResumeGrace(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	_, remote, auth, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Resumable || remote.ResumeGrace != 0 {
+		t.Error("session resumable by default")
+	}
+
+	config.ResumeGrace = 30
+	_, remote, auth, err = config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.Resumable || remote.ResumeGrace != 30*time.Second {
+		t.Errorf("expecting a resumable session with 30s grace, got %v and %v", auth.Resumable, remote.ResumeGrace)
+	}
+
+	config.UDP = true
+	if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for ResumeGrace with UDP")
+	}
+	config = validRawConfig()
+	config.ResumeGrace = -1
+	if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for a negative ResumeGrace")
+	}
+}
+
+func TestSplitConfigs_KnockPort(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.KnockPort = "62201"
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.KnockPort != "62201" {
+		t.Errorf("expecting KnockPort 62201, got %v", remote.KnockPort)
+	}
+
+	for _, port := range []string{"knock", "0", "65536"} {
+		config.KnockPort = port
+		if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+			t.Errorf("expecting an error for KnockPort %v", port)
+		}
+	}
+}
+
+func TestSplitConfigs_EncryptionMethodAuto(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	if method := autoEncryptionMethod(true); method != mux.E_METHOD_AES_GCM {
+		t.Errorf("expecting aes-gcm with AES hardware, got %v", method)
+	}
+	if method := autoEncryptionMethod(false); method != mux.E_METHOD_CHACHA20_POLY1305 {
+		t.Errorf("expecting chacha20-poly1305 without AES hardware, got %v", method)
+	}
+
+	config := validRawConfig()
+	config.EncryptionMethod = "auto"
+	_, _, auth, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.EncryptionMethod != autoEncryptionMethod(hasAESHardware) {
+		t.Errorf("expecting the encryption method of this CPU, got %v", auth.EncryptionMethod)
+	}
+}
+
+func TestSplitConfigs_WarmSessions(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.WarmSessions = 2
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.WarmSessions != 2 {
+		t.Errorf("expecting 2 warm sessions, got %v", remote.WarmSessions)
+	}
+
+	config.WarmSessions = -1
+	if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for negative WarmSessions")
+	}
+}
+
+func TestSplitConfigs_ReconnectMaxDelay(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Backoff == nil || remote.Backoff.max != defaultReconnectMaxDelay {
+		t.Errorf("expecting the default ReconnectMaxDelay, got %+v", remote.Backoff)
+	}
+
+	config.ReconnectMaxDelay = 10
+	if _, remote, _, err = config.SplitConfigs(worldState); err != nil {
+		t.Fatal(err)
+	}
+	if remote.Backoff.max != 10*time.Second {
+		t.Errorf("expecting 10s, got %v", remote.Backoff.max)
+	}
+
+	config.ReconnectMaxDelay = -1
+	if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for negative ReconnectMaxDelay")
+	}
+}
+
+func TestSplitConfigs_Endpoints(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Endpoints != nil {
+		t.Error("Endpoints made without any")
+	}
+
+	config.Endpoints = []string{"backup.com:443@2", ":8443"}
+	if _, remote, _, err = config.SplitConfigs(worldState); err != nil {
+		t.Fatal(err)
+	}
+	if len(remote.Endpoints.endpoints) != 3 || remote.Endpoints.endpoints[0].addr != remote.RemoteAddr {
+		t.Errorf("unexpected endpoints %+v", remote.Endpoints.endpoints)
+	}
+	if remote.Endpoints.interval != defaultHealthCheckInterval {
+		t.Errorf("expecting the default HealthCheckInterval, got %v", remote.Endpoints.interval)
+	}
+
+	bad := map[string]func(*RawConfig){
+		"negative HealthCheckInterval": func(raw *RawConfig) { raw.HealthCheckInterval = -1 },
+		"with MultipathAddrs":          func(raw *RawConfig) { raw.MultipathAddrs = []string{"backup.com:443"} },
+		"bad weight":                   func(raw *RawConfig) { raw.Endpoints = []string{"backup.com:443@0"} },
+	}
+	for name, mutate := range bad {
+		config := validRawConfig()
+		config.Endpoints = []string{":8443"}
+		mutate(&config)
+		if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+			t.Errorf("%v: expecting an error", name)
+		}
+	}
+}
+
+func TestSplitConfigs_CDNEdges(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.Transport = "cdn"
+	config.CDNEdges = []string{"104.16.1.1", "104.16.2.0/30"}
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Endpoints == nil || len(remote.Endpoints.endpoints) != 5 || remote.Endpoints.probe == nil {
+		t.Fatalf("unexpected endpoints %+v", remote.Endpoints)
+	}
+	if remote.Endpoints.endpoints[1].addr != net.JoinHostPort("104.16.1.1", config.RemotePort) {
+		t.Errorf("expecting the edges on RemotePort, got %v", remote.Endpoints.endpoints[1].addr)
+	}
+
+	config.Transport = "direct"
+	if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for CDNEdges with Transport direct")
+	}
+}
+
+func TestSplitConfigs_EarlyData(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.NumConn = 1
+	config.EarlyData = true
+	_, _, auth, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.EarlyData {
+		t.Error("EarlyData isn't set")
+	}
+
+	bad := map[string]func(*RawConfig){
+		"NumConn":   func(raw *RawConfig) { raw.NumConn = 4 },
+		"Multipath": func(raw *RawConfig) { raw.Multipath = "stripe" },
+		"Transport": func(raw *RawConfig) { raw.Transport = "CDN" },
+	}
+	for name, change := range bad {
+		t.Run(name, func(t *testing.T) {
+			config := validRawConfig()
+			config.NumConn = 1
+			config.EarlyData = true
+			change(&config)
+			if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+				t.Error("expecting an error")
+			}
+		})
+	}
+}
+
+func TestSplitConfigs_SessionTickets(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.SessionTickets = true
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tickets := remote.TransportMaker().(*DirectTLS).tickets
+	if tickets == nil || tickets.length != common.SessionTicketLength(config.PublicKey) {
+		t.Errorf("unexpected session tickets %+v", tickets)
+	}
+	// the connections of a session share them
+	if remote.TransportMaker().(*DirectTLS).tickets != tickets {
+		t.Error("session tickets aren't shared")
+	}
+
+	config.Transport = "realtls"
+	if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for SessionTickets with realtls")
+	}
+}
+
+func TestSplitConfigs_H2Path(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.Transport = "h2"
+	config.H2Path = "/upload"
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transport := remote.TransportMaker().(*HTTP2OverTLS); transport.path != config.H2Path {
+		t.Errorf("expecting path %v, got %v", config.H2Path, transport.path)
+	}
+
+	for _, path := range []string{"", "upload"} {
+		config.H2Path = path
+		if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+			t.Errorf("expecting an error for H2Path %q", path)
+		}
+	}
+}
+
+func TestSplitConfigs_FrontingHost(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.Transport = "cdn"
+	config.FrontingHost = "hidden.example.com"
+	config.FrontingHosts = []string{"", "other.example.com"}
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []string{"hidden.example.com", "other.example.com"}
+	if transport := remote.TransportMaker().(*WSOverTLS); !reflect.DeepEqual(transport.hosts, hosts) {
+		t.Errorf("expecting hosts %v, got %v", hosts, transport.hosts)
+	}
+
+	config.Transport = "grpc"
+	config.GRPCPath = "/stream.Service/Tunnel"
+	if _, remote, _, err = config.SplitConfigs(worldState); err != nil {
+		t.Fatal(err)
+	}
+	if transport := remote.TransportMaker().(*GRPCOverTLS); !reflect.DeepEqual(transport.hosts, hosts) {
+		t.Errorf("expecting hosts %v, got %v", hosts, transport.hosts)
+	}
+
+	t.Run("Host in WSHeaders", func(t *testing.T) {
+		config := config
+		config.Transport = "cdn"
+		config.WSHeaders = map[string]string{"host": "x.example.com"}
+		if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("direct", func(t *testing.T) {
+		config := config
+		config.Transport = "direct"
+		if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func TestSplitConfigs_ResolverURL(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.ResolverURL = "tls://dns.quad9.net"
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Resolver == nil || remote.Resolver.url.Host != "dns.quad9.net:853" {
+		t.Errorf("unexpected resolver %+v", remote.Resolver)
+	}
+
+	config.ResolverURL = "udp://9.9.9.9"
+	if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error")
+	}
+}
+
+func TestRawConfig_SocketBinding(t *testing.T) {
+	config := validRawConfig()
+	config.SourceIP = "192.0.2.1"
+	binding, err := config.SocketBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !binding.SourceIP.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("expecting SourceIP 192.0.2.1, got %v", binding.SourceIP)
+	}
+
+	for name, bad := range map[string]RawConfig{
+		"bad SourceIP":    {SourceIP: "192.0.2"},
+		"negative FwMark": {FwMark: -1},
+	} {
+		if _, err := bad.SocketBinding(); err == nil {
+			t.Errorf("%v: expecting an error", name)
+		}
+	}
+}
+
+func TestSplitConfigs_DoH(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.Transport = "doh"
+	config.RemoteHost = "dns.example.net"
+	config.DoHDomain = "t.example.com"
+	config.ServerListPath = "servers.json"
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := remote.TransportMaker().(*DoH)
+	if transport.path != "/dns-query" || transport.domain != config.DoHDomain {
+		t.Errorf("unexpected transport %+v", transport)
+	}
+	if remote.ServerListPath != config.ServerListPath {
+		t.Errorf("expecting ServerListPath %v, got %v", config.ServerListPath, remote.ServerListPath)
+	}
+
+	bad := map[string]func(*RawConfig){
+		"no DoHDomain":       func(raw *RawConfig) { raw.DoHDomain = "" },
+		"DoHDomain too long": func(raw *RawConfig) { raw.DoHDomain = strings.Repeat("a.", 120) },
+		"DoHPath":            func(raw *RawConfig) { raw.DoHPath = "dns-query" },
+		"RecordSizing":       func(raw *RawConfig) { raw.RecordSizing = "dynamic" },
+	}
+	for name, change := range bad {
+		t.Run(name, func(t *testing.T) {
+			config := validRawConfig()
+			config.Transport = "doh"
+			config.DoHDomain = "t.example.com"
+			change(&config)
+			if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+				t.Error("expecting an error")
+			}
+		})
+	}
+}
+
+func TestSplitConfigs_Heartbeat(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	_, _, auth, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Heartbeat != 0 {
+		t.Errorf("expecting no heartbeat by default, got %v", auth.Heartbeat)
+	}
+
+	config.Heartbeat = 30
+	_, _, auth, err = config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.Heartbeat != 30*time.Second {
+		t.Errorf("expecting a heartbeat of 30s, got %v", auth.Heartbeat)
+	}
+
+	for _, bad := range []int{-1, 256} {
+		config.Heartbeat = bad
+		if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+			t.Errorf("%v: expecting an error", bad)
+		}
+	}
+}
+
+func TestSplitConfigs_RekeyInterval(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.EncryptionMethod = "aes-gcm"
+	config.RekeyInterval = 3600
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.RekeyInterval != time.Hour {
+		t.Errorf("expecting a RekeyInterval of 1h, got %v", remote.RekeyInterval)
+	}
+
+	for name, bad := range map[string]func(*RawConfig){
+		"negative":  func(c *RawConfig) { c.RekeyInterval = -1 },
+		"too short": func(c *RawConfig) { c.RekeyInterval = 60 },
+		"resumable": func(c *RawConfig) { c.ResumeGrace = 30 },
+		"plain":     func(c *RawConfig) { c.EncryptionMethod = "plain" },
+	} {
+		config := validRawConfig()
+		config.EncryptionMethod = "aes-gcm"
+		config.RekeyInterval = 3600
+		bad(&config)
+		if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+			t.Errorf("%v: expecting an error", name)
+		}
+	}
+}
+
+func TestSplitConfigs_TrafficProfile(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	for name, expected := range map[string]byte{"": mux.PROFILE_NONE, "none": mux.PROFILE_NONE, "Browsing": mux.PROFILE_BROWSING, "streaming": mux.PROFILE_STREAMING} {
+		config.TrafficProfile = name
+		_, _, auth, err := config.SplitConfigs(worldState)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if auth.TrafficProfile != expected {
+			t.Errorf("%v: expecting profile %v, got %v", name, expected, auth.TrafficProfile)
+		}
+	}
+
+	config.TrafficProfile = "gaming"
+	if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for an unknown profile")
+	}
+}
+
+func TestSplitConfigs_RecordSizing(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	for name, expected := range map[string]byte{"": mux.RECORD_SIZING_FULL, "full": mux.RECORD_SIZING_FULL, "Dynamic": mux.RECORD_SIZING_DYNAMIC} {
+		config.RecordSizing = name
+		_, remote, _, err := config.SplitConfigs(worldState)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if remote.RecordSizing != expected {
+			t.Errorf("%v: expecting sizing %v, got %v", name, expected, remote.RecordSizing)
+		}
+	}
+
+	config.RecordSizing = "tiny"
+	if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for an unknown sizing")
+	}
+
+	config.RecordSizing = "dynamic"
+	config.Transport = "cdn"
+	if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for dynamic sizing in CDN mode")
+	}
+}
+
+func TestSplitConfigs_QuotaAddr(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	local, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.QuotaAddr != "" || remote.Quota != nil {
+		t.Error("quota watched without QuotaAddr")
+	}
+
+	config.QuotaAddr = "127.0.0.1:1985"
+	local, remote, _, err = config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.QuotaAddr != config.QuotaAddr || remote.Quota == nil {
+		t.Error("quota not watched with QuotaAddr")
+	}
+
+	config.QuotaAddr = "1985"
+	if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for a QuotaAddr without a host")
+	}
+}
+
+func TestSplitConfigs_StatsAddr(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	_, remote, _, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Stats != nil || remote.Valve != nil {
+		t.Error("stats counted without StatsAddr")
+	}
+
+	for _, addr := range []string{"127.0.0.1:1986", "unix:/run/ck-client/stats.sock"} {
+		config.StatsAddr = addr
+		local, remote, _, err := config.SplitConfigs(worldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if local.StatsAddr != addr || remote.Stats == nil || remote.Valve == nil {
+			t.Errorf("stats not counted with StatsAddr %v", addr)
+		}
+	}
+
+	config.StatsAddr = "1986"
+	if _, _, _, err := config.SplitConfigs(worldState); err == nil {
+		t.Error("expecting an error for a StatsAddr without a host")
+	}
+}
+
+func TestSplitConfigs_FECShards(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	config := validRawConfig()
+	config.FECShards = "10:3"
+	_, _, auth, err := config.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.FECDataShards != 10 || auth.FECParityShards != 3 {
+		t.Errorf("expecting 10:3 shards, got %v:%v", auth.FECDataShards, auth.FECParityShards)
+	}
+
+	for _, bad := range []string{"10", "10:0", "0:3", "129:3", "a:b"} {
+		config.FECShards = bad
+		if _, _, _, err = config.SplitConfigs(worldState); err == nil {
+			t.Errorf("%v: expecting an error", bad)
+		}
+	}
+}
+
+func TestParseConfig_Environment(t *testing.T) {
+	os.Setenv("CK_CLIENT_UID", "5nneblJy6lniPJfr81LuYQ==")
+	os.Setenv("CK_CLIENT_NUMCONN", "8")
+	defer os.Unsetenv("CK_CLIENT_UID")
+	defer os.Unsetenv("CK_CLIENT_NUMCONN")
+
+	raw, err := ParseConfig("ServerName=www.bing.com;NumConn=4;UID=iGAO85zysIyR4c09CyZSLdNhtP/ckcYu7nIPI082AHA=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.ServerName != "www.bing.com" || raw.NumConn != 8 || len(raw.UID) != 16 {
+		t.Errorf("the environment isn't taken over the options: %+v", raw)
+	}
+
+	raw, err = ParseConfig("")
+	if err != nil || raw.NumConn != 8 {
+		t.Errorf("the configuration isn't read from the environment alone: %+v %v", raw, err)
+	}
+
+	os.Setenv("CK_CLIENT_NUMCONN", "eight")
+	if _, err = ParseConfig(""); err == nil {
+		t.Error("expecting an error for a bad NumConn")
+	}
+}
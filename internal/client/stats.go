@@ -0,0 +1,131 @@
+package client
+
+// With StatsAddr, what the sessions have sent and received, how fast, the streams open in them and the server they're
+// connected to are served on StatsAddr in JSON, for GUI clients and status bars to poll. StatsAddr is an ip:port, or a
+// Unix socket as unix:/path/to/socket
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
+
+// the shortest time the rates are worked out over. Polled more often, they're those of the last time they were
+const statsRateWindow = time.Second
+
+// ClientStats is what the client has done as of when it's served
+type ClientStats struct {
+	// bytes sent to and received from the server since the client started
+	Sent     int64
+	Received int64
+	// bytes per second sent and received since the rates were last worked out
+	SendRate    int64
+	ReceiveRate int64
+	Sessions    int
+	// the streams open in the sessions, not counting their control streams
+	Streams int
+	// the address of the server the last connection was made to, empty until one has been
+	Endpoint string
+}
+
+// Stats counts what the sessions made with it as their RemoteConnConfig do
+type Stats struct {
+	valve *mux.CountingValve
+
+	m        sync.Mutex
+	sessions []*mux.Session
+	endpoint string
+	// the traffic as of when the rates were last worked out, and the rates then
+	sampled               time.Time
+	sampledTx, sampledRx  int64
+	sendRate, receiveRate int64
+}
+
+// MakeStats makes a Stats that counts the traffic through valve, which must be the Valve of the sessions
+func MakeStats(valve *mux.CountingValve) *Stats {
+	return &Stats{valve: valve, sampled: time.Now()}
+}
+
+// connected records that a connection has been made to remoteAddr. Nothing is recorded on nil
+func (s *Stats) connected(remoteAddr string) {
+	if s == nil {
+		return
+	}
+	s.m.Lock()
+	s.endpoint = remoteAddr
+	s.m.Unlock()
+}
+
+// track counts the streams of sesh until it's closed. Nothing is tracked on nil
+func (s *Stats) track(sesh *mux.Session) {
+	if s == nil {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.sessions = append(s.openSessions(), sesh)
+}
+
+// openSessions returns the tracked sessions that haven't closed. s.m must be held
+func (s *Stats) openSessions() []*mux.Session {
+	open := s.sessions[:0]
+	for _, sesh := range s.sessions {
+		if !sesh.IsClosed() {
+			open = append(open, sesh)
+		}
+	}
+	return open
+}
+
+// Stats returns what the client has done up to now
+func (s *Stats) Stats() ClientStats {
+	s.m.Lock()
+	defer s.m.Unlock()
+	tx, rx := s.valve.GetTx(), s.valve.GetRx()
+	if elapsed := time.Since(s.sampled); elapsed >= statsRateWindow {
+		s.sendRate = int64(float64(tx-s.sampledTx) / elapsed.Seconds())
+		s.receiveRate = int64(float64(rx-s.sampledRx) / elapsed.Seconds())
+		s.sampled, s.sampledTx, s.sampledRx = time.Now(), tx, rx
+	}
+
+	s.sessions = s.openSessions()
+	stats := ClientStats{
+		Sent:        tx,
+		Received:    rx,
+		SendRate:    s.sendRate,
+		ReceiveRate: s.receiveRate,
+		Sessions:    len(s.sessions),
+		Endpoint:    s.endpoint,
+	}
+	for _, sesh := range s.sessions {
+		for _, stream := range sesh.Streams() {
+			if stream.Type != "control" {
+				stats.Streams++
+			}
+		}
+	}
+	return stats
+}
+
+// StatsHandler serves the stats of s on /stats
+func StatsHandler(s *Stats) http.Handler {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.Stats())
+	})
+	return serveMux
+}
+
+// ListenStats listens on StatsAddr, which is a Unix socket if it's prefixed with unix:
+func ListenStats(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	return net.Listen("tcp", addr)
+}
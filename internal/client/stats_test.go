@@ -0,0 +1,64 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/connutil"
+)
+
+func TestStats(t *testing.T) {
+	valve := &mux.CountingValve{}
+	stats := MakeStats(valve)
+	obfuscator, _ := mux.MakeObfuscator(mux.E_METHOD_PLAIN, [32]byte{})
+	clientSession := mux.MakeSession(1, mux.SessionConfig{Obfuscator: obfuscator, Valve: valve})
+	serverSession := mux.MakeSession(1, mux.SessionConfig{Obfuscator: obfuscator})
+	defer clientSession.Close()
+	c, s := connutil.AsyncPipe()
+	clientSession.AddConnection(&common.TLSConn{Conn: c})
+	serverSession.AddConnection(&common.TLSConn{Conn: s})
+
+	stats.connected("example.com:443")
+	stats.track(clientSession)
+	if _, err := clientSession.OpenControlStream(); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := clientSession.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	// so that the rates are worked out
+	stats.sampled = stats.sampled.Add(-statsRateWindow)
+
+	handler := StatsHandler(stats)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var got ClientStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Sent < 1000 || got.SendRate == 0 || got.Sessions != 1 || got.Streams != 1 || got.Endpoint != "example.com:443" {
+		t.Errorf("unexpected stats %+v", got)
+	}
+
+	clientSession.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for stats.Stats().Sessions != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed session is still counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var none *Stats
+	none.connected("example.com:443")
+	none.track(clientSession)
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// As a transparent proxy, e.g. on a router, ck-client is handed connections by the firewall rather than by the
+// applications making them. With REDIRECT, their destinations are changed to ck-client, and the original ones are
+// kept by netfilter in SO_ORIGINAL_DST. With TPROXY, which needs ck-client to listen with ListenTransparent, they are
+// accepted as they are, so their local addresses are their destinations. Either way, ck-client's own connections to
+// the Cloak server must be left out of the rules
+
+var errNotRedirected = errors.New("connection wasn't redirected to us")
+
+// transparentTarget is where a connection handed to us by the firewall was going
+func transparentTarget(conn net.Conn, listenAddr net.Addr, tproxy bool) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errNotRedirected
+	}
+	if !tproxy {
+		return originalDst(tcpConn)
+	}
+	// a connection made to us directly would go round in a loop
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if local.Port == listenAddr.(*net.TCPAddr).Port && isHostIP(local.IP) {
+		return "", errNotRedirected
+	}
+	return local.String(), nil
+}
+
+// isHostIP checks if ip is an address of this host
+func isHostIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeTransparent carries the connections that the firewall REDIRECTs, or TPROXYs if tproxy, to listener to their
+// original destinations. It returns when listener fails to accept
+func ServeTransparent(listener net.Listener, tproxy bool, streamTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) error {
+	var sesh *mux.Session
+	for {
+		localConn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !useSessionPerConnection && !reusable(sesh) {
+			sesh = newSeshFunc()
+		}
+		connectionSession := sesh
+		go func() {
+			target, err := transparentTarget(localConn, listener.Addr(), tproxy)
+			if err != nil {
+				log.Errorf("Failed to get the original destination of %v: %v", localConn.RemoteAddr(), err)
+				localConn.Close()
+				return
+			}
+			stream, err := OpenTargetStream(target, connectionSession, newSeshFunc, useSessionPerConnection)
+			if err != nil {
+				log.Errorf("Failed to open stream to %v: %v", target, err)
+				localConn.Close()
+				return
+			}
+			pipeLocal(localConn, stream, streamTimeout)
+		}()
+	}
+}
@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h and linux/in6.h
+const (
+	soOriginalDst     = 80
+	ip6tSoOriginalDst = 80
+	ipv6Transparent   = 75
+)
+
+// originalDst gets the destination of a connection before it was REDIRECTed to us
+func originalDst(conn *net.TCPConn) (target string, err error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+	ctrlErr := rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			// the sockaddr_in6 is the first field of ip6_mtuinfo. Its port is in network byte order
+			var info *syscall.IPv6MTUInfo
+			info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tSoOriginalDst)
+			if err == nil {
+				port := binary.BigEndian.Uint16((*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:])
+				target = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port)))
+			}
+			return
+		}
+		// the sockaddr_in fits in the 16 bytes of ipv6_mreq
+		var mreq *syscall.IPv6Mreq
+		mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+		if err == nil {
+			port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			target = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(int(port)))
+		}
+	})
+	if ctrlErr != nil {
+		return "", ctrlErr
+	}
+	return target, err
+}
+
+// ListenTransparent listens on addr with IP_TRANSPARENT, so that connections TPROXY'd to it are accepted with their
+// original destinations as their local addresses. It needs CAP_NET_ADMIN
+func ListenTransparent(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		ctrlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			if err == nil && network == "tcp6" {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			}
+		})
+		if ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
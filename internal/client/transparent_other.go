@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxying is only supported on Linux")
+
+func originalDst(*net.TCPConn) (string, error) { return "", errTransparentUnsupported }
+
+func ListenTransparent(string) (net.Listener, error) { return nil, errTransparentUnsupported }
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTransparentTarget(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	clientConn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	conn := <-accepted
+	defer conn.Close()
+
+	// connections made to us directly have no original destination
+	t.Run("redirect", func(t *testing.T) {
+		if target, err := transparentTarget(conn, l.Addr(), false); err == nil {
+			t.Errorf("direct connection goes to %v", target)
+		}
+	})
+	t.Run("tproxy", func(t *testing.T) {
+		if target, err := transparentTarget(conn, l.Addr(), true); err != errNotRedirected {
+			t.Errorf("expecting %v, got %v, %v", errNotRedirected, target, err)
+		}
+	})
+}
+
+func TestListenTransparent(t *testing.T) {
+	l, err := ListenTransparent("127.0.0.1:0")
+	if err != nil {
+		t.Skipf("can't listen with IP_TRANSPARENT: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -2,9 +2,22 @@ package client
 
 import (
 	"net"
+
+	"github.com/cbeuw/Cloak/internal/common"
 )
 
 type Transport interface {
 	Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error)
 	net.Conn
 }
+
+// pickOne returns one of choices at random, or fallback if there are none. Transports use it to vary what they send
+// from connection to connection
+func pickOne(choices []string, fallback string) string {
+	if len(choices) == 0 {
+		return fallback
+	}
+	var r [1]byte
+	common.CryptoRandRead(r[:])
+	return choices[int(r[0])%len(choices)]
+}
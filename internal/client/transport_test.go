@@ -0,0 +1,17 @@
+package client
+
+import "testing"
+
+func TestPickOne(t *testing.T) {
+	if picked := pickOne(nil, "fallback"); picked != "fallback" {
+		t.Errorf("expecting the fallback, got %v", picked)
+	}
+	choices := []string{"a", "b"}
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		seen[pickOne(choices, "fallback")] = true
+	}
+	if len(seen) != 2 || !seen["a"] || !seen["b"] {
+		t.Errorf("expecting both to be picked, got %v", seen)
+	}
+}
@@ -0,0 +1,492 @@
+package client
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// In TUN mode, ck-client is a VPN: whatever is routed to its TUN device is carried to a "direct" proxy method. Rather
+// than bringing a TCP/IP stack of its own, it lets the kernel's terminate TCP. A TCP packet from an application,
+// S:s -> D:d, is written back to the TUN device as natIP:n -> tunIP:listenPort, so that the kernel hands the
+// connection to our listener on tunIP, from natIP:n, and n tells us where it was going. The listener's packets to
+// natIP:n come back out of the TUN device and are written back as D:d -> S:s. UDP, including DNS, is handled here:
+// the datagrams of each application socket are carried in a datagram stream, with their destinations. Only IPv4 is
+// supported, and fragments are dropped. The TCP and UDP of IPv6 are refused with an ICMPv6 Destination Unreachable,
+// so that applications fall back to IPv4 straight away rather than waiting for a reply that never comes
+
+const (
+	ipProtoTCP    = 6
+	ipProtoUDP    = 17
+	ipProtoICMPv6 = 58
+)
+
+// an ICMPv6 error carries as much of the packet it's about as fits in the minimum IPv6 MTU
+const ipv6MinMTU = 1280
+
+var ErrTUNAddr = errors.New("TUN address must be IPv4, in a subnet with room for another address")
+
+// how long a NAT port of a TCP connection is kept once the connection is closed or if it's never accepted
+const tunNATTimeout = 60 * time.Second
+
+// tunFlow is the source and destination of a packet from an application
+type tunFlow struct {
+	src, dst [4]byte
+	srcPort  uint16
+	dstPort  uint16
+}
+
+type natEntry struct {
+	flow tunFlow
+	// whether the accepted connection is still open
+	open     bool
+	lastSeen time.Time
+}
+
+type tunStack struct {
+	writeM sync.Mutex
+	dev    io.Writer
+
+	tunIP      [4]byte
+	natIP      [4]byte
+	listenPort uint16
+
+	natM     sync.Mutex
+	nat      map[uint16]*natEntry
+	natPorts map[tunFlow]uint16
+	nextPort uint16
+
+	udpTimeout         time.Duration
+	openDatagramStream func() (ConnWithReadFromTimeout, error)
+	udpM               sync.Mutex
+	udp                map[[6]byte]*udpMapping
+
+	ipv6Warned sync.Once
+}
+
+func newTUNStack(dev io.Writer, tunIP, natIP net.IP, listenPort uint16, udpTimeout time.Duration, openDatagramStream func() (ConnWithReadFromTimeout, error)) *tunStack {
+	s := &tunStack{
+		dev:                dev,
+		listenPort:         listenPort,
+		nat:                make(map[uint16]*natEntry),
+		natPorts:           make(map[tunFlow]uint16),
+		nextPort:           1024,
+		udpTimeout:         udpTimeout,
+		openDatagramStream: openDatagramStream,
+		udp:                make(map[[6]byte]*udpMapping),
+	}
+	copy(s.tunIP[:], tunIP.To4())
+	copy(s.natIP[:], natIP.To4())
+	return s
+}
+
+// tunNATAddr is the address in tunNet that connections appear to come from, the one after the address of the device
+func tunNATAddr(tunNet *net.IPNet) (net.IP, error) {
+	ip := tunNet.IP.To4()
+	if ip == nil {
+		return nil, ErrTUNAddr
+	}
+	natIP := make(net.IP, 4)
+	binary.BigEndian.PutUint32(natIP, binary.BigEndian.Uint32(ip)+1)
+	if !tunNet.Contains(natIP) {
+		return nil, ErrTUNAddr
+	}
+	return natIP, nil
+}
+
+func (s *tunStack) writePacket(packet []byte) {
+	s.writeM.Lock()
+	defer s.writeM.Unlock()
+	if _, err := s.dev.Write(packet); err != nil {
+		log.Tracef("writing to TUN device: %v", err)
+	}
+}
+
+// handlePacket processes a packet read from the TUN device
+func (s *tunStack) handlePacket(packet []byte) {
+	if len(packet) >= 40 && packet[0]>>4 == 6 {
+		s.refuseIPv6(packet)
+		return
+	}
+	if len(packet) < 20 || packet[0]>>4 != 4 {
+		return
+	}
+	ihl := int(packet[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:4]))
+	if ihl < 20 || totalLen < ihl || totalLen > len(packet) {
+		return
+	}
+	packet = packet[:totalLen]
+	// more fragments, or a fragment offset
+	if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+		return
+	}
+	switch packet[9] {
+	case ipProtoTCP:
+		if len(packet) >= ihl+20 {
+			s.handleTCP(packet, ihl)
+		}
+	case ipProtoUDP:
+		if len(packet) >= ihl+8 {
+			s.handleUDP(packet, ihl)
+		}
+	}
+}
+
+// refuseIPv6 replies to the TCP or UDP of an IPv6 packet with an ICMPv6 Destination Unreachable. What the kernel sends
+// by itself, such as neighbour discovery and multicast, is dropped quietly
+func (s *tunStack) refuseIPv6(packet []byte) {
+	nextHeader := packet[6]
+	var src, dst [16]byte
+	copy(src[:], packet[8:24])
+	copy(dst[:], packet[24:40])
+	if nextHeader != ipProtoTCP && nextHeader != ipProtoUDP || dst[0] == 0xff || src == [16]byte{} {
+		return
+	}
+	s.ipv6Warned.Do(func() {
+		log.Warn("IPv6 isn't carried in TUN mode, and its connections are refused. Only route IPv4 to the TUN device")
+	})
+	log.Tracef("refusing IPv6 from %v to %v", net.IP(src[:]), net.IP(dst[:]))
+	s.writePacket(icmpv6Unreachable(dst, src, packet))
+}
+
+func (s *tunStack) handleTCP(packet []byte, ihl int) {
+	var src, dst [4]byte
+	copy(src[:], packet[12:16])
+	copy(dst[:], packet[16:20])
+	srcPort := binary.BigEndian.Uint16(packet[ihl:])
+	dstPort := binary.BigEndian.Uint16(packet[ihl+2:])
+
+	s.natM.Lock()
+	if src == s.tunIP && srcPort == s.listenPort && dst == s.natIP {
+		// from our listener
+		entry, ok := s.nat[dstPort]
+		if !ok {
+			s.natM.Unlock()
+			return
+		}
+		entry.lastSeen = time.Now()
+		s.natM.Unlock()
+		rewriteTCP(packet, ihl, entry.flow.dst, entry.flow.dstPort, entry.flow.src, entry.flow.srcPort)
+		s.writePacket(packet)
+		return
+	}
+	flow := tunFlow{src: src, dst: dst, srcPort: srcPort, dstPort: dstPort}
+	port, ok := s.natPorts[flow]
+	if !ok {
+		port, ok = s.allocNATPort()
+		if !ok {
+			s.natM.Unlock()
+			log.Warn("ran out of NAT ports for TUN connections")
+			return
+		}
+		s.nat[port] = &natEntry{flow: flow}
+		s.natPorts[flow] = port
+	}
+	s.nat[port].lastSeen = time.Now()
+	s.natM.Unlock()
+	rewriteTCP(packet, ihl, s.natIP, port, s.tunIP, s.listenPort)
+	s.writePacket(packet)
+}
+
+// allocNATPort finds a NAT port that isn't in use. natM must be held
+func (s *tunStack) allocNATPort() (uint16, bool) {
+	for i := 0; i < 65536-1024; i++ {
+		port := s.nextPort
+		s.nextPort++
+		if s.nextPort == 0 {
+			s.nextPort = 1024
+		}
+		if _, ok := s.nat[port]; !ok {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// accepted looks up where a connection accepted from natIP:port was going, and marks it open
+func (s *tunStack) accepted(remote *net.TCPAddr) (target string, ok bool) {
+	if !remote.IP.Equal(net.IP(s.natIP[:])) {
+		return "", false
+	}
+	s.natM.Lock()
+	defer s.natM.Unlock()
+	entry, ok := s.nat[uint16(remote.Port)]
+	if !ok {
+		return "", false
+	}
+	entry.open = true
+	return (&net.TCPAddr{IP: net.IP(entry.flow.dst[:]), Port: int(entry.flow.dstPort)}).String(), true
+}
+
+// closed marks the connection from natIP:port closed, so that its NAT port expires
+func (s *tunStack) closed(remote *net.TCPAddr) {
+	s.natM.Lock()
+	defer s.natM.Unlock()
+	if entry, ok := s.nat[uint16(remote.Port)]; ok {
+		entry.open = false
+		entry.lastSeen = time.Now()
+	}
+}
+
+// expireNAT drops the NAT ports of closed connections, and of connections never accepted, that are past
+// tunNATTimeout
+func (s *tunStack) expireNAT(now time.Time) {
+	s.natM.Lock()
+	defer s.natM.Unlock()
+	for port, entry := range s.nat {
+		if !entry.open && now.Sub(entry.lastSeen) > tunNATTimeout {
+			delete(s.nat, port)
+			delete(s.natPorts, entry.flow)
+		}
+	}
+}
+
+func (s *tunStack) handleUDP(packet []byte, ihl int) {
+	udpLen := int(binary.BigEndian.Uint16(packet[ihl+4:]))
+	if udpLen < 8 || ihl+udpLen > len(packet) {
+		return
+	}
+	var source [6]byte
+	copy(source[:4], packet[12:16])
+	copy(source[4:], packet[ihl:ihl+2])
+	target, _ := common.MarshalTarget((&net.UDPAddr{IP: net.IP(packet[16:20]), Port: int(binary.BigEndian.Uint16(packet[ihl+2:]))}).String())
+	datagram := append(target, packet[ihl+8:ihl+udpLen]...)
+
+	mapping, err := s.udpMapping(source)
+	if err != nil {
+		log.Errorf("Failed to open stream for UDP from TUN: %v", err)
+		return
+	}
+	mapping.touch(s.udpTimeout)
+	if _, err = mapping.stream.Write(datagram); err != nil {
+		log.Tracef("copying TUN to stream: %v", err)
+		s.dropUDP(source, mapping)
+	}
+}
+
+// udpMapping gets the stream of an application's UDP socket, opening one if there isn't one
+func (s *tunStack) udpMapping(source [6]byte) (*udpMapping, error) {
+	s.udpM.Lock()
+	mapping, ok := s.udp[source]
+	s.udpM.Unlock()
+	if ok {
+		return mapping, nil
+	}
+	stream, err := s.openDatagramStream()
+	if err != nil {
+		return nil, err
+	}
+	m := &udpMapping{stream: stream}
+	if s.udpTimeout > 0 {
+		m.expiry = time.AfterFunc(s.udpTimeout, func() {
+			log.Tracef("UDP mapping of %v expired", net.IP(source[:4]))
+			s.dropUDP(source, m)
+		})
+	}
+	s.udpM.Lock()
+	s.udp[source] = m
+	s.udpM.Unlock()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := m.stream.Read(buf)
+			if err != nil {
+				log.Tracef("copying stream to TUN: %v", err)
+				s.dropUDP(source, m)
+				return
+			}
+			m.touch(s.udpTimeout)
+			from, payload, err := common.SplitTarget(buf[:n])
+			if err != nil {
+				continue
+			}
+			fromAddr, err := net.ResolveUDPAddr("udp", from)
+			if err != nil || fromAddr.IP.To4() == nil {
+				continue
+			}
+			var fromIP [4]byte
+			copy(fromIP[:], fromAddr.IP.To4())
+			var dst [4]byte
+			copy(dst[:], source[:4])
+			s.writePacket(udpPacket(fromIP, uint16(fromAddr.Port), dst, binary.BigEndian.Uint16(source[4:]), payload))
+		}
+	}()
+	return m, nil
+}
+
+// dropUDP removes the mapping of a source if it's still m, and closes its stream
+func (s *tunStack) dropUDP(source [6]byte, m *udpMapping) {
+	s.udpM.Lock()
+	if s.udp[source] == m {
+		delete(s.udp, source)
+	}
+	s.udpM.Unlock()
+	if m.expiry != nil {
+		m.expiry.Stop()
+	}
+	m.stream.Close()
+}
+
+// checksum is the internet checksum (RFC 1071) of data, carrying on from sum
+func checksum(sum uint32, data []byte) uint16 {
+	for ; len(data) >= 2; data = data[2:] {
+		sum += uint32(binary.BigEndian.Uint16(data))
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum is the sum of the pseudo header of a TCP or UDP segment
+func pseudoHeaderSum(src, dst [4]byte, proto byte, length int) uint32 {
+	return uint32(binary.BigEndian.Uint16(src[:2])) + uint32(binary.BigEndian.Uint16(src[2:])) +
+		uint32(binary.BigEndian.Uint16(dst[:2])) + uint32(binary.BigEndian.Uint16(dst[2:])) +
+		uint32(proto) + uint32(length)
+}
+
+// rewriteTCP changes the addresses of a TCP packet and recomputes its checksums
+func rewriteTCP(packet []byte, ihl int, src [4]byte, srcPort uint16, dst [4]byte, dstPort uint16) {
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	binary.BigEndian.PutUint16(packet[10:], 0)
+	binary.BigEndian.PutUint16(packet[10:], checksum(0, packet[:ihl]))
+
+	segment := packet[ihl:]
+	binary.BigEndian.PutUint16(segment[0:], srcPort)
+	binary.BigEndian.PutUint16(segment[2:], dstPort)
+	binary.BigEndian.PutUint16(segment[16:], 0)
+	binary.BigEndian.PutUint16(segment[16:], checksum(pseudoHeaderSum(src, dst, ipProtoTCP, len(segment)), segment))
+}
+
+// udpPacket makes an IPv4 packet of a UDP datagram
+func udpPacket(src [4]byte, srcPort uint16, dst [4]byte, dstPort uint16, payload []byte) []byte {
+	packet := make([]byte, 28+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = ipProtoUDP
+	copy(packet[12:16], src[:])
+	copy(packet[16:20], dst[:])
+	binary.BigEndian.PutUint16(packet[10:], checksum(0, packet[:20]))
+
+	segment := packet[20:]
+	binary.BigEndian.PutUint16(segment[0:], srcPort)
+	binary.BigEndian.PutUint16(segment[2:], dstPort)
+	binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+	copy(segment[8:], payload)
+	sum := checksum(pseudoHeaderSum(src, dst, ipProtoUDP, len(segment)), segment)
+	if sum == 0 {
+		// zero means no checksum in UDP
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(segment[6:], sum)
+	return packet
+}
+
+// icmpv6Unreachable makes an IPv6 packet of an ICMPv6 Destination Unreachable (administratively prohibited) about
+// invoking, as if from src
+func icmpv6Unreachable(src, dst [16]byte, invoking []byte) []byte {
+	if len(invoking) > ipv6MinMTU-48 {
+		invoking = invoking[:ipv6MinMTU-48]
+	}
+	packet := make([]byte, 48+len(invoking))
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:], uint16(8+len(invoking)))
+	packet[6] = ipProtoICMPv6
+	packet[7] = 64
+	copy(packet[8:24], src[:])
+	copy(packet[24:40], dst[:])
+
+	message := packet[40:]
+	message[0] = 1
+	message[1] = 1
+	copy(message[8:], invoking)
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(packet[i:]))
+	}
+	sum += uint32(len(message)) + ipProtoICMPv6
+	binary.BigEndian.PutUint16(message[2:], checksum(sum, message))
+	return packet
+}
+
+// ServeTUN carries what's routed to the TUN device dev, with the address tunNet, to a direct proxy method. It returns
+// when dev fails to read
+func ServeTUN(dev io.ReadWriter, tunNet *net.IPNet, streamTimeout time.Duration, udpTimeout time.Duration, newSeshFunc func() *mux.Session, useSessionPerConnection bool) error {
+	natIP, err := tunNATAddr(tunNet)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: tunNet.IP})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	var seshM sync.Mutex
+	var sesh *mux.Session
+	session := func() *mux.Session {
+		seshM.Lock()
+		defer seshM.Unlock()
+		if !useSessionPerConnection && !reusable(sesh) {
+			sesh = newSeshFunc()
+		}
+		return sesh
+	}
+	stack := newTUNStack(dev, tunNet.IP, natIP, uint16(listener.Addr().(*net.TCPAddr).Port), udpTimeout, func() (ConnWithReadFromTimeout, error) {
+		return openLocalStream(session(), newSeshFunc, useSessionPerConnection, (*mux.Session).OpenDatagramStream)
+	})
+
+	go func() {
+		for range time.Tick(tunNATTimeout / 2) {
+			stack.expireNAT(time.Now())
+		}
+	}()
+
+	go func() {
+		for {
+			localConn, err := listener.AcceptTCP()
+			if err != nil {
+				log.Errorf("Failed to accept TUN connection: %v", err)
+				return
+			}
+			go func() {
+				remote := localConn.RemoteAddr().(*net.TCPAddr)
+				target, ok := stack.accepted(remote)
+				if !ok {
+					localConn.Close()
+					return
+				}
+				defer stack.closed(remote)
+				stream, err := OpenTargetStream(target, session(), newSeshFunc, useSessionPerConnection)
+				if err != nil {
+					log.Errorf("Failed to open stream to %v: %v", target, err)
+					localConn.Close()
+					return
+				}
+				pipeLocal(localConn, stream, streamTimeout)
+			}()
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := dev.Read(buf)
+		if err != nil {
+			return err
+		}
+		stack.handlePacket(buf[:n])
+	}
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// ifreq is struct ifreq of linux/if.h: the name of the interface, then a union that's at most 24 bytes
+type ifreq [syscall.IFNAMSIZ + 24]byte
+
+func newIfreq(name string) (*ifreq, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name %v is too long", name)
+	}
+	var ifr ifreq
+	copy(ifr[:], name)
+	return &ifr, nil
+}
+
+func ioctl(fd int, req uintptr, ifr *ifreq) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// setSockaddr puts an IPv4 address in the union of ifr as a struct sockaddr_in
+func (ifr *ifreq) setSockaddr(ip net.IP) {
+	binary.NativeEndian.PutUint16(ifr[syscall.IFNAMSIZ:], syscall.AF_INET)
+	copy(ifr[syscall.IFNAMSIZ+4:], ip.To4())
+}
+
+// OpenTUN creates the TUN device name, gives it the address tunNet and brings it up with mtu. It needs CAP_NET_ADMIN
+func OpenTUN(name string, tunNet *net.IPNet, mtu int) (io.ReadWriteCloser, error) {
+	if tunNet.IP.To4() == nil {
+		return nil, ErrTUNAddr
+	}
+	ifr, err := newIfreq(name)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	binary.NativeEndian.PutUint16(ifr[syscall.IFNAMSIZ:], syscall.IFF_TUN|syscall.IFF_NO_PI)
+	if err = ioctl(fd, syscall.TUNSETIFF, ifr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN device %v: %v", name, err)
+	}
+	dev := os.NewFile(uintptr(fd), "/dev/net/tun")
+
+	// the addresses, MTU and flags of an interface are set through any socket
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	defer syscall.Close(sock)
+	configure := func(req uintptr, set func(*ifreq)) error {
+		ifr, _ := newIfreq(name)
+		set(ifr)
+		return ioctl(sock, req, ifr)
+	}
+	steps := []struct {
+		what string
+		req  uintptr
+		set  func(*ifreq)
+	}{
+		{"address", syscall.SIOCSIFADDR, func(ifr *ifreq) { ifr.setSockaddr(tunNet.IP) }},
+		{"netmask", syscall.SIOCSIFNETMASK, func(ifr *ifreq) { ifr.setSockaddr(net.IP(tunNet.Mask)) }},
+		{"MTU", syscall.SIOCSIFMTU, func(ifr *ifreq) { binary.NativeEndian.PutUint32(ifr[syscall.IFNAMSIZ:], uint32(mtu)) }},
+		{"flags", syscall.SIOCSIFFLAGS, func(ifr *ifreq) {
+			binary.NativeEndian.PutUint16(ifr[syscall.IFNAMSIZ:], syscall.IFF_UP|syscall.IFF_RUNNING)
+		}},
+	}
+	for _, step := range steps {
+		if err = configure(step.req, step.set); err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("failed to set %v of %v: %v", step.what, name, err)
+		}
+	}
+	return dev, nil
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+func OpenTUN(string, *net.IPNet, int) (io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN mode is only supported on Linux")
+}
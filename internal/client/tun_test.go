@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// fakeTUN is the TUN device as seen by the kernel: what the stack writes to it
+type fakeTUN chan []byte
+
+func (dev fakeTUN) Write(p []byte) (int, error) {
+	dev <- append([]byte{}, p...)
+	return len(p), nil
+}
+
+type pipeStream struct{ net.Conn }
+
+func (pipeStream) SetReadFromTimeout(time.Duration) {}
+
+func ip4(s string) (ret [4]byte) {
+	copy(ret[:], net.ParseIP(s).To4())
+	return
+}
+
+// tcpPacket makes an IPv4 packet of a TCP segment with no options or payload
+func tcpPacket(src [4]byte, srcPort uint16, dst [4]byte, dstPort uint16) []byte {
+	packet := make([]byte, 40)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:], 40)
+	packet[8] = 64
+	packet[9] = ipProtoTCP
+	packet[20+12] = 5 << 4
+	rewriteTCP(packet, 20, src, srcPort, dst, dstPort)
+	return packet
+}
+
+func checkChecksums(t *testing.T, packet []byte) {
+	if checksum(0, packet[:20]) != 0 {
+		t.Error("bad IPv4 header checksum")
+	}
+	var src, dst [4]byte
+	copy(src[:], packet[12:16])
+	copy(dst[:], packet[16:20])
+	if checksum(pseudoHeaderSum(src, dst, packet[9], len(packet)-20), packet[20:]) != 0 {
+		t.Error("bad transport checksum")
+	}
+}
+
+func TestTUNNATAddr(t *testing.T) {
+	_, tunNet, _ := net.ParseCIDR("198.18.0.0/16")
+	tunNet.IP = net.ParseIP("198.18.0.1")
+	natIP, err := tunNATAddr(tunNet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !natIP.Equal(net.ParseIP("198.18.0.2")) {
+		t.Errorf("expecting 198.18.0.2, got %v", natIP)
+	}
+
+	_, tunNet, _ = net.ParseCIDR("198.18.0.1/32")
+	if _, err = tunNATAddr(tunNet); err != ErrTUNAddr {
+		t.Errorf("expecting %v, got %v", ErrTUNAddr, err)
+	}
+}
+
+func TestTUNStackTCP(t *testing.T) {
+	dev := make(fakeTUN, 1)
+	tunIP, natIP := net.ParseIP("198.18.0.1"), net.ParseIP("198.18.0.2")
+	stack := newTUNStack(dev, tunIP, natIP, 1080, 0, nil)
+	app, dst := ip4("198.18.0.1"), ip4("203.0.113.1")
+
+	stack.handlePacket(tcpPacket(app, 40000, dst, 443))
+	toListener := <-dev
+	checkChecksums(t, toListener)
+	natPort := binary.BigEndian.Uint16(toListener[20:])
+	if !bytes.Equal(toListener[12:16], natIP.To4()) || !bytes.Equal(toListener[16:20], tunIP.To4()) || binary.BigEndian.Uint16(toListener[22:]) != 1080 {
+		t.Errorf("packet from application isn't sent to the listener: %x", toListener[:24])
+	}
+
+	target, ok := stack.accepted(&net.TCPAddr{IP: natIP, Port: int(natPort)})
+	if !ok || target != "203.0.113.1:443" {
+		t.Errorf("expecting the connection to go to 203.0.113.1:443, got %v", target)
+	}
+
+	stack.handlePacket(tcpPacket(ip4("198.18.0.1"), 1080, ip4("198.18.0.2"), natPort))
+	toApp := <-dev
+	checkChecksums(t, toApp)
+	if !bytes.Equal(toApp[12:16], dst[:]) || binary.BigEndian.Uint16(toApp[20:]) != 443 ||
+		!bytes.Equal(toApp[16:20], app[:]) || binary.BigEndian.Uint16(toApp[22:]) != 40000 {
+		t.Errorf("packet from the listener isn't sent back as the destination: %x", toApp[:24])
+	}
+
+	t.Run("expiry", func(t *testing.T) {
+		stack.expireNAT(time.Now().Add(2 * tunNATTimeout))
+		if _, ok := stack.accepted(&net.TCPAddr{IP: natIP, Port: int(natPort)}); !ok {
+			t.Error("NAT port of an open connection expires")
+		}
+		stack.closed(&net.TCPAddr{IP: natIP, Port: int(natPort)})
+		stack.expireNAT(time.Now().Add(2 * tunNATTimeout))
+		if _, ok := stack.accepted(&net.TCPAddr{IP: natIP, Port: int(natPort)}); ok {
+			t.Error("NAT port of a closed connection doesn't expire")
+		}
+	})
+}
+
+func TestTUNStackUDP(t *testing.T) {
+	dev := make(fakeTUN, 1)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	stack := newTUNStack(dev, net.ParseIP("198.18.0.1"), net.ParseIP("198.18.0.2"), 1080, time.Minute, func() (ConnWithReadFromTimeout, error) {
+		return pipeStream{local}, nil
+	})
+	app, dns := ip4("198.18.0.1"), ip4("203.0.113.53")
+
+	go stack.handlePacket(udpPacket(app, 40000, dns, 53, []byte("query")))
+	buf := make([]byte, 1500)
+	n, err := remote.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, payload, err := common.SplitTarget(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "203.0.113.53:53" || string(payload) != "query" {
+		t.Errorf("unexpected datagram to %v: %q", target, payload)
+	}
+
+	reply, _ := common.MarshalTarget("203.0.113.53:53")
+	go remote.Write(append(reply, "answer"...))
+	toApp := <-dev
+	checkChecksums(t, toApp)
+	if !bytes.Equal(toApp, udpPacket(dns, 53, app, 40000, []byte("answer"))) {
+		t.Errorf("unexpected packet to application %x", toApp)
+	}
+}
+
+func TestTUNStack_RefusesIPv6(t *testing.T) {
+	dev := make(fakeTUN, 1)
+	s := newTUNStack(dev, net.ParseIP("198.18.0.1"), net.ParseIP("198.18.0.2"), 4000, time.Minute, nil)
+
+	src, dst := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	packet := make([]byte, 60)
+	packet[0] = 6 << 4
+	binary.BigEndian.PutUint16(packet[4:], 20)
+	packet[6] = ipProtoTCP
+	packet[7] = 64
+	copy(packet[8:24], src)
+	copy(packet[24:40], dst)
+	s.handlePacket(packet)
+
+	var reply []byte
+	select {
+	case reply = <-dev:
+	default:
+		t.Fatal("IPv6 isn't refused")
+	}
+	if reply[6] != ipProtoICMPv6 || reply[40] != 1 {
+		t.Fatalf("expecting an ICMPv6 Destination Unreachable, got next header %v, type %v", reply[6], reply[40])
+	}
+	if !net.IP(reply[8:24]).Equal(dst) || !net.IP(reply[24:40]).Equal(src) {
+		t.Errorf("unexpected addresses %v -> %v", net.IP(reply[8:24]), net.IP(reply[24:40]))
+	}
+	if !bytes.Equal(reply[48:], packet) {
+		t.Error("the refused packet isn't quoted")
+	}
+	// a checksum over the pseudo header as well comes to zero
+	var sum uint32
+	for i := 8; i < 40; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(reply[i:]))
+	}
+	sum += uint32(len(reply)-40) + ipProtoICMPv6
+	if checksum(sum, reply[40:]) != 0 {
+		t.Error("bad ICMPv6 checksum")
+	}
+
+	// neighbour discovery from the kernel
+	packet[6] = ipProtoICMPv6
+	s.handlePacket(packet)
+	select {
+	case <-dev:
+		t.Error("ICMPv6 is replied to")
+	default:
+	}
+}
@@ -10,11 +10,37 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 )
 
 type WSOverTLS struct {
 	*common.WebSocketConn
 	cdnDomainPort string
+	path          string
+	// the Host of the upgrade request is one of these for each connection, or cdnDomainPort if there are none
+	hosts []string
+	// extra headers of the upgrade request. If there are userAgents, one of them is picked for each connection
+	header     http.Header
+	userAgents []string
+}
+
+func (ws *WSOverTLS) Close() error {
+	if ws.WebSocketConn == nil {
+		return nil
+	}
+	return ws.WebSocketConn.Close()
+}
+
+// isAllowedWSHeader returns false for the headers made by gorilla/websocket for the handshake, or by us to carry the
+// authentication
+func isAllowedWSHeader(key string) bool {
+	key = http.CanonicalHeaderKey(key)
+	switch {
+	case key == "Upgrade", key == "Connection", key == "Hidden", strings.HasPrefix(key, "Sec-Websocket-"):
+		return false
+	default:
+		return true
+	}
 }
 
 func (ws *WSOverTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey [32]byte, err error) {
@@ -28,13 +54,19 @@ func (ws *WSOverTLS) Handshake(rawConn net.Conn, authInfo AuthInfo) (sessionKey
 		return
 	}
 
-	u, err := url.Parse("ws://" + ws.cdnDomainPort)
+	u, err := url.Parse("ws://" + pickOne(ws.hosts, ws.cdnDomainPort) + ws.path)
 	if err != nil {
 		return sessionKey, fmt.Errorf("failed to parse ws url: %v", err)
 	}
 
 	payload, sharedSecret := makeAuthenticationPayload(authInfo)
 	header := http.Header{}
+	for k, v := range ws.header {
+		header[k] = v
+	}
+	if len(ws.userAgents) != 0 {
+		header.Set("User-Agent", pickOne(ws.userAgents, ""))
+	}
 	header.Add("hidden", base64.StdEncoding.EncodeToString(append(payload.randPubKey[:], payload.ciphertextWithTag[:]...)))
 	c, _, err := websocket.NewClient(uconn, u, header, 16480, 16480)
 	if err != nil {
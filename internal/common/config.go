@@ -0,0 +1,231 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFormat is the format of the configuration file at path by its extension: "yaml" for .yaml and .yml, "toml"
+// for .toml and "json" for anything else
+func ConfigFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// DecodeConfig decodes content in format, one of those of ConfigFormat, into v, which must point to a struct. YAML
+// and TOML are turned into JSON first, so v's UnmarshalJSON is used for all of them. A top-level field that v doesn't
+// have is an error, as is one that's set more than once, and errors say the line they're on where it can be told
+func DecodeConfig(content []byte, format string, v interface{}) error {
+	var err error
+	data := content
+	switch format {
+	case "yaml":
+		var tree interface{}
+		if err = yaml.Unmarshal(content, &tree); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(jsonable(tree)); err != nil {
+			return err
+		}
+	case "toml":
+		tree := make(map[string]interface{})
+		if _, err = toml.Decode(string(content), &tree); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(tree); err != nil {
+			return err
+		}
+	}
+
+	if err = checkFields(data, reflect.TypeOf(v)); err != nil {
+		return withLine(err, content, format)
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return withLine(err, content, format)
+	}
+	return nil
+}
+
+// jsonable makes the maps that YAML decodes with keys other than strings into ones that JSON can encode
+func jsonable(tree interface{}) interface{} {
+	switch tree := tree.(type) {
+	case map[string]interface{}:
+		for k, v := range tree {
+			tree[k] = jsonable(v)
+		}
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(tree))
+		for k, v := range tree {
+			m[fmt.Sprint(k)] = jsonable(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range tree {
+			tree[i] = jsonable(v)
+		}
+	}
+	return tree
+}
+
+// unknownFieldError is a top-level field of the configuration that isn't in the struct it's decoded into
+type unknownFieldError struct {
+	field     string
+	suggested string
+}
+
+func (e unknownFieldError) Error() string {
+	if e.suggested != "" {
+		return fmt.Sprintf("unknown field %v, did you mean %v?", e.field, e.suggested)
+	}
+	return fmt.Sprintf("unknown field %v", e.field)
+}
+
+// checkFields returns an unknownFieldError if the JSON object in data has a key that doesn't match a field of the
+// struct that t points to in the way encoding/json matches them, without regard to case
+func checkFields(data []byte, t reflect.Type) error {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	fields := make(map[string]string)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" || f.PkgPath != "" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields[strings.ToLower(name)] = name
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	tok, err := dec.Token()
+	if err != nil {
+		// the syntax error is reported by the decoding that follows
+		return nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return errors.New("the configuration must be an object of fields")
+	}
+	seen := make(map[string]bool)
+	var unknown []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		key := tok.(string)
+		if _, ok := fields[strings.ToLower(key)]; !ok {
+			unknown = append(unknown, key)
+		} else if seen[strings.ToLower(key)] {
+			return fmt.Errorf("field %v is set more than once", key)
+		}
+		seen[strings.ToLower(key)] = true
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return unknownFieldError{field: unknown[0], suggested: closestField(unknown[0], fields)}
+}
+
+// closestField is the name in fields that's at most two edits away from field, if any
+func closestField(field string, fields map[string]string) string {
+	best, bestDistance := "", 3
+	for lower, name := range fields {
+		if d := editDistance(strings.ToLower(field), lower); d < bestDistance || (d == bestDistance && name < best) {
+			best, bestDistance = name, d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// withLine adds the line of content that err is about to it, if it can be told
+func withLine(err error, content []byte, format string) error {
+	line := 0
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var fieldErr unknownFieldError
+	switch {
+	case errors.As(err, &syntaxErr) && format == "json":
+		line = lineAt(content, syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if i := strings.IndexByte(field, '.'); i != -1 {
+			field = field[:i]
+		}
+		if line = keyLine(content, field); line == 0 && format == "json" {
+			line = lineAt(content, typeErr.Offset)
+		}
+	case errors.As(err, &fieldErr):
+		line = keyLine(content, fieldErr.field)
+	}
+	if line == 0 {
+		return err
+	}
+	return fmt.Errorf("line %v: %w", line, err)
+}
+
+// lineAt is the line that offset is on in content, counted from 1
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte{'\n'}) + 1
+}
+
+// keyLine is the first line of content that starts with key being set, in any of the formats, or 0 if there's none
+func keyLine(content []byte, key string) int {
+	if key == "" {
+		return 0
+	}
+	re := regexp.MustCompile(`(?mi)^[ \t{,]*["']?` + regexp.QuoteMeta(key) + `["']?[ \t]*[:=]`)
+	loc := re.FindIndex(content)
+	if loc == nil {
+		return 0
+	}
+	return lineAt(content, int64(loc[0]))
+}
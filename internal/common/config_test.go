@@ -0,0 +1,69 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+type testConfig struct {
+	ServerName string
+	NumConn    int
+	UID        []byte
+	Addrs      []string
+	Hidden     string `json:"-"`
+}
+
+func TestConfigFormat(t *testing.T) {
+	for path, format := range map[string]string{
+		"ckclient.json": "json",
+		"ckclient.yaml": "yaml",
+		"ckclient.YML":  "yaml",
+		"ckserver.toml": "toml",
+		"ckserver":      "json",
+	} {
+		if got := ConfigFormat(path); got != format {
+			t.Errorf("%v: expecting %v, got %v", path, format, got)
+		}
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	for format, content := range map[string]string{
+		"json": `{"ServerName": "www.bing.com", "NumConn": 4, "UID": "5nneblJy6lniPJfr81LuYQ==", "Addrs": ["a", "b"]}`,
+		"yaml": "ServerName: www.bing.com\nNumConn: 4\nUID: 5nneblJy6lniPJfr81LuYQ==\nAddrs:\n  - a\n  - b\n",
+		"toml": "ServerName = \"www.bing.com\"\nNumConn = 4\nUID = \"5nneblJy6lniPJfr81LuYQ==\"\nAddrs = [\"a\", \"b\"]\n",
+	} {
+		var config testConfig
+		if err := DecodeConfig([]byte(content), format, &config); err != nil {
+			t.Errorf("%v: %v", format, err)
+			continue
+		}
+		if config.ServerName != "www.bing.com" || config.NumConn != 4 || len(config.UID) != 16 || len(config.Addrs) != 2 {
+			t.Errorf("%v: wrong config %+v", format, config)
+		}
+	}
+}
+
+func TestDecodeConfig_Errors(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		format  string
+		content string
+		want    string
+	}{
+		{"unknown field", "json", "{\n\"ServerName\": \"a\",\n\"NumCon\": 4\n}", "line 3: unknown field NumCon, did you mean NumConn?"},
+		{"unknown field in YAML", "yaml", "ServerName: a\nFoo: 1\n", "line 2: unknown field Foo"},
+		{"field set twice", "json", `{"ServerName": "a", "servername": "b"}`, "set more than once"},
+		{"hidden field", "json", `{"Hidden": "a"}`, "unknown field Hidden"},
+		{"wrong type", "toml", "ServerName = \"a\"\n\nNumConn = \"four\"\n", "line 3: "},
+		{"wrong type in JSON", "json", "{\n\"NumConn\": \"four\"}", "line 2: "},
+		{"syntax", "json", "{\n\"ServerName\": \"a\",\n}", "line 3: "},
+		{"YAML syntax", "yaml", "ServerName: a\n  NumConn: 4\n", "line 2"},
+		{"not an object", "json", `["a"]`, "must be an object"},
+	} {
+		err := DecodeConfig([]byte(c.content), c.format, &testConfig{})
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: expecting an error with %q, got %v", c.name, c.want, err)
+		}
+	}
+}
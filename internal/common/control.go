@@ -0,0 +1,30 @@
+package common
+
+// What the client and the server send each other on a control stream, each message in JSON in a Write of its own.
+// The client queries its quota with MSG_QUERY_QUOTA, which the server answers with MSG_QUOTA. The server sends
+// MSG_LOW_CREDIT without being asked when the user's credit runs low. The client asks for the addresses of the
+// servers it can connect to with MSG_QUERY_SERVERS, which the server answers with MSG_SERVERS.
+const (
+	MSG_QUERY_QUOTA   = "query_quota"
+	MSG_QUOTA         = "quota"
+	MSG_LOW_CREDIT    = "low_credit"
+	MSG_QUERY_SERVERS = "query_servers"
+	MSG_SERVERS       = "servers"
+)
+
+type ControlMessage struct {
+	Type    string
+	Quota   *Quota   `json:",omitempty"`
+	Servers []string `json:",omitempty"`
+}
+
+// Quota is what a user has left
+type Quota struct {
+	// the user isn't subject to bandwidth and credit controls, and the rest is empty
+	Unlimited bool
+	// in bytes
+	UpCredit   int64
+	DownCredit int64
+	// unix timestamp
+	ExpiryTime int64
+}
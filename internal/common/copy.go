@@ -33,10 +33,17 @@ Forked from https://golang.org/src/io/io.go
 package common
 
 import (
+	"errors"
 	"io"
 	"net"
 )
 
+// ErrSpliceUnsupported is returned by what splices when it can't be done, before anything has been moved
+var ErrSpliceUnsupported = errors.New("splice isn't supported")
+
+// Copy relays between a stream and the connection it's proxied to. On Linux, what's copied from a socket to a stream of
+// a session with the plain encryption method is spliced by the stream's ReadFrom, and only the record layer and the
+// header of each frame go through user space
 func Copy(dst net.Conn, src net.Conn) (written int64, err error) {
 	defer func() { src.Close(); dst.Close() }()
 
@@ -1,7 +1,46 @@
 package common
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 type Dialer interface {
 	Dial(network, address string) (net.Conn, error)
 }
+
+// ContextDialer is a Dialer that gives up once a context is done, like net.Dialer
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialContext dials address with dialer, returning ctx.Err() once ctx is done. A dialer that isn't a ContextDialer is
+// left to finish in the background, and the connection it makes too late is closed
+func DialContext(ctx context.Context, dialer Dialer, network, address string) (net.Conn, error) {
+	if d, ok := dialer.(ContextDialer); ok {
+		return d.DialContext(ctx, network, address)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	dialed := make(chan dialResult, 1)
+	go func() {
+		conn, err := dialer.Dial(network, address)
+		dialed <- dialResult{conn, err}
+	}()
+	select {
+	case d := <-dialed:
+		return d.conn, d.err
+	case <-ctx.Done():
+		go func() {
+			if d := <-dialed; d.conn != nil {
+				d.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
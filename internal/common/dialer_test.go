@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// slowDialer dials a net.Pipe once it's let to, and isn't a ContextDialer
+type slowDialer struct {
+	let    chan struct{}
+	closed chan struct{}
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+	closed chan struct{}
+}
+
+func (c *closeNotifyingConn) Close() error {
+	close(c.closed)
+	return c.Conn.Close()
+}
+
+func (d *slowDialer) Dial(network, address string) (net.Conn, error) {
+	<-d.let
+	conn, _ := net.Pipe()
+	return &closeNotifyingConn{Conn: conn, closed: d.closed}, nil
+}
+
+func TestDialContext(t *testing.T) {
+	t.Run("dialled in time", func(t *testing.T) {
+		d := &slowDialer{let: make(chan struct{}), closed: make(chan struct{})}
+		close(d.let)
+		conn, err := DialContext(context.Background(), d, "tcp", "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	})
+	t.Run("given up", func(t *testing.T) {
+		d := &slowDialer{let: make(chan struct{}), closed: make(chan struct{})}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if _, err := DialContext(ctx, d, "tcp", "example.com:443"); err != context.DeadlineExceeded {
+			t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+		}
+		close(d.let)
+		select {
+		case <-d.closed:
+		case <-time.After(5 * time.Second):
+			t.Error("the connection made too late isn't closed")
+		}
+	})
+	t.Run("context dialer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := DialContext(ctx, &net.Dialer{}, "tcp", "127.0.0.1:1"); err == nil {
+			t.Error("expecting an error dialling with a cancelled context")
+		}
+	})
+}
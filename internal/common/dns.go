@@ -0,0 +1,136 @@
+package common
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// In DoH mode, the Cloak connection is carried in DNS queries for TXT records under a domain whose authoritative
+// name server is ck-server, sent over DNS over HTTPS to a public resolver that passes them on. What the client sends
+// is in the names of the queries, and what the server sends is in the TXT records of the answers. Each direction has
+// one chunk of data in flight at a time, which is sent again until it's acknowledged, so nothing is lost if the
+// resolver drops or repeats queries. The server can only answer, so the client keeps polling it.
+//
+// Query name, in base32 split into labels of up to 63 characters, followed by the domain:
+// +------------------+---------+---------+-------+-------+--------+
+// | _ConversationID_ | _Nonce_ | _Flags_ | _Seq_ | _Ack_ | _Data_ |
+// +------------------+---------+---------+-------+-------+--------+
+// | 8 bytes          | 4 bytes | 1 byte  | 2     | 2     | varies |
+// +------------------+---------+---------+-------+-------+--------+
+//
+// Answer, the strings of the TXT record put together:
+// +---------+-------+-------+--------+
+// | _Flags_ | _Seq_ | _Ack_ | _Data_ |
+// +---------+-------+-------+--------+
+// | 1 byte  | 2     | 2     | varies |
+// +---------+-------+-------+--------+
+//
+// The nonce is different in every query so that no resolver answers from its cache. Seq is the sequence number of
+// Data, which is ignored if Data is empty, and Ack is the sequence number of the chunk expected next from the other
+// side.
+
+const (
+	// the side that sets it has closed the conversation
+	DNS_FLAG_CLOSE = 0x01 // 0000 0001
+)
+
+const (
+	dnsQueryHeaderLength  = 8 + 4 + DNSAnswerHeaderLength
+	DNSAnswerHeaderLength = 1 + 2 + 2
+	// of a name in text, without the dot of the root
+	maxDNSNameLength  = 253
+	maxDNSLabelLength = 63
+)
+
+var ErrNotTunnelled = errors.New("not a query of the DNS tunnel")
+
+// DNSPacket is what either side sends in one query or answer
+type DNSPacket struct {
+	Flags byte
+	Seq   uint16
+	Ack   uint16
+	Data  []byte
+}
+
+var dnsEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// dnsLabelsLength is the length of n characters split into labels
+func dnsLabelsLength(n int) int {
+	if n == 0 {
+		return 0
+	}
+	return n + (n-1)/maxDNSLabelLength
+}
+
+// MaxDNSQueryData is the most data a query under domain can carry, which is below 1 if domain is too long for any
+func MaxDNSQueryData(domain string) int {
+	room := maxDNSNameLength - len(strings.Trim(domain, ".")) - 1
+	chars := room
+	for chars > 0 && dnsLabelsLength(chars) > room {
+		chars--
+	}
+	return chars*5/8 - dnsQueryHeaderLength
+}
+
+// MarshalDNSQuery returns the name of the query for packet in conversation
+func MarshalDNSQuery(conversation [8]byte, nonce uint32, packet DNSPacket, domain string) string {
+	raw := make([]byte, 12, dnsQueryHeaderLength+len(packet.Data))
+	copy(raw, conversation[:])
+	binary.BigEndian.PutUint32(raw[8:12], nonce)
+	raw = append(raw, MarshalDNSAnswer(packet)...)
+
+	encoded := strings.ToLower(dnsEncoding.EncodeToString(raw))
+	var name strings.Builder
+	for len(encoded) > maxDNSLabelLength {
+		name.WriteString(encoded[:maxDNSLabelLength])
+		name.WriteByte('.')
+		encoded = encoded[maxDNSLabelLength:]
+	}
+	name.WriteString(encoded)
+	name.WriteByte('.')
+	name.WriteString(strings.Trim(domain, "."))
+	name.WriteByte('.')
+	return name.String()
+}
+
+// UnmarshalDNSQuery reads the conversation and the packet of a query for name. Resolvers may change the case of the
+// letters of names, which doesn't matter
+func UnmarshalDNSQuery(name string, domain string) (conversation [8]byte, packet DNSPacket, err error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	labels, ok := strings.CutSuffix(name, "."+strings.ToLower(strings.Trim(domain, ".")))
+	if !ok {
+		err = ErrNotTunnelled
+		return
+	}
+	raw, decodeErr := dnsEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(labels, ".", "")))
+	if decodeErr != nil || len(raw) < dnsQueryHeaderLength {
+		err = ErrNotTunnelled
+		return
+	}
+	copy(conversation[:], raw[:8])
+	packet, err = UnmarshalDNSAnswer(raw[12:])
+	return
+}
+
+// MarshalDNSAnswer returns the content of the TXT record of an answer of packet
+func MarshalDNSAnswer(packet DNSPacket) []byte {
+	raw := make([]byte, DNSAnswerHeaderLength, DNSAnswerHeaderLength+len(packet.Data))
+	raw[0] = packet.Flags
+	binary.BigEndian.PutUint16(raw[1:3], packet.Seq)
+	binary.BigEndian.PutUint16(raw[3:5], packet.Ack)
+	return append(raw, packet.Data...)
+}
+
+func UnmarshalDNSAnswer(raw []byte) (packet DNSPacket, err error) {
+	if len(raw) < DNSAnswerHeaderLength {
+		err = ErrNotTunnelled
+		return
+	}
+	packet.Flags = raw[0]
+	packet.Seq = binary.BigEndian.Uint16(raw[1:3])
+	packet.Ack = binary.BigEndian.Uint16(raw[3:5])
+	packet.Data = raw[DNSAnswerHeaderLength:]
+	return
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDNSQuery(t *testing.T) {
+	domain := "t.example.com"
+	conversation := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	max := MaxDNSQueryData(domain)
+	for _, length := range []int{0, 1, 100, max} {
+		packet := DNSPacket{Flags: DNS_FLAG_CLOSE, Seq: 65535, Ack: 7, Data: bytes.Repeat([]byte{0xab}, length)}
+		name := MarshalDNSQuery(conversation, 42, packet, domain)
+		if len(name) > maxDNSNameLength+1 {
+			t.Errorf("name of %v bytes is %v long", length, len(name))
+		}
+		for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+			if len(label) > maxDNSLabelLength || len(label) == 0 {
+				t.Errorf("bad label %q", label)
+			}
+		}
+
+		// resolvers may randomise the case of names
+		gotConversation, got, err := UnmarshalDNSQuery(strings.ToUpper(name), domain+".")
+		if err != nil {
+			t.Fatalf("%v bytes: %v", length, err)
+		}
+		if gotConversation != conversation || got.Flags != packet.Flags || got.Seq != packet.Seq ||
+			got.Ack != packet.Ack || !bytes.Equal(got.Data, packet.Data) {
+			t.Errorf("expecting %+v, got %+v", packet, got)
+		}
+	}
+
+	if MaxDNSQueryData(strings.Repeat("a.", 120)) >= 1 {
+		t.Error("expecting no room under a domain that's too long")
+	}
+	for _, name := range []string{"abc.t.example.org.", "t.example.com.", "a1.t.example.com.", "aaaa.t.example.com."} {
+		if _, _, err := UnmarshalDNSQuery(name, domain); !errors.Is(err, ErrNotTunnelled) {
+			t.Errorf("%v: expecting %v, got %v", name, ErrNotTunnelled, err)
+		}
+	}
+}
+
+func TestDNSAnswer(t *testing.T) {
+	packet := DNSPacket{Seq: 1, Ack: 2, Data: []byte("hello")}
+	got, err := UnmarshalDNSAnswer(MarshalDNSAnswer(packet))
+	if err != nil || got.Seq != 1 || got.Ack != 2 || string(got.Data) != "hello" {
+		t.Errorf("expecting %+v, got %+v, %v", packet, got, err)
+	}
+	if _, err := UnmarshalDNSAnswer([]byte{0, 1}); !errors.Is(err, ErrNotTunnelled) {
+		t.Errorf("expecting %v, got %v", ErrNotTunnelled, err)
+	}
+}
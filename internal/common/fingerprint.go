@@ -0,0 +1,170 @@
+package common
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint is what a ClientHello is told apart from other ClientHellos by, i.e. the fields of JA3. GREASE values
+// are left out
+type Fingerprint struct {
+	Version      uint16
+	CipherSuites []uint16
+	Extensions   []uint16
+	Groups       []uint16
+	PointFormats []uint16
+}
+
+const (
+	sniExtensionType             = 0
+	supportedGroupsExtensionType = 10
+	pointFormatsExtensionType    = 11
+)
+
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	var ret []uint16
+	for _, v := range values {
+		if !isGREASE(v) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// ParseFingerprint reads the Fingerprint and the SNI of a ClientHello handshake message, which is without the
+// record layer. The SNI is empty if there's none
+func ParseFingerprint(ch []byte) (f Fingerprint, serverName string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed ClientHello")
+		}
+	}()
+	u16s := func(data []byte) []uint16 {
+		ret := make([]uint16, len(data)/2)
+		for i := range ret {
+			ret[i] = binary.BigEndian.Uint16(data[2*i:])
+		}
+		return ret
+	}
+
+	if ch[0] != 0x01 {
+		return f, "", errors.New("not a ClientHello")
+	}
+	if length := int(ch[1])<<16 | int(ch[2])<<8 | int(ch[3]); length != len(ch)-4 {
+		return f, "", errors.New("ClientHello length doesn't match")
+	}
+	pointer := 4
+	f.Version = binary.BigEndian.Uint16(ch[pointer : pointer+2])
+	// and the random
+	pointer += 2 + 32
+	sessionIdLen := int(ch[pointer])
+	pointer += 1 + sessionIdLen
+	cipherSuitesLen := int(binary.BigEndian.Uint16(ch[pointer : pointer+2]))
+	pointer += 2
+	f.CipherSuites = withoutGREASE(u16s(ch[pointer : pointer+cipherSuitesLen]))
+	pointer += cipherSuitesLen
+	compressionMethodsLen := int(ch[pointer])
+	pointer += 1 + compressionMethodsLen
+	extensionsEnd := pointer + 2 + int(binary.BigEndian.Uint16(ch[pointer:pointer+2]))
+	pointer += 2
+	for pointer < extensionsEnd {
+		typ := binary.BigEndian.Uint16(ch[pointer : pointer+2])
+		length := int(binary.BigEndian.Uint16(ch[pointer+2 : pointer+4]))
+		data := ch[pointer+4 : pointer+4+length]
+		pointer += 4 + length
+		if isGREASE(typ) {
+			continue
+		}
+		f.Extensions = append(f.Extensions, typ)
+		switch typ {
+		case sniExtensionType:
+			// after the length of server_name_list and the name_type
+			nameLen := int(binary.BigEndian.Uint16(data[3:5]))
+			serverName = string(data[5 : 5+nameLen])
+		case supportedGroupsExtensionType:
+			f.Groups = withoutGREASE(u16s(data[2 : 2+int(binary.BigEndian.Uint16(data[0:2]))]))
+		case pointFormatsExtensionType:
+			for _, format := range data[1 : 1+int(data[0])] {
+				f.PointFormats = append(f.PointFormats, uint16(format))
+			}
+		}
+	}
+	return f, serverName, nil
+}
+
+func joinValues(values []uint16) string {
+	var s []string
+	for _, v := range values {
+		s = append(s, strconv.Itoa(int(v)))
+	}
+	return strings.Join(s, "-")
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA3 returns the JA3 string of the fingerprint
+func (f Fingerprint) JA3() string {
+	return fmt.Sprintf("%v,%v,%v,%v,%v", f.Version, joinValues(f.CipherSuites), joinValues(f.Extensions),
+		joinValues(f.Groups), joinValues(f.PointFormats))
+}
+
+// JA3N returns the JA3 string of the fingerprint with its extensions sorted. Browsers such as Chrome shuffle their
+// extensions, so only this stays the same across their ClientHellos
+func (f Fingerprint) JA3N() string {
+	sorted := append([]uint16(nil), f.Extensions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	f.Extensions = sorted
+	return f.JA3()
+}
+
+func (f Fingerprint) JA3Hash() string  { return md5Hex(f.JA3()) }
+func (f Fingerprint) JA3NHash() string { return md5Hex(f.JA3N()) }
+
+// Differences describes how f differs from want, apart from the order of extensions. It's empty if they're alike
+func (f Fingerprint) Differences(want Fingerprint) []string {
+	var diffs []string
+	if f.Version != want.Version {
+		diffs = append(diffs, fmt.Sprintf("version is %v instead of %v", f.Version, want.Version))
+	}
+	if joinValues(f.CipherSuites) != joinValues(want.CipherSuites) {
+		diffs = append(diffs, fmt.Sprintf("cipher suites are %v instead of %v", joinValues(f.CipherSuites), joinValues(want.CipherSuites)))
+	}
+	has := func(values []uint16, v uint16) bool {
+		for _, value := range values {
+			if value == v {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ext := range f.Extensions {
+		if !has(want.Extensions, ext) {
+			diffs = append(diffs, fmt.Sprintf("extension %v is extra", ext))
+		}
+	}
+	for _, ext := range want.Extensions {
+		if !has(f.Extensions, ext) {
+			diffs = append(diffs, fmt.Sprintf("extension %v is missing", ext))
+		}
+	}
+	if joinValues(f.Groups) != joinValues(want.Groups) {
+		diffs = append(diffs, fmt.Sprintf("supported groups are %v instead of %v", joinValues(f.Groups), joinValues(want.Groups)))
+	}
+	if joinValues(f.PointFormats) != joinValues(want.PointFormats) {
+		diffs = append(diffs, fmt.Sprintf("point formats are %v instead of %v", joinValues(f.PointFormats), joinValues(want.PointFormats)))
+	}
+	return diffs
+}
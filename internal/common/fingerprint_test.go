@@ -0,0 +1,94 @@
+package common
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// testClientHello makes a ClientHello with GREASE in its cipher suites, extensions and supported groups
+func testClientHello() []byte {
+	extension := func(typ uint16, data []byte) []byte {
+		ext := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint16(ext[0:2], typ)
+		binary.BigEndian.PutUint16(ext[2:4], uint16(len(data)))
+		return append(ext, data...)
+	}
+	serverName := append([]byte{0x00, 0x12, 0x00, 0x00, 0x0f}, "www.example.com"...)
+	var extensions []byte
+	extensions = append(extensions, extension(0x1a1a, nil)...)
+	extensions = append(extensions, extension(0, serverName)...)
+	extensions = append(extensions, extension(10, []byte{0x00, 0x06, 0x2a, 0x2a, 0x00, 0x1d, 0x00, 0x17})...)
+	extensions = append(extensions, extension(11, []byte{0x01, 0x00})...)
+	extensions = append(extensions, extension(43, []byte{0x02, 0x03, 0x04})...)
+
+	body := []byte{0x03, 0x03}
+	body = append(body, make([]byte, 32)...)
+	body = append(body, 0x00)
+	body = append(body, 0x00, 0x06, 0x0a, 0x0a, 0x13, 0x01, 0xc0, 0x2b)
+	body = append(body, 0x01, 0x00)
+	body = append(body, byte(len(extensions)>>8), byte(len(extensions)))
+	body = append(body, extensions...)
+
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(body)))
+	length[0] = 0x01
+	return append(length, body...)
+}
+
+func TestParseFingerprint(t *testing.T) {
+	f, serverName, err := ParseFingerprint(testClientHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "www.example.com" {
+		t.Errorf("expecting SNI www.example.com, got %v", serverName)
+	}
+	if ja3 := f.JA3(); ja3 != "771,4865-49195,0-10-11-43,29-23,0" {
+		t.Errorf("unexpected JA3 %v", ja3)
+	}
+
+	if _, _, err := ParseFingerprint(testClientHello()[:60]); err == nil {
+		t.Error("expecting an error for a truncated ClientHello")
+	}
+	if _, _, err := ParseFingerprint([]byte{0x02, 0x00}); err == nil {
+		t.Error("expecting an error for a handshake message that isn't a ClientHello")
+	}
+}
+
+func TestFingerprint_JA3N(t *testing.T) {
+	f := Fingerprint{Version: 771, CipherSuites: []uint16{4865}, Extensions: []uint16{43, 0, 10}, Groups: []uint16{29}, PointFormats: []uint16{0}}
+	shuffled := f
+	shuffled.Extensions = []uint16{10, 43, 0}
+	if f.JA3() == shuffled.JA3() {
+		t.Error("JA3 doesn't depend on the order of extensions")
+	}
+	if f.JA3N() != "771,4865,0-10-43,29,0" || f.JA3NHash() != shuffled.JA3NHash() {
+		t.Errorf("JA3N depends on the order of extensions: %v and %v", f.JA3N(), shuffled.JA3N())
+	}
+	if !reflect.DeepEqual(f.Extensions, []uint16{43, 0, 10}) {
+		t.Error("JA3N changed the fingerprint")
+	}
+	if len(f.JA3Hash()) != 32 {
+		t.Errorf("unexpected JA3 hash %v", f.JA3Hash())
+	}
+}
+
+func TestFingerprint_Differences(t *testing.T) {
+	want := Fingerprint{Version: 771, CipherSuites: []uint16{4865, 4866}, Extensions: []uint16{0, 10, 43}, Groups: []uint16{29}}
+	same := want
+	same.Extensions = []uint16{43, 10, 0}
+	if diffs := same.Differences(want); len(diffs) != 0 {
+		t.Errorf("expecting no differences but the order of extensions, got %v", diffs)
+	}
+
+	got := Fingerprint{Version: 771, CipherSuites: []uint16{4866, 4865}, Extensions: []uint16{0, 10, 21}, Groups: []uint16{29}}
+	expected := []string{
+		"cipher suites are 4866-4865 instead of 4865-4866",
+		"extension 21 is extra",
+		"extension 43 is missing",
+	}
+	if diffs := got.Differences(want); !reflect.DeepEqual(diffs, expected) {
+		t.Errorf("expecting %v, got %v", expected, diffs)
+	}
+}
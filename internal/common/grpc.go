@@ -0,0 +1,112 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// gRPC Length-Prefixed-Message header: 1 byte compressed flag and 4 bytes message length
+	grpcMessageHeaderLength = 5
+	// protobuf tag of field 1 with wire type 2 (length-delimited), i.e. the bytes field in message Hunk { bytes data = 1; }
+	grpcHunkTag = 0x0a
+)
+
+var ErrMalformedGRPCMessage = errors.New("malformed gRPC message")
+
+// GRPCConn carries each Write as one message in a bidirectional gRPC stream, and Read returns the content of exactly
+// one message. Stream is the body of the HTTP/2 stream, which is the request body and the response writer on one side
+// and the response body and the request body on the other.
+type GRPCConn struct {
+	Stream io.ReadWriteCloser
+	Local  net.Addr
+	Remote net.Addr
+
+	writeM sync.Mutex
+	header [grpcMessageHeaderLength]byte
+}
+
+func (g *GRPCConn) Write(data []byte) (int, error) {
+	var varint [binary.MaxVarintLen64]byte
+	varintLen := binary.PutUvarint(varint[:], uint64(len(data)))
+	msgLen := 1 + varintLen + len(data)
+
+	msg := make([]byte, grpcMessageHeaderLength+msgLen)
+	msg[0] = 0x00 // not compressed
+	binary.BigEndian.PutUint32(msg[1:5], uint32(msgLen))
+	msg[5] = grpcHunkTag
+	copy(msg[6:], varint[:varintLen])
+	copy(msg[6+varintLen:], data)
+
+	g.writeM.Lock()
+	_, err := g.Stream.Write(msg)
+	g.writeM.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (g *GRPCConn) Read(buf []byte) (n int, err error) {
+	for n == 0 {
+		_, err = io.ReadFull(g.Stream, g.header[:])
+		if err != nil {
+			return
+		}
+		if g.header[0] != 0x00 {
+			return 0, ErrMalformedGRPCMessage
+		}
+		msgLen := int(binary.BigEndian.Uint32(g.header[1:5]))
+		if msgLen == 0 {
+			// an empty Hunk
+			continue
+		}
+		if msgLen > len(buf) {
+			return 0, io.ErrShortBuffer
+		}
+		_, err = io.ReadFull(g.Stream, buf[:msgLen])
+		if err != nil {
+			return
+		}
+		if buf[0] != grpcHunkTag {
+			return 0, ErrMalformedGRPCMessage
+		}
+		dataLen, varintLen := binary.Uvarint(buf[1:msgLen])
+		if varintLen <= 0 || int(dataLen) != msgLen-1-varintLen {
+			return 0, ErrMalformedGRPCMessage
+		}
+		n = copy(buf, buf[1+varintLen:msgLen])
+	}
+	return
+}
+
+func (g *GRPCConn) Close() error         { return g.Stream.Close() }
+func (g *GRPCConn) LocalAddr() net.Addr  { return g.Local }
+func (g *GRPCConn) RemoteAddr() net.Addr { return g.Remote }
+
+// Deadlines aren't supported because an HTTP/2 connection, and therefore its deadlines, may be shared by many streams
+func (g *GRPCConn) SetDeadline(t time.Time) error      { return nil }
+func (g *GRPCConn) SetReadDeadline(t time.Time) error  { return nil }
+func (g *GRPCConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// StreamConn is the body of an HTTP/2 stream as a net.Conn, with nothing added to what's written. Like in GRPCConn,
+// Stream is the request body and the response writer on one side and the response body and the request body on the
+// other
+type StreamConn struct {
+	Stream io.ReadWriteCloser
+	Local  net.Addr
+	Remote net.Addr
+}
+
+func (s *StreamConn) Read(buf []byte) (int, error)     { return s.Stream.Read(buf) }
+func (s *StreamConn) Write(data []byte) (int, error)   { return s.Stream.Write(data) }
+func (s *StreamConn) Close() error                     { return s.Stream.Close() }
+func (s *StreamConn) LocalAddr() net.Addr              { return s.Local }
+func (s *StreamConn) RemoteAddr() net.Addr             { return s.Remote }
+func (s *StreamConn) SetDeadline(time.Time) error      { return nil }
+func (s *StreamConn) SetReadDeadline(time.Time) error  { return nil }
+func (s *StreamConn) SetWriteDeadline(time.Time) error { return nil }
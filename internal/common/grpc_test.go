@@ -0,0 +1,49 @@
+package common
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestGRPCConn(t *testing.T) {
+	l, r := net.Pipe()
+	sender := &GRPCConn{Stream: l}
+	receiver := &GRPCConn{Stream: r}
+
+	t.Run("messages of various lengths", func(t *testing.T) {
+		for _, length := range []int{1, 127, 128, 16401} {
+			data := make([]byte, length)
+			rand.Read(data)
+			go sender.Write(data)
+
+			buf := make([]byte, 16401+16)
+			n, err := receiver.Read(buf)
+			if err != nil {
+				t.Fatalf("reading %v bytes: %v", length, err)
+			}
+			if !bytes.Equal(data, buf[:n]) {
+				t.Errorf("expecting %v bytes, got %v bytes", length, n)
+			}
+		}
+	})
+	t.Run("short buffer", func(t *testing.T) {
+		go sender.Write(make([]byte, 64))
+		_, err := receiver.Read(make([]byte, 32))
+		if err == nil {
+			t.Error("expecting error, got nil")
+		}
+	})
+}
+
+func TestGRPCConnMalformed(t *testing.T) {
+	l, r := net.Pipe()
+	receiver := &GRPCConn{Stream: r}
+	// the length of the bytes field is wrong
+	go l.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x03, 0x0a, 0x05, 0x01})
+	_, err := receiver.Read(make([]byte, 64))
+	if err != ErrMalformedGRPCMessage {
+		t.Errorf("expecting %v, got %v", ErrMalformedGRPCMessage, err)
+	}
+}
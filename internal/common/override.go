@@ -0,0 +1,183 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// ConfigField is a field of a configuration that can be set by an environment variable or on the command line
+type ConfigField struct {
+	Name string
+	// the environment variable that sets it
+	Env string
+	// how its value is written
+	Type string
+}
+
+// configStruct is the struct type that v points to
+func configStruct(v interface{}) reflect.Type {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// ConfigFields lists the fields that the configuration v points to has in JSON, with their environment variables
+// being the upper case names of the fields after envPrefix, e.g. CK_SERVER_BINDADDR
+func ConfigFields(v interface{}, envPrefix string) []ConfigField {
+	t := configStruct(v)
+	var fields []ConfigField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("json") == "-" || f.PkgPath != "" {
+			continue
+		}
+		fields = append(fields, ConfigField{
+			Name: f.Name,
+			Env:  envPrefix + strings.ToUpper(f.Name),
+			Type: valueType(f.Type),
+		})
+	}
+	return fields
+}
+
+// valueType describes how a value of type t is written in an environment variable or on the command line
+func valueType(t reflect.Type) string {
+	switch {
+	case t.Kind() == reflect.String:
+		return "string"
+	case t.Kind() == reflect.Bool:
+		return "bool"
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return "int"
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return "base64"
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.String:
+		return "comma separated list or JSON"
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Slice && t.Elem().Elem().Kind() == reflect.Uint8:
+		return "comma separated base64 or JSON"
+	default:
+		return "JSON"
+	}
+}
+
+// WriteConfigHelp writes the fields of the configuration v points to, their environment variables and how their
+// values are written to w, as a table
+func WriteConfigHelp(w io.Writer, v interface{}, envPrefix string) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tENVIRONMENT VARIABLE\tVALUE")
+	for _, field := range ConfigFields(v, envPrefix) {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", field.Name, field.Env, field.Type)
+	}
+	tw.Flush()
+}
+
+// ConfigEnv returns the values of the environment variables of the fields of the configuration v points to that are
+// set, by field name
+func ConfigEnv(v interface{}, envPrefix string, lookupEnv func(string) (string, bool)) map[string]string {
+	values := make(map[string]string)
+	for _, field := range ConfigFields(v, envPrefix) {
+		if value, ok := lookupEnv(field.Env); ok {
+			values[field.Name] = value
+		}
+	}
+	return values
+}
+
+// ConfigFlags is a flag that can be given many times to set fields of the configuration, as -set Field=value
+type ConfigFlags map[string]string
+
+func (f *ConfigFlags) String() string {
+	var pairs []string
+	for name, value := range *f {
+		pairs = append(pairs, name+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f *ConfigFlags) Set(pair string) error {
+	sp := strings.SplitN(pair, "=", 2)
+	if len(sp) != 2 || sp[0] == "" {
+		return fmt.Errorf("%v isn't in the form of Field=value", pair)
+	}
+	if *f == nil {
+		*f = make(ConfigFlags)
+	}
+	(*f)[sp[0]] = sp[1]
+	return nil
+}
+
+// OverrideConfig sets the fields of the configuration v points to to values, by field name regardless of case. Each
+// value is decoded as the field would be in JSON, from how ConfigFields describes it, and replaces what the field
+// had along with the fields in companions of it, which are those that are also set by it in JSON
+func OverrideConfig(v interface{}, values map[string]string, companions map[string][]string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	t := configStruct(v)
+	dst := reflect.ValueOf(v).Elem()
+	fields := make(map[string]reflect.Type)
+	for _, field := range ConfigFields(v, "") {
+		f, _ := t.FieldByName(field.Name)
+		fields[strings.ToLower(field.Name)] = f.Type
+	}
+	for name, value := range values {
+		ft, ok := fields[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown field %v", name)
+		}
+		f, _ := t.FieldByNameFunc(func(n string) bool { return strings.EqualFold(n, name) })
+		encoded, err := json.Marshal(map[string]json.RawMessage{f.Name: encodeValue(ft, value)})
+		if err != nil {
+			return fmt.Errorf("bad value of %v: %v", f.Name, err)
+		}
+		// decoding into a fresh configuration, rather than v, makes sure fields that would be added to, like lists
+		// of objects, are replaced
+		fresh := reflect.New(t)
+		if err = json.Unmarshal(encoded, fresh.Interface()); err != nil {
+			return fmt.Errorf("bad value of %v: %v", f.Name, err)
+		}
+		for _, n := range append([]string{f.Name}, companions[f.Name]...) {
+			dst.FieldByName(n).Set(fresh.Elem().FieldByName(n))
+		}
+	}
+	return nil
+}
+
+// encodeValue turns value into the JSON of a field of type t
+func encodeValue(t reflect.Type, value string) json.RawMessage {
+	trimmed := strings.TrimSpace(value)
+	quote := func(s string) json.RawMessage {
+		b, _ := json.Marshal(s)
+		return b
+	}
+	switch valueType(t) {
+	case "string":
+		// an object in place of a string, like RedirAddr's, is taken as it is
+		if strings.HasPrefix(trimmed, "{") {
+			return json.RawMessage(trimmed)
+		}
+		return quote(value)
+	case "base64":
+		return quote(trimmed)
+	case "comma separated list or JSON", "comma separated base64 or JSON":
+		if strings.HasPrefix(trimmed, "[") {
+			return json.RawMessage(trimmed)
+		}
+		var elems []json.RawMessage
+		for _, elem := range strings.Split(trimmed, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				elems = append(elems, quote(elem))
+			}
+		}
+		list, _ := json.Marshal(elems)
+		return list
+	default:
+		return json.RawMessage(trimmed)
+	}
+}
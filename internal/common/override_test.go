@@ -0,0 +1,89 @@
+package common
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type overrideConfig struct {
+	ServerName string
+	NumConn    int
+	UDP        bool
+	UID        []byte
+	Addrs      []string
+	BypassUID  [][]byte
+	Headers    map[string]string
+	Derived    string `json:"-"`
+}
+
+func TestConfigEnv(t *testing.T) {
+	env := map[string]string{"CK_TEST_SERVERNAME": "www.bing.com", "CK_TEST_DERIVED": "a", "NUMCONN": "4"}
+	values := ConfigEnv(&overrideConfig{}, "CK_TEST_", func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	})
+	if !reflect.DeepEqual(values, map[string]string{"ServerName": "www.bing.com"}) {
+		t.Errorf("wrong values from the environment %v", values)
+	}
+}
+
+func TestOverrideConfig(t *testing.T) {
+	config := overrideConfig{ServerName: "a", NumConn: 1, Addrs: []string{"x"}, Derived: "old"}
+	err := OverrideConfig(&config, map[string]string{
+		"servername": "www.bing.com",
+		"NumConn":    "4",
+		"UDP":        "true",
+		"UID":        "5nneblJy6lniPJfr81LuYQ==",
+		"Addrs":      "a, b",
+		"BypassUID":  "5nneblJy6lniPJfr81LuYQ==,5nneblJy6lniPJfr81LuYQ==",
+		"Headers":    `{"Host": "example.com"}`,
+	}, map[string][]string{"Addrs": {"Derived"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := overrideConfig{
+		ServerName: "www.bing.com",
+		NumConn:    4,
+		UDP:        true,
+		UID:        config.UID,
+		Addrs:      []string{"a", "b"},
+		BypassUID:  config.BypassUID,
+		Headers:    map[string]string{"Host": "example.com"},
+	}
+	if len(config.UID) != 16 || len(config.BypassUID) != 2 || !reflect.DeepEqual(config, want) {
+		t.Errorf("expecting %+v, got %+v", want, config)
+	}
+
+	if err = OverrideConfig(&config, map[string]string{"Addrs": `["c"]`}, nil); err != nil || len(config.Addrs) != 1 {
+		t.Errorf("a JSON list isn't taken as it is: %v %v", config.Addrs, err)
+	}
+
+	for name, value := range map[string]string{"NumConn": "four", "UID": "not base64", "Nonexistent": "a", "Derived": "a"} {
+		if err := OverrideConfig(&config, map[string]string{name: value}, nil); err == nil {
+			t.Errorf("expecting an error setting %v to %v", name, value)
+		}
+	}
+}
+
+func TestConfigFlags(t *testing.T) {
+	var flags ConfigFlags
+	if err := flags.Set("ProxyBook={\"a\": [\"tcp\", \"127.0.0.1:1\"]}"); err != nil {
+		t.Fatal(err)
+	}
+	if flags["ProxyBook"] != `{"a": ["tcp", "127.0.0.1:1"]}` {
+		t.Errorf("wrong value %v", flags["ProxyBook"])
+	}
+	if err := flags.Set("NumConn"); err == nil {
+		t.Error("expecting an error without a value")
+	}
+}
+
+func TestWriteConfigHelp(t *testing.T) {
+	var out bytes.Buffer
+	WriteConfigHelp(&out, &overrideConfig{}, "CK_TEST_")
+	if !strings.Contains(out.String(), "CK_TEST_BYPASSUID") || strings.Contains(out.String(), "Derived") {
+		t.Errorf("unexpected help %q", out.String())
+	}
+}
@@ -0,0 +1,13 @@
+package common
+
+import (
+	utls "github.com/refraction-networking/utls"
+)
+
+// Parrots are the uTLS presets of the browsers a client can pretend to be with BrowserSig. The server handshakes with
+// the redirection server using the same presets so that it knows how the cover site responds to each of them
+var Parrots = map[string]utls.ClientHelloID{
+	"chrome":  utls.HelloChrome_Auto,
+	"firefox": utls.HelloFirefox_Auto,
+	"safari":  utls.HelloSafari_Auto,
+}
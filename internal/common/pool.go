@@ -0,0 +1,25 @@
+package common
+
+import "sync"
+
+// BufferSize is the size of the buffers in the pool, which fit a record of the largest frame a session sends with
+// the default buffer sizes, along with its record layer
+const BufferSize = 20480
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, BufferSize)
+		return &buf
+	},
+}
+
+// GetBuffer takes a buffer of BufferSize from the pool. It's to be given back with PutBuffer once nothing refers
+// to it any more
+func GetBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+// PutBuffer gives a buffer from GetBuffer back to the pool
+func PutBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
@@ -0,0 +1,125 @@
+package common
+
+// Secrets are kept in pages of memory of their own, which on Linux are locked so that they aren't swapped out and are
+// left out of core dumps. They're zeroised once they're wiped, which is when what they're of is done with or the
+// process exits. What's copied out of them, such as the schedules of the ciphers keyed with them and the keys on the
+// stacks of handshakes, isn't, so they only keep what outlives a handshake from lingering
+
+import (
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the sizes of the slots secrets are kept in, the slots of a page being of one size. A secret larger than all of them
+// has pages of its own
+var secretSlotSizes = []int{32, 64, 128, 256, 512, 1024, 2048}
+
+var secrets = struct {
+	sync.Mutex
+	// the free slots of each size in secretSlotSizes
+	free [][][]byte
+	live map[*Secret]struct{}
+}{
+	free: make([][][]byte, len(secretSlotSizes)),
+	live: make(map[*Secret]struct{}),
+}
+
+// Secret is a key, or anything else that's secret, kept out of swap and core dumps until it's wiped
+type Secret struct {
+	m sync.RWMutex
+	// nil once it's wiped
+	b []byte
+	// the index of the size of its slot in secretSlotSizes, -1 if its pages are its own
+	class int
+}
+
+// NewSecret copies b into a Secret
+func NewSecret(b []byte) *Secret {
+	s := &Secret{class: -1}
+	for i, size := range secretSlotSizes {
+		if len(b) <= size {
+			s.class = i
+			break
+		}
+	}
+
+	secrets.Lock()
+	var slot []byte
+	if s.class == -1 {
+		pageSize := os.Getpagesize()
+		slot = allocSecretPages((len(b) + pageSize - 1) / pageSize * pageSize)
+	} else {
+		free := secrets.free[s.class]
+		if len(free) == 0 {
+			page := allocSecretPages(os.Getpagesize())
+			size := secretSlotSizes[s.class]
+			for i := 0; i+size <= len(page); i += size {
+				free = append(free, page[i:i+size:i+size])
+			}
+		}
+		slot = free[len(free)-1]
+		secrets.free[s.class] = free[:len(free)-1]
+	}
+	secrets.live[s] = struct{}{}
+	secrets.Unlock()
+
+	s.b = slot[:len(b)]
+	copy(s.b, b)
+	return s
+}
+
+// Use calls f with what's kept, which mustn't be kept by f. It doesn't call f and returns false if s has been wiped
+func (s *Secret) Use(f func(b []byte)) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.b == nil {
+		return false
+	}
+	f(s.b)
+	return true
+}
+
+// Wipe zeroises s once nothing is using it. It can't be used after
+func (s *Secret) Wipe() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.b == nil {
+		return
+	}
+	slot := s.b[:cap(s.b)]
+	clear(slot)
+	s.b = nil
+
+	secrets.Lock()
+	defer secrets.Unlock()
+	delete(secrets.live, s)
+	if s.class == -1 {
+		freeSecretPages(slot)
+	} else {
+		secrets.free[s.class] = append(secrets.free[s.class], slot)
+	}
+}
+
+// WipeSecrets wipes every Secret that hasn't been, for when the process is exiting
+func WipeSecrets() {
+	secrets.Lock()
+	live := make([]*Secret, 0, len(secrets.live))
+	for s := range secrets.live {
+		live = append(live, s)
+	}
+	secrets.Unlock()
+	for _, s := range live {
+		s.Wipe()
+	}
+}
+
+var warnUnlockedOnce sync.Once
+
+// warnUnlocked warns, once, that secrets can't be locked in memory
+func warnUnlocked(err error) {
+	warnUnlockedOnce.Do(func() {
+		log.Warnf("secrets can't be kept out of swap, raising the limit of locked memory (ulimit -l) may help: %v", err)
+	})
+}
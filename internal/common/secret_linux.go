@@ -0,0 +1,26 @@
+package common
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocSecretPages maps n bytes of pages that are locked and left out of core dumps
+func allocSecretPages(n int) []byte {
+	pages, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		// as the runtime would if it were out of memory
+		panic(fmt.Sprintf("unable to map pages for secrets: %v", err))
+	}
+	_ = unix.Madvise(pages, unix.MADV_DONTDUMP)
+	if err = unix.Mlock(pages); err != nil {
+		warnUnlocked(err)
+	}
+	return pages
+}
+
+func freeSecretPages(pages []byte) {
+	_ = unix.Munlock(pages)
+	_ = unix.Munmap(pages)
+}
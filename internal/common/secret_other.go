@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+// allocSecretPages can't lock what it allocates here, so secrets are only zeroised
+func allocSecretPages(n int) []byte { return make([]byte, n) }
+
+func freeSecretPages(pages []byte) {}
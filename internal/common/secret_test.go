@@ -0,0 +1,53 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecret(t *testing.T) {
+	t.Run("use and wipe", func(t *testing.T) {
+		key := bytes.Repeat([]byte{0x42}, 32)
+		s := NewSecret(key)
+		var kept []byte
+		if !s.Use(func(b []byte) { kept = b }) {
+			t.Fatal("a Secret that hasn't been wiped can't be used")
+		}
+		if !bytes.Equal(kept, key) {
+			t.Errorf("expecting %x, got %x", key, kept)
+		}
+		s.Wipe()
+		if !bytes.Equal(kept, make([]byte, 32)) {
+			t.Errorf("a wiped Secret isn't zeroised: %x", kept)
+		}
+		if s.Use(func(b []byte) { t.Error("a wiped Secret is used") }) {
+			t.Error("a wiped Secret can be used")
+		}
+		s.Wipe()
+	})
+
+	t.Run("sizes", func(t *testing.T) {
+		for _, size := range []int{0, 1, 32, 33, 2048, 5000} {
+			b := make([]byte, size)
+			for i := range b {
+				b[i] = byte(i)
+			}
+			s := NewSecret(b)
+			s.Use(func(kept []byte) {
+				if !bytes.Equal(kept, b) {
+					t.Errorf("a Secret of %v bytes isn't kept", size)
+				}
+			})
+			s.Wipe()
+		}
+	})
+
+	t.Run("WipeSecrets", func(t *testing.T) {
+		a := NewSecret([]byte("a"))
+		b := NewSecret(bytes.Repeat([]byte("b"), 100))
+		WipeSecrets()
+		if a.Use(func([]byte) {}) || b.Use(func([]byte) {}) {
+			t.Error("a Secret isn't wiped by WipeSecrets")
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// A share link carries what a client needs to connect to a server, to be handed to users as text or a QR code:
+//
+//	cloak://host:port?PublicKey=...&ServerName=...&Transport=...#name
+//
+// The query is made of fields of the client's configuration by name, written as for an environment variable (see
+// ConfigFields), and the fragment is a name for the server that's for people to read
+
+const ShareLinkScheme = "cloak"
+
+// ShareLink is a cloak:// link
+type ShareLink struct {
+	RemoteHost string
+	RemotePort string
+	// the fields of the client's configuration, by name
+	Fields map[string]string
+	Name   string
+}
+
+// String is the cloak:// URI of l, with the fields in alphabetical order
+func (l ShareLink) String() string {
+	query := url.Values{}
+	for name, value := range l.Fields {
+		query.Set(name, value)
+	}
+	u := url.URL{
+		Scheme:   ShareLinkScheme,
+		Host:     net.JoinHostPort(l.RemoteHost, l.RemotePort),
+		RawQuery: query.Encode(),
+		Fragment: l.Name,
+	}
+	return u.String()
+}
+
+// ParseShareLink parses a cloak:// URI. The port is 443 if it isn't given
+func ParseShareLink(uri string) (l ShareLink, err error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return l, err
+	}
+	if !strings.EqualFold(u.Scheme, ShareLinkScheme) {
+		return l, fmt.Errorf("%v isn't a %v:// link", uri, ShareLinkScheme)
+	}
+	l.RemoteHost = u.Hostname()
+	if l.RemoteHost == "" {
+		return l, errors.New("the link has no host")
+	}
+	l.RemotePort = u.Port()
+	if l.RemotePort == "" {
+		l.RemotePort = "443"
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return l, err
+	}
+	l.Fields = make(map[string]string)
+	for name, values := range query {
+		l.Fields[name] = values[len(values)-1]
+	}
+	l.Name = u.Fragment
+	return l, nil
+}
+
+// WriteQRCode writes content as a QR code to w, either as a PNG of size pixels across if png is set, or in ANSI
+// escape codes of background colours for a terminal, two spaces to a module
+func WriteQRCode(w io.Writer, content string, png bool, size int) error {
+	code, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		return err
+	}
+	if png {
+		b, err := code.PNG(size)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	const (
+		black = "\033[40m  \033[0m"
+		white = "\033[47m  \033[0m"
+	)
+	var b strings.Builder
+	for _, row := range code.Bitmap() {
+		for _, dark := range row {
+			if dark {
+				b.WriteString(black)
+			} else {
+				b.WriteString(white)
+			}
+		}
+		b.WriteByte('\n')
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,36 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShareLink(t *testing.T) {
+	link := ShareLink{
+		RemoteHost: "2001:db8::1",
+		RemotePort: "8443",
+		Fields:     map[string]string{"PublicKey": "IYoUzkle/T/kriE+Ufdm7AHQtIeGnBWbhhlTbmDpUUI=", "ServerName": "www.bing.com"},
+		Name:       "my server",
+	}
+	uri := link.String()
+	if uri != "cloak://[2001:db8::1]:8443?PublicKey=IYoUzkle%2FT%2FkriE%2BUfdm7AHQtIeGnBWbhhlTbmDpUUI%3D&ServerName=www.bing.com#my%20server" {
+		t.Errorf("unexpected link %v", uri)
+	}
+	parsed, err := ParseShareLink(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, link) {
+		t.Errorf("expecting %+v, got %+v", link, parsed)
+	}
+
+	parsed, err = ParseShareLink("CLOAK://example.com?ServerName=a")
+	if err != nil || parsed.RemotePort != "443" || parsed.Fields["ServerName"] != "a" {
+		t.Errorf("unexpected link %+v %v", parsed, err)
+	}
+	for _, uri := range []string{"ss://example.com", "cloak://?ServerName=a", "cloak://example.com?%zz"} {
+		if _, err := ParseShareLink(uri); err == nil {
+			t.Errorf("expecting an error for %v", uri)
+		}
+	}
+}
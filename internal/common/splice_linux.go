@@ -0,0 +1,120 @@
+package common
+
+import (
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// SplicePipe holds what's spliced from a socket until it's spliced to another, so that it isn't copied into user space
+// on the way
+type SplicePipe struct {
+	r, w int
+}
+
+// NewSplicePipe makes a SplicePipe, which must be closed once it's no longer used
+func NewSplicePipe() (*SplicePipe, error) {
+	var fds [2]int
+	if err := unix.Pipe2(fds[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	return &SplicePipe{r: fds[0], w: fds[1]}, nil
+}
+
+// Fill moves up to max bytes from src into the pipe, which must be empty, waiting until there's something to be read.
+// It returns io.EOF once src has been closed by the remote
+func (p *SplicePipe) Fill(src syscall.RawConn, max int) (n int, err error) {
+	rerr := src.Read(func(fd uintptr) bool {
+		// unix.Splice returns an int64 on 64-bit platforms and an int on 32-bit ones
+		moved, serr := unix.Splice(int(fd), nil, p.w, nil, max, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+		if err = serr; err == unix.EAGAIN {
+			return false
+		}
+		n = int(moved)
+		return true
+	})
+	if rerr != nil {
+		return 0, rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Read reads what's in the pipe, for when it can't be spliced to where it's going
+func (p *SplicePipe) Read(b []byte) (int, error) {
+	n, err := unix.Read(p.r, b)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (p *SplicePipe) Close() error {
+	unix.Close(p.w)
+	return unix.Close(p.r)
+}
+
+// WriteSpliced writes a record of head, n bytes spliced from p, and tail, with nothing else written to the connection
+// in between. It returns ErrSpliceUnsupported before anything is written if the connection isn't a socket
+func (tls *TLSConn) WriteSpliced(head []byte, p *SplicePipe, n int, tail []byte) (int, error) {
+	sc, ok := tls.Conn.(syscall.Conn)
+	if !ok {
+		return 0, ErrSpliceUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, ErrSpliceUnsupported
+	}
+	record := make([]byte, recordLayerLength+len(head))
+	putRecordLayer(record, ApplicationData, VersionTLS13, len(head)+n+len(tail))
+	copy(record[recordLayerLength:], head)
+
+	// the connection is locked for writing until all of it has been written, waiting for it to be writable whenever
+	// it's full
+	spliced := 0
+	werr := raw.Write(func(fd uintptr) bool {
+		for len(record) > 0 {
+			var wrote int
+			wrote, err = unix.Write(int(fd), record)
+			if err == unix.EAGAIN {
+				return false
+			} else if err != nil {
+				return true
+			}
+			record = record[wrote:]
+		}
+		for spliced < n {
+			moved, serr := unix.Splice(p.r, nil, int(fd), nil, n-spliced, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			if err = serr; err == unix.EAGAIN {
+				return false
+			} else if err != nil {
+				return true
+			}
+			spliced += int(moved)
+		}
+		for len(tail) > 0 {
+			var wrote int
+			wrote, err = unix.Write(int(fd), tail)
+			if err == unix.EAGAIN {
+				return false
+			} else if err != nil {
+				return true
+			}
+			tail = tail[wrote:]
+		}
+		return true
+	})
+	if werr != nil {
+		return 0, werr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(head) + n + len(tail), nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import "syscall"
+
+// SplicePipe can't be made here, so what's relayed is always copied through user space
+type SplicePipe struct{}
+
+func NewSplicePipe() (*SplicePipe, error) { return nil, ErrSpliceUnsupported }
+
+func (p *SplicePipe) Fill(src syscall.RawConn, max int) (int, error) { return 0, ErrSpliceUnsupported }
+
+func (p *SplicePipe) Read(b []byte) (int, error) { return 0, ErrSpliceUnsupported }
+
+func (p *SplicePipe) Close() error { return nil }
+
+func (tls *TLSConn) WriteSpliced(head []byte, p *SplicePipe, n int, tail []byte) (int, error) {
+	return 0, ErrSpliceUnsupported
+}
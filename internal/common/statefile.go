@@ -0,0 +1,64 @@
+package common
+
+// The files ck-server and ck-client keep their state in are replaced in one go, so that a crash, or another process
+// reading them at the same time, never sees them half written. A directory that's only to be used by one process at a
+// time, like the StateDir of ck-server, is held with an advisory lock on a file in it
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var ErrLocked = errors.New("locked by another process")
+
+// WriteFileAtomic replaces the file at path with what write writes, with perm. It's written to a temporary file in the
+// same directory, which is synced before being renamed over path
+func WriteFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	// it's gone already once it's been renamed
+	defer os.Remove(tmp.Name())
+	if err = write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// so that the rename survives a crash too. Directories can't be synced everywhere, e.g. on Windows
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// LockFile takes an advisory lock on the file at path, creating it if it doesn't exist, or returns ErrLocked straight
+// away if another process holds it. The lock is held until the returned file is closed, or the process exits, and
+// only keeps out others that take it with LockFile
+func LockFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
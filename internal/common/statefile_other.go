@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+// +build !unix,!windows
+
+package common
+
+import "os"
+
+// files can't be locked here, so nothing is kept out
+func lockFile(f *os.File) error { return nil }
@@ -0,0 +1,65 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	write := func(content string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}
+	}
+	if err := WriteFileAtomic(path, 0600, write("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, 0644, write("second")); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "second" {
+		t.Errorf("expecting the file to be replaced, got %q", content)
+	}
+	if info, _ := os.Stat(path); runtime.GOOS != "windows" && info.Mode().Perm() != 0644 {
+		t.Errorf("expecting mode 0644, got %v", info.Mode().Perm())
+	}
+
+	failed := errors.New("failed")
+	err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		io.WriteString(w, "half")
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expecting the error of write, got %v", err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "second" {
+		t.Errorf("file is changed by a write that failed: %q", content)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("temporary files are left behind: %v", entries)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	lock, err := LockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LockFile(path); err != ErrLocked {
+		t.Errorf("expecting %v while it's held, got %v", ErrLocked, err)
+	}
+	lock.Close()
+	again, err := LockFile(path)
+	if err != nil {
+		t.Fatalf("lock isn't let go of: %v", err)
+	}
+	again.Close()
+}
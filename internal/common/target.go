@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// A stream to a "direct" proxy method tells the server where to connect it by starting with the target address, in
+// the ATYP | ADDR | PORT format of SOCKS5 (RFC 1928). On a datagram stream, every datagram instead starts with the
+// address it is to, or from
+
+const (
+	AddrTypeIPv4   = 0x01
+	AddrTypeDomain = 0x03
+	AddrTypeIPv6   = 0x04
+)
+
+var ErrAddrType = errors.New("unsupported address type")
+
+// MarshalTarget encodes a host:port target address
+func MarshalTarget(target string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("bad port in %v: %v", target, err)
+	}
+	var ret []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("bad host in %v", target)
+		}
+		ret = append([]byte{AddrTypeDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		ret = append([]byte{AddrTypeIPv4}, ip4...)
+	} else {
+		ret = append([]byte{AddrTypeIPv6}, ip...)
+	}
+	return binary.BigEndian.AppendUint16(ret, uint16(port)), nil
+}
+
+// ReadTarget reads an encoded target address from r and returns it as host:port
+func ReadTarget(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp[0] {
+	case AddrTypeIPv4, AddrTypeIPv6:
+		addr := make([]byte, net.IPv4len)
+		if atyp[0] == AddrTypeIPv6 {
+			addr = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = net.IP(addr).String()
+	case AddrTypeDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		addr := make([]byte, l[0])
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return "", err
+		}
+		host = string(addr)
+	default:
+		return "", fmt.Errorf("%w %v", ErrAddrType, atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// SplitTarget splits a datagram into the target address it starts with and its payload
+func SplitTarget(datagram []byte) (target string, payload []byte, err error) {
+	r := bytes.NewReader(datagram)
+	target, err = ReadTarget(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errors.New("datagram is shorter than its target address")
+	}
+	if err != nil {
+		return
+	}
+	return target, datagram[len(datagram)-r.Len():], nil
+}
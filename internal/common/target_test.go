@@ -0,0 +1,58 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestTarget(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, target := range []string{"203.0.113.1:80", "[2001:db8::1]:443", "example.com:53"} {
+			encoded, err := MarshalTarget(target)
+			if err != nil {
+				t.Fatalf("marshalling %v: %v", target, err)
+			}
+			decoded, err := ReadTarget(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatalf("reading %v: %v", target, err)
+			}
+			if decoded != target {
+				t.Errorf("expecting %v, got %v", target, decoded)
+			}
+		}
+	})
+	t.Run("IPv4 encoding", func(t *testing.T) {
+		encoded, _ := MarshalTarget("203.0.113.1:80")
+		if !bytes.Equal(encoded, []byte{AddrTypeIPv4, 203, 0, 113, 1, 0x00, 0x50}) {
+			t.Errorf("unexpected encoding %x", encoded)
+		}
+	})
+	t.Run("bad targets", func(t *testing.T) {
+		for _, target := range []string{"example.com", "example.com:65536", ":80"} {
+			if _, err := MarshalTarget(target); err == nil {
+				t.Errorf("%q is marshalled", target)
+			}
+		}
+	})
+	t.Run("unsupported address type", func(t *testing.T) {
+		_, err := ReadTarget(bytes.NewReader([]byte{0x02, 0, 0}))
+		if !errors.Is(err, ErrAddrType) {
+			t.Errorf("expecting %v, got %v", ErrAddrType, err)
+		}
+	})
+	t.Run("split datagram", func(t *testing.T) {
+		datagram, _ := MarshalTarget("example.com:53")
+		datagram = append(datagram, "payload"...)
+		target, payload, err := SplitTarget(datagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != "example.com:53" || string(payload) != "payload" {
+			t.Errorf("unexpected target %v and payload %q", target, payload)
+		}
+		if _, _, err = SplitTarget(datagram[:5]); err == nil {
+			t.Error("truncated datagram is split")
+		}
+	})
+}
@@ -1,6 +1,8 @@
 package common
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/binary"
 	"io"
 	"net"
@@ -27,18 +29,27 @@ func AddRecordLayer(input []byte, typ byte, ver uint16) []byte {
 		ret = make([]byte, retLen)
 	}
 	copy(ret[recordLayerLength:], input)
-	ret[0] = typ
-	ret[1] = byte(ver >> 8)
-	ret[2] = byte(ver)
-	ret[3] = byte(msgLen >> 8)
-	ret[4] = byte(msgLen)
+	putRecordLayer(ret, typ, ver, msgLen)
 	return ret
 }
 
+func putRecordLayer(record []byte, typ byte, ver uint16, msgLen int) {
+	record[0] = typ
+	record[1] = byte(ver >> 8)
+	record[2] = byte(ver)
+	record[3] = byte(msgLen >> 8)
+	record[4] = byte(msgLen)
+}
+
 type TLSConn struct {
 	net.Conn
 }
 
+// NetConn is the connection the records are sent on
+func (tls *TLSConn) NetConn() net.Conn {
+	return tls.Conn
+}
+
 func (tls *TLSConn) LocalAddr() net.Addr {
 	return tls.Conn.LocalAddr()
 }
@@ -78,6 +89,18 @@ func (tls *TLSConn) Read(buffer []byte) (n int, err error) {
 }
 
 func (tls *TLSConn) Write(in []byte) (n int, err error) {
+	recordLen := len(in) + recordLayerLength
+	if cap(in) < recordLen && recordLen <= BufferSize {
+		// in has no room for the record layer, so rather than having a record made for every Write, it's put
+		// together in a buffer from the pool
+		buf := GetBuffer()
+		defer PutBuffer(buf)
+		record := (*buf)[:recordLen]
+		putRecordLayer(record, ApplicationData, VersionTLS13, len(in))
+		copy(record[recordLayerLength:], in)
+		n, err = tls.Conn.Write(record)
+		return n - recordLayerLength, err
+	}
 	// TODO: write record layer directly first?
 	toWrite := AddRecordLayer(in, ApplicationData, VersionTLS13)
 	n, err = tls.Conn.Write(toWrite)
@@ -87,3 +110,41 @@ func (tls *TLSConn) Write(in []byte) (n int, err error) {
 func (tls *TLSConn) Close() error {
 	return tls.Conn.Close()
 }
+
+// MaxTranscriptRecords is the maximum number of encrypted handshake records that may follow ServerHello and
+// ChangeCipherSpec
+const MaxTranscriptRecords = 8
+
+// RecordCountHint returns the 4 bytes that the server places at the end of the key share in its ServerHello to tell
+// the client how many encrypted handshake records follow. It is indistinguishable from random to anyone without
+// the shared secret
+func RecordCountHint(sharedSecret []byte, count int) []byte {
+	mac := hmac.New(sha256.New, sharedSecret)
+	mac.Write([]byte("record count"))
+	mac.Write([]byte{byte(count)})
+	return mac.Sum(nil)[:4]
+}
+
+// EarlySessionKey returns the session key of a client that sends frames right after its ClientHello, before the
+// server has sent it a session key. Both sides derive it from the shared secret of the handshake
+func EarlySessionKey(sharedSecret []byte) (key [32]byte) {
+	mac := hmac.New(sha256.New, sharedSecret)
+	mac.Write([]byte("early session key"))
+	copy(key[:], mac.Sum(nil))
+	return
+}
+
+// the tickets a server issues are all about the same length, which depends on how it makes them
+const (
+	minSessionTicketLength = 160
+	maxSessionTicketLength = 240
+)
+
+// SessionTicketLength returns the length of the fake session tickets the server with serverPub issues, which is the
+// same for all of them as a real server's would be, and which both sides work out without telling each other
+func SessionTicketLength(serverPub []byte) int {
+	mac := hmac.New(sha256.New, serverPub)
+	mac.Write([]byte("session ticket"))
+	sum := mac.Sum(nil)
+	return minSessionTicketLength + int(binary.BigEndian.Uint16(sum))%(maxSessionTicketLength-minSessionTicketLength)
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestTLSConn_ReadWrite(t *testing.T) {
+	tcpClient, tcpServer := tcpPair(t)
+	pipeClient, pipeServer := net.Pipe()
+	conns := map[string][2]net.Conn{
+		"tcp":  {tcpClient, tcpServer},
+		"pipe": {pipeClient, pipeServer},
+	}
+	for name, pair := range conns {
+		t.Run(name, func(t *testing.T) {
+			writer := &TLSConn{Conn: pair[0]}
+			reader := &TLSConn{Conn: pair[1]}
+			defer writer.Close()
+			defer reader.Close()
+
+			records := make([][]byte, 16)
+			for i := range records {
+				records[i] = make([]byte, rand.Intn(16000)+1)
+				rand.Read(records[i])
+			}
+			go func() {
+				for _, record := range records {
+					writer.Write(record)
+				}
+			}()
+
+			buf := make([]byte, 16384)
+			for i, record := range records {
+				n, err := reader.Read(buf)
+				if err != nil {
+					t.Fatalf("failed to read record %v: %v", i, err)
+				}
+				if !bytes.Equal(buf[:n], record) {
+					t.Fatalf("record %v doesn't match what's written", i)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTLSConn_Write(b *testing.B) {
+	client, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	writer := &TLSConn{Conn: client}
+	bufs := map[string][]byte{
+		// as the frames from a Stream have
+		"with spare capacity": make([]byte, 16384, 16384+recordLayerLength),
+		// as the shards of FEC have
+		"without spare capacity": make([]byte, 16384),
+	}
+	for name, buf := range bufs {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(buf)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writer.Write(buf)
+			}
+		})
+	}
+}
+
+func TestEarlySessionKey(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	key := EarlySessionKey(secret)
+	if key != EarlySessionKey(secret) {
+		t.Error("the early session key isn't the same for the same shared secret")
+	}
+	if bytes.Equal(key[:], secret) || key == ([32]byte{}) {
+		t.Error("the early session key isn't derived from the shared secret")
+	}
+	other := append([]byte{}, secret...)
+	other[0] ^= 1
+	if key == EarlySessionKey(other) {
+		t.Error("different shared secrets give the same early session key")
+	}
+}
+
+func TestSessionTicketLength(t *testing.T) {
+	pub := make([]byte, 32)
+	for i := 0; i < 100; i++ {
+		rand.Read(pub)
+		length := SessionTicketLength(pub)
+		if length < minSessionTicketLength || length >= maxSessionTicketLength {
+			t.Fatalf("ticket length %v is out of range", length)
+		}
+		if SessionTicketLength(pub) != length {
+			t.Fatal("ticket length isn't the same for the same server")
+		}
+	}
+}
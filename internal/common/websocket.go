@@ -4,6 +4,7 @@ import (
 	"errors"
 	"github.com/gorilla/websocket"
 	"io"
+	"net"
 	"sync"
 	"time"
 )
@@ -15,6 +16,11 @@ type WebSocketConn struct {
 	writeM sync.Mutex
 }
 
+// NetConn is the connection the WebSocket is on
+func (ws *WebSocketConn) NetConn() net.Conn {
+	return ws.UnderlyingConn()
+}
+
 func (ws *WebSocketConn) Write(data []byte) (int, error) {
 	ws.writeM.Lock()
 	err := ws.WriteMessage(websocket.BinaryMessage, data)
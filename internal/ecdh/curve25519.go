@@ -32,6 +32,7 @@ import (
 	"crypto"
 	"io"
 
+	"github.com/cbeuw/Cloak/internal/common"
 	"golang.org/x/crypto/curve25519"
 )
 
@@ -68,13 +69,35 @@ func Unmarshal(data []byte) (crypto.PublicKey, bool) {
 	return &pub, true
 }
 
+// GenerateSharedSecret returns the shared secret of privKey and pubKey, all 0s if privKey is a common.Secret that has
+// been wiped
 func GenerateSharedSecret(privKey crypto.PrivateKey, pubKey crypto.PublicKey) []byte {
-	var priv, pub, secret *[32]byte
+	var pub, secret *[32]byte
 
-	priv = privKey.(*[32]byte)
 	pub = pubKey.(*[32]byte)
 	secret = new([32]byte)
 
-	curve25519.ScalarMult(secret, priv, pub)
+	withPrivateKey(privKey, func(priv *[32]byte) {
+		curve25519.ScalarMult(secret, priv, pub)
+	})
 	return secret[:]
 }
+
+// PublicKey returns the public key of privKey
+func PublicKey(privKey crypto.PrivateKey) crypto.PublicKey {
+	pub := new([32]byte)
+	withPrivateKey(privKey, func(priv *[32]byte) {
+		curve25519.ScalarBaseMult(pub, priv)
+	})
+	return pub
+}
+
+// withPrivateKey calls f with privKey, which is either a *[32]byte or a *common.Secret of 32 bytes. f isn't called if
+// the common.Secret has been wiped
+func withPrivateKey(privKey crypto.PrivateKey, f func(priv *[32]byte)) {
+	if secret, ok := privKey.(*common.Secret); ok {
+		secret.Use(func(b []byte) { f((*[32]byte)(b)) })
+		return
+	}
+	f(privKey.(*[32]byte))
+}
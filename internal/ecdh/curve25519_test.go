@@ -33,6 +33,8 @@ import (
 	"crypto"
 	"crypto/rand"
 	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
 )
 
 func TestCurve25519(t *testing.T) {
@@ -88,3 +90,30 @@ func testECDH(t testing.TB) {
 		t.Fatalf("The two shared keys: %d, %d do not match", secret1, secret2)
 	}
 }
+
+func TestPublicKey(t *testing.T) {
+	priv, pub, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(Marshal(PublicKey(priv)), Marshal(pub)) {
+		t.Error("public key doesn't match the one generated with the private key")
+	}
+}
+
+func TestSecretPrivateKey(t *testing.T) {
+	privKey, pubKey, _ := GenerateKey(rand.Reader)
+	otherPriv, otherPub, _ := GenerateKey(rand.Reader)
+	secret := common.NewSecret(privKey.(*[32]byte)[:])
+
+	if !bytes.Equal(Marshal(PublicKey(secret)), Marshal(pubKey)) {
+		t.Error("the public key of a common.Secret doesn't match")
+	}
+	if !bytes.Equal(GenerateSharedSecret(secret, otherPub), GenerateSharedSecret(otherPriv, pubKey)) {
+		t.Error("the shared secret of a common.Secret doesn't match")
+	}
+	secret.Wipe()
+	if !bytes.Equal(GenerateSharedSecret(secret, otherPub), make([]byte, 32)) {
+		t.Error("a wiped common.Secret still agrees on a shared secret")
+	}
+}
@@ -0,0 +1,45 @@
+package ecdh
+
+import (
+	"crypto/mlkem"
+	"crypto/sha256"
+	"io"
+)
+
+// The hybrid key exchange X25519MLKEM768 (draft-ietf-tls-ecdhe-mlkem), as browsers do in TLS 1.3. The key share of
+// a ClientHello is an ML-KEM-768 encapsulation key followed by an x25519 public key, and the key share of a
+// ServerHello is an ML-KEM-768 ciphertext followed by an x25519 public key
+
+const (
+	MLKEMEncapsulationKeySize = mlkem.EncapsulationKeySize768
+	MLKEMCiphertextSize       = mlkem.CiphertextSize768
+)
+
+// GenerateMLKEMKey derives the ML-KEM-768 decapsulation key from a seed read from rand
+func GenerateMLKEMKey(rand io.Reader) (*mlkem.DecapsulationKey768, error) {
+	seed := make([]byte, mlkem.SeedSize)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, err
+	}
+	return mlkem.NewDecapsulationKey768(seed)
+}
+
+// Encapsulate generates a shared secret and the ciphertext of it for the marshalled encapsulation key
+func Encapsulate(encapsulationKey []byte) (sharedSecret []byte, ciphertext []byte, err error) {
+	ek, err := mlkem.NewEncapsulationKey768(encapsulationKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sharedSecret, ciphertext = ek.Encapsulate()
+	return sharedSecret, ciphertext, nil
+}
+
+// HybridSharedSecret combines the shared secrets of x25519 and ML-KEM, so that it stays secret as long as either of
+// them does
+func HybridSharedSecret(x25519Secret []byte, mlkemSecret []byte) (ret [32]byte) {
+	h := sha256.New()
+	h.Write(mlkemSecret)
+	h.Write(x25519Secret)
+	copy(ret[:], h.Sum(nil))
+	return
+}
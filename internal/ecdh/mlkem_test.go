@@ -0,0 +1,59 @@
+package ecdh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestMLKEM(t *testing.T) {
+	dk, err := GenerateMLKEMKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := dk.EncapsulationKey().Bytes()
+	if len(ek) != MLKEMEncapsulationKeySize {
+		t.Errorf("encapsulation key is %v bytes instead of %v", len(ek), MLKEMEncapsulationKeySize)
+	}
+
+	secret, ciphertext, err := Encapsulate(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphertext) != MLKEMCiphertextSize {
+		t.Errorf("ciphertext is %v bytes instead of %v", len(ciphertext), MLKEMCiphertextSize)
+	}
+	decapsulated, err := dk.Decapsulate(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret, decapsulated) {
+		t.Error("shared secrets don't match")
+	}
+
+	t.Run("deterministic with the same seed", func(t *testing.T) {
+		seed := make([]byte, 64)
+		dk1, _ := GenerateMLKEMKey(bytes.NewReader(seed))
+		dk2, _ := GenerateMLKEMKey(bytes.NewReader(seed))
+		if !bytes.Equal(dk1.EncapsulationKey().Bytes(), dk2.EncapsulationKey().Bytes()) {
+			t.Error("different keys from the same seed")
+		}
+	})
+	t.Run("bad encapsulation key", func(t *testing.T) {
+		_, _, err := Encapsulate(ek[:100])
+		if err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("hybrid secret depends on both", func(t *testing.T) {
+		x25519Secret := make([]byte, 32)
+		a := HybridSharedSecret(x25519Secret, secret)
+		x25519Secret[0] = 1
+		if a == HybridSharedSecret(x25519Secret, secret) {
+			t.Error("hybrid secret doesn't depend on the x25519 secret")
+		}
+		if a == HybridSharedSecret(make([]byte, 32), make([]byte, 32)) {
+			t.Error("hybrid secret doesn't depend on the ML-KEM secret")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package multiplex
+
+// Frames of streams are written to the connections by the Writes that send them, so a Write takes as long as the
+// connections take to carry what it's given, and nothing piles up in between. To keep the frames of many streams from
+// piling up waiting for their turn when the connections are congested, the payload of frames that a session has been
+// given but hasn't written yet is limited to MaxPendingSend. A Write that would go over waits until enough has been
+// written, or, on a stream set to be non-blocking, returns ErrWouldBlock. A frame is let through on its own however
+// large it is, so that a MaxPendingSend smaller than a frame doesn't stop the session.
+//
+// What a session holds in memory, waiting on the connections or on the application, is told by Buffered
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrWouldBlock is returned by a Write to a non-blocking stream that can't be sent yet, either because the connections
+// of its session are congested or because the remote hasn't read enough of what's been sent
+var ErrWouldBlock = errors.New("write would block")
+
+// the payload of frames a session can have waiting to be written if the configuration doesn't say
+const defaultMaxPendingSend = 1 << 20
+
+type sendBudget struct {
+	m sync.Mutex
+	// broadcast when what's pending goes down, or the session is closed
+	cond *sync.Cond
+	// the payload of frames being sent
+	pending int
+}
+
+// BufferedBytes is what a session holds in memory
+type BufferedBytes struct {
+	// the payload of frames of streams that are waiting to be written to a connection
+	Sending int
+	// frames that have been sent and are kept to be sent again if the session is resumed
+	Retained int
+	// frames waiting to be written on slower paths as duplicates
+	Duplicating int
+	// what's come on the ordered streams and hasn't been read off them yet
+	Receiving int
+}
+
+func (sesh *Session) initSendBudget() {
+	sesh.pending.cond = sync.NewCond(&sesh.pending.m)
+}
+
+// SetNonBlocking sets whether a Write returns ErrWouldBlock, with what it has sent so far, rather than waiting when
+// what it's given can't be sent yet. A non-blocking Write may still block on writing to a connection, but only for
+// what's been let through
+func (s *Stream) SetNonBlocking(nonBlocking bool) {
+	if nonBlocking {
+		atomic.StoreUint32(&s.nonBlocking, 1)
+	} else {
+		atomic.StoreUint32(&s.nonBlocking, 0)
+	}
+}
+
+func (s *Stream) blocks() bool { return atomic.LoadUint32(&s.nonBlocking) == 0 }
+
+// reserveSend waits until a frame of n bytes of payload can be sent without going over MaxPendingSend, or returns
+// ErrWouldBlock if it can't be straight away and block is false. It must be given back with releaseSend
+func (sesh *Session) reserveSend(n int, block bool) error {
+	b := &sesh.pending
+	b.m.Lock()
+	defer b.m.Unlock()
+	for b.pending > 0 && b.pending+n > sesh.MaxPendingSend {
+		if sesh.IsClosed() {
+			return ErrBrokenStream
+		}
+		if !block {
+			return ErrWouldBlock
+		}
+		b.cond.Wait()
+	}
+	b.pending += n
+	return nil
+}
+
+// releaseSend gives back what reserveSend has taken, once the frame has been written
+func (sesh *Session) releaseSend(n int) {
+	sesh.pending.m.Lock()
+	sesh.pending.pending -= n
+	sesh.pending.cond.Broadcast()
+	sesh.pending.m.Unlock()
+}
+
+// wakeSenders has the sends waiting for room check whether the session has been closed
+func (sesh *Session) wakeSenders() {
+	sesh.pending.m.Lock()
+	sesh.pending.cond.Broadcast()
+	sesh.pending.m.Unlock()
+}
+
+// Buffered returns how many bytes the session holds in memory, by what they're waiting on
+func (sesh *Session) Buffered() BufferedBytes {
+	var buffered BufferedBytes
+	sesh.pending.m.Lock()
+	buffered.Sending = sesh.pending.pending
+	sesh.pending.m.Unlock()
+
+	if r := sesh.resumption; r != nil {
+		r.retainedM.Lock()
+		buffered.Retained = r.size
+		r.retainedM.Unlock()
+	}
+
+	sesh.sb.paths.Range(func(_, pI interface{}) bool {
+		buffered.Duplicating += int(atomic.LoadInt64(&pI.(*path).queued))
+		return true
+	})
+
+	sesh.flow.m.Lock()
+	sesh.streams.Range(func(_, streamI interface{}) bool {
+		if s, ok := streamI.(*Stream); ok && s.flowControlled() {
+			buffered.Receiving += int(s.window.received - s.window.consumed)
+		}
+		return true
+	})
+	sesh.flow.m.Unlock()
+	return buffered
+}
@@ -0,0 +1,90 @@
+package multiplex
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	const window = 64 << 10
+
+	t.Run("waits for pending sends", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1)
+		defer clientSession.Close()
+		go func() {
+			if serverStream, err := serverSession.Accept(); err == nil {
+				io.Copy(io.Discard, serverStream)
+			}
+		}()
+		stream, _ := clientSession.OpenStream()
+		// as if the connections were congested with what other streams are sending
+		clientSession.reserveSend(clientSession.MaxPendingSend, true)
+		if got := clientSession.Buffered().Sending; got != clientSession.MaxPendingSend {
+			t.Errorf("expecting %v pending, got %v", clientSession.MaxPendingSend, got)
+		}
+
+		written := writeInBackground(stream, make([]byte, 1024))
+		select {
+		case <-written:
+			t.Fatal("wrote while the session had too much pending")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		clientSession.releaseSend(clientSession.MaxPendingSend)
+		select {
+		case n := <-written:
+			if n != 1024 {
+				t.Errorf("expecting 1024 written, got %v", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the write didn't go once what was pending had been sent")
+		}
+		if got := clientSession.Buffered().Sending; got != 0 {
+			t.Errorf("expecting nothing pending, got %v", got)
+		}
+	})
+
+	t.Run("non-blocking while congested", func(t *testing.T) {
+		clientSession, _, _ := makeSessionPair(1)
+		defer clientSession.Close()
+		stream, _ := clientSession.OpenStream()
+		stream.SetNonBlocking(true)
+		clientSession.reserveSend(clientSession.MaxPendingSend, true)
+		n, err := stream.Write(make([]byte, 1024))
+		if !errors.Is(err, ErrWouldBlock) || n != 0 {
+			t.Errorf("expecting nothing written with ErrWouldBlock, got %v with %v", n, err)
+		}
+		clientSession.releaseSend(clientSession.MaxPendingSend)
+		if _, err = stream.Write(make([]byte, 1024)); err != nil {
+			t.Errorf("expecting the write to go once the session isn't congested, got %v", err)
+		}
+	})
+
+	t.Run("non-blocking without a window", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withFlowControl(window, 4*window, true))
+		defer clientSession.Close()
+		if !waitFor(func() bool { return clientSession.peerStreamWindow() == window }, time.Second) {
+			t.Fatal("the server didn't tell its windows")
+		}
+		stream, _ := clientSession.OpenStream()
+		stream.SetNonBlocking(true)
+		n, err := stream.Write(make([]byte, 2*window))
+		if !errors.Is(err, ErrWouldBlock) || n != window {
+			t.Errorf("expecting the window written with ErrWouldBlock, got %v with %v", n, err)
+		}
+
+		// what's come and not been read is buffered by the server
+		if !waitFor(func() bool { return serverSession.Buffered().Receiving == window }, time.Second) {
+			t.Errorf("expecting %v buffered to be read, got %v", window, serverSession.Buffered().Receiving)
+		}
+		serverStream, _ := serverSession.Accept()
+		if _, err = io.ReadFull(serverStream, make([]byte, window)); err != nil {
+			t.Fatal(err)
+		}
+		if got := serverSession.Buffered().Receiving; got != 0 {
+			t.Errorf("expecting nothing buffered once read, got %v", got)
+		}
+	})
+}
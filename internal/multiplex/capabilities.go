@@ -0,0 +1,86 @@
+package multiplex
+
+// The client sends the version of the protocol it speaks in the last byte of its handshake, which older clients leave
+// as 0. A server that sees a client of version 1 or later tells it, in a C_CAPABILITIES frame as soon as the session
+// has a connection, its own version and which of the CAP_ capabilities it has for the session, so that the client can
+// use what the server has, and keep to what older servers take otherwise. Until the frame comes, or if it never does
+// because the server is older, the client takes it that the server has none of them.
+//
+// What the client has is told by the flags of its handshake, which the server uses likewise. A new feature that an
+// older peer would be broken by is given a CAP_ bit, or a flag, and only used once the other side has it
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ProtocolVersion is the version of the protocol spoken by this Cloak. It goes up when features are added that the
+// other side needs to know of
+const ProtocolVersion = 1
+
+// Capabilities of a server for a session
+const (
+	// it takes unreliable streams
+	CAP_UNRELIABLE = 1 << iota
+	// it decompresses frames, and compresses those it sends
+	CAP_COMPRESSION
+	// it answers C_REKEY frames
+	CAP_REKEY
+)
+
+type peerCapabilities struct {
+	// atomic. 0 until the remote has told them
+	version      uint32
+	capabilities uint32
+}
+
+// announceCapabilities tells the remote our version and capabilities, once, if it takes them
+func (sesh *Session) announceCapabilities() {
+	if !sesh.AnnounceCapabilities {
+		return
+	}
+	sesh.capabilitiesOnce.Do(func() { go sesh.sendCapabilities() })
+}
+
+func (sesh *Session) sendCapabilities() {
+	payload := []byte{ProtocolVersion}
+	payload = binary.BigEndian.AppendUint32(payload, sesh.Capabilities)
+	// so that sessions with different capabilities aren't told apart by the length of the frame
+	payload = append(payload, genRandomPadding()...)
+	obfsBuf, err := sesh.sessionFrame(C_CAPABILITIES, payload)
+	if err != nil {
+		log.Errorf("failed to make capabilities frame for session %v: %v", sesh.id, err)
+		return
+	}
+	if _, err = sesh.sb.send(obfsBuf, new(uint32)); err != nil {
+		log.Debugf("failed to send capabilities of session %v: %v", sesh.id, err)
+	}
+}
+
+// recvCapabilities takes the version and capabilities from a C_CAPABILITIES frame of the remote
+func (sesh *Session) recvCapabilities(frame *Frame) {
+	if len(frame.Payload) < 5 {
+		return
+	}
+	version := uint32(frame.Payload[0])
+	capabilities := binary.BigEndian.Uint32(frame.Payload[1:5])
+	atomic.StoreUint32(&sesh.peer.capabilities, capabilities)
+	atomic.StoreUint32(&sesh.peer.version, version)
+	log.Debugf("remote of session %v speaks version %v with capabilities %#x", sesh.id, version, capabilities)
+}
+
+// PeerCapabilities returns the protocol version and the CAP_ capabilities the remote has told, both 0 if it hasn't
+func (sesh *Session) PeerCapabilities() (version byte, capabilities uint32) {
+	return byte(atomic.LoadUint32(&sesh.peer.version)), atomic.LoadUint32(&sesh.peer.capabilities)
+}
+
+// peerHas is whether a feature of capability can be used with the remote. Without LearnsCapabilities, the remote is
+// known to have what's configured
+func (sesh *Session) peerHas(capability uint32) bool {
+	if !sesh.LearnsCapabilities {
+		return true
+	}
+	return atomic.LoadUint32(&sesh.peer.capabilities)&capability != 0
+}
@@ -0,0 +1,47 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+)
+
+// withCapabilities makes the client learn the capabilities of the server, which has CAP_UNRELIABLE and announces it
+// if announce
+func withCapabilities(announce bool) sessionPairOption {
+	return func(client, server *SessionConfig) {
+		client.UnreliableDatagrams, client.LearnsCapabilities = true, true
+		server.Capabilities, server.AnnounceCapabilities = CAP_UNRELIABLE, announce
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	t.Run("announced", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withCapabilities(true))
+		defer clientSession.Close()
+		defer serverSession.Close()
+		if !waitFor(func() bool { _, caps := clientSession.PeerCapabilities(); return caps != 0 }, time.Second) {
+			t.Fatal("the client wasn't told the capabilities of the server")
+		}
+		version, caps := clientSession.PeerCapabilities()
+		if version != ProtocolVersion || caps != CAP_UNRELIABLE {
+			t.Errorf("expecting version %v with %#x, got %v with %#x", ProtocolVersion, CAP_UNRELIABLE, version, caps)
+		}
+		stream, _ := clientSession.OpenDatagramStream()
+		if !stream.IsUnreliable() {
+			t.Error("the datagram stream isn't unreliable though the server has them")
+		}
+		if clientSession.peerHas(CAP_COMPRESSION) {
+			t.Error("the client takes it that the server has compression")
+		}
+	})
+
+	t.Run("older server", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withCapabilities(false))
+		defer clientSession.Close()
+		defer serverSession.Close()
+		stream, _ := clientSession.OpenDatagramStream()
+		if stream.IsUnreliable() || !stream.IsDatagram() {
+			t.Error("expecting a reliable datagram stream to a server that hasn't told its capabilities")
+		}
+	})
+}
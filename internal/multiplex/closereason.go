@@ -0,0 +1,67 @@
+package multiplex
+
+// With CloseReasons, the C_SESSION frame a session is closed with starts with why it's closed, so that the remote
+// can tell e.g. that its user has run out of credit from the connection dropping. Without it the frame is all padding,
+// which is what a remote that doesn't know about reasons expects. Both ends agree on it in the handshake.
+
+import (
+	"sync/atomic"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// the reasons are sent in the closing frame, so new ones must be added at the end
+const (
+	CLOSE_UNSPECIFIED = iota
+	CLOSE_EXPIRED
+	CLOSE_NO_CREDIT
+	CLOSE_KICKED
+)
+
+var closeReasonMsgs = map[byte]string{
+	CLOSE_EXPIRED:   "user has expired",
+	CLOSE_NO_CREDIT: "user has no credit left",
+	CLOSE_KICKED:    "user has been kicked",
+}
+
+// CloseFor closes the session like Close, telling the remote that it's closed for reason if it reads it
+func (sesh *Session) CloseFor(reason byte) error {
+	atomic.StoreUint32(&sesh.closeReason, uint32(reason))
+	return sesh.Close()
+}
+
+// CloseReason is the reason the remote gave for closing the session, CLOSE_UNSPECIFIED if it hasn't
+func (sesh *Session) CloseReason() byte {
+	return byte(atomic.LoadUint32(&sesh.remoteCloseReason))
+}
+
+func (sesh *Session) closingPayload() []byte {
+	pad := genRandomPadding()
+	if !sesh.CloseReasons {
+		if len(pad) == 0 {
+			// a frame can't be empty
+			pad = make([]byte, 1)
+			common.CryptoRandRead(pad)
+		}
+		return pad
+	}
+	return append([]byte{byte(atomic.LoadUint32(&sesh.closeReason))}, pad...)
+}
+
+// recvCloseReason takes the reason out of the closing frame from the remote
+func (sesh *Session) recvCloseReason(frame *Frame) {
+	if !sesh.CloseReasons || len(frame.Payload) == 0 {
+		sesh.SetTerminalMsg("Received a closing notification frame")
+		return
+	}
+	reason := frame.Payload[0]
+	atomic.StoreUint32(&sesh.remoteCloseReason, uint32(reason))
+	msg, ok := closeReasonMsgs[reason]
+	if !ok {
+		sesh.SetTerminalMsg("Received a closing notification frame")
+		return
+	}
+	log.Warnf("session %v is closed by the remote: %v", sesh.id, msg)
+	sesh.SetTerminalMsg("closed by the remote: " + msg)
+}
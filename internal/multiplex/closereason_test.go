@@ -0,0 +1,71 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+)
+
+// withCloseReasons tells whether the client reads the reasons a session is closed for, and whether the server sends
+// them
+func withCloseReasons(clientReads, serverSends bool) sessionPairOption {
+	return func(client, server *SessionConfig) {
+		client.CloseReasons, server.CloseReasons = clientReads, serverSends
+	}
+}
+
+func TestSession_CloseFor(t *testing.T) {
+	t.Run("reason is told", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withCloseReasons(true, true))
+		connectTCP(t, clientSession, serverSession)
+		serverSession.CloseFor(CLOSE_NO_CREDIT)
+		if !waitFor(clientSession.IsClosed, time.Second) {
+			t.Fatal("client session isn't closed")
+		}
+		if clientSession.CloseReason() != CLOSE_NO_CREDIT {
+			t.Errorf("expecting reason %v, got %v", CLOSE_NO_CREDIT, clientSession.CloseReason())
+		}
+		if clientSession.TerminalMsg() != "closed by the remote: "+closeReasonMsgs[CLOSE_NO_CREDIT] {
+			t.Errorf("unexpected terminal message %q", clientSession.TerminalMsg())
+		}
+	})
+
+	t.Run("plain close", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withCloseReasons(true, true))
+		connectTCP(t, clientSession, serverSession)
+		serverSession.Close()
+		if !waitFor(clientSession.IsClosed, time.Second) {
+			t.Fatal("client session isn't closed")
+		}
+		if clientSession.CloseReason() != CLOSE_UNSPECIFIED {
+			t.Errorf("expecting no reason, got %v", clientSession.CloseReason())
+		}
+	})
+
+	t.Run("remote without reasons", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withCloseReasons(false, false))
+		connectTCP(t, clientSession, serverSession)
+		serverSession.CloseFor(CLOSE_EXPIRED)
+		if !waitFor(clientSession.IsClosed, time.Second) {
+			t.Fatal("client session isn't closed")
+		}
+		if clientSession.CloseReason() != CLOSE_UNSPECIFIED {
+			t.Errorf("padding taken as reason %v", clientSession.CloseReason())
+		}
+	})
+}
+
+func TestClosingPayload(t *testing.T) {
+	sesh := setupSesh(false, emptyKey, E_METHOD_PLAIN)
+	// the padding is empty one time in 256, which a frame can't be
+	for i := 0; i < 2048; i++ {
+		if len(sesh.closingPayload()) == 0 {
+			t.Fatal("empty closing payload")
+		}
+	}
+
+	sesh.CloseReasons = true
+	sesh.closeReason = CLOSE_EXPIRED
+	if payload := sesh.closingPayload(); payload[0] != CLOSE_EXPIRED {
+		t.Errorf("expecting the payload to start with %v, got %v", CLOSE_EXPIRED, payload[0])
+	}
+}
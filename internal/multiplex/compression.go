@@ -0,0 +1,89 @@
+package multiplex
+
+// With Compression, the payload of each frame of a stream is compressed with zstd before it's obfuscated, if that
+// makes it smaller, which is marked in the upper bit of the byte of the length of its extra, as that's never more
+// than 16. Each frame is compressed on its own, so that it can be decompressed however frames are lost, resent or
+// reordered. A stream that sends frames that don't get smaller, e.g. because what it carries is encrypted already,
+// stops trying after a few of them in a row.
+//
+// Compressing what's encrypted after leaks how compressible it is by its length, which lets whoever controls part of
+// it guess the secrets next to it, as CRIME did with TLS. So it's off unless the client asks for it, and the server
+// only takes it up for the ProxyMethods it's configured for, which it tells the client with CAP_COMPRESSION. Either
+// side decompresses whatever frames come compressed
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// frames in a row that didn't get smaller, after which a stream stops compressing
+	incompressibleFrames = 8
+	// the upper bit of the byte of the extra length in the header
+	compressedBit = 0x80
+	// the most a frame can be decompressed to, so that a small frame can't be made to take up much memory
+	maxDecompressedLen = 1 << 20
+)
+
+var errDecompressedTooLong = errors.New("frame decompresses to too much")
+
+// EncodeAll and DecodeAll of these are safe to use at once
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEnc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+	zstdDec, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecompressedLen))
+}
+
+// compressFrame compresses the payload of f into the buffer of s if that makes it smaller, returning whether it has.
+// writingM of s must be held
+func (s *Stream) compressFrame(f *Frame) bool {
+	f.Compressed = false
+	if !s.compress || len(f.Payload) == 0 || !s.session.peerHas(CAP_COMPRESSION) {
+		return false
+	}
+	zstdOnce.Do(initZstd)
+	s.compressBuf = zstdEnc.EncodeAll(f.Payload, s.compressBuf[:0])
+	if len(s.compressBuf) >= len(f.Payload) {
+		s.incompressible++
+		if s.incompressible >= incompressibleFrames {
+			s.compress = false
+		}
+		return false
+	}
+	s.incompressible = 0
+	f.Payload = s.compressBuf
+	f.Compressed = true
+	return true
+}
+
+// decompressFrame replaces the payload of f with what it decompresses to, if it's been compressed
+func decompressFrame(f *Frame) error {
+	if !f.Compressed {
+		return nil
+	}
+	zstdOnce.Do(initZstd)
+	header := zstd.Header{}
+	if err := header.Decode(f.Payload); err != nil {
+		return err
+	}
+	if !header.HasFCS || header.FrameContentSize > maxDecompressedLen {
+		return errDecompressedTooLong
+	}
+	payload, err := zstdDec.DecodeAll(f.Payload, make([]byte, 0, header.FrameContentSize))
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxDecompressedLen {
+		return errDecompressedTooLong
+	}
+	f.Payload = payload
+	f.Compressed = false
+	return nil
+}
@@ -0,0 +1,81 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// withCompression makes the client compress what it sends. The server decompresses what comes compressed whether it
+// compresses or not
+func withCompression(compression bool) sessionPairOption {
+	return func(client, _ *SessionConfig) { client.Compression = compression }
+}
+
+func TestCompression(t *testing.T) {
+	text := bytes.Repeat([]byte("GET /index.html HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\n\r\n"), 2000)
+
+	t.Run("compressible", func(t *testing.T) {
+		clientSession, serverSession, pairs := makeSessionPair(1, withCompression(true))
+		defer clientSession.Close()
+		stream, _ := clientSession.OpenStream()
+		if _, err := stream.Write(text); err != nil {
+			t.Fatal(err)
+		}
+		serverStream, _ := serverSession.Accept()
+		got := make([]byte, len(text))
+		if _, err := io.ReadFull(serverStream, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, text) {
+			t.Error("what's read doesn't match what's written")
+		}
+		if written := atomic.LoadInt64(&pairs[0].clientConn.written); written >= int64(len(text))/4 {
+			t.Errorf("expecting %v bytes to be compressed to far less, got %v", len(text), written)
+		}
+	})
+
+	t.Run("off", func(t *testing.T) {
+		clientSession, _, pairs := makeSessionPair(1, withCompression(false))
+		defer clientSession.Close()
+		stream, _ := clientSession.OpenStream()
+		stream.Write(text)
+		if written := atomic.LoadInt64(&pairs[0].clientConn.written); written < int64(len(text)) {
+			t.Errorf("expecting %v bytes not to be compressed, got %v", len(text), written)
+		}
+	})
+
+	t.Run("incompressible", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withCompression(true))
+		defer clientSession.Close()
+		stream, _ := clientSession.OpenStream()
+		data := make([]byte, 32*clientSession.maxStreamUnitWrite)
+		rand.Read(data)
+		go stream.Write(data)
+		serverStream, _ := serverSession.Accept()
+		got := make([]byte, len(data))
+		if _, err := io.ReadFull(serverStream, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("what's read doesn't match what's written")
+		}
+		stream.writingM.Lock()
+		defer stream.writingM.Unlock()
+		if stream.compress {
+			t.Error("the stream kept compressing frames that didn't get smaller")
+		}
+	})
+
+	t.Run("too long decompressed", func(t *testing.T) {
+		enc, _ := zstd.NewWriter(nil)
+		f := &Frame{Payload: enc.EncodeAll(make([]byte, maxDecompressedLen+1), nil), Compressed: true}
+		if err := decompressFrame(f); err == nil {
+			t.Error("expecting a frame that decompresses to too much to be rejected")
+		}
+	})
+}
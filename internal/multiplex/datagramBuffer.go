@@ -19,6 +19,8 @@ type datagramBuffer struct {
 	rwCond    *sync.Cond
 	wtTimeout time.Duration
 	rDeadline time.Time
+	// if it's not 0, datagrams that would take what's buffered over it are dropped rather than waited for
+	lossyLimit int
 }
 
 func NewDatagramBuffer() *datagramBuffer {
@@ -28,6 +30,13 @@ func NewDatagramBuffer() *datagramBuffer {
 	return d
 }
 
+// newLossyDatagramBuffer makes a datagramBuffer that drops datagrams once limit bytes are waiting to be read
+func newLossyDatagramBuffer(limit int) *datagramBuffer {
+	d := NewDatagramBuffer()
+	d.lossyLimit = limit
+	return d
+}
+
 func (d *datagramBuffer) Read(target []byte) (int, error) {
 	d.rwCond.L.Lock()
 	defer d.rwCond.L.Unlock()
@@ -110,6 +119,9 @@ func (d *datagramBuffer) Write(f Frame) (toBeClosed bool, err error) {
 	if d.buf == nil {
 		d.buf = new(bytes.Buffer)
 	}
+	if d.lossyLimit != 0 && !d.closed && f.Closing == C_NOOP && d.buf.Len()+len(f.Payload) > d.lossyLimit {
+		return false, nil
+	}
 	for {
 		if d.closed {
 			return true, io.ErrClosedPipe
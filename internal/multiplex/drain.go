@@ -0,0 +1,55 @@
+package multiplex
+
+// A server about to go away tells the client of each session with a C_DRAIN frame, after which the client opens no
+// more streams on the session and makes a new one for what comes next, which a load balancer sends to another
+// server. The session is closed once the streams it already has are done. Only a client that has said in the
+// handshake that it takes C_DRAIN is sent one, as any other would take the frame for one of a stream.
+
+import (
+	"sync/atomic"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// Drain tells the remote to open no more streams on the session, if it takes C_DRAIN
+func (sesh *Session) Drain() error {
+	if !sesh.PeerDrains || sesh.IsClosed() {
+		return nil
+	}
+	pad := genRandomPadding()
+	if len(pad) == 0 {
+		// a frame can't be empty
+		pad = make([]byte, 1)
+		common.CryptoRandRead(pad)
+	}
+	frame, err := sesh.sessionFrame(C_DRAIN, pad)
+	if err != nil {
+		return err
+	}
+	sesh.sb.broadcast([][]byte{frame})
+	return nil
+}
+
+// IsDraining is whether the remote has said it's going away, so that no more streams are to be opened on the session
+func (sesh *Session) IsDraining() bool {
+	return atomic.LoadUint32(&sesh.draining) == 1
+}
+
+func (sesh *Session) recvDrain() {
+	if atomic.SwapUint32(&sesh.draining, 1) == 1 {
+		return
+	}
+	log.Infof("the server of session %v is draining, new connections will go to a new session", sesh.id)
+	if sesh.streamCount() == 0 {
+		sesh.closeDrained()
+	}
+}
+
+// closeDrained closes the session, which is draining, once it has no streams left
+func (sesh *Session) closeDrained() {
+	if !sesh.IsClosed() {
+		sesh.SetTerminalMsg("the server is draining")
+		sesh.Close()
+	}
+}
@@ -0,0 +1,57 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+)
+
+// withPeerDrains tells the server whether the client drains its session
+func withPeerDrains(peerDrains bool) sessionPairOption {
+	return func(_, server *SessionConfig) { server.PeerDrains = peerDrains }
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("stream carries on until closed", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withPeerDrains(true))
+		go serveEcho(serverSession)
+		stream, _ := clientSession.OpenStream()
+		echo(t, stream, []byte("hello"))
+
+		if err := serverSession.Drain(); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(clientSession.IsDraining, time.Second) {
+			t.Fatal("the client wasn't told the server is draining")
+		}
+		echo(t, stream, []byte("hello again"))
+		if clientSession.IsClosed() {
+			t.Fatal("a draining session closed while it still had a stream")
+		}
+
+		stream.Close()
+		if !waitFor(func() bool { return clientSession.IsClosed() && serverSession.IsClosed() }, time.Second) {
+			t.Error("a draining session wasn't closed after its last stream")
+		}
+		if serverSession.streamCount() != 0 {
+			t.Error("the drain frame was taken as a stream")
+		}
+	})
+
+	t.Run("idle session is closed", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withPeerDrains(true))
+		serverSession.Drain()
+		if !waitFor(func() bool { return clientSession.IsClosed() && serverSession.IsClosed() }, time.Second) {
+			t.Error("a draining session without streams wasn't closed")
+		}
+	})
+
+	t.Run("not sent to a peer that doesn't take it", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withPeerDrains(false))
+		defer clientSession.Close()
+		serverSession.Drain()
+		time.Sleep(100 * time.Millisecond)
+		if clientSession.IsDraining() || clientSession.IsClosed() {
+			t.Error("the drain frame was sent to a peer that didn't say it takes it")
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package multiplex
+
+// With forward error correction, the frames sent on a session are grouped into blocks of up to dataShards, and
+// parityShards frames of parity are sent after each block, on whichever connections. A frame is passed on as soon as
+// it arrives, and missing ones are recovered once enough of the rest of their block has arrived, so a frame lost
+// with a connection doesn't hold the others up for long.
+//
+// Every frame is prefixed with the id of its block and its index in it. A parity frame also has how many frames of
+// data its block has, as a block is cut short if it doesn't fill within fecFlushInterval:
+//
+//	data:   | block id u32 | index u8 | obfuscated frame |
+//	parity: | block id u32 | index u8 | data shards u8 | parity |
+//
+// Each data shard is the length of its frame as u16 followed by the frame, and the shorter ones are padded with 0s to
+// the length of the longest.
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// MaxFECShards is the most data or parity shards a block can have
+const MaxFECShards = 128
+
+const (
+	fecDataHeaderLen   = 5
+	fecParityHeaderLen = 6
+	// the most a frame can grow by: the parity header and the length in the shard
+	fecOverhead = fecParityHeaderLen + 2
+
+	// how long a block that isn't full waits for more frames before its parity is sent
+	fecFlushInterval = 20 * time.Millisecond
+	// how many blocks behind the latest a block can be, to have its frames recovered
+	fecBlockWindow = 64
+)
+
+var errBadFECShard = errors.New("malformed FEC shard")
+
+type fecEncoder struct {
+	dataShards int
+	rs         *reedSolomon
+	// sends the parity shards of a block that wasn't full
+	sendParity func([][]byte)
+
+	m      sync.Mutex
+	block  uint32
+	shards [][]byte
+	timer  *time.Timer
+}
+
+func makeFECEncoder(dataShards, parityShards int, sendParity func([][]byte)) *fecEncoder {
+	return &fecEncoder{
+		dataShards: dataShards,
+		rs:         makeReedSolomon(dataShards, parityShards),
+		sendParity: sendParity,
+	}
+}
+
+// encode makes the shard of frame, and the parity shards of its block if it fills the block
+func (enc *fecEncoder) encode(frame []byte) (shard []byte, parity [][]byte) {
+	enc.m.Lock()
+	defer enc.m.Unlock()
+
+	shard = make([]byte, fecDataHeaderLen+len(frame))
+	binary.BigEndian.PutUint32(shard, enc.block)
+	shard[4] = byte(len(enc.shards))
+	copy(shard[fecDataHeaderLen:], frame)
+
+	data := make([]byte, 2+len(frame))
+	binary.BigEndian.PutUint16(data, uint16(len(frame)))
+	copy(data[2:], frame)
+	enc.shards = append(enc.shards, data)
+
+	if len(enc.shards) == enc.dataShards {
+		if enc.timer != nil {
+			enc.timer.Stop()
+		}
+		return shard, enc.finishBlock()
+	}
+	if len(enc.shards) == 1 {
+		block := enc.block
+		enc.timer = time.AfterFunc(fecFlushInterval, func() { enc.flush(block) })
+	}
+	return shard, nil
+}
+
+// flush finishes block if it's still waiting for frames
+func (enc *fecEncoder) flush(block uint32) {
+	enc.m.Lock()
+	if enc.block != block || len(enc.shards) == 0 {
+		enc.m.Unlock()
+		return
+	}
+	parity := enc.finishBlock()
+	enc.m.Unlock()
+	enc.sendParity(parity)
+}
+
+// finishBlock makes the parity shards of the current block and starts the next one. Must hold m
+func (enc *fecEncoder) finishBlock() [][]byte {
+	rs := enc.rs
+	if len(enc.shards) != enc.dataShards {
+		rs = makeReedSolomon(len(enc.shards), enc.rs.parityShards)
+	}
+	var shardLen int
+	for _, s := range enc.shards {
+		if len(s) > shardLen {
+			shardLen = len(s)
+		}
+	}
+	for i, s := range enc.shards {
+		if len(s) < shardLen {
+			padded := make([]byte, shardLen)
+			copy(padded, s)
+			enc.shards[i] = padded
+		}
+	}
+
+	parity := rs.encode(enc.shards)
+	records := make([][]byte, len(parity))
+	for i, p := range parity {
+		records[i] = make([]byte, fecParityHeaderLen+len(p))
+		binary.BigEndian.PutUint32(records[i], enc.block)
+		records[i][4] = byte(enc.dataShards + i)
+		records[i][5] = byte(len(enc.shards))
+		copy(records[i][fecParityHeaderLen:], p)
+	}
+	enc.block++
+	enc.shards = nil
+	return records
+}
+
+type fecBlock struct {
+	// 0 until a parity shard has arrived
+	dataShards int
+	data       [MaxFECShards][]byte
+	parity     [MaxFECShards][]byte
+	// whether each data shard has been passed on, and whether all of them have
+	passedOn [MaxFECShards]bool
+	done     bool
+}
+
+type fecDecoder struct {
+	dataShards   int
+	parityShards int
+
+	m      sync.Mutex
+	blocks map[uint32]*fecBlock
+	latest uint32
+}
+
+func makeFECDecoder(dataShards, parityShards int) *fecDecoder {
+	return &fecDecoder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		blocks:       make(map[uint32]*fecBlock),
+	}
+}
+
+func (dec *fecDecoder) getBlock(id uint32) *fecBlock {
+	if b, ok := dec.blocks[id]; ok {
+		return b
+	}
+	if int32(id-dec.latest) > 0 {
+		dec.latest = id
+		for old := range dec.blocks {
+			if dec.latest-old >= fecBlockWindow {
+				delete(dec.blocks, old)
+			}
+		}
+	} else if dec.latest-id >= fecBlockWindow {
+		return nil
+	}
+	b := &fecBlock{}
+	dec.blocks[id] = b
+	return b
+}
+
+// decode takes a shard and returns the frames it makes available: its own if it's a data shard, and any recovered
+func (dec *fecDecoder) decode(shard []byte) ([][]byte, error) {
+	if len(shard) < fecDataHeaderLen {
+		return nil, errBadFECShard
+	}
+	id := binary.BigEndian.Uint32(shard)
+	index := int(shard[4])
+	if index >= dec.dataShards+dec.parityShards {
+		return nil, errBadFECShard
+	}
+
+	dec.m.Lock()
+	defer dec.m.Unlock()
+	b := dec.getBlock(id)
+
+	var frames [][]byte
+	if index < dec.dataShards {
+		frame := shard[fecDataHeaderLen:]
+		if b == nil {
+			// too old to be kept, but it's still a frame
+			return [][]byte{frame}, nil
+		}
+		if b.passedOn[index] {
+			return nil, nil
+		}
+		b.passedOn[index] = true
+		frames = append(frames, frame)
+		if b.done {
+			return frames, nil
+		}
+		data := make([]byte, 2+len(frame))
+		binary.BigEndian.PutUint16(data, uint16(len(frame)))
+		copy(data[2:], frame)
+		b.data[index] = data
+	} else {
+		if len(shard) < fecParityHeaderLen {
+			return nil, errBadFECShard
+		}
+		dataShards := int(shard[5])
+		if dataShards == 0 || dataShards > dec.dataShards || (b != nil && b.dataShards != 0 && b.dataShards != dataShards) {
+			return nil, errBadFECShard
+		}
+		if b == nil || b.done {
+			return nil, nil
+		}
+		b.dataShards = dataShards
+		b.parity[index-dec.dataShards] = append([]byte(nil), shard[fecParityHeaderLen:]...)
+	}
+
+	recovered, err := b.recover(dec.parityShards)
+	return append(frames, recovered...), err
+}
+
+// recover returns the frames of the block that haven't arrived, if enough of its shards have
+func (b *fecBlock) recover(parityShards int) ([][]byte, error) {
+	if b.dataShards == 0 {
+		return nil, nil
+	}
+	var have, missing int
+	for _, p := range b.parity[:parityShards] {
+		if p != nil {
+			have++
+		}
+	}
+	for j := 0; j < b.dataShards; j++ {
+		if b.data[j] != nil {
+			have++
+		} else {
+			missing++
+		}
+	}
+	if missing == 0 {
+		b.finish()
+		return nil, nil
+	}
+	if have < b.dataShards {
+		return nil, nil
+	}
+
+	var shardLen int
+	for _, p := range b.parity[:parityShards] {
+		if p != nil {
+			shardLen = len(p)
+		}
+	}
+	data := make([][]byte, b.dataShards)
+	for j := range data {
+		if b.data[j] == nil {
+			continue
+		}
+		if len(b.data[j]) > shardLen {
+			return nil, errBadFECShard
+		}
+		data[j] = make([]byte, shardLen)
+		copy(data[j], b.data[j])
+	}
+	parity := make([][]byte, parityShards)
+	for i := range parity {
+		if p := b.parity[i]; p != nil && len(p) == shardLen {
+			parity[i] = p
+		}
+	}
+	if err := makeReedSolomon(b.dataShards, parityShards).reconstruct(data, parity); err != nil {
+		return nil, err
+	}
+
+	var frames [][]byte
+	for j := 0; j < b.dataShards; j++ {
+		if b.passedOn[j] {
+			continue
+		}
+		frameLen := int(binary.BigEndian.Uint16(data[j]))
+		if 2+frameLen > len(data[j]) {
+			b.finish()
+			return frames, errBadFECShard
+		}
+		b.passedOn[j] = true
+		frames = append(frames, data[j][2:2+frameLen])
+	}
+	b.finish()
+	return frames, nil
+}
+
+// finish lets go of the shards of a block that won't be needed any more
+func (b *fecBlock) finish() {
+	b.done = true
+	b.data = [MaxFECShards][]byte{}
+	b.parity = [MaxFECShards][]byte{}
+}
@@ -0,0 +1,155 @@
+package multiplex
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFEC(t *testing.T) {
+	const dataShards, parityShards = 4, 2
+	frames := make([][]byte, dataShards)
+	for i := range frames {
+		frames[i] = make([]byte, 100+rand.Intn(100))
+		rand.Read(frames[i])
+	}
+	encodeBlock := func(enc *fecEncoder) (shards [][]byte) {
+		for _, frame := range frames {
+			shard, parity := enc.encode(frame)
+			shards = append(shards, shard)
+			shards = append(shards, parity...)
+		}
+		return
+	}
+
+	t.Run("lost frames recovered", func(t *testing.T) {
+		enc := makeFECEncoder(dataShards, parityShards, nil)
+		dec := makeFECDecoder(dataShards, parityShards)
+		shards := encodeBlock(enc)
+		if len(shards) != dataShards+parityShards {
+			t.Fatalf("expecting %v shards, got %v", dataShards+parityShards, len(shards))
+		}
+
+		var got [][]byte
+		// the first and the third frames are lost
+		for _, shard := range append(shards[1:2], shards[3:]...) {
+			recovered, err := dec.decode(shard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, recovered...)
+		}
+		if len(got) != dataShards {
+			t.Fatalf("expecting %v frames, got %v", dataShards, len(got))
+		}
+		for _, frame := range frames {
+			found := false
+			for _, g := range got {
+				found = found || bytes.Equal(g, frame)
+			}
+			if !found {
+				t.Error("a frame isn't recovered")
+			}
+		}
+
+		// a lost frame turning up late isn't passed on again
+		if late, _ := dec.decode(shards[0]); len(late) != 0 {
+			t.Error("recovered frame passed on twice")
+		}
+	})
+
+	t.Run("short block flushed", func(t *testing.T) {
+		flushed := make(chan [][]byte, 1)
+		enc := makeFECEncoder(dataShards, parityShards, func(parity [][]byte) { flushed <- parity })
+		dec := makeFECDecoder(dataShards, parityShards)
+		shard, parity := enc.encode(frames[0])
+		if parity != nil {
+			t.Fatal("parity sent before the block is full")
+		}
+		select {
+		case parity = <-flushed:
+		case <-time.After(time.Second):
+			t.Fatal("block not flushed")
+		}
+		got, err := dec.decode(parity[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || !bytes.Equal(got[0], frames[0]) {
+			t.Error("frame of a short block not recovered from parity")
+		}
+		if late, _ := dec.decode(shard); len(late) != 0 {
+			t.Error("recovered frame passed on twice")
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		dec := makeFECDecoder(dataShards, parityShards)
+		for _, shard := range [][]byte{
+			{0, 0},
+			{0, 0, 0, 0, dataShards + parityShards},
+			{0, 0, 0, 0, dataShards, 0, 1},
+			{0, 0, 0, 0, dataShards, dataShards + 1, 1},
+		} {
+			if _, err := dec.decode(shard); err != errBadFECShard {
+				t.Errorf("%x: expecting %v, got %v", shard, errBadFECShard, err)
+			}
+		}
+	})
+}
+
+func TestSession_FEC(t *testing.T) {
+	for _, unordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("unordered %v", unordered), func(t *testing.T) {
+			clientSession, serverSession, pairs := makeSessionPair(1, func(client, server *SessionConfig) {
+				for _, config := range []*SessionConfig{client, server} {
+					config.Unordered = unordered
+					config.FECDataShards, config.FECParityShards = 10, 3
+				}
+			})
+			atomic.StoreUint32(&pairs[0].clientConn.dropEvery, 7)
+
+			stream, err := clientSession.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent := make([][]byte, 100)
+			for i := range sent {
+				sent[i] = make([]byte, 1000)
+				rand.Read(sent[i])
+				if _, err = stream.Write(sent[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			accepted, err := serverSession.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := make(map[string]bool)
+			buf := make([]byte, 1000)
+			accepted.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for len(received) < len(sent) {
+				if unordered {
+					n, err := accepted.Read(buf)
+					if err != nil {
+						t.Fatalf("received %v of %v: %v", len(received), len(sent), err)
+					}
+					received[string(buf[:n])] = true
+					continue
+				}
+				if _, err := io.ReadFull(accepted, buf); err != nil {
+					t.Fatalf("received %v of %v: %v", len(received), len(sent), err)
+				}
+				if !bytes.Equal(buf, sent[len(received)]) {
+					t.Fatalf("frame %v received wrong", len(received))
+				}
+				received[string(buf)] = true
+			}
+		})
+	}
+}
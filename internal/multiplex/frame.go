@@ -4,11 +4,42 @@ const (
 	C_NOOP = iota
 	C_STREAM
 	C_SESSION
+	// how far each stream has been received, of a resumable session. C_RESUME also asks for what's unacknowledged
+	// to be sent again
+	C_ACK
+	C_RESUME
+	// sent on every connection every Heartbeat to show the sender is still there
+	C_HEARTBEAT
+	// a dummy frame of a traffic profile, which is dropped
+	C_PADDING
+	// the server is going away, so the client is to open new sessions elsewhere
+	C_DRAIN
+	// how far the remote can send on a stream, or on the session
+	C_WINDOW
+	// the protocol version and capabilities of the server
+	C_CAPABILITIES
+	// an ephemeral key of a key exchange to move on to the next epoch of payload keys
+	C_REKEY
+)
+
+// Stream types. A datagram stream preserves the boundaries of what is written to it, like a stream of an unordered
+// session does, but it can also be opened in an ordered session, e.g. to carry UDP next to TCP. A control stream is
+// between the client and the server themselves rather than to the proxy server, and preserves boundaries too. An
+// unreliable stream is a datagram stream whose datagrams can be dropped
+const (
+	T_STREAM = iota
+	T_DATAGRAM
+	T_CONTROL
+	T_UNRELIABLE
 )
 
 type Frame struct {
-	StreamID uint32
-	Seq      uint64
-	Closing  uint8
-	Payload  []byte
+	StreamID   uint32
+	Seq        uint64
+	Closing    uint8
+	StreamType uint8
+	Priority   uint8
+	Payload    []byte
+	// whether Payload is compressed
+	Compressed bool
 }
@@ -0,0 +1,59 @@
+package multiplex
+
+// With a Heartbeat, a C_HEARTBEAT frame is sent on every connection of a session that often, so that a NAT or a
+// firewall in between doesn't drop the connections of an idle session, and so that a remote that has gone away is
+// found out about without waiting for TCP to time out. A connection that has had nothing to read, heartbeats
+// included, for missedHeartbeats of them is deemed dead and closed, and dealt with as any connection that drops. Both
+// ends of the session send heartbeats at the same interval, which they agree on in the handshake.
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// a connection that has missed this many heartbeats in a row is dead
+const missedHeartbeats = 3
+
+func (sesh *Session) heartbeatFrame() ([]byte, error) {
+	pad := genRandomPadding()
+	if len(pad) == 0 {
+		// a frame can't be empty
+		pad = make([]byte, 1)
+		common.CryptoRandRead(pad)
+	}
+	return sesh.sessionFrame(C_HEARTBEAT, pad)
+}
+
+func (sesh *Session) monitorHeartbeat() {
+	ticker := time.NewTicker(sesh.Heartbeat)
+	defer ticker.Stop()
+	deadAfter := missedHeartbeats * sesh.Heartbeat
+	for range ticker.C {
+		if sesh.IsClosed() {
+			return
+		}
+		frame, err := sesh.heartbeatFrame()
+		if err != nil {
+			log.Errorf("failed to make heartbeat for session %v: %v", sesh.id, err)
+			return
+		}
+		sesh.sb.broadcast([][]byte{frame})
+
+		now := time.Now()
+		sesh.sb.lastReads.Range(func(idI, lastI interface{}) bool {
+			if now.Sub(time.Unix(0, atomic.LoadInt64(lastI.(*int64)))) <= deadAfter {
+				return true
+			}
+			if connI, ok := sesh.sb.conns.Load(idI); ok {
+				log.Infof("a connection of session %v has had nothing to read for %v, closing it", sesh.id, deadAfter)
+				// which its deplex sees as the connection dropping
+				connI.(net.Conn).Close()
+			}
+			return true
+		})
+	}
+}
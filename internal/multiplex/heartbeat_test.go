@@ -0,0 +1,49 @@
+package multiplex
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withHeartbeat makes both sessions send heartbeats every heartbeat
+func withHeartbeat(heartbeat time.Duration) sessionPairOption {
+	return func(client, server *SessionConfig) { client.Heartbeat, server.Heartbeat = heartbeat, heartbeat }
+}
+
+func TestHeartbeat(t *testing.T) {
+	const heartbeat = 100 * time.Millisecond
+
+	t.Run("idle session is kept", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withHeartbeat(heartbeat))
+		defer clientSession.Close()
+		time.Sleep(2 * missedHeartbeats * heartbeat)
+		if clientSession.IsClosed() || serverSession.IsClosed() {
+			t.Fatal("idle session closed despite heartbeats")
+		}
+		if serverSession.streamCount() != 0 || clientSession.streamCount() != 0 {
+			t.Error("heartbeats taken as streams")
+		}
+	})
+
+	t.Run("dead peer is found", func(t *testing.T) {
+		clientSession, serverSession, pairs := makeSessionPair(1, withHeartbeat(heartbeat))
+		// as if the network between them has gone, without either connection being closed
+		atomic.StoreUint32(&pairs[0].clientConn.losing, 1)
+		atomic.StoreUint32(&pairs[0].serverConn.losing, 1)
+		if !waitFor(func() bool { return clientSession.IsClosed() && serverSession.IsClosed() }, 2*missedHeartbeats*heartbeat+time.Second) {
+			t.Error("sessions not closed after the remote stopped sending heartbeats")
+		}
+	})
+
+	t.Run("stream carries on", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withHeartbeat(heartbeat))
+		defer clientSession.Close()
+		go serveEcho(serverSession)
+		stream, _ := clientSession.OpenStream()
+		for i := 0; i < 5; i++ {
+			echo(t, stream, []byte("hello"))
+			time.Sleep(heartbeat)
+		}
+	})
+}
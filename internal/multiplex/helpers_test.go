@@ -0,0 +1,134 @@
+package multiplex
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+)
+
+// testConn is a connection of a session in the tests. It counts what's written to it, and can drop it
+type testConn struct {
+	net.Conn
+	writes  uint32
+	written int64
+	// drops everything written once it's set, as a connection hanging after a network change would
+	losing uint32
+	// drops one in every dropEvery writes if it isn't zero
+	dropEvery uint32
+
+	// the length of every write, once recording is set
+	recording atomic.Bool
+	m         sync.Mutex
+	lengths   []int
+}
+
+func newTestConn(conn net.Conn) *testConn {
+	return &testConn{Conn: &common.TLSConn{Conn: conn}}
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	writes := atomic.AddUint32(&c.writes, 1)
+	atomic.AddInt64(&c.written, int64(len(b)))
+	if c.recording.Load() {
+		c.m.Lock()
+		c.lengths = append(c.lengths, len(b))
+		c.m.Unlock()
+	}
+	if atomic.LoadUint32(&c.losing) == 1 {
+		return len(b), nil
+	}
+	if dropEvery := atomic.LoadUint32(&c.dropEvery); dropEvery != 0 && writes%dropEvery == 0 {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *testConn) writeLengths() []int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]int(nil), c.lengths...)
+}
+
+type connPair struct {
+	clientConn *testConn
+	serverConn *testConn
+}
+
+// sessionPairOption changes the configs of the client and the server session of makeSessionPair, which are the same
+// to start with
+type sessionPairOption func(client, server *SessionConfig)
+
+// makeSessionPair makes a client and a server session connected by numConn connections
+func makeSessionPair(numConn int, opts ...sessionPairOption) (*Session, *Session, []*connPair) {
+	sessionKey := [32]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31}
+	sessionId := 1
+	obfuscator, _ := MakeObfuscator(E_METHOD_CHACHA20_POLY1305, sessionKey)
+	clientConfig := SessionConfig{
+		Obfuscator: obfuscator,
+		Valve:      nil,
+		Unordered:  false,
+	}
+	serverConfig := clientConfig
+	for _, opt := range opts {
+		opt(&clientConfig, &serverConfig)
+	}
+
+	clientSession := MakeSession(uint32(sessionId), clientConfig)
+	serverSession := MakeSession(uint32(sessionId), serverConfig)
+
+	pairs := make([]*connPair, numConn)
+	for i := 0; i < numConn; i++ {
+		pairs[i] = connect(clientSession, serverSession)
+	}
+	return clientSession, serverSession, pairs
+}
+
+// connect adds a connection to both sessions
+func connect(clientSession, serverSession *Session) *connPair {
+	c, s := connutil.AsyncPipe()
+	return addConnPair(clientSession, serverSession, c, s)
+}
+
+// connectTCP adds a TCP connection on the loopback to both sessions, which unlike a pipe still has what's been written
+// to it to be read once the other end is closed
+func connectTCP(t *testing.T, clientSession, serverSession *Session) *connPair {
+	c, s := tcpPair(t)
+	return addConnPair(clientSession, serverSession, c, s)
+}
+
+func addConnPair(clientSession, serverSession *Session, c, s net.Conn) *connPair {
+	pair := &connPair{
+		clientConn: newTestConn(c),
+		serverConn: newTestConn(s),
+	}
+	clientSession.AddConnection(pair.clientConn)
+	serverSession.AddConnection(pair.serverConn)
+	return pair
+}
+
+// tcpPair returns the two ends of a TCP connection on the loopback
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("failed to accept")
+	}
+	return dialed, conn
+}
@@ -0,0 +1,82 @@
+package multiplex
+
+import (
+	"errors"
+	"sort"
+)
+
+var ErrNoSuchStream = errors.New("no such stream")
+
+var streamTypeNames = map[uint8]string{
+	T_STREAM:     "stream",
+	T_DATAGRAM:   "datagram",
+	T_CONTROL:    "control",
+	T_UNRELIABLE: "unreliable",
+}
+
+var encryptionMethodNames = map[byte]string{
+	E_METHOD_PLAIN:              "plain",
+	E_METHOD_AES_GCM:            "aes-gcm",
+	E_METHOD_CHACHA20_POLY1305:  "chacha20-poly1305",
+	E_METHOD_XCHACHA20_POLY1305: "xchacha20-poly1305",
+	E_METHOD_AES_128_GCM:        "aes-128-gcm",
+}
+
+// EncryptionMethodName is the name encryptionMethod is given as in the config of the client, empty if it's unknown
+func EncryptionMethodName(encryptionMethod byte) string {
+	return encryptionMethodNames[encryptionMethod]
+}
+
+// StreamInfo is a stream that's open in a session
+type StreamInfo struct {
+	ID uint32
+	// one of "stream", "datagram", "control" and "unreliable"
+	Type     string
+	Priority uint8
+	// where it's relayed to, as set with SetDestination. Empty if it hasn't been
+	Destination string
+	// the bytes of payload sent to and received from the remote through it
+	Sent     uint64
+	Received uint64
+}
+
+// SetDestination records where the stream is relayed to, for Streams to tell
+func (s *Stream) SetDestination(destination string) { s.destination.Store(destination) }
+
+func (s *Stream) info() StreamInfo {
+	destination, _ := s.destination.Load().(string)
+	return StreamInfo{
+		ID:          s.id,
+		Type:        streamTypeNames[s.streamType],
+		Priority:    s.priority,
+		Destination: destination,
+		Sent:        s.sent.Load(),
+		Received:    s.received.Load(),
+	}
+}
+
+// Streams returns the streams that are open in the session, in ascending order of their IDs
+func (sesh *Session) Streams() []StreamInfo {
+	infos := []StreamInfo{}
+	sesh.streams.Range(func(_, streamI interface{}) bool {
+		if s, ok := streamI.(*Stream); ok && !s.isClosed() {
+			infos = append(infos, s.info())
+		}
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// CloseStream closes the stream of id, telling the remote, or returns ErrNoSuchStream if it isn't open
+func (sesh *Session) CloseStream(id uint32) error {
+	streamI, ok := sesh.streams.Load(id)
+	if !ok {
+		return ErrNoSuchStream
+	}
+	s, ok := streamI.(*Stream)
+	if !ok || s.isClosed() {
+		return ErrNoSuchStream
+	}
+	return s.Close()
+}
@@ -0,0 +1,42 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreams(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+	defer clientSession.Close()
+	go serveEcho(serverSession)
+
+	stream, _ := clientSession.OpenStreamWithPriority(PRIORITY_BULK)
+	stream.SetDestination("example.com:443")
+	echo(t, stream, []byte("hello"))
+
+	streams := clientSession.Streams()
+	if len(streams) != 1 {
+		t.Fatalf("expecting 1 stream, got %v", streams)
+	}
+	want := StreamInfo{ID: stream.id, Type: "stream", Priority: PRIORITY_BULK, Destination: "example.com:443", Sent: 5, Received: 5}
+	if streams[0] != want {
+		t.Errorf("expecting %+v, got %+v", want, streams[0])
+	}
+
+	if err := serverSession.CloseStream(stream.id); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(clientSession.Streams()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream closed by the remote is still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := serverSession.CloseStream(stream.id); err != ErrNoSuchStream {
+		t.Errorf("expecting ErrNoSuchStream closing a closed stream, got %v", err)
+	}
+	if err := serverSession.CloseStream(1 << 20); err != ErrNoSuchStream {
+		t.Errorf("expecting ErrNoSuchStream closing a stream that was never opened, got %v", err)
+	}
+}
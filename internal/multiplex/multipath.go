@@ -0,0 +1,240 @@
+package multiplex
+
+// With the LATENCY_WEIGHTED strategy, the connections of a session are paths that may well go to different server
+// addresses. Each frame is sent on a path picked at random, weighted by how fast the path has been, so frames are
+// striped across paths in proportion to their speed. The latency of a path is its round trip time, read from its TCP
+// socket where the platform allows, plus how long writes to it have been blocking. A path that gets much slower than
+// the fastest one, e.g. because it's being throttled, is failed over from and only gets the odd probe, which keeps
+// it measured so that it's taken back once it recovers.
+//
+// With duplicate, every frame is sent on the fastest path and queued on all the others. The receiving end drops the
+// copies of frames it already has. A frame lost on a path that drops is still delivered by the others, so the
+// session carries on until its last connection drops.
+
+import (
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// a path this many times slower than the fastest one is failed over from
+	failoverFactor = 4
+	// one in this many frames goes on a random path, regardless of how slow it is
+	probeInterval = 64
+	// how often the round trip time of a path is read from its socket
+	rttProbeInterval = time.Second
+	// how many frames can wait to be duplicated on a path before it's deemed too slow to need them
+	duplicateQueueLen = 256
+	// paths are taken to be at least this slow, so that one that hasn't had a write block doesn't get all frames
+	minPathLatency = time.Millisecond
+)
+
+type path struct {
+	conn net.Conn
+
+	// in nanoseconds, atomic
+	rtt        int64
+	writeDelay int64
+	// unix nano, atomic
+	lastRTTProbe int64
+
+	// frames to be duplicated on this path, and their size, atomic
+	queue  chan []byte
+	queued int64
+	done   chan struct{}
+}
+
+// updateEWMA takes sample into the exponentially weighted moving average at avg
+func updateEWMA(avg *int64, sample int64) {
+	for {
+		old := atomic.LoadInt64(avg)
+		updated := old + (sample-old)/8
+		if old == 0 {
+			updated = sample
+		}
+		if atomic.CompareAndSwapInt64(avg, old, updated) {
+			return
+		}
+	}
+}
+
+func (p *path) write(data []byte) (int, error) {
+	start := time.Now()
+	n, err := p.conn.Write(data)
+	updateEWMA(&p.writeDelay, int64(time.Since(start)))
+	return n, err
+}
+
+func (p *path) latency() time.Duration {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&p.lastRTTProbe)
+	if now-last >= int64(rttProbeInterval) && atomic.CompareAndSwapInt64(&p.lastRTTProbe, last, now) {
+		// the kernel's is smoothed already
+		if rtt, ok := tcpRTT(p.conn); ok {
+			atomic.StoreInt64(&p.rtt, int64(rtt))
+		}
+	}
+	latency := time.Duration(atomic.LoadInt64(&p.rtt) + atomic.LoadInt64(&p.writeDelay))
+	if latency < minPathLatency {
+		return minPathLatency
+	}
+	return latency
+}
+
+// underlyingTCPConn unwraps conn down to its TCP connection, if it has one
+func underlyingTCPConn(conn net.Conn) *net.TCPConn {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+func (sb *switchboard) addPath(connId uint32, conn net.Conn) {
+	p := &path{conn: conn, done: make(chan struct{})}
+	if sb.duplicate {
+		p.queue = make(chan []byte, duplicateQueueLen)
+		go sb.drainPath(connId, p)
+	}
+	sb.paths.Store(connId, p)
+}
+
+func (sb *switchboard) removePath(connId uint32) {
+	if pI, ok := sb.paths.LoadAndDelete(connId); ok {
+		close(pI.(*path).done)
+	}
+}
+
+// pickPath picks the fastest path if fastest, otherwise a random one weighted by speed. Paths slower than
+// failoverFactor times the fastest one are left out, but for probes
+func (sb *switchboard) pickPath(fastest bool) (uint32, *path, error) {
+	type candidate struct {
+		id      uint32
+		p       *path
+		latency time.Duration
+	}
+	var candidates []candidate
+	var best time.Duration
+	sb.paths.Range(func(idI, pI interface{}) bool {
+		c := candidate{id: idI.(uint32), p: pI.(*path)}
+		c.latency = c.p.latency()
+		if len(candidates) == 0 || c.latency < best {
+			best = c.latency
+		}
+		candidates = append(candidates, c)
+		return true
+	})
+	if len(candidates) == 0 {
+		return 0, nil, errBrokenSwitchboard
+	}
+
+	if !fastest && atomic.AddUint32(&sb.sends, 1)%probeInterval == 0 {
+		c := candidates[rand.Intn(len(candidates))]
+		return c.id, c.p, nil
+	}
+
+	var total float64
+	cumulative := make([]float64, len(candidates))
+	for i, c := range candidates {
+		if fastest && c.latency == best {
+			return c.id, c.p, nil
+		}
+		if c.latency <= failoverFactor*best {
+			total += 1 / float64(c.latency)
+		}
+		cumulative[i] = total
+	}
+	r := rand.Float64() * total
+	for i, c := range candidates {
+		if c.latency <= failoverFactor*best && r <= cumulative[i] {
+			return c.id, c.p, nil
+		}
+	}
+	// rounding error
+	c := candidates[len(candidates)-1]
+	return c.id, c.p, nil
+}
+
+func (sb *switchboard) sendWeighted(data []byte) (int, error) {
+	var dup []byte
+	if sb.duplicate {
+		// taken before data is written, as a Write may use the spare capacity of what it's given. It has none itself
+		dup = make([]byte, len(data))
+		copy(dup, data)
+	}
+	for {
+		connId, p, err := sb.pickPath(sb.duplicate)
+		if err != nil {
+			return 0, errBrokenSwitchboard
+		}
+		n, err := p.write(data)
+		if err != nil {
+			resumable := sb.session.resumable()
+			if sb.dropConn(connId) && resumable {
+				sb.session.connLost()
+			}
+			if sb.duplicate && sb.connsCount() > 0 {
+				log.Debugf("failed to write to a connection of session %v, trying another: %v", sb.session.id, err)
+				continue
+			}
+			if resumable {
+				// it's been kept, and is sent again once the session resumes
+				return len(data), nil
+			}
+			sb.close("failed to write to remote " + err.Error())
+			return n, err
+		}
+		sb.valve.AddTx(int64(n))
+		if sb.duplicate {
+			sb.duplicateFrame(connId, dup)
+		}
+		return n, nil
+	}
+}
+
+// duplicateFrame queues dup on all paths but sentOn
+func (sb *switchboard) duplicateFrame(sentOn uint32, dup []byte) {
+	sb.paths.Range(func(idI, pI interface{}) bool {
+		if idI.(uint32) == sentOn {
+			return true
+		}
+		select {
+		case pI.(*path).queue <- dup:
+			atomic.AddInt64(&pI.(*path).queued, int64(len(dup)))
+		default:
+			// the path is too far behind to make a difference to this frame
+		}
+		return true
+	})
+}
+
+func (sb *switchboard) drainPath(connId uint32, p *path) {
+	for {
+		select {
+		case data := <-p.queue:
+			atomic.AddInt64(&p.queued, -int64(len(data)))
+			n, err := p.write(data)
+			if err != nil {
+				log.Debugf("failed to write to a connection of session %v: %v", sb.session.id, err)
+				if sb.dropConn(connId) && sb.session.resumable() {
+					sb.session.connLost()
+				} else if sb.connsCount() == 0 {
+					sb.close("failed to write to remote " + err.Error())
+				}
+				return
+			}
+			sb.valve.AddTx(int64(n))
+		case <-p.done:
+			return
+		}
+	}
+}
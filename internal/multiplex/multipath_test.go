@@ -0,0 +1,130 @@
+package multiplex
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+)
+
+// withMultipath makes both sessions multipath, duplicating frames across connections if duplicate
+func withMultipath(duplicate bool) sessionPairOption {
+	return func(client, server *SessionConfig) {
+		client.Multipath, client.Duplicate = true, duplicate
+		server.Multipath, server.Duplicate = true, duplicate
+	}
+}
+
+func openStreams(t *testing.T, sesh *Session, n int) []*Stream {
+	streams := make([]*Stream, n)
+	for i := range streams {
+		stream, err := sesh.OpenStream()
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		streams[i] = stream
+	}
+	return streams
+}
+
+func TestSwitchboard_PickPath(t *testing.T) {
+	sesh := MakeSession(0, SessionConfig{Multipath: true})
+	sesh.AddConnection(connutil.Discard())
+	sesh.AddConnection(connutil.Discard())
+
+	var slowId uint32
+	sesh.sb.paths.Range(func(idI, pI interface{}) bool {
+		slowId = idI.(uint32)
+		pI.(*path).writeDelay = int64(time.Second)
+		return false
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		const picks = 6400
+		var slow int
+		for i := 0; i < picks; i++ {
+			id, _, err := sesh.sb.pickPath(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id == slowId {
+				slow++
+			}
+		}
+		// only probes go on it, which are on a random path
+		if slow == 0 || slow > picks/probeInterval {
+			t.Errorf("throttled path got %v of %v frames", slow, picks)
+		}
+	})
+
+	t.Run("fastest", func(t *testing.T) {
+		for i := 0; i < probeInterval*2; i++ {
+			id, _, err := sesh.sb.pickPath(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id == slowId {
+				t.Fatal("picked the throttled path as the fastest")
+			}
+		}
+	})
+
+	t.Run("no path", func(t *testing.T) {
+		sesh.sb.closeAll()
+		if _, _, err := sesh.sb.pickPath(false); err != errBrokenSwitchboard {
+			t.Errorf("expecting %v, got %v", errBrokenSwitchboard, err)
+		}
+	})
+}
+
+func TestMultipath(t *testing.T) {
+	t.Run("stripe", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(4, withMultipath(false))
+		go serveEcho(serverSession)
+		runEchoTest(t, openStreams(t, clientSession, 100))
+	})
+
+	t.Run("duplicate survives a dropped connection", func(t *testing.T) {
+		clientSession, serverSession, pairs := makeSessionPair(2, withMultipath(true))
+		go serveEcho(serverSession)
+		runEchoTest(t, openStreams(t, clientSession, 100))
+
+		pairs[0].serverConn.Close()
+		time.Sleep(500 * time.Millisecond)
+		if clientSession.IsClosed() || serverSession.IsClosed() {
+			t.Fatal("session closed after one of its connections dropped")
+		}
+		if clientSession.sb.connsCount() != 1 || serverSession.sb.connsCount() != 1 {
+			t.Errorf("expecting 1 connection left, got %v and %v", clientSession.sb.connsCount(), serverSession.sb.connsCount())
+		}
+		runEchoTest(t, openStreams(t, clientSession, 100))
+
+		pairs[1].serverConn.Close()
+		time.Sleep(500 * time.Millisecond)
+		if !clientSession.IsClosed() {
+			t.Error("session not closed after all of its connections dropped")
+		}
+	})
+}
+
+func TestUnderlyingTCPConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if underlyingTCPConn(&common.TLSConn{Conn: conn}) != conn {
+		t.Error("TCP connection under a TLSConn not found")
+	}
+	if underlyingTCPConn(connutil.Discard()) != nil {
+		t.Error("found a TCP connection under a pipe")
+	}
+}
@@ -2,8 +2,6 @@ package multiplex
 
 import (
 	"bytes"
-	"github.com/cbeuw/Cloak/internal/common"
-	"github.com/cbeuw/connutil"
 	"io"
 	"math/rand"
 	"net"
@@ -29,40 +27,6 @@ func serveEcho(l net.Listener) {
 	}
 }
 
-type connPair struct {
-	clientConn net.Conn
-	serverConn net.Conn
-}
-
-func makeSessionPair(numConn int) (*Session, *Session, []*connPair) {
-	sessionKey := [32]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31}
-	sessionId := 1
-	obfuscator, _ := MakeObfuscator(E_METHOD_CHACHA20_POLY1305, sessionKey)
-	clientConfig := SessionConfig{
-		Obfuscator: obfuscator,
-		Valve:      nil,
-		Unordered:  false,
-	}
-	serverConfig := clientConfig
-
-	clientSession := MakeSession(uint32(sessionId), clientConfig)
-	serverSession := MakeSession(uint32(sessionId), serverConfig)
-
-	paris := make([]*connPair, numConn)
-	for i := 0; i < numConn; i++ {
-		c, s := connutil.AsyncPipe()
-		clientConn := &common.TLSConn{Conn: c}
-		serverConn := &common.TLSConn{Conn: s}
-		paris[i] = &connPair{
-			clientConn: clientConn,
-			serverConn: serverConn,
-		}
-		clientSession.AddConnection(clientConn)
-		serverSession.AddConnection(serverConn)
-	}
-	return clientSession, serverSession, paris
-}
-
 func runEchoTest(t *testing.T, streams []*Stream) {
 	const testDataLen = 16384
 	var wg sync.WaitGroup
@@ -157,3 +121,74 @@ func TestMux_StreamClosing(t *testing.T) {
 		t.Errorf("incorrect data read back")
 	}
 }
+
+func TestMux_DatagramStream(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+
+	stream, err := clientSession.OpenDatagramStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagrams := [][]byte{make([]byte, 1), make([]byte, 1500), make([]byte, 3)}
+	for _, d := range datagrams {
+		rand.Read(d)
+		if _, err := stream.Write(d); err != nil {
+			t.Fatalf("can't write to stream: %v", err)
+		}
+	}
+	_, err = stream.Write(make([]byte, clientSession.maxStreamUnitWrite+1))
+	if err != io.ErrShortBuffer {
+		t.Errorf("a datagram larger than a frame: expecting io.ErrShortBuffer, got %v", err)
+	}
+
+	serverStream, err := serverSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serverStream.(*Stream).IsDatagram() {
+		t.Error("accepted stream isn't a datagram stream")
+	}
+	recvBuf := make([]byte, 2048)
+	for _, d := range datagrams {
+		n, err := serverStream.Read(recvBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d, recvBuf[:n]) {
+			t.Errorf("expecting a datagram of %v bytes, got %v", len(d), n)
+		}
+	}
+}
+
+func TestMux_ControlStream(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+
+	stream, err := clientSession.OpenControlStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := [][]byte{[]byte(`{"Type":"a"}`), []byte(`{"Type":"bc"}`)}
+	for _, m := range messages {
+		if _, err := stream.Write(m); err != nil {
+			t.Fatalf("can't write to stream: %v", err)
+		}
+	}
+
+	serverStream, err := serverSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !serverStream.(*Stream).IsControl() || serverStream.(*Stream).IsDatagram() {
+		t.Error("accepted stream isn't a control stream")
+	}
+	recvBuf := make([]byte, 2048)
+	for _, m := range messages {
+		n, err := serverStream.Read(recvBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m, recvBuf[:n]) {
+			t.Errorf("expecting %s, got %s", m, recvBuf[:n])
+		}
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/cbeuw/Cloak/internal/common"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/salsa20"
+	"sync/atomic"
 )
 
 type Obfser func(*Frame, []byte, int) (int, error)
@@ -21,23 +22,85 @@ var putU64 = binary.BigEndian.PutUint64
 
 const HEADER_LEN = 14
 
+// the IDs are sent in the handshake, so new ones must be added at the end. Servers that don't know an ID turn the
+// client away
 const (
 	E_METHOD_PLAIN = iota
 	E_METHOD_AES_GCM
 	E_METHOD_CHACHA20_POLY1305
+	E_METHOD_XCHACHA20_POLY1305
+	E_METHOD_AES_128_GCM
 )
 
+var ErrUnknownEncryptionMethod = errors.New("unknown encryption method")
+var errWipedSessionKey = errors.New("session key has been wiped")
+
 // Obfuscator is responsible for the obfuscation and deobfuscation of frames
 type Obfuscator struct {
 	// Used in Stream.Write. Add multiplexing headers, encrypt and add TLS header
 	Obfs Obfser
 	// Remove TLS header, decrypt and unmarshall frames
-	Deobfs      Deobfser
-	SessionKey  [32]byte
+	Deobfs Deobfser
+	// wiped once the sessions of the Obfuscator have all closed
+	SessionKey *common.Secret
+	// how many sessions haven't closed
+	sessions    *int32
 	minOverhead int
+	// what the payload of frames is sealed with, nil if it's plain, so that sessions that are rekeyed can make the
+	// ciphers of later epochs
+	encryptionMethod byte
+	payloadCipher    cipher.AEAD
+}
+
+// sealer gives the cipher the payload of a frame is sealed or opened with, nil if it's plain, and the bits of the
+// last byte of the header that tell which. opened is called with the bits of each frame that has been opened
+type sealer interface {
+	sealing() (cipher.AEAD, byte)
+	opening(bits byte) (cipher.AEAD, error)
+	opened(bits byte)
 }
 
-func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
+// fixedSealer seals every frame with one cipher
+type fixedSealer struct {
+	cipher.AEAD
+}
+
+func (s fixedSealer) sealing() (cipher.AEAD, byte) { return s.AEAD, 0 }
+
+func (s fixedSealer) opening(bits byte) (cipher.AEAD, error) {
+	if bits != 0 {
+		return nil, errUnknownEpoch
+	}
+	return s.AEAD, nil
+}
+
+func (fixedSealer) opened(byte) {}
+
+// headerNonceAEAD is an AEAD with nonces longer than the 12 bytes of the frame header they're taken from, which are
+// padded with 0s
+type headerNonceAEAD struct {
+	cipher.AEAD
+}
+
+func (a headerNonceAEAD) NonceSize() int { return 12 }
+
+func (a headerNonceAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	var full [chacha20poly1305.NonceSizeX]byte
+	copy(full[:], nonce)
+	return a.AEAD.Seal(dst, full[:a.AEAD.NonceSize()], plaintext, additionalData)
+}
+
+func (a headerNonceAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	var full [chacha20poly1305.NonceSizeX]byte
+	copy(full[:], nonce)
+	return a.AEAD.Open(dst, full[:a.AEAD.NonceSize()], ciphertext, additionalData)
+}
+
+func MakeObfs(salsaKey *common.Secret, payloadCipher cipher.AEAD) Obfser {
+	return makeObfs(salsaKey, fixedSealer{payloadCipher})
+}
+
+func makeObfs(salsaKey *common.Secret, s sealer) Obfser {
 	obfs := func(f *Frame, buf []byte, payloadOffsetInBuf int) (int, error) {
 		// we need the encrypted data to be at least 8 bytes to be used as nonce for salsa20 stream header encryption
 		// this will be the case if the encryption method is an AEAD cipher, however for plain, it's well possible
@@ -46,6 +109,7 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 		if payloadLen == 0 {
 			return 0, errors.New("payload cannot be empty")
 		}
+		payloadCipher, epochBits := s.sealing()
 		var extraLen int
 		if payloadCipher == nil {
 			if extraLen = 8 - payloadLen; extraLen < 0 {
@@ -70,10 +134,7 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 		}
 
 		header := buf[:HEADER_LEN]
-		putU32(header[0:4], f.StreamID)
-		putU64(header[4:12], f.Seq)
-		header[12] = f.Closing
-		header[13] = byte(extraLen)
+		putHeader(header, f, extraLen, epochBits)
 
 		if payloadCipher == nil {
 			if extraLen != 0 { // read nonce
@@ -85,14 +146,44 @@ func MakeObfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Obfser {
 		}
 
 		nonce := buf[usefulLen-8 : usefulLen]
-		salsa20.XORKeyStream(header, header, nonce, &salsaKey)
+		if !salsaKey.Use(func(key []byte) { salsa20.XORKeyStream(header, header, nonce, (*[32]byte)(key)) }) {
+			return 0, errWipedSessionKey
+		}
 
 		return usefulLen, nil
 	}
 	return obfs
 }
 
-func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Deobfser {
+// putHeader puts the header of f, before it's obfuscated, into header
+func putHeader(header []byte, f *Frame, extraLen int, epochBits byte) {
+	putU32(header[0:4], f.StreamID)
+	putU64(header[4:12], f.Seq)
+	// the stream type takes the upper 4 bits of the closing byte, of which its priority takes the upper 2
+	header[12] = (f.Priority<<2|f.StreamType&0x03)<<4 | f.Closing&0x0f
+	header[13] = byte(extraLen) | epochBits
+	if f.Compressed {
+		header[13] |= compressedBit
+	}
+}
+
+// obfsSplicedHeader puts into header the obfuscated header of a plain frame whose payload is sent separately, followed
+// by nonce, which is made random and the header is obfuscated with. The remote takes nonce as the extra bytes of the
+// frame, as it does those of a frame with a payload shorter than 8 bytes
+func (o *Obfuscator) obfsSplicedHeader(f *Frame, header []byte, nonce []byte) error {
+	putHeader(header, f, len(nonce), 0)
+	common.CryptoRandRead(nonce)
+	if !o.SessionKey.Use(func(key []byte) { salsa20.XORKeyStream(header, header, nonce, (*[32]byte)(key)) }) {
+		return errWipedSessionKey
+	}
+	return nil
+}
+
+func MakeDeobfs(salsaKey *common.Secret, payloadCipher cipher.AEAD) Deobfser {
+	return makeDeobfs(salsaKey, fixedSealer{payloadCipher})
+}
+
+func makeDeobfs(salsaKey *common.Secret, s sealer) Deobfser {
 	// stream header length + minimum data size (i.e. nonce size of salsa20)
 	const minInputLen = HEADER_LEN + 8
 	deobfs := func(in []byte) (*Frame, error) {
@@ -104,12 +195,20 @@ func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Deobfser {
 		pldWithOverHead := in[HEADER_LEN:] // payload + potential overhead
 
 		nonce := in[len(in)-8:]
-		salsa20.XORKeyStream(header, header, nonce, &salsaKey)
+		if !salsaKey.Use(func(key []byte) { salsa20.XORKeyStream(header, header, nonce, (*[32]byte)(key)) }) {
+			return nil, errWipedSessionKey
+		}
 
 		streamID := u32(header[0:4])
 		seq := u64(header[4:12])
-		closing := header[12]
-		extraLen := header[13]
+		closing := header[12] & 0x0f
+		streamType := header[12] >> 4 & 0x03
+		priority := header[12] >> 6
+		extraLen := header[13] &^ (compressedBit | epochBit)
+		payloadCipher, err := s.opening(header[13] & epochBit)
+		if err != nil {
+			return nil, err
+		}
 
 		usefulPayloadLen := len(pldWithOverHead) - int(extraLen)
 		if usefulPayloadLen < 0 || usefulPayloadLen > len(pldWithOverHead) {
@@ -129,51 +228,91 @@ func MakeDeobfs(salsaKey [32]byte, payloadCipher cipher.AEAD) Deobfser {
 			if err != nil {
 				return nil, err
 			}
+			s.opened(header[13] & epochBit)
 			outputPayload = pldWithOverHead[:usefulPayloadLen]
 		}
 
 		ret := &Frame{
-			StreamID: streamID,
-			Seq:      seq,
-			Closing:  closing,
-			Payload:  outputPayload,
+			StreamID:   streamID,
+			Seq:        seq,
+			Closing:    closing,
+			StreamType: streamType,
+			Priority:   priority,
+			Payload:    outputPayload,
+			Compressed: header[13]&compressedBit != 0,
 		}
 		return ret, nil
 	}
 	return deobfs
 }
 
+// MakeObfuscator makes an Obfuscator of sessionKey, which is kept in a common.Secret until the sessions it's given to
+// have all closed
 func MakeObfuscator(encryptionMethod byte, sessionKey [32]byte) (obfuscator Obfuscator, err error) {
 	obfuscator = Obfuscator{
-		SessionKey: sessionKey,
+		SessionKey: common.NewSecret(sessionKey[:]),
+		sessions:   new(int32),
 	}
-	var payloadCipher cipher.AEAD
+	defer func() {
+		if err != nil {
+			obfuscator.SessionKey.Wipe()
+		}
+	}()
+	payloadCipher, err := makePayloadCipher(encryptionMethod, sessionKey[:])
+	if err != nil {
+		return
+	}
+	if payloadCipher != nil {
+		obfuscator.minOverhead = payloadCipher.Overhead()
+	}
+	obfuscator.encryptionMethod = encryptionMethod
+	obfuscator.payloadCipher = payloadCipher
+
+	obfuscator.Obfs = MakeObfs(obfuscator.SessionKey, payloadCipher)
+	obfuscator.Deobfs = MakeDeobfs(obfuscator.SessionKey, payloadCipher)
+	return
+}
+
+// makePayloadCipher makes the cipher of encryptionMethod keyed with key, nil if it's plain
+func makePayloadCipher(encryptionMethod byte, key []byte) (cipher.AEAD, error) {
 	switch encryptionMethod {
 	case E_METHOD_PLAIN:
-		payloadCipher = nil
-		obfuscator.minOverhead = 0
+		return nil, nil
 	case E_METHOD_AES_GCM:
-		var c cipher.Block
-		c, err = aes.NewCipher(sessionKey[:])
+		c, err := aes.NewCipher(key)
 		if err != nil {
-			return
+			return nil, err
 		}
-		payloadCipher, err = cipher.NewGCM(c)
+		return cipher.NewGCM(c)
+	case E_METHOD_CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	case E_METHOD_XCHACHA20_POLY1305:
+		x, err := chacha20poly1305.NewX(key)
 		if err != nil {
-			return
+			return nil, err
 		}
-		obfuscator.minOverhead = payloadCipher.Overhead()
-	case E_METHOD_CHACHA20_POLY1305:
-		payloadCipher, err = chacha20poly1305.New(sessionKey[:])
+		return headerNonceAEAD{x}, nil
+	case E_METHOD_AES_128_GCM:
+		c, err := aes.NewCipher(key[:16])
 		if err != nil {
-			return
+			return nil, err
 		}
-		obfuscator.minOverhead = payloadCipher.Overhead()
+		return cipher.NewGCM(c)
 	default:
-		return obfuscator, errors.New("Unknown encryption method")
+		return nil, ErrUnknownEncryptionMethod
 	}
+}
 
-	obfuscator.Obfs = MakeObfs(sessionKey, payloadCipher)
-	obfuscator.Deobfs = MakeDeobfs(sessionKey, payloadCipher)
-	return
+// holdSessionKey counts a session that the Obfuscator is given to
+func (o *Obfuscator) holdSessionKey() {
+	if o.sessions != nil {
+		atomic.AddInt32(o.sessions, 1)
+	}
+}
+
+// releaseSessionKey counts a session of the Obfuscator closing, wiping SessionKey if it was the last
+func (o *Obfuscator) releaseSessionKey() {
+	if o.sessions != nil && atomic.AddInt32(o.sessions, -1) == 0 {
+		o.SessionKey.Wipe()
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"github.com/cbeuw/Cloak/internal/common"
 	"golang.org/x/crypto/chacha20poly1305"
 	"math/rand"
 	"reflect"
@@ -31,7 +32,8 @@ func TestGenerateObfs(t *testing.T) {
 			ct.Error("failed to deobfs ", err)
 			return
 		}
-		if !bytes.Equal(testFrame.Payload, resultFrame.Payload) || testFrame.StreamID != resultFrame.StreamID {
+		if !bytes.Equal(testFrame.Payload, resultFrame.Payload) || testFrame.StreamID != resultFrame.StreamID ||
+			testFrame.Compressed != resultFrame.Compressed {
 			ct.Error("expecting", testFrame,
 				"got", resultFrame)
 			return
@@ -62,9 +64,42 @@ func TestGenerateObfs(t *testing.T) {
 			run(obfuscator, t)
 		}
 	})
+	t.Run("xchacha20-poly1305", func(t *testing.T) {
+		obfuscator, err := MakeObfuscator(E_METHOD_XCHACHA20_POLY1305, sessionKey)
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("aes-128-gcm", func(t *testing.T) {
+		obfuscator, err := MakeObfuscator(E_METHOD_AES_128_GCM, sessionKey)
+		if err != nil {
+			t.Errorf("failed to generate obfuscator %v", err)
+		} else {
+			run(obfuscator, t)
+		}
+	})
+	t.Run("stream type", func(t *testing.T) {
+		obfuscator, _ := MakeObfuscator(E_METHOD_PLAIN, sessionKey)
+		obfsBuf := make([]byte, 512)
+		testFrame := &Frame{StreamID: 1, Closing: C_STREAM, StreamType: T_DATAGRAM, Payload: []byte{1, 2, 3}}
+		i, err := obfuscator.Obfs(testFrame, obfsBuf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resultFrame, err := obfuscator.Deobfs(obfsBuf[:i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resultFrame.Closing != C_STREAM || resultFrame.StreamType != T_DATAGRAM {
+			t.Errorf("expecting closing %v and stream type %v, got %v and %v",
+				C_STREAM, T_DATAGRAM, resultFrame.Closing, resultFrame.StreamType)
+		}
+	})
 	t.Run("unknown encryption method", func(t *testing.T) {
 		_, err := MakeObfuscator(0xff, sessionKey)
-		if err == nil {
+		if err != ErrUnknownEncryptionMethod {
 			t.Errorf("unknown encryption mehtod error expected")
 		}
 	})
@@ -77,18 +112,22 @@ func BenchmarkObfs(b *testing.B) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 
 	obfsBuf := make([]byte, defaultSendRecvBufSize)
 
 	var key [32]byte
 	rand.Read(key[:])
+	salsaKey := common.NewSecret(key[:])
 	b.Run("AES256GCM", func(b *testing.B) {
 		c, _ := aes.NewCipher(key[:])
 		payloadCipher, _ := cipher.NewGCM(c)
 
-		obfs := MakeObfs(key, payloadCipher)
+		obfs := MakeObfs(salsaKey, payloadCipher)
 		b.SetBytes(int64(len(testFrame.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
@@ -99,7 +138,7 @@ func BenchmarkObfs(b *testing.B) {
 		c, _ := aes.NewCipher(key[:16])
 		payloadCipher, _ := cipher.NewGCM(c)
 
-		obfs := MakeObfs(key, payloadCipher)
+		obfs := MakeObfs(salsaKey, payloadCipher)
 		b.SetBytes(int64(len(testFrame.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
@@ -107,7 +146,7 @@ func BenchmarkObfs(b *testing.B) {
 		}
 	})
 	b.Run("plain", func(b *testing.B) {
-		obfs := MakeObfs(key, nil)
+		obfs := MakeObfs(salsaKey, nil)
 		b.SetBytes(int64(len(testFrame.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
@@ -117,7 +156,7 @@ func BenchmarkObfs(b *testing.B) {
 	b.Run("chacha20Poly1305", func(b *testing.B) {
 		payloadCipher, _ := chacha20poly1305.New(key[:16])
 
-		obfs := MakeObfs(key, payloadCipher)
+		obfs := MakeObfs(salsaKey, payloadCipher)
 		b.SetBytes(int64(len(testFrame.Payload)))
 		b.ResetTimer()
 		for i := 0; i < b.N; i++ {
@@ -133,20 +172,24 @@ func BenchmarkDeobfs(b *testing.B) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 
 	obfsBuf := make([]byte, defaultSendRecvBufSize)
 
 	var key [32]byte
 	rand.Read(key[:])
+	salsaKey := common.NewSecret(key[:])
 	b.Run("AES256GCM", func(b *testing.B) {
 		c, _ := aes.NewCipher(key[:])
 		payloadCipher, _ := cipher.NewGCM(c)
 
-		obfs := MakeObfs(key, payloadCipher)
+		obfs := MakeObfs(salsaKey, payloadCipher)
 		n, _ := obfs(testFrame, obfsBuf, 0)
-		deobfs := MakeDeobfs(key, payloadCipher)
+		deobfs := MakeDeobfs(salsaKey, payloadCipher)
 
 		b.SetBytes(int64(n))
 		b.ResetTimer()
@@ -158,9 +201,9 @@ func BenchmarkDeobfs(b *testing.B) {
 		c, _ := aes.NewCipher(key[:16])
 		payloadCipher, _ := cipher.NewGCM(c)
 
-		obfs := MakeObfs(key, payloadCipher)
+		obfs := MakeObfs(salsaKey, payloadCipher)
 		n, _ := obfs(testFrame, obfsBuf, 0)
-		deobfs := MakeDeobfs(key, payloadCipher)
+		deobfs := MakeDeobfs(salsaKey, payloadCipher)
 
 		b.ResetTimer()
 		b.SetBytes(int64(n))
@@ -169,9 +212,9 @@ func BenchmarkDeobfs(b *testing.B) {
 		}
 	})
 	b.Run("plain", func(b *testing.B) {
-		obfs := MakeObfs(key, nil)
+		obfs := MakeObfs(salsaKey, nil)
 		n, _ := obfs(testFrame, obfsBuf, 0)
-		deobfs := MakeDeobfs(key, nil)
+		deobfs := MakeDeobfs(salsaKey, nil)
 
 		b.ResetTimer()
 		b.SetBytes(int64(n))
@@ -182,9 +225,9 @@ func BenchmarkDeobfs(b *testing.B) {
 	b.Run("chacha20Poly1305", func(b *testing.B) {
 		payloadCipher, _ := chacha20poly1305.New(key[:16])
 
-		obfs := MakeObfs(key, payloadCipher)
+		obfs := MakeObfs(salsaKey, payloadCipher)
 		n, _ := obfs(testFrame, obfsBuf, 0)
-		deobfs := MakeDeobfs(key, payloadCipher)
+		deobfs := MakeDeobfs(salsaKey, payloadCipher)
 
 		b.ResetTimer()
 		b.SetBytes(int64(n))
@@ -193,3 +236,23 @@ func BenchmarkDeobfs(b *testing.B) {
 		}
 	})
 }
+
+func TestSessionKeyWiped(t *testing.T) {
+	obfuscator, _ := MakeObfuscator(E_METHOD_PLAIN, emptyKey)
+	clientSession := MakeSession(1, SessionConfig{Obfuscator: obfuscator})
+	serverSession := MakeSession(1, SessionConfig{Obfuscator: obfuscator})
+	usable := func() bool { return obfuscator.SessionKey.Use(func([]byte) {}) }
+
+	clientSession.Close()
+	if !usable() {
+		t.Error("session key is wiped while a session of it is open")
+	}
+	serverSession.passiveClose()
+	if usable() {
+		t.Error("session key isn't wiped once its sessions have closed")
+	}
+	f := &Frame{StreamID: 1, Payload: []byte{1}}
+	if _, err := obfuscator.Obfs(f, make([]byte, 64), 0); err != errWipedSessionKey {
+		t.Errorf("expecting %v, got %v", errWipedSessionKey, err)
+	}
+}
@@ -0,0 +1,153 @@
+package multiplex
+
+// A traffic profile shapes what a session sends after the kind of traffic it's profiled on, so that the sizes and
+// timing of the records of a Cloak session don't stand out to a classifier. After a frame is sent, a dummy
+// C_PADDING frame of a random size may be sent after it, and a dummy frame is sent every so often while the session
+// is idle. The first frame after the session has been quiet for a bit is held back by a random delay, which doesn't
+// slow down bulk transfers as the frames after it aren't.
+//
+// Both ends of the session shape what they send after the same profile, which they agree on in the handshake.
+// Dummy frames take up bandwidth like any other.
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// the IDs are sent in the handshake, so new ones must be added at the end
+const (
+	PROFILE_NONE = iota
+	PROFILE_BROWSING
+	PROFILE_STREAMING
+)
+
+// a session that hasn't sent anything for this long is quiet, and has its next frame held back
+const burstGap = 50 * time.Millisecond
+
+type trafficProfile struct {
+	// the chance of a dummy frame being sent after each frame, and its size
+	padProbability float64
+	minPad, maxPad int
+	// the most the first frame after a quiet spell is held back by
+	maxJitter time.Duration
+	// an idle session sends a dummy frame after between these
+	minIdle, maxIdle time.Duration
+}
+
+var trafficProfiles = map[byte]trafficProfile{
+	// bursts of requests and responses, with many small records
+	PROFILE_BROWSING: {
+		padProbability: 0.2,
+		minPad:         64,
+		maxPad:         1400,
+		maxJitter:      20 * time.Millisecond,
+		minIdle:        2 * time.Second,
+		maxIdle:        15 * time.Second,
+	},
+	// large records arriving steadily, and rarely nothing for long
+	PROFILE_STREAMING: {
+		padProbability: 0.1,
+		minPad:         4096,
+		maxPad:         16384,
+		maxJitter:      5 * time.Millisecond,
+		minIdle:        500 * time.Millisecond,
+		maxIdle:        2 * time.Second,
+	},
+}
+
+// ValidTrafficProfile reports whether profile is known
+func ValidTrafficProfile(profile byte) bool {
+	_, ok := trafficProfiles[profile]
+	return profile == PROFILE_NONE || ok
+}
+
+type trafficShaper struct {
+	trafficProfile
+	// unix nano, atomic
+	lastSend int64
+}
+
+func makeTrafficShaper(profile byte) *trafficShaper {
+	p, ok := trafficProfiles[profile]
+	if !ok {
+		return nil
+	}
+	return &trafficShaper{trafficProfile: p}
+}
+
+func randDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(rand.Int63n(int64(max-min)))
+}
+
+// hold holds back a frame about to be sent if the session has been quiet
+func (sh *trafficShaper) hold() {
+	now := time.Now().UnixNano()
+	last := atomic.SwapInt64(&sh.lastSend, now)
+	if time.Duration(now-last) >= burstGap && sh.maxJitter > 0 {
+		time.Sleep(randDuration(0, sh.maxJitter))
+	}
+}
+
+// dummyFrame makes a dummy frame of a size the profile allows, but no larger than a frame can be
+func (sesh *Session) dummyFrame() ([]byte, error) {
+	sh := sesh.shaper
+	maxPad := sh.maxPad
+	if maxPad > sesh.maxStreamUnitWrite {
+		maxPad = sesh.maxStreamUnitWrite
+	}
+	minPad := sh.minPad
+	if minPad > maxPad {
+		minPad = maxPad
+	}
+	pad := make([]byte, minPad+rand.Intn(maxPad-minPad+1))
+	common.CryptoRandRead(pad)
+	return sesh.sessionFrame(C_PADDING, pad)
+}
+
+// pad may send a dummy frame on connId after a frame has been sent on it
+func (sb *switchboard) pad(connId *uint32) {
+	sh := sb.session.shaper
+	if rand.Float64() >= sh.padProbability {
+		return
+	}
+	dummy, err := sb.session.dummyFrame()
+	if err != nil {
+		log.Errorf("failed to make dummy frame for session %v: %v", sb.session.id, err)
+		return
+	}
+	if _, err = sb.sendFrame(dummy, connId); err != nil {
+		log.Debugf("failed to send dummy frame for session %v: %v", sb.session.id, err)
+	}
+}
+
+// padIdle sends a dummy frame whenever the session has been idle for a while, until it's closed
+func (sesh *Session) padIdle() {
+	sh := sesh.shaper
+	for {
+		idle := randDuration(sh.minIdle, sh.maxIdle)
+		time.Sleep(idle)
+		if sesh.IsClosed() {
+			return
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&sh.lastSend))) < idle || sesh.sb.connsCount() == 0 {
+			continue
+		}
+		dummy, err := sesh.dummyFrame()
+		if err != nil {
+			log.Errorf("failed to make dummy frame for session %v: %v", sesh.id, err)
+			return
+		}
+		atomic.StoreInt64(&sh.lastSend, time.Now().UnixNano())
+		var connId uint32
+		if _, err = sesh.sb.sendFrame(dummy, &connId); err != nil {
+			log.Debugf("failed to send dummy frame for session %v: %v", sesh.id, err)
+		}
+	}
+}
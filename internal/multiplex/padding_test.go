@@ -0,0 +1,89 @@
+package multiplex
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+// withTrafficProfile makes both sessions shape their traffic with profile
+func withTrafficProfile(profile byte) sessionPairOption {
+	return func(client, server *SessionConfig) { client.TrafficProfile, server.TrafficProfile = profile, profile }
+}
+
+func TestTrafficProfile(t *testing.T) {
+	for name, profile := range map[string]byte{"browsing": PROFILE_BROWSING, "streaming": PROFILE_STREAMING} {
+		t.Run(name, func(t *testing.T) {
+			clientSession, serverSession, pairs := makeSessionPair(1, withTrafficProfile(profile))
+			defer clientSession.Close()
+			go serveEcho(serverSession)
+
+			stream, _ := clientSession.OpenStream()
+			const frames = 200
+			for i := 0; i < frames; i++ {
+				echo(t, stream, []byte("hello"))
+			}
+			if writes := atomic.LoadUint32(&pairs[0].clientConn.writes); writes <= frames {
+				t.Errorf("expecting dummy frames on top of %v frames, got %v writes", frames, writes)
+			}
+			if serverSession.streamCount() != 1 {
+				t.Errorf("expecting 1 stream, got %v", serverSession.streamCount())
+			}
+		})
+	}
+
+	t.Run("idle session sends dummy frames", func(t *testing.T) {
+		clientSession, _, pairs := makeSessionPair(1, withTrafficProfile(PROFILE_STREAMING))
+		defer clientSession.Close()
+		if !waitFor(func() bool { return atomic.LoadUint32(&pairs[0].clientConn.writes) > 0 }, 3*trafficProfiles[PROFILE_STREAMING].maxIdle) {
+			t.Error("no dummy frame sent while idle")
+		}
+	})
+
+	t.Run("no profile", func(t *testing.T) {
+		clientSession, serverSession, pairs := makeSessionPair(1, withTrafficProfile(PROFILE_NONE))
+		defer clientSession.Close()
+		go serveEcho(serverSession)
+
+		stream, _ := clientSession.OpenStream()
+		for i := 0; i < 10; i++ {
+			echo(t, stream, []byte("hello"))
+		}
+		if writes := atomic.LoadUint32(&pairs[0].clientConn.writes); writes != 10 {
+			t.Errorf("expecting 10 writes, got %v", writes)
+		}
+	})
+}
+
+func TestDummyFrame(t *testing.T) {
+	sesh := setupSesh(false, emptyKey, E_METHOD_PLAIN)
+	sesh.shaper = makeTrafficShaper(PROFILE_STREAMING)
+	sesh.maxStreamUnitWrite = 10000
+
+	for i := 0; i < 100; i++ {
+		data, err := sesh.dummyFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := sesh.Deobfs(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Closing != C_PADDING {
+			t.Fatalf("expecting C_PADDING, got %v", f.Closing)
+		}
+		if len(f.Payload) < sesh.shaper.minPad || len(f.Payload) > sesh.maxStreamUnitWrite {
+			t.Fatalf("dummy frame of %v bytes is out of bounds", len(f.Payload))
+		}
+	}
+}
+
+func TestValidTrafficProfile(t *testing.T) {
+	for _, profile := range []byte{PROFILE_NONE, PROFILE_BROWSING, PROFILE_STREAMING} {
+		if !ValidTrafficProfile(profile) {
+			t.Errorf("%v is valid", profile)
+		}
+	}
+	if ValidTrafficProfile(PROFILE_STREAMING + 1) {
+		t.Error("unknown profile is valid")
+	}
+}
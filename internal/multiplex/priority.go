@@ -0,0 +1,111 @@
+package multiplex
+
+// Each stream has a priority, which is given when it's opened and sent with its frames in the upper 2 bits of the
+// byte of its type, so that the remote sends what comes back on the stream with the same priority. When more frames
+// are waiting to be sent than there are connections to send them on, e.g. because a Valve holds them back or the
+// connections are full, they take turns by weighted round robin: for every frame of a bulk stream, 4 frames of normal
+// streams and 16 of interactive ones are sent, so that an interactive stream isn't starved by a download sharing
+// its session, and a download isn't starved either. Frames of the session itself don't wait for a turn
+
+import (
+	"sync"
+)
+
+// Stream priorities
+const (
+	PRIORITY_NORMAL = iota
+	PRIORITY_INTERACTIVE
+	PRIORITY_BULK
+	numPriorities
+)
+
+// how many turns each priority gets in a round
+var priorityWeights = [numPriorities]int{
+	PRIORITY_NORMAL:      4,
+	PRIORITY_INTERACTIVE: 16,
+	PRIORITY_BULK:        1,
+}
+
+// the order priorities are given their turns in within a round
+var priorityOrder = [numPriorities]uint8{PRIORITY_INTERACTIVE, PRIORITY_NORMAL, PRIORITY_BULK}
+
+// scheduler lets up to a number of sends, the number of connections, go at once, and decides which of the others
+// waiting goes next
+type scheduler struct {
+	m    sync.Mutex
+	busy int
+	// the sends waiting, of each priority, first come first served within each
+	waiting [numPriorities][]chan struct{}
+	// the turns each priority has left in the round
+	turns [numPriorities]int
+}
+
+// acquire waits for a turn to send a frame of priority, with up to slots sends going at once
+func (sc *scheduler) acquire(priority uint8, slots int) {
+	if priority >= numPriorities {
+		priority = PRIORITY_NORMAL
+	}
+	sc.m.Lock()
+	if sc.busy < max(slots, 1) && sc.numWaiting() == 0 {
+		sc.busy++
+		sc.m.Unlock()
+		return
+	}
+	turn := make(chan struct{})
+	sc.waiting[priority] = append(sc.waiting[priority], turn)
+	sc.m.Unlock()
+	<-turn
+}
+
+// release ends a send, giving its turn to the next waiting
+func (sc *scheduler) release(slots int) {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	sc.busy--
+	for sc.busy < max(slots, 1) {
+		turn := sc.next()
+		if turn == nil {
+			return
+		}
+		sc.busy++
+		close(turn)
+	}
+}
+
+func (sc *scheduler) numWaiting() int {
+	n := 0
+	for _, w := range sc.waiting {
+		n += len(w)
+	}
+	return n
+}
+
+// next takes the send whose turn it is off the queues, nil if none is waiting
+func (sc *scheduler) next() chan struct{} {
+	if sc.numWaiting() == 0 {
+		return nil
+	}
+	for {
+		for _, p := range priorityOrder {
+			if len(sc.waiting[p]) != 0 && sc.turns[p] > 0 {
+				sc.turns[p]--
+				turn := sc.waiting[p][0]
+				sc.waiting[p] = sc.waiting[p][1:]
+				return turn
+			}
+		}
+		// every priority with a send waiting has had its turns, so a new round starts
+		sc.turns = priorityWeights
+	}
+}
+
+// sendOf sends a frame of s once it's the turn of s
+func (sb *switchboard) sendOf(s *Stream, data []byte) (int, error) {
+	sb.scheduler.acquire(s.priority, sb.connsCount())
+	defer sb.scheduler.release(sb.connsCount())
+	if s.IsUnreliable() {
+		// so that it isn't held up behind what the connection of s is resending
+		return sb.sendAnywhere(data)
+	}
+	return sb.send(data, &s.assignedConnId)
+}
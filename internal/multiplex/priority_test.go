@@ -0,0 +1,89 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMux_StreamPriority(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+
+	if _, err := clientSession.OpenStreamWithPriority(numPriorities); err == nil {
+		t.Error("expecting an error for an unknown priority")
+	}
+	stream, err := clientSession.OpenStreamWithPriority(PRIORITY_INTERACTIVE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	serverStream, err := serverSession.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if priority := serverStream.(*Stream).Priority(); priority != PRIORITY_INTERACTIVE {
+		t.Errorf("expecting the accepted stream to be interactive, got %v", priority)
+	}
+	if serverStream.(*Stream).streamType != T_STREAM {
+		t.Errorf("the priority changed the type of the stream to %v", serverStream.(*Stream).streamType)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	t.Run("free slots", func(t *testing.T) {
+		var sc scheduler
+		done := make(chan struct{})
+		go func() {
+			sc.acquire(PRIORITY_BULK, 2)
+			sc.acquire(PRIORITY_BULK, 2)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("sends waited while there were free slots")
+		}
+	})
+
+	t.Run("weighted turns", func(t *testing.T) {
+		var sc scheduler
+		sc.acquire(PRIORITY_NORMAL, 1)
+
+		// sends queued up behind the one going
+		order := make(chan uint8, 100)
+		queue := func(priority uint8, n int) {
+			for i := 0; i < n; i++ {
+				waiting := sc.lockedNumWaiting()
+				go func() {
+					sc.acquire(priority, 1)
+					order <- priority
+					sc.release(1)
+				}()
+				for sc.lockedNumWaiting() == waiting {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}
+		queue(PRIORITY_BULK, 10)
+		queue(PRIORITY_INTERACTIVE, 40)
+		sc.release(1)
+
+		counts := make(map[uint8]int)
+		for i := 0; i < 16+1; i++ {
+			counts[<-order]++
+		}
+		if counts[PRIORITY_INTERACTIVE] != 16 || counts[PRIORITY_BULK] != 1 {
+			t.Errorf("expecting 16 interactive sends to 1 bulk one in a round, got %v", counts)
+		}
+		for i := 16 + 1; i < 50; i++ {
+			<-order
+		}
+	})
+}
+
+func (sc *scheduler) lockedNumWaiting() int {
+	sc.m.Lock()
+	defer sc.m.Unlock()
+	return sc.numWaiting()
+}
@@ -2,6 +2,7 @@ package multiplex
 
 import (
 	"sync/atomic"
+	"time"
 
 	"github.com/juju/ratelimit"
 )
@@ -22,11 +23,32 @@ type LimitedValve struct {
 
 type UnlimitedValve struct{}
 
+// CountingValve lets everything through like UnlimitedValve, but counts the traffic, e.g. for a client to know how
+// much it has sent and received
+type CountingValve struct {
+	rx int64
+	tx int64
+}
+
+// MakeValve makes a valve that lets through up to a second's worth of traffic at once
 func MakeValve(rxRate, txRate int64) *LimitedValve {
+	return MakeValveWithBurst(rxRate, txRate, time.Second)
+}
+
+// MakeValveWithBurst makes a valve that lets through up to burst's worth of traffic at the rates at once, after which
+// the traffic is smoothed to the rates. A shorter burst gives a smoother throughput
+func MakeValveWithBurst(rxRate, txRate int64, burst time.Duration) *LimitedValve {
+	capacity := func(rate int64) int64 {
+		c := int64(float64(rate) * burst.Seconds())
+		if c < 1 {
+			return 1
+		}
+		return c
+	}
 	var rx, tx int64
 	v := &LimitedValve{
-		rxtb: ratelimit.NewBucketWithRate(float64(rxRate), rxRate),
-		txtb: ratelimit.NewBucketWithRate(float64(txRate), txRate),
+		rxtb: ratelimit.NewBucketWithRate(float64(rxRate), capacity(rxRate)),
+		txtb: ratelimit.NewBucketWithRate(float64(txRate), capacity(txRate)),
 		rx:   &rx,
 		tx:   &tx,
 	}
@@ -55,6 +77,18 @@ func (v *UnlimitedValve) GetRx() int64            { return 0 }
 func (v *UnlimitedValve) GetTx() int64            { return 0 }
 func (v *UnlimitedValve) Nullify() (int64, int64) { return 0, 0 }
 
+func (v *CountingValve) rxWait(n int)  {}
+func (v *CountingValve) txWait(n int)  {}
+func (v *CountingValve) AddRx(n int64) { atomic.AddInt64(&v.rx, n) }
+func (v *CountingValve) AddTx(n int64) { atomic.AddInt64(&v.tx, n) }
+func (v *CountingValve) GetRx() int64  { return atomic.LoadInt64(&v.rx) }
+func (v *CountingValve) GetTx() int64  { return atomic.LoadInt64(&v.tx) }
+func (v *CountingValve) Nullify() (int64, int64) {
+	rx := atomic.SwapInt64(&v.rx, 0)
+	tx := atomic.SwapInt64(&v.tx, 0)
+	return rx, tx
+}
+
 type Valve interface {
 	rxWait(n int)
 	txWait(n int)
@@ -0,0 +1,60 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMakeValveWithBurst(t *testing.T) {
+	t.Run("capacity", func(t *testing.T) {
+		v := MakeValveWithBurst(1<<20, 1<<10, 100*time.Millisecond)
+		if c := v.rxtb.Capacity(); c != 1<<20/10 {
+			t.Errorf("expecting rx burst of %v bytes, got %v", 1<<20/10, c)
+		}
+		if c := v.txtb.Capacity(); c != 1<<10/10 {
+			t.Errorf("expecting tx burst of %v bytes, got %v", 1<<10/10, c)
+		}
+		if c := MakeValveWithBurst(1, 1, time.Millisecond).txtb.Capacity(); c != 1 {
+			t.Errorf("expecting a burst of at least 1 byte, got %v", c)
+		}
+		if c := MakeValve(1<<20, 1<<20).txtb.Capacity(); c != 1<<20 {
+			t.Errorf("expecting a second's worth of burst by default, got %v", c)
+		}
+	})
+	t.Run("smoothed after burst", func(t *testing.T) {
+		const rate = 100 * 1024
+		v := MakeValveWithBurst(rate, rate, 100*time.Millisecond)
+		start := time.Now()
+		v.txWait(rate / 10)
+		if time.Since(start) > 50*time.Millisecond {
+			t.Error("the burst is throttled")
+		}
+		start = time.Now()
+		v.txWait(rate / 5)
+		if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+			t.Errorf("200ms worth of traffic after the burst went through in %v", elapsed)
+		}
+	})
+}
+
+func TestCountingValve(t *testing.T) {
+	v := &CountingValve{}
+	start := time.Now()
+	v.txWait(1 << 30)
+	v.rxWait(1 << 30)
+	if time.Since(start) > 50*time.Millisecond {
+		t.Error("counting valve throttled the traffic")
+	}
+	v.AddTx(10)
+	v.AddTx(20)
+	v.AddRx(5)
+	if v.GetTx() != 30 || v.GetRx() != 5 {
+		t.Errorf("expecting 30 sent and 5 received, got %v and %v", v.GetTx(), v.GetRx())
+	}
+	if rx, tx := v.Nullify(); rx != 5 || tx != 30 {
+		t.Errorf("nullify returned %v and %v", rx, tx)
+	}
+	if v.GetTx() != 0 || v.GetRx() != 0 {
+		t.Error("counts not reset by nullify")
+	}
+}
@@ -0,0 +1,98 @@
+package multiplex
+
+// Every frame is sent in a TLS record of its own, so without a record sizer a bulk transfer is a run of records all
+// the size of the largest frame, right from its first byte. HTTPS servers and clients commonly size their records
+// dynamically instead: the first records of a burst each fit in a TCP segment so that they can be decrypted as soon
+// as it arrives, they grow with each record sent, and they're only as large as they can be once the burst has gone
+// on for a while. With RECORD_SIZING_DYNAMIC, a session sizes the frames of its streams in the same way, after the
+// constants crypto/tls uses, and starts small again after it has been quiet.
+//
+// Only the end sending the records sizes them, and the remote reads frames of any size, so the two ends don't have
+// to agree on it.
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RECORD_SIZING_FULL = iota
+	RECORD_SIZING_DYNAMIC
+)
+
+const (
+	// how much of a TCP segment a record is taken to have to fit in
+	tcpMSSEstimate = 1208
+	// a burst that has sent this much has its records as large as they can be
+	recordSizeBoostThreshold = 128 * 1024
+	// a session that hasn't sent anything for this long starts its records small again
+	recordSizeResetIdle = time.Second
+	// the record layer, which isn't in a frame
+	recordLayerLength = 5
+)
+
+type recordSizer struct {
+	// the payload of the first record of a burst, and the most a payload can be
+	minPayload, maxPayload int
+
+	m         sync.Mutex
+	bytesSent int
+	records   int
+	lastSend  time.Time
+}
+
+// makeRecordSizer makes a recordSizer for frames that are frameOverhead larger than their payloads, which can be
+// at most maxPayload. It's nil if frames aren't sized
+func makeRecordSizer(sizing byte, frameOverhead int, maxPayload int) *recordSizer {
+	if sizing != RECORD_SIZING_DYNAMIC {
+		return nil
+	}
+	minPayload := tcpMSSEstimate - recordLayerLength - frameOverhead
+	if minPayload > maxPayload {
+		minPayload = maxPayload
+	}
+	return &recordSizer{minPayload: minPayload, maxPayload: maxPayload}
+}
+
+// limit returns how large the payload of the next frame can be
+func (rs *recordSizer) limit() int {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	if time.Since(rs.lastSend) >= recordSizeResetIdle {
+		rs.bytesSent = 0
+		rs.records = 0
+	}
+	if rs.bytesSent >= recordSizeBoostThreshold {
+		return rs.maxPayload
+	}
+	// records grow in an arithmetic progression
+	size := rs.minPayload * (rs.records + 1)
+	if size > rs.maxPayload {
+		size = rs.maxPayload
+	}
+	return size
+}
+
+// sent takes a frame with a payload of n as sent
+func (rs *recordSizer) sent(n int) {
+	rs.m.Lock()
+	rs.bytesSent += n
+	rs.records++
+	rs.lastSend = time.Now()
+	rs.m.Unlock()
+}
+
+// frameLimit is the most the payload of the next frame a stream sends can be
+func (sesh *Session) frameLimit() int {
+	if sesh.recordSizer == nil {
+		return sesh.maxStreamUnitWrite
+	}
+	return sesh.recordSizer.limit()
+}
+
+// frameSent is called after a stream has sent a frame with a payload of n
+func (sesh *Session) frameSent(n int) {
+	if sesh.recordSizer != nil {
+		sesh.recordSizer.sent(n)
+	}
+}
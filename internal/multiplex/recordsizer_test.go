@@ -0,0 +1,85 @@
+package multiplex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestRecordSizer(t *testing.T) {
+	const maxPayload = 16000
+	rs := makeRecordSizer(RECORD_SIZING_DYNAMIC, 30, maxPayload)
+
+	t.Run("records grow", func(t *testing.T) {
+		first := rs.limit()
+		if first+30+recordLayerLength != tcpMSSEstimate {
+			t.Fatalf("first record of %v doesn't fit in a segment", first)
+		}
+		last := 0
+		for sent := 0; sent < recordSizeBoostThreshold; {
+			limit := rs.limit()
+			if limit < last {
+				t.Fatalf("record shrank from %v to %v", last, limit)
+			}
+			last = limit
+			rs.sent(limit)
+			sent += limit
+		}
+		if rs.limit() != maxPayload {
+			t.Errorf("records aren't full after %v bytes", recordSizeBoostThreshold)
+		}
+	})
+
+	t.Run("small writes count for little", func(t *testing.T) {
+		rs := makeRecordSizer(RECORD_SIZING_DYNAMIC, 30, maxPayload)
+		first := rs.limit()
+		for i := 0; i < 10; i++ {
+			rs.sent(10)
+		}
+		if limit := rs.limit(); limit != first*11 {
+			t.Errorf("expecting %v after 10 records, got %v", first*11, limit)
+		}
+	})
+
+	t.Run("quiet spell resets", func(t *testing.T) {
+		rs.lastSend = time.Now().Add(-recordSizeResetIdle)
+		if limit := rs.limit(); limit != rs.minPayload {
+			t.Errorf("expecting %v after a quiet spell, got %v", rs.minPayload, limit)
+		}
+	})
+
+	t.Run("full sizing", func(t *testing.T) {
+		if makeRecordSizer(RECORD_SIZING_FULL, 30, maxPayload) != nil {
+			t.Error("full sizing has a sizer")
+		}
+	})
+}
+
+func TestStream_RecordSizing(t *testing.T) {
+	clientSession, serverSession, pairs := makeSessionPair(1, func(client, server *SessionConfig) {
+		client.RecordSizing, server.RecordSizing = RECORD_SIZING_DYNAMIC, RECORD_SIZING_DYNAMIC
+	})
+	defer clientSession.Close()
+	clientConn := pairs[0].clientConn
+	clientConn.recording.Store(true)
+	go serveEcho(serverSession)
+
+	stream, _ := clientSession.OpenStream()
+	data := make([]byte, 64*1024)
+	common.CryptoRandRead(data)
+	echo(t, stream, data)
+
+	lengths := clientConn.writeLengths()
+	if len(lengths) < 2 {
+		t.Fatalf("expecting the write to be split into growing frames, got %v", lengths)
+	}
+	if lengths[0] > tcpMSSEstimate {
+		t.Errorf("first frame of %v doesn't fit in a segment", lengths[0])
+	}
+	for i := 1; i < len(lengths)-1; i++ {
+		if lengths[i] < lengths[i-1] {
+			t.Errorf("frame %v of %v is smaller than the one before it of %v", i, lengths[i], lengths[i-1])
+		}
+	}
+}
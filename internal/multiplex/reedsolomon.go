@@ -0,0 +1,171 @@
+package multiplex
+
+import "errors"
+
+// A systematic Reed-Solomon erasure code over GF(2^8). The data shards are sent as they are, and each parity shard
+// is a combination of all of them by a row of a Cauchy matrix. Every square submatrix of a Cauchy matrix can be
+// inverted, so any dataShards of the shards of a block are enough to get the rest of the data back.
+
+var errTooFewShards = errors.New("too few shards to reconstruct the data")
+
+var gfExp [510]byte
+var gfLog [256]byte
+
+// gfMulTable[a][b] is a times b
+var gfMulTable [256][256]byte
+
+func init() {
+	// generated by 2 modulo x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := range gfMulTable {
+		for b := range gfMulTable[a] {
+			gfMulTable[a][b] = gfMul(byte(a), byte(b))
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c times src to dst
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	product := &gfMulTable[c]
+	for i, s := range src {
+		dst[i] ^= product[s]
+	}
+}
+
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	// parityShards rows of dataShards
+	parityMatrix [][]byte
+}
+
+// makeReedSolomon takes dataShards+parityShards to be no more than 256
+func makeReedSolomon(dataShards, parityShards int) *reedSolomon {
+	rs := &reedSolomon{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		parityMatrix: make([][]byte, parityShards),
+	}
+	for i := range rs.parityMatrix {
+		rs.parityMatrix[i] = make([]byte, dataShards)
+		for j := range rs.parityMatrix[i] {
+			rs.parityMatrix[i][j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+	}
+	return rs
+}
+
+// encode makes the parity shards of data, which are all of the same length
+func (rs *reedSolomon) encode(data [][]byte) [][]byte {
+	parity := make([][]byte, rs.parityShards)
+	for i, row := range rs.parityMatrix {
+		parity[i] = make([]byte, len(data[0]))
+		for j, shard := range data {
+			gfMulAdd(parity[i], shard, row[j])
+		}
+	}
+	return parity
+}
+
+// reconstruct fills in the nil ones of the data shards from the rest and the parity shards, of which nil ones are
+// missing too. All the shards that are there are of the same length
+func (rs *reedSolomon) reconstruct(data, parity [][]byte) error {
+	var missing []int
+	for j, shard := range data {
+		if shard == nil {
+			missing = append(missing, j)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// the rows of the generator matrix of the first dataShards shards there are, and the shards themselves
+	matrix := make([][]byte, 0, rs.dataShards)
+	shards := make([][]byte, 0, rs.dataShards)
+	for j, shard := range data {
+		if shard != nil {
+			row := make([]byte, rs.dataShards)
+			row[j] = 1
+			matrix = append(matrix, row)
+			shards = append(shards, shard)
+		}
+	}
+	for i, shard := range parity {
+		if len(matrix) == rs.dataShards {
+			break
+		}
+		if shard != nil {
+			matrix = append(matrix, append([]byte(nil), rs.parityMatrix[i]...))
+			shards = append(shards, shard)
+		}
+	}
+	if len(matrix) < rs.dataShards {
+		return errTooFewShards
+	}
+
+	inverse := invertMatrix(matrix)
+	for _, j := range missing {
+		data[j] = make([]byte, len(shards[0]))
+		for k, shard := range shards {
+			gfMulAdd(data[j], shard, inverse[j][k])
+		}
+	}
+	return nil
+}
+
+// invertMatrix inverts an invertible square matrix by Gauss-Jordan elimination, overwriting it
+func invertMatrix(m [][]byte) [][]byte {
+	n := len(m)
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for m[pivot][col] == 0 {
+			pivot++
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfInv(m[col][col])
+		for k := 0; k < n; k++ {
+			m[col][k] = gfMul(m[col][k], scale)
+			inverse[col][k] = gfMul(inverse[col][k], scale)
+		}
+		for row := 0; row < n; row++ {
+			if row == col || m[row][col] == 0 {
+				continue
+			}
+			c := m[row][col]
+			gfMulAdd(m[row], m[col], c)
+			gfMulAdd(inverse[row], inverse[col], c)
+		}
+	}
+	return inverse
+}
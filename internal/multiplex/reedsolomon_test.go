@@ -0,0 +1,67 @@
+package multiplex
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	const dataShards, parityShards, shardLen = 10, 4, 100
+	rs := makeReedSolomon(dataShards, parityShards)
+	data := make([][]byte, dataShards)
+	for i := range data {
+		data[i] = make([]byte, shardLen)
+		rand.Read(data[i])
+	}
+	parity := rs.encode(data)
+	if len(parity) != parityShards {
+		t.Fatalf("expecting %v parity shards, got %v", parityShards, len(parity))
+	}
+
+	t.Run("any missing up to the parity shards", func(t *testing.T) {
+		for trial := 0; trial < 100; trial++ {
+			gotData := append([][]byte(nil), data...)
+			gotParity := append([][]byte(nil), parity...)
+			for _, i := range rand.Perm(dataShards + parityShards)[:parityShards] {
+				if i < dataShards {
+					gotData[i] = nil
+				} else {
+					gotParity[i-dataShards] = nil
+				}
+			}
+			if err := rs.reconstruct(gotData, gotParity); err != nil {
+				t.Fatal(err)
+			}
+			for i := range data {
+				if !bytes.Equal(gotData[i], data[i]) {
+					t.Fatalf("data shard %v reconstructed wrong", i)
+				}
+			}
+		}
+	})
+
+	t.Run("too many missing", func(t *testing.T) {
+		gotData := append([][]byte(nil), data...)
+		for i := 0; i < parityShards+1; i++ {
+			gotData[i] = nil
+		}
+		if err := rs.reconstruct(gotData, parity); err != errTooFewShards {
+			t.Errorf("expecting %v, got %v", errTooFewShards, err)
+		}
+	})
+}
+
+func BenchmarkReedSolomon_Encode(b *testing.B) {
+	rs := makeReedSolomon(10, 3)
+	data := make([][]byte, 10)
+	for i := range data {
+		data[i] = make([]byte, 16384)
+		rand.Read(data[i])
+	}
+	b.SetBytes(10 * 16384)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.encode(data)
+	}
+}
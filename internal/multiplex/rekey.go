@@ -0,0 +1,324 @@
+package multiplex
+
+// With Rekeys, the payload of frames is sealed with keys of epochs that are moved on from every so often, so that
+// one that's found out, e.g. from the memory of a process, doesn't open what has been recorded of the session before.
+// The client starts a rekey every RekeyInterval with a C_REKEY frame carrying an ephemeral X25519 public key, and the
+// server answers with one of its own. The key of the next epoch is derived with HKDF from their key exchange, salted
+// with the key of the epoch before, so it can't be had from any key before it, nor the other way round. The server
+// sends in the next epoch once a frame of it has come from the client, which moves on as soon as it has the answer. A
+// bit of the header of each frame tells which of two epochs in a row its payload is sealed in, and the cipher of the
+// epoch before is forgotten once its frames can no longer be on the way.
+//
+// Headers are still obfuscated with the session key, which is kept for connections to be added to the session with.
+// It only opens the payload of the first epoch. A resumable session isn't rekeyed, as what it retains to send again
+// has been sealed already. Only a server with CAP_REKEY is sent a C_REKEY, as an older one would take it for a frame
+// of a stream
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	log "github.com/sirupsen/logrus"
+)
+
+// the bit of the last byte of a frame's header that tells which of two epochs in a row its payload is sealed in
+const epochBit = 0x40
+
+// how long the cipher of an epoch is kept after frames stop being sent in it, for those that are still on the way
+const rekeyGrace = time.Minute
+
+// MinRekeyInterval is the shortest RekeyInterval, so that the epoch before has been forgotten by the time a rekey
+// starts the next
+const MinRekeyInterval = 2 * rekeyGrace
+
+var errUnknownEpoch = errors.New("frame is of an epoch whose key isn't known")
+var errBadRekey = errors.New("bad rekey")
+
+type epochKeys struct {
+	encryptionMethod byte
+
+	m sync.RWMutex
+	// the epoch frames are sent in, and its key, from which that of the next is derived
+	epoch uint64
+	key   *common.Secret
+	// the ciphers of two epochs in a row by the parities of their numbers, either side of epoch. nil where there
+	// isn't one
+	ciphers [2]cipher.AEAD
+	epochs  [2]uint64
+	// the key of the next epoch, nil unless the server has answered a rekey whose epoch hasn't been sent in yet
+	nextKey *common.Secret
+	// the ephemeral private key of the rekey the client has started, nil if it hasn't
+	ephemeral *common.Secret
+}
+
+func makeEpochKeys(sessionKey *common.Secret, encryptionMethod byte, payloadCipher cipher.AEAD) *epochKeys {
+	k := &epochKeys{encryptionMethod: encryptionMethod}
+	k.ciphers[0] = payloadCipher
+	if !sessionKey.Use(func(key []byte) { k.key = common.NewSecret(key) }) {
+		// rekeying fails, and so does everything else
+		k.key = common.NewSecret(nil)
+		k.key.Wipe()
+	}
+	return k
+}
+
+func epochBitsOf(epoch uint64) byte {
+	if epoch&1 == 1 {
+		return epochBit
+	}
+	return 0
+}
+
+func (k *epochKeys) sealing() (cipher.AEAD, byte) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	return k.ciphers[k.epoch&1], epochBitsOf(k.epoch)
+}
+
+func (k *epochKeys) opening(bits byte) (cipher.AEAD, error) {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	c := k.ciphers[bits>>6]
+	if c == nil {
+		return nil, errUnknownEpoch
+	}
+	return c, nil
+}
+
+// opened moves the server on to the next epoch once a frame of it has come
+func (k *epochKeys) opened(bits byte) {
+	k.m.RLock()
+	next := k.nextKey != nil && epochBitsOf(k.epoch+1) == bits
+	k.m.RUnlock()
+	if next {
+		k.m.Lock()
+		if k.nextKey != nil && epochBitsOf(k.epoch+1) == bits {
+			k.advance(k.nextKey)
+		}
+		k.m.Unlock()
+	}
+}
+
+// advance sends in the next epoch, whose key is nextKey, and forgets the cipher of this one after rekeyGrace. k.m
+// must be held
+func (k *epochKeys) advance(nextKey *common.Secret) {
+	k.key.Wipe()
+	k.key, k.nextKey = nextKey, nil
+	k.epoch++
+	old := k.epoch - 1
+	time.AfterFunc(rekeyGrace, func() {
+		k.m.Lock()
+		defer k.m.Unlock()
+		if k.epochs[old&1] == old {
+			k.ciphers[old&1] = nil
+		}
+	})
+}
+
+// derive installs the cipher of the epoch after this one, from the key exchange of ephemeral and peerPub, and
+// returns its key. k.m must be held
+func (k *epochKeys) derive(ephemeral crypto.PrivateKey, peerPub []byte) (*common.Secret, error) {
+	pub, ok := ecdh.Unmarshal(peerPub)
+	if !ok {
+		return nil, errBadRekey
+	}
+	shared := ecdh.GenerateSharedSecret(ephemeral, pub)
+	defer clear(shared)
+	if subtle.ConstantTimeCompare(shared, make([]byte, len(shared))) == 1 {
+		return nil, errors.New("key exchange of rekey is all 0s")
+	}
+
+	var next []byte
+	var err error
+	if !k.key.Use(func(key []byte) { next, err = hkdf.Key(sha256.New, shared, key, "cloak epoch key", 32) }) {
+		return nil, errWipedSessionKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer clear(next)
+	c, err := makePayloadCipher(k.encryptionMethod, next)
+	if err != nil {
+		return nil, err
+	}
+	epoch := k.epoch + 1
+	k.ciphers[epoch&1], k.epochs[epoch&1] = c, epoch
+	return common.NewSecret(next), nil
+}
+
+// rekeyPayload is the payload of a C_REKEY frame moving on to epoch
+func rekeyPayload(epoch uint64, pub crypto.PublicKey) []byte {
+	payload := make([]byte, 8, 8+32)
+	putU64(payload, epoch)
+	payload = append(payload, ecdh.Marshal(pub)...)
+	// so that rekeys aren't told apart from other frames by their length
+	return append(payload, genRandomPadding()...)
+}
+
+func parseRekey(payload []byte) (epoch uint64, pub []byte, err error) {
+	if len(payload) < 8+32 {
+		return 0, nil, errBadRekey
+	}
+	return u64(payload[:8]), payload[8 : 8+32], nil
+}
+
+// start starts a rekey of the client, returning the payload of its C_REKEY. One that hasn't been answered is given up
+func (k *epochKeys) start() ([]byte, error) {
+	priv, pub, err := ecdh.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k.m.Lock()
+	defer k.m.Unlock()
+	if k.ephemeral != nil {
+		k.ephemeral.Wipe()
+	}
+	k.ephemeral = common.NewSecret(priv.(*[32]byte)[:])
+	clear(priv.(*[32]byte)[:])
+	return rekeyPayload(k.epoch+1, pub), nil
+}
+
+// finish takes the answer of the server to the rekey the client has started, and moves on to the next epoch
+func (k *epochKeys) finish(payload []byte) (uint64, error) {
+	epoch, peerPub, err := parseRekey(payload)
+	if err != nil {
+		return 0, err
+	}
+	k.m.Lock()
+	defer k.m.Unlock()
+	if k.ephemeral == nil || epoch != k.epoch+1 {
+		return 0, errBadRekey
+	}
+	nextKey, err := k.derive(k.ephemeral, peerPub)
+	k.ephemeral.Wipe()
+	k.ephemeral = nil
+	if err != nil {
+		return 0, err
+	}
+	k.advance(nextKey)
+	return k.epoch, nil
+}
+
+// answer takes a rekey started by the client, returning the payload of the server's C_REKEY in answer. The server
+// keeps sending in this epoch until a frame of the next comes
+func (k *epochKeys) answer(payload []byte) ([]byte, error) {
+	epoch, peerPub, err := parseRekey(payload)
+	if err != nil {
+		return nil, err
+	}
+	priv, pub, err := ecdh.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(priv.(*[32]byte)[:])
+	k.m.Lock()
+	defer k.m.Unlock()
+	// a rekey the client has given up on is started again for the same epoch
+	if epoch != k.epoch+1 {
+		return nil, errBadRekey
+	}
+	nextKey, err := k.derive(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	if k.nextKey != nil {
+		k.nextKey.Wipe()
+	}
+	k.nextKey = nextKey
+	return rekeyPayload(epoch, pub), nil
+}
+
+// wipe wipes the keys, for when the session closes. It does nothing if k is nil
+func (k *epochKeys) wipe() {
+	if k == nil {
+		return
+	}
+	k.m.Lock()
+	defer k.m.Unlock()
+	for _, secret := range []*common.Secret{k.key, k.nextKey, k.ephemeral} {
+		if secret != nil {
+			secret.Wipe()
+		}
+	}
+}
+
+// rekeyEvery starts a rekey every RekeyInterval, once the remote is known to have CAP_REKEY
+func (sesh *Session) rekeyEvery() {
+	ticker := time.NewTicker(sesh.RekeyInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if sesh.IsClosed() {
+			return
+		}
+		if !sesh.peerHas(CAP_REKEY) {
+			continue
+		}
+		payload, err := sesh.rekey.start()
+		if err != nil {
+			log.Errorf("failed to start a rekey of session %v: %v", sesh.id, err)
+			continue
+		}
+		frame, err := sesh.sessionFrame(C_REKEY, payload)
+		if err != nil {
+			log.Errorf("failed to make rekey frame for session %v: %v", sesh.id, err)
+			continue
+		}
+		if _, err = sesh.sb.send(frame, new(uint32)); err != nil {
+			log.Debugf("failed to send rekey of session %v: %v", sesh.id, err)
+		}
+	}
+}
+
+// recvRekey takes a C_REKEY frame of the remote, which is the answer to a rekey if the session starts them
+func (sesh *Session) recvRekey(frame *Frame) {
+	if sesh.rekey == nil {
+		return
+	}
+	if sesh.RekeyInterval > 0 {
+		epoch, err := sesh.rekey.finish(frame.Payload)
+		if err != nil {
+			log.Warnf("failed to rekey session %v: %v", sesh.id, err)
+			return
+		}
+		log.Debugf("session %v is rekeyed to epoch %v", sesh.id, epoch)
+		// a frame of the new epoch, which moves the server on to it
+		pad := genRandomPadding()
+		if len(pad) == 0 {
+			// a frame can't be empty
+			pad = make([]byte, 1)
+			common.CryptoRandRead(pad)
+		}
+		padding, err := sesh.sessionFrame(C_PADDING, pad)
+		if err != nil {
+			log.Errorf("failed to make padding frame for session %v: %v", sesh.id, err)
+			return
+		}
+		if _, err = sesh.sb.send(padding, new(uint32)); err != nil {
+			log.Debugf("failed to send padding of session %v: %v", sesh.id, err)
+		}
+		return
+	}
+
+	payload, err := sesh.rekey.answer(frame.Payload)
+	if err != nil {
+		log.Warnf("failed to answer rekey of session %v: %v", sesh.id, err)
+		return
+	}
+	answer, err := sesh.sessionFrame(C_REKEY, payload)
+	if err != nil {
+		log.Errorf("failed to make rekey frame for session %v: %v", sesh.id, err)
+		return
+	}
+	if _, err = sesh.sb.send(answer, new(uint32)); err != nil {
+		log.Debugf("failed to send rekey of session %v: %v", sesh.id, err)
+	}
+}
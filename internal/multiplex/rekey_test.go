@@ -0,0 +1,135 @@
+package multiplex
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+)
+
+func (k *epochKeys) sendingEpoch() uint64 {
+	k.m.RLock()
+	defer k.m.RUnlock()
+	return k.epoch
+}
+
+func TestEpochKeys(t *testing.T) {
+	sessionKey := common.NewSecret(make([]byte, 32))
+	defer sessionKey.Wipe()
+	payloadCipher, _ := makePayloadCipher(E_METHOD_AES_GCM, make([]byte, 32))
+	client := makeEpochKeys(sessionKey, E_METHOD_AES_GCM, payloadCipher)
+	server := makeEpochKeys(sessionKey, E_METHOD_AES_GCM, payloadCipher)
+	defer client.wipe()
+	defer server.wipe()
+
+	obfsBuf := make([]byte, 1024)
+	send := func(from *epochKeys, to *epochKeys) ([]byte, error) {
+		payload := []byte("hello")
+		n, err := makeObfs(sessionKey, from)(&Frame{StreamID: 1, Payload: payload}, obfsBuf, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frame, err := makeDeobfs(sessionKey, to)(obfsBuf[:n])
+		if err != nil {
+			return nil, err
+		}
+		return frame.Payload, nil
+	}
+	rekey := func() {
+		request, err := client.start()
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer, err := server.answer(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = client.finish(answer); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rekey()
+	if client.sendingEpoch() != 1 || server.sendingEpoch() != 0 {
+		t.Fatalf("expecting the client in epoch 1 and the server in 0, got %v and %v", client.sendingEpoch(), server.sendingEpoch())
+	}
+	if payload, err := send(server, client); err != nil || !bytes.Equal(payload, []byte("hello")) {
+		t.Errorf("frame of the epoch before isn't opened: %v", err)
+	}
+	if payload, err := send(client, server); err != nil || !bytes.Equal(payload, []byte("hello")) {
+		t.Errorf("frame of the next epoch isn't opened: %v", err)
+	}
+	if server.sendingEpoch() != 1 {
+		t.Fatalf("expecting the server to move on to epoch 1, got %v", server.sendingEpoch())
+	}
+
+	t.Run("stale rekey", func(t *testing.T) {
+		request, _ := client.start()
+		putU64(request, 1)
+		if _, err := server.answer(request); err == nil {
+			t.Error("rekey to an epoch that has been moved on to is answered")
+		}
+	})
+
+	t.Run("epoch forgotten", func(t *testing.T) {
+		n, _ := makeObfs(sessionKey, client)(&Frame{StreamID: 1, Payload: []byte("hello")}, obfsBuf, 0)
+		stale := append([]byte{}, obfsBuf[:n]...)
+		rekey()
+		if _, err := send(client, server); err != nil {
+			t.Fatal(err)
+		}
+		rekey()
+		if _, err := send(client, server); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := makeDeobfs(sessionKey, server)(stale); err == nil {
+			t.Error("frame of an epoch two before is opened")
+		}
+	})
+
+	t.Run("bad key exchange", func(t *testing.T) {
+		request, _ := client.start()
+		// a low order point, whose key exchange is all 0s
+		copy(request[8:40], make([]byte, 32))
+		if _, err := server.answer(request); err == nil {
+			t.Error("rekey of a low order point is answered")
+		}
+	})
+}
+
+func TestRekey(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	obfuscator, _ := MakeObfuscator(E_METHOD_CHACHA20_POLY1305, [32]byte{1})
+	clientSession := MakeSession(1, SessionConfig{Obfuscator: obfuscator, Rekeys: true, RekeyInterval: interval})
+	serverSession := MakeSession(1, SessionConfig{Obfuscator: obfuscator, Rekeys: true})
+	defer clientSession.Close()
+	if serverSession.Capabilities&CAP_REKEY == 0 {
+		t.Error("server doesn't have CAP_REKEY")
+	}
+	c, s := connutil.AsyncPipe()
+	clientSession.AddConnection(&common.TLSConn{Conn: c})
+	serverSession.AddConnection(&common.TLSConn{Conn: s})
+	go serveEcho(serverSession)
+
+	stream, _ := clientSession.OpenStream()
+	deadline := time.Now().Add(5 * interval)
+	for time.Now().Before(deadline) {
+		echo(t, stream, []byte("hello"))
+		time.Sleep(interval / 10)
+	}
+	if clientSession.rekey.sendingEpoch() < 2 || serverSession.rekey.sendingEpoch() < 2 {
+		t.Errorf("expecting the session to be rekeyed, the client is in epoch %v and the server in %v",
+			clientSession.rekey.sendingEpoch(), serverSession.rekey.sendingEpoch())
+	}
+
+	t.Run("not encrypted", func(t *testing.T) {
+		plain, _ := MakeObfuscator(E_METHOD_PLAIN, [32]byte{})
+		sesh := MakeSession(1, SessionConfig{Obfuscator: plain, Rekeys: true})
+		defer sesh.Close()
+		if sesh.rekey != nil || sesh.Capabilities&CAP_REKEY != 0 {
+			t.Error("session without encryption is rekeyed")
+		}
+	})
+}
@@ -0,0 +1,370 @@
+package multiplex
+
+// A resumable session outlives the connections it's on, e.g. when a client moves between networks. Each end keeps
+// the frames it has sent on ordered streams until the other end acknowledges them. The acknowledgements are C_ACK
+// frames carrying how far each stream has been received, sent every second or so when there's been something to
+// acknowledge, and on every connection every few seconds as a heartbeat. A connection that hasn't had anything read
+// from it in a while is deemed dead, as a network change tends to leave connections hanging rather than closed.
+//
+// The frames in flight on a connection that drops are lost. The end that sees it tells the other end how far it has
+// received with a C_RESUME frame, then sends again all it has kept. The other end does the same on receiving the
+// C_RESUME. If the last connection dropped, the session waits for a new one for up to the grace period and holds
+// off writes meanwhile. Either end drops the frames it already has.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ackInterval = time.Second
+	// this much received makes an acknowledgement go out before the next tick
+	ackThreshold = 1 << 20
+	// how often an acknowledgement is sent on every connection
+	heartbeatInterval = 5 * time.Second
+	// a connection that hasn't been read from in this long, despite the heartbeats, is dead
+	deadConnTimeout = 3 * heartbeatInterval
+	// a session that has more than this sent but unacknowledged is no longer resumable
+	retainLimit = 16 << 20
+
+	// u32 stream id then u64 next seq to receive
+	ackEntryLen = 12
+	// the next seq of a stream that has been closed, which acknowledges all of it
+	streamGone = ^uint64(0)
+)
+
+type retainedFrame struct {
+	streamID uint32
+	seq      uint64
+	data     []byte
+}
+
+type resumption struct {
+	grace time.Duration
+
+	// atomic. Whether the remote keeps frames for us too. The client only learns this from the first
+	// acknowledgement the server sends
+	peerResumes uint32
+	// atomic
+	overflowed uint32
+	// atomic
+	receivedSinceAck int64
+
+	retainedM sync.Mutex
+	retained  []retainedFrame
+	size      int
+	// streams that were closed by the remote since the last acknowledgement
+	closedSinceAck []uint32
+
+	ackCh        chan struct{}
+	monitorOnce  sync.Once
+	announceOnce sync.Once
+}
+
+func makeResumption(grace time.Duration, peerResumes bool) *resumption {
+	r := &resumption{
+		grace: grace,
+		ackCh: make(chan struct{}, 1),
+	}
+	if peerResumes {
+		r.peerResumes = 1
+	}
+	return r
+}
+
+func (sesh *Session) resumable() bool {
+	r := sesh.resumption
+	return r != nil && atomic.LoadUint32(&r.peerResumes) == 1 && atomic.LoadUint32(&r.overflowed) == 0
+}
+
+// retain keeps a copy of a frame sent on an ordered stream until it's acknowledged
+func (sesh *Session) retain(streamID uint32, seq uint64, frame []byte) {
+	r := sesh.resumption
+	if r == nil || atomic.LoadUint32(&r.overflowed) == 1 {
+		return
+	}
+	data := make([]byte, len(frame))
+	copy(data, frame)
+
+	r.retainedM.Lock()
+	defer r.retainedM.Unlock()
+	if r.size+len(data) > retainLimit {
+		if atomic.LoadUint32(&r.peerResumes) == 1 {
+			log.Warnf("session %v has too much unacknowledged and can no longer be resumed", sesh.id)
+		} else {
+			log.Warnf("remote of session %v doesn't acknowledge frames and may not support resumption", sesh.id)
+		}
+		atomic.StoreUint32(&r.overflowed, 1)
+		r.retained = nil
+		r.size = 0
+		return
+	}
+	r.retained = append(r.retained, retainedFrame{streamID, seq, data})
+	r.size += len(data)
+}
+
+// forgetStream is called when the remote closes a stream, which means it has had all we sent on it
+func (sesh *Session) forgetStream(streamID uint32) {
+	r := sesh.resumption
+	if r == nil {
+		return
+	}
+	r.retainedM.Lock()
+	defer r.retainedM.Unlock()
+	r.trim(map[uint32]uint64{streamID: streamGone})
+	r.closedSinceAck = append(r.closedSinceAck, streamID)
+}
+
+// trim drops the retained frames that have been received according to acked. Must hold retainedM
+func (r *resumption) trim(acked map[uint32]uint64) {
+	kept := r.retained[:0]
+	for _, f := range r.retained {
+		if next, ok := acked[f.streamID]; ok && f.seq < next {
+			r.size -= len(f.data)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	// so that the dropped ones can be garbage collected
+	for i := len(kept); i < len(r.retained); i++ {
+		r.retained[i] = retainedFrame{}
+	}
+	r.retained = kept
+}
+
+// received counts bytes of frames received, for acknowledgements to be sent before the next tick if need be
+func (sesh *Session) received(n int) {
+	r := sesh.resumption
+	if r == nil {
+		return
+	}
+	if atomic.AddInt64(&r.receivedSinceAck, int64(n)) >= ackThreshold {
+		select {
+		case r.ackCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// stateFrames makes obfuscated frames of type closing of how far each ordered stream has been received
+func (sesh *Session) stateFrames(closing uint8) ([][]byte, error) {
+	var entries []byte
+	sesh.streams.Range(func(idI, streamI interface{}) bool {
+		if streamI == nil {
+			return true
+		}
+		buf, ok := streamI.(*Stream).recvBuf.(*streamBuffer)
+		if !ok {
+			return true
+		}
+		entries = binary.BigEndian.AppendUint32(entries, idI.(uint32))
+		entries = binary.BigEndian.AppendUint64(entries, buf.received())
+		return true
+	})
+	r := sesh.resumption
+	r.retainedM.Lock()
+	for _, id := range r.closedSinceAck {
+		entries = binary.BigEndian.AppendUint32(entries, id)
+		entries = binary.BigEndian.AppendUint64(entries, streamGone)
+	}
+	r.closedSinceAck = nil
+	r.retainedM.Unlock()
+
+	perFrame := (sesh.maxStreamUnitWrite - 2) / ackEntryLen
+	var frames [][]byte
+	for {
+		n := len(entries) / ackEntryLen
+		if n > perFrame {
+			n = perFrame
+		}
+		payload := make([]byte, 2, 2+n*ackEntryLen)
+		binary.BigEndian.PutUint16(payload, uint16(n))
+		payload = append(payload, entries[:n*ackEntryLen]...)
+		entries = entries[n*ackEntryLen:]
+
+		f := &Frame{
+			StreamID: 0xffffffff,
+			Closing:  closing,
+			Payload:  payload,
+		}
+		obfsBuf := make([]byte, len(payload)+64)
+		i, err := sesh.Obfs(f, obfsBuf, 0)
+		if err != nil {
+			return nil, err
+		}
+		// of exactly its length, so that no write would touch the others
+		frame := make([]byte, i)
+		copy(frame, obfsBuf[:i])
+		frames = append(frames, frame)
+		if len(entries) == 0 {
+			return frames, nil
+		}
+	}
+}
+
+func (sesh *Session) sendState(closing uint8) {
+	frames, err := sesh.stateFrames(closing)
+	if err != nil {
+		log.Errorf("failed to make acknowledgement for session %v: %v", sesh.id, err)
+		return
+	}
+	for _, frame := range frames {
+		if _, err = sesh.sb.send(frame, new(uint32)); err != nil {
+			log.Debugf("failed to send acknowledgement for session %v: %v", sesh.id, err)
+			return
+		}
+	}
+}
+
+// heartbeat sends an acknowledgement on every connection
+func (sesh *Session) heartbeat() {
+	frames, err := sesh.stateFrames(C_ACK)
+	if err != nil {
+		log.Errorf("failed to make acknowledgement for session %v: %v", sesh.id, err)
+		return
+	}
+	sesh.sb.broadcast(frames)
+}
+
+// recvState applies an acknowledgement, or a request to resume, from the remote
+func (sesh *Session) recvState(frame *Frame) error {
+	r := sesh.resumption
+	if r == nil {
+		// we didn't ask for resumption
+		return nil
+	}
+	p := frame.Payload
+	if len(p) < 2 || len(p)-2 < int(binary.BigEndian.Uint16(p))*ackEntryLen {
+		return fmt.Errorf("malformed acknowledgement for session %v", sesh.id)
+	}
+	n := int(binary.BigEndian.Uint16(p))
+	acked := make(map[uint32]uint64, n)
+	for i := 0; i < n; i++ {
+		entry := p[2+i*ackEntryLen:]
+		acked[binary.BigEndian.Uint32(entry)] = binary.BigEndian.Uint64(entry[4:])
+	}
+	if atomic.CompareAndSwapUint32(&r.peerResumes, 0, 1) {
+		log.Debugf("session %v is resumable", sesh.id)
+	}
+	r.monitorOnce.Do(func() { go sesh.monitorResumption() })
+
+	r.retainedM.Lock()
+	r.trim(acked)
+	r.retainedM.Unlock()
+
+	if frame.Closing == C_RESUME {
+		log.Debugf("remote is resuming session %v", sesh.id)
+		go sesh.resendRetained()
+	}
+	return nil
+}
+
+// resendRetained sends again what hasn't been acknowledged, as it may have been lost with a connection
+func (sesh *Session) resendRetained() {
+	r := sesh.resumption
+	r.retainedM.Lock()
+	toSend := make([]retainedFrame, len(r.retained))
+	copy(toSend, r.retained)
+	// the frames of streams we've closed won't be acknowledged by a live stream, so they're only sent once more
+	kept := r.retained[:0]
+	for _, f := range r.retained {
+		if streamI, ok := sesh.streams.Load(f.streamID); ok && streamI == nil {
+			r.size -= len(f.data)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	for i := len(kept); i < len(r.retained); i++ {
+		r.retained[i] = retainedFrame{}
+	}
+	r.retained = kept
+	r.retainedM.Unlock()
+
+	log.Debugf("sending %v unacknowledged frames of session %v again", len(toSend), sesh.id)
+	var connId uint32
+	for _, f := range toSend {
+		data := make([]byte, len(f.data))
+		copy(data, f.data)
+		if _, err := sesh.sb.send(data, &connId); err != nil {
+			log.Debugf("failed to resume session %v: %v", sesh.id, err)
+			return
+		}
+	}
+}
+
+// connLost is called when a connection of a resumable session has dropped
+func (sesh *Session) connLost() {
+	if sesh.IsClosed() {
+		return
+	}
+	if sesh.Redial != nil {
+		go sesh.Redial()
+	}
+	if sesh.sb.connsCount() == 0 {
+		log.Infof("session %v has no connection left, waiting %v for one", sesh.id, sesh.resumption.grace)
+		sesh.sb.suspend()
+		if sesh.sb.connsCount() > 0 && sesh.sb.endSuspension() {
+			// one came in the meantime
+			go sesh.resume()
+		}
+		return
+	}
+	go sesh.resume()
+}
+
+// resume asks the remote to send again what it has kept and does the same, after a connection has been lost
+func (sesh *Session) resume() {
+	sesh.sendState(C_RESUME)
+	sesh.resendRetained()
+	sesh.sendWindows()
+}
+
+func (sesh *Session) monitorResumption() {
+	r := sesh.resumption
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	lastHeartbeat := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-r.ackCh:
+		}
+		if sesh.IsClosed() {
+			return
+		}
+		now := time.Now()
+		if sesh.sb.connsCount() > 0 {
+			r.retainedM.Lock()
+			closed := len(r.closedSinceAck) > 0
+			r.retainedM.Unlock()
+			received := atomic.SwapInt64(&r.receivedSinceAck, 0) > 0
+			if now.Sub(lastHeartbeat) >= heartbeatInterval {
+				lastHeartbeat = now
+				sesh.heartbeat()
+			} else if received || closed {
+				go sesh.sendState(C_ACK)
+			}
+		}
+		if !sesh.resumable() {
+			continue
+		}
+
+		sesh.sb.lastReads.Range(func(idI, lastI interface{}) bool {
+			if now.Sub(time.Unix(0, atomic.LoadInt64(lastI.(*int64)))) > deadConnTimeout {
+				log.Debugf("a connection of session %v has had nothing to read for %v", sesh.id, deadConnTimeout)
+				sesh.sb.dropConn(idI.(uint32))
+				sesh.connLost()
+			}
+			return true
+		})
+		if since := sesh.sb.suspendedFor(); !since.IsZero() && now.Sub(since) > r.grace {
+			sesh.sb.close("no connection has come back in time to resume the session")
+			return
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withResumption makes the client resume the session within grace, and the server too if serverResumes
+func withResumption(grace time.Duration, serverResumes bool) sessionPairOption {
+	return func(client, server *SessionConfig) {
+		client.ResumeGrace = grace
+		if serverResumes {
+			server.ResumeGrace = grace
+			server.PeerResumes = true
+		}
+	}
+}
+
+func echo(t *testing.T, stream *Stream, data []byte) {
+	if _, err := stream.Write(data); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	got := make([]byte, len(data))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(stream, got); err != nil {
+		t.Fatalf("failed to read echo: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo doesn't match what's sent")
+	}
+}
+
+func waitFor(cond func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func TestResumption(t *testing.T) {
+	t.Run("frames lost with the last connection are sent again", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withResumption(time.Minute, true))
+		go serveEcho(serverSession)
+		conn := connect(clientSession, serverSession).clientConn
+		clientSession.Redial = func() { connect(clientSession, serverSession) }
+
+		stream, _ := clientSession.OpenStream()
+		echo(t, stream, []byte("before"))
+		if !waitFor(clientSession.resumable, 2*time.Second) {
+			t.Fatal("client doesn't find out the session is resumable")
+		}
+
+		atomic.StoreUint32(&conn.losing, 1)
+		if _, err := stream.Write([]byte(" lost")); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		got := make([]byte, len(" lost"))
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(stream, got); err != nil {
+			t.Fatalf("failed to read echo: %v", err)
+		}
+		if string(got) != " lost" {
+			t.Errorf("expecting \" lost\", got %q", got)
+		}
+		echo(t, stream, []byte(" after"))
+		if clientSession.IsClosed() || serverSession.IsClosed() {
+			t.Error("session closed after being resumed")
+		}
+	})
+
+	t.Run("acknowledged frames are dropped", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withResumption(time.Minute, true))
+		go serveEcho(serverSession)
+		connect(clientSession, serverSession)
+
+		stream, _ := clientSession.OpenStream()
+		echo(t, stream, make([]byte, 4096))
+		retained := func(sesh *Session) int {
+			sesh.resumption.retainedM.Lock()
+			defer sesh.resumption.retainedM.Unlock()
+			return sesh.resumption.size
+		}
+		if !waitFor(func() bool { return retained(clientSession) == 0 && retained(serverSession) == 0 }, 3*time.Second) {
+			t.Errorf("%v and %v bytes still retained", retained(clientSession), retained(serverSession))
+		}
+
+		stream.Close()
+		if !waitFor(func() bool { return retained(clientSession) == 0 && retained(serverSession) == 0 }, 3*time.Second) {
+			t.Errorf("%v and %v bytes still retained after the stream closed", retained(clientSession), retained(serverSession))
+		}
+	})
+
+	t.Run("closed after the grace period", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withResumption(time.Second, true))
+		conn := connect(clientSession, serverSession).clientConn
+		if !waitFor(clientSession.resumable, 2*time.Second) {
+			t.Fatal("client doesn't find out the session is resumable")
+		}
+		conn.Close()
+
+		time.Sleep(500 * time.Millisecond)
+		if clientSession.IsClosed() || serverSession.IsClosed() {
+			t.Fatal("session closed within the grace period")
+		}
+		if !waitFor(func() bool { return clientSession.IsClosed() && serverSession.IsClosed() }, 3*time.Second) {
+			t.Error("session not closed after the grace period")
+		}
+	})
+
+	t.Run("remote doesn't resume", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(0, withResumption(time.Minute, false))
+		go serveEcho(serverSession)
+		conn := connect(clientSession, serverSession).clientConn
+		stream, _ := clientSession.OpenStream()
+		echo(t, stream, []byte("hello"))
+
+		conn.Close()
+		if !waitFor(clientSession.IsClosed, time.Second) {
+			t.Error("session not closed after its connection dropped")
+		}
+	})
+}
+
+func TestStateFrames(t *testing.T) {
+	sesh, _, _ := makeSessionPair(0, withResumption(time.Minute, true))
+	sesh.maxStreamUnitWrite = 2 + 10*ackEntryLen
+	for i := 0; i < 25; i++ {
+		sesh.openStream(T_STREAM, PRIORITY_NORMAL)
+	}
+	sesh.forgetStream(1000)
+
+	frames, err := sesh.stateFrames(C_ACK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 3 {
+		t.Errorf("expecting 26 entries in 3 frames, got %v frames", len(frames))
+	}
+	entries := 0
+	for _, data := range frames {
+		f, err := sesh.Deobfs(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Closing != C_ACK {
+			t.Errorf("expecting C_ACK, got %v", f.Closing)
+		}
+		if err = sesh.recvState(f); err != nil {
+			t.Error(err)
+		}
+		entries += int(f.Payload[0])<<8 | int(f.Payload[1])
+	}
+	if entries != 26 {
+		t.Errorf("expecting 26 entries, got %v", entries)
+	}
+
+	if err = sesh.recvState(&Frame{Closing: C_ACK, Payload: []byte{0, 1, 0}}); err == nil {
+		t.Error("malformed acknowledgement accepted")
+	}
+}
@@ -0,0 +1,28 @@
+package multiplex
+
+import (
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// tcpRTT is the smoothed round trip time the kernel keeps for the TCP connection under conn
+func tcpRTT(conn net.Conn) (time.Duration, bool) {
+	tcpConn := underlyingTCPConn(conn)
+	if tcpConn == nil {
+		return 0, false
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	var info *unix.TCPInfo
+	ctrlErr := rawConn.Control(func(fd uintptr) {
+		info, err = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if ctrlErr != nil || err != nil || info.Rtt == 0 {
+		return 0, false
+	}
+	return time.Duration(info.Rtt) * time.Microsecond, true
+}
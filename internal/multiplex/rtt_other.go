@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package multiplex
+
+import (
+	"net"
+	"time"
+)
+
+// tcpRTT isn't available here, leaving the latency of a path to how long writes block
+func tcpRTT(conn net.Conn) (time.Duration, bool) { return 0, false }
@@ -1,6 +1,7 @@
 package multiplex
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
@@ -15,7 +16,7 @@ import (
 const (
 	acceptBacklog = 1024
 	// TODO: will this be a signature?
-	defaultSendRecvBufSize = 20480
+	defaultSendRecvBufSize = common.BufferSize
 )
 
 var ErrBrokenSession = errors.New("broken session")
@@ -31,6 +32,71 @@ type SessionConfig struct {
 
 	Unordered bool
 
+	// Multipath spreads frames across connections by how fast each has been, rather than fixing each stream to one.
+	// With Duplicate, every frame is sent on all connections, so that the session outlives all but one of them
+	Multipath bool
+	Duplicate bool
+
+	// ResumeGrace is how long the session waits for a connection after losing all of them, rather than closing. Only
+	// an ordered session can be resumed, and only if PeerResumes, i.e. the remote has agreed to it. The client
+	// doesn't know this when the session is made, and finds it out from the remote. Redial is called whenever a
+	// connection is lost, to have a new one added
+	ResumeGrace time.Duration
+	PeerResumes bool
+	Redial      func()
+
+	// with FECDataShards, frames are sent in blocks of that many followed by FECParityShards frames of parity,
+	// from which lost frames can be recovered. Both are at most MaxFECShards
+	FECDataShards   int
+	FECParityShards int
+
+	// with Heartbeat, a heartbeat is sent on every connection that often, and a connection that has had nothing to
+	// read for a few heartbeats is closed. The remote must be sending heartbeats at the same interval
+	Heartbeat time.Duration
+
+	// the traffic profile, one of the PROFILE_ constants, that what the session sends is shaped after
+	TrafficProfile byte
+
+	// how the frames of streams are sized, one of the RECORD_SIZING_ constants
+	RecordSizing byte
+
+	// whether the closing frames of the session say why it's closed, which the remote must have agreed to
+	CloseReasons bool
+
+	// whether the remote takes a C_DRAIN frame, so that Drain can tell it to go elsewhere
+	PeerDrains bool
+
+	// how many bytes the remote can send on each stream, and on all of them, that haven't been read yet. 0 if it's
+	// not limited. With PeerFlowControl, the remote is known to take C_WINDOW frames, so that it can be told these
+	// as soon as there's a connection
+	StreamWindow    int
+	SessionWindow   int
+	PeerFlowControl bool
+
+	// whether OpenDatagramStream opens unreliable streams, if the remote has them
+	UnreliableDatagrams bool
+
+	// whether the payload of frames of streams is compressed when it gets smaller, which the remote must have agreed to
+	Compression bool
+
+	// the CAP_ capabilities the server has for the session, which it tells the client with AnnounceCapabilities,
+	// i.e. if the client is of a version that takes them. With LearnsCapabilities, features that the remote may not
+	// have are only used once it's told that it does
+	Capabilities         uint32
+	AnnounceCapabilities bool
+	LearnsCapabilities   bool
+
+	// with Rekeys, the payload of frames is sealed with keys that are moved on from with C_REKEY frames, if it's
+	// encrypted and the session isn't resumable, which is then among the Capabilities. A rekey is started every
+	// RekeyInterval, at least MinRekeyInterval, once the remote has CAP_REKEY. The server only answers them, with a
+	// RekeyInterval of 0
+	Rekeys        bool
+	RekeyInterval time.Duration
+
+	// how many bytes of payload of frames of streams can be waiting to be written to the connections at once, over
+	// which Writes wait, or return ErrWouldBlock on a non-blocking stream
+	MaxPendingSend int
+
 	MaxFrameSize      int // maximum size of the frame, including the header
 	SendBufferSize    int
 	ReceiveBufferSize int
@@ -51,6 +117,18 @@ type Session struct {
 	// Switchboard manages all connections to remote
 	sb *switchboard
 
+	// nil if the session isn't resumable
+	resumption *resumption
+
+	// nil if there's no traffic profile
+	shaper *trafficShaper
+
+	// nil if frames are as large as they can be
+	recordSizer *recordSizer
+
+	// nil if the session isn't rekeyed
+	rekey *epochKeys
+
 	// Used for LocalAddr() and RemoteAddr() etc.
 	addrs atomic.Value
 
@@ -58,9 +136,27 @@ type Session struct {
 	acceptCh chan *Stream
 
 	closed uint32
+	// cancelled once the session is closed
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	terminalMsg atomic.Value
 
+	// atomic, the CLOSE_ reason to tell the remote when closing, and the one it's told us
+	closeReason       uint32
+	remoteCloseReason uint32
+
+	// atomic, 1 once the remote has said it's draining
+	draining uint32
+
+	flow flowControl
+
+	pending sendBudget
+
+	// what the remote has told it has
+	peer             peerCapabilities
+	capabilitiesOnce sync.Once
+
 	maxStreamUnitWrite int // the max size passed to Write calls before it splits it into multiple frames
 }
 
@@ -71,7 +167,9 @@ func MakeSession(id uint32, config SessionConfig) *Session {
 		nextStreamID:  1,
 		acceptCh:      make(chan *Stream, acceptBacklog),
 	}
+	sesh.ctx, sesh.cancel = context.WithCancel(context.Background())
 	sesh.addrs.Store([]net.Addr{nil, nil})
+	sesh.holdSessionKey()
 
 	if config.Valve == nil {
 		sesh.Valve = UNLIMITED_VALVE
@@ -82,15 +180,23 @@ func MakeSession(id uint32, config SessionConfig) *Session {
 	if config.ReceiveBufferSize <= 0 {
 		sesh.ReceiveBufferSize = defaultSendRecvBufSize
 	}
+	if config.MaxPendingSend <= 0 {
+		sesh.MaxPendingSend = defaultMaxPendingSend
+	}
 	if config.MaxFrameSize <= 0 {
 		sesh.MaxFrameSize = defaultSendRecvBufSize - 1024
 	}
 	// todo: validation. this must be smaller than the buffer sizes
 	sesh.maxStreamUnitWrite = sesh.MaxFrameSize - HEADER_LEN - sesh.Obfuscator.minOverhead
+	if sesh.FECDataShards > 0 {
+		sesh.maxStreamUnitWrite -= fecOverhead
+	}
 
 	sbConfig := switchboardConfig{
-		valve:          sesh.Valve,
-		recvBufferSize: sesh.ReceiveBufferSize,
+		valve:           sesh.Valve,
+		recvBufferSize:  sesh.ReceiveBufferSize,
+		fecDataShards:   sesh.FECDataShards,
+		fecParityShards: sesh.FECParityShards,
 	}
 	if sesh.Unordered {
 		log.Debug("Connection is unordered")
@@ -98,7 +204,37 @@ func MakeSession(id uint32, config SessionConfig) *Session {
 	} else {
 		sbConfig.strategy = FIXED_CONN_MAPPING
 	}
+	if sesh.Multipath {
+		log.Debug("Connections are multipath")
+		sbConfig.strategy = LATENCY_WEIGHTED
+		sbConfig.duplicate = sesh.Duplicate
+	}
+	sesh.initFlowControl()
+	sesh.initSendBudget()
+	sesh.shaper = makeTrafficShaper(sesh.TrafficProfile)
+	sesh.recordSizer = makeRecordSizer(sesh.RecordSizing, sesh.MaxFrameSize-sesh.maxStreamUnitWrite, sesh.maxStreamUnitWrite)
 	sesh.sb = makeSwitchboard(sesh, sbConfig)
+	if sesh.ResumeGrace > 0 && !sesh.Unordered {
+		sesh.resumption = makeResumption(sesh.ResumeGrace, sesh.PeerResumes)
+		if sesh.PeerResumes {
+			sesh.resumption.monitorOnce.Do(func() { go sesh.monitorResumption() })
+		}
+	}
+	if sesh.Rekeys && sesh.payloadCipher != nil && sesh.resumption == nil {
+		sesh.rekey = makeEpochKeys(sesh.SessionKey, sesh.encryptionMethod, sesh.payloadCipher)
+		sesh.Obfs = makeObfs(sesh.SessionKey, sesh.rekey)
+		sesh.Deobfs = makeDeobfs(sesh.SessionKey, sesh.rekey)
+		sesh.Capabilities |= CAP_REKEY
+		if sesh.RekeyInterval > 0 {
+			go sesh.rekeyEvery()
+		}
+	}
+	if sesh.Heartbeat > 0 {
+		go sesh.monitorHeartbeat()
+	}
+	if sesh.shaper != nil {
+		go sesh.padIdle()
+	}
 	go sesh.timeoutAfter(30 * time.Second)
 	return sesh
 }
@@ -117,15 +253,50 @@ func (sesh *Session) AddConnection(conn net.Conn) {
 	sesh.sb.addConn(conn)
 	addrs := []net.Addr{conn.LocalAddr(), conn.RemoteAddr()}
 	sesh.addrs.Store(addrs)
+	sesh.announceWindows()
+	sesh.announceCapabilities()
+	if sesh.resumable() {
+		// so that the remote knows it can resume the session
+		sesh.resumption.announceOnce.Do(func() { go sesh.sendState(C_ACK) })
+	}
 }
 
 func (sesh *Session) OpenStream() (*Stream, error) {
+	return sesh.openStream(T_STREAM, PRIORITY_NORMAL)
+}
+
+// OpenStreamWithPriority opens a stream whose frames, both ways, take turns with those of other streams by priority,
+// one of the PRIORITY_ constants
+func (sesh *Session) OpenStreamWithPriority(priority uint8) (*Stream, error) {
+	if priority >= numPriorities {
+		return nil, fmt.Errorf("unknown stream priority %v", priority)
+	}
+	return sesh.openStream(T_STREAM, priority)
+}
+
+// OpenDatagramStream opens a stream that keeps the boundaries of each Write, even if the session is ordered. Each Write
+// must fit into one frame. The remote can tell it apart from other streams with IsDatagram. With UnreliableDatagrams,
+// it's an unreliable stream if the remote has them
+func (sesh *Session) OpenDatagramStream() (*Stream, error) {
+	if sesh.UnreliableDatagrams && sesh.peerHas(CAP_UNRELIABLE) {
+		return sesh.OpenUnreliableStream()
+	}
+	return sesh.openStream(T_DATAGRAM, PRIORITY_NORMAL)
+}
+
+// OpenControlStream opens a stream for the client and the server to talk to each other on, which keeps the
+// boundaries of each Write like a datagram stream. The remote can tell it apart from other streams with IsControl
+func (sesh *Session) OpenControlStream() (*Stream, error) {
+	return sesh.openStream(T_CONTROL, PRIORITY_NORMAL)
+}
+
+func (sesh *Session) openStream(streamType uint8, priority uint8) (*Stream, error) {
 	if sesh.IsClosed() {
 		return nil, ErrBrokenSession
 	}
 	id := atomic.AddUint32(&sesh.nextStreamID, 1) - 1
 	// Because atomic.AddUint32 returns the value after incrementation
-	stream := makeStream(sesh, id)
+	stream := makeStream(sesh, id, streamType, priority)
 	sesh.streams.Store(id, stream)
 	sesh.streamCountIncr()
 	log.Tracef("stream %v of session %v opened", id, sesh.id)
@@ -149,36 +320,51 @@ func (sesh *Session) closeStream(s *Stream, active bool) error {
 		return fmt.Errorf("closing stream %v: %w", s.id, errRepeatStreamClosing)
 	}
 	_ = s.recvBuf.Close() // both datagramBuffer and streamBuffer won't return err on Close()
+	s.windowClosed()
 
 	if active {
 		// Notify remote that this stream is closed
 		padding := genRandomPadding()
 		f := &Frame{
-			StreamID: s.id,
-			Seq:      s.nextSendSeq,
-			Closing:  C_STREAM,
-			Payload:  padding,
+			StreamID:   s.id,
+			Seq:        s.nextSendSeq,
+			Closing:    C_STREAM,
+			StreamType: s.streamType,
+			Priority:   s.priority,
+			Payload:    padding,
 		}
 		s.nextSendSeq++
 
-		obfsBuf := make([]byte, len(padding)+64)
+		obfsBufP := common.GetBuffer()
+		defer common.PutBuffer(obfsBufP)
+		obfsBuf := *obfsBufP
 		i, err := sesh.Obfs(f, obfsBuf, 0)
 		if err != nil {
 			return err
 		}
-		_, err = sesh.sb.send(obfsBuf[:i], &s.assignedConnId)
+		if !s.keepsBoundaries() {
+			sesh.retain(s.id, f.Seq, obfsBuf[:i])
+		}
+		_, err = sesh.sb.sendOf(s, obfsBuf[:i])
 		if err != nil {
 			return err
 		}
 		log.Tracef("stream %v actively closed. seq %v", s.id, f.Seq)
 	} else {
+		if !s.keepsBoundaries() {
+			sesh.forgetStream(s.id)
+		}
 		log.Tracef("stream %v passively closed", s.id)
 	}
 
 	sesh.streams.Store(s.id, nil) // id may or may not exist. if we use Delete(s.id) here it will panic
 	if sesh.streamCountDecr() == 0 {
 		log.Debugf("session %v has no active stream left", sesh.id)
-		go sesh.timeoutAfter(30 * time.Second)
+		if sesh.IsDraining() {
+			go sesh.closeDrained()
+		} else {
+			go sesh.timeoutAfter(30 * time.Second)
+		}
 	}
 	return nil
 }
@@ -192,16 +378,50 @@ func (sesh *Session) recvDataFromRemote(data []byte) error {
 		return fmt.Errorf("Failed to decrypt a frame for session %v: %v", sesh.id, err)
 	}
 
+	if err = decompressFrame(frame); err != nil {
+		return fmt.Errorf("Failed to decompress a frame for session %v: %v", sesh.id, err)
+	}
+
 	if frame.Closing == C_SESSION {
-		sesh.SetTerminalMsg("Received a closing notification frame")
+		sesh.recvCloseReason(frame)
 		return sesh.passiveClose()
 	}
-
-	newStream := makeStream(sesh, frame.StreamID)
-	existingStreamI, existing := sesh.streams.LoadOrStore(frame.StreamID, newStream)
+	if frame.Closing == C_ACK || frame.Closing == C_RESUME {
+		return sesh.recvState(frame)
+	}
+	if frame.Closing == C_HEARTBEAT || frame.Closing == C_PADDING {
+		// the connection it came on has been marked as alive already, and there's nothing else to them
+		return nil
+	}
+	if frame.Closing == C_DRAIN {
+		sesh.recvDrain()
+		return nil
+	}
+	if frame.Closing == C_WINDOW {
+		sesh.recvWindow(frame)
+		return nil
+	}
+	if frame.Closing == C_CAPABILITIES {
+		sesh.recvCapabilities(frame)
+		return nil
+	}
+	if frame.Closing == C_REKEY {
+		sesh.recvRekey(frame)
+		return nil
+	}
+	sesh.received(len(data))
+
+	existingStreamI, existing := sesh.streams.Load(frame.StreamID)
+	var newStream *Stream
+	if !existing {
+		// a Stream is only made when there may not be one, as most frames are of a stream that exists
+		newStream = makeStream(sesh, frame.StreamID, frame.StreamType, frame.Priority)
+		existingStreamI, existing = sesh.streams.LoadOrStore(frame.StreamID, newStream)
+	}
 	if existing {
 		if existingStreamI == nil {
 			// this is when the stream existed before but has since been closed. We do nothing
+			sesh.windowDropped(frame)
 			return nil
 		}
 		return existingStreamI.(*Stream).writeFrame(*frame)
@@ -232,6 +452,9 @@ func (sesh *Session) passiveClose() error {
 		log.Debugf("session %v has already been closed", sesh.id)
 		return errRepeatSessionClosing
 	}
+	sesh.cancel()
+	defer sesh.releaseSessionKey()
+	defer sesh.rekey.wipe()
 	sesh.acceptCh <- nil
 
 	sesh.streams.Range(func(key, streamI interface{}) bool {
@@ -245,12 +468,45 @@ func (sesh *Session) passiveClose() error {
 		sesh.streamCountDecr()
 		return true
 	})
+	sesh.wakeWindows()
+	sesh.wakeSenders()
 
 	sesh.sb.closeAll()
 	log.Debugf("session %v closed gracefully", sesh.id)
 	return nil
 }
 
+// sessionFrame obfuscates a frame that isn't of any stream
+func (sesh *Session) sessionFrame(closing uint8, payload []byte) ([]byte, error) {
+	f := &Frame{
+		StreamID: 0xffffffff,
+		Seq:      0,
+		Closing:  closing,
+		Payload:  payload,
+	}
+	obfsBuf := make([]byte, len(payload)+64)
+	i, err := sesh.Obfs(f, obfsBuf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return obfsBuf[:i], nil
+}
+
+// getBuffer takes a buffer of size from the pool if it's of the pool's size, which is that of the default buffers
+func getBuffer(size int) *[]byte {
+	if size == common.BufferSize {
+		return common.GetBuffer()
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+func putBuffer(buf *[]byte) {
+	if len(*buf) == common.BufferSize {
+		common.PutBuffer(buf)
+	}
+}
+
 func genRandomPadding() []byte {
 	lenB := make([]byte, 1)
 	common.CryptoRandRead(lenB)
@@ -265,6 +521,9 @@ func (sesh *Session) Close() error {
 		log.Debugf("session %v has already been closed", sesh.id)
 		return errRepeatSessionClosing
 	}
+	sesh.cancel()
+	defer sesh.releaseSessionKey()
+	defer sesh.rekey.wipe()
 	sesh.acceptCh <- nil
 
 	sesh.streams.Range(func(key, streamI interface{}) bool {
@@ -278,15 +537,20 @@ func (sesh *Session) Close() error {
 		sesh.streamCountDecr()
 		return true
 	})
+	sesh.wakeWindows()
+	sesh.wakeSenders()
 
-	pad := genRandomPadding()
+	// writes held off for the session to be resumed would otherwise wait forever
+	sesh.sb.endSuspension()
+
+	payload := sesh.closingPayload()
 	f := &Frame{
 		StreamID: 0xffffffff,
 		Seq:      0,
 		Closing:  C_SESSION,
-		Payload:  pad,
+		Payload:  payload,
 	}
-	obfsBuf := make([]byte, len(pad)+64)
+	obfsBuf := make([]byte, len(payload)+64)
 	i, err := sesh.Obfs(f, obfsBuf, 0)
 	if err != nil {
 		return err
@@ -305,6 +569,12 @@ func (sesh *Session) IsClosed() bool {
 	return atomic.LoadUint32(&sesh.closed) == 1
 }
 
+// Context is cancelled once the session is closed, for what's done on behalf of the session, such as dialling where
+// its streams go, to give up with it
+func (sesh *Session) Context() context.Context {
+	return sesh.ctx
+}
+
 func (sesh *Session) timeoutAfter(to time.Duration) {
 	time.Sleep(to)
 
@@ -25,7 +25,10 @@ func TestRecvDataFromRemote(t *testing.T) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	obfsBuf := make([]byte, 17000)
 
@@ -160,7 +163,10 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 		1,
 		0,
 		C_NOOP,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	// create stream 1
 	n, _ := sesh.Obfs(f1, obfsBuf, 0)
@@ -181,7 +187,10 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 		2,
 		0,
 		C_NOOP,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	n, _ = sesh.Obfs(f2, obfsBuf, 0)
 	err = sesh.recvDataFromRemote(obfsBuf[:n])
@@ -201,7 +210,10 @@ func TestRecvDataFromRemote_Closing_InOrder(t *testing.T) {
 		1,
 		1,
 		C_STREAM,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	n, _ = sesh.Obfs(f1CloseStream, obfsBuf, 0)
 	err = sesh.recvDataFromRemote(obfsBuf[:n])
@@ -292,7 +304,10 @@ func TestRecvDataFromRemote_Closing_OutOfOrder(t *testing.T) {
 		1,
 		1,
 		C_STREAM,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	n, _ := sesh.Obfs(f1CloseStream, obfsBuf, 0)
 	err := sesh.recvDataFromRemote(obfsBuf[:n])
@@ -312,7 +327,10 @@ func TestRecvDataFromRemote_Closing_OutOfOrder(t *testing.T) {
 		1,
 		0,
 		C_NOOP,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	n, _ = sesh.Obfs(f1, obfsBuf, 0)
 	err = sesh.recvDataFromRemote(obfsBuf[:n])
@@ -356,7 +374,10 @@ func TestParallel(t *testing.T) {
 			uint32(id),
 			atomic.AddUint64(seqs[id], 1) - 1,
 			uint8(rand.Intn(2)),
+			T_STREAM,
+			PRIORITY_NORMAL,
 			[]byte{1, 2, 3, 4},
+			false,
 		}
 	}
 
@@ -444,6 +465,22 @@ func TestStream_SetReadDeadline(t *testing.T) {
 	testReadDeadline(sesh)
 }
 
+func TestSession_Context(t *testing.T) {
+	clientSession, serverSession, _ := makeSessionPair(1)
+	if err := clientSession.Context().Err(); err != nil {
+		t.Fatalf("context of an open session is done: %v", err)
+	}
+	clientSession.Close()
+	if clientSession.Context().Err() == nil {
+		t.Error("context of a closed session isn't done")
+	}
+	select {
+	case <-serverSession.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Error("context of a session closed by the remote isn't done")
+	}
+}
+
 func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 	testPayloadLen := 1024
 	testPayload := make([]byte, testPayloadLen)
@@ -452,7 +489,10 @@ func BenchmarkRecvDataFromRemote_Ordered(b *testing.B) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 	obfsBuf := make([]byte, 17000)
 
@@ -0,0 +1,134 @@
+package multiplex
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// the random bytes a spliced frame ends with, which its header is obfuscated with in place of the end of its payload
+const splicedNonceLen = 8
+
+// splices reports whether the frames of the stream can be sent as soon as their payload has been read, so that it can
+// be spliced to the connections instead. Their payload isn't sealed, compressed, kept to be resent or sent more than
+// once, and the frames aren't held back by a traffic profile
+func (s *Stream) splices() bool {
+	sesh := s.session
+	return sesh.payloadCipher == nil && !s.keepsBoundaries() && !s.compress && sesh.resumption == nil &&
+		sesh.shaper == nil && sesh.sb.fecEnc == nil && sesh.sb.strategy == FIXED_CONN_MAPPING
+}
+
+// spliceFrom is ReadFrom from a socket. The payload of each frame is spliced from src to the connection the frame is
+// sent on, and only its record layer and header are written from user space. handled is false if it can't be done,
+// in which case nothing has been read from src
+func (s *Stream) spliceFrom(src syscall.Conn) (n int64, err error, handled bool) {
+	if !s.splices() || s.session.maxStreamUnitWrite <= splicedNonceLen {
+		return 0, nil, false
+	}
+	raw, err := src.SyscallConn()
+	if err != nil {
+		return 0, nil, false
+	}
+	p, err := common.NewSplicePipe()
+	if err != nil {
+		return 0, nil, false
+	}
+	defer p.Close()
+	// for the frames sent on connections that can't be spliced to
+	obfsBufP := getBuffer(s.session.SendBufferSize)
+	defer putBuffer(obfsBufP)
+	f := &Frame{
+		StreamID:   s.id,
+		Closing:    C_NOOP,
+		StreamType: s.streamType,
+		Priority:   s.priority,
+	}
+	for {
+		if s.rfTimeout != 0 {
+			if rder, ok := src.(net.Conn); ok {
+				rder.SetReadDeadline(time.Now().Add(s.rfTimeout))
+			}
+		}
+		limit := s.session.frameLimit() - splicedNonceLen
+		if limit <= 0 {
+			limit = 1
+		}
+		window, er := s.awaitWindow(limit, true)
+		if er != nil {
+			return n, er, true
+		}
+		read, er := p.Fill(raw, window)
+		s.returnWindow(window - read)
+		if er != nil {
+			return n, er, true
+		}
+		if s.isClosed() {
+			return n, ErrBrokenStream, true
+		}
+
+		if err = s.session.reserveSend(read, true); err != nil {
+			s.returnWindow(read)
+			return n, err, true
+		}
+		var spliced bool
+		s.writingM.Lock()
+		f.Seq = s.nextSendSeq
+		s.nextSendSeq++
+		spliced, err = s.sendSpliced(f, p, read, *obfsBufP)
+		s.writingM.Unlock()
+		s.session.releaseSend(read)
+
+		if err != nil {
+			return n, err, true
+		}
+		s.session.frameSent(read)
+		s.sent.Add(uint64(read))
+		if spliced {
+			s.spliced.Add(uint64(read))
+		}
+		n += int64(read)
+	}
+}
+
+// sendSpliced sends f with the payloadLen bytes in p as its payload. If the connection it's sent on can't be spliced
+// to, the payload is read into obfsBuf and the frame is sent as any other. spliced is whether it's been spliced
+func (s *Stream) sendSpliced(f *Frame, p *common.SplicePipe, payloadLen int, obfsBuf []byte) (spliced bool, err error) {
+	var header [HEADER_LEN]byte
+	var nonce [splicedNonceLen]byte
+	if err = s.session.obfsSplicedHeader(f, header[:], nonce[:]); err != nil {
+		return false, err
+	}
+	sb := s.session.sb
+	sb.scheduler.acquire(s.priority, sb.connsCount())
+	_, err = sb.sendWith(HEADER_LEN+payloadLen+splicedNonceLen, &s.assignedConnId, func(conn net.Conn) (int, error) {
+		if tlsConn, ok := conn.(*common.TLSConn); ok {
+			n, err := tlsConn.WriteSpliced(header[:], p, payloadLen, nonce[:])
+			if err != common.ErrSpliceUnsupported {
+				spliced = err == nil
+				return n, err
+			}
+		}
+		f.Payload = obfsBuf[HEADER_LEN : HEADER_LEN+payloadLen]
+		if _, err := io.ReadFull(p, f.Payload); err != nil {
+			return 0, err
+		}
+		i, err := s.session.Obfs(f, obfsBuf, HEADER_LEN)
+		if err != nil {
+			return 0, err
+		}
+		return conn.Write(obfsBuf[:i])
+	})
+	sb.scheduler.release(sb.connsCount())
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.Tracef("%v spliced to remote through stream %v with err %v. seq: %v", payloadLen, s.id, err, f.Seq)
+	}
+	if err == errBrokenSwitchboard {
+		s.session.SetTerminalMsg(err.Error())
+		s.session.passiveClose()
+	}
+	return spliced, err
+}
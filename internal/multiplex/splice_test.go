@@ -0,0 +1,89 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/connutil"
+)
+
+func TestStream_ReadFromSocket(t *testing.T) {
+	sessionKey := [32]byte{1}
+	for _, c := range []struct {
+		name             string
+		encryptionMethod byte
+		tcp              bool
+		spliced          bool
+	}{
+		{"spliced", E_METHOD_PLAIN, true, runtime.GOOS == "linux"},
+		{"not a socket", E_METHOD_PLAIN, false, false},
+		{"encrypted", E_METHOD_CHACHA20_POLY1305, true, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			obfuscator, _ := MakeObfuscator(c.encryptionMethod, sessionKey)
+			// the connections are TLSConns themselves rather than testConns, as only those are spliced to
+			clientSession := MakeSession(1, SessionConfig{Obfuscator: obfuscator})
+			serverSession := MakeSession(1, SessionConfig{Obfuscator: obfuscator})
+			for i := 0; i < 2; i++ {
+				var clientConn, serverConn net.Conn
+				if c.tcp {
+					clientConn, serverConn = tcpPair(t)
+				} else {
+					clientConn, serverConn = connutil.AsyncPipe()
+				}
+				clientSession.AddConnection(&common.TLSConn{Conn: clientConn})
+				serverSession.AddConnection(&common.TLSConn{Conn: serverConn})
+			}
+			defer clientSession.Close()
+			defer serverSession.Close()
+
+			stream, err := clientSession.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			backend, proxied := tcpPair(t)
+			defer backend.Close()
+			go func() {
+				common.Copy(stream, proxied)
+			}()
+
+			sent := make([]byte, 1<<20)
+			rand.Read(sent)
+			// payloads shorter than the nonce of a spliced frame too
+			sent[0] = 'x'
+			go func() {
+				backend.Write(sent[:1])
+				backend.Write(sent[1:])
+			}()
+
+			serverStream, err := serverSession.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			received := make([]byte, len(sent))
+			if _, err = io.ReadFull(serverStream, received); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sent, received) {
+				t.Error("what's received isn't what's sent")
+			}
+			// what's sent is counted once the frame has been written, which can be after it's been received
+			spliced := stream.spliced.Load()
+			for deadline := time.Now().Add(time.Second); c.spliced && spliced < uint64(len(sent)) && time.Now().Before(deadline); {
+				time.Sleep(time.Millisecond)
+				spliced = stream.spliced.Load()
+			}
+			if c.spliced && spliced != uint64(len(sent)) {
+				t.Errorf("expecting all %v bytes to be spliced, got %v", len(sent), spliced)
+			} else if !c.spliced && spliced != 0 {
+				t.Errorf("expecting nothing to be spliced, got %v", spliced)
+			}
+		})
+	}
+}
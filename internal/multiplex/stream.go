@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,6 +19,11 @@ type Stream struct {
 
 	session *Session
 
+	streamType uint8
+
+	// one of the PRIORITY_ constants
+	priority uint8
+
 	recvBuf recvBuffer
 
 	nextSendSeq uint64
@@ -26,10 +32,22 @@ type Stream struct {
 
 	// atomic
 	closed uint32
+	// atomic, 1 once Close has been called, so that a Write waiting for a window gives up
+	closing uint32
+	// atomic, 1 if Write returns ErrWouldBlock rather than waiting
+	nonBlocking uint32
+
+	// guarded by the flow control of the session
+	window streamWindow
 
-	// only alloc when writing to the stream
-	allocIdempot sync.Once
-	obfsBuf      []byte
+	// whether frames are compressed, frames in a row that didn't get smaller, and what they're compressed into. Guarded
+	// by writingM
+	compress       bool
+	incompressible int
+	compressBuf    []byte
+
+	// taken from the pool on the first Write, and given back once the stream is closed. ReadFrom has its own
+	obfsBuf *[]byte
 
 	// we assign each stream a fixed underlying TCP connection to utilise order guarantee provided by TCP itself
 	// so that frameSorter should have few to none ooo frames to deal with
@@ -38,28 +56,64 @@ type Stream struct {
 	assignedConnId uint32
 
 	rfTimeout time.Duration
+
+	// the payload sent and received through the stream, and where the remote's end of it is relayed to, for
+	// inspecting the session
+	sent, received atomic.Uint64
+	// what of sent has been spliced to the connections rather than copied through user space
+	spliced     atomic.Uint64
+	destination atomic.Value
 }
 
-func makeStream(sesh *Session, id uint32) *Stream {
+func makeStream(sesh *Session, id uint32, streamType uint8, priority uint8) *Stream {
 	var recvBuf recvBuffer
-	if sesh.Unordered {
+	if streamType == T_UNRELIABLE {
+		recvBuf = newLossyDatagramBuffer(unreliableBufferLimit)
+	} else if sesh.Unordered || streamType == T_DATAGRAM || streamType == T_CONTROL {
 		recvBuf = NewDatagramBuffer()
 	} else {
-		recvBuf = NewStreamBuffer()
+		sb := NewStreamBuffer()
+		// what's resent on resumption may have arrived before the connection it was sent on dropped
+		sb.dropsCopies = sesh.Multipath && sesh.Duplicate || sesh.resumption != nil
+		recvBuf = sb
 	}
 
 	stream := &Stream{
-		id:      id,
-		session: sesh,
-		recvBuf: recvBuf,
+		id:         id,
+		session:    sesh,
+		streamType: streamType,
+		priority:   priority,
+		recvBuf:    recvBuf,
+		compress:   sesh.Compression && streamType != T_CONTROL,
 	}
+	sesh.initStreamWindow(stream)
 
 	return stream
 }
 
 func (s *Stream) isClosed() bool { return atomic.LoadUint32(&s.closed) == 1 }
 
+func (s *Stream) isClosing() bool { return atomic.LoadUint32(&s.closing) == 1 }
+
+// IsDatagram is true if the stream was opened with OpenDatagramStream or OpenUnreliableStream
+func (s *Stream) IsDatagram() bool { return s.streamType == T_DATAGRAM || s.streamType == T_UNRELIABLE }
+
+// IsControl is true if the stream was opened with OpenControlStream
+func (s *Stream) IsControl() bool { return s.streamType == T_CONTROL }
+
+// Priority is the PRIORITY_ constant the stream was opened with, by either side
+func (s *Stream) Priority() uint8 { return s.priority }
+
+// each Write to a datagram or control stream, or any stream of an unordered session, is sent as exactly one frame
+func (s *Stream) keepsBoundaries() bool {
+	return s.session.Unordered || s.streamType != T_STREAM
+}
+
 func (s *Stream) writeFrame(frame Frame) error {
+	if frame.Closing == C_NOOP {
+		s.windowReceived(len(frame.Payload))
+		s.received.Add(uint64(len(frame.Payload)))
+	}
 	toBeClosed, err := s.recvBuf.Write(frame)
 	if toBeClosed {
 		err = s.passiveClose()
@@ -80,6 +134,7 @@ func (s *Stream) Read(buf []byte) (n int, err error) {
 	}
 
 	n, err = s.recvBuf.Read(buf)
+	s.windowConsumed(n)
 	log.Tracef("%v read from stream %v with err %v", n, s.id, err)
 	if err == io.EOF {
 		return n, ErrBrokenStream
@@ -89,7 +144,7 @@ func (s *Stream) Read(buf []byte) (n int, err error) {
 
 func (s *Stream) WriteTo(w io.Writer) (int64, error) {
 	// will keep writing until the underlying buffer is closed
-	n, err := s.recvBuf.WriteTo(w)
+	n, err := s.recvBuf.WriteTo(&windowWriter{w, s})
 	log.Tracef("%v read from stream %v with err %v", n, s.id, err)
 	if err == io.EOF {
 		return n, ErrBrokenStream
@@ -97,15 +152,26 @@ func (s *Stream) WriteTo(w io.Writer) (int64, error) {
 	return n, nil
 }
 
-func (s *Stream) sendFrame(f *Frame, framePayloadOffset int) error {
+// sendFrame obfuscates f into obfsBuf and sends it. Nothing refers to obfsBuf once it returns
+func (s *Stream) sendFrame(f *Frame, obfsBuf []byte, framePayloadOffset int) error {
+	if s.compressFrame(f) {
+		// it's no longer where it was in obfsBuf
+		framePayloadOffset = 0
+	}
 	var cipherTextLen int
-	cipherTextLen, err := s.session.Obfs(f, s.obfsBuf, framePayloadOffset)
+	cipherTextLen, err := s.session.Obfs(f, obfsBuf, framePayloadOffset)
 	if err != nil {
 		return err
 	}
+	if !s.keepsBoundaries() {
+		s.session.retain(s.id, f.Seq, obfsBuf[:cipherTextLen])
+	}
 
-	_, err = s.session.sb.send(s.obfsBuf[:cipherTextLen], &s.assignedConnId)
-	log.Tracef("%v sent to remote through stream %v with err %v. seq: %v", len(f.Payload), s.id, err, f.Seq)
+	_, err = s.session.sb.sendOf(s, obfsBuf[:cipherTextLen])
+	if log.IsLevelEnabled(log.TraceLevel) {
+		// the arguments would be allocated for every frame otherwise
+		log.Tracef("%v sent to remote through stream %v with err %v. seq: %v", len(f.Payload), s.id, err, f.Seq)
+	}
 	if err != nil {
 		if err == errBrokenSwitchboard {
 			s.session.SetTerminalMsg(err.Error())
@@ -125,38 +191,75 @@ func (s *Stream) Write(in []byte) (n int, err error) {
 	}
 
 	if s.obfsBuf == nil {
-		s.obfsBuf = make([]byte, s.session.SendBufferSize)
+		s.obfsBuf = getBuffer(s.session.SendBufferSize)
+	}
+	// reused for every frame of the Write, as it escapes
+	f := &Frame{
+		StreamID:   s.id,
+		Closing:    C_NOOP,
+		StreamType: s.streamType,
+		Priority:   s.priority,
 	}
 	for n < len(in) {
 		var framePayload []byte
-		if len(in)-n <= s.session.maxStreamUnitWrite {
+		limit := s.session.maxStreamUnitWrite
+		if !s.keepsBoundaries() {
+			limit = s.session.frameLimit()
+		}
+		if !s.keepsBoundaries() {
+			if limit, err = s.awaitWindow(min(limit, len(in)-n), s.blocks()); err != nil {
+				return
+			}
+		}
+		if len(in)-n <= limit {
 			framePayload = in[n:]
 		} else {
-			if s.session.Unordered { // no splitting
+			if s.keepsBoundaries() { // no splitting
 				err = io.ErrShortBuffer
 				return
 			}
-			framePayload = in[n : s.session.maxStreamUnitWrite+n]
+			framePayload = in[n : limit+n]
 		}
-		f := &Frame{
-			StreamID: s.id,
-			Seq:      s.nextSendSeq,
-			Closing:  C_NOOP,
-			Payload:  framePayload,
+		if s.IsUnreliable() {
+			if !s.session.reserveDatagram(len(framePayload)) {
+				// dropped, as it would be by a congested network
+				return len(in), nil
+			}
+		} else if err = s.session.reserveSend(len(framePayload), s.blocks()); err != nil {
+			s.returnWindow(len(framePayload))
+			return
 		}
+		f.Seq = s.nextSendSeq
+		f.Payload = framePayload
 		s.nextSendSeq++
-		err = s.sendFrame(f, 0)
+		err = s.sendFrame(f, *s.obfsBuf, 0)
+		s.session.releaseSend(len(framePayload))
 		if err != nil {
 			return
 		}
+		s.session.frameSent(len(framePayload))
+		s.sent.Add(uint64(len(framePayload)))
 		n += len(framePayload)
 	}
 	return
 }
 
 func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
-	if s.obfsBuf == nil {
-		s.obfsBuf = make([]byte, s.session.SendBufferSize)
+	if sc, ok := r.(syscall.Conn); ok {
+		if n, err, handled := s.spliceFrom(sc); handled {
+			return n, err
+		}
+	}
+	// the stream can be closed while this is blocked reading into the buffer, so it can't be the one Close gives
+	// back to the pool
+	obfsBufP := getBuffer(s.session.SendBufferSize)
+	defer putBuffer(obfsBufP)
+	obfsBuf := *obfsBufP
+	f := &Frame{
+		StreamID:   s.id,
+		Closing:    C_NOOP,
+		StreamType: s.streamType,
+		Priority:   s.priority,
 	}
 	for {
 		if s.rfTimeout != 0 {
@@ -166,42 +269,72 @@ func (s *Stream) ReadFrom(r io.Reader) (n int64, err error) {
 				rder.SetReadDeadline(time.Now().Add(s.rfTimeout))
 			}
 		}
-		read, er := r.Read(s.obfsBuf[HEADER_LEN : HEADER_LEN+s.session.maxStreamUnitWrite])
+		window, er := s.awaitWindow(s.session.frameLimit(), true)
+		if er != nil {
+			return n, er
+		}
+		read, er := r.Read(obfsBuf[HEADER_LEN : HEADER_LEN+window])
+		s.returnWindow(window - read)
 		if er != nil {
+			s.returnWindow(read)
 			return n, er
 		}
 		if s.isClosed() {
 			return n, ErrBrokenStream
 		}
 
-		s.writingM.Lock()
-		f := &Frame{
-			StreamID: s.id,
-			Seq:      s.nextSendSeq,
-			Closing:  C_NOOP,
-			Payload:  s.obfsBuf[HEADER_LEN : HEADER_LEN+read],
+		// only once it's been read, as what's reserved isn't given back while waiting on r
+		if err = s.session.reserveSend(read, true); err != nil {
+			s.returnWindow(read)
+			return
 		}
+		s.writingM.Lock()
+		f.Seq = s.nextSendSeq
+		f.Payload = obfsBuf[HEADER_LEN : HEADER_LEN+read]
 		s.nextSendSeq++
-		err = s.sendFrame(f, HEADER_LEN)
+		err = s.sendFrame(f, obfsBuf, HEADER_LEN)
 		s.writingM.Unlock()
+		s.session.releaseSend(read)
 
 		if err != nil {
 			return
 		}
+		s.session.frameSent(read)
+		s.sent.Add(uint64(read))
 		n += int64(read)
 	}
 }
 
+// windowWriter counts what WriteTo writes as read off the stream
+type windowWriter struct {
+	io.Writer
+	s *Stream
+}
+
+func (w *windowWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.s.windowConsumed(n)
+	return n, err
+}
+
 func (s *Stream) passiveClose() error {
 	return s.session.closeStream(s, false)
 }
 
 // active close. Close locally and tell the remote that this stream is being closed
 func (s *Stream) Close() error {
+	atomic.StoreUint32(&s.closing, 1)
+	s.session.wakeWindows()
 	s.writingM.Lock()
 	defer s.writingM.Unlock()
 
-	return s.session.closeStream(s, true)
+	err := s.session.closeStream(s, true)
+	// Write doesn't use it once the stream is closed, which it is even if it's been closed before
+	if s.obfsBuf != nil {
+		putBuffer(s.obfsBuf)
+		s.obfsBuf = nil
+	}
+	return err
 }
 
 // the following functions are purely for implementing net.Conn interface.
@@ -47,6 +47,9 @@ type streamBuffer struct {
 
 	nextRecvSeq uint64
 	sh          sorterHeap
+	// whether frames can arrive more than once, as they're duplicated across connections or resent on resumption, so
+	// that the ones we've already had are dropped rather than taken as an error
+	dropsCopies bool
 
 	buf *bufferedPipe
 }
@@ -74,13 +77,24 @@ func (sb *streamBuffer) Write(f Frame) (toBeClosed bool, err error) {
 	}
 
 	if f.Seq < sb.nextRecvSeq {
+		if sb.dropsCopies {
+			return false, nil
+		}
 		return false, fmt.Errorf("seq %v is smaller than nextRecvSeq %v", f.Seq, sb.nextRecvSeq)
 	}
 
-	heap.Push(&sb.sh, &f)
+	// the payload is in the buffer the frame was read into, which is reused for the next read. f itself isn't
+	// pushed, so that it doesn't escape for the frames that arrive in order
+	ooo := f
+	ooo.Payload = append([]byte(nil), f.Payload...)
+	heap.Push(&sb.sh, &ooo)
 	// Keep popping from the heap until empty or to the point that the wanted seq was not received
-	for len(sb.sh) > 0 && sb.sh[0].Seq == sb.nextRecvSeq {
+	for len(sb.sh) > 0 && sb.sh[0].Seq <= sb.nextRecvSeq {
 		f = *heap.Pop(&sb.sh).(*Frame)
+		if f.Seq < sb.nextRecvSeq {
+			// the copy of a frame that was in the heap twice
+			continue
+		}
 		if f.Closing != C_NOOP {
 			return true, nil
 		} else {
@@ -91,6 +105,13 @@ func (sb *streamBuffer) Write(f Frame) (toBeClosed bool, err error) {
 	return false, nil
 }
 
+// received is the seq of the next frame to be received in order
+func (sb *streamBuffer) received() uint64 {
+	sb.recvM.Lock()
+	defer sb.recvM.Unlock()
+	return sb.nextRecvSeq
+}
+
 func (sb *streamBuffer) Read(buf []byte) (int, error) {
 	return sb.buf.Read(buf)
 }
@@ -1,6 +1,7 @@
 package multiplex
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 	//"log"
@@ -89,3 +90,29 @@ func TestStreamBuffer_RecvThenClose(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestStreamBuffer_Duplicates(t *testing.T) {
+	sb := NewStreamBuffer()
+	sb.Write(Frame{Seq: 0, Payload: []byte{0}})
+	if _, err := sb.Write(Frame{Seq: 0, Payload: []byte{0}}); err == nil {
+		t.Error("a stale seq should fail unless frames are duplicated")
+	}
+
+	sb = NewStreamBuffer()
+	sb.dropsCopies = true
+	for _, n := range []uint64{0, 0, 2, 1, 2, 1, 0, 3} {
+		_, err := sb.Write(Frame{Seq: n, Payload: []byte{byte(n)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recvBuf := make([]byte, 8)
+	n, err := sb.Read(recvBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recvBuf[:n], []byte{0, 1, 2, 3}) {
+		t.Errorf("expecting each frame once in order, got %v", recvBuf[:n])
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
+	"runtime"
 	"testing"
 	"time"
 
@@ -36,9 +38,11 @@ func BenchmarkStream_Write_Ordered(b *testing.B) {
 	testData := make([]byte, testDataLen)
 	rand.Read(testData)
 	eMethods := map[string]byte{
-		"plain":             E_METHOD_PLAIN,
-		"chacha20-poly1305": E_METHOD_CHACHA20_POLY1305,
-		"aes-gcm":           E_METHOD_AES_GCM,
+		"plain":              E_METHOD_PLAIN,
+		"chacha20-poly1305":  E_METHOD_CHACHA20_POLY1305,
+		"aes-gcm":            E_METHOD_AES_GCM,
+		"xchacha20-poly1305": E_METHOD_XCHACHA20_POLY1305,
+		"aes-128-gcm":        E_METHOD_AES_128_GCM,
 	}
 
 	for name, method := range eMethods {
@@ -55,6 +59,77 @@ func BenchmarkStream_Write_Ordered(b *testing.B) {
 	}
 }
 
+// BenchmarkStream_Relay sends data on a stream between two sessions over TCP, which is read on the other end as a
+// proxied connection's would be, and reports how often the GC has had to run
+func BenchmarkStream_Relay(b *testing.B) {
+	var sessionKey [32]byte
+	rand.Read(sessionKey[:])
+
+	const testDataLen = 65536
+	testData := make([]byte, testDataLen)
+	rand.Read(testData)
+	eMethods := map[string]byte{
+		"plain":             E_METHOD_PLAIN,
+		"chacha20-poly1305": E_METHOD_CHACHA20_POLY1305,
+		"aes-gcm":           E_METHOD_AES_GCM,
+	}
+
+	for name, method := range eMethods {
+		b.Run(name, func(b *testing.B) {
+			obfuscator, _ := MakeObfuscator(method, sessionKey)
+			clientSession := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+			serverSession := MakeSession(0, SessionConfig{Obfuscator: obfuscator})
+			defer clientSession.Close()
+			defer serverSession.Close()
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			remoteConn, err := l.Accept()
+			if err != nil {
+				b.Fatal(err)
+			}
+			clientSession.AddConnection(&common.TLSConn{Conn: conn})
+			serverSession.AddConnection(&common.TLSConn{Conn: remoteConn})
+
+			stream, _ := clientSession.OpenStream()
+			received := make(chan struct{})
+			go func() {
+				remoteStream, err := serverSession.Accept()
+				if err != nil {
+					return
+				}
+				buf := make([]byte, testDataLen)
+				for {
+					if _, err := io.ReadFull(remoteStream, buf); err != nil {
+						return
+					}
+					received <- struct{}{}
+				}
+			}()
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			b.SetBytes(testDataLen)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				stream.Write(testData)
+				<-received
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(after.NumGC-before.NumGC)/float64(b.N), "GCs/op")
+		})
+	}
+}
+
 /*
 func BenchmarkStream_Read_Ordered(b *testing.B) {
 	var sessionKey [32]byte
@@ -67,7 +142,10 @@ func BenchmarkStream_Read_Ordered(b *testing.B) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 
 	obfsBuf := make([]byte, 17000)
@@ -182,7 +260,10 @@ func TestStream_Close(t *testing.T) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 
 	conn, writingEnd := connutil.AsyncPipe()
@@ -217,6 +298,28 @@ func TestStream_Close(t *testing.T) {
 	}
 }
 
+func TestStream_CloseGivesBackBuffer(t *testing.T) {
+	sesh := setupSesh(false, emptyKey, E_METHOD_PLAIN)
+	sesh.AddConnection(connutil.Discard())
+	stream, _ := sesh.OpenStream()
+	if _, err := stream.Write([]byte{42}); err != nil {
+		t.Fatal(err)
+	}
+	if stream.obfsBuf == nil {
+		t.Fatal("no buffer taken for Write")
+	}
+
+	stream.Close()
+	if stream.obfsBuf != nil {
+		t.Error("buffer kept after the stream is closed")
+	}
+	// it mustn't be given back twice
+	stream.Close()
+	if _, err := stream.Write([]byte{42}); err != ErrBrokenStream {
+		t.Errorf("expecting ErrBrokenStream writing to a closed stream, got %v", err)
+	}
+}
+
 func TestStream_Read(t *testing.T) {
 	seshes := map[string]bool{
 		"ordered":   false,
@@ -229,7 +332,10 @@ func TestStream_Read(t *testing.T) {
 		1,
 		0,
 		0,
+		T_STREAM,
+		PRIORITY_NORMAL,
 		testPayload,
+		false,
 	}
 
 	var streamID uint32
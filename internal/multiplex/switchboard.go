@@ -7,17 +7,24 @@ import (
 	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	FIXED_CONN_MAPPING switchboardStrategy = iota
 	UNIFORM_SPREAD
+	LATENCY_WEIGHTED
 )
 
 type switchboardConfig struct {
 	valve          Valve
 	strategy       switchboardStrategy
 	recvBufferSize int
+	// with LATENCY_WEIGHTED, whether every frame is sent on all connections
+	duplicate bool
+	// 0 if there's no FEC
+	fecDataShards   int
+	fecParityShards int
 }
 
 // switchboard is responsible for keeping the reference of TCP connections between client and server
@@ -30,6 +37,25 @@ type switchboard struct {
 	numConns   uint32
 	nextConnId uint32
 
+	// connId -> *path, for LATENCY_WEIGHTED
+	paths sync.Map
+	// atomic
+	sends uint32
+
+	// connId -> *int64 of unix nano, for telling dead connections of a resumable session
+	lastReads sync.Map
+
+	// closed when a connection comes to a resumable session that has none left
+	suspendedM     sync.Mutex
+	suspendedCh    chan struct{}
+	suspendedSince time.Time
+
+	fecEnc *fecEncoder
+	fecDec *fecDecoder
+
+	// which frames of streams are sent next when they can't all be at once
+	scheduler scheduler
+
 	broken uint32
 }
 
@@ -41,6 +67,10 @@ func makeSwitchboard(sesh *Session, config switchboardConfig) *switchboard {
 		switchboardConfig: config,
 		nextConnId:        1,
 	}
+	if config.fecDataShards > 0 {
+		sb.fecEnc = makeFECEncoder(config.fecDataShards, config.fecParityShards, sb.sendParity)
+		sb.fecDec = makeFECDecoder(config.fecDataShards, config.fecParityShards)
+	}
 	return sb
 }
 
@@ -54,15 +84,143 @@ func (sb *switchboard) addConn(conn net.Conn) {
 	connId := atomic.AddUint32(&sb.nextConnId, 1) - 1
 	atomic.AddUint32(&sb.numConns, 1)
 	sb.conns.Store(connId, conn)
+	lastRead := time.Now().UnixNano()
+	sb.lastReads.Store(connId, &lastRead)
+	if sb.strategy == LATENCY_WEIGHTED {
+		sb.addPath(connId, conn)
+	}
 	go sb.deplex(connId, conn)
+	if sb.endSuspension() {
+		log.Infof("session %v has a connection again", sb.session.id)
+		go sb.session.resume()
+	}
+}
+
+// suspend holds off sends until a connection comes, or the session is closed
+func (sb *switchboard) suspend() {
+	sb.suspendedM.Lock()
+	defer sb.suspendedM.Unlock()
+	if sb.suspendedCh == nil && sb.connsCount() == 0 {
+		sb.suspendedCh = make(chan struct{})
+		sb.suspendedSince = time.Now()
+	}
+}
+
+// endSuspension lets sends carry on, and reports whether they were held off
+func (sb *switchboard) endSuspension() bool {
+	sb.suspendedM.Lock()
+	defer sb.suspendedM.Unlock()
+	if sb.suspendedCh == nil {
+		return false
+	}
+	close(sb.suspendedCh)
+	sb.suspendedCh = nil
+	sb.suspendedSince = time.Time{}
+	return true
+}
+
+// suspension is the channel to wait on until sends can carry on, or nil if they can now
+func (sb *switchboard) suspension() chan struct{} {
+	sb.suspendedM.Lock()
+	defer sb.suspendedM.Unlock()
+	return sb.suspendedCh
+}
+
+func (sb *switchboard) suspendedFor() time.Time {
+	sb.suspendedM.Lock()
+	defer sb.suspendedM.Unlock()
+	return sb.suspendedSince
 }
 
 // a pointer to connId is passed here so that the switchboard can reassign it
-func (sb *switchboard) send(data []byte, connId *uint32) (n int, err error) {
-	writeAndRegUsage := func(conn net.Conn, d []byte) (int, error) {
-		n, err = conn.Write(d)
+func (sb *switchboard) send(data []byte, connId *uint32) (int, error) {
+	if sb.session.shaper == nil {
+		return sb.sendFrame(data, connId)
+	}
+	sb.session.shaper.hold()
+	n, err := sb.sendFrame(data, connId)
+	if err == nil {
+		sb.pad(connId)
+	}
+	return n, err
+}
+
+// sendFrame sends what's to be passed on to recvDataFromRemote by the remote
+func (sb *switchboard) sendFrame(data []byte, connId *uint32) (int, error) {
+	if sb.fecEnc == nil {
+		return sb.sendRecord(data, connId)
+	}
+	shard, parity := sb.fecEnc.encode(data)
+	n, err := sb.sendRecord(shard, connId)
+	if err != nil {
+		return n, err
+	}
+	sb.sendParity(parity)
+	return n, nil
+}
+
+// prepare returns what to write to a connection for a frame, which is a copy of it, and the parity shards to be
+// sent after it if there's FEC
+func (sb *switchboard) prepare(frame []byte) ([]byte, [][]byte) {
+	if sb.fecEnc == nil {
+		record := make([]byte, len(frame))
+		copy(record, frame)
+		return record, nil
+	}
+	return sb.fecEnc.encode(frame)
+}
+
+// broadcast sends frames on every connection
+func (sb *switchboard) broadcast(frames [][]byte) {
+	sb.conns.Range(func(_, connI interface{}) bool {
+		conn := connI.(net.Conn)
+		// a write to a dead connection can block until it's found to be dead
+		go func() {
+			for _, frame := range frames {
+				data, parity := sb.prepare(frame)
+				n, err := conn.Write(data)
+				if err != nil {
+					return
+				}
+				sb.valve.AddTx(int64(n))
+				sb.sendParity(parity)
+			}
+		}()
+		return true
+	})
+}
+
+func (sb *switchboard) sendParity(parity [][]byte) {
+	for _, p := range parity {
+		if _, err := sb.sendRecord(p, new(uint32)); err != nil {
+			log.Debugf("failed to send parity of session %v: %v", sb.session.id, err)
+			return
+		}
+	}
+}
+
+// sendRecord sends what's to be read from a connection as a whole by the remote
+func (sb *switchboard) sendRecord(data []byte, connId *uint32) (n int, err error) {
+	if sb.strategy == LATENCY_WEIGHTED {
+		if err = sb.awaitConns(len(data)); err != nil {
+			return 0, err
+		}
+		return sb.sendWeighted(data)
+	}
+	return sb.sendWith(len(data), connId, func(conn net.Conn) (int, error) { return conn.Write(data) })
+}
+
+// sendWith sends a record of size bytes, which write writes to the connection it's sent on, as sendRecord does
+func (sb *switchboard) sendWith(size int, connId *uint32, write func(net.Conn) (int, error)) (n int, err error) {
+	writeAndRegUsage := func(conn net.Conn) (int, error) {
+		n, err = write(conn)
 		if err != nil {
-			sb.conns.Delete(*connId)
+			if sb.dropConn(*connId) && sb.session.resumable() {
+				// a frame that needs delivering has been kept, and is sent again once the session resumes
+				log.Debugf("failed to write to a connection of session %v: %v", sb.session.id, err)
+				sb.session.connLost()
+				return size, nil
+			}
 			sb.close("failed to write to remote " + err.Error())
 			return n, err
 		}
@@ -70,36 +228,50 @@ func (sb *switchboard) send(data []byte, connId *uint32) (n int, err error) {
 		return n, nil
 	}
 
-	sb.valve.txWait(len(data))
-	if atomic.LoadUint32(&sb.broken) == 1 || sb.connsCount() == 0 {
-		return 0, errBrokenSwitchboard
+	if err = sb.awaitConns(size); err != nil {
+		return 0, err
 	}
-
 	switch sb.strategy {
 	case UNIFORM_SPREAD:
 		_, conn, err := sb.pickRandConn()
 		if err != nil {
 			return 0, errBrokenSwitchboard
 		}
-		return writeAndRegUsage(conn, data)
+		return writeAndRegUsage(conn)
 	case FIXED_CONN_MAPPING:
 		connI, ok := sb.conns.Load(*connId)
 		if ok {
 			conn := connI.(net.Conn)
-			return writeAndRegUsage(conn, data)
+			return writeAndRegUsage(conn)
 		} else {
 			newConnId, conn, err := sb.pickRandConn()
 			if err != nil {
 				return 0, errBrokenSwitchboard
 			}
 			*connId = newConnId
-			return writeAndRegUsage(conn, data)
+			return writeAndRegUsage(conn)
 		}
 	default:
 		return 0, errors.New("unsupported traffic distribution strategy")
 	}
 }
 
+// awaitConns waits until size bytes can be sent and there's a connection to send them on
+func (sb *switchboard) awaitConns(size int) error {
+	sb.valve.txWait(size)
+	for sb.connsCount() == 0 && atomic.LoadUint32(&sb.broken) == 0 && !sb.session.IsClosed() {
+		ch := sb.suspension()
+		if ch == nil {
+			break
+		}
+		<-ch
+	}
+	if atomic.LoadUint32(&sb.broken) == 1 || sb.connsCount() == 0 {
+		return errBrokenSwitchboard
+	}
+	return nil
+}
+
 // returns a random connId
 func (sb *switchboard) pickRandConn() (uint32, net.Conn, error) {
 	connCount := sb.connsCount()
@@ -130,6 +302,18 @@ func (sb *switchboard) pickRandConn() (uint32, net.Conn, error) {
 	return id, conn, nil
 }
 
+// dropConn closes a connection and forgets about it. It reports whether the connection was still there
+func (sb *switchboard) dropConn(connId uint32) bool {
+	sb.lastReads.Delete(connId)
+	sb.removePath(connId)
+	if connI, ok := sb.conns.LoadAndDelete(connId); ok {
+		atomic.AddUint32(&sb.numConns, ^uint32(0))
+		connI.(net.Conn).Close()
+		return true
+	}
+	return false
+}
+
 func (sb *switchboard) close(terminalMsg string) {
 	atomic.StoreUint32(&sb.broken, 1)
 	if !sb.session.IsClosed() {
@@ -141,32 +325,58 @@ func (sb *switchboard) close(terminalMsg string) {
 // actively triggered by session.Close()
 func (sb *switchboard) closeAll() {
 	sb.conns.Range(func(key, connI interface{}) bool {
-		conn := connI.(net.Conn)
-		conn.Close()
-		sb.conns.Delete(key)
+		sb.dropConn(key.(uint32))
 		return true
 	})
+	sb.endSuspension()
 }
 
 // deplex function costantly reads from a TCP connection
 func (sb *switchboard) deplex(connId uint32, conn net.Conn) {
 	defer conn.Close()
-	buf := make([]byte, sb.recvBufferSize)
+	bufP := getBuffer(sb.recvBufferSize)
+	defer putBuffer(bufP)
+	buf := *bufP
 	for {
 		n, err := conn.Read(buf)
 		sb.valve.rxWait(n)
 		sb.valve.AddRx(int64(n))
 		if err != nil {
 			log.Debugf("a connection for session %v has closed: %v", sb.session.id, err)
-			sb.conns.Delete(connId)
-			atomic.AddUint32(&sb.numConns, ^uint32(0))
+			dropped := sb.dropConn(connId)
+			if sb.session.resumable() {
+				if dropped {
+					sb.session.connLost()
+				}
+				return
+			}
+			// every frame sent on it has also been sent on the others
+			if sb.duplicate && sb.connsCount() > 0 && atomic.LoadUint32(&sb.broken) == 0 {
+				log.Debugf("session %v carries on with %v connections", sb.session.id, sb.connsCount())
+				return
+			}
 			sb.close("a connection has dropped unexpectedly")
 			return
 		}
 
-		err = sb.session.recvDataFromRemote(buf[:n])
+		if lastRead, ok := sb.lastReads.Load(connId); ok {
+			atomic.StoreInt64(lastRead.(*int64), time.Now().UnixNano())
+		}
+		if sb.fecDec == nil {
+			err = sb.session.recvDataFromRemote(buf[:n])
+			if err != nil {
+				log.Error(err)
+			}
+			continue
+		}
+		frames, err := sb.fecDec.decode(buf[:n])
 		if err != nil {
-			log.Error(err)
+			log.Errorf("failed to decode FEC shard for session %v: %v", sb.session.id, err)
+		}
+		for _, frame := range frames {
+			if err = sb.session.recvDataFromRemote(frame); err != nil {
+				log.Error(err)
+			}
 		}
 	}
 }
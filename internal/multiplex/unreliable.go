@@ -0,0 +1,42 @@
+package multiplex
+
+// An unreliable stream is a datagram stream whose datagrams can be lost, like those of UDP, so that real-time traffic
+// isn't held up by what's slow. A datagram is dropped rather than waited for if the connections of the session are
+// congested or there are none, and it's sent on any connection rather than the one of its stream, so that it isn't
+// held up behind a connection that's resending what it's lost. The remote drops datagrams that come while its
+// buffer of the stream is full rather than stopping reading the connection, and with it the other streams. Its
+// frames are sent with the interactive priority.
+//
+// The connections are all over TCP for now, so datagrams aren't lost by the network itself, but only by being dropped
+// on either end
+
+// the most datagrams of an unreliable stream that are kept to be read before more are dropped
+const unreliableBufferLimit = 1 << 20
+
+// OpenUnreliableStream opens an unreliable stream, of which a Write is sent as exactly one datagram, or dropped. The
+// remote can tell it apart from other streams with IsUnreliable. It must have CAP_UNRELIABLE
+func (sesh *Session) OpenUnreliableStream() (*Stream, error) {
+	return sesh.openStream(T_UNRELIABLE, PRIORITY_INTERACTIVE)
+}
+
+// IsUnreliable is true if the stream was opened with OpenUnreliableStream, or with OpenDatagramStream of a session
+// with UnreliableDatagrams
+func (s *Stream) IsUnreliable() bool { return s.streamType == T_UNRELIABLE }
+
+// reserveDatagram reserves what's needed to send a datagram of n bytes on an unreliable stream straight away,
+// returning false if it's to be dropped instead
+func (sesh *Session) reserveDatagram(n int) bool {
+	if sesh.sb.connsCount() == 0 {
+		return false
+	}
+	return sesh.reserveSend(n, false) == nil
+}
+
+// sendAnywhere sends a frame on any connection
+func (sb *switchboard) sendAnywhere(data []byte) (int, error) {
+	connId, _, err := sb.pickRandConn()
+	if err != nil {
+		return 0, errBrokenSwitchboard
+	}
+	return sb.send(data, &connId)
+}
@@ -0,0 +1,78 @@
+package multiplex
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestUnreliableStream(t *testing.T) {
+	t.Run("datagrams", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(2)
+		defer clientSession.Close()
+		stream, err := clientSession.OpenUnreliableStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = stream.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := serverSession.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverStream := conn.(*Stream)
+		if !serverStream.IsUnreliable() || !serverStream.IsDatagram() {
+			t.Error("the stream isn't unreliable on the server")
+		}
+		if serverStream.Priority() != PRIORITY_INTERACTIVE {
+			t.Errorf("expecting interactive priority, got %v", serverStream.Priority())
+		}
+		buf := make([]byte, 16)
+		n, err := serverStream.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], []byte("hello")) {
+			t.Errorf("expecting hello, got %q with %v", buf[:n], err)
+		}
+	})
+
+	t.Run("dropped while congested", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1)
+		defer clientSession.Close()
+		stream, _ := clientSession.OpenUnreliableStream()
+		clientSession.reserveSend(clientSession.MaxPendingSend, true)
+		n, err := stream.Write([]byte("lost"))
+		if err != nil || n != 4 {
+			t.Errorf("expecting the datagram to be taken, got %v with %v", n, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if serverSession.streamCount() != 0 {
+			t.Error("a dropped datagram was sent")
+		}
+
+		clientSession.releaseSend(clientSession.MaxPendingSend)
+		stream.Write([]byte("sent"))
+		conn, _ := serverSession.Accept()
+		buf := make([]byte, 16)
+		n, _ = conn.Read(buf)
+		if !bytes.Equal(buf[:n], []byte("sent")) {
+			t.Errorf("expecting sent, got %q", buf[:n])
+		}
+	})
+
+	t.Run("dropped once the buffer is full", func(t *testing.T) {
+		d := newLossyDatagramBuffer(10)
+		d.Write(Frame{Payload: []byte("12345678")})
+		d.Write(Frame{Payload: []byte("abcdefgh")})
+		buf := make([]byte, 16)
+		n, _ := d.Read(buf)
+		if !bytes.Equal(buf[:n], []byte("12345678")) {
+			t.Errorf("expecting the first datagram, got %q", buf[:n])
+		}
+		if len(d.pLens) != 0 {
+			t.Error("the datagram over the limit was kept")
+		}
+		if toBeClosed, _ := d.Write(Frame{Closing: C_STREAM, Payload: make([]byte, 32)}); !toBeClosed {
+			t.Error("a closing frame was dropped")
+		}
+	})
+}
@@ -0,0 +1,299 @@
+package multiplex
+
+// With flow control, what's sent on the ordered streams of a session is limited by how much of it the remote has
+// read off them, so that a slow application or proxy server at the other end doesn't have the remote buffer without
+// end. Each side lets the other send up to StreamWindow bytes of payload on each stream that it hasn't read yet, and
+// up to SessionWindow on all of them together, and tells the other side how far it can send with C_WINDOW frames
+// as what's been sent is read. The limits they carry are counted from the start of the stream, or of the session, so
+// that a frame that's repeated or overtaken doesn't matter.
+//
+// A C_WINDOW frame of the session comes first, with the limit of the session and the window of each stream. Until
+// one comes, what's sent isn't limited. The server sends one if the client has said in the handshake that it takes
+// them, and the client sends its own once the server's has come. Datagram and control streams, and the streams of
+// an unordered session, aren't limited.
+
+import (
+	"encoding/binary"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the windows if the configuration doesn't say
+	DefaultStreamWindow  = 4 << 20
+	DefaultSessionWindow = 16 << 20
+)
+
+type flowControl struct {
+	m sync.Mutex
+	// broadcast when a limit goes up, or a stream or the session is closed
+	cond *sync.Cond
+
+	// whether the remote takes C_WINDOW frames, and ours have been sent
+	peerTakes    bool
+	announceOnce sync.Once
+
+	// the window the remote has for each new stream, 0 until it's told us
+	peerStreamWindow uint64
+	// what's been sent on all streams, and how far the remote lets that go. sendLimit is 0 while it isn't limited
+	sent      uint64
+	sendLimit uint64
+	// what's been read off all streams, or dropped, and how far we've let the remote send
+	consumed  uint64
+	recvLimit uint64
+}
+
+// streamWindow is what a flow controlled stream is counted and limited by. It's guarded by the m of
+// the flowControl of its session
+type streamWindow struct {
+	sent      uint64
+	sendLimit uint64
+	// what's come on the stream, and been read off it
+	received  uint64
+	consumed  uint64
+	recvLimit uint64
+}
+
+func (sesh *Session) initFlowControl() {
+	sesh.flow.cond = sync.NewCond(&sesh.flow.m)
+	sesh.flow.peerTakes = sesh.PeerFlowControl
+	sesh.flow.recvLimit = uint64(sesh.SessionWindow)
+}
+
+// flowControlled is whether what's sent on s is limited by the windows of the remote
+func (s *Stream) flowControlled() bool {
+	return !s.keepsBoundaries()
+}
+
+func (sesh *Session) initStreamWindow(s *Stream) {
+	if !s.flowControlled() {
+		return
+	}
+	sesh.flow.m.Lock()
+	s.window.sendLimit = sesh.flow.peerStreamWindow
+	s.window.recvLimit = uint64(sesh.StreamWindow)
+	sesh.flow.m.Unlock()
+}
+
+// wakeWindows has the sends waiting for a window check whether their stream or session has been closed
+func (sesh *Session) wakeWindows() {
+	sesh.flow.m.Lock()
+	sesh.flow.cond.Broadcast()
+	sesh.flow.m.Unlock()
+}
+
+// available is how much the remote lets be sent, of at most max, given what's been sent and the limit. A limit of 0
+// lets anything through
+func available(sent, limit uint64, max int) int {
+	if limit == 0 {
+		return max
+	}
+	if sent >= limit {
+		return 0
+	}
+	if limit-sent < uint64(max) {
+		return int(limit - sent)
+	}
+	return max
+}
+
+// awaitWindow waits until some of max bytes can be sent on s, and takes up to max of the windows for it, or returns
+// ErrWouldBlock if none can be straight away and block is false. The bytes not sent after all must be given back
+// with returnWindow
+func (s *Stream) awaitWindow(max int, block bool) (int, error) {
+	if !s.flowControlled() {
+		return max, nil
+	}
+	flow := &s.session.flow
+	flow.m.Lock()
+	defer flow.m.Unlock()
+	for {
+		if s.isClosed() || s.isClosing() || s.session.IsClosed() {
+			return 0, ErrBrokenStream
+		}
+		n := available(s.window.sent, s.window.sendLimit, max)
+		n = available(flow.sent, flow.sendLimit, n)
+		if n > 0 {
+			s.window.sent += uint64(n)
+			flow.sent += uint64(n)
+			return n, nil
+		}
+		if !block {
+			return 0, ErrWouldBlock
+		}
+		flow.cond.Wait()
+	}
+}
+
+// returnWindow gives back n bytes taken by awaitWindow that weren't sent
+func (s *Stream) returnWindow(n int) {
+	if !s.flowControlled() || n == 0 {
+		return
+	}
+	s.session.flow.m.Lock()
+	s.window.sent -= uint64(n)
+	s.session.flow.sent -= uint64(n)
+	s.session.flow.m.Unlock()
+}
+
+// windowReceived counts what's come on s
+func (s *Stream) windowReceived(n int) {
+	if !s.flowControlled() || n == 0 {
+		return
+	}
+	s.session.flow.m.Lock()
+	s.window.received += uint64(n)
+	s.session.flow.m.Unlock()
+}
+
+// windowConsumed counts what's been read off s, telling the remote it can send more once half of a window has been
+func (s *Stream) windowConsumed(n int) {
+	if !s.flowControlled() || n == 0 {
+		return
+	}
+	sesh := s.session
+	sesh.flow.m.Lock()
+	s.window.consumed += uint64(n)
+	sesh.flow.consumed += uint64(n)
+	var streamLimit uint64
+	if sesh.flow.peerTakes && sesh.StreamWindow > 0 && s.window.consumed+uint64(sesh.StreamWindow/2) >= s.window.recvLimit {
+		s.window.recvLimit = s.window.consumed + uint64(sesh.StreamWindow)
+		streamLimit = s.window.recvLimit
+	}
+	sessionLimit := sesh.updateSessionLimit()
+	sesh.flow.m.Unlock()
+
+	if streamLimit != 0 {
+		sesh.sendWindow(s.id, streamLimit)
+	}
+	if sessionLimit != 0 {
+		sesh.sendWindow(0xffffffff, sessionLimit)
+	}
+}
+
+// updateSessionLimit moves the limit of the session on if half of its window has been read, returning the new limit
+// to tell the remote, or 0 if it hasn't moved. flow.m must be held
+func (sesh *Session) updateSessionLimit() uint64 {
+	if !sesh.flow.peerTakes || sesh.SessionWindow <= 0 || sesh.flow.consumed+uint64(sesh.SessionWindow/2) < sesh.flow.recvLimit {
+		return 0
+	}
+	sesh.flow.recvLimit = sesh.flow.consumed + uint64(sesh.SessionWindow)
+	return sesh.flow.recvLimit
+}
+
+// windowClosed counts what's come on s but won't be read, now that s is closed, as read for the session
+func (s *Stream) windowClosed() {
+	sesh := s.session
+	sesh.flow.m.Lock()
+	var sessionLimit uint64
+	if s.flowControlled() && s.window.received > s.window.consumed {
+		sesh.flow.consumed += s.window.received - s.window.consumed
+		s.window.consumed = s.window.received
+		sessionLimit = sesh.updateSessionLimit()
+	}
+	sesh.flow.cond.Broadcast()
+	sesh.flow.m.Unlock()
+	if sessionLimit != 0 {
+		sesh.sendWindow(0xffffffff, sessionLimit)
+	}
+}
+
+// windowDropped counts what's come for a stream that's been closed as read for the session
+func (sesh *Session) windowDropped(frame *Frame) {
+	if sesh.Unordered || frame.StreamType != T_STREAM || frame.Closing != C_NOOP || len(frame.Payload) == 0 {
+		return
+	}
+	sesh.flow.m.Lock()
+	sesh.flow.consumed += uint64(len(frame.Payload))
+	sessionLimit := sesh.updateSessionLimit()
+	sesh.flow.m.Unlock()
+	if sessionLimit != 0 {
+		sesh.sendWindow(0xffffffff, sessionLimit)
+	}
+}
+
+// sendWindow tells the remote how far it can send on the stream of streamID, or on the session if it's 0xffffffff
+func (sesh *Session) sendWindow(streamID uint32, limit uint64) {
+	payload := binary.BigEndian.AppendUint64(nil, limit)
+	if streamID == 0xffffffff {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(sesh.StreamWindow))
+	}
+	// so that window updates aren't told apart by their length
+	payload = append(payload, genRandomPadding()...)
+	f := &Frame{
+		StreamID: streamID,
+		Closing:  C_WINDOW,
+		Payload:  payload,
+	}
+	obfsBuf := make([]byte, len(payload)+64)
+	i, err := sesh.Obfs(f, obfsBuf, 0)
+	if err != nil {
+		log.Errorf("failed to make window update for session %v: %v", sesh.id, err)
+		return
+	}
+	if _, err = sesh.sb.send(obfsBuf[:i], new(uint32)); err != nil {
+		log.Debugf("failed to send window update for session %v: %v", sesh.id, err)
+	}
+}
+
+// announceWindows tells the remote our windows, once it's known to take them and there's a connection to send
+// them on
+func (sesh *Session) announceWindows() {
+	sesh.flow.m.Lock()
+	announce := sesh.flow.peerTakes && sesh.StreamWindow > 0 && sesh.SessionWindow > 0
+	sesh.flow.m.Unlock()
+	if announce {
+		sesh.flow.announceOnce.Do(func() { go sesh.sendWindows() })
+	}
+}
+
+// sendWindows tells the remote how far it can send on the session and on each stream, e.g. again after resuming,
+// as an update may have been lost with a connection
+func (sesh *Session) sendWindows() {
+	sesh.flow.m.Lock()
+	if !sesh.flow.peerTakes || sesh.StreamWindow <= 0 || sesh.SessionWindow <= 0 {
+		sesh.flow.m.Unlock()
+		return
+	}
+	sessionLimit := sesh.flow.recvLimit
+	streamLimits := make(map[uint32]uint64)
+	sesh.streams.Range(func(key, streamI interface{}) bool {
+		if s, ok := streamI.(*Stream); ok && s.flowControlled() {
+			streamLimits[s.id] = s.window.recvLimit
+		}
+		return true
+	})
+	sesh.flow.m.Unlock()
+
+	sesh.sendWindow(0xffffffff, sessionLimit)
+	for id, limit := range streamLimits {
+		sesh.sendWindow(id, limit)
+	}
+}
+
+// recvWindow applies a C_WINDOW frame from the remote
+func (sesh *Session) recvWindow(frame *Frame) {
+	if len(frame.Payload) < 8 {
+		return
+	}
+	limit := binary.BigEndian.Uint64(frame.Payload)
+	sesh.flow.m.Lock()
+	if frame.StreamID == 0xffffffff {
+		if len(frame.Payload) >= 12 {
+			sesh.flow.peerStreamWindow = uint64(binary.BigEndian.Uint32(frame.Payload[8:12]))
+		}
+		if limit > sesh.flow.sendLimit {
+			sesh.flow.sendLimit = limit
+		}
+		sesh.flow.peerTakes = true
+	} else if streamI, ok := sesh.streams.Load(frame.StreamID); ok && streamI != nil {
+		s := streamI.(*Stream)
+		if limit > s.window.sendLimit {
+			s.window.sendLimit = limit
+		}
+	}
+	sesh.flow.cond.Broadcast()
+	sesh.flow.m.Unlock()
+	sesh.announceWindows()
+}
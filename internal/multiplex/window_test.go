@@ -0,0 +1,141 @@
+package multiplex
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// withFlowControl gives both sessions the windows, and tells the server whether the client controls its flow
+func withFlowControl(streamWindow, sessionWindow int, peerFlowControl bool) sessionPairOption {
+	return func(client, server *SessionConfig) {
+		client.StreamWindow, client.SessionWindow = streamWindow, sessionWindow
+		server.StreamWindow, server.SessionWindow = streamWindow, sessionWindow
+		server.PeerFlowControl = peerFlowControl
+	}
+}
+
+// writeInBackground writes data to stream, returning a channel that's sent how much has been written once it's done
+func writeInBackground(stream *Stream, data []byte) chan int {
+	written := make(chan int, 1)
+	go func() {
+		n, _ := stream.Write(data)
+		written <- n
+	}()
+	return written
+}
+
+func TestFlowControl(t *testing.T) {
+	const window = 64 << 10
+
+	t.Run("stream window", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withFlowControl(window, 4*window, true))
+		defer clientSession.Close()
+		// the server's windows have come
+		if !waitFor(func() bool { return clientSession.peerStreamWindow() == window }, time.Second) {
+			t.Fatal("the server didn't tell its windows")
+		}
+
+		stream, _ := clientSession.OpenStream()
+		data := make([]byte, 3*window)
+		rand.Read(data)
+		written := writeInBackground(stream, data)
+		select {
+		case <-written:
+			t.Fatal("wrote more than the window without the server reading")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		serverStream, err := serverSession.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(data))
+		if _, err = io.ReadFull(serverStream, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("what's read doesn't match what's written")
+		}
+		select {
+		case n := <-written:
+			if n != len(data) {
+				t.Errorf("expecting %v written, got %v", len(data), n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the write didn't finish once the server read")
+		}
+	})
+
+	t.Run("session window", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withFlowControl(window, window, true))
+		defer clientSession.Close()
+		if !waitFor(func() bool { return clientSession.peerStreamWindow() == window }, time.Second) {
+			t.Fatal("the server didn't tell its windows")
+		}
+
+		idle, _ := clientSession.OpenStream()
+		<-writeInBackground(idle, make([]byte, window))
+		busy, _ := clientSession.OpenStream()
+		written := writeInBackground(busy, make([]byte, 1))
+		select {
+		case <-written:
+			t.Fatal("wrote more than the window of the session without the server reading")
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		// what's come on a stream that's closed unread is let go of
+		serverStream, _ := serverSession.Accept()
+		serverStream.Close()
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatal("the window of the session wasn't freed by closing a stream")
+		}
+	})
+
+	t.Run("close while waiting", func(t *testing.T) {
+		clientSession, _, _ := makeSessionPair(1, withFlowControl(window, 4*window, true))
+		defer clientSession.Close()
+		if !waitFor(func() bool { return clientSession.peerStreamWindow() == window }, time.Second) {
+			t.Fatal("the server didn't tell its windows")
+		}
+		stream, _ := clientSession.OpenStream()
+		written := writeInBackground(stream, make([]byte, 2*window))
+		time.Sleep(100 * time.Millisecond)
+		stream.Close()
+		select {
+		case n := <-written:
+			if n != window {
+				t.Errorf("expecting the window written, got %v", n)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a write waiting for the window wasn't ended by closing the stream")
+		}
+	})
+
+	t.Run("not told to a peer that doesn't take it", func(t *testing.T) {
+		clientSession, serverSession, _ := makeSessionPair(1, withFlowControl(window, window, false))
+		defer clientSession.Close()
+		stream, _ := clientSession.OpenStream()
+		select {
+		case <-writeInBackground(stream, make([]byte, 4*window)):
+		case <-time.After(time.Second):
+			t.Fatal("the write was limited without windows")
+		}
+		if !waitFor(func() bool { return serverSession.streamCount() == 1 }, time.Second) {
+			t.Errorf("expecting only the stream on the server, got %v", serverSession.streamCount())
+		}
+		if clientSession.peerStreamWindow() != 0 {
+			t.Error("the server told its windows")
+		}
+	})
+}
+
+func (sesh *Session) peerStreamWindow() uint64 {
+	sesh.flow.m.Lock()
+	defer sesh.flow.m.Unlock()
+	return sesh.flow.peerStreamWindow
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"crypto"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
@@ -15,50 +16,190 @@ import (
 
 const appDataMaxLength = 16401
 
-type TLS struct{}
+type TLS struct {
+	// transcripts to sample the lengths of encrypted handshake records from, by transcriptKey. If nil, a single
+	// record is sent, of a length from coalesced or recordLength
+	transcripts map[string][][]int
+	// the lengths of the transcripts learnt for the ClientHello as single records, from which the length of the
+	// single record is sampled if there are any
+	coalesced []int
+	// the range of the length of the single record otherwise, defaultRecordLength if it's zero
+	recordLength [2]int
+	// the ML-KEM-768 encapsulation key in the X25519MLKEM768 key share of the ClientHello. If not nil, the session key
+	// is sent under a hybrid key exchange of x25519 and ML-KEM
+	mlkemKeyShare []byte
+	// the length of the fake session tickets sent after the encrypted handshake records. 0 if none are sent
+	ticketLength int
+	// whether the ClientHello offers a session ticket, in which case the handshake looks resumed
+	resumes bool
+	// the ServerHellos learnt from the redirection server by cipherSuitesKey
+	serverHellos map[string]serverHelloTemplate
+	// the cipher suite to reply with if the client offers it, zero if it isn't configured
+	cipherSuite [2]byte
+	// what the ServerHello is put together by, as chosen for the ClientHello
+	serverHello serverHelloTemplate
+	// whether ClientHellos that no TLS 1.3 client sends are rejected, as with parseStrictClientHello
+	strict bool
+}
+
+// NewSessionTicket messages sent after every handshake, as OpenSSL does. They're dropped if there isn't room for them
+// in common.MaxTranscriptRecords
+const sessionTicketsIssued = 2
+
+// the bytes of a NewSessionTicket record besides the ticket: the message header, ticket_lifetime, ticket_age_add,
+// an 8 byte ticket_nonce, the ticket length, empty extensions, and the inner content type and the AEAD tag of TLS 1.3
+const newSessionTicketOverhead = 4 + 4 + 4 + 1 + 8 + 2 + 2 + 1 + 16
+
+// defaultRecordLength is the range of the length of the single encrypted handshake record if RecordLength isn't set.
+// It's around that of defaultTranscript in one record, as long as the certificate chains of most sites
+var defaultRecordLength = [2]int{2800, 4200}
+
+// the inner content type and the AEAD tag that every encrypted record has once
+const encryptedRecordOverhead = 1 + 16
+
+// coalescedLength returns the length of the records of transcript if they're sent in one
+func coalescedLength(transcript []int) int {
+	length := 0
+	for _, record := range transcript {
+		length += record - encryptedRecordOverhead
+	}
+	return min(length+encryptedRecordOverhead, appDataMaxLength)
+}
+
+// resumedTranscript returns the records of a resumed handshake with the server of transcript, which has
+// EncryptedExtensions and Finished but no Certificate or CertificateVerify
+func resumedTranscript(transcript []int) []int {
+	if len(transcript) < 3 {
+		// they're coalesced, so there's no telling them apart
+		return []int{defaultTranscript[0], defaultTranscript[len(defaultTranscript)-1]}
+	}
+	return []int{transcript[0], transcript[len(transcript)-1]}
+}
 
 var ErrBadClientHello = errors.New("non (or malformed) ClientHello")
 
 func (TLS) String() string { return "TLS" }
 
-func (TLS) processFirstPacket(clientHello []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
-	ch, err := parseClientHello(clientHello)
+func (t *TLS) processFirstPacket(clientHello []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+	parse := parseClientHello
+	if t.strict {
+		parse = parseStrictClientHello
+	}
+	ch, err := parse(clientHello)
 	if err != nil {
 		log.Debug(err)
-		err = ErrBadClientHello
+		err = fmt.Errorf("%w: %w", ErrBadClientHello, err)
 		return
 	}
 
-	fragments, err = TLS{}.unmarshalClientHello(ch, privateKey)
+	fragments, err = TLS{}.unmarshalClientHello(ch, staticPvs)
 	if err != nil {
 		err = fmt.Errorf("failed to unmarshal ClientHello into authFragments: %v", err)
 		return
 	}
+	t.mlkemKeyShare, err = parseMLKEMKeyShare(ch.extensions[[2]byte{0x00, 0x33}])
+	if err != nil {
+		err = fmt.Errorf("failed to parse ClientHello's key share: %v", err)
+		return
+	}
+	_, t.resumes = ch.extensions[pskExtensionType]
+	t.serverHello = t.chooseServerHello(ch)
+	if t.serverHello.keyShareGroup == x25519Group {
+		// the redirection server doesn't take the hybrid key exchange when it's offered, so neither do we
+		t.mlkemKeyShare = nil
+	}
+
+	for _, transcript := range t.transcripts[transcriptKey(ch)] {
+		t.coalesced = append(t.coalesced, coalescedLength(transcript))
+	}
 
-	respond = TLS{}.makeResponder(ch.sessionId, fragments.sharedSecret)
+	respond = t.makeResponder(ch.sessionId, transcriptKey(ch), fragments.sharedSecret)
 
 	return
 }
 
-func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte) Responder {
+// chooseServerHello returns the template of the ServerHello that the redirection server replies to ch with. The
+// configured cipher suite takes precedence if ch offers it
+func (t *TLS) chooseServerHello(ch *ClientHello) serverHelloTemplate {
+	template, ok := t.serverHellos[cipherSuitesKey(ch)]
+	if !ok {
+		template.cipherSuite = firstTLS13CipherSuite(ch)
+	}
+	if t.cipherSuite != [2]byte{} && offersCipherSuite(ch, t.cipherSuite) {
+		template.cipherSuite = t.cipherSuite
+	}
+	return template
+}
+
+// makeResponder reads t.transcripts, t.mlkemKeyShare, t.ticketLength, t.resumes and t.serverHello when the Responder
+// is called, as it's only known after the client's flags have been decrypted whether it supports them
+func (t *TLS) makeResponder(clientHelloSessionId []byte, transcriptKey string, sharedSecret [32]byte) Responder {
 	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
-		// the cert length needs to be the same for all handshakes belonging to the same session
+		// the record lengths need to be the same for all handshakes belonging to the same session
 		// we can use sessionKey as a seed here to ensure consistency
-		possibleCertLengths := []int{42, 27, 68, 59, 36, 44, 46}
-		rand.Seed(int64(sessionKey[0]))
-		cert := make([]byte, possibleCertLengths[rand.Intn(len(possibleCertLengths))])
-		common.RandRead(randSource, cert)
+		sessionRand := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sessionKey[0:8]))))
+		var records [][]byte
+		if t.transcripts == nil {
+			var length int
+			if len(t.coalesced) > 0 {
+				length = t.coalesced[sessionRand.Intn(len(t.coalesced))]
+			} else {
+				lengths := t.recordLength
+				if lengths == [2]int{} {
+					lengths = defaultRecordLength
+				}
+				length = lengths[0] + sessionRand.Intn(lengths[1]-lengths[0]+1)
+			}
+			cert := make([]byte, length)
+			common.RandRead(randSource, cert)
+			records = [][]byte{cert}
+		} else {
+			transcripts, ok := t.transcripts[transcriptKey]
+			if !ok {
+				transcripts = [][]int{defaultTranscript}
+			}
+			transcript := transcripts[sessionRand.Intn(len(transcripts))]
+			if t.resumes {
+				transcript = resumedTranscript(transcript)
+			}
+			for _, length := range transcript {
+				record := make([]byte, length)
+				common.RandRead(randSource, record)
+				records = append(records, record)
+			}
+		}
+
+		var tickets [][]byte
+		for i := 0; i < sessionTicketsIssued && t.ticketLength > 0 && len(records)+len(tickets) < common.MaxTranscriptRecords; i++ {
+			ticket := make([]byte, t.ticketLength+newSessionTicketOverhead)
+			common.RandRead(randSource, ticket)
+			tickets = append(tickets, ticket)
+		}
+
+		secret := sharedSecret
+		var mlkemCiphertext []byte
+		if t.mlkemKeyShare != nil {
+			var mlkemSecret []byte
+			mlkemSecret, mlkemCiphertext, err = ecdh.Encapsulate(t.mlkemKeyShare)
+			if err != nil {
+				err = fmt.Errorf("failed to encapsulate to the client's ML-KEM key: %v", err)
+				return
+			}
+			secret = ecdh.HybridSharedSecret(sharedSecret[:], mlkemSecret)
+		}
 
 		var nonce [12]byte
 		common.RandRead(randSource, nonce[:])
-		encryptedSessionKey, err := common.AESGCMEncrypt(nonce[:], sharedSecret[:], sessionKey[:])
+		encryptedSessionKey, err := common.AESGCMEncrypt(nonce[:], secret[:], sessionKey[:])
 		if err != nil {
 			return
 		}
 		var encryptedSessionKeyArr [48]byte
 		copy(encryptedSessionKeyArr[:], encryptedSessionKey)
 
-		reply := composeReply(clientHelloSessionId, nonce, encryptedSessionKeyArr, cert)
+		// the client reads the tickets along with the encrypted handshake records
+		recordCountHint := common.RecordCountHint(secret[:], len(records)+len(tickets))
+		reply := composeReply(clientHelloSessionId, nonce, encryptedSessionKeyArr, records, tickets, recordCountHint, mlkemCiphertext, t.resumes, t.serverHello)
 		_, err = originalConn.Write(reply)
 		if err != nil {
 			err = fmt.Errorf("failed to write TLS reply: %v", err)
@@ -71,7 +212,9 @@ func (TLS) makeResponder(clientHelloSessionId []byte, sharedSecret [32]byte) Res
 	return respond
 }
 
-func (TLS) unmarshalClientHello(ch *ClientHello, staticPv crypto.PrivateKey) (fragments authFragments, err error) {
+// unmarshalClientHello extracts the authFragments from ch, with the shared secret of whichever of staticPvs the client
+// connected with
+func (TLS) unmarshalClientHello(ch *ClientHello, staticPvs []crypto.PrivateKey) (fragments authFragments, err error) {
 	copy(fragments.randPubKey[:], ch.random)
 	ephPub, ok := ecdh.Unmarshal(fragments.randPubKey[:])
 	if !ok {
@@ -79,18 +222,19 @@ func (TLS) unmarshalClientHello(ch *ClientHello, staticPv crypto.PrivateKey) (fr
 		return
 	}
 
-	copy(fragments.sharedSecret[:], ecdh.GenerateSharedSecret(staticPv, ephPub))
 	var keyShare []byte
 	keyShare, err = parseKeyShare(ch.extensions[[2]byte{0x00, 0x33}])
 	if err != nil {
 		return
 	}
 
-	ctxTag := append(ch.sessionId, keyShare...)
+	// the session id shares its backing array with the rest of the ClientHello, which appending to it would overwrite
+	ctxTag := append(append([]byte{}, ch.sessionId...), keyShare...)
 	if len(ctxTag) != 64 {
 		err = fmt.Errorf("%v: %v", ErrCiphertextLength, len(ctxTag))
 		return
 	}
 	copy(fragments.ciphertextWithTag[:], ctxTag)
+	fragments.findSharedSecret(staticPvs, ephPub)
 	return
 }
@@ -2,11 +2,13 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"strings"
 )
 
 // ClientHello contains every field in a ClientHello message
@@ -25,58 +27,203 @@ type ClientHello struct {
 	extensions            map[[2]byte][]byte
 }
 
+// encryptedClientHello is the outer variant of the encrypted_client_hello extension
+type encryptedClientHello struct {
+	kdfId    uint16
+	aeadId   uint16
+	configId byte
+	enc      []byte
+	payload  []byte
+}
+
+var echExtensionType = [2]byte{0xfe, 0x0d}
+var pskExtensionType = [2]byte{0x00, 0x29}
+
 var u16 = binary.BigEndian.Uint16
 var u32 = binary.BigEndian.Uint32
 
-func parseExtensions(input []byte) (ret map[[2]byte][]byte, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New("Malformed Extensions")
-		}
-	}()
-	pointer := 0
-	totalLen := len(input)
+// errors of ClientHellos that can't be parsed, which are told apart in the metrics of rejected handshakes
+var (
+	ErrNotClientHello = errors.New("not a TLS 1.3 ClientHello")
+	ErrHelloTruncated = errors.New("ClientHello is truncated")
+	ErrHelloLength    = errors.New("ClientHello length doesn't match")
+	// only in strict mode
+	ErrHelloTrailingData       = errors.New("ClientHello has trailing data")
+	ErrHelloDuplicateExtension = errors.New("ClientHello has a duplicate extension")
+	ErrHelloOddField           = errors.New("ClientHello has a field no TLS 1.3 client sends")
+)
+
+// helloReader reads the fields of a handshake message from its front, checking that each is within what's left of
+// it, so that nothing from the network is indexed out of bounds
+type helloReader []byte
+
+// read returns the next n bytes, which are capped so that appending to them can't overwrite what follows
+func (r *helloReader) read(n int) ([]byte, bool) {
+	if n < 0 || len(*r) < n {
+		return nil, false
+	}
+	ret := (*r)[:n:n]
+	*r = (*r)[n:]
+	return ret, true
+}
+
+// readInt reads an unsigned big endian integer of n bytes, up to 4
+func (r *helloReader) readInt(n int) (int, bool) {
+	b, ok := r.read(n)
+	if !ok {
+		return 0, false
+	}
+	ret := 0
+	for _, x := range b {
+		ret = ret<<8 | int(x)
+	}
+	return ret, true
+}
+
+// readVector reads a field prefixed by its length of lenBytes bytes
+func (r *helloReader) readVector(lenBytes int) (helloReader, bool) {
+	length, ok := r.readInt(lenBytes)
+	if !ok {
+		return nil, false
+	}
+	return r.read(length)
+}
+
+// parseExtensions parses the extensions of a ClientHello by their types. A type that's repeated is an error in
+// strict mode, and takes the last of them otherwise
+func parseExtensions(input []byte, strict bool) (ret map[[2]byte][]byte, err error) {
+	r := helloReader(input)
 	ret = make(map[[2]byte][]byte)
-	for pointer < totalLen {
-		var typ [2]byte
-		copy(typ[:], input[pointer:pointer+2])
-		pointer += 2
-		length := int(u16(input[pointer : pointer+2]))
-		pointer += 2
-		data := input[pointer : pointer+length]
-		pointer += length
-		ret[typ] = data
+	for len(r) > 0 {
+		typ, ok := r.read(2)
+		if !ok {
+			return nil, fmt.Errorf("%w: extension type", ErrHelloTruncated)
+		}
+		data, ok := r.readVector(2)
+		if !ok {
+			return nil, fmt.Errorf("%w: extension %x", ErrHelloTruncated, typ)
+		}
+		key := [2]byte(typ)
+		if _, ok := ret[key]; ok && strict {
+			return nil, fmt.Errorf("%w: %x", ErrHelloDuplicateExtension, typ)
+		}
+		ret[key] = data
 	}
-	return ret, err
+	return ret, nil
 }
 
-func parseKeyShare(input []byte) (ret []byte, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New("malformed key_share")
+var sniExtensionType = [2]byte{0x00, 0x00}
+
+// parseSNI returns the host name in the server_name extension
+func parseSNI(input []byte) (ret string, err error) {
+	r := helloReader(input)
+	list, ok := r.readVector(2)
+	if !ok {
+		return "", errors.New("malformed server_name")
+	}
+	for len(list) > 0 {
+		nameType, ok1 := list.readInt(1)
+		name, ok2 := list.readVector(2)
+		if !ok1 || !ok2 {
+			return "", errors.New("malformed server_name")
 		}
-	}()
-	totalLen := int(u16(input[0:2]))
-	// 2 bytes "client key share length"
-	pointer := 2
-	for pointer < totalLen {
-		if bytes.Equal([]byte{0x00, 0x1d}, input[pointer:pointer+2]) {
-			// skip "key exchange length"
-			pointer += 2
-			length := int(u16(input[pointer : pointer+2]))
-			pointer += 2
-			if length != 32 {
-				return nil, fmt.Errorf("key share length should be 32, instead of %v", length)
-			}
-			return input[pointer : pointer+length], nil
+		if nameType == 0x00 {
+			return string(name), nil
 		}
-		pointer += 2
-		length := int(u16(input[pointer : pointer+2]))
-		pointer += 2
-		_ = input[pointer : pointer+length]
-		pointer += length
 	}
-	return nil, errors.New("x25519 does not exist")
+	return "", errors.New("no host_name in server_name")
+}
+
+var x25519Group = [2]byte{0x00, 0x1d}
+var x25519MLKEM768Group = [2]byte{0x11, 0xec}
+
+// findKeyShare returns the key exchange of group in the key_share extension, or nil if there isn't one
+func findKeyShare(input []byte, group [2]byte) (ret []byte, err error) {
+	r := helloReader(input)
+	list, ok := r.readVector(2)
+	if !ok {
+		return nil, errors.New("malformed key_share")
+	}
+	for len(list) > 0 {
+		shareGroup, ok1 := list.read(2)
+		keyExchange, ok2 := list.readVector(2)
+		if !ok1 || !ok2 {
+			return nil, errors.New("malformed key_share")
+		}
+		if bytes.Equal(group[:], shareGroup) {
+			return keyExchange, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkKeyShare checks that the key_share extension is exactly a list of key shares
+func checkKeyShare(input []byte) error {
+	r := helloReader(input)
+	list, ok := r.readVector(2)
+	if !ok || len(r) != 0 {
+		return fmt.Errorf("%w: key_share list length", ErrHelloOddField)
+	}
+	for len(list) > 0 {
+		_, ok1 := list.read(2)
+		keyExchange, ok2 := list.readVector(2)
+		if !ok1 || !ok2 || len(keyExchange) == 0 {
+			return fmt.Errorf("%w: key_share entry", ErrHelloOddField)
+		}
+	}
+	return nil
+}
+
+func parseKeyShare(input []byte) (ret []byte, err error) {
+	ret, err = findKeyShare(input, x25519Group)
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, errors.New("x25519 does not exist")
+	}
+	if len(ret) != 32 {
+		return nil, fmt.Errorf("key share length should be 32, instead of %v", len(ret))
+	}
+	return ret, nil
+}
+
+// parseMLKEMKeyShare returns the ML-KEM-768 encapsulation key in the X25519MLKEM768 key share, or nil if there
+// isn't one
+func parseMLKEMKeyShare(input []byte) (ret []byte, err error) {
+	ret, err = findKeyShare(input, x25519MLKEM768Group)
+	if ret == nil || err != nil {
+		return nil, err
+	}
+	if len(ret) != ecdh.MLKEMEncapsulationKeySize+32 {
+		return nil, fmt.Errorf("X25519MLKEM768 key share length should be %v, instead of %v", ecdh.MLKEMEncapsulationKeySize+32, len(ret))
+	}
+	return ret[:ecdh.MLKEMEncapsulationKeySize], nil
+}
+
+// parseECH parses the encrypted_client_hello extension. We can't decrypt the ClientHelloInner, but a ClientHello
+// that can't be parsed by the decoy's client-facing server shouldn't be accepted by us either
+func parseECH(input []byte) (ret *encryptedClientHello, err error) {
+	r := helloReader(input)
+	echType, ok := r.readInt(1)
+	if !ok {
+		return nil, errors.New("malformed encrypted_client_hello")
+	}
+	if echType != 0x00 {
+		return nil, fmt.Errorf("ECH type should be outer, instead of %v", echType)
+	}
+	ret = &encryptedClientHello{}
+	kdfId, ok1 := r.readInt(2)
+	aeadId, ok2 := r.readInt(2)
+	configId, ok3 := r.readInt(1)
+	enc, ok4 := r.readVector(2)
+	payload, ok5 := r.readVector(2)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || len(payload) == 0 || len(r) != 0 {
+		return nil, errors.New("malformed encrypted_client_hello")
+	}
+	ret.kdfId, ret.aeadId, ret.configId = uint16(kdfId), uint16(aeadId), byte(configId)
+	ret.enc, ret.payload = enc, payload
+	return ret, nil
 }
 
 // addRecordLayer adds record layer to data
@@ -94,66 +241,105 @@ func addRecordLayer(input []byte, typ []byte, ver []byte) []byte {
 // parseClientHello parses everything on top of the TLS layer
 // (including the record layer) into ClientHello type
 func parseClientHello(data []byte) (ret *ClientHello, err error) {
-	defer func() {
-		if r := recover(); r != nil {
-			err = errors.New("Malformed ClientHello")
-		}
-	}()
+	return readClientHello(data, false)
+}
+
+// parseStrictClientHello is parseClientHello that also rejects ClientHellos which are well-formed but which no TLS 1.3
+// client sends, e.g. with bytes after the extensions, a repeated extension or a compression method, so that probes
+// can be told apart from clients earlier
+func parseStrictClientHello(data []byte) (ret *ClientHello, err error) {
+	return readClientHello(data, true)
+}
 
-	if !bytes.Equal(data[0:3], []byte{0x16, 0x03, 0x01}) {
-		return ret, errors.New("wrong TLS1.3 handshake magic bytes")
+func readClientHello(data []byte, strict bool) (ret *ClientHello, err error) {
+	if len(data) < 5 || !bytes.Equal(data[0:3], []byte{0x16, 0x03, 0x01}) {
+		return ret, fmt.Errorf("%w: wrong TLS1.3 handshake magic bytes", ErrNotClientHello)
+	}
+	if strict && int(u16(data[3:5])) != len(data)-5 {
+		return ret, fmt.Errorf("%w: record length doesn't match", ErrHelloLength)
 	}
 
 	peeled := make([]byte, len(data)-5)
 	copy(peeled, data[5:])
-	pointer := 0
+	r := helloReader(peeled)
 	// Handshake Type
-	handshakeType := peeled[pointer]
+	handshakeType, ok := r.readInt(1)
+	if !ok {
+		return ret, fmt.Errorf("%w: handshake type", ErrHelloTruncated)
+	}
 	if handshakeType != 0x01 {
-		return ret, errors.New("Not a ClientHello")
+		return ret, fmt.Errorf("%w: handshake type %v", ErrNotClientHello, handshakeType)
 	}
-	pointer += 1
 	// Length
-	length := int(u32(append([]byte{0x00}, peeled[pointer:pointer+3]...)))
-	pointer += 3
-	if length != len(peeled[pointer:]) {
-		return ret, errors.New("Hello length doesn't match")
+	length, ok := r.readInt(3)
+	if !ok {
+		return ret, fmt.Errorf("%w: length", ErrHelloTruncated)
+	}
+	if length != len(r) {
+		return ret, ErrHelloLength
 	}
 	// Client Version
-	clientVersion := peeled[pointer : pointer+2]
-	pointer += 2
+	clientVersion, ok := r.read(2)
+	if !ok {
+		return ret, fmt.Errorf("%w: client version", ErrHelloTruncated)
+	}
 	// Random
-	random := peeled[pointer : pointer+32]
-	pointer += 32
+	random, ok := r.read(32)
+	if !ok {
+		return ret, fmt.Errorf("%w: random", ErrHelloTruncated)
+	}
 	// Session ID
-	sessionIdLen := int(peeled[pointer])
-	pointer += 1
-	sessionId := peeled[pointer : pointer+sessionIdLen]
-	pointer += sessionIdLen
+	sessionId, ok := r.readVector(1)
+	if !ok {
+		return ret, fmt.Errorf("%w: session id", ErrHelloTruncated)
+	}
 	// Cipher Suites
-	cipherSuitesLen := int(u16(peeled[pointer : pointer+2]))
-	pointer += 2
-	cipherSuites := peeled[pointer : pointer+cipherSuitesLen]
-	pointer += cipherSuitesLen
+	cipherSuites, ok := r.readVector(2)
+	if !ok {
+		return ret, fmt.Errorf("%w: cipher suites", ErrHelloTruncated)
+	}
 	// Compression Methods
-	compressionMethodsLen := int(peeled[pointer])
-	pointer += 1
-	compressionMethods := peeled[pointer : pointer+compressionMethodsLen]
-	pointer += compressionMethodsLen
+	compressionMethods, ok := r.readVector(1)
+	if !ok {
+		return ret, fmt.Errorf("%w: compression methods", ErrHelloTruncated)
+	}
 	// Extensions
-	extensionsLen := int(u16(peeled[pointer : pointer+2]))
-	pointer += 2
-	extensions, err := parseExtensions(peeled[pointer:])
+	extensionsLen, ok := r.readInt(2)
+	if !ok {
+		return ret, fmt.Errorf("%w: extensions length", ErrHelloTruncated)
+	}
+	if strict {
+		if err = checkHelloFields(clientVersion, sessionId, cipherSuites, compressionMethods); err != nil {
+			return
+		}
+		if extensionsLen != len(r) {
+			return ret, fmt.Errorf("%w: %v bytes after the extensions", ErrHelloTrailingData, len(r)-extensionsLen)
+		}
+	}
+	extensions, err := parseExtensions(r, strict)
+	if err != nil {
+		return
+	}
+	if echExt, ok := extensions[echExtensionType]; ok {
+		if _, err = parseECH(echExt); err != nil {
+			return
+		}
+	}
+	if keyShare, ok := extensions[keyShareExtensionType]; ok && strict {
+		if err = checkKeyShare(keyShare); err != nil {
+			return
+		}
+	}
 	ret = &ClientHello{
-		handshakeType,
+		byte(handshakeType),
 		length,
 		clientVersion,
 		random,
-		sessionIdLen,
+		len(sessionId),
 		sessionId,
-		cipherSuitesLen,
+		len(cipherSuites),
 		cipherSuites,
-		compressionMethodsLen,
+		len(compressionMethods),
 		compressionMethods,
 		extensionsLen,
 		extensions,
@@ -161,42 +347,223 @@ func parseClientHello(data []byte) (ret *ClientHello, err error) {
 	return
 }
 
-func composeServerHello(sessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte) []byte {
-	var serverHello [11][]byte
+// checkHelloFields checks the fields before the extensions of a ClientHello against what a TLS 1.3 client sends
+func checkHelloFields(clientVersion, sessionId, cipherSuites, compressionMethods []byte) error {
+	switch {
+	case !bytes.Equal(clientVersion, []byte{0x03, 0x03}):
+		return fmt.Errorf("%w: client version %x", ErrHelloOddField, clientVersion)
+	case len(sessionId) > 32:
+		return fmt.Errorf("%w: session id of %v bytes", ErrHelloOddField, len(sessionId))
+	case len(cipherSuites) == 0 || len(cipherSuites)%2 != 0:
+		return fmt.Errorf("%w: cipher suites of %v bytes", ErrHelloOddField, len(cipherSuites))
+	case !bytes.Equal(compressionMethods, []byte{0x00}):
+		return fmt.Errorf("%w: compression methods %x", ErrHelloOddField, compressionMethods)
+	}
+	return nil
+}
+
+var keyShareExtensionType = [2]byte{0x00, 0x33}
+var supportedVersionsExtensionType = [2]byte{0x00, 0x2b}
+
+// serverHelloTemplate is how a ServerHello is put together around the fields that carry the session key
+type serverHelloTemplate struct {
+	cipherSuite [2]byte
+	// the order of key_share, supported_versions and pre_shared_key. pre_shared_key is only sent if the handshake is
+	// resumed, and goes last if it's not in the order
+	extensions [][2]byte
+	// the group of the key share the redirection server has taken, zero if it isn't learnt
+	keyShareGroup [2]byte
+}
+
+// the random of a HelloRetryRequest, which is a ServerHello in format
+var helloRetryRequestRandom, _ = hex.DecodeString("cf21ad74e59a6111be1d8c021e65b891c2a211167abb8c5e079e09e2c8a8339c")
+
+// legacyExtensionOrder is the order of the ServerHello extensions that older clients read the key share from
+var legacyExtensionOrder = [][2]byte{keyShareExtensionType, supportedVersionsExtensionType, pskExtensionType}
+
+// parseServerHelloTemplate learns the template of a ServerHello, without its record layer, from a TLS 1.3 server
+func parseServerHelloTemplate(sh []byte) (template serverHelloTemplate, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.New("malformed ServerHello")
+		}
+	}()
+	if sh[0] != 0x02 {
+		return template, errors.New("not a ServerHello")
+	}
+	if bytes.Equal(sh[6:38], helloRetryRequestRandom) {
+		return template, errors.New("HelloRetryRequest rather than ServerHello")
+	}
+	pointer := 4 + 2 + 32
+	pointer += 1 + int(sh[pointer])
+	copy(template.cipherSuite[:], sh[pointer:pointer+2])
+	pointer += 2 + 1
+	extensionsLen := int(u16(sh[pointer : pointer+2]))
+	pointer += 2
+	if pointer+extensionsLen > len(sh) {
+		return template, errors.New("ServerHello extensions longer than the ServerHello")
+	}
+	extensions, err := parseExtensions(sh[pointer:pointer+extensionsLen], false)
+	if err != nil {
+		return
+	}
+	if !bytes.Equal(extensions[supportedVersionsExtensionType], []byte{0x03, 0x04}) {
+		return template, errors.New("ServerHello isn't of TLS 1.3")
+	}
+	keyShare := extensions[keyShareExtensionType]
+	if len(keyShare) < 2 {
+		return template, errors.New("ServerHello has no key share")
+	}
+	copy(template.keyShareGroup[:], keyShare[0:2])
+	for end := pointer + extensionsLen; pointer < end; {
+		var typ [2]byte
+		copy(typ[:], sh[pointer:pointer+2])
+		pointer += 4 + int(u16(sh[pointer+2:pointer+4]))
+		switch typ {
+		case keyShareExtensionType, supportedVersionsExtensionType, pskExtensionType:
+			template.extensions = append(template.extensions, typ)
+		}
+	}
+	return
+}
+
+// isGREASE tells if value is one of the GREASE values of RFC 8701, which are 0x?a?a with both bytes the same
+func isGREASE(value []byte) bool {
+	return value[0] == value[1] && value[0]&0x0f == 0x0a
+}
+
+// cipherSuitesKey identifies the cipher suites of a ClientHello, which are what decides the cipher suite a server
+// chooses. GREASE values are left out as they're random
+func cipherSuitesKey(ch *ClientHello) string {
+	var key []byte
+	for i := 0; i+2 <= len(ch.cipherSuites); i += 2 {
+		if !isGREASE(ch.cipherSuites[i : i+2]) {
+			key = append(key, ch.cipherSuites[i:i+2]...)
+		}
+	}
+	return string(key)
+}
+
+// offersCipherSuite tells if suite is one of the cipher suites of ch
+func offersCipherSuite(ch *ClientHello, suite [2]byte) bool {
+	for i := 0; i+2 <= len(ch.cipherSuites); i += 2 {
+		if bytes.Equal(ch.cipherSuites[i:i+2], suite[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstTLS13CipherSuite returns the first TLS 1.3 cipher suite offered by ch, which is what a server that doesn't
+// have preferences of its own chooses. It's TLS_AES_128_GCM_SHA256 if there's none
+func firstTLS13CipherSuite(ch *ClientHello) [2]byte {
+	for i := 0; i+2 <= len(ch.cipherSuites); i += 2 {
+		if ch.cipherSuites[i] == 0x13 && ch.cipherSuites[i+1] >= 0x01 && ch.cipherSuites[i+1] <= 0x05 {
+			return [2]byte{ch.cipherSuites[i], ch.cipherSuites[i+1]}
+		}
+	}
+	return [2]byte{0x13, 0x01}
+}
+
+// parseCipherSuite returns the TLS 1.3 cipher suite of name in crypto/tls
+func parseCipherSuite(name string) ([2]byte, error) {
+	for _, suite := range tls.CipherSuites() {
+		if !strings.EqualFold(suite.Name, name) {
+			continue
+		}
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS13 {
+				return [2]byte{byte(suite.ID >> 8), byte(suite.ID)}, nil
+			}
+		}
+		return [2]byte{}, fmt.Errorf("cipher suite %v isn't of TLS 1.3", name)
+	}
+	return [2]byte{}, fmt.Errorf("unknown cipher suite %v", name)
+}
+
+// composeServerHello puts the encrypted session key and the record count hint into the random and the x25519 key
+// exchange. If mlkemCiphertext isn't nil, the key share is X25519MLKEM768 with mlkemCiphertext as its ML-KEM part. If
+// resumed, the pre_shared_key extension accepts the first ticket the client offered. The cipher suite and the order
+// of the extensions are those of template, and the extensions are in legacyExtensionOrder if it has none
+func composeServerHello(sessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, recordCountHint []byte, mlkemCiphertext []byte, resumed bool, template serverHelloTemplate) []byte {
+	keyExchange := make([]byte, 32)
+	copy(keyExchange, encryptedSessionKeyWithTag[20:48])
+	copy(keyExchange[28:32], recordCountHint)
+	group := x25519Group
+	if mlkemCiphertext != nil {
+		group = x25519MLKEM768Group
+		keyExchange = append(append([]byte{}, mlkemCiphertext...), keyExchange...)
+	}
+	keyShare := make([]byte, 8+len(keyExchange))
+	copy(keyShare[0:2], keyShareExtensionType[:])
+	binary.BigEndian.PutUint16(keyShare[2:4], uint16(4+len(keyExchange)))
+	copy(keyShare[4:6], group[:])
+	binary.BigEndian.PutUint16(keyShare[6:8], uint16(len(keyExchange)))
+	copy(keyShare[8:], keyExchange)
+	supportedVersions, _ := hex.DecodeString("002b00020304")
+	var preSharedKey []byte
+	if resumed {
+		// selected_identity 0
+		preSharedKey = []byte{pskExtensionType[0], pskExtensionType[1], 0x00, 0x02, 0x00, 0x00}
+	}
+
+	order := template.extensions
+	if order == nil {
+		order = legacyExtensionOrder
+	}
+	var extensions []byte
+	pskSent := false
+	for _, typ := range order {
+		switch typ {
+		case keyShareExtensionType:
+			extensions = append(extensions, keyShare...)
+		case supportedVersionsExtensionType:
+			extensions = append(extensions, supportedVersions...)
+		case pskExtensionType:
+			extensions = append(extensions, preSharedKey...)
+			pskSent = true
+		}
+	}
+	if !pskSent {
+		extensions = append(extensions, preSharedKey...)
+	}
+
+	var serverHello [10][]byte
 	serverHello[0] = []byte{0x02}                                             // handshake type
-	serverHello[1] = []byte{0x00, 0x00, 0x76}                                 // length 77
+	serverHello[1] = make([]byte, 3)                                          // length, filled in below
 	serverHello[2] = []byte{0x03, 0x03}                                       // server version
 	serverHello[3] = append(nonce[0:12], encryptedSessionKeyWithTag[0:20]...) // random 32 bytes
 	serverHello[4] = []byte{0x20}                                             // session id length 32
 	serverHello[5] = sessionId                                                // session id
-	serverHello[6] = []byte{0xc0, 0x30}                                       // cipher suite TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	serverHello[6] = template.cipherSuite[:]                                  // cipher suite
 	serverHello[7] = []byte{0x00}                                             // compression method null
-	serverHello[8] = []byte{0x00, 0x2e}                                       // extensions length 46
+	serverHello[8] = make([]byte, 2)                                          // extensions length
+	binary.BigEndian.PutUint16(serverHello[8], uint16(len(extensions)))
+	serverHello[9] = extensions
 
-	keyShare, _ := hex.DecodeString("00330024001d0020")
-	keyExchange := make([]byte, 32)
-	copy(keyExchange, encryptedSessionKeyWithTag[20:48])
-	common.CryptoRandRead(keyExchange[28:32])
-	serverHello[9] = append(keyShare, keyExchange...)
-
-	serverHello[10], _ = hex.DecodeString("002b00020304")
 	var ret []byte
 	for _, s := range serverHello {
 		ret = append(ret, s...)
 	}
+	length := len(ret) - 4
+	ret[1], ret[2], ret[3] = byte(length>>16), byte(length>>8), byte(length)
 	return ret
 }
 
-// composeReply composes the ServerHello, ChangeCipherSpec and an ApplicationData messages
-// together with their respective record layers into one byte slice.
-func composeReply(clientHelloSessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, cert []byte) []byte {
+// composeReply composes the ServerHello, ChangeCipherSpec, the encrypted handshake records and the NewSessionTicket
+// records after them (in the format of ApplicationData) together with their respective record layers into one byte
+// slice.
+func composeReply(clientHelloSessionId []byte, nonce [12]byte, encryptedSessionKeyWithTag [48]byte, encryptedRecords [][]byte, sessionTickets [][]byte, recordCountHint []byte, mlkemCiphertext []byte, resumed bool, template serverHelloTemplate) []byte {
 	TLS12 := []byte{0x03, 0x03}
-	sh := composeServerHello(clientHelloSessionId, nonce, encryptedSessionKeyWithTag)
+	sh := composeServerHello(clientHelloSessionId, nonce, encryptedSessionKeyWithTag, recordCountHint, mlkemCiphertext, resumed, template)
 	shBytes := addRecordLayer(sh, []byte{0x16}, TLS12)
 	ccsBytes := addRecordLayer([]byte{0x01}, []byte{0x14}, TLS12)
-
-	encryptedCertBytes := addRecordLayer(cert, []byte{0x17}, TLS12)
 	ret := append(shBytes, ccsBytes...)
-	ret = append(ret, encryptedCertBytes...)
+	for _, record := range encryptedRecords {
+		ret = append(ret, addRecordLayer(record, []byte{0x17}, TLS12)...)
+	}
+	for _, ticket := range sessionTickets {
+		ret = append(ret, addRecordLayer(ticket, []byte{0x17}, TLS12)...)
+	}
 	return ret
 }
@@ -2,7 +2,12 @@ package server
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -52,3 +57,360 @@ func TestParseClientHello(t *testing.T) {
 		}
 	})
 }
+
+// clientHello puts together a ClientHello with its record layer from the fields after the random
+func clientHello(sessionId, cipherSuites, compressionMethods []byte, extensionsLen int, extensions []byte) []byte {
+	body := append([]byte{0x03, 0x03}, make([]byte, 32)...)
+	body = append(body, byte(len(sessionId)))
+	body = append(body, sessionId...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(cipherSuites)))
+	body = append(body, cipherSuites...)
+	body = append(body, byte(len(compressionMethods)))
+	body = append(body, compressionMethods...)
+	body = binary.BigEndian.AppendUint16(body, uint16(extensionsLen))
+	body = append(body, extensions...)
+	hello := append([]byte{0x01, 0x00, byte(len(body) >> 8), byte(len(body))}, body...)
+	return addRecordLayer(hello, []byte{0x16}, []byte{0x03, 0x01})
+}
+
+func TestParseStrictClientHello(t *testing.T) {
+	sessionId := make([]byte, 32)
+	suites := []byte{0x13, 0x01, 0x13, 0x02}
+	sni, _ := hex.DecodeString("00000010000e00000b6578616d706c652e636f6d")
+	keyShare := append([]byte{0x00, 0x33, 0x00, 0x26, 0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, make([]byte, 32)...)
+	extensions := append(append([]byte{}, sni...), keyShare...)
+	outOfBounds := clientHello(sessionId, suites, []byte{0x00}, len(extensions), extensions)
+	// the length of the cipher suites
+	outOfBounds[76], outOfBounds[77] = 0xff, 0xff
+
+	t.Run("good Cloak ClientHello", func(t *testing.T) {
+		chBytes, _ := hex.DecodeString("1603010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+		if _, err := parseStrictClientHello(chBytes); err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+
+	tests := []struct {
+		name  string
+		hello []byte
+		// the error in strict mode. Lenient mode only errs if it's not strict
+		expErr error
+		strict bool
+	}{
+		{"well-formed", clientHello(sessionId, suites, []byte{0x00}, len(extensions), extensions), nil, false},
+		{"truncated", clientHello(sessionId, suites, []byte{0x00}, len(extensions), extensions)[:60], ErrHelloLength, false},
+		{"field out of bounds", outOfBounds, ErrHelloTruncated, false},
+		{"duplicate extension", clientHello(sessionId, suites, []byte{0x00}, len(extensions)+len(sni), append(extensions, sni...)), ErrHelloDuplicateExtension, true},
+		{"trailing data", clientHello(sessionId, suites, []byte{0x00}, len(sni), extensions), ErrHelloTrailingData, true},
+		{"compression method", clientHello(sessionId, suites, []byte{0x01, 0x00}, len(extensions), extensions), ErrHelloOddField, true},
+		{"odd cipher suites", clientHello(sessionId, suites[:3], []byte{0x00}, len(extensions), extensions), ErrHelloOddField, true},
+		{"key share list length", clientHello(sessionId, suites, []byte{0x00}, len(extensions)+1, append(append(append([]byte{}, sni...), 0x00, 0x33, 0x00, 0x27), append(keyShare[4:], 0x00)...)), ErrHelloOddField, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseStrictClientHello(test.hello)
+			if !errors.Is(err, test.expErr) {
+				t.Errorf("expecting %v in strict mode, got %v", test.expErr, err)
+			}
+			_, err = parseClientHello(test.hello)
+			if test.strict && err != nil {
+				t.Errorf("expecting no error in lenient mode, got %v", err)
+			} else if !test.strict && !errors.Is(err, test.expErr) {
+				t.Errorf("expecting %v in lenient mode, got %v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestParseECH(t *testing.T) {
+	// outer, HKDF-SHA256, AES-128-GCM, config id 0x2a, 32 bytes enc and 32 bytes payload
+	good := "00000100012a0020" + strings.Repeat("ab", 32) + "0020" + strings.Repeat("cd", 32)
+	t.Run("good ECH", func(t *testing.T) {
+		input, _ := hex.DecodeString(good)
+		ech, err := parseECH(input)
+		if err != nil {
+			t.Fatalf("expecting no error, got %v", err)
+		}
+		if ech.configId != 0x2a || len(ech.enc) != 32 || len(ech.payload) != 32 {
+			t.Errorf("wrongly parsed ECH %+v", ech)
+		}
+	})
+	t.Run("inner ECH", func(t *testing.T) {
+		input, _ := hex.DecodeString("01" + good[2:])
+		_, err := parseECH(input)
+		if err == nil {
+			t.Error("expecting error, got nil")
+		}
+	})
+	t.Run("truncated ECH", func(t *testing.T) {
+		input, _ := hex.DecodeString(good[:len(good)-2])
+		_, err := parseECH(input)
+		if err == nil {
+			t.Error("expecting error, got nil")
+		}
+	})
+	t.Run("trailing bytes", func(t *testing.T) {
+		input, _ := hex.DecodeString(good + "00")
+		_, err := parseECH(input)
+		if err == nil {
+			t.Error("expecting error, got nil")
+		}
+	})
+}
+
+func TestParseMLKEMKeyShare(t *testing.T) {
+	ek := make([]byte, ecdh.MLKEMEncapsulationKeySize)
+	ek[0] = 0xaa
+	hybrid := append([]byte{0x11, 0xec, 0x04, 0xc0}, append(ek, make([]byte, 32)...)...)
+	x25519 := append([]byte{0x00, 0x1d, 0x00, 0x20}, make([]byte, 32)...)
+	keyShares := func(shares ...[]byte) []byte {
+		var ret []byte
+		for _, s := range shares {
+			ret = append(ret, s...)
+		}
+		return append([]byte{byte(len(ret) >> 8), byte(len(ret))}, ret...)
+	}
+
+	t.Run("hybrid and x25519", func(t *testing.T) {
+		ret, err := parseMLKEMKeyShare(keyShares(hybrid, x25519))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ret, ek) {
+			t.Error("wrong encapsulation key")
+		}
+		if _, err := parseKeyShare(keyShares(hybrid, x25519)); err != nil {
+			t.Errorf("x25519 key share not found after the hybrid one: %v", err)
+		}
+	})
+	t.Run("x25519 only", func(t *testing.T) {
+		ret, err := parseMLKEMKeyShare(keyShares(x25519))
+		if ret != nil || err != nil {
+			t.Errorf("expecting nothing, got %x, %v", ret, err)
+		}
+	})
+	t.Run("wrong length", func(t *testing.T) {
+		short := append([]byte{0x11, 0xec, 0x00, 0x20}, make([]byte, 32)...)
+		_, err := parseMLKEMKeyShare(keyShares(short, x25519))
+		if err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func TestComposeServerHello(t *testing.T) {
+	sessionId := make([]byte, 32)
+	var nonce [12]byte
+	var encryptedSessionKey [48]byte
+	encryptedSessionKey[47] = 0x47
+	hint := []byte{1, 2, 3, 4}
+	legacy := serverHelloTemplate{cipherSuite: [2]byte{0x13, 0x02}}
+
+	t.Run("x25519", func(t *testing.T) {
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, false, legacy)
+		if len(sh) != 122 || int(sh[1])<<16|int(sh[2])<<8|int(sh[3]) != len(sh)-4 {
+			t.Errorf("wrong length %v: %x", len(sh), sh[1:4])
+		}
+		if !bytes.Equal(sh[71:73], []byte{0x13, 0x02}) {
+			t.Errorf("expecting cipher suite 1302, got %x", sh[71:73])
+		}
+		if !bytes.Equal(sh[80:84], []byte{0x00, 0x1d, 0x00, 0x20}) {
+			t.Errorf("expecting an x25519 key share, got %x", sh[80:84])
+		}
+		if !bytes.Equal(sh[112:116], hint) {
+			t.Error("record count hint not at the end of the key exchange")
+		}
+	})
+	t.Run("resumed", func(t *testing.T) {
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, true, legacy)
+		if len(sh) != 128 || int(sh[74])<<8|int(sh[75]) != len(sh)-76 {
+			t.Errorf("wrong length %v with extensions length %x", len(sh), sh[74:76])
+		}
+		if !bytes.Equal(sh[122:], []byte{0x00, 0x29, 0x00, 0x02, 0x00, 0x00}) {
+			t.Errorf("expecting pre_shared_key with the first identity selected, got %x", sh[122:])
+		}
+		if !bytes.Equal(sh[112:116], hint) {
+			t.Error("record count hint moved")
+		}
+	})
+	t.Run("X25519MLKEM768", func(t *testing.T) {
+		ciphertext := bytes.Repeat([]byte{0xcc}, ecdh.MLKEMCiphertextSize)
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, ciphertext, false, legacy)
+		if int(sh[1])<<16|int(sh[2])<<8|int(sh[3]) != len(sh)-4 {
+			t.Errorf("wrong length %v: %x", len(sh), sh[1:4])
+		}
+		if int(sh[74])<<8|int(sh[75]) != len(sh)-76 {
+			t.Errorf("wrong extensions length %x", sh[74:76])
+		}
+		if !bytes.Equal(sh[80:84], []byte{0x11, 0xec, 0x04, 0x60}) {
+			t.Errorf("expecting an X25519MLKEM768 key share of 1120 bytes, got %x", sh[80:84])
+		}
+		if !bytes.Equal(sh[84:84+ecdh.MLKEMCiphertextSize], ciphertext) {
+			t.Error("ciphertext not embedded")
+		}
+		keyExchange := sh[84+ecdh.MLKEMCiphertextSize : 84+ecdh.MLKEMCiphertextSize+32]
+		if keyExchange[27] != 0x47 || !bytes.Equal(keyExchange[28:], hint) {
+			t.Errorf("x25519 part of the key share doesn't carry the session key: %x", keyExchange)
+		}
+	})
+	t.Run("extension order", func(t *testing.T) {
+		template := serverHelloTemplate{
+			cipherSuite: [2]byte{0x13, 0x01},
+			extensions:  [][2]byte{pskExtensionType, supportedVersionsExtensionType, keyShareExtensionType},
+		}
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, true, template)
+		if len(sh) != 128 || int(sh[74])<<8|int(sh[75]) != len(sh)-76 {
+			t.Errorf("wrong length %v with extensions length %x", len(sh), sh[74:76])
+		}
+		if !bytes.Equal(sh[76:88], []byte{0x00, 0x29, 0x00, 0x02, 0x00, 0x00, 0x00, 0x2b, 0x00, 0x02, 0x03, 0x04}) {
+			t.Errorf("expecting pre_shared_key and supported_versions first, got %x", sh[76:88])
+		}
+		if !bytes.Equal(sh[88:92], []byte{0x00, 0x33, 0x00, 0x24}) || !bytes.Equal(sh[124:128], hint) {
+			t.Errorf("expecting the key share last, got %x", sh[88:])
+		}
+	})
+}
+
+func TestParseServerHelloTemplate(t *testing.T) {
+	sessionId := make([]byte, 32)
+	var nonce [12]byte
+	var encryptedSessionKey [48]byte
+	hint := make([]byte, 4)
+
+	t.Run("round trip", func(t *testing.T) {
+		template := serverHelloTemplate{
+			cipherSuite:   [2]byte{0x13, 0x03},
+			extensions:    [][2]byte{supportedVersionsExtensionType, keyShareExtensionType},
+			keyShareGroup: x25519Group,
+		}
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, false, template)
+		parsed, err := parseServerHelloTemplate(sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, template) {
+			t.Errorf("expecting %v, got %v", template, parsed)
+		}
+	})
+	t.Run("X25519MLKEM768", func(t *testing.T) {
+		ciphertext := make([]byte, ecdh.MLKEMCiphertextSize)
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, ciphertext, false, serverHelloTemplate{})
+		parsed, err := parseServerHelloTemplate(sh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.keyShareGroup != x25519MLKEM768Group {
+			t.Errorf("expecting the hybrid group, got %x", parsed.keyShareGroup)
+		}
+	})
+	t.Run("HelloRetryRequest", func(t *testing.T) {
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, false, serverHelloTemplate{})
+		copy(sh[6:38], helloRetryRequestRandom)
+		if _, err := parseServerHelloTemplate(sh); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("TLS 1.2", func(t *testing.T) {
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, false, serverHelloTemplate{})
+		// supported_versions of TLS 1.2
+		sh[len(sh)-1] = 0x03
+		if _, err := parseServerHelloTemplate(sh); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		sh := composeServerHello(sessionId, nonce, encryptedSessionKey, hint, nil, false, serverHelloTemplate{})
+		if _, err := parseServerHelloTemplate(sh[:80]); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func TestCipherSuites(t *testing.T) {
+	// GREASE, TLS_AES_256_GCM_SHA384, TLS_CHACHA20_POLY1305_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+	ch := &ClientHello{cipherSuites: []byte{0x3a, 0x3a, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x30}}
+	if key := cipherSuitesKey(ch); key != "\x13\x02\x13\x03\xc0\x30" {
+		t.Errorf("GREASE not left out of %x", key)
+	}
+	if suite := firstTLS13CipherSuite(ch); suite != [2]byte{0x13, 0x02} {
+		t.Errorf("expecting 1302, got %x", suite)
+	}
+	if suite := firstTLS13CipherSuite(&ClientHello{cipherSuites: []byte{0xc0, 0x30}}); suite != [2]byte{0x13, 0x01} {
+		t.Errorf("expecting 1301 without TLS 1.3 cipher suites, got %x", suite)
+	}
+	if !offersCipherSuite(ch, [2]byte{0x13, 0x03}) || offersCipherSuite(ch, [2]byte{0x13, 0x01}) {
+		t.Error("wrong offered cipher suites")
+	}
+
+	suite, err := parseCipherSuite("tls_chacha20_poly1305_sha256")
+	if err != nil || suite != [2]byte{0x13, 0x03} {
+		t.Errorf("expecting 1303, got %x, %v", suite, err)
+	}
+	for _, name := range []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_NOTHING"} {
+		if _, err := parseCipherSuite(name); err == nil {
+			t.Errorf("expecting an error from %v", name)
+		}
+	}
+}
+
+func TestParseSNI(t *testing.T) {
+	t.Run("host_name", func(t *testing.T) {
+		ext, _ := hex.DecodeString("000f00000c7777772e62696e672e636f6d")
+		sni, err := parseSNI(ext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sni != "www.bing.com" {
+			t.Errorf("expecting www.bing.com, got %v", sni)
+		}
+	})
+	t.Run("malformed", func(t *testing.T) {
+		ext, _ := hex.DecodeString("000f00000c7777")
+		_, err := parseSNI(ext)
+		if err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	good, _ := hex.DecodeString("1603010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+	f.Add(good)
+	f.Add(clientHello(nil, []byte{0x13, 0x01}, []byte{0x00}, 0, nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ch, err := parseClientHello(data)
+		if err != nil {
+			return
+		}
+		if _, err := parseSNI(ch.extensions[sniExtensionType]); err == nil {
+			_ = decoyNameOf(data)
+		}
+		_, _ = parseKeyShare(ch.extensions[keyShareExtensionType])
+		_, _ = parseMLKEMKeyShare(ch.extensions[keyShareExtensionType])
+		if _, err := parseStrictClientHello(data); err == nil && ch.compressionMethodsLen != 1 {
+			t.Error("a ClientHello with compression methods passed strict mode")
+		}
+	})
+}
+
+func FuzzParseKeyShare(f *testing.F) {
+	f.Add(append([]byte{0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, make([]byte, 32)...))
+	f.Add([]byte{0x00, 0x04, 0x11, 0xec, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, input []byte) {
+		_, findErr := findKeyShare(input, x25519Group)
+		if checkKeyShare(input) == nil && findErr != nil {
+			t.Errorf("a key share that passed strict mode can't be searched: %v", findErr)
+		}
+		_, _ = parseKeyShare(input)
+		_, _ = parseMLKEMKeyShare(input)
+	})
+}
+
+func FuzzParseECH(f *testing.F) {
+	good, _ := hex.DecodeString("00000100012a0020" + strings.Repeat("ab", 32) + "0020" + strings.Repeat("cd", 32))
+	f.Add(good)
+	f.Fuzz(func(t *testing.T, input []byte) {
+		_, _ = parseECH(input)
+		_, _ = parseSNI(input)
+	})
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	utls "github.com/refraction-networking/utls"
+	"net"
+	"testing"
+)
+
+func TestTLSResponder(t *testing.T) {
+	sessionId := make([]byte, 32)
+	var sharedSecret, sessionKey [32]byte
+	common.CryptoRandRead(sharedSecret[:])
+	common.CryptoRandRead(sessionKey[:])
+
+	// respond returns the ServerHello sent to the client
+	respond := func(tls *TLS) []byte {
+		serverConn, clientConn := net.Pipe()
+		go func() {
+			_, err := tls.makeResponder(sessionId, "", sharedSecret)(serverConn, sessionKey, rand.Reader)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		buf := make([]byte, 4096)
+		conn := &common.TLSConn{Conn: clientConn}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+	decryptSessionKey := func(sh []byte, keyExchange []byte, secret [32]byte) []byte {
+		encrypted := append(append([]byte{}, sh[6:38]...), keyExchange...)
+		key, err := common.AESGCMDecrypt(encrypted[0:12], secret[:], encrypted[12:60])
+		if err != nil {
+			t.Fatalf("failed to decrypt session key: %v", err)
+		}
+		return key
+	}
+
+	t.Run("x25519", func(t *testing.T) {
+		sh := respond(&TLS{})
+		if !bytes.Equal(decryptSessionKey(sh, sh[84:116], sharedSecret), sessionKey[:]) {
+			t.Error("wrong session key")
+		}
+	})
+	t.Run("single record", func(t *testing.T) {
+		// the length of the record after the ServerHello and ChangeCipherSpec
+		recordLength := func(tls *TLS) int {
+			serverConn, clientConn := net.Pipe()
+			go func() {
+				_, err := tls.makeResponder(sessionId, "", sharedSecret)(serverConn, sessionKey, rand.Reader)
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+			conn := &common.TLSConn{Conn: clientConn}
+			buf := make([]byte, appDataMaxLength)
+			var n int
+			for i := 0; i < 3; i++ {
+				var err error
+				n, err = conn.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			return n
+		}
+		if n := recordLength(&TLS{recordLength: [2]int{500, 500}}); n != 500 {
+			t.Errorf("expecting a record of 500 bytes, got %v", n)
+		}
+		if n := recordLength(&TLS{}); n < defaultRecordLength[0] || n > defaultRecordLength[1] {
+			t.Errorf("expecting a record of %v bytes, got %v", defaultRecordLength, n)
+		}
+		if n := recordLength(&TLS{coalesced: []int{1234}, recordLength: [2]int{500, 500}}); n != 1234 {
+			t.Errorf("expecting the coalesced transcript of 1234 bytes, got %v", n)
+		}
+		// it's the same for every connection of the session
+		if recordLength(&TLS{recordLength: [2]int{100, 10000}}) != recordLength(&TLS{recordLength: [2]int{100, 10000}}) {
+			t.Error("record length changes within a session")
+		}
+	})
+	t.Run("X25519MLKEM768", func(t *testing.T) {
+		dk, _ := ecdh.GenerateMLKEMKey(rand.Reader)
+		sh := respond(&TLS{mlkemKeyShare: dk.EncapsulationKey().Bytes()})
+		if !bytes.Equal(sh[80:82], x25519MLKEM768Group[:]) {
+			t.Fatalf("expecting an X25519MLKEM768 key share, got %x", sh[80:82])
+		}
+		mlkemSecret, err := dk.Decapsulate(sh[84 : 84+ecdh.MLKEMCiphertextSize])
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyExchange := sh[84+ecdh.MLKEMCiphertextSize : 84+ecdh.MLKEMCiphertextSize+32]
+		hybridSecret := ecdh.HybridSharedSecret(sharedSecret[:], mlkemSecret)
+		if !bytes.Equal(decryptSessionKey(sh, keyExchange, hybridSecret), sessionKey[:]) {
+			t.Error("wrong session key")
+		}
+		if _, err := common.AESGCMDecrypt(sh[6:18], sharedSecret[:], append(append([]byte{}, sh[18:38]...), keyExchange[:28]...)); err == nil {
+			t.Error("session key can be decrypted with the x25519 secret alone")
+		}
+	})
+	t.Run("session tickets", func(t *testing.T) {
+		// the records after the ServerHello and ChangeCipherSpec, as many as the record count hint says
+		flight := func(tls *TLS) (sh []byte, records []int) {
+			serverConn, clientConn := net.Pipe()
+			go func() {
+				_, err := tls.makeResponder(sessionId, "", sharedSecret)(serverConn, sessionKey, rand.Reader)
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+			conn := &common.TLSConn{Conn: clientConn}
+			buf := make([]byte, 4096)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sh = append([]byte{}, buf[:n]...)
+			count := 0
+			for n := 1; n <= common.MaxTranscriptRecords; n++ {
+				if bytes.Equal(sh[112:116], common.RecordCountHint(sharedSecret[:], n)) {
+					count = n
+				}
+			}
+			for i := 0; i < 1+count; i++ {
+				n, err := conn.Read(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if i > 0 {
+					records = append(records, n)
+				}
+			}
+			return
+		}
+		transcripts := map[string][][]int{"": {defaultTranscript}}
+		ticket := 200 + newSessionTicketOverhead
+
+		sh, records := flight(&TLS{transcripts: transcripts, ticketLength: 200})
+		expected := append(append([]int{}, defaultTranscript...), ticket, ticket)
+		if fmt.Sprint(records) != fmt.Sprint(expected) {
+			t.Errorf("expecting records of %v, got %v", expected, records)
+		}
+		if bytes.Contains(sh, []byte{0x00, 0x29, 0x00, 0x02, 0x00, 0x00}) {
+			t.Error("full handshake accepts a pre_shared_key")
+		}
+
+		sh, records = flight(&TLS{transcripts: transcripts, ticketLength: 200, resumes: true})
+		expected = []int{defaultTranscript[0], defaultTranscript[3], ticket, ticket}
+		if fmt.Sprint(records) != fmt.Sprint(expected) {
+			t.Errorf("expecting records of %v when resumed, got %v", expected, records)
+		}
+		if !bytes.HasSuffix(sh, []byte{0x00, 0x29, 0x00, 0x02, 0x00, 0x00}) {
+			t.Error("resumed handshake doesn't accept the pre_shared_key")
+		}
+
+		// tickets don't take the records past what a client reads
+		long := map[string][][]int{"": {{1, 2, 3, 4, 5, 6, 7}}}
+		_, records = flight(&TLS{transcripts: long, ticketLength: 200})
+		if len(records) != common.MaxTranscriptRecords {
+			t.Errorf("expecting %v records, got %v", common.MaxTranscriptRecords, records)
+		}
+	})
+}
+
+func TestTLS_chooseServerHello(t *testing.T) {
+	ch := &ClientHello{cipherSuites: []byte{0x8a, 0x8a, 0x13, 0x01, 0x13, 0x02, 0x13, 0x03}}
+	learnt := serverHelloTemplate{
+		cipherSuite: [2]byte{0x13, 0x02},
+		extensions:  [][2]byte{supportedVersionsExtensionType, keyShareExtensionType},
+	}
+	serverHellos := map[string]serverHelloTemplate{cipherSuitesKey(ch): learnt}
+
+	tests := map[string]struct {
+		tls      *TLS
+		ch       *ClientHello
+		expected serverHelloTemplate
+	}{
+		"nothing learnt": {&TLS{}, ch, serverHelloTemplate{cipherSuite: [2]byte{0x13, 0x01}}},
+		"learnt":         {&TLS{serverHellos: serverHellos}, ch, learnt},
+		"configured": {&TLS{serverHellos: serverHellos, cipherSuite: [2]byte{0x13, 0x03}}, ch,
+			serverHelloTemplate{cipherSuite: [2]byte{0x13, 0x03}, extensions: learnt.extensions}},
+		"configured but not offered": {&TLS{cipherSuite: [2]byte{0x13, 0x03}},
+			&ClientHello{cipherSuites: []byte{0x13, 0x02}}, serverHelloTemplate{cipherSuite: [2]byte{0x13, 0x02}}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.tls.chooseServerHello(test.ch); fmt.Sprint(got) != fmt.Sprint(test.expected) {
+				t.Errorf("expecting %x, got %x", test.expected, got)
+			}
+		})
+	}
+}
+
+// chromeClientHello returns the ClientHello of Chrome, with its record layer
+func chromeClientHello(t *testing.T) ([]byte, *ClientHello) {
+	uconn := utls.UClient(nil, &utls.Config{ServerName: "www.example.com"}, common.Parrots["chrome"])
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	clientHello := common.AddRecordLayer(append([]byte{}, uconn.HandshakeState.Hello.Raw...), common.Handshake, common.VersionTLS11)
+	ch, err := parseClientHello(clientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientHello, ch
+}
+
+func TestTLS_processFirstPacket_keyShareGroup(t *testing.T) {
+	// Chrome offers X25519MLKEM768
+	clientHello, ch := chromeClientHello(t)
+	pv, _, _ := ecdh.GenerateKey(rand.Reader)
+
+	for group, hybrid := range map[[2]byte]bool{{}: true, x25519MLKEM768Group: true, x25519Group: false} {
+		tls := &TLS{serverHellos: map[string]serverHelloTemplate{
+			cipherSuitesKey(ch): {cipherSuite: [2]byte{0x13, 0x01}, keyShareGroup: group},
+		}}
+		if _, _, err := tls.processFirstPacket(clientHello, []crypto.PrivateKey{pv}); err != nil {
+			t.Fatal(err)
+		}
+		if (tls.mlkemKeyShare != nil) != hybrid {
+			t.Errorf("learnt group %x: expecting the hybrid key exchange to be %v", group, hybrid)
+		}
+	}
+}
+
+func TestTLS_processFirstPacket_coalesced(t *testing.T) {
+	clientHello, ch := chromeClientHello(t)
+	pv, _, _ := ecdh.GenerateKey(rand.Reader)
+	tls := &TLS{transcripts: map[string][][]int{transcriptKey(ch): {{32, 2870, 281, 53}, {100, 200}}}}
+	if _, _, err := tls.processFirstPacket(clientHello, []crypto.PrivateKey{pv}); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(tls.coalesced) != fmt.Sprint([]int{3185, 283}) {
+		t.Errorf("expecting the transcripts in single records of 3185 and 283 bytes, got %v", tls.coalesced)
+	}
+}
+
+func TestCoalescedLength(t *testing.T) {
+	tests := map[int][]int{
+		53:               {53},
+		3185:             defaultTranscript,
+		appDataMaxLength: {16000, 16000},
+		2*100 - 17:       {100, 100},
+	}
+	for expected, transcript := range tests {
+		if got := coalescedLength(transcript); got != expected {
+			t.Errorf("%v: expecting %v, got %v", transcript, expected, got)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// Users can be suspended automatically when what they do looks like their UID is being abused, e.g. it has been
+// leaked. What users subject to credit controls do is told to each AbuseDetector, and the first to give a reason
+// suspends the user: its sessions are closed and new ones are refused as if the UID were unauthorised, until the
+// suspension runs out or is lifted through the admin API. Each suspension is logged and recorded as an event of the
+// admin API.
+//
+// The detectors in the configuration are
+//
+//   - impossible-travel: sessions from two countries within AbuseTravelWindow, which needs GeoIPDatabases
+//   - handshake-failures: AbuseHandshakeFailures sessions refused by the user manager in 10 minutes
+//   - quota-fraud: either credit overdrawn by more than AbuseOverdraft, which a user can only do by using its UID on
+//     several servers at once
+//
+// and more can be added with AddAbuseDetector
+
+// what users do
+const (
+	// a session was made
+	ACTIVITY_SESSION = iota + 1
+	// a session was refused by the user manager
+	ACTIVITY_REFUSED
+	// the credit of the user was read from the user manager
+	ACTIVITY_CREDIT
+)
+
+// the types of AbuseEvents
+const (
+	EVENT_SUSPENDED = "suspended"
+	EVENT_LIFTED    = "lifted"
+)
+
+// how many events are kept for the admin API
+const maxAbuseEvents = 1000
+
+// the window that AbuseHandshakeFailures is counted in
+const handshakeFailureWindow = 10 * time.Minute
+
+var ErrSuspended = errors.New("User suspended")
+
+// UserActivity is something a user did, which AbuseDetectors are told of
+type UserActivity struct {
+	Kind int
+	UID  []byte
+	Time time.Time
+	// where the session was made or refused from, nil for ACTIVITY_CREDIT
+	IP net.IP
+	// why the session was refused, for ACTIVITY_REFUSED
+	Err error
+	// the credit left, for ACTIVITY_CREDIT
+	UpCredit   int64
+	DownCredit int64
+}
+
+// AbuseDetector looks for patterns of abuse in what users do. It's told of activities from many goroutines at once
+type AbuseDetector interface {
+	// Name is what the suspensions it asks for are recorded as being by
+	Name() string
+	// Observe is told of an activity, returning why its user should be suspended, or an empty string if it shouldn't
+	Observe(activity UserActivity) string
+}
+
+// Suspension is a user that's been suspended
+type Suspension struct {
+	UID      []byte
+	Detector string
+	Reason   string
+	// the address of the activity that the user was suspended on, if it had one
+	IP    string
+	Since int64
+	// when the suspension runs out, 0 if it lasts until it's lifted
+	Until int64
+}
+
+// AbuseEvent is a user having been suspended, or its suspension having been lifted
+type AbuseEvent struct {
+	// increasing from 1
+	ID   uint64
+	Type string
+	Time int64
+	UID  []byte
+	// those of the suspension for EVENT_SUSPENDED
+	Detector string
+	Reason   string
+	IP       string
+}
+
+type abuseMonitor struct {
+	world common.WorldState
+	// 0 if suspensions last until they're lifted
+	suspendFor time.Duration
+	// closes the sessions of a suspended user
+	terminate func(UID []byte, reason string)
+
+	detectorsM sync.RWMutex
+	detectors  []AbuseDetector
+
+	m           sync.Mutex
+	suspensions map[[16]byte]Suspension
+	events      []AbuseEvent
+	lastEventID uint64
+}
+
+func newAbuseMonitor(detectors []AbuseDetector, suspendFor time.Duration, terminate func([]byte, string), world common.WorldState) *abuseMonitor {
+	return &abuseMonitor{
+		world:       world,
+		suspendFor:  suspendFor,
+		terminate:   terminate,
+		detectors:   detectors,
+		suspensions: make(map[[16]byte]Suspension),
+	}
+}
+
+// parseAbuseDetectors makes the detectors that AbuseTravelWindow, AbuseHandshakeFailures and AbuseOverdraft of
+// preParse ask for
+func parseAbuseDetectors(preParse RawConfig) ([]AbuseDetector, error) {
+	if preParse.AbuseTravelWindow < 0 || preParse.AbuseHandshakeFailures < 0 || preParse.AbuseOverdraft < 0 || preParse.AbuseSuspendFor < 0 {
+		return nil, errors.New("AbuseTravelWindow, AbuseHandshakeFailures, AbuseOverdraft and AbuseSuspendFor can't be negative")
+	}
+	var detectors []AbuseDetector
+	if preParse.AbuseTravelWindow > 0 {
+		if len(preParse.GeoIPDatabases) == 0 {
+			return nil, errors.New("AbuseTravelWindow needs GeoIPDatabases")
+		}
+		databases, err := openGeoIPDatabases(preParse.GeoIPDatabases)
+		if err != nil {
+			return nil, err
+		}
+		detectors = append(detectors, newTravelDetector(time.Duration(preParse.AbuseTravelWindow)*time.Second, databases))
+	}
+	if preParse.AbuseHandshakeFailures > 0 {
+		detectors = append(detectors, newHandshakeFailureDetector(preParse.AbuseHandshakeFailures, handshakeFailureWindow))
+	}
+	if preParse.AbuseOverdraft > 0 {
+		detectors = append(detectors, overdraftDetector{limit: preParse.AbuseOverdraft})
+	}
+	return detectors, nil
+}
+
+// AddAbuseDetector has d told of what users do from now on, alongside the detectors in the configuration
+func (sta *State) AddAbuseDetector(d AbuseDetector) {
+	sta.abuse.detectorsM.Lock()
+	sta.abuse.detectors = append(sta.abuse.detectors, d)
+	sta.abuse.detectorsM.Unlock()
+}
+
+// observe tells every detector of activity, suspending its user if any of them asks for it
+func (m *abuseMonitor) observe(activity UserActivity) {
+	if m == nil {
+		return
+	}
+	m.detectorsM.RLock()
+	detectors := m.detectors
+	m.detectorsM.RUnlock()
+	// every detector is told, so that those keeping track of users don't miss anything
+	var detector, reason string
+	for _, d := range detectors {
+		if r := d.Observe(activity); r != "" && reason == "" {
+			detector, reason = d.Name(), r
+		}
+	}
+	if reason != "" {
+		m.suspend(activity, detector, reason)
+	}
+}
+
+// suspend suspends the user of activity unless it already is, and closes its sessions
+func (m *abuseMonitor) suspend(activity UserActivity, detector string, reason string) {
+	UID := append([]byte(nil), activity.UID...)
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	now := m.world.Now()
+	s := Suspension{
+		UID:      UID,
+		Detector: detector,
+		Reason:   reason,
+		Since:    now.Unix(),
+	}
+	if activity.IP != nil {
+		s.IP = activity.IP.String()
+	}
+	if m.suspendFor > 0 {
+		s.Until = now.Add(m.suspendFor).Unix()
+	}
+
+	m.m.Lock()
+	if m.suspendedLocked(arrUID, now) {
+		m.m.Unlock()
+		return
+	}
+	m.suspensions[arrUID] = s
+	m.recordLocked(AbuseEvent{
+		Type:     EVENT_SUSPENDED,
+		Time:     s.Since,
+		UID:      UID,
+		Detector: detector,
+		Reason:   reason,
+		IP:       s.IP,
+	})
+	m.m.Unlock()
+
+	log.WithFields(log.Fields{
+		"UID":        b64(UID),
+		"remoteAddr": s.IP,
+		"detector":   detector,
+		"reason":     reason,
+		"until":      s.Until,
+	}).Warn("User suspended")
+	if m.terminate != nil {
+		// the user may be told of while the user panel is locked
+		go m.terminate(UID, ErrSuspended.Error())
+	}
+}
+
+func (m *abuseMonitor) recordLocked(event AbuseEvent) {
+	m.lastEventID++
+	event.ID = m.lastEventID
+	m.events = append(m.events, event)
+	if len(m.events) > maxAbuseEvents {
+		m.events = m.events[len(m.events)-maxAbuseEvents:]
+	}
+}
+
+// suspendedLocked is whether a user is suspended, forgetting its suspension if it has run out
+func (m *abuseMonitor) suspendedLocked(arrUID [16]byte, now time.Time) bool {
+	s, ok := m.suspensions[arrUID]
+	if !ok {
+		return false
+	}
+	if s.Until != 0 && now.Unix() >= s.Until {
+		delete(m.suspensions, arrUID)
+		return false
+	}
+	return true
+}
+
+// suspended is whether a user is suspended
+func (m *abuseMonitor) suspended(UID []byte) bool {
+	if m == nil {
+		return false
+	}
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.suspendedLocked(arrUID, m.world.Now())
+}
+
+// lift lifts the suspension of a user, returning whether it was suspended
+func (m *abuseMonitor) lift(UID []byte) bool {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	now := m.world.Now()
+	m.m.Lock()
+	if !m.suspendedLocked(arrUID, now) {
+		m.m.Unlock()
+		return false
+	}
+	delete(m.suspensions, arrUID)
+	m.recordLocked(AbuseEvent{Type: EVENT_LIFTED, Time: now.Unix(), UID: arrUID[:]})
+	m.m.Unlock()
+	log.WithField("UID", b64(arrUID[:])).Info("User suspension lifted")
+	return true
+}
+
+// suspensionList returns the users that are suspended
+func (m *abuseMonitor) suspensionList() []Suspension {
+	now := m.world.Now()
+	m.m.Lock()
+	defer m.m.Unlock()
+	list := make([]Suspension, 0, len(m.suspensions))
+	for arrUID, s := range m.suspensions {
+		if m.suspendedLocked(arrUID, now) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// eventsSince returns the events kept that came after the one with the ID since
+func (m *abuseMonitor) eventsSince(since uint64) []AbuseEvent {
+	m.m.Lock()
+	defer m.m.Unlock()
+	list := make([]AbuseEvent, 0)
+	for _, event := range m.events {
+		if event.ID > since {
+			list = append(list, event)
+		}
+	}
+	return list
+}
+
+// travelDetector suspends users whose sessions are made from two countries too soon after one another to have
+// travelled between them
+type travelDetector struct {
+	window    time.Duration
+	databases []geoLocator
+
+	m sync.Mutex
+	// the country each user last made a session from, and when
+	last map[[16]byte]sighting
+}
+
+type sighting struct {
+	country string
+	time    time.Time
+}
+
+func newTravelDetector(window time.Duration, databases []geoLocator) *travelDetector {
+	return &travelDetector{
+		window:    window,
+		databases: databases,
+		last:      make(map[[16]byte]sighting),
+	}
+}
+
+func (d *travelDetector) Name() string { return "impossible-travel" }
+
+func (d *travelDetector) Observe(activity UserActivity) string {
+	if activity.Kind != ACTIVITY_SESSION || activity.IP == nil {
+		return ""
+	}
+	var country string
+	for _, db := range d.databases {
+		if c, err := db.Country(activity.IP); err == nil && c != "" {
+			country = c
+			break
+		}
+	}
+	if country == "" {
+		return ""
+	}
+	var arrUID [16]byte
+	copy(arrUID[:], activity.UID)
+	d.m.Lock()
+	defer d.m.Unlock()
+	last, ok := d.last[arrUID]
+	d.last[arrUID] = sighting{country: country, time: activity.Time}
+	if !ok || last.country == country {
+		return ""
+	}
+	if elapsed := activity.Time.Sub(last.time); elapsed < d.window {
+		return fmt.Sprintf("sessions from %v and %v within %v", last.country, country, elapsed.Round(time.Second))
+	}
+	return ""
+}
+
+// handshakeFailureDetector suspends users that have too many sessions refused in a window, as a leaked UID that
+// has run out of credit or sessions would
+type handshakeFailureDetector struct {
+	limit  int
+	window time.Duration
+
+	m sync.Mutex
+	// when each user's recent sessions were refused
+	failures map[[16]byte][]time.Time
+}
+
+func newHandshakeFailureDetector(limit int, window time.Duration) *handshakeFailureDetector {
+	return &handshakeFailureDetector{
+		limit:    limit,
+		window:   window,
+		failures: make(map[[16]byte][]time.Time),
+	}
+}
+
+func (d *handshakeFailureDetector) Name() string { return "handshake-failures" }
+
+func (d *handshakeFailureDetector) Observe(activity UserActivity) string {
+	// there's nobody to suspend if the UID doesn't belong to a user
+	if activity.Kind != ACTIVITY_REFUSED || activity.Err == usermanager.ErrUserNotFound {
+		return ""
+	}
+	var arrUID [16]byte
+	copy(arrUID[:], activity.UID)
+	d.m.Lock()
+	defer d.m.Unlock()
+	recent := d.failures[arrUID][:0]
+	for _, t := range d.failures[arrUID] {
+		if activity.Time.Sub(t) < d.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, activity.Time)
+	if len(recent) < d.limit {
+		d.failures[arrUID] = recent
+		return ""
+	}
+	delete(d.failures, arrUID)
+	return fmt.Sprintf("%v sessions refused within %v, the last because %v", len(recent), d.window, activity.Err)
+}
+
+// overdraftDetector suspends users that have overdrawn their credit by more than limit
+type overdraftDetector struct {
+	limit int64
+}
+
+func (d overdraftDetector) Name() string { return "quota-fraud" }
+
+func (d overdraftDetector) Observe(activity UserActivity) string {
+	if activity.Kind != ACTIVITY_CREDIT {
+		return ""
+	}
+	if -activity.UpCredit > d.limit {
+		return fmt.Sprintf("UpCredit overdrawn by %v bytes", -activity.UpCredit)
+	}
+	if -activity.DownCredit > d.limit {
+		return fmt.Sprintf("DownCredit overdrawn by %v bytes", -activity.DownCredit)
+	}
+	return ""
+}
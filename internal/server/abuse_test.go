@@ -0,0 +1,205 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+func TestTravelDetector(t *testing.T) {
+	d := newTravelDetector(time.Hour, []geoLocator{fakeLocator{countries: map[string]string{
+		"192.0.2.1":    "GB",
+		"192.0.2.2":    "GB",
+		"198.51.100.1": "JP",
+	}}})
+	start := time.Unix(1000, 0)
+	session := func(ip string, after time.Duration) string {
+		return d.Observe(UserActivity{Kind: ACTIVITY_SESSION, UID: mockUID, Time: start.Add(after), IP: net.ParseIP(ip)})
+	}
+
+	if reason := session("192.0.2.1", 0); reason != "" {
+		t.Errorf("first session: expecting no suspension, got %v", reason)
+	}
+	if reason := session("192.0.2.2", time.Minute); reason != "" {
+		t.Errorf("same country: expecting no suspension, got %v", reason)
+	}
+	if reason := session("203.0.113.1", 2*time.Minute); reason != "" {
+		t.Errorf("unknown country: expecting no suspension, got %v", reason)
+	}
+	if reason := session("198.51.100.1", 3*time.Minute); !strings.Contains(reason, "GB and JP") {
+		t.Errorf("another country too soon: expecting a suspension, got %q", reason)
+	}
+	if reason := session("192.0.2.1", 3*time.Minute+2*time.Hour); reason != "" {
+		t.Errorf("another country later: expecting no suspension, got %v", reason)
+	}
+	if reason := d.Observe(UserActivity{Kind: ACTIVITY_REFUSED, UID: mockUID, Time: start, IP: net.ParseIP("198.51.100.1")}); reason != "" {
+		t.Errorf("refused session: expecting no suspension, got %v", reason)
+	}
+}
+
+func TestHandshakeFailureDetector(t *testing.T) {
+	d := newHandshakeFailureDetector(3, 10*time.Minute)
+	start := time.Unix(1000, 0)
+	refuse := func(after time.Duration, err error) string {
+		return d.Observe(UserActivity{Kind: ACTIVITY_REFUSED, UID: mockUID, Time: start.Add(after), Err: err})
+	}
+
+	refuse(0, usermanager.ErrNoUpCredit)
+	refuse(5*time.Minute, usermanager.ErrNoUpCredit)
+	// the first has fallen out of the window
+	if reason := refuse(11*time.Minute, usermanager.ErrNoUpCredit); reason != "" {
+		t.Errorf("expecting no suspension, got %v", reason)
+	}
+	if reason := refuse(11*time.Minute, usermanager.ErrUserNotFound); reason != "" {
+		t.Errorf("no such user: expecting no suspension, got %v", reason)
+	}
+	if reason := refuse(12*time.Minute, usermanager.ErrSessionsCapReached); reason == "" {
+		t.Error("expecting a suspension")
+	}
+	if reason := refuse(12*time.Minute, usermanager.ErrSessionsCapReached); reason != "" {
+		t.Errorf("failures are counted afresh after a suspension, got %v", reason)
+	}
+}
+
+func TestOverdraftDetector(t *testing.T) {
+	d := overdraftDetector{limit: 100}
+	for _, c := range []struct {
+		up, down int64
+		suspend  bool
+	}{
+		{10, 10, false},
+		{-100, 10, false},
+		{-101, 10, true},
+		{10, -1000, true},
+	} {
+		reason := d.Observe(UserActivity{Kind: ACTIVITY_CREDIT, UID: mockUID, UpCredit: c.up, DownCredit: c.down})
+		if (reason != "") != c.suspend {
+			t.Errorf("credit %v, %v: expecting suspension %v, got %q", c.up, c.down, c.suspend, reason)
+		}
+	}
+}
+
+// suspendOn suspends users on activities of a kind
+type suspendOn int
+
+func (s suspendOn) Name() string { return "test" }
+
+func (s suspendOn) Observe(activity UserActivity) string {
+	if activity.Kind == int(s) {
+		return "test reason"
+	}
+	return ""
+}
+
+func TestAbuseMonitor(t *testing.T) {
+	now := time.Unix(1000, 0)
+	world := common.WorldState{Now: func() time.Time { return now }}
+	terminated := make(chan string, 2)
+	m := newAbuseMonitor([]AbuseDetector{suspendOn(ACTIVITY_REFUSED)}, time.Hour, func(UID []byte, reason string) {
+		terminated <- reason
+	}, world)
+
+	m.observe(UserActivity{Kind: ACTIVITY_SESSION, UID: mockUID, Time: now})
+	if m.suspended(mockUID) {
+		t.Fatal("suspended without reason")
+	}
+	m.observe(UserActivity{Kind: ACTIVITY_REFUSED, UID: mockUID, Time: now, IP: net.ParseIP("192.0.2.1")})
+	if !m.suspended(mockUID) {
+		t.Fatal("not suspended")
+	}
+	select {
+	case reason := <-terminated:
+		if reason != ErrSuspended.Error() {
+			t.Errorf("expecting the user terminated for %v, got %v", ErrSuspended, reason)
+		}
+	case <-time.After(time.Second):
+		t.Error("the user wasn't terminated")
+	}
+
+	// already suspended
+	m.observe(UserActivity{Kind: ACTIVITY_REFUSED, UID: mockUID, Time: now})
+	list := m.suspensionList()
+	if len(list) != 1 || list[0].Detector != "test" || list[0].IP != "192.0.2.1" || list[0].Until != now.Add(time.Hour).Unix() {
+		t.Errorf("unexpected suspensions %+v", list)
+	}
+	events := m.eventsSince(0)
+	if len(events) != 1 || events[0].Type != EVENT_SUSPENDED || events[0].ID != 1 {
+		t.Errorf("unexpected events %+v", events)
+	}
+
+	now = now.Add(time.Hour)
+	if m.suspended(mockUID) {
+		t.Error("the suspension didn't run out")
+	}
+	if m.lift(mockUID) {
+		t.Error("lifted a suspension that had run out")
+	}
+
+	m.observe(UserActivity{Kind: ACTIVITY_REFUSED, UID: mockUID, Time: now})
+	if !m.lift(mockUID) || m.suspended(mockUID) {
+		t.Error("the suspension wasn't lifted")
+	}
+	events = m.eventsSince(1)
+	if len(events) != 2 || events[0].Type != EVENT_SUSPENDED || events[1].Type != EVENT_LIFTED || events[1].ID != 3 {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestParseAbuseDetectors(t *testing.T) {
+	detectors, err := parseAbuseDetectors(RawConfig{})
+	if err != nil || len(detectors) != 0 {
+		t.Errorf("expecting no detectors, got %v, %v", detectors, err)
+	}
+	detectors, err = parseAbuseDetectors(RawConfig{AbuseHandshakeFailures: 20, AbuseOverdraft: 1 << 30})
+	if err != nil || len(detectors) != 2 {
+		t.Errorf("expecting two detectors, got %v, %v", detectors, err)
+	}
+	if _, err = parseAbuseDetectors(RawConfig{AbuseTravelWindow: 3600}); err == nil {
+		t.Error("AbuseTravelWindow without GeoIPDatabases should fail")
+	}
+	if _, err = parseAbuseDetectors(RawConfig{AbuseSuspendFor: -1}); err == nil {
+		t.Error("negative AbuseSuspendFor should fail")
+	}
+}
+
+func TestAdminAPI_Suspensions(t *testing.T) {
+	sta := makeAdminAPIState(t, "127.0.0.1:0")
+	handler := AdminAPIHandler(sta)
+	sta.AddAbuseDetector(suspendOn(ACTIVITY_REFUSED))
+	sta.abuse.observe(UserActivity{Kind: ACTIVITY_REFUSED, UID: mockUID, Time: mockWorldState.Now()})
+
+	rec := adminRequest(handler, "GET", "/v2/suspensions", "")
+	var suspensions []Suspension
+	if err := json.NewDecoder(rec.Body).Decode(&suspensions); err != nil {
+		t.Fatal(err)
+	}
+	if len(suspensions) != 1 || string(suspensions[0].UID) != string(mockUID) || suspensions[0].Until != 0 {
+		t.Errorf("unexpected suspensions %+v", suspensions)
+	}
+
+	path := "/v2/suspensions/" + base64.URLEncoding.EncodeToString(mockUID)
+	if rec = adminRequest(handler, "DELETE", path, ""); rec.Code != 200 {
+		t.Errorf("lifting: expecting status 200, got %v", rec.Code)
+	}
+	if rec = adminRequest(handler, "DELETE", path, ""); rec.Code != 404 {
+		t.Errorf("lifting again: expecting status 404, got %v", rec.Code)
+	}
+
+	rec = adminRequest(handler, "GET", "/v2/events?since=1", "")
+	var events []AbuseEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Type != EVENT_LIFTED {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if rec = adminRequest(handler, "GET", "/v2/events?since=x", ""); rec.Code != 400 {
+		t.Errorf("bad since: expecting status 400, got %v", rec.Code)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// With ACMEDomains, the certificate to terminate TLS with is obtained from Let's Encrypt (or the CA at
+// ACMEDirectoryURL) when it's first needed, and renewed before it expires. The CA validates the domain either with a
+// TLS-ALPN-01 challenge, which is answered in the TLS handshake on a BindAddr on port 443, or with an HTTP-01
+// challenge, which is answered on a BindAddr on port 80. The account key and certificates are kept in StateDir
+
+var ErrNoStateDir = errors.New("StateDir must be set to keep the certificates from ACME in")
+
+var acmeChallengePrefix = []byte("GET /.well-known/acme-challenge/")
+
+func newACMEManager(raw RawConfig) (*autocert.Manager, error) {
+	if raw.StateDir == "" {
+		return nil, ErrNoStateDir
+	}
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(filepath.Join(raw.StateDir, "acme")),
+		HostPolicy: autocert.HostWhitelist(raw.ACMEDomains...),
+		Email:      raw.ACMEEmail,
+	}
+	if raw.ACMEDirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: raw.ACMEDirectoryURL}
+	}
+	return manager, nil
+}
+
+// isACMEChallenge checks if the first packet is an HTTP-01 challenge request from the CA
+func isACMEChallenge(firstPacket []byte, sta *State) bool {
+	return sta.acme != nil && bytes.HasPrefix(firstPacket, acmeChallengePrefix)
+}
+
+// serveACMEChallenge answers an HTTP-01 challenge on conn, whose first packet has already been read
+func serveACMEChallenge(conn net.Conn, firstPacket []byte, sta *State) {
+	log.WithField("remoteAddr", conn.RemoteAddr()).Debug("answering ACME HTTP-01 challenge")
+	challenge := sta.acme.HTTPHandler(nil)
+	http.Serve(newWsAcceptor(conn, firstPacket), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the connection isn't kept alive, so that whatever comes after the challenge goes to the cover site
+		w.Header().Set("Connection", "close")
+		challenge.ServeHTTP(w, r)
+	}))
+}
+
+// getRealTLSCertificate returns the certificate from ACME for the domains in ACMEDomains, and the one in TLSCert for
+// everything else
+func (sta *State) getRealTLSCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	static := sta.realTLSCertificate()
+	if sta.acme != nil {
+		cert, err := sta.acme.GetCertificate(hello)
+		if err == nil || static == nil {
+			return cert, err
+		}
+		log.Debugf("falling back to TLSCert for %v: %v", hello.ServerName, err)
+	}
+	return static, nil
+}
+
+// terminatesTLS checks if there's a real certificate to terminate TLS with
+func (sta *State) terminatesTLS() bool {
+	return sta.acme != nil || sta.realTLSCertificate() != nil
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"golang.org/x/crypto/acme"
+
+	"github.com/cbeuw/Cloak/internal/test"
+)
+
+func TestInitState_ACME(t *testing.T) {
+	t.Run("without StateDir", func(t *testing.T) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		_, err := InitState(RawConfig{
+			DatabasePath: tmpDB.Name(),
+			RedirAddr:    "127.0.0.1:9999",
+			ACMEDomains:  []string{"cloak.example.com"},
+		}, mockWorldState)
+		if err != ErrNoStateDir {
+			t.Errorf("expecting %v, got %v", ErrNoStateDir, err)
+		}
+	})
+
+	t.Run("with TLSCert as fallback", func(t *testing.T) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		certPath, keyPath, _ := test.WriteSelfSignedCert(t, t.TempDir())
+		sta, err := InitState(RawConfig{
+			DatabasePath: tmpDB.Name(),
+			RedirAddr:    "127.0.0.1:9999",
+			ACMEDomains:  []string{"cloak.example.com"},
+			StateDir:     t.TempDir(),
+			TLSCert:      certPath,
+			TLSKey:       keyPath,
+		}, mockWorldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sta.Panel.Manager.(interface{ Close() error }).Close()
+		if !sta.terminatesTLS() {
+			t.Error("TLS isn't terminated with ACME")
+		}
+		hasALPN := false
+		for _, proto := range sta.realTLS.NextProtos {
+			hasALPN = hasALPN || proto == acme.ALPNProto
+		}
+		if !hasALPN {
+			t.Errorf("%v isn't offered for TLS-ALPN-01 challenges", acme.ALPNProto)
+		}
+		// a domain that isn't in ACMEDomains
+		cert, err := sta.getRealTLSCertificate(&tls.ClientHelloInfo{ServerName: "www.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert != sta.realTLSCertificate() {
+			t.Error("TLSCert isn't used for a domain that isn't in ACMEDomains")
+		}
+	})
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("decoy"))
+	}))
+	defer web.Close()
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	sta, err := InitState(RawConfig{
+		DatabasePath: tmpDB.Name(),
+		RedirAddr:    web.Listener.Addr().String(),
+		ACMEDomains:  []string{"cloak.example.com"},
+		StateDir:     t.TempDir(),
+	}, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ckL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckL.Close()
+	go func() {
+		for {
+			conn, err := ckL.Accept()
+			if err != nil {
+				return
+			}
+			go dispatchConnection(conn, sta, nil)
+		}
+	}()
+
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest("GET", "http://"+ckL.Addr().String()+path, nil)
+		req.Host = "cloak.example.com"
+		resp, err := http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("challenge", func(t *testing.T) {
+		// there's no such token, but it's answered by ACME rather than the cover site
+		status, body := get("/.well-known/acme-challenge/token")
+		if body == "decoy" || status != http.StatusNotFound {
+			t.Errorf("expecting status 404 from ACME, got %v %q", status, body)
+		}
+	})
+	t.Run("other path", func(t *testing.T) {
+		_, body := get("/index.html")
+		if body != "decoy" {
+			t.Errorf("expecting response from decoy, got %q", body)
+		}
+	})
+}
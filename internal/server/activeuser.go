@@ -2,7 +2,10 @@ package server
 
 import (
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
 )
@@ -18,6 +21,37 @@ type ActiveUser struct {
 
 	sessionsM sync.RWMutex
 	sessions  map[uint32]*mux.Session
+	// the IP address each session was made from
+	sessionIPs map[uint32]string
+	// how each session was made, for inspecting it
+	sessionDetails map[uint32]sessionDetail
+
+	// userLimits, not set for bypass users
+	limits atomic.Value
+}
+
+// userLimits is the credit and expiry of a user as of when they were last read from the UserManager
+type userLimits struct {
+	upCredit, downCredit int64
+	expiryTime           int64
+}
+
+// sessionDetail is how a session was made, beyond the IP address it was made from
+type sessionDetail struct {
+	transport        string
+	encryptionMethod byte
+	proxyMethod      string
+	opened           time.Time
+}
+
+// the reasons given to clients for the messages users are terminated with
+var closeReasons = map[string]byte{
+	usermanager.ErrUserExpired.Error():  mux.CLOSE_EXPIRED,
+	usermanager.ErrNoUpCredit.Error():   mux.CLOSE_NO_CREDIT,
+	usermanager.ErrNoDownCredit.Error(): mux.CLOSE_NO_CREDIT,
+	userDeletedMsg:                      mux.CLOSE_KICKED,
+	kickedMsg:                           mux.CLOSE_KICKED,
+	ErrSuspended.Error():                mux.CLOSE_KICKED,
 }
 
 // CloseSession closes a session and removes its reference from the user
@@ -25,7 +59,10 @@ func (u *ActiveUser) CloseSession(sessionID uint32, reason string) {
 	u.sessionsM.Lock()
 	sesh, existing := u.sessions[sessionID]
 	if existing {
+		u.unshare(map[uint32]string{sessionID: u.sessionIPs[sessionID]})
 		delete(u.sessions, sessionID)
+		delete(u.sessionIPs, sessionID)
+		delete(u.sessionDetails, sessionID)
 		sesh.SetTerminalMsg(reason)
 		sesh.Close()
 	}
@@ -37,16 +74,24 @@ func (u *ActiveUser) CloseSession(sessionID uint32, reason string) {
 }
 
 // GetSession returns the reference to an existing session, or if one such session doesn't exist, it queries
-// the UserManager for the authorisation for a new session. If a new session is allowed, it creates this new session
-// and returns its reference
-func (u *ActiveUser) GetSession(sessionID uint32, config mux.SessionConfig) (sesh *mux.Session, existing bool, err error) {
+// the UserManager for the authorisation for a new session for proxyMethod from sourceIP. If a new session is
+// allowed, it creates this new session and returns its reference
+func (u *ActiveUser) GetSession(sessionID uint32, proxyMethod string, sourceIP string, config mux.SessionConfig) (sesh *mux.Session, existing bool, err error) {
 	u.sessionsM.Lock()
 	defer u.sessionsM.Unlock()
 	if sesh = u.sessions[sessionID]; sesh != nil {
 		return sesh, true, nil
 	} else {
 		if !u.bypass {
-			ainfo := usermanager.AuthorisationInfo{NumExistingSessions: len(u.sessions)}
+			ainfo := usermanager.AuthorisationInfo{
+				NumExistingSessions: len(u.sessions),
+				ProxyMethod:         proxyMethod,
+				SourceIP:            sourceIP,
+				ExistingSourceIPs:   u.sourceIPsLocked(),
+			}
+			if u.panel.cluster != nil {
+				u.panel.cluster.addRemoteSessions(u.arrUID, &ainfo)
+			}
 			err := u.panel.Manager.AuthoriseNewSession(u.arrUID[:], ainfo)
 			if err != nil {
 				return nil, false, err
@@ -55,24 +100,143 @@ func (u *ActiveUser) GetSession(sessionID uint32, config mux.SessionConfig) (ses
 		config.Valve = u.valve
 		sesh = mux.MakeSession(sessionID, config)
 		u.sessions[sessionID] = sesh
+		u.sessionIPs[sessionID] = sourceIP
+		if u.panel.cluster != nil && !u.bypass {
+			u.panel.cluster.logError(u.arrUID, u.panel.cluster.keep(u.arrUID, map[uint32]string{sessionID: sourceIP}))
+		}
 		return sesh, false, nil
 	}
 }
 
+// sourceIPsLocked returns the IP addresses the sessions were made from, each once and in ascending order. sessionsM
+// must be held
+func (u *ActiveUser) sourceIPsLocked() []string {
+	seen := make(map[string]struct{})
+	ips := make([]string, 0, len(u.sessionIPs))
+	for _, ip := range u.sessionIPs {
+		if _, ok := seen[ip]; !ok {
+			seen[ip] = struct{}{}
+			ips = append(ips, ip)
+		}
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+// sourceIPs returns the IP addresses the sessions were made from, each once and in ascending order
+func (u *ActiveUser) sourceIPs() []string {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	return u.sourceIPsLocked()
+}
+
+// unshare unregisters sessions from the other nodes, if there are any
+func (u *ActiveUser) unshare(sessionIPs map[uint32]string) {
+	if u.panel.cluster != nil && !u.bypass {
+		u.panel.cluster.logError(u.arrUID, u.panel.cluster.drop(u.arrUID, sessionIPs))
+	}
+}
+
 // closeAllSessions closes all sessions of this active user
 func (u *ActiveUser) closeAllSessions(reason string) {
 	u.sessionsM.Lock()
+	u.unshare(u.sessionIPs)
 	for sessionID, sesh := range u.sessions {
 		sesh.SetTerminalMsg(reason)
-		sesh.Close()
+		sesh.CloseFor(closeReasons[reason])
 		delete(u.sessions, sessionID)
+		delete(u.sessionIPs, sessionID)
+		delete(u.sessionDetails, sessionID)
 	}
 	u.sessionsM.Unlock()
 }
 
+// hasSession returns whether the session of sessionID is active
+func (u *ActiveUser) hasSession(sessionID uint32) bool {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	_, ok := u.sessions[sessionID]
+	return ok
+}
+
+// drainSessions tells the clients of all sessions of this active user that the server is draining
+func (u *ActiveUser) drainSessions() {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	for _, sesh := range u.sessions {
+		sesh.Drain()
+	}
+}
+
 // NumSession returns the number of active sessions
 func (u *ActiveUser) NumSession() int {
 	u.sessionsM.RLock()
 	defer u.sessionsM.RUnlock()
 	return len(u.sessions)
 }
+
+// sessionIDs returns the IDs of active sessions in ascending order
+func (u *ActiveUser) sessionIDs() []uint32 {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	ids := make([]uint32, 0, len(u.sessions))
+	for id := range u.sessions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// buffered returns how many bytes each active session holds in memory
+func (u *ActiveUser) buffered() map[uint32]mux.BufferedBytes {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	ret := make(map[uint32]mux.BufferedBytes, len(u.sessions))
+	for id, sesh := range u.sessions {
+		ret[id] = sesh.Buffered()
+	}
+	return ret
+}
+
+// describeSession records how the session of sessionID was made, if it's still active
+func (u *ActiveUser) describeSession(sessionID uint32, detail sessionDetail) {
+	u.sessionsM.Lock()
+	defer u.sessionsM.Unlock()
+	if _, ok := u.sessions[sessionID]; ok {
+		u.sessionDetails[sessionID] = detail
+	}
+}
+
+// sessionInfo returns the session of sessionID as of now, and whether it's active
+func (u *ActiveUser) sessionInfo(sessionID uint32, now time.Time) (SessionInfo, bool) {
+	u.sessionsM.RLock()
+	defer u.sessionsM.RUnlock()
+	sesh, ok := u.sessions[sessionID]
+	if !ok {
+		return SessionInfo{}, false
+	}
+	info := SessionInfo{
+		SessionID: sessionID,
+		SourceIP:  u.sessionIPs[sessionID],
+		Buffered:  sesh.Buffered(),
+		Streams:   sesh.Streams(),
+	}
+	if detail, ok := u.sessionDetails[sessionID]; ok {
+		info.Transport = detail.transport
+		info.EncryptionMethod = mux.EncryptionMethodName(detail.encryptionMethod)
+		info.ProxyMethod = detail.proxyMethod
+		info.Uptime = int64(now.Sub(detail.opened) / time.Second)
+	}
+	return info, true
+}
+
+// closeStream closes a stream of the session of sessionID
+func (u *ActiveUser) closeStream(sessionID uint32, streamID uint32) error {
+	u.sessionsM.RLock()
+	sesh, ok := u.sessions[sessionID]
+	u.sessionsM.RUnlock()
+	if !ok {
+		return errNoSuchSession
+	}
+	return sesh.CloseStream(streamID)
+}
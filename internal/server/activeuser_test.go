@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func getSeshConfig(unordered bool) mux.SessionConfig {
@@ -32,7 +33,7 @@ func TestActiveUser_Bypass(t *testing.T) {
 	if err != nil {
 		t.Fatal("failed to make local manager", err)
 	}
-	panel := MakeUserPanel(manager)
+	panel := MakeUserPanel(manager, common.RealWorldState)
 	UID, _ := base64.StdEncoding.DecodeString("u97xvcc5YoQA8obCyt9q/w==")
 	user, _ := panel.GetBypassUser(UID)
 	var sesh0 *mux.Session
@@ -40,7 +41,7 @@ func TestActiveUser_Bypass(t *testing.T) {
 	var sesh1 *mux.Session
 
 	// get first session
-	sesh0, existing, err = user.GetSession(0, getSeshConfig(false))
+	sesh0, existing, err = user.GetSession(0, "shadowsocks", "", getSeshConfig(false))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -52,7 +53,7 @@ func TestActiveUser_Bypass(t *testing.T) {
 	}
 
 	// get first session again
-	seshx, existing, err := user.GetSession(0, mux.SessionConfig{})
+	seshx, existing, err := user.GetSession(0, "shadowsocks", "", mux.SessionConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,7 +68,7 @@ func TestActiveUser_Bypass(t *testing.T) {
 	}
 
 	// get second session
-	sesh1, existing, err = user.GetSession(1, getSeshConfig(false))
+	sesh1, existing, err = user.GetSession(1, "shadowsocks", "", getSeshConfig(false))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -96,7 +97,7 @@ func TestActiveUser_Bypass(t *testing.T) {
 	}
 
 	// get session again after termination
-	seshy, existing, err := user.GetSession(0, getSeshConfig(false))
+	seshy, existing, err := user.GetSession(0, "shadowsocks", "", getSeshConfig(false))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -120,3 +121,51 @@ func TestActiveUser_Bypass(t *testing.T) {
 		t.Fatal("failed to close localmanager", err)
 	}
 }
+
+func TestActiveUser_SourceIPs(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), common.RealWorldState)
+	if err != nil {
+		t.Fatal("failed to make local manager", err)
+	}
+	defer manager.Close()
+	UID, _ := base64.StdEncoding.DecodeString("u97xvcc5YoQA8obCyt9q/w==")
+	err = manager.WriteUserInfo(usermanager.UserInfo{
+		UID:          UID,
+		SessionsCap:  10,
+		UpRate:       1e6,
+		DownRate:     1e6,
+		UpCredit:     1e9,
+		DownCredit:   1e9,
+		ExpiryTime:   time.Now().Add(time.Hour).Unix(),
+		MaxSourceIPs: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(manager, common.RealWorldState)
+	user, err := panel.GetUser(UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+		if _, _, err = user.GetSession(uint32(i), "shadowsocks", ip, getSeshConfig(false)); err != nil {
+			t.Fatalf("session %v from %v: %v", i, ip, err)
+		}
+	}
+	if _, _, err = user.GetSession(3, "shadowsocks", "192.0.2.3", getSeshConfig(false)); err != usermanager.ErrSourceIPsCapReached {
+		t.Errorf("expecting %v, got %v", usermanager.ErrSourceIPsCapReached, err)
+	}
+	if ips := user.sourceIPs(); len(ips) != 2 || ips[0] != "192.0.2.1" || ips[1] != "192.0.2.2" {
+		t.Errorf("wrong source IPs %v", ips)
+	}
+
+	// the address is freed once none of its sessions are left
+	user.CloseSession(1, "")
+	if _, _, err = user.GetSession(3, "shadowsocks", "192.0.2.3", getSeshConfig(false)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// The admin API v2 is served on AdminAPIAddr, separately from Cloak connections, so that it can be used without going
+// through a Cloak client in admin mode. Every request must carry the token in AdminAPIToken as
+//
+//	Authorization: Bearer <AdminAPIToken>
+//
+// UIDs in paths are in URL safe base64, and everything is returned in JSON. It's documented in
+// usermanager/api_v2.yaml
+
+// what users are terminated with when they're deleted or kicked through the admin API
+const (
+	userDeletedMsg = "User deleted"
+	kickedMsg      = "Kicked by admin"
+)
+
+var ErrNoAdminAPIToken = errors.New("AdminAPIToken must be set to serve the admin API")
+var errNoSuchSession = errors.New("no such session")
+
+// userInfoPatch is the fields of a UserInfo to be changed, the others are left untouched
+type userInfoPatch struct {
+	SessionsCap *int32
+	UpRate      *int64
+	DownRate    *int64
+	UpCredit    *int64
+	DownCredit  *int64
+	ExpiryTime  *int64
+	// an empty list lets the user use any proxy method
+	ProxyMethods *[]string
+	MaxSourceIPs *int32
+}
+
+func (p userInfoPatch) apply(uinfo *usermanager.UserInfo) {
+	if p.SessionsCap != nil {
+		uinfo.SessionsCap = *p.SessionsCap
+	}
+	if p.UpRate != nil {
+		uinfo.UpRate = *p.UpRate
+	}
+	if p.DownRate != nil {
+		uinfo.DownRate = *p.DownRate
+	}
+	if p.UpCredit != nil {
+		uinfo.UpCredit = *p.UpCredit
+	}
+	if p.DownCredit != nil {
+		uinfo.DownCredit = *p.DownCredit
+	}
+	if p.ExpiryTime != nil {
+		uinfo.ExpiryTime = *p.ExpiryTime
+	}
+	if p.ProxyMethods != nil {
+		uinfo.ProxyMethods = *p.ProxyMethods
+	}
+	if p.MaxSourceIPs != nil {
+		uinfo.MaxSourceIPs = *p.MaxSourceIPs
+	}
+}
+
+// ActiveUserInfo is a user with at least one live session
+type ActiveUserInfo struct {
+	UID        []byte
+	Bypass     bool
+	SessionIDs []uint32
+	// the IP addresses its sessions were made from
+	SourceIPs []string
+	// how many bytes each session holds in memory, by session ID
+	Buffered map[uint32]mux.BufferedBytes
+}
+
+// SessionInfo is a live session of a user and the streams open in it
+type SessionInfo struct {
+	SessionID        uint32
+	SourceIP         string
+	Transport        string
+	EncryptionMethod string
+	ProxyMethod      string
+	// seconds since the session was made
+	Uptime   int64
+	Buffered mux.BufferedBytes
+	Streams  []mux.StreamInfo
+}
+
+type adminAPI struct {
+	sta *State
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct{ Error string }{err.Error()})
+}
+
+func (api *adminAPI) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), api.sta.adminAPIToken) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func pathUID(r *http.Request) ([]byte, error) {
+	UID, err := base64.URLEncoding.DecodeString(gmux.Vars(r)["UID"])
+	if err != nil {
+		return nil, err
+	}
+	if len(UID) != 16 {
+		return nil, errors.New("UID must be 16 bytes")
+	}
+	return UID, nil
+}
+
+// pathSession returns the active user and the ID of the session in the path
+func (api *adminAPI) pathSession(r *http.Request) (*ActiveUser, uint32, error) {
+	UID, err := pathUID(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	sessionID, err := strconv.ParseUint(gmux.Vars(r)["SessionID"], 10, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+	return api.sta.Panel.activeUser(UID), uint32(sessionID), nil
+}
+
+func (api *adminAPI) listUsersHlr(w http.ResponseWriter, r *http.Request) {
+	infos, err := api.sta.Panel.Manager.ListAllUsers()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if infos == nil {
+		infos = []usermanager.UserInfo{}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (api *adminAPI) getUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, err := pathUID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	uinfo, err := api.sta.Panel.Manager.GetUserInfo(UID)
+	if err == usermanager.ErrUserNotFound {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, uinfo)
+}
+
+// putUserHlr creates a user, or replaces all of its UserInfo if it exists
+func (api *adminAPI) putUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, err := pathUID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var uinfo usermanager.UserInfo
+	err = json.NewDecoder(r.Body).Decode(&uinfo)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	uinfo.UID = UID
+	err = api.sta.Panel.Manager.WriteUserInfo(uinfo)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// a new credit or expiry is enforced on an active user from now on
+	api.sta.Panel.refreshUser(UID)
+	writeJSON(w, http.StatusOK, uinfo)
+}
+
+// patchUserHlr changes some fields of an existing user, e.g. to top up its credit or extend its expiry
+func (api *adminAPI) patchUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, err := pathUID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	var patch userInfoPatch
+	err = json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	uinfo, err := api.sta.Panel.Manager.GetUserInfo(UID)
+	if err == usermanager.ErrUserNotFound {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	patch.apply(&uinfo)
+	err = api.sta.Panel.Manager.WriteUserInfo(uinfo)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// a new credit or expiry is enforced on an active user from now on
+	api.sta.Panel.refreshUser(UID)
+	writeJSON(w, http.StatusOK, uinfo)
+}
+
+// deleteUserHlr deletes a user and closes its sessions
+func (api *adminAPI) deleteUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, err := pathUID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	_, err = api.sta.Panel.Manager.GetUserInfo(UID)
+	if err == usermanager.ErrUserNotFound {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	err = api.sta.Panel.Manager.DeleteUser(UID)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	api.sta.Panel.kick(UID, userDeletedMsg)
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (api *adminAPI) listSessionsHlr(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.sta.Panel.activeUserInfos())
+}
+
+func (api *adminAPI) getSessionHlr(w http.ResponseWriter, r *http.Request) {
+	user, sessionID, err := api.pathSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if user == nil {
+		writeJSONError(w, http.StatusNotFound, errNoSuchSession)
+		return
+	}
+	info, ok := user.sessionInfo(sessionID, api.sta.WorldState.Now())
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errNoSuchSession)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// closeSessionHlr closes a session of a user. Its client may make another
+func (api *adminAPI) closeSessionHlr(w http.ResponseWriter, r *http.Request) {
+	user, sessionID, err := api.pathSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if user == nil || !user.hasSession(sessionID) {
+		writeJSONError(w, http.StatusNotFound, errNoSuchSession)
+		return
+	}
+	user.CloseSession(sessionID, kickedMsg)
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// closeStreamHlr closes a stream of a session, which the client sees as closed by the other end
+func (api *adminAPI) closeStreamHlr(w http.ResponseWriter, r *http.Request) {
+	user, sessionID, err := api.pathSession(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	streamID, err := strconv.ParseUint(gmux.Vars(r)["StreamID"], 10, 32)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if user == nil {
+		writeJSONError(w, http.StatusNotFound, errNoSuchSession)
+		return
+	}
+	err = user.closeStream(sessionID, uint32(streamID))
+	if errors.Is(err, errNoSuchSession) || errors.Is(err, mux.ErrNoSuchStream) {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// kickUserHlr closes all sessions of a user. It may connect again unless it's also deleted or expired
+func (api *adminAPI) kickUserHlr(w http.ResponseWriter, r *http.Request) {
+	UID, err := pathUID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !api.sta.Panel.kick(UID, kickedMsg) {
+		writeJSONError(w, http.StatusNotFound, errors.New("user isn't active"))
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// UserTrafficInfo is the traffic of a user since ck-server started
+type UserTrafficInfo struct {
+	UID  []byte
+	Up   int64
+	Down int64
+}
+
+// trafficHlr returns the traffic of users subject to bandwidth and credit controls, from which the dashboard
+// calculates their bandwidth
+func (api *adminAPI) trafficHlr(w http.ResponseWriter, r *http.Request) {
+	traffic := api.sta.Panel.Traffic()
+	infos := make([]UserTrafficInfo, 0, len(traffic))
+	for arrUID, total := range traffic {
+		UID := arrUID
+		infos = append(infos, UserTrafficInfo{UID: UID[:], Up: total.Up, Down: total.Down})
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+// listSuspensionsHlr returns the users suspended for abuse
+func (api *adminAPI) listSuspensionsHlr(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.sta.abuse.suspensionList())
+}
+
+// liftSuspensionHlr lets a suspended user connect again
+func (api *adminAPI) liftSuspensionHlr(w http.ResponseWriter, r *http.Request) {
+	UID, err := pathUID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !api.sta.abuse.lift(UID) {
+		writeJSONError(w, http.StatusNotFound, errors.New("user isn't suspended"))
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// eventsHlr returns the recent suspensions and lifts of them, after the event of the ID in the query parameter since
+// if it's given, for the events to be polled
+func (api *adminAPI) eventsHlr(w http.ResponseWriter, r *http.Request) {
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		since, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, errors.New("since must be the ID of an event"))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, api.sta.abuse.eventsSince(since))
+}
+
+// drainRequest is how to drain, over DrainTimeout and DrainNotify of the configuration
+type drainRequest struct {
+	// in seconds
+	Timeout *int
+	Notify  *bool
+}
+
+// drainHlr starts draining, after which ck-server exits. The body is optional
+func (api *adminAPI) drainHlr(w http.ResponseWriter, r *http.Request) {
+	var req drainRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	timeout, notify := api.sta.DrainTimeout, api.sta.DrainNotify
+	if req.Timeout != nil {
+		if *req.Timeout < 0 {
+			writeJSONError(w, http.StatusBadRequest, errors.New("Timeout can't be negative"))
+			return
+		}
+		timeout = time.Duration(*req.Timeout) * time.Second
+	}
+	if req.Notify != nil {
+		notify = *req.Notify
+	}
+	api.sta.Drain(timeout, notify)
+	writeJSON(w, http.StatusAccepted, api.sta.drainStatus())
+}
+
+// drainStatusHlr returns how far draining has gone
+func (api *adminAPI) drainStatusHlr(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.sta.drainStatus())
+}
+
+func (api *adminAPI) reloadHlr(w http.ResponseWriter, r *http.Request) {
+	err := api.sta.ReloadConfig()
+	if err == ErrReloadUnsupported {
+		writeJSONError(w, http.StatusNotImplemented, err)
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// AdminAPIHandler serves the admin API v2 of sta on /v2, debugging endpoints on /debug, and the dashboard on
+// everything else
+func AdminAPIHandler(sta *State) http.Handler {
+	api := &adminAPI{sta: sta}
+	router := gmux.NewRouter()
+	v2 := router.PathPrefix("/v2").Subrouter()
+	v2.HandleFunc("/users", api.listUsersHlr).Methods("GET")
+	v2.HandleFunc("/users/{UID}", api.getUserHlr).Methods("GET")
+	v2.HandleFunc("/users/{UID}", api.putUserHlr).Methods("PUT")
+	v2.HandleFunc("/users/{UID}", api.patchUserHlr).Methods("PATCH")
+	v2.HandleFunc("/users/{UID}", api.deleteUserHlr).Methods("DELETE")
+	v2.HandleFunc("/users/{UID}/kick", api.kickUserHlr).Methods("POST")
+	v2.HandleFunc("/sessions", api.listSessionsHlr).Methods("GET")
+	v2.HandleFunc("/sessions/{UID}/{SessionID}", api.getSessionHlr).Methods("GET")
+	v2.HandleFunc("/sessions/{UID}/{SessionID}", api.closeSessionHlr).Methods("DELETE")
+	v2.HandleFunc("/sessions/{UID}/{SessionID}/streams/{StreamID}", api.closeStreamHlr).Methods("DELETE")
+	v2.HandleFunc("/traffic", api.trafficHlr).Methods("GET")
+	v2.HandleFunc("/reload", api.reloadHlr).Methods("POST")
+	v2.HandleFunc("/drain", api.drainStatusHlr).Methods("GET")
+	v2.HandleFunc("/drain", api.drainHlr).Methods("POST")
+	v2.HandleFunc("/suspensions", api.listSuspensionsHlr).Methods("GET")
+	v2.HandleFunc("/suspensions/{UID}", api.liftSuspensionHlr).Methods("DELETE")
+	v2.HandleFunc("/events", api.eventsHlr).Methods("GET")
+	v2.Use(api.authMiddleware)
+	debug := router.PathPrefix("/debug").Subrouter()
+	api.handleDebug(debug)
+	debug.Use(api.authMiddleware)
+	router.PathPrefix("/").Handler(dashboardHandler())
+	return router
+}
+
+// listenAdminAPI listens on addr, which is a Unix socket if it's prefixed with unix:
+func listenAdminAPI(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// ListenAdminAPI listens on AdminAPIAddr for the admin API v2, in TLS if a certificate is configured
+func ListenAdminAPI(sta *State) (net.Listener, error) {
+	listener, err := listenAdminAPI(sta.AdminAPIAddr)
+	if err != nil {
+		return nil, err
+	}
+	if sta.adminAPITLS != nil {
+		listener = tls.NewListener(listener, sta.adminAPITLS)
+	}
+	return listener, nil
+}
+
+// ServeAdminAPI serves the admin API v2 on AdminAPIAddr, in TLS if a certificate is configured. It only returns when
+// it fails
+func ServeAdminAPI(sta *State) error {
+	listener, err := ListenAdminAPI(sta)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, AdminAPIHandler(sta))
+}
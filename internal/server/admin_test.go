@@ -0,0 +1,284 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mockAdminAPIToken = "correct horse battery staple"
+
+func makeAdminAPIState(t *testing.T, addr string) *State {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	t.Cleanup(func() { os.Remove(tmpDB.Name()) })
+	sta, err := InitState(RawConfig{
+		DatabasePath:  tmpDB.Name(),
+		RedirAddr:     "127.0.0.1:9999",
+		AdminAPIAddr:  addr,
+		AdminAPIToken: mockAdminAPIToken,
+	}, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sta
+}
+
+func adminRequest(handler http.Handler, method string, path string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+mockAdminAPIToken)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminAPI(t *testing.T) {
+	sta := makeAdminAPIState(t, "127.0.0.1:0")
+	handler := AdminAPIHandler(sta)
+	userPath := "/v2/users/" + base64.URLEncoding.EncodeToString(validUserInfo.UID)
+
+	t.Run("unauthorised", func(t *testing.T) {
+		for _, header := range []string{"", "Bearer wrong", mockAdminAPIToken + "x"} {
+			req := httptest.NewRequest("GET", "/v2/users", nil)
+			req.Header.Set("Authorization", header)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("authorization %q: expecting status 401, got %v", header, rec.Code)
+			}
+		}
+	})
+
+	t.Run("create and get", func(t *testing.T) {
+		body, _ := json.Marshal(validUserInfo)
+		rec := adminRequest(handler, "PUT", userPath, string(body))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v: %v", rec.Code, rec.Body)
+		}
+		rec = adminRequest(handler, "GET", userPath, "")
+		var uinfo usermanager.UserInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &uinfo); err != nil {
+			t.Fatal(err)
+		}
+		if uinfo.DownCredit != validUserInfo.DownCredit {
+			t.Errorf("expecting DownCredit %v, got %v", validUserInfo.DownCredit, uinfo.DownCredit)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		rec := adminRequest(handler, "GET", "/v2/users", "")
+		var infos []usermanager.UserInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &infos); err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 {
+			t.Errorf("expecting 1 user, got %v", len(infos))
+		}
+	})
+
+	t.Run("adjust credit and expiry", func(t *testing.T) {
+		rec := adminRequest(handler, "PATCH", userPath, `{"DownCredit": 1, "ExpiryTime": 2}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v: %v", rec.Code, rec.Body)
+		}
+		uinfo, _ := sta.Panel.Manager.GetUserInfo(validUserInfo.UID)
+		if uinfo.DownCredit != 1 || uinfo.ExpiryTime != 2 {
+			t.Errorf("credit and expiry aren't adjusted: %+v", uinfo)
+		}
+		if uinfo.UpCredit != validUserInfo.UpCredit {
+			t.Errorf("UpCredit is changed to %v", uinfo.UpCredit)
+		}
+
+		rec = adminRequest(handler, "PATCH", "/v2/users/"+base64.URLEncoding.EncodeToString(make([]byte, 16)), `{}`)
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("patching a non-existent user: expecting status 404, got %v", rec.Code)
+		}
+	})
+
+	t.Run("restrict proxy methods", func(t *testing.T) {
+		rec := adminRequest(handler, "PATCH", userPath, `{"ProxyMethods": ["shadowsocks"]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v: %v", rec.Code, rec.Body)
+		}
+		uinfo, _ := sta.Panel.Manager.GetUserInfo(validUserInfo.UID)
+		if len(uinfo.ProxyMethods) != 1 || uinfo.ProxyMethods[0] != "shadowsocks" {
+			t.Errorf("ProxyMethods aren't set: %+v", uinfo)
+		}
+
+		adminRequest(handler, "PATCH", userPath, `{"DownCredit": 1}`)
+		if uinfo, _ = sta.Panel.Manager.GetUserInfo(validUserInfo.UID); len(uinfo.ProxyMethods) != 1 {
+			t.Errorf("ProxyMethods are changed by a patch without them: %+v", uinfo)
+		}
+
+		adminRequest(handler, "PATCH", userPath, `{"ProxyMethods": []}`)
+		if uinfo, _ = sta.Panel.Manager.GetUserInfo(validUserInfo.UID); len(uinfo.ProxyMethods) != 0 {
+			t.Errorf("ProxyMethods aren't cleared: %+v", uinfo)
+		}
+	})
+
+	t.Run("sessions and kick", func(t *testing.T) {
+		user, err := sta.Panel.GetBypassUser(validUserInfo.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, _ = user.GetSession(2, "shadowsocks", "", getSeshConfig(false))
+		_, _, _ = user.GetSession(1, "shadowsocks", "", getSeshConfig(false))
+
+		rec := adminRequest(handler, "GET", "/v2/sessions", "")
+		var active []ActiveUserInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &active); err != nil {
+			t.Fatal(err)
+		}
+		if len(active) != 1 || len(active[0].SessionIDs) != 2 || active[0].SessionIDs[0] != 1 {
+			t.Errorf("unexpected active users %+v", active)
+		}
+
+		sessionPath := "/v2/sessions/" + base64.URLEncoding.EncodeToString(validUserInfo.UID)
+		user.describeSession(1, sessionDetail{
+			transport:        "TLS",
+			encryptionMethod: mux.E_METHOD_CHACHA20_POLY1305,
+			proxyMethod:      "shadowsocks",
+			opened:           sta.WorldState.Now().Add(-time.Minute),
+		})
+		rec = adminRequest(handler, "GET", sessionPath+"/1", "")
+		var info SessionInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.SessionID != 1 || info.Transport != "TLS" || info.EncryptionMethod != "chacha20-poly1305" ||
+			info.ProxyMethod != "shadowsocks" || info.Uptime != 60 || info.Streams == nil {
+			t.Errorf("unexpected session %+v", info)
+		}
+		rec = adminRequest(handler, "DELETE", sessionPath+"/1/streams/1", "")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("closing a stream that isn't open: expecting status 404, got %v", rec.Code)
+		}
+		rec = adminRequest(handler, "GET", sessionPath+"/x", "")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("bad session ID: expecting status 400, got %v", rec.Code)
+		}
+
+		rec = adminRequest(handler, "DELETE", sessionPath+"/2", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v: %v", rec.Code, rec.Body)
+		}
+		if user.hasSession(2) || !user.hasSession(1) {
+			t.Error("wrong session is closed")
+		}
+		for _, method := range []string{"GET", "DELETE"} {
+			rec = adminRequest(handler, method, sessionPath+"/2", "")
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("%v a closed session: expecting status 404, got %v", method, rec.Code)
+			}
+		}
+
+		rec = adminRequest(handler, "POST", userPath+"/kick", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v: %v", rec.Code, rec.Body)
+		}
+		if sta.Panel.isActive(validUserInfo.UID) {
+			t.Error("user is still active after being kicked")
+		}
+		rec = adminRequest(handler, "POST", userPath+"/kick", "")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("kicking an inactive user: expecting status 404, got %v", rec.Code)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		rec := adminRequest(handler, "DELETE", userPath, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v: %v", rec.Code, rec.Body)
+		}
+		if _, err := sta.Panel.Manager.GetUserInfo(validUserInfo.UID); err != usermanager.ErrUserNotFound {
+			t.Errorf("expecting %v, got %v", usermanager.ErrUserNotFound, err)
+		}
+		rec = adminRequest(handler, "DELETE", userPath, "")
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("deleting again: expecting status 404, got %v", rec.Code)
+		}
+	})
+
+	t.Run("traffic", func(t *testing.T) {
+		sta.Panel.trafficM.Lock()
+		sta.Panel.traffic[[16]byte{1}] = userTraffic{Up: 1, Down: 2}
+		sta.Panel.trafficM.Unlock()
+		rec := adminRequest(handler, "GET", "/v2/traffic", "")
+		var traffic []UserTrafficInfo
+		if err := json.Unmarshal(rec.Body.Bytes(), &traffic); err != nil {
+			t.Fatal(err)
+		}
+		if len(traffic) != 1 || traffic[0].Up != 1 || traffic[0].Down != 2 {
+			t.Errorf("unexpected traffic %+v", traffic)
+		}
+	})
+
+	t.Run("dashboard", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200 without a token, got %v", rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "Cloak dashboard") {
+			t.Error("the dashboard isn't served")
+		}
+	})
+
+	t.Run("bad UID", func(t *testing.T) {
+		rec := adminRequest(handler, "GET", "/v2/users/AAEC", "")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expecting status 400, got %v", rec.Code)
+		}
+	})
+}
+
+func TestServeAdminAPI(t *testing.T) {
+	t.Run("without token", func(t *testing.T) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		_, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", AdminAPIAddr: "127.0.0.1:0"}, mockWorldState)
+		if err != ErrNoAdminAPIToken {
+			t.Errorf("expecting %v, got %v", ErrNoAdminAPIToken, err)
+		}
+	})
+
+	t.Run("on unix socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "admin.sock")
+		sta := makeAdminAPIState(t, "unix:"+socket)
+		go ServeAdminAPI(sta)
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		}}
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			req, _ := http.NewRequest("GET", "http://unix/v2/users", nil)
+			req.Header.Set("Authorization", "Bearer "+mockAdminAPIToken)
+			resp, err = client.Do(req)
+			if err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expecting status 200, got %v", resp.StatusCode)
+		}
+	})
+}
@@ -2,10 +2,13 @@ package server
 
 import (
 	"bytes"
+	"crypto"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -17,21 +20,108 @@ type ClientInfo struct {
 	ProxyMethod      string
 	EncryptionMethod byte
 	Unordered        bool
-	Transport        Transport
+	// whether the client can read the encrypted handshake records of a transcript
+	AcceptsTranscript bool
+	// whether the client can take a hybrid key exchange with the ML-KEM key in its ClientHello
+	PostQuantum bool
+	// whether the frames of the session are spread across its connections by their latency, and whether they're
+	// all sent on every connection
+	Multipath bool
+	Duplicate bool
+	// whether the client wants its session kept for a while after losing all its connections
+	Resumable bool
+	// whether the client reads why its session is closed from the closing frame
+	CloseReasons bool
+	// whether the client has sent frames under the early session key right after its ClientHello
+	EarlyData bool
+	// whether the client can read a ServerHello whose extensions are in the order of the cover site's
+	AcceptsExtensionOrder bool
+	// whether the client takes a C_DRAIN frame and goes elsewhere
+	Drains bool
+	// whether the client takes C_WINDOW frames
+	FlowControl bool
+	// whether the client wants the frames of its streams compressed
+	Compression bool
+	// the protocol version the client speaks, 0 if it's older than versions
+	Version byte
+	// the shards of each block of forward error correction. 0 if there's no FEC
+	FECDataShards   int
+	FECParityShards int
+	// how often the client wants heartbeats on the session's connections. 0 if it doesn't
+	Heartbeat time.Duration
+	// the traffic profile the session is shaped after, one of the mux.PROFILE_ constants
+	TrafficProfile byte
+	Transport      Transport
+	// the SNI of the ClientHello, or the Host of the HTTP request, that the handshake was in. Empty if it's unknown
+	SNI string
+
+	// when the client made the handshake
+	timestamp time.Time
+	// the shared secret of the handshake, which the early session key is derived from
+	sharedSecret [32]byte
 }
 
 type authFragments struct {
 	sharedSecret      [32]byte
 	randPubKey        [32]byte
 	ciphertextWithTag [64]byte
+	// which of the static private keys the client connected with, 0 being the current one
+	keyIndex int
 }
 
+// findSharedSecret sets the shared secret of fragments to that of the client's ephemeral key with whichever of
+// staticPvs, the current private key followed by the previous ones, ciphertextWithTag is encrypted to. Clients of
+// a previous key can only be told apart by their ciphertext opening with it, so each key is tried in turn, and if
+// none of them opens it, the secret with the current key is kept for decryptClientInfo to reject
+func (fragments *authFragments) findSharedSecret(staticPvs []crypto.PrivateKey, ephPub crypto.PublicKey) {
+	copy(fragments.sharedSecret[:], ecdh.GenerateSharedSecret(staticPvs[0], ephPub))
+	fragments.keyIndex = 0
+	if len(staticPvs) == 1 {
+		return
+	}
+	nonce := fragments.randPubKey[0:12]
+	if _, err := common.AESGCMDecrypt(nonce, fragments.sharedSecret[:], fragments.ciphertextWithTag[:]); err == nil {
+		return
+	}
+	for i, staticPv := range staticPvs[1:] {
+		secret := ecdh.GenerateSharedSecret(staticPv, ephPub)
+		if _, err := common.AESGCMDecrypt(nonce, secret, fragments.ciphertextWithTag[:]); err == nil {
+			copy(fragments.sharedSecret[:], secret)
+			fragments.keyIndex = i + 1
+			return
+		}
+	}
+}
+
+const (
+	UNORDERED_FLAG    = 0x01 // 0000 0001
+	TRANSCRIPT_FLAG   = 0x02 // 0000 0010
+	POST_QUANTUM_FLAG = 0x04 // 0000 0100
+	MULTIPATH_FLAG    = 0x08 // 0000 1000
+	DUPLICATE_FLAG    = 0x10 // 0001 0000
+	RESUMABLE_FLAG    = 0x20 // 0010 0000
+	// the client reads why its session is closed from the closing frame
+	CLOSE_REASONS_FLAG = 0x40 // 0100 0000
+	// the client sends frames under the early session key right after its ClientHello
+	EARLY_DATA_FLAG = 0x80 // 1000 0000
+)
+
+// in the second byte of flags
 const (
-	UNORDERED_FLAG = 0x01 // 0000 0001
+	// the client finds the key share of the ServerHello among extensions in any order
+	EXTENSION_ORDER_FLAG = 0x01 // 0000 0001
+	// the client opens new sessions elsewhere when its server says it's draining
+	DRAIN_FLAG = 0x02 // 0000 0010
+	// the client takes C_WINDOW frames and limits what it sends by them
+	FLOW_CONTROL_FLAG = 0x04 // 0000 0100
+	// the client compresses the frames of its streams, and wants those sent to it compressed
+	COMPRESSION_FLAG = 0x08 // 0000 1000
 )
 
 var ErrTimestampOutOfWindow = errors.New("timestamp is outside of the accepting window")
 var ErrUnrecognisedProtocol = errors.New("unrecognised protocol")
+var ErrBadFECShards = errors.New("invalid FEC shards")
+var ErrUnknownTrafficProfile = errors.New("unknown traffic profile")
 
 // decryptClientInfo checks if a the authFragments are valid. It doesn't check if the UID is authorised
 func decryptClientInfo(fragments authFragments, serverTime time.Time) (info ClientInfo, err error) {
@@ -42,11 +132,36 @@ func decryptClientInfo(fragments authFragments, serverTime time.Time) (info Clie
 	}
 
 	info = ClientInfo{
-		UID:              plaintext[0:16],
-		SessionId:        0,
-		ProxyMethod:      string(bytes.Trim(plaintext[16:28], "\x00")),
-		EncryptionMethod: plaintext[28],
-		Unordered:        plaintext[41]&UNORDERED_FLAG != 0,
+		UID:               plaintext[0:16],
+		SessionId:         0,
+		ProxyMethod:       string(bytes.Trim(plaintext[16:28], "\x00")),
+		EncryptionMethod:  plaintext[28],
+		Unordered:         plaintext[41]&UNORDERED_FLAG != 0,
+		AcceptsTranscript: plaintext[41]&TRANSCRIPT_FLAG != 0,
+		PostQuantum:       plaintext[41]&POST_QUANTUM_FLAG != 0,
+		Multipath:         plaintext[41]&MULTIPATH_FLAG != 0,
+		Duplicate:         plaintext[41]&DUPLICATE_FLAG != 0,
+		Resumable:         plaintext[41]&RESUMABLE_FLAG != 0,
+		CloseReasons:      plaintext[41]&CLOSE_REASONS_FLAG != 0,
+		EarlyData:         plaintext[41]&EARLY_DATA_FLAG != 0,
+		FECDataShards:     int(plaintext[42]),
+		FECParityShards:   int(plaintext[43]),
+		Heartbeat:         time.Duration(plaintext[44]) * time.Second,
+		TrafficProfile:    plaintext[45],
+	}
+	info.AcceptsExtensionOrder = plaintext[46]&EXTENSION_ORDER_FLAG != 0
+	info.Drains = plaintext[46]&DRAIN_FLAG != 0
+	info.FlowControl = plaintext[46]&FLOW_CONTROL_FLAG != 0
+	info.Compression = plaintext[46]&COMPRESSION_FLAG != 0
+	info.Version = plaintext[47]
+	if (info.FECDataShards == 0) != (info.FECParityShards == 0) ||
+		info.FECDataShards > mux.MaxFECShards || info.FECParityShards > mux.MaxFECShards {
+		err = ErrBadFECShards
+		return
+	}
+	if !mux.ValidTrafficProfile(info.TrafficProfile) {
+		err = ErrUnknownTrafficProfile
+		return
 	}
 
 	timestamp := int64(binary.BigEndian.Uint64(plaintext[29:37]))
@@ -55,11 +170,14 @@ func decryptClientInfo(fragments authFragments, serverTime time.Time) (info Clie
 		err = fmt.Errorf("%v: received timestamp %v", ErrTimestampOutOfWindow, timestamp)
 		return
 	}
+	info.timestamp = clientTime
+	info.sharedSecret = fragments.sharedSecret
 	info.SessionId = binary.BigEndian.Uint32(plaintext[37:41])
 	return
 }
 
 var ErrReplay = errors.New("duplicate random")
+var ErrNotCloak = errors.New("not Cloak")
 var ErrBadProxyMethod = errors.New("invalid proxy method")
 
 // AuthFirstPacket checks if the first packet of data is ClientHello or HTTP GET, and checks if it was from a Cloak client
@@ -70,34 +188,81 @@ func AuthFirstPacket(firstPacket []byte, sta *State) (info ClientInfo, finisher
 	var transport Transport
 	switch firstPacket[0] {
 	case 0x47:
-		transport = &WebSocket{}
+		transport = &WebSocket{path: sta.WSPath, hosts: sta.webSocketHosts(), origins: sta.WSOrigins}
 	case 0x16:
-		transport = &TLS{}
+		transport = &TLS{
+			transcripts:  sta.Transcripts(),
+			ticketLength: sta.sessionTicketLength,
+			serverHellos: sta.ServerHellos(),
+			cipherSuite:  sta.cipherSuite,
+			recordLength: sta.handshakeRecordLength,
+			strict:       sta.StrictClientHello,
+		}
 	default:
 		err = ErrUnrecognisedProtocol
+		sta.metrics.handshake(err)
 		return
 	}
+	return authenticate(firstPacket, transport, sta)
+}
 
-	fragments, finisher, err := transport.processFirstPacket(firstPacket, sta.StaticPv)
-	if err != nil {
-		return
+// authenticate checks if reqPacket, in the format of transport, is from a Cloak client, on a worker of the handshake
+// pool if there is one
+func authenticate(reqPacket []byte, transport Transport, sta *State) (info ClientInfo, finisher Responder, err error) {
+	defer func() { sta.metrics.handshake(err) }()
+	if !sta.handshakes.do(func() { info, finisher, err = checkHandshake(reqPacket, transport, sta) }) {
+		err = ErrHandshakeOverloaded
 	}
+	return
+}
 
-	if sta.registerRandom(fragments.randPubKey) {
-		err = ErrReplay
+// checkHandshake is authenticate on the goroutine it's called on
+func checkHandshake(reqPacket []byte, transport Transport, sta *State) (info ClientInfo, finisher Responder, err error) {
+	fragments, finisher, err := transport.processFirstPacket(reqPacket, sta.staticPvs())
+	if err != nil {
 		return
 	}
 
 	info, err = decryptClientInfo(fragments, sta.WorldState.Now())
 	if err != nil {
 		log.Debug(err)
-		err = fmt.Errorf("transport %v in correct format but not Cloak: %v", transport, err)
+		err = fmt.Errorf("%w: transport %v in correct format: %v", ErrNotCloak, transport, err)
+		return
+	}
+	// only handshakes that are from a Cloak client and within the timestamp window are remembered, so that probes
+	// don't take up the replay cache
+	if sta.registerRandom(fragments.randPubKey, info.timestamp) {
+		err = ErrReplay
 		return
 	}
-	if _, ok := sta.ProxyBook[info.ProxyMethod]; !ok {
+	if _, ok := sta.proxyAddr(info.ProxyMethod); !ok {
 		err = ErrBadProxyMethod
 		return
 	}
+	if t, ok := transport.(*TLS); ok {
+		if !info.AcceptsTranscript {
+			// older clients read exactly one encrypted handshake record
+			t.transcripts = nil
+			t.ticketLength = 0
+			t.resumes = false
+		}
+		if !info.AcceptsExtensionOrder {
+			// older clients read the key share right after the extensions length
+			t.serverHello.extensions = nil
+		}
+		if fragments.keyIndex != 0 && t.ticketLength != 0 {
+			// the client works the length of the tickets out from the public key it has
+			pub := ecdh.PublicKey(sta.PreviousStaticPvs[fragments.keyIndex-1])
+			t.ticketLength = common.SessionTicketLength(ecdh.Marshal(pub))
+		}
+		if !info.PostQuantum {
+			// the ML-KEM key share isn't ours, e.g. it's from an older client
+			t.mlkemKeyShare = nil
+		}
+	} else {
+		// only direct TLS has room for frames after the first packet
+		info.EarlyData = false
+	}
 	info.Transport = transport
 	return
 }
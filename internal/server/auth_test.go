@@ -2,10 +2,13 @@ package server
 
 import (
 	"crypto"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/ecdh"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"testing"
 	"time"
 )
@@ -18,7 +21,7 @@ func TestTouchStone(t *testing.T) {
 	t.Run("correct time", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
 		ch, _ := parseClientHello(chBytes)
-		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
+		ai, err := TLS{}.unmarshalClientHello(ch, []crypto.PrivateKey{staticPv})
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -37,7 +40,7 @@ func TestTouchStone(t *testing.T) {
 	t.Run("roughly correct time", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
 		ch, _ := parseClientHello(chBytes)
-		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
+		ai, err := TLS{}.unmarshalClientHello(ch, []crypto.PrivateKey{staticPv})
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -60,7 +63,7 @@ func TestTouchStone(t *testing.T) {
 	t.Run("over interval", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
 		ch, _ := parseClientHello(chBytes)
-		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
+		ai, err := TLS{}.unmarshalClientHello(ch, []crypto.PrivateKey{staticPv})
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -76,7 +79,7 @@ func TestTouchStone(t *testing.T) {
 	t.Run("under interval", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
 		ch, _ := parseClientHello(chBytes)
-		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
+		ai, err := TLS{}.unmarshalClientHello(ch, []crypto.PrivateKey{staticPv})
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -92,7 +95,7 @@ func TestTouchStone(t *testing.T) {
 	t.Run("not cloak psk", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010246010002420303794ae79c6db7a31e67e2ce91b8afcb82995ae79ad1d0dc885f933e4193bf95cd208abd7a70f3b82cc31c02f1c2b94ba74d5222a66695a5cf92a366421d7f5eb9530022fafa130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a010001d75a5a00000000001e001c0000196c68332e676f6f676c6575736572636f6e74656e742e636f6d00170000ff01000100000a000a0008baba001d00170018000b00020100002300000010000e000c02683208687474702f312e31000500050100000000000d00140012040308040401050308050501080606010201001200000033002b0029baba000100001d002074bfe93336c364b43cf0879d997b2e11dc97068b86fc90174e0f2bcea1d4ed1c002d00020101002b000b0ababa0304030303020301001b00030200029a9a0001000029010500e000da00d1f6c0918f865390ae3ca33c77f61a1974cb4533456071b214ec018d17dc22845f2f72cf1dba48f9cdc0758803002dda9b964fad5522e82442af7cbbe242241e39233386f2383bce3ced8e16b1ae3f0ef52a706f58e1e6a1bca0cd3b3a2a4c4cb738770b01b56bf3e73c472bf4fb238cab510aa78f8427a3ca99f741aa433f548be460705f43a3abe878cec6ee3158c129406910b93e798e8a7aaffc2e7ff7b8fd872778d3687a0beaa1452fe7ec418070d537344b64d09f6edd053346ff9c9678eef6b8886882aba81d4be11d9df653de35659f93a22ac39399e3ba400021204e22b73261693967a9216fe4a3b004571c53f316309e76671a18d78931b5b072")
 		ch, _ := parseClientHello(chBytes)
-		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
+		ai, err := TLS{}.unmarshalClientHello(ch, []crypto.PrivateKey{staticPv})
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -108,7 +111,7 @@ func TestTouchStone(t *testing.T) {
 	t.Run("not cloak no psk", func(t *testing.T) {
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303eae4c204a867390a758fcff3afa5803cac3e07011cf0c9f3befc1267445aabee20fc398df698113617f8161cbcb89534efa892088a6c5e49246534e05f790ea36f00220a0a130113021303c02bc02fc02cc030cca9cca8c013c014009c009d002f0035000a010001910a0a000000000014001200000f63646e2e62697a69626c652e636f6d00170000ff01000100000a000a0008caca001d00170018000b00020100002300000010000e000c02683208687474702f312e31000500050100000000000d00140012040308040401050308050501080606010201001200000033002b0029caca000100001d00204c8f1563fb70c261bc0c32c1b568b8d02fab25f4094711e7868b1712751dc754002d00020101002b000b0a2a2a0304030303020301001b00030200026a6a000100001500c9000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
 		ch, _ := parseClientHello(chBytes)
-		ai, err := TLS{}.unmarshalClientHello(ch, staticPv)
+		ai, err := TLS{}.unmarshalClientHello(ch, []crypto.PrivateKey{staticPv})
 		if err != nil {
 			t.Errorf("expecting no error, got %v", err)
 			return
@@ -152,6 +155,65 @@ func TestAuthFirstPacket(t *testing.T) {
 			return
 		}
 	})
+	t.Run("TLS legacy client gets no transcript", func(t *testing.T) {
+		sta := getNewState()
+		sta.MimicTranscript = true
+		sta.transcripts = map[string][][]int{"": {{100, 200}}}
+		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+		info, _, err := AuthFirstPacket(chBytes, sta)
+		if err != nil {
+			t.Errorf("failed to get client info: %v", err)
+			return
+		}
+		if info.AcceptsTranscript {
+			t.Error("client doesn't advertise transcript support")
+		}
+		if info.Transport.(*TLS).transcripts != nil {
+			t.Error("transcripts are replayed to a legacy client")
+		}
+	})
+	t.Run("TLS legacy client gets the legacy extension order", func(t *testing.T) {
+		sta := getNewState()
+		sta.MimicTranscript = true
+		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+		ch, _ := parseClientHello(chBytes)
+		sta.serverHellos = map[string]serverHelloTemplate{cipherSuitesKey(ch): {
+			cipherSuite: [2]byte{0x13, 0x02},
+			extensions:  [][2]byte{supportedVersionsExtensionType, keyShareExtensionType},
+		}}
+		info, _, err := AuthFirstPacket(chBytes, sta)
+		if err != nil {
+			t.Fatalf("failed to get client info: %v", err)
+		}
+		serverHello := info.Transport.(*TLS).serverHello
+		if serverHello.extensions != nil {
+			t.Error("extensions are reordered for a legacy client")
+		}
+		// only the order of the extensions moves the key share
+		if serverHello.cipherSuite != [2]byte{0x13, 0x02} {
+			t.Errorf("expecting the learnt cipher suite, got %x", serverHello.cipherSuite)
+		}
+	})
+	t.Run("TLS with a previous key", func(t *testing.T) {
+		sta := getNewState()
+		current, _, _ := ecdh.GenerateKey(rand.Reader)
+		sta.StaticPv = current
+		sta.PreviousStaticPvs = []crypto.PrivateKey{p.(crypto.PrivateKey)}
+		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+		info, _, err := AuthFirstPacket(chBytes, sta)
+		if err != nil {
+			t.Fatalf("failed to get client info: %v", err)
+		}
+		if info.SessionId != 3710878841 {
+			t.Error("failed to get correct session id")
+		}
+
+		sta = getNewState()
+		sta.StaticPv = current
+		if _, _, err = AuthFirstPacket(chBytes, sta); err == nil {
+			t.Error("a key that isn't ours shouldn't be accepted")
+		}
+	})
 	t.Run("TLS correct but replay", func(t *testing.T) {
 		sta := getNewState()
 		chBytes, _ := hex.DecodeString("1603010200010001fc0303ac530b5778469dbbc3f9a83c6ac35b63aa6a70c2014026ade30f2faf0266f0242068424f320bcad49b4315a761f9f6dec32b0a403c2d8c0ab337608a694c6e411c0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00204655c2c83aaed1db2e89ed17d671fcdc76dc96e36bde8840022f1bda2f31019600170041543af1f8d28b37d984073f40e8361613da502f16e4039f00656f427de0f66480b2e77e3e552e126bb0cc097168f6e5454c7f9501126a2377fb40151f6cfc007e0e002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
@@ -193,3 +255,148 @@ Upgrade: websocket
 	})
 
 }
+
+func TestDecryptClientInfo_FEC(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	fragmentsOf := func(dataShards, parityShards byte) (fragments authFragments) {
+		plaintext := make([]byte, 48)
+		binary.BigEndian.PutUint64(plaintext[29:37], uint64(now.Unix()))
+		plaintext[42] = dataShards
+		plaintext[43] = parityShards
+		ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+		copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+		return
+	}
+
+	info, err := decryptClientInfo(fragmentsOf(10, 3), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.FECDataShards != 10 || info.FECParityShards != 3 {
+		t.Errorf("expecting 10:3 shards, got %v:%v", info.FECDataShards, info.FECParityShards)
+	}
+	for _, shards := range [][2]byte{{10, 0}, {0, 3}, {200, 3}} {
+		if _, err = decryptClientInfo(fragmentsOf(shards[0], shards[1]), now); err != ErrBadFECShards {
+			t.Errorf("%v:%v: expecting %v, got %v", shards[0], shards[1], ErrBadFECShards, err)
+		}
+	}
+}
+
+func TestDecryptClientInfo_Heartbeat(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	plaintext := make([]byte, 48)
+	binary.BigEndian.PutUint64(plaintext[29:37], uint64(now.Unix()))
+	plaintext[44] = 30
+	var fragments authFragments
+	ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+	copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+
+	info, err := decryptClientInfo(fragments, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Heartbeat != 30*time.Second {
+		t.Errorf("expecting a heartbeat of 30s, got %v", info.Heartbeat)
+	}
+}
+
+func TestDecryptClientInfo_TrafficProfile(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	fragmentsOf := func(profile byte) (fragments authFragments) {
+		plaintext := make([]byte, 48)
+		binary.BigEndian.PutUint64(plaintext[29:37], uint64(now.Unix()))
+		plaintext[45] = profile
+		ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+		copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+		return
+	}
+
+	info, err := decryptClientInfo(fragmentsOf(mux.PROFILE_STREAMING), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.TrafficProfile != mux.PROFILE_STREAMING {
+		t.Errorf("expecting profile %v, got %v", mux.PROFILE_STREAMING, info.TrafficProfile)
+	}
+	if _, err = decryptClientInfo(fragmentsOf(200), now); err != ErrUnknownTrafficProfile {
+		t.Errorf("expecting %v, got %v", ErrUnknownTrafficProfile, err)
+	}
+}
+
+func TestDecryptClientInfo_CloseReasons(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	fragmentsOf := func(flags byte) (fragments authFragments) {
+		plaintext := make([]byte, 48)
+		binary.BigEndian.PutUint64(plaintext[29:37], uint64(now.Unix()))
+		plaintext[41] = flags
+		ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+		copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+		return
+	}
+
+	for flags, expected := range map[byte]bool{CLOSE_REASONS_FLAG: true, RESUMABLE_FLAG: false} {
+		info, err := decryptClientInfo(fragmentsOf(flags), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.CloseReasons != expected {
+			t.Errorf("flags %x: expecting CloseReasons %v, got %v", flags, expected, info.CloseReasons)
+		}
+	}
+}
+
+func TestDecryptClientInfo_EarlyData(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	fragments := authFragments{sharedSecret: [32]byte{1, 2, 3}}
+	plaintext := make([]byte, 48)
+	binary.BigEndian.PutUint64(plaintext[29:37], uint64(now.Unix()))
+	plaintext[41] = EARLY_DATA_FLAG
+	ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+	copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+
+	info, err := decryptClientInfo(fragments, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.EarlyData {
+		t.Error("EarlyData isn't set")
+	}
+	// the early session key is derived from it
+	if info.sharedSecret != fragments.sharedSecret {
+		t.Error("shared secret isn't kept")
+	}
+}
+
+func TestDecryptClientInfo_ExtensionOrder(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	fragments := authFragments{sharedSecret: [32]byte{1, 2, 3}}
+	plaintext := make([]byte, 48)
+	binary.BigEndian.PutUint64(plaintext[29:37], uint64(now.Unix()))
+	plaintext[46] = EXTENSION_ORDER_FLAG | DRAIN_FLAG | FLOW_CONTROL_FLAG | COMPRESSION_FLAG
+	plaintext[47] = 1
+	ciphertextWithTag, _ := common.AESGCMEncrypt(fragments.randPubKey[:12], fragments.sharedSecret[:], plaintext)
+	copy(fragments.ciphertextWithTag[:], ciphertextWithTag)
+
+	info, err := decryptClientInfo(fragments, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.AcceptsExtensionOrder {
+		t.Error("AcceptsExtensionOrder isn't set")
+	}
+	if !info.Drains {
+		t.Error("Drains isn't set")
+	}
+	if !info.FlowControl {
+		t.Error("FlowControl isn't set")
+	}
+	if !info.Compression {
+		t.Error("Compression isn't set")
+	}
+	if info.AcceptsTranscript {
+		t.Error("the second byte of flags is taken as the first")
+	}
+	if info.Version != 1 {
+		t.Errorf("expecting version 1, got %v", info.Version)
+	}
+}
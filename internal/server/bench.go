@@ -0,0 +1,33 @@
+package server
+
+import (
+	"io"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// benchAddr is the ProxyBook entry of a proxy method that ck-client bench measures the server with, without an
+// upstream proxy server in the way. "echo" sends back whatever its streams carry, and "discard" throws it away
+type benchAddr string
+
+func (a benchAddr) Network() string { return string(a) }
+func (benchAddr) String() string    { return "" }
+
+// serveBench echoes back or discards what stream carries until it's closed
+func serveBench(stream *mux.Stream, echo bool, sta *State) {
+	sta.metrics.streamOpened()
+	defer sta.metrics.streamClosed()
+	var err error
+	if echo {
+		stream.SetWriteToTimeout(sta.Timeout)
+		_, err = common.Copy(stream, stream)
+	} else {
+		_, err = io.Copy(io.Discard, stream)
+		stream.Close()
+	}
+	if err != nil {
+		log.Tracef("serving a benchmark stream: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+package server
+
+import "testing"
+
+func TestParseProxyBook_Bench(t *testing.T) {
+	proxyBook, err := parseProxyBook(map[string][]string{"echo": {"echo"}, "sink": {"Discard"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := proxyBook["echo"]; !ok || addr.Network() != "echo" {
+		t.Errorf("expecting an echo proxy method, got %v", addr)
+	}
+	if addr, ok := proxyBook["sink"]; !ok || addr.Network() != "discard" {
+		t.Errorf("expecting a discard proxy method, got %v", addr)
+	}
+}
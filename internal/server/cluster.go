@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
+)
+
+// ck-servers behind a load balancer share what has to be known across them in Redis at ClusterRedisURL, so that a
+// handshake replayed to another of them is still caught, and a user's SessionsCap and MaxSourceIPs count its
+// sessions on all of them:
+//
+//   - the random of each handshake is the key ck:replay:<random in base64>, which expires after ClusterReplayTTL
+//   - the sessions of each user are the sorted set ck:sessions:<UID in base64> of "<node> <session ID> <source IP>",
+//     scored by when they expire. Each node renews its own every third of ClusterSessionTTL, so that those of a node
+//     that has gone away are dropped
+//
+// Each node still keeps its own replay cache, and carries on with only that and its own sessions while Redis can't
+// be reached. Every call to Redis is given up on after clusterCallTimeout, as handshakes wait on them
+
+const defaultClusterSessionTTL = 60 * time.Second
+
+const clusterCallTimeout = 500 * time.Millisecond
+
+// a handshake's timestamp is accepted from the start of the epoch before it until TIMESTAMP_TOLERANCE after it, so
+// its random has to be remembered for that long after it's first seen
+const minClusterReplayTTL = 2 * TIMESTAMP_TOLERANCE
+
+type clusterRegistry struct {
+	redis *usermanager.RedisClient
+	world common.WorldState
+	// tells the sessions of this node apart from those of others
+	node       string
+	replayTTL  time.Duration
+	sessionTTL time.Duration
+}
+
+// clusterSession is a session of a user on a node
+type clusterSession struct {
+	node      string
+	sessionID uint32
+	sourceIP  string
+}
+
+func (s clusterSession) member() string {
+	return fmt.Sprintf("%v %v %v", s.node, s.sessionID, s.sourceIP)
+}
+
+func parseClusterSession(member string) (s clusterSession, ok bool) {
+	fields := strings.SplitN(member, " ", 3)
+	if len(fields) != 3 {
+		return s, false
+	}
+	sessionID, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		return s, false
+	}
+	return clusterSession{node: fields[0], sessionID: uint32(sessionID), sourceIP: fields[2]}, true
+}
+
+// parseCluster connects to the Redis of ClusterRedisURL of preParse. The registry is nil if it's empty
+func parseCluster(preParse RawConfig, worldState common.WorldState) (*clusterRegistry, error) {
+	if preParse.ClusterRedisURL == "" {
+		return nil, nil
+	}
+	if preParse.ClusterReplayTTL < 0 || preParse.ClusterSessionTTL < 0 {
+		return nil, errors.New("ClusterReplayTTL and ClusterSessionTTL can't be negative")
+	}
+	cluster := &clusterRegistry{
+		world:      worldState,
+		replayTTL:  minClusterReplayTTL,
+		sessionTTL: defaultClusterSessionTTL,
+	}
+	if preParse.ClusterReplayTTL != 0 {
+		cluster.replayTTL = time.Duration(preParse.ClusterReplayTTL) * time.Second
+		if cluster.replayTTL < minClusterReplayTTL {
+			return nil, fmt.Errorf("ClusterReplayTTL can't be shorter than %v seconds, for which handshakes can be replayed", int(minClusterReplayTTL/time.Second))
+		}
+	}
+	if preParse.ClusterSessionTTL != 0 {
+		cluster.sessionTTL = time.Duration(preParse.ClusterSessionTTL) * time.Second
+	}
+	var node [8]byte
+	common.RandRead(worldState.Rand, node[:])
+	cluster.node = hex.EncodeToString(node[:])
+	var err error
+	cluster.redis, err = usermanager.OpenRedis(preParse.ClusterRedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to ClusterRedisURL: %v", err)
+	}
+	return cluster, nil
+}
+
+// callContext bounds a call to Redis by clusterCallTimeout
+func callContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), clusterCallTimeout)
+}
+
+// registerRandom remembers random, returning whether another node, or this one, has seen it before
+func (cluster *clusterRegistry) registerRandom(random [32]byte) (bool, error) {
+	key := "ck:replay:" + base64.StdEncoding.EncodeToString(random[:])
+	ctx, cancel := callContext()
+	defer cancel()
+	reply, err := cluster.redis.DoContext(ctx, "SET", key, "1", "NX", "EX", strconv.Itoa(int(cluster.replayTTL/time.Second)))
+	if err != nil {
+		return false, err
+	}
+	// the key isn't set if it exists
+	return reply == nil, nil
+}
+
+func clusterSessionsKey(arrUID [16]byte) string {
+	return "ck:sessions:" + base64.StdEncoding.EncodeToString(arrUID[:])
+}
+
+// remoteSessions returns the sessions of a user on the other nodes
+func (cluster *clusterRegistry) remoteSessions(arrUID [16]byte) ([]clusterSession, error) {
+	key := clusterSessionsKey(arrUID)
+	now := strconv.FormatInt(cluster.world.Now().Unix(), 10)
+	ctx, cancel := callContext()
+	defer cancel()
+	if _, err := cluster.redis.DoContext(ctx, "ZREMRANGEBYSCORE", key, "-inf", now); err != nil {
+		return nil, err
+	}
+	reply, err := cluster.redis.DoContext(ctx, "ZRANGEBYSCORE", key, "("+now, "+inf")
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	var sessions []clusterSession
+	for _, member := range members {
+		b, _ := member.([]byte)
+		s, ok := parseClusterSession(string(b))
+		if ok && s.node != cluster.node {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// addRemoteSessions adds the sessions of a user on the other nodes to what's known of it to authorise a new session
+func (cluster *clusterRegistry) addRemoteSessions(arrUID [16]byte, ainfo *usermanager.AuthorisationInfo) {
+	sessions, err := cluster.remoteSessions(arrUID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"UID":   b64(arrUID[:]),
+			"error": err,
+		}).Warn("failed to read the sessions of a user on other nodes")
+		return
+	}
+	ainfo.NumExistingSessions += len(sessions)
+	seen := make(map[string]struct{})
+	for _, ip := range ainfo.ExistingSourceIPs {
+		seen[ip] = struct{}{}
+	}
+	for _, s := range sessions {
+		if _, ok := seen[s.sourceIP]; !ok {
+			seen[s.sourceIP] = struct{}{}
+			ainfo.ExistingSourceIPs = append(ainfo.ExistingSourceIPs, s.sourceIP)
+		}
+	}
+}
+
+// keep registers sessions of a user on this node, or renews them
+func (cluster *clusterRegistry) keep(arrUID [16]byte, sessionIPs map[uint32]string) error {
+	if len(sessionIPs) == 0 {
+		return nil
+	}
+	key := clusterSessionsKey(arrUID)
+	expiry := strconv.FormatInt(cluster.world.Now().Add(cluster.sessionTTL).Unix(), 10)
+	zadd := []string{"ZADD", key}
+	for sessionID, ip := range sessionIPs {
+		zadd = append(zadd, expiry, clusterSession{node: cluster.node, sessionID: sessionID, sourceIP: ip}.member())
+	}
+	ctx, cancel := callContext()
+	defer cancel()
+	return cluster.redis.TransactContext(ctx, zadd, []string{"EXPIRE", key, strconv.Itoa(int(cluster.sessionTTL / time.Second))})
+}
+
+// drop unregisters sessions of a user on this node
+func (cluster *clusterRegistry) drop(arrUID [16]byte, sessionIPs map[uint32]string) error {
+	if len(sessionIPs) == 0 {
+		return nil
+	}
+	zrem := []string{"ZREM", clusterSessionsKey(arrUID)}
+	for sessionID, ip := range sessionIPs {
+		zrem = append(zrem, clusterSession{node: cluster.node, sessionID: sessionID, sourceIP: ip}.member())
+	}
+	ctx, cancel := callContext()
+	defer cancel()
+	_, err := cluster.redis.DoContext(ctx, zrem...)
+	return err
+}
+
+// logError logs a failure to share the sessions of a user
+func (cluster *clusterRegistry) logError(arrUID [16]byte, err error) {
+	if err != nil {
+		log.WithFields(log.Fields{
+			"UID":   b64(arrUID[:]),
+			"error": err,
+		}).Warn("failed to share the sessions of a user with other nodes")
+	}
+}
+
+// regularRenew renews the sessions of the users of panel every third of sessionTTL until stop is closed
+func (cluster *clusterRegistry) regularRenew(panel *userPanel, stop <-chan struct{}) {
+	ticker := time.NewTicker(cluster.sessionTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for arrUID, sessionIPs := range panel.sessionIPs() {
+			cluster.logError(arrUID, cluster.keep(arrUID, sessionIPs))
+		}
+	}
+}
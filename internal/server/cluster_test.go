@@ -0,0 +1,348 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+// fakeClusterRedis serves the commands that clusterRegistry sends
+type fakeClusterRedis struct {
+	m       sync.Mutex
+	strings map[string]string
+	// member to score of each sorted set
+	zsets map[string]map[string]int64
+}
+
+func startFakeClusterRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	fake := &fakeClusterRedis{strings: make(map[string]string), zsets: make(map[string]map[string]int64)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// readCommand reads a command as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, length+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:length])
+	}
+	return args, nil
+}
+
+func (fake *fakeClusterRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		switch {
+		case args[0] == "MULTI":
+			inMulti = true
+			io.WriteString(conn, "+OK\r\n")
+		case args[0] == "EXEC":
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "*%d\r\n", len(queued))
+			for _, cmd := range queued {
+				b.WriteString(fake.do(cmd))
+			}
+			queued, inMulti = nil, false
+			conn.Write(b.Bytes())
+		case inMulti:
+			queued = append(queued, args)
+			io.WriteString(conn, "+QUEUED\r\n")
+		default:
+			io.WriteString(conn, fake.do(args))
+		}
+	}
+}
+
+func (fake *fakeClusterRedis) do(args []string) string {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	score := func(s string) int64 {
+		switch s {
+		case "-inf":
+			return -1 << 62
+		case "+inf":
+			return 1 << 62
+		}
+		n, _ := strconv.ParseInt(strings.TrimPrefix(s, "("), 10, 64)
+		if strings.HasPrefix(s, "(") {
+			n++
+		}
+		return n
+	}
+	switch args[0] {
+	case "SET":
+		if _, ok := fake.strings[args[1]]; ok {
+			return "$-1\r\n"
+		}
+		fake.strings[args[1]] = args[2]
+		return "+OK\r\n"
+	case "ZADD":
+		if fake.zsets[args[1]] == nil {
+			fake.zsets[args[1]] = make(map[string]int64)
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			fake.zsets[args[1]][args[i+1]] = score(args[i])
+		}
+		return ":1\r\n"
+	case "ZREM":
+		for _, member := range args[2:] {
+			delete(fake.zsets[args[1]], member)
+		}
+		return ":1\r\n"
+	case "ZREMRANGEBYSCORE":
+		for member, s := range fake.zsets[args[1]] {
+			if s >= score(args[2]) && s <= score(args[3]) {
+				delete(fake.zsets[args[1]], member)
+			}
+		}
+		return ":1\r\n"
+	case "ZRANGEBYSCORE":
+		var members []string
+		for member, s := range fake.zsets[args[1]] {
+			if s >= score(args[2]) && s <= score(args[3]) {
+				members = append(members, member)
+			}
+		}
+		sort.Strings(members)
+		reply := fmt.Sprintf("*%d\r\n", len(members))
+		for _, member := range members {
+			reply += fmt.Sprintf("$%d\r\n%s\r\n", len(member), member)
+		}
+		return reply
+	case "EXPIRE":
+		return ":1\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestParseCluster(t *testing.T) {
+	cluster, err := parseCluster(RawConfig{}, mockWorldState)
+	if err != nil || cluster != nil {
+		t.Errorf("expecting no cluster, got %v, %v", cluster, err)
+	}
+	addr := startFakeClusterRedis(t)
+	if _, err = parseCluster(RawConfig{ClusterRedisURL: "redis://" + addr, ClusterReplayTTL: 60}, mockWorldState); err == nil {
+		t.Error("ClusterReplayTTL shorter than the timestamp window should fail")
+	}
+	if _, err = parseCluster(RawConfig{ClusterRedisURL: "http://" + addr}, mockWorldState); err == nil {
+		t.Error("a URL that isn't redis:// should fail")
+	}
+	cluster, err = parseCluster(RawConfig{ClusterRedisURL: "redis://" + addr}, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cluster.replayTTL != 2*TIMESTAMP_TOLERANCE || cluster.sessionTTL != defaultClusterSessionTTL {
+		t.Errorf("unexpected TTLs %v, %v", cluster.replayTTL, cluster.sessionTTL)
+	}
+}
+
+func TestCluster_Replay(t *testing.T) {
+	addr := startFakeClusterRedis(t)
+	makeNode := func() *State {
+		cluster, err := parseCluster(RawConfig{ClusterRedisURL: "redis://" + addr}, mockWorldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &State{
+			WorldState:  mockWorldState,
+			replayCache: newReplayCache(defaultReplayCacheCapacity, mockWorldState),
+			cluster:     cluster,
+		}
+	}
+	a, b := makeNode(), makeNode()
+
+	var random [32]byte
+	common.CryptoRandRead(random[:])
+	if a.registerRandom(random, mockWorldState.Now()) {
+		t.Error("a new random was taken as a replay")
+	}
+	if !b.registerRandom(random, mockWorldState.Now()) {
+		t.Error("a random replayed to another node wasn't caught")
+	}
+	if !a.registerRandom(random, mockWorldState.Now()) {
+		t.Error("a random replayed to the same node wasn't caught")
+	}
+}
+
+func TestCluster_Sessions(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	UID, _ := base64.StdEncoding.DecodeString("u97xvcc5YoQA8obCyt9q/w==")
+	err = manager.WriteUserInfo(usermanager.UserInfo{
+		UID:          UID,
+		SessionsCap:  2,
+		UpRate:       1e6,
+		DownRate:     1e6,
+		UpCredit:     1e9,
+		DownCredit:   1e9,
+		ExpiryTime:   time.Now().Add(time.Hour).Unix(),
+		MaxSourceIPs: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := startFakeClusterRedis(t)
+	makeNode := func() *ActiveUser {
+		cluster, err := parseCluster(RawConfig{ClusterRedisURL: "redis://" + addr}, common.RealWorldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		panel := MakeUserPanel(manager, common.RealWorldState)
+		panel.cluster = cluster
+		user, err := panel.GetUser(UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return user
+	}
+	a, b := makeNode(), makeNode()
+
+	if _, _, err = a.GetSession(1, "shadowsocks", "192.0.2.1", getSeshConfig(false)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = b.GetSession(2, "shadowsocks", "192.0.2.2", getSeshConfig(false)); err != usermanager.ErrSourceIPsCapReached {
+		t.Errorf("another address on another node: expecting %v, got %v", usermanager.ErrSourceIPsCapReached, err)
+	}
+	if _, _, err = b.GetSession(2, "shadowsocks", "192.0.2.1", getSeshConfig(false)); err != nil {
+		t.Errorf("the same address on another node: %v", err)
+	}
+	if _, _, err = a.GetSession(3, "shadowsocks", "192.0.2.1", getSeshConfig(false)); err != usermanager.ErrSessionsCapReached {
+		t.Errorf("expecting %v, got %v", usermanager.ErrSessionsCapReached, err)
+	}
+
+	b.CloseSession(2, "")
+	if _, _, err = a.GetSession(3, "shadowsocks", "192.0.2.1", getSeshConfig(false)); err != nil {
+		t.Errorf("after a session on another node closed: %v", err)
+	}
+}
+
+func TestCluster_Unresponsive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// accepts connections but never replies to anything sent on them
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	cluster, err := parseCluster(RawConfig{ClusterRedisURL: "redis://" + l.Addr().String()}, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := &State{
+		WorldState:  mockWorldState,
+		replayCache: newReplayCache(defaultReplayCacheCapacity, mockWorldState),
+		cluster:     cluster,
+	}
+
+	var random [32]byte
+	common.CryptoRandRead(random[:])
+	start := time.Now()
+	if sta.registerRandom(random, mockWorldState.Now()) {
+		t.Error("a new random was taken as a replay")
+	}
+	if elapsed := time.Since(start); elapsed > 4*clusterCallTimeout {
+		t.Errorf("registering a random took %v", elapsed)
+	}
+	if !sta.registerRandom(random, mockWorldState.Now()) {
+		t.Error("a replay wasn't caught by the local replay cache")
+	}
+}
+
+func TestCluster_StopRenewing(t *testing.T) {
+	addr := startFakeClusterRedis(t)
+	cluster, err := parseCluster(RawConfig{ClusterRedisURL: "redis://" + addr}, common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster.sessionTTL = 30 * time.Millisecond
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+	panel := MakeUserPanel(manager, common.RealWorldState)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		cluster.regularRenew(panel, stop)
+		close(stopped)
+	}()
+	time.Sleep(2 * cluster.sessionTTL)
+	close(stop)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("regularRenew didn't stop")
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// a user with less than this much of either credit left is warned
+const defaultLowCreditWarning = 100 * 1024 * 1024
+
+const defaultLowCreditCheckInterval = 10 * time.Second
+
+// quotaOf returns what a user has left, as of its limits and what it has used since they were read. It's false
+// if the limits of the user haven't been read
+func (panel *userPanel) quotaOf(user *ActiveUser) (common.Quota, bool) {
+	if user.bypass {
+		return common.Quota{Unlimited: true}, true
+	}
+	limits, ok := user.limits.Load().(userLimits)
+	if !ok {
+		return common.Quota{}, false
+	}
+	up, down := panel.pendingUsage(user)
+	return common.Quota{
+		UpCredit:   limits.upCredit - up,
+		DownCredit: limits.downCredit - down,
+		ExpiryTime: limits.expiryTime,
+	}, true
+}
+
+// isLow is whether a quota is short enough of credit to be warned about
+func (panel *userPanel) isLow(quota common.Quota) bool {
+	if quota.Unlimited || panel.lowCreditWarning < 0 {
+		return false
+	}
+	return quota.UpCredit < panel.lowCreditWarning || quota.DownCredit < panel.lowCreditWarning
+}
+
+// servers returns ServerList as last reloaded
+func (sta *State) servers() []string {
+	sta.reloadM.RLock()
+	defer sta.reloadM.RUnlock()
+	return sta.serverList
+}
+
+// serveControl answers the quota and server list queries of a user on a control stream and warns it once its credit
+// runs low, until the stream is closed. servers is what the server list queries are answered with
+func serveControl(stream net.Conn, user *ActiveUser, servers []string) {
+	defer stream.Close()
+	panel := user.panel
+
+	queries := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(queries)
+		buf := make([]byte, 1024)
+		for {
+			n, err := stream.Read(buf)
+			if err != nil {
+				return
+			}
+			var msg common.ControlMessage
+			if err := json.Unmarshal(buf[:n], &msg); err != nil {
+				log.Debugf("malformed control message: %v", err)
+				continue
+			}
+			if msg.Type != common.MSG_QUERY_QUOTA && msg.Type != common.MSG_QUERY_SERVERS {
+				log.Debugf("unknown control message %v", msg.Type)
+				continue
+			}
+			select {
+			case queries <- msg.Type:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	send := func(msgType string, quota common.Quota) error {
+		msg, _ := json.Marshal(common.ControlMessage{Type: msgType, Quota: &quota})
+		_, err := stream.Write(msg)
+		return err
+	}
+
+	ticker := time.NewTicker(panel.lowCreditCheckInterval)
+	defer ticker.Stop()
+	// so that a user is warned once, and again if its credit runs low after being topped up
+	warned := false
+	for {
+		select {
+		case query, ok := <-queries:
+			if !ok {
+				return
+			}
+			if query == common.MSG_QUERY_SERVERS {
+				msg, _ := json.Marshal(common.ControlMessage{Type: common.MSG_SERVERS, Servers: servers})
+				if _, err := stream.Write(msg); err != nil {
+					return
+				}
+				continue
+			}
+			quota, ok := panel.quotaOf(user)
+			if !ok {
+				continue
+			}
+			if err := send(common.MSG_QUOTA, quota); err != nil {
+				return
+			}
+		case <-ticker.C:
+			quota, ok := panel.quotaOf(user)
+			if !ok {
+				continue
+			}
+			low := panel.isLow(quota)
+			if low && !warned {
+				if err := send(common.MSG_LOW_CREDIT, quota); err != nil {
+					return
+				}
+			}
+			warned = low
+		}
+	}
+}
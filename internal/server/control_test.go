@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+func readControlMessage(t *testing.T, conn net.Conn) common.ControlMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg common.ControlMessage
+	if err := json.Unmarshal(buf[:n], &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func queryQuota(t *testing.T, conn net.Conn) common.ControlMessage {
+	t.Helper()
+	query, _ := json.Marshal(common.ControlMessage{Type: common.MSG_QUERY_QUOTA})
+	if _, err := conn.Write(query); err != nil {
+		t.Fatal(err)
+	}
+	return readControlMessage(t, conn)
+}
+
+func TestServeControl(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	mgr, err := usermanager.MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(mgr, mockWorldState)
+	panel.lowCreditWarning = validUserInfo.UpCredit/2 + 1
+	panel.lowCreditCheckInterval = 10 * time.Millisecond
+	_ = mgr.WriteUserInfo(validUserInfo)
+	user, err := panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("query quota", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveControl(server, user, nil)
+
+		user.valve.AddTx(100)
+		msg := queryQuota(t, client)
+		if msg.Type != common.MSG_QUOTA || msg.Quota == nil {
+			t.Fatalf("unexpected reply %+v", msg)
+		}
+		expected := common.Quota{
+			UpCredit:   validUserInfo.UpCredit,
+			DownCredit: validUserInfo.DownCredit - 100,
+			ExpiryTime: validUserInfo.ExpiryTime,
+		}
+		if *msg.Quota != expected {
+			t.Errorf("expecting %+v, got %+v", expected, *msg.Quota)
+		}
+	})
+
+	t.Run("unknown messages are ignored", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveControl(server, user, nil)
+
+		client.Write([]byte("not json"))
+		unknown, _ := json.Marshal(common.ControlMessage{Type: "top_up"})
+		client.Write(unknown)
+		if msg := queryQuota(t, client); msg.Type != common.MSG_QUOTA {
+			t.Errorf("unexpected reply %+v", msg)
+		}
+	})
+
+	t.Run("query servers", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		servers := []string{"203.0.113.1:443", "cloak.example.com:443"}
+		go serveControl(server, user, servers)
+
+		query, _ := json.Marshal(common.ControlMessage{Type: common.MSG_QUERY_SERVERS})
+		client.Write(query)
+		msg := readControlMessage(t, client)
+		if msg.Type != common.MSG_SERVERS || len(msg.Servers) != 2 || msg.Servers[1] != servers[1] {
+			t.Errorf("unexpected reply %+v", msg)
+		}
+	})
+
+	t.Run("bypass user", func(t *testing.T) {
+		bypassUser, _ := panel.GetBypassUser(make([]byte, 16))
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveControl(server, bypassUser, nil)
+
+		if msg := queryQuota(t, client); msg.Quota == nil || !msg.Quota.Unlimited {
+			t.Errorf("expecting an unlimited quota, got %+v", msg)
+		}
+	})
+
+	t.Run("low credit warning", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go serveControl(server, user, nil)
+
+		user.valve.AddRx(validUserInfo.UpCredit / 2)
+		msg := readControlMessage(t, client)
+		if msg.Type != common.MSG_LOW_CREDIT {
+			t.Fatalf("expecting %v, got %+v", common.MSG_LOW_CREDIT, msg)
+		}
+		if msg.Quota.UpCredit != validUserInfo.UpCredit/2 {
+			t.Errorf("expecting %v of up credit left, got %v", validUserInfo.UpCredit/2, msg.Quota.UpCredit)
+		}
+
+		// warned only once
+		client.SetReadDeadline(time.Now().Add(5 * panel.lowCreditCheckInterval))
+		if _, err := client.Read(make([]byte, 1024)); err == nil {
+			t.Error("warned again")
+		}
+	})
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// The dashboard is a static page served on AdminAPIAddr alongside the admin API v2. It asks for AdminAPIToken and
+// does everything through the API from the browser, so the page itself needs no authentication
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	files, _ := fs.Sub(dashboardFiles, "dashboard")
+	return http.FileServer(http.FS(files))
+}
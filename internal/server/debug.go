@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	rpprof "runtime/pprof"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// Debugging endpoints are served on AdminAPIAddr under /debug, behind AdminAPIToken like the admin API, so that leaks
+// in a long running ck-server can be looked into without rebuilding it:
+//
+//	/debug/pprof/      the profiles of net/http/pprof, e.g. go tool pprof of /debug/pprof/heap
+//	/debug/goroutines  the stacks of all goroutines in text
+//	/debug/state       the sizes of what ck-server keeps in memory, in JSON
+
+// DebugState is the size of what ck-server keeps in memory, which shouldn't grow without bound
+type DebugState struct {
+	Goroutines  int
+	HeapAlloc   uint64
+	HeapObjects uint64
+
+	ReplayCacheEntries  int
+	ReplayCacheCapacity int
+	ActiveUsers         int
+	ActiveSessions      int
+	// addresses admitted by knocks that haven't been forgotten yet, expired or not
+	KnockAdmissions int
+	// connections held in the tarpit
+	Tarpitted int
+}
+
+func (sta *State) debugState() DebugState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	state := DebugState{
+		Goroutines:          runtime.NumGoroutine(),
+		HeapAlloc:           mem.HeapAlloc,
+		HeapObjects:         mem.HeapObjects,
+		ReplayCacheEntries:  sta.replayCache.size(),
+		ReplayCacheCapacity: sta.replayCache.capacity,
+	}
+	if sta.Panel != nil {
+		state.ActiveUsers, state.ActiveSessions = sta.Panel.numActive()
+	}
+	sta.knocks.m.Lock()
+	state.KnockAdmissions = len(sta.knocks.admitted)
+	sta.knocks.m.Unlock()
+	if sta.tarpit != nil {
+		state.Tarpitted = int(sta.tarpit.held.Load())
+	}
+	return state
+}
+
+func (api *adminAPI) debugStateHlr(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, api.sta.debugState())
+}
+
+func goroutinesHlr(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_ = rpprof.Lookup("goroutine").WriteTo(w, 2)
+}
+
+// handleDebug adds the debugging endpoints to debug, which is the subrouter of /debug
+func (api *adminAPI) handleDebug(debug *gmux.Router) {
+	debug.HandleFunc("/state", api.debugStateHlr).Methods("GET")
+	debug.HandleFunc("/goroutines", goroutinesHlr).Methods("GET")
+	debug.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/pprof/trace", pprof.Trace)
+	// the index, and the profiles it lists by their names, e.g. /debug/pprof/heap
+	debug.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+}
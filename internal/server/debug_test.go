@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAPI_debug(t *testing.T) {
+	sta := makeAdminAPIState(t, "127.0.0.1:0")
+	handler := AdminAPIHandler(sta)
+
+	t.Run("unauthorised", func(t *testing.T) {
+		for _, path := range []string{"/debug/state", "/debug/goroutines", "/debug/pprof/", "/debug/pprof/heap"} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if rec.Code != http.StatusUnauthorized {
+				t.Errorf("%v: expecting status 401, got %v", path, rec.Code)
+			}
+		}
+	})
+
+	t.Run("state", func(t *testing.T) {
+		rec := adminRequest(handler, "GET", "/debug/state", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expecting status 200, got %v", rec.Code)
+		}
+		var state DebugState
+		if err := json.Unmarshal(rec.Body.Bytes(), &state); err != nil {
+			t.Fatal(err)
+		}
+		if state.Goroutines == 0 || state.HeapAlloc == 0 {
+			t.Errorf("runtime statistics missing: %+v", state)
+		}
+		if state.ReplayCacheCapacity != defaultReplayCacheCapacity {
+			t.Errorf("expecting replay cache capacity %v, got %v", defaultReplayCacheCapacity, state.ReplayCacheCapacity)
+		}
+	})
+
+	t.Run("goroutines", func(t *testing.T) {
+		rec := adminRequest(handler, "GET", "/debug/goroutines", "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine ") {
+			t.Errorf("expecting a goroutine dump, got %v: %.100v", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("pprof", func(t *testing.T) {
+		rec := adminRequest(handler, "GET", "/debug/pprof/", "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "heap") {
+			t.Errorf("expecting the index of profiles, got %v", rec.Code)
+		}
+		rec = adminRequest(handler, "GET", "/debug/pprof/heap", "")
+		if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+			t.Errorf("expecting the heap profile, got %v", rec.Code)
+		}
+		rec = adminRequest(handler, "GET", "/debug/pprof/cmdline", "")
+		if rec.Code != http.StatusOK {
+			t.Errorf("expecting the command line, got %v", rec.Code)
+		}
+	})
+}
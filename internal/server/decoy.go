@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/server/geoip"
+	log "github.com/sirupsen/logrus"
+)
+
+// Connections that fail authentication are sent to the redirection server, unless the decoy policy says otherwise for
+// the country or the AS they're from
+const (
+	DECOY_REDIRECT = "redirect"
+	DECOY_RESET    = "reset"
+	// needs TarpitDuration
+	DECOY_TARPIT = "tarpit"
+)
+
+// geoLocator tells where an IP address is, from a geoip.DB
+type geoLocator interface {
+	Country(ip net.IP) (string, error)
+	ASN(ip net.IP) (uint, error)
+}
+
+type decoyPolicy struct {
+	databases []geoLocator
+	// by upper case ISO 3166-1 code
+	byCountry map[string]string
+	byASN     map[uint]string
+}
+
+func parseDecoyAction(action string, preParse RawConfig) (string, error) {
+	switch strings.ToLower(action) {
+	case DECOY_REDIRECT:
+		return DECOY_REDIRECT, nil
+	case DECOY_RESET:
+		return DECOY_RESET, nil
+	case DECOY_TARPIT:
+		if preParse.TarpitDuration <= 0 {
+			return "", fmt.Errorf("decoy action %v needs TarpitDuration", action)
+		}
+		return DECOY_TARPIT, nil
+	}
+	return "", fmt.Errorf("unknown decoy action %v", action)
+}
+
+// parseDecoyPolicy reads GeoIPDatabases, DecoyByCountry and DecoyByASN of preParse. The policy is nil if there's
+// nothing in it
+func parseDecoyPolicy(preParse RawConfig) (*decoyPolicy, error) {
+	if len(preParse.DecoyByCountry) == 0 && len(preParse.DecoyByASN) == 0 {
+		return nil, nil
+	}
+	if len(preParse.GeoIPDatabases) == 0 {
+		return nil, fmt.Errorf("DecoyByCountry and DecoyByASN need GeoIPDatabases")
+	}
+	policy := &decoyPolicy{
+		byCountry: make(map[string]string),
+		byASN:     make(map[uint]string),
+	}
+	for country, action := range preParse.DecoyByCountry {
+		action, err := parseDecoyAction(action, preParse)
+		if err != nil {
+			return nil, fmt.Errorf("DecoyByCountry of %v: %v", country, err)
+		}
+		policy.byCountry[strings.ToUpper(country)] = action
+	}
+	for asn, action := range preParse.DecoyByASN {
+		// both 4134 and AS4134
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(asn), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("bad AS number %v in DecoyByASN", asn)
+		}
+		action, err := parseDecoyAction(action, preParse)
+		if err != nil {
+			return nil, fmt.Errorf("DecoyByASN of %v: %v", asn, err)
+		}
+		policy.byASN[uint(number)] = action
+	}
+	databases, err := openGeoIPDatabases(preParse.GeoIPDatabases)
+	if err != nil {
+		return nil, err
+	}
+	policy.databases = databases
+	return policy, nil
+}
+
+// openGeoIPDatabases opens the GeoIP databases at paths
+func openGeoIPDatabases(paths []string) ([]geoLocator, error) {
+	var databases []geoLocator
+	for _, path := range paths {
+		db, err := geoip.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open GeoIP database: %v", err)
+		}
+		databases = append(databases, db)
+	}
+	return databases, nil
+}
+
+// actionOf returns how a connection from ip is turned away, and the country and the AS it's from as far as they're
+// known
+func (policy *decoyPolicy) actionOf(ip net.IP) (action string, country string, asn uint) {
+	for _, db := range policy.databases {
+		var err error
+		if country == "" {
+			country, err = db.Country(ip)
+		}
+		if asn == 0 && err == nil {
+			asn, err = db.ASN(ip)
+		}
+		if err != nil {
+			log.WithField("remoteAddr", ip).Debugf("failed to look up in a GeoIP database: %v", err)
+		}
+	}
+	if action, ok := policy.byASN[asn]; ok && asn != 0 {
+		return action, country, asn
+	}
+	if action, ok := policy.byCountry[strings.ToUpper(country)]; ok && country != "" {
+		return action, country, asn
+	}
+	return DECOY_REDIRECT, country, asn
+}
+
+// decoy returns what to do with conn once it's failed authentication, which is goWeb unless the decoy policy turns
+// away connections from where conn is from in another way
+func (sta *State) decoy(conn net.Conn, goWeb func()) func() {
+	return func() {
+		sta.reloadM.RLock()
+		policy := sta.decoyPolicy
+		sta.reloadM.RUnlock()
+		if policy == nil {
+			goWeb()
+			return
+		}
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+		if ip == nil {
+			goWeb()
+			return
+		}
+		action, country, asn := policy.actionOf(ip)
+		if action == DECOY_REDIRECT {
+			goWeb()
+			return
+		}
+		log.WithFields(log.Fields{
+			"remoteAddr": conn.RemoteAddr(),
+			"country":    country,
+			"ASN":        asn,
+			"action":     action,
+		}).Debug("turning away an unauthenticated connection by the decoy policy")
+		if action == DECOY_TARPIT {
+			if sta.tarpit == nil || !sta.tarpit.hold(conn, sta.WorldState) {
+				goWeb()
+			}
+			return
+		}
+		resetConn(conn)
+	}
+}
+
+// resetConn closes conn with a reset rather than a FIN, as if from a port nothing listens on. The TCP connection
+// under TLS is reset without a close_notify
+func resetConn(conn net.Conn) {
+	underlying := conn
+	for {
+		if tlsConn, ok := underlying.(*tls.Conn); ok {
+			underlying = tlsConn.NetConn()
+		} else if buffed, ok := underlying.(*firstBuffedConn); ok {
+			underlying = buffed.Conn
+		} else {
+			break
+		}
+	}
+	if tcpConn, ok := underlying.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+		tcpConn.Close()
+		return
+	}
+	conn.Close()
+}
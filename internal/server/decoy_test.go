@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeLocator places the addresses it knows of, and fails for those it doesn't
+type fakeLocator struct {
+	countries map[string]string
+	asns      map[string]uint
+}
+
+var errUnknownAddress = errors.New("unknown address")
+
+func (l fakeLocator) Country(ip net.IP) (string, error) {
+	country, ok := l.countries[ip.String()]
+	if !ok {
+		return "", errUnknownAddress
+	}
+	return country, nil
+}
+
+func (l fakeLocator) ASN(ip net.IP) (uint, error) {
+	return l.asns[ip.String()], nil
+}
+
+func TestParseDecoyPolicy(t *testing.T) {
+	t.Run("empty", func(t *testing.T) {
+		policy, err := parseDecoyPolicy(RawConfig{GeoIPDatabases: []string{"unused.mmdb"}})
+		if err != nil || policy != nil {
+			t.Errorf("expecting no policy, got %v, %v", policy, err)
+		}
+	})
+	bad := map[string]RawConfig{
+		"no databases":                  {DecoyByCountry: map[string]string{"CN": "reset"}},
+		"unknown action":                {GeoIPDatabases: []string{"x.mmdb"}, DecoyByCountry: map[string]string{"CN": "explode"}},
+		"bad AS number":                 {GeoIPDatabases: []string{"x.mmdb"}, DecoyByASN: map[string]string{"ASx": "reset"}},
+		"tarpit without TarpitDuration": {GeoIPDatabases: []string{"x.mmdb"}, DecoyByASN: map[string]string{"4134": "tarpit"}},
+		"missing database":              {GeoIPDatabases: []string{filepath.Join(t.TempDir(), "x.mmdb")}, DecoyByASN: map[string]string{"AS4134": "reset"}},
+	}
+	for name, raw := range bad {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseDecoyPolicy(raw); err == nil {
+				t.Error("expecting an error")
+			}
+		})
+	}
+}
+
+func TestDecoyPolicy_actionOf(t *testing.T) {
+	policy := &decoyPolicy{
+		databases: []geoLocator{
+			fakeLocator{countries: map[string]string{"1.1.1.1": "CN", "2.2.2.2": "CN", "3.3.3.3": "US"}},
+			fakeLocator{
+				countries: map[string]string{"4.4.4.4": "cn"},
+				asns:      map[string]uint{"2.2.2.2": 4134, "3.3.3.3": 4134},
+			},
+		},
+		byCountry: map[string]string{"CN": DECOY_REDIRECT, "US": DECOY_RESET},
+		byASN:     map[uint]string{4134: DECOY_RESET},
+	}
+	tests := []struct {
+		ip      string
+		action  string
+		country string
+		asn     uint
+	}{
+		{"1.1.1.1", DECOY_REDIRECT, "CN", 0},
+		// the AS takes precedence over the country
+		{"2.2.2.2", DECOY_RESET, "CN", 4134},
+		{"3.3.3.3", DECOY_RESET, "US", 4134},
+		// only the second database has it
+		{"4.4.4.4", DECOY_REDIRECT, "cn", 0},
+		{"5.5.5.5", DECOY_REDIRECT, "", 0},
+	}
+	for _, test := range tests {
+		action, country, asn := policy.actionOf(net.ParseIP(test.ip))
+		if action != test.action || country != test.country || asn != test.asn {
+			t.Errorf("%v: expecting %v from %v AS%v, got %v from %v AS%v", test.ip, test.action, test.country,
+				test.asn, action, country, asn)
+		}
+	}
+}
+
+func TestState_decoy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	connect := func() (client net.Conn, server net.Conn) {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err = l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+
+	sta := &State{}
+	t.Run("no policy", func(t *testing.T) {
+		client, server := connect()
+		defer client.Close()
+		defer server.Close()
+		redirected := false
+		sta.decoy(server, func() { redirected = true })()
+		if !redirected {
+			t.Error("not sent to the redirection server without a policy")
+		}
+	})
+
+	sta.decoyPolicy = &decoyPolicy{
+		databases: []geoLocator{fakeLocator{countries: map[string]string{"127.0.0.1": "ZZ"}}},
+		byCountry: map[string]string{"ZZ": DECOY_RESET},
+	}
+	t.Run("reset", func(t *testing.T) {
+		client, server := connect()
+		defer client.Close()
+		redirected := false
+		sta.decoy(server, func() { redirected = true })()
+		if redirected {
+			t.Error("sent to the redirection server despite the policy")
+		}
+		_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := client.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); err == nil || (ok && netErr.Timeout()) {
+			t.Errorf("expecting the connection to be reset, got %v", err)
+		}
+	})
+}
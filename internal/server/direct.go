@@ -0,0 +1,186 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+// A "direct" proxy method, e.g. "direct": ["direct"] in ProxyBook, has no proxy server behind it. Each of its streams
+// starts with the target address to connect it to, and each datagram of its datagram streams with the address to send
+// it to, so that ck-server itself is the proxy server for ck-client's SOCKS5 front-end
+
+var ErrForbiddenTarget = errors.New("target resolves to no address that is allowed")
+
+// how long the target address of a stream may take to arrive
+const directTargetTimeout = 10 * time.Second
+
+// directAddr is the ProxyBook entry of a direct proxy method
+type directAddr struct{}
+
+func (directAddr) Network() string { return "direct" }
+func (directAddr) String() string  { return "" }
+
+// targetAllowed checks if an address that a target resolves to can be connected to. Unless AllowPrivateTargets,
+// clients aren't let in to the network of the server
+func (sta *State) targetAllowed(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	return sta.AllowPrivateTargets || !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast())
+}
+
+// resolveTarget resolves the host of a host:port target to the addresses that are allowed. They are what's connected
+// to, instead of the host, so that a host that resolves differently the next time can't get past targetAllowed. It gives
+// up once ctx is done
+func resolveTarget(ctx context.Context, target string, sta *State) (ips []net.IP, port string, err error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, directTargetTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, addr := range addrs {
+		if sta.targetAllowed(addr.IP) {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, "", ErrForbiddenTarget
+	}
+	return ips, port, nil
+}
+
+// serveDirect connects a stream of a direct proxy method to its target with dialer. If the proxy method has a dial
+// policy, only the addresses of its IP version are connected to, and datagrams are sent from its source address.
+// Resolving and connecting are given up on once ctx, that of the session, is done
+func serveDirect(ctx context.Context, stream *mux.Stream, sta *State, dialer common.Dialer, policy *proxyDialer) {
+	if stream.IsDatagram() {
+		network, laddr := "udp", (*net.UDPAddr)(nil)
+		if policy != nil {
+			network, laddr = "udp"+policy.ipVersion, policy.localUDPAddr()
+		}
+		udpConn, err := net.ListenUDP(network, laddr)
+		if err != nil {
+			log.Errorf("Failed to open UDP socket for direct datagrams: %v", err)
+			stream.Close()
+			return
+		}
+		sta.metrics.streamOpened()
+		relayUDP(&targetedPacketConn{UDPConn: udpConn, ctx: ctx, sta: sta, resolved: make(map[string]*net.UDPAddr)}, stream, sta.UDPTimeout)
+		sta.metrics.streamClosed()
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(directTargetTimeout))
+	target, err := common.ReadTarget(stream)
+	if err != nil {
+		log.Debugf("Failed to read target of direct stream: %v", err)
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+	stream.SetDestination(target)
+
+	ips, port, err := resolveTarget(ctx, target, sta)
+	if err == nil && policy != nil {
+		var allowed []net.IP
+		for _, ip := range ips {
+			if policy.allows(ip) {
+				allowed = append(allowed, ip)
+			}
+		}
+		ips = allowed
+		if len(ips) == 0 {
+			err = fmt.Errorf("no address of IPv%v", policy.ipVersion)
+		}
+	}
+	if err != nil {
+		log.Debugf("Failed to resolve %v: %v", target, err)
+		stream.Close()
+		return
+	}
+	var targetConn net.Conn
+	for _, ip := range ips {
+		targetConn, err = common.DialContext(ctx, dialer, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		log.Debugf("Failed to connect to %v: %v", target, err)
+		stream.Close()
+		return
+	}
+	log.Tracef("direct stream connected to %v", target)
+	sta.metrics.streamOpened()
+	relayStream(targetConn, stream, sta)
+}
+
+// targetedPacketConn is an unconnected UDP socket as a net.Conn of the datagrams of a direct datagram stream: those
+// written to it are sent to the targets they start with, and those read from it start with where they came from
+type targetedPacketConn struct {
+	*net.UDPConn
+	// that of the session, which targets are resolved in
+	ctx context.Context
+	sta *State
+	// targets already resolved, which are only touched by Write
+	resolved map[string]*net.UDPAddr
+	readBuf  [65536]byte
+}
+
+// the most targets resolved by a datagram stream that are remembered
+const maxResolvedTargets = 256
+
+func (c *targetedPacketConn) Read(b []byte) (int, error) {
+	n, from, err := c.UDPConn.ReadFromUDP(c.readBuf[:])
+	if err != nil {
+		return 0, err
+	}
+	header, err := common.MarshalTarget(from.String())
+	if err != nil {
+		return 0, err
+	}
+	i := copy(b, header)
+	return i + copy(b[i:], c.readBuf[:n]), nil
+}
+
+// Write sends a datagram to its target. Datagrams that can't be sent are dropped, like they could have been anywhere
+// else along the way, rather than ending the stream
+func (c *targetedPacketConn) Write(b []byte) (int, error) {
+	target, payload, err := common.SplitTarget(b)
+	if err != nil {
+		log.Debugf("dropping direct datagram: %v", err)
+		return len(b), nil
+	}
+	addr, ok := c.resolved[target]
+	if !ok {
+		ips, port, err := resolveTarget(c.ctx, target, c.sta)
+		if err != nil {
+			log.Debugf("dropping direct datagram to %v: %v", target, err)
+			return len(b), nil
+		}
+		addr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+		if err != nil {
+			return len(b), nil
+		}
+		if len(c.resolved) >= maxResolvedTargets {
+			c.resolved = make(map[string]*net.UDPAddr)
+		}
+		c.resolved[target] = addr
+	}
+	if _, err = c.UDPConn.WriteToUDP(payload, addr); err != nil {
+		log.Debugf("dropping direct datagram to %v: %v", target, err)
+	}
+	return len(b), nil
+}
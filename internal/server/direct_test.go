@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestParseProxyBook_Direct(t *testing.T) {
+	proxyBook, err := parseProxyBook(map[string][]string{"direct": {"direct"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := proxyBook["direct"]; !ok || addr.Network() != "direct" {
+		t.Errorf("expecting a direct proxy method, got %v", addr)
+	}
+}
+
+func TestTargetAllowed(t *testing.T) {
+	sta := &State{}
+	for ip, allowed := range map[string]bool{
+		"203.0.113.1": true,
+		"2001:db8::1": true,
+		"127.0.0.1":   false,
+		"10.0.0.1":    false,
+		"169.254.0.1": false,
+		"fe80::1":     false,
+		"0.0.0.0":     false,
+		"224.0.0.1":   false,
+	} {
+		if sta.targetAllowed(net.ParseIP(ip)) != allowed {
+			t.Errorf("expecting %v to be allowed: %v", ip, allowed)
+		}
+	}
+
+	sta.AllowPrivateTargets = true
+	if !sta.targetAllowed(net.ParseIP("127.0.0.1")) {
+		t.Error("loopback isn't allowed with AllowPrivateTargets")
+	}
+	if sta.targetAllowed(net.ParseIP("0.0.0.0")) {
+		t.Error("unspecified address is allowed with AllowPrivateTargets")
+	}
+}
+
+func TestTargetedPacketConn(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	newConn := func(sta *State) *targetedPacketConn {
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &targetedPacketConn{UDPConn: udpConn, ctx: context.Background(), sta: sta, resolved: make(map[string]*net.UDPAddr)}
+	}
+	target, _ := common.MarshalTarget(echo.LocalAddr().String())
+	datagram := append(target, "hello"...)
+
+	t.Run("allowed target", func(t *testing.T) {
+		conn := newConn(&State{AllowPrivateTargets: true})
+		defer conn.Close()
+		if _, err := conn.Write(datagram); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], datagram) {
+			t.Errorf("expecting %x, got %x", datagram, buf[:n])
+		}
+	})
+
+	t.Run("forbidden target", func(t *testing.T) {
+		conn := newConn(&State{})
+		defer conn.Close()
+		if n, err := conn.Write(datagram); err != nil || n != len(datagram) {
+			t.Errorf("dropping a datagram isn't silent: %v, %v", n, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Read(make([]byte, 1500)); err == nil {
+			t.Error("datagram is sent to loopback")
+		}
+	})
+}
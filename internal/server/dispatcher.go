@@ -3,11 +3,16 @@ package server
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"io"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
@@ -16,7 +21,14 @@ import (
 
 var b64 = base64.StdEncoding.EncodeToString
 
+// Serve accepts connections of all transports on l until it's closed, or draining starts
 func Serve(l net.Listener, sta *State) {
+	go sta.closeOnDrain(l)
+	serve(l, sta, func() listenerConfig { return listenerConfig{} })
+}
+
+// serve accepts connections on l until it's closed, and dispatches them as the config at the time says
+func serve(l net.Listener, sta *State, config func() listenerConfig) {
 	waitDur := [10]time.Duration{
 		50 * time.Millisecond, 100 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond, 1 * time.Second,
 		3 * time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second}
@@ -24,7 +36,9 @@ func Serve(l net.Listener, sta *State) {
 	fails := 0
 	for {
 		conn, err := l.Accept()
-		if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
 			log.Errorf("%v, retrying", err)
 			time.Sleep(waitDur[fails])
 			if fails < 9 {
@@ -33,47 +47,229 @@ func Serve(l net.Listener, sta *State) {
 			continue
 		}
 		fails = 0
-		go dispatchConnection(conn, sta)
+		c := config()
+		if c.knock != "" && !sta.knocked(conn.RemoteAddr()) {
+			go turnAway(conn, c.knock, sta)
+			continue
+		}
+		go dispatchConnection(conn, sta, c.transports)
+	}
+}
+
+// decoyNameOf returns the domain that the first packet is for, i.e. the SNI of a ClientHello or the Host of an HTTP
+// request, to choose the redirection server by. It's empty if there isn't one
+func decoyNameOf(firstPacket []byte) string {
+	if len(firstPacket) == 0 {
+		return ""
+	}
+	if firstPacket[0] == 0x16 {
+		ch, err := parseClientHello(firstPacket)
+		if err != nil {
+			return ""
+		}
+		ext, ok := ch.extensions[sniExtensionType]
+		if !ok {
+			return ""
+		}
+		sni, _ := parseSNI(ext)
+		return sni
+	}
+	for _, line := range strings.Split(string(firstPacket), "\r\n")[1:] {
+		if line == "" {
+			break
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(key, "Host") {
+			host := strings.TrimSpace(value)
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				return hostname
+			}
+			return host
+		}
+	}
+	return ""
+}
+
+// redirectToWeb connects conn to the redirection server and relays between them until either side closes. The first
+// packet which has already been read from conn is sent to the redirection server before anything else, so that
+// whoever is on the other side of conn talks to the cover site as if Cloak isn't there. Cleartext HTTP is served with
+// WebRoot instead if it's set
+func redirectToWeb(conn net.Conn, firstPacket []byte, sta *State) {
+	if sta.webRoot != nil && len(firstPacket) != 0 && firstPacket[0] != 0x16 {
+		serveWebRoot(conn, firstPacket, sta)
+		return
 	}
+	_, localPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+	redirAddr, _ := sta.redirAddr(decoyNameOf(firstPacket), localPort)
+	dialled := time.Now()
+	webConn, err := sta.RedirDialer.Dial("tcp", redirAddr)
+	if err != nil {
+		log.Errorf("Making connection to redirection server: %v", err)
+		conn.Close()
+		return
+	}
+	var answered func()
+	if sta.timing != nil && len(firstPacket) != 0 {
+		answered = func() { sta.timing.redirected(time.Since(dialled)) }
+	}
+	relayToWeb(conn, webConn, firstPacket, answered)
 }
 
-func dispatchConnection(conn net.Conn, sta *State) {
+// relayToWeb sends firstPacket to the redirection server on webConn, then relays between it and conn. answered is
+// called when the redirection server first sends something back, unless it's nil
+func relayToWeb(conn net.Conn, webConn net.Conn, firstPacket []byte, answered func()) {
+	if len(firstPacket) != 0 {
+		_, err := webConn.Write(firstPacket)
+		if err != nil {
+			log.Error("Failed to send first packet to redirection server", err)
+			webConn.Close()
+			conn.Close()
+			return
+		}
+	}
+	// io.Copy between two TCP connections uses splice(2) on Linux.
+	// When one side finishes sending, this is passed onto the other side as a half close so that
+	// any response still in flight gets through
+	var wg sync.WaitGroup
+	relay := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+			_ = cw.CloseWrite()
+			return
+		}
+		dst.Close()
+		src.Close()
+	}
+	wg.Add(2)
+	go relay(webConn, conn)
+	if answered == nil {
+		go relay(conn, webConn)
+	} else {
+		go func() {
+			// the rest is still spliced. An error reading is left for relay to come across again
+			first := make([]byte, 5+16384)
+			if n, _ := webConn.Read(first); n > 0 {
+				answered()
+				if _, err := conn.Write(first[:n]); err != nil {
+					wg.Done()
+					webConn.Close()
+					conn.Close()
+					return
+				}
+			}
+			relay(conn, webConn)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		webConn.Close()
+		conn.Close()
+	}()
+}
+
+// dispatchConnection serves conn as whichever of transports its first packet is of. Anything else is sent to the
+// redirection server
+func dispatchConnection(conn net.Conn, sta *State, transports transportSet) {
 	remoteAddr := conn.RemoteAddr()
 	var err error
-	buf := make([]byte, 1500)
+	buf := make([]byte, 5+16384) // one maximum sized TLS record
 
-	// TODO: potential fingerprint for active probers here
 	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
 	i, err := io.ReadAtLeast(conn, buf, 1)
 	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// A real web server wouldn't close the connection this early. Let the redirection server decide
+			// how long to wait for a connection that has sent nothing
+			log.WithField("remoteAddr", remoteAddr).Debug("nothing has been read after connection is established")
+			conn.SetReadDeadline(time.Time{})
+			redirectToWeb(conn, nil, sta)
+			return
+		}
 		log.WithField("remoteAddr", remoteAddr).
 			Infof("failed to read anything after connection is established: %v", err)
 		conn.Close()
 		return
 	}
+	// a ClientHello with a post-quantum key share doesn't fit in one TCP segment, so read up to the end of the record
+	if i >= 5 && buf[0] == 0x16 {
+		recordLen := 5 + int(binary.BigEndian.Uint16(buf[3:5]))
+		if recordLen > i && recordLen <= len(buf) {
+			var more int
+			more, err = io.ReadFull(conn, buf[i:recordLen])
+			i += more
+			if err != nil {
+				log.WithField("remoteAddr", remoteAddr).Debugf("failed to read the rest of the TLS record: %v", err)
+			}
+		}
+	}
 	conn.SetReadDeadline(time.Time{})
+	// the timing of the response to it is from when it's been read
+	read := time.Now()
 	data := buf[:i]
-
-	goWeb := func() {
-		redirPort := sta.RedirPort
-		if redirPort == "" {
-			_, redirPort, _ = net.SplitHostPort(conn.LocalAddr().String())
+	if i > 5 && buf[0] == 0x16 {
+		// whatever follows the ClientHello, such as the early data of a Cloak client, is left to be read from conn by
+		// whoever it's handed to
+		if recordLen := 5 + int(binary.BigEndian.Uint16(buf[3:5])); recordLen < i {
+			data = buf[:recordLen]
+			conn = &firstBuffedConn{Conn: conn, firstPacket: buf[recordLen:i]}
 		}
-		webConn, err := sta.RedirDialer.Dial("tcp", net.JoinHostPort(sta.RedirHost.String(), redirPort))
-		if err != nil {
-			log.Errorf("Making connection to redirection server: %v", err)
-			return
-		}
-		_, err = webConn.Write(data)
-		if err != nil {
-			log.Error("Failed to send first packet to redirection server", err)
-			return
-		}
-		go io.Copy(webConn, conn)
-		go io.Copy(conn, webConn)
+	}
+
+	// handshakes are limited across tenants
+	limit, metrics := sta.handshakeLimit, sta.metrics
+	if tenant := sta.tenantOf(data); tenant != nil {
+		// from here on, including where it's redirected to if it isn't from a client, it's the tenant's
+		sta = tenant
+	}
+
+	goWeb := func() { redirectToWeb(conn, data, sta) }
+	if data[0] == 0x16 && sta.terminatesTLS() && (transports.allows(RealTLS{}.String()) ||
+		transports.allows(WebSocket{}.String()) || (sta.H2Path != "" && transports.allows(HTTP2{}.String()))) {
+		// a ClientHello that isn't from a Cloak client in TLS mimicry mode is either from a Cloak client in real TLS
+		// or HTTP/2 mode, a CDN in front of clients in CDN mode, or someone visiting the cover site, all of whom expect
+		// our real certificate
+		goWeb = func() { serveRealTLS(conn, data, sta, transports) }
+	} else {
+		// those in real TLS are turned away by the decoy policy once it's terminated, so that clients in real TLS or
+		// CDN mode can still be authenticated
+		goWeb = sta.decoy(conn, goWeb)
+	}
+
+	if isACMEChallenge(data, sta) {
+		serveACMEChallenge(conn, data, sta)
+		return
+	}
+
+	if bytes.HasPrefix(data, h2Preface) && ((sta.GRPCPath != "" && transports.allows(GRPC{}.String())) ||
+		(sta.H2Path != "" && transports.allows(HTTP2{}.String()))) {
+		serveHTTP2(conn, data, "", sta, transports)
+		return
+	}
+
+	if !transports.allowsFirstPacket(data) {
+		sta.timing.hold(read, timingUndecodable)
+		goWeb()
+		return
+	}
+
+	if !limit.allow(remoteAddr) {
+		log.WithField("remoteAddr", remoteAddr).Debug(ErrHandshakeRateLimited)
+		metrics.handshake(ErrHandshakeRateLimited)
+		goWeb()
+		return
 	}
 
 	ci, finishHandshake, err := AuthFirstPacket(data, sta)
+	if errors.Is(err, ErrNotCloak) {
+		// most likely someone visiting the cover site, which isn't worth a warning
+		log.WithField("remoteAddr", remoteAddr).Debug(err)
+		if sta.probes != nil && data[0] == 0x16 && !errors.Is(err, ErrHandshakeOverloaded) {
+			sta.probes.record(data, remoteAddr)
+		}
+		sta.timing.hold(read, timingNotCloak)
+		goWeb()
+		return
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"remoteAddr":       remoteAddr,
@@ -82,24 +278,84 @@ func dispatchConnection(conn net.Conn, sta *State) {
 			"proxyMethod":      ci.ProxyMethod,
 			"encryptionMethod": ci.EncryptionMethod,
 		}).Warn(err)
+		if sta.tarpitted(conn, err) {
+			return
+		}
+		sta.timing.hold(read, timingOutcomeOf(err))
 		goWeb()
 		return
 	}
+	ci.SNI = decoyNameOf(data)
+	if sta.timing != nil {
+		goWeb, finishHandshake = sta.timing.heldClient(read, goWeb, finishHandshake)
+	}
+	serveClient(conn, ci, finishHandshake, sta, goWeb)
+}
+
+// serveClient carries on with an authenticated Cloak connection. goWeb is called if the connection turns out to be
+// unauthorised, before anything has been sent to it
+func serveClient(conn net.Conn, ci ClientInfo, finishHandshake Responder, sta *State, goWeb func()) {
+	remoteAddr := conn.RemoteAddr()
+	var err error
 
 	var sessionKey [32]byte
-	common.RandRead(sta.WorldState.Rand, sessionKey[:])
+	if ci.EarlyData {
+		// the client has already sent frames under it
+		sessionKey = common.EarlySessionKey(ci.sharedSecret[:])
+	} else {
+		common.RandRead(sta.WorldState.Rand, sessionKey[:])
+	}
 	obfuscator, err := mux.MakeObfuscator(ci.EncryptionMethod, sessionKey)
 	if err != nil {
-		log.Error(err)
+		log.WithFields(log.Fields{
+			"UID":              b64(ci.UID),
+			"remoteAddr":       remoteAddr,
+			"encryptionMethod": ci.EncryptionMethod,
+		}).Warn(err)
 		goWeb()
 		return
 	}
+	// the session it's given to wipes its key
+	seshMade := false
+	defer func() {
+		if !seshMade {
+			obfuscator.SessionKey.Wipe()
+		}
+	}()
 
 	seshConfig := mux.SessionConfig{
-		Obfuscator:   obfuscator,
-		Valve:        nil,
-		Unordered:    ci.Unordered,
-		MaxFrameSize: appDataMaxLength,
+		Obfuscator:      obfuscator,
+		Valve:           nil,
+		Unordered:       ci.Unordered,
+		Multipath:       ci.Multipath,
+		Duplicate:       ci.Duplicate,
+		FECDataShards:   ci.FECDataShards,
+		FECParityShards: ci.FECParityShards,
+		Heartbeat:       ci.Heartbeat,
+		TrafficProfile:  ci.TrafficProfile,
+		CloseReasons:    ci.CloseReasons,
+		PeerDrains:      ci.Drains,
+		StreamWindow:    sta.StreamWindow,
+		SessionWindow:   sta.SessionWindow,
+		PeerFlowControl: ci.FlowControl,
+		Compression:     ci.Compression && sta.compresses(ci.ProxyMethod),
+		MaxFrameSize:    appDataMaxLength,
+		// a client of an older version would take the frame for one of a stream
+		Capabilities:         mux.CAP_UNRELIABLE,
+		AnnounceCapabilities: ci.Version >= 1,
+		// the client starts rekeys
+		Rekeys: true,
+	}
+	if seshConfig.Compression {
+		seshConfig.Capabilities |= mux.CAP_COMPRESSION
+	}
+	// the records of the other transports are made by the TLS library
+	if _, ok := ci.Transport.(*TLS); ok {
+		seshConfig.RecordSizing = sta.RecordSizing
+	}
+	if ci.Resumable && sta.ResumeGrace > 0 {
+		seshConfig.ResumeGrace = sta.ResumeGrace
+		seshConfig.PeerResumes = true
 	}
 
 	// adminUID can use the server as normal with unlimited QoS credits. The adminUID is not
@@ -113,20 +369,50 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		}
 		log.Trace("finished handshake")
 		sesh := mux.MakeSession(0, seshConfig)
+		seshMade = true
 		sesh.AddConnection(preparedConn)
 		//TODO: Router could be nil in cnc mode
 		log.WithField("remoteAddr", preparedConn.RemoteAddr()).Info("New admin session")
-		err = http.Serve(sesh, usermanager.APIRouterOf(sta.Panel.Manager))
+		err = http.Serve(sesh, usermanager.APIRouterOf(sta.Panel.Manager, sta.ReloadConfig))
 		if err != nil {
 			log.Error(err)
 			return
 		}
 	}
 
+	sourceIP, _, splitErr := net.SplitHostPort(remoteAddr.String())
+	if splitErr != nil {
+		sourceIP = remoteAddr.String()
+	}
+	// what users subject to credit controls do is watched for abuse
+	observe := func(kind int, err error) {
+		if !sta.IsBypass(ci.UID) && err != ErrSuspended {
+			sta.abuse.observe(UserActivity{
+				Kind: kind,
+				UID:  ci.UID,
+				Time: sta.WorldState.Now(),
+				IP:   net.ParseIP(sourceIP),
+				Err:  err,
+			})
+		}
+	}
+
+	// checked before the user is looked up, as that makes it active
+	if sta.draining() && !sta.Panel.hasSession(ci.UID, ci.SessionId) {
+		log.WithFields(log.Fields{
+			"UID":        b64(ci.UID),
+			"remoteAddr": remoteAddr,
+		}).Info("Refusing a new session while draining")
+		goWeb()
+		return
+	}
+
 	var user *ActiveUser
 	if sta.IsBypass(ci.UID) {
 		user, err = sta.Panel.GetBypassUser(ci.UID)
-	} else {
+	} else if sta.abuse.suspended(ci.UID) {
+		err = ErrSuspended
+	} else if err = sta.Panel.authenticateHandshake(ci); err == nil {
 		user, err = sta.Panel.GetUser(ci.UID)
 	}
 	if err != nil {
@@ -135,19 +421,31 @@ func dispatchConnection(conn net.Conn, sta *State) {
 			"remoteAddr": remoteAddr,
 			"error":      err,
 		}).Warn("+1 unauthorised UID")
+		observe(ACTIVITY_REFUSED, err)
 		goWeb()
 		return
 	}
 
-	sesh, existing, err := user.GetSession(ci.SessionId, seshConfig)
+	sesh, existing, err := user.GetSession(ci.SessionId, ci.ProxyMethod, sourceIP, seshConfig)
 	if err != nil {
 		user.CloseSession(ci.SessionId, "")
-		log.Error(err)
+		log.WithFields(log.Fields{
+			"UID":        b64(ci.UID),
+			"remoteAddr": remoteAddr,
+			"error":      err,
+		}).Warn("+1 unauthorised session")
+		observe(ACTIVITY_REFUSED, err)
+		goWeb()
 		return
 	}
 
 	if existing {
-		preparedConn, err := finishHandshake(conn, sesh.SessionKey, sta.WorldState.Rand)
+		// the connection joins the session under its key
+		if !sesh.SessionKey.Use(func(key []byte) { copy(sessionKey[:], key) }) {
+			log.Debugf("session %v has closed", ci.SessionId)
+			return
+		}
+		preparedConn, err := finishHandshake(conn, sessionKey, sta.WorldState.Rand)
 		if err != nil {
 			log.Error(err)
 			return
@@ -156,6 +454,13 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		sesh.AddConnection(preparedConn)
 		return
 	}
+	seshMade = true
+	user.describeSession(ci.SessionId, sessionDetail{
+		transport:        fmt.Sprint(ci.Transport),
+		encryptionMethod: ci.EncryptionMethod,
+		proxyMethod:      ci.ProxyMethod,
+		opened:           sta.WorldState.Now(),
+	})
 
 	preparedConn, err := finishHandshake(conn, sessionKey, sta.WorldState.Rand)
 	if err != nil {
@@ -168,6 +473,7 @@ func dispatchConnection(conn net.Conn, sta *State) {
 		"UID":       b64(ci.UID),
 		"sessionID": ci.SessionId,
 	}).Info("New session")
+	observe(ACTIVITY_SESSION, nil)
 	sesh.AddConnection(preparedConn)
 
 	for {
@@ -186,28 +492,70 @@ func dispatchConnection(conn net.Conn, sta *State) {
 				continue
 			}
 		}
-		proxyAddr := sta.ProxyBook[ci.ProxyMethod]
-		localConn, err := sta.ProxyDialer.Dial(proxyAddr.Network(), proxyAddr.String())
+		if newStream.(*mux.Stream).IsControl() {
+			go serveControl(newStream, user, sta.servers())
+			continue
+		}
+		proxyAddr, ok := sta.proxyAddr(ci.ProxyMethod)
+		if !ok {
+			// ProxyMethod has been removed from ProxyBook by a reload since the session was opened
+			log.WithField("proxyMethod", ci.ProxyMethod).Warn("proxy method no longer exists")
+			user.CloseSession(ci.SessionId, "Proxy method no longer exists")
+			return
+		}
+		dialer, policy := sta.proxyDialer(ci.ProxyMethod)
+		network := proxyAddr.Network()
+		if network == "direct" {
+			go serveDirect(sesh.Context(), newStream.(*mux.Stream), sta, dialer, policy)
+			continue
+		}
+		if network == "echo" || network == "discard" {
+			go serveBench(newStream.(*mux.Stream), network == "echo", sta)
+			continue
+		}
+		if newStream.(*mux.Stream).IsDatagram() {
+			if network == "unix" {
+				log.WithField("proxyMethod", ci.ProxyMethod).Warn("datagrams can't be relayed to a Unix domain socket")
+				newStream.Close()
+				continue
+			}
+			// datagram streams carry the UDP relay of the proxy server, which listens on the same address
+			network = "udp"
+		}
+		localConn, err := common.DialContext(sesh.Context(), dialer, network, proxyAddr.String())
 		if err != nil {
 			log.Errorf("Failed to connect to %v: %v", ci.ProxyMethod, err)
 			user.CloseSession(ci.SessionId, "Failed to connect to proxy server")
 			continue
 		}
 		log.Tracef("%v endpoint has been successfully connected", ci.ProxyMethod)
+		newStream.(*mux.Stream).SetDestination(proxyAddr.String())
+		sta.metrics.streamOpened()
 
-		// if stream has nothing to send to proxy server for sta.Timeout period of time, stream will return error
-		newStream.(*mux.Stream).SetWriteToTimeout(sta.Timeout)
-		go func() {
-			if _, err := common.Copy(localConn, newStream); err != nil {
-				log.Tracef("copying stream to proxy server: %v", err)
-			}
-		}()
+		if network == "udp" {
+			go func() {
+				relayUDP(localConn, newStream, sta.UDPTimeout)
+				sta.metrics.streamClosed()
+			}()
+			continue
+		}
 
-		go func() {
-			if _, err := common.Copy(newStream, localConn); err != nil {
-				log.Tracef("copying proxy server to stream: %v", err)
-			}
-		}()
+		go relayStream(localConn, newStream.(*mux.Stream), sta)
 	}
 
 }
+
+// relayStream copies between a stream and its connection to the proxy server until either is closed
+func relayStream(localConn net.Conn, stream *mux.Stream, sta *State) {
+	// if stream has nothing to send to proxy server for sta.Timeout period of time, stream will return error
+	stream.SetWriteToTimeout(sta.Timeout)
+	go func() {
+		if _, err := common.Copy(stream, localConn); err != nil {
+			log.Tracef("copying proxy server to stream: %v", err)
+		}
+	}()
+	if _, err := common.Copy(localConn, stream); err != nil {
+		log.Tracef("copying stream to proxy server: %v", err)
+	}
+	sta.metrics.streamClosed()
+}
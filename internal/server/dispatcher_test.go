@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRedirectToWeb(t *testing.T) {
+	webL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webL.Close()
+	// the web server reads the whole request before replying
+	go func() {
+		conn, err := webL.Accept()
+		if err != nil {
+			return
+		}
+		req, _ := ioutil.ReadAll(conn)
+		conn.Write(append([]byte("reply to "), req...))
+		conn.Close()
+	}()
+
+	ckL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckL.Close()
+
+	webHost, webPort, _ := net.SplitHostPort(webL.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+	}
+
+	go func() {
+		conn, err := ckL.Accept()
+		if err != nil {
+			return
+		}
+		first := make([]byte, 5)
+		n, _ := conn.Read(first)
+		redirectToWeb(conn, first[:n], sta)
+	}()
+
+	prober, err := net.Dial("tcp", ckL.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prober.Write([]byte("first"))
+	prober.Write([]byte(" second"))
+	prober.(*net.TCPConn).CloseWrite()
+
+	reply, err := ioutil.ReadAll(prober)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(reply) != "reply to first second" {
+		t.Errorf("expecting reply to the whole request, got %q", reply)
+	}
+}
+
+func TestDispatchConnection_ReadTimeout(t *testing.T) {
+	webL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webL.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := webL.Accept()
+		if err != nil {
+			return
+		}
+		req, _ := ioutil.ReadAll(conn)
+		received <- req
+		conn.Close()
+	}()
+
+	webHost, webPort, _ := net.SplitHostPort(webL.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+	}
+
+	ckL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckL.Close()
+	go func() {
+		conn, err := ckL.Accept()
+		if err != nil {
+			return
+		}
+		dispatchConnection(conn, sta, nil)
+	}()
+
+	prober, err := net.Dial("tcp", ckL.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prober.Close()
+
+	// sends nothing until the dispatcher gives up waiting for the first packet
+	time.Sleep(3500 * time.Millisecond)
+	_, err = prober.Write([]byte("late request"))
+	if err != nil {
+		t.Fatalf("connection closed after timeout: %v", err)
+	}
+	prober.(*net.TCPConn).CloseWrite()
+
+	select {
+	case req := <-received:
+		if string(req) != "late request" {
+			t.Errorf("expecting the redirection server to receive %q, got %q", "late request", req)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("connection wasn't redirected after timeout")
+	}
+}
+
+func TestDispatchConnection_AfterClientHello(t *testing.T) {
+	webL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webL.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := webL.Accept()
+		if err != nil {
+			return
+		}
+		req, _ := ioutil.ReadAll(conn)
+		received <- req
+		conn.Close()
+	}()
+
+	webHost, webPort, _ := net.SplitHostPort(webL.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+	}
+
+	ckL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckL.Close()
+	go func() {
+		conn, err := ckL.Accept()
+		if err != nil {
+			return
+		}
+		// TLS isn't allowed, so the ClientHello goes straight to the redirection server
+		dispatchConnection(conn, sta, transportSet{WebSocket{}.String(): true})
+	}()
+
+	prober, err := net.Dial("tcp", ckL.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer prober.Close()
+
+	// a handshake record followed by an application data record in the same segment
+	sent := append(common.AddRecordLayer([]byte("hello"), common.Handshake, common.VersionTLS11),
+		common.AddRecordLayer([]byte("early data"), common.ApplicationData, common.VersionTLS13)...)
+	_, err = prober.Write(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prober.(*net.TCPConn).CloseWrite()
+
+	select {
+	case req := <-received:
+		if !bytes.Equal(req, sent) {
+			t.Errorf("expecting the redirection server to receive %x, got %x", sent, req)
+		}
+	case <-time.After(3 * time.Second):
+		t.Error("connection wasn't redirected")
+	}
+}
+
+func TestServeClient_UnauthorisedSession(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), common.RealWorldState)
+	if err != nil {
+		t.Fatal("failed to make local manager", err)
+	}
+	UID, _ := base64.StdEncoding.DecodeString("u97xvcc5YoQA8obCyt9q/w==")
+	// no more sessions are allowed
+	err = manager.WriteUserInfo(usermanager.UserInfo{
+		UID:         UID,
+		SessionsCap: 0,
+		UpRate:      1e6,
+		DownRate:    1e6,
+		UpCredit:    1e9,
+		DownCredit:  1e9,
+		ExpiryTime:  time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sta := &State{
+		Panel:      MakeUserPanel(manager, common.RealWorldState),
+		WorldState: common.RealWorldState,
+	}
+	ci := ClientInfo{
+		UID:              UID,
+		SessionId:        1,
+		EncryptionMethod: 0x00,
+	}
+	var finished, redirected bool
+	finishHandshake := func(conn net.Conn, sessionKey [32]byte, randSource io.Reader) (net.Conn, error) {
+		finished = true
+		return conn, nil
+	}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	serveClient(conn, ci, finishHandshake, sta, func() { redirected = true })
+
+	if finished {
+		t.Error("handshake finished for an unauthorised session")
+	}
+	if !redirected {
+		t.Error("unauthorised session isn't redirected")
+	}
+}
+
+func TestDecoyNameOf(t *testing.T) {
+	chBytes, _ := hex.DecodeString("1603010200010001fc03034986187cfaf4c55866a0d9b68f82505fd694a3f0fbf21ca3dcf260baad91d75e20c10e2d2c66f4f9366296678550ed769aa0c41cae7e5f480f59bd929b747ee48d0024130113031302c02bc02fcca9cca8c02cc030c00ac009c013c01400330039002f0035000a0100018f00000011000f00000c7777772e62696e672e636f6d00170000ff01000100000a000e000c001d00170018001901000101000b00020100002300000010000e000c02683208687474702f312e310005000501000000000033006b0069001d00208d7d5a544a72e67adb1bacde46aa147b086f714c073f8335688dc13b2a032986001700414e06fb9a27480a93159f3d6273afebb4d307c4a734d7107d883b6edacb58f7d289a95ad8aaedef1b5f76fe09267a14e6bee2b6db4506b43cf0a410a4645105f79f002b0009080304030303020301000d0018001604030503060308040805080604010501060102030201002d00020101001c00024001001500920000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000")
+	for _, c := range []struct {
+		name        string
+		firstPacket []byte
+		expected    string
+	}{
+		{"ClientHello", chBytes, "www.bing.com"},
+		{"truncated ClientHello", chBytes[:100], ""},
+		{"HTTP request", []byte("GET / HTTP/1.1\r\nUser-Agent: curl\r\nhost: www.example.com:8080\r\n\r\n"), "www.example.com"},
+		{"HTTP request without Host", []byte("GET / HTTP/1.0\r\n\r\nHost: body"), ""},
+		{"nothing", nil, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if name := decoyNameOf(c.firstPacket); name != c.expected {
+				t.Errorf("expecting %q, got %q", c.expected, name)
+			}
+		})
+	}
+}
+
+func TestServeClient_Draining(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), common.RealWorldState)
+	if err != nil {
+		t.Fatal("failed to make local manager", err)
+	}
+	UID, _ := base64.StdEncoding.DecodeString("u97xvcc5YoQA8obCyt9q/w==")
+	err = manager.WriteUserInfo(usermanager.UserInfo{
+		UID:         UID,
+		SessionsCap: 10,
+		UpRate:      1e6,
+		DownRate:    1e6,
+		UpCredit:    1e9,
+		DownCredit:  1e9,
+		ExpiryTime:  time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sta := &State{
+		Panel:      MakeUserPanel(manager, common.RealWorldState),
+		WorldState: common.RealWorldState,
+	}
+	sta.Drain(time.Minute, false)
+	ci := ClientInfo{
+		UID:              UID,
+		SessionId:        1,
+		EncryptionMethod: 0x00,
+	}
+	var finished, redirected bool
+	finishHandshake := func(conn net.Conn, sessionKey [32]byte, randSource io.Reader) (net.Conn, error) {
+		finished = true
+		return conn, nil
+	}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	serveClient(conn, ci, finishHandshake, sta, func() { redirected = true })
+
+	if finished || !redirected {
+		t.Error("a new session is served while draining")
+	}
+	if sta.Panel.isActive(UID) {
+		t.Error("the user refused is left active")
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// In DoH mode, ck-server is the authoritative name server of DNSDomain on DNSAddr, and each conversation of queries
+// under it is a Cloak connection. It starts with the authentication data, which is the same as the hidden data of
+// gRPC mode. The tunnel is described in common.DNSPacket
+
+const (
+	// a conversation is closed after this long without a query
+	dnsIdleTimeout = 60 * time.Second
+	// beyond this many conversations at once, queries starting new ones are answered as if they're closed
+	maxDNSConversations = 1024
+	// the most a conversation keeps of what's to be sent before its writes wait
+	dnsSendBuffer = 256 * 1024
+	// answers are kept to this if the query doesn't say how large a response the resolver takes, as in RFC 1035
+	defaultDNSResponseSize = 512
+	// and never made larger than this, which keeps them from being fragmented
+	maxDNSResponseSize = 1232
+)
+
+type DoH struct{}
+
+func (DoH) String() string { return "DoH" }
+
+// reqPacket for DoH is what the conversation starts with, and the Responder must be called with a *dnsConversation
+func (DoH) processFirstPacket(reqPacket []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+	fragments, err = unmarshalHidden(reqPacket, staticPvs)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal the start of a DNS conversation into authFragments: %v", err)
+		return
+	}
+
+	// a conversation is a byte stream like TLS, so the frames are put in records the same way
+	respond = RealTLS{}.makeResponder(fragments.sharedSecret)
+	return
+}
+
+// dnsConversation is a conversation of queries as a net.Conn, reading what the client has sent and writing what's
+// sent in the answers
+type dnsConversation struct {
+	local  net.Addr
+	remote net.Addr
+
+	m sync.Mutex
+	// signalled when there's more received, less to be sent or the conversation is closed
+	cond     *sync.Cond
+	received []byte
+	// the sequence number of the chunk expected next from the client
+	nextSeq uint16
+	// what's to be sent that isn't in flight
+	sending []byte
+	// the chunk sent in the last answer that the client hasn't acknowledged, nil if there isn't one
+	inFlight []byte
+	sendSeq  uint16
+	closed   bool
+	lastSeen time.Time
+}
+
+func newDNSConversation(local net.Addr, remote net.Addr, now time.Time) *dnsConversation {
+	conv := &dnsConversation{local: local, remote: remote, lastSeen: now}
+	conv.cond = sync.NewCond(&conv.m)
+	return conv
+}
+
+func (conv *dnsConversation) Read(buf []byte) (int, error) {
+	conv.m.Lock()
+	defer conv.m.Unlock()
+	for len(conv.received) == 0 && !conv.closed {
+		conv.cond.Wait()
+	}
+	if len(conv.received) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, conv.received)
+	conv.received = conv.received[n:]
+	return n, nil
+}
+
+func (conv *dnsConversation) Write(data []byte) (int, error) {
+	conv.m.Lock()
+	defer conv.m.Unlock()
+	for len(conv.sending) >= dnsSendBuffer && !conv.closed {
+		conv.cond.Wait()
+	}
+	if conv.closed {
+		return 0, net.ErrClosed
+	}
+	conv.sending = append(conv.sending, data...)
+	return len(data), nil
+}
+
+func (conv *dnsConversation) Close() error {
+	conv.m.Lock()
+	conv.closed = true
+	conv.cond.Broadcast()
+	conv.m.Unlock()
+	return nil
+}
+
+func (conv *dnsConversation) LocalAddr() net.Addr              { return conv.local }
+func (conv *dnsConversation) RemoteAddr() net.Addr             { return conv.remote }
+func (conv *dnsConversation) SetDeadline(time.Time) error      { return nil }
+func (conv *dnsConversation) SetReadDeadline(time.Time) error  { return nil }
+func (conv *dnsConversation) SetWriteDeadline(time.Time) error { return nil }
+
+// exchange takes a packet of a query and returns the packet to answer it with, carrying at most room bytes of data
+func (conv *dnsConversation) exchange(packet common.DNSPacket, room int, now time.Time) (reply common.DNSPacket, done bool) {
+	conv.m.Lock()
+	defer conv.m.Unlock()
+	conv.lastSeen = now
+	if packet.Flags&common.DNS_FLAG_CLOSE != 0 {
+		// nothing more is read by the client
+		conv.closed = true
+		conv.inFlight, conv.sending = nil, nil
+		conv.cond.Broadcast()
+	}
+	if len(packet.Data) != 0 && packet.Seq == conv.nextSeq && !conv.closed {
+		conv.received = append(conv.received, packet.Data...)
+		conv.nextSeq++
+		conv.cond.Broadcast()
+	}
+	if conv.inFlight != nil && packet.Ack == conv.sendSeq+1 {
+		conv.inFlight = nil
+		conv.sendSeq++
+	}
+	if conv.inFlight == nil && len(conv.sending) != 0 && room > 0 {
+		n := min(room, len(conv.sending))
+		conv.inFlight = append([]byte{}, conv.sending[:n]...)
+		conv.sending = conv.sending[n:]
+		conv.cond.Broadcast()
+	}
+
+	reply = common.DNSPacket{Seq: conv.sendSeq, Ack: conv.nextSeq}
+	// a chunk can't be cut shorter once sent, as the client may have it already. If this answer has less room than
+	// the one it was first sent in, it waits for the next one
+	if len(conv.inFlight) <= room {
+		reply.Data = conv.inFlight
+	}
+	done = conv.closed && conv.inFlight == nil && len(conv.sending) == 0
+	if done {
+		reply.Flags |= common.DNS_FLAG_CLOSE
+	}
+	return
+}
+
+// dnsTunnel is the conversations on a DNSAddr, by their IDs
+type dnsTunnel struct {
+	m             sync.Mutex
+	conversations map[[8]byte]*dnsConversation
+}
+
+// conversationOf returns the conversation a query is in, starting it if packet is the start of a new one. It's nil
+// if the conversation doesn't exist
+func (tunnel *dnsTunnel) conversationOf(id [8]byte, packet common.DNSPacket, local net.Addr, from net.Addr, sta *State) *dnsConversation {
+	tunnel.m.Lock()
+	defer tunnel.m.Unlock()
+	if conv, ok := tunnel.conversations[id]; ok {
+		return conv
+	}
+	if packet.Seq != 0 || packet.Ack != 0 || len(packet.Data) == 0 || packet.Flags&common.DNS_FLAG_CLOSE != 0 {
+		return nil
+	}
+	if len(tunnel.conversations) >= maxDNSConversations {
+		log.WithField("remoteAddr", from).Warn("too many DNS conversations, turning away a new one")
+		return nil
+	}
+	conv := newDNSConversation(local, from, time.Now())
+	tunnel.conversations[id] = conv
+	go serveConversation(conv, sta)
+	return conv
+}
+
+func (tunnel *dnsTunnel) remove(id [8]byte) {
+	tunnel.m.Lock()
+	delete(tunnel.conversations, id)
+	tunnel.m.Unlock()
+}
+
+// expire closes and forgets the conversations without a query for dnsIdleTimeout
+func (tunnel *dnsTunnel) expire(now time.Time) {
+	tunnel.m.Lock()
+	defer tunnel.m.Unlock()
+	for id, conv := range tunnel.conversations {
+		conv.m.Lock()
+		idle := now.Sub(conv.lastSeen) > dnsIdleTimeout
+		conv.m.Unlock()
+		if idle {
+			conv.Close()
+			delete(tunnel.conversations, id)
+		}
+	}
+}
+
+// serveConversation authenticates a new conversation, which then carries on as a Cloak connection
+func serveConversation(conv *dnsConversation, sta *State) {
+	hidden := make([]byte, 96)
+	if _, err := io.ReadFull(conv, hidden); err != nil {
+		conv.Close()
+		return
+	}
+	ci, finishHandshake, err := authenticate(hidden, DoH{}, sta)
+	if errors.Is(err, ErrNotCloak) {
+		log.WithField("remoteAddr", conv.RemoteAddr()).Debug(err)
+		conv.Close()
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"remoteAddr": conv.RemoteAddr(),
+			"UID":        b64(ci.UID),
+			"sessionId":  ci.SessionId,
+		}).Warn(err)
+		conv.Close()
+		return
+	}
+	// there's no cover site behind a name server, so unauthorised conversations are just closed
+	serveClient(conv, ci, finishHandshake, sta, func() { conv.Close() })
+}
+
+// ServeDNS answers the queries on conn until it's closed, as the authoritative name server of DNSDomain
+func (sta *State) ServeDNS(conn net.PacketConn) {
+	tunnel := &dnsTunnel{conversations: make(map[[8]byte]*dnsConversation)}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(dnsIdleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				tunnel.expire(now)
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Errorf("Failed to receive DNS queries: %v", err)
+			continue
+		}
+		answer, err := sta.answerDNS(tunnel, buf[:n], conn.LocalAddr(), from)
+		if err != nil {
+			log.WithField("remoteAddr", from).Debugf("unable to answer a DNS query: %v", err)
+			continue
+		}
+		if _, err := conn.WriteTo(answer, from); err != nil {
+			log.WithField("remoteAddr", from).Debugf("failed to answer a DNS query: %v", err)
+		}
+	}
+}
+
+// answerDNS returns the answer to a query. Names under DNSDomain that aren't of the tunnel, and types other than
+// TXT, have no records, which is what resolvers minimising the names they ask about expect of names that exist.
+// Other domains are refused
+func (sta *State) answerDNS(tunnel *dnsTunnel, query []byte, local net.Addr, from net.Addr) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("not a query")
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	if err = parser.SkipAllQuestions(); err != nil {
+		return nil, err
+	}
+	if err = parser.SkipAllAnswers(); err != nil {
+		return nil, err
+	}
+	if err = parser.SkipAllAuthorities(); err != nil {
+		return nil, err
+	}
+	size := defaultDNSResponseSize
+	edns := false
+	for {
+		additional, err := parser.AdditionalHeader()
+		if err != nil {
+			break
+		}
+		if additional.Type == dnsmessage.TypeOPT {
+			edns = true
+			size = min(max(int(additional.Class), defaultDNSResponseSize), maxDNSResponseSize)
+		}
+		if err = parser.SkipAdditional(); err != nil {
+			return nil, err
+		}
+	}
+
+	answer := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               header.ID,
+			Response:         true,
+			OpCode:           header.OpCode,
+			Authoritative:    true,
+			RecursionDesired: header.RecursionDesired,
+		},
+		Questions: []dnsmessage.Question{question},
+	}
+	if edns {
+		var opt dnsmessage.ResourceHeader
+		if err := opt.SetEDNS0(maxDNSResponseSize, dnsmessage.RCodeSuccess, false); err != nil {
+			return nil, err
+		}
+		answer.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(question.Name.String(), "."))
+	if name != sta.DNSDomain && !strings.HasSuffix(name, "."+sta.DNSDomain) {
+		answer.RCode = dnsmessage.RCodeRefused
+		return answer.Pack()
+	}
+	if question.Type != dnsmessage.TypeTXT || question.Class != dnsmessage.ClassINET {
+		return answer.Pack()
+	}
+	id, packet, err := common.UnmarshalDNSQuery(name, sta.DNSDomain)
+	if err != nil {
+		return answer.Pack()
+	}
+
+	txt := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+		Body:   &dnsmessage.TXTResource{TXT: []string{""}},
+	}
+	answer.Answers = []dnsmessage.Resource{txt}
+	empty, err := answer.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// what's left for the strings of the TXT record, each of which has a length byte before up to 255 bytes
+	left := size - len(empty) + 1
+	room := left - (left+255)/256 - common.DNSAnswerHeaderLength
+
+	var reply common.DNSPacket
+	conv := tunnel.conversationOf(id, packet, local, from, sta)
+	if conv == nil {
+		reply.Flags = common.DNS_FLAG_CLOSE
+	} else {
+		var done bool
+		reply, done = conv.exchange(packet, room, time.Now())
+		if done {
+			tunnel.remove(id)
+		}
+	}
+
+	raw := string(common.MarshalDNSAnswer(reply))
+	var strs []string
+	for len(raw) > 255 {
+		strs = append(strs, raw[:255])
+		raw = raw[255:]
+	}
+	txt.Body = &dnsmessage.TXTResource{TXT: append(strs, raw)}
+	answer.Answers = []dnsmessage.Resource{txt}
+	return answer.Pack()
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// makeDNSQuery makes a query for name of qtype, which says it takes responses of ednsSize if it isn't 0
+func makeDNSQuery(t *testing.T, name string, qtype dnsmessage.Type, ednsSize int) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	if ednsSize != 0 {
+		var opt dnsmessage.ResourceHeader
+		_ = opt.SetEDNS0(ednsSize, dnsmessage.RCodeSuccess, false)
+		msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+// unpackDNSAnswer returns an answer and the packet in its TXT record, which is nil if there isn't one
+func unpackDNSAnswer(t *testing.T, raw []byte) (dnsmessage.Message, *common.DNSPacket) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(raw); err != nil {
+		t.Fatal(err)
+	}
+	for _, answer := range msg.Answers {
+		if txt, ok := answer.Body.(*dnsmessage.TXTResource); ok {
+			var content []byte
+			for _, s := range txt.TXT {
+				content = append(content, s...)
+			}
+			packet, err := common.UnmarshalDNSAnswer(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return msg, &packet
+		}
+	}
+	return msg, nil
+}
+
+func TestAnswerDNS(t *testing.T) {
+	sta := &State{DNSDomain: "t.example.com", StaticPv: &[32]byte{1}, WorldState: mockWorldState}
+	tunnel := &dnsTunnel{conversations: make(map[[8]byte]*dnsConversation)}
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+	from := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5353}
+	answer := func(query []byte) (dnsmessage.Message, *common.DNSPacket) {
+		t.Helper()
+		raw, err := sta.answerDNS(tunnel, query, local, from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return unpackDNSAnswer(t, raw)
+	}
+
+	t.Run("other domain", func(t *testing.T) {
+		msg, _ := answer(makeDNSQuery(t, "www.example.org.", dnsmessage.TypeA, 0))
+		if msg.RCode != dnsmessage.RCodeRefused {
+			t.Errorf("expecting %v, got %v", dnsmessage.RCodeRefused, msg.RCode)
+		}
+	})
+	t.Run("no records", func(t *testing.T) {
+		for _, name := range []string{"t.example.com.", "T.Example.com.", "abc.t.example.com."} {
+			msg, packet := answer(makeDNSQuery(t, name, dnsmessage.TypeA, 0))
+			if msg.RCode != dnsmessage.RCodeSuccess || !msg.Authoritative || len(msg.Answers) != 0 || packet != nil {
+				t.Errorf("%v: expecting an empty authoritative answer, got %+v", name, msg)
+			}
+		}
+	})
+	t.Run("unknown conversation", func(t *testing.T) {
+		name := common.MarshalDNSQuery([8]byte{1}, 1, common.DNSPacket{Seq: 3, Ack: 2}, sta.DNSDomain)
+		_, packet := answer(makeDNSQuery(t, name, dnsmessage.TypeTXT, 0))
+		if packet == nil || packet.Flags&common.DNS_FLAG_CLOSE == 0 {
+			t.Errorf("expecting the conversation to be closed, got %+v", packet)
+		}
+	})
+	t.Run("unauthenticated conversation", func(t *testing.T) {
+		id := [8]byte{2}
+		hidden := bytes.Repeat([]byte{0x55}, 96)
+		maxData := common.MaxDNSQueryData(sta.DNSDomain)
+		var seq uint16
+		for nonce := uint32(0); len(hidden) != 0; nonce++ {
+			n := min(maxData, len(hidden))
+			name := common.MarshalDNSQuery(id, nonce, common.DNSPacket{Seq: seq, Data: hidden[:n]}, sta.DNSDomain)
+			query := makeDNSQuery(t, name, dnsmessage.TypeTXT, 4096)
+			_, packet := answer(query)
+			// a resolver repeating the query changes nothing
+			_, repeated := answer(query)
+			if packet == nil || packet.Ack != seq+1 || repeated == nil || repeated.Ack != seq+1 {
+				t.Fatalf("chunk %v isn't acknowledged: %+v, %+v", seq, packet, repeated)
+			}
+			hidden = hidden[n:]
+			seq++
+		}
+
+		deadline := time.Now().Add(3 * time.Second)
+		for nonce := uint32(100); ; nonce++ {
+			name := common.MarshalDNSQuery(id, nonce, common.DNSPacket{Seq: seq, Ack: 0}, sta.DNSDomain)
+			_, packet := answer(makeDNSQuery(t, name, dnsmessage.TypeTXT, 4096))
+			if packet != nil && packet.Flags&common.DNS_FLAG_CLOSE != 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("conversation failing authentication isn't closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if _, ok := tunnel.conversations[id]; ok {
+			t.Error("closed conversation isn't forgotten")
+		}
+	})
+	t.Run("answer size", func(t *testing.T) {
+		for ednsSize, limit := range map[int]int{0: defaultDNSResponseSize, 4096: maxDNSResponseSize} {
+			id := [8]byte{3, byte(ednsSize)}
+			conv := newDNSConversation(local, from, time.Now())
+			conv.Write(make([]byte, 4096))
+			tunnel.conversations[id] = conv
+			name := common.MarshalDNSQuery(id, 1, common.DNSPacket{Data: make([]byte, 10)}, sta.DNSDomain)
+			raw, err := sta.answerDNS(tunnel, makeDNSQuery(t, name, dnsmessage.TypeTXT, ednsSize), local, from)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(raw) > limit || len(raw) < limit-2 {
+				t.Errorf("expecting an answer of about %v bytes, got %v", limit, len(raw))
+			}
+		}
+	})
+}
+
+func TestDNSConversation_exchange(t *testing.T) {
+	conv := newDNSConversation(nil, nil, time.Now())
+	sent := make([]byte, 1000)
+	for i := range sent {
+		sent[i] = byte(i)
+	}
+	conv.Write(sent)
+
+	reply, _ := conv.exchange(common.DNSPacket{Seq: 0, Data: []byte("hi")}, 600, time.Now())
+	if reply.Ack != 1 || reply.Seq != 0 || !bytes.Equal(reply.Data, sent[:600]) {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	// sent again until it's acknowledged, and the repeated chunk from the client is taken once
+	reply, _ = conv.exchange(common.DNSPacket{Seq: 0, Data: []byte("hi")}, 600, time.Now())
+	if reply.Ack != 1 || reply.Seq != 0 || !bytes.Equal(reply.Data, sent[:600]) {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	buf := make([]byte, 10)
+	if n, _ := conv.Read(buf); string(buf[:n]) != "hi" {
+		t.Errorf("expecting hi, got %q", buf[:n])
+	}
+	// a chunk that doesn't fit waits
+	reply, _ = conv.exchange(common.DNSPacket{Seq: 1}, 100, time.Now())
+	if len(reply.Data) != 0 {
+		t.Errorf("expecting no data in a smaller answer, got %v bytes", len(reply.Data))
+	}
+	reply, _ = conv.exchange(common.DNSPacket{Seq: 1, Ack: 1}, 600, time.Now())
+	if reply.Seq != 1 || !bytes.Equal(reply.Data, sent[600:]) {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+
+	conv.Close()
+	if _, err := conv.Write([]byte("late")); err == nil {
+		t.Error("expecting writes to fail once closed")
+	}
+	// what's left is still sent before the client is told
+	reply, done := conv.exchange(common.DNSPacket{Seq: 1, Ack: 1}, 600, time.Now())
+	if done || reply.Flags&common.DNS_FLAG_CLOSE != 0 {
+		t.Error("closed before everything is sent")
+	}
+	reply, done = conv.exchange(common.DNSPacket{Seq: 1, Ack: 2}, 600, time.Now())
+	if !done || reply.Flags&common.DNS_FLAG_CLOSE == 0 {
+		t.Errorf("expecting the client to be told of the close, got %+v", reply)
+	}
+}
+
+func TestDNSTunnel_expire(t *testing.T) {
+	tunnel := &dnsTunnel{conversations: make(map[[8]byte]*dnsConversation)}
+	now := time.Now()
+	idle := newDNSConversation(nil, nil, now.Add(-2*dnsIdleTimeout))
+	tunnel.conversations[[8]byte{1}] = idle
+	tunnel.conversations[[8]byte{2}] = newDNSConversation(nil, nil, now)
+	tunnel.expire(now)
+	if len(tunnel.conversations) != 1 || tunnel.conversations[[8]byte{2}] == nil {
+		t.Errorf("unexpected conversations left %v", tunnel.conversations)
+	}
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Error("idle conversation isn't closed")
+	}
+}
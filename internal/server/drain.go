@@ -0,0 +1,145 @@
+package server
+
+// Draining lets a ck-server behind a load balancer go away without dropping what goes through it. It stops listening,
+// so that new connections go to the other servers, refuses the handshakes of new sessions that have reached it
+// already, and waits for the sessions it has to end, up to a deadline after which they're closed. With notify, the
+// client of each session is also told to make its next session elsewhere, so that only the streams already open are
+// waited for
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how often the sessions left are counted while draining
+const drainPollInterval = time.Second
+
+// what the sessions left when draining runs out of time are closed with
+const drainedMsg = "Server is shutting down"
+
+// DrainStatus is how far draining has gone
+type DrainStatus struct {
+	Draining bool
+	// whether all sessions have ended or been closed
+	Drained bool
+	// the number of sessions left
+	Sessions int
+}
+
+// drainer is the zero value until draining starts
+type drainer struct {
+	m sync.Mutex
+	// closed when draining starts, and when it's done
+	started chan struct{}
+	done    chan struct{}
+}
+
+func (d *drainer) channels() (started chan struct{}, done chan struct{}) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.started == nil {
+		d.started = make(chan struct{})
+		d.done = make(chan struct{})
+	}
+	return d.started, d.done
+}
+
+// start closes started, returning false if it has been already
+func (d *drainer) start() bool {
+	started, _ := d.channels()
+	d.m.Lock()
+	defer d.m.Unlock()
+	select {
+	case <-started:
+		return false
+	default:
+		close(started)
+		return true
+	}
+}
+
+// Drain starts draining, unless it has started already, and returns a channel that's closed once it's done. The
+// sessions still open after timeout are closed. With notify, their clients are told to go elsewhere
+func (sta *State) Drain(timeout time.Duration, notify bool) <-chan struct{} {
+	_, done := sta.drain.channels()
+	if !sta.drain.start() {
+		return done
+	}
+	_, sessions := sta.Panel.numActive()
+	log.Infof("Draining %v sessions for up to %v", sessions, timeout)
+	if sta.Listeners != nil {
+		sta.Listeners.Close()
+	}
+	if notify {
+		sta.Panel.drainSessions()
+	}
+	for _, tenant := range sta.tenants {
+		tenant.Drain(timeout, notify)
+	}
+	go sta.awaitDrained(timeout, done)
+	return done
+}
+
+func (sta *State) awaitDrained(timeout time.Duration, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		for _, tenant := range sta.tenants {
+			<-tenant.Drained()
+		}
+	}()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		_, sessions := sta.Panel.numActive()
+		if sessions == 0 {
+			log.Info("All sessions have ended")
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			log.Warnf("Closing the %v sessions left after draining for %v", sessions, timeout)
+			sta.Panel.terminateAll(drainedMsg)
+			return
+		}
+	}
+}
+
+// Drained returns a channel that's closed once draining is done, however it was started
+func (sta *State) Drained() <-chan struct{} {
+	_, done := sta.drain.channels()
+	return done
+}
+
+// draining is whether draining has started
+func (sta *State) draining() bool {
+	started, _ := sta.drain.channels()
+	select {
+	case <-started:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sta *State) drainStatus() DrainStatus {
+	_, sessions := sta.Panel.numActive()
+	status := DrainStatus{Draining: sta.draining(), Sessions: sessions}
+	select {
+	case <-sta.Drained():
+		status.Drained = true
+	default:
+	}
+	return status
+}
+
+// closeOnDrain closes l, which isn't supervised by Listeners, when draining starts
+func (sta *State) closeOnDrain(l interface{ Close() error }) {
+	started, _ := sta.drain.channels()
+	<-started
+	l.Close()
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	t.Run("sessions end on their own", func(t *testing.T) {
+		sta := makeAdminAPIState(t, "127.0.0.1:0")
+		user, _ := sta.Panel.GetBypassUser(mockUID)
+		user.GetSession(1, "shadowsocks", "", getSeshConfig(false))
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go Serve(l, sta)
+
+		done := sta.Drain(time.Minute, true)
+		if !sta.draining() {
+			t.Error("not draining")
+		}
+		time.Sleep(100 * time.Millisecond)
+		if conn, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+			t.Error("still listening after draining started")
+		}
+		if !user.hasSession(1) {
+			t.Fatal("a session was closed before it ended")
+		}
+		if again := sta.Drain(0, false); again != done {
+			t.Error("draining started again")
+		}
+
+		user.CloseSession(1, "")
+		select {
+		case <-done:
+		case <-time.After(2 * drainPollInterval):
+			t.Fatal("not drained after the last session ended")
+		}
+		if status := sta.drainStatus(); !status.Drained || status.Sessions != 0 {
+			t.Errorf("unexpected status %+v", status)
+		}
+	})
+
+	t.Run("sessions left are closed", func(t *testing.T) {
+		sta := makeAdminAPIState(t, "127.0.0.1:0")
+		user, _ := sta.Panel.GetBypassUser(mockUID)
+		sesh, _, _ := user.GetSession(1, "shadowsocks", "", getSeshConfig(false))
+
+		select {
+		case <-sta.Drain(100*time.Millisecond, false):
+		case <-time.After(time.Second):
+			t.Fatal("not drained after the timeout")
+		}
+		if !sesh.IsClosed() || sesh.TerminalMsg() != drainedMsg {
+			t.Errorf("the session left isn't closed for draining: %v", sesh.TerminalMsg())
+		}
+		if sta.Panel.isActive(mockUID) {
+			t.Error("the user is still active")
+		}
+	})
+}
+
+func TestAdminAPI_Drain(t *testing.T) {
+	sta := makeAdminAPIState(t, "127.0.0.1:0")
+	handler := AdminAPIHandler(sta)
+
+	var status DrainStatus
+	rec := adminRequest(handler, "GET", "/v2/drain", "")
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Draining || status.Drained {
+		t.Errorf("unexpected status before draining %+v", status)
+	}
+
+	if rec = adminRequest(handler, "POST", "/v2/drain", `{"Timeout": -1}`); rec.Code != 400 {
+		t.Errorf("negative timeout: expecting status 400, got %v", rec.Code)
+	}
+	if sta.draining() {
+		t.Fatal("draining started by a bad request")
+	}
+	if rec = adminRequest(handler, "POST", "/v2/drain", ""); rec.Code != 202 {
+		t.Errorf("expecting status 202, got %v", rec.Code)
+	}
+	select {
+	case <-sta.Drained():
+	case <-time.After(time.Second):
+		t.Fatal("not drained")
+	}
+	rec = adminRequest(handler, "GET", "/v2/drain", "")
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Draining || !status.Drained {
+		t.Errorf("unexpected status after draining %+v", status)
+	}
+}
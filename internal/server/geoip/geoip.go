@@ -0,0 +1,111 @@
+// Package geoip looks up IP addresses in databases of the MaxMind DB format, such as GeoLite2 Country, City and ASN
+// and those of DB-IP and IPinfo in the same format.
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var ErrBadDatabase = errors.New("not a MaxMind DB")
+
+// DB is a database that has been read into memory as a whole
+type DB struct {
+	reader *maxminddb.Reader
+
+	// The type of the database, e.g. GeoLite2-Country
+	Type string
+}
+
+// Open reads the database at path
+func Open(path string) (*DB, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content)
+}
+
+// Parse takes a database from its content, which is kept and mustn't be changed afterwards
+func Parse(content []byte) (*DB, error) {
+	reader, err := maxminddb.FromBytes(content)
+	if err != nil {
+		return nil, badDatabase(err)
+	}
+	if v := reader.Metadata.IPVersion; v != 4 && v != 6 {
+		return nil, fmt.Errorf("%w: unsupported ip_version %v", ErrBadDatabase, v)
+	}
+	return &DB{reader: reader, Type: reader.Metadata.DatabaseType}, nil
+}
+
+// Lookup returns the data of the network that ip is in, which is usually a map of string to values of the types
+// string, uint64, *big.Int, int, float32, float64, bool, []byte, []interface{} and map[string]interface{}. It's nil if
+// ip isn't in any network of the database
+func (db *DB) Lookup(ip net.IP) (interface{}, error) {
+	var value interface{}
+	if err := db.reader.Lookup(ip, &value); err != nil {
+		return nil, badDatabase(err)
+	}
+	return value, nil
+}
+
+// Country returns the ISO 3166-1 code of the country that ip is in, falling back to the country it's registered to.
+// It's empty if it isn't known
+func (db *DB) Country(ip net.IP) (string, error) {
+	value, err := db.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	record, _ := value.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := record[key].(map[string]interface{})
+		if code, ok := country["iso_code"].(string); ok {
+			return code, nil
+		}
+	}
+	// the flat layout of DB-IP Lite and IPinfo
+	for _, key := range []string{"country_code", "country"} {
+		if code, ok := record[key].(string); ok {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// ASN returns the number of the autonomous system that ip is in, or 0 if it isn't known
+func (db *DB) ASN(ip net.IP) (uint, error) {
+	value, err := db.Lookup(ip)
+	if err != nil {
+		return 0, err
+	}
+	record, _ := value.(map[string]interface{})
+	if asn, ok := asUint(record["autonomous_system_number"]); ok {
+		return asn, nil
+	}
+	return 0, nil
+}
+
+func asUint(value interface{}) (uint, bool) {
+	switch v := value.(type) {
+	case uint64:
+		return uint(v), true
+	case int:
+		if v >= 0 {
+			return uint(v), true
+		}
+	}
+	return 0, false
+}
+
+// badDatabase makes the errors of a malformed database ErrBadDatabase
+func badDatabase(err error) error {
+	var invalid maxminddb.InvalidDatabaseError
+	if errors.As(err, &invalid) {
+		return fmt.Errorf("%w: %v", ErrBadDatabase, err)
+	}
+	return err
+}
@@ -0,0 +1,292 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// the metadata is after this marker
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// the search tree and the data section are separated by 16 zero bytes
+const dataSectionSeparator = 16
+
+// the types of the data section
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// encode encodes v in the data section format. Strings that are in pointers are written as pointers to them
+func encode(v interface{}, pointers map[string]uint) []byte {
+	control := func(typ int, size int) []byte {
+		var head []byte
+		switch {
+		case size < 29:
+			head = []byte{byte(size)}
+		case size < 285:
+			head = []byte{29, byte(size - 29)}
+		default:
+			head = []byte{30, byte((size - 285) >> 8), byte(size - 285)}
+		}
+		if typ <= 7 {
+			head[0] |= byte(typ) << 5
+			return head
+		}
+		return append([]byte{head[0], byte(typ - 7)}, head[1:]...)
+	}
+	switch v := v.(type) {
+	case string:
+		if pointer, ok := pointers[v]; ok {
+			return []byte{typePointer<<5 | byte(pointer>>8), byte(pointer)}
+		}
+		return append(control(typeString, len(v)), v...)
+	case uint32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		b = bytes.TrimLeft(b, "\x00")
+		return append(control(typeUint32, len(b)), b...)
+	case uint16:
+		b := []byte{byte(v >> 8), byte(v)}
+		b = bytes.TrimLeft(b, "\x00")
+		return append(control(typeUint16, len(b)), b...)
+	case bool:
+		if v {
+			return control(typeBool, 1)
+		}
+		return control(typeBool, 0)
+	case []interface{}:
+		b := control(typeArray, len(v))
+		for _, e := range v {
+			b = append(b, encode(e, pointers)...)
+		}
+		return b
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b := control(typeMap, len(v))
+		for _, key := range keys {
+			b = append(b, encode(key, pointers)...)
+			b = append(b, encode(v[key], pointers)...)
+		}
+		return b
+	}
+	panic("can't encode")
+}
+
+type testNetwork struct {
+	cidr string
+	data map[string]interface{}
+}
+
+// makeTestDB makes an IPv6 database with 24 bit records of networks, whose strings in shared are put at the start
+// of the data section and pointed to
+func makeTestDB(networks []testNetwork, shared []string) []byte {
+	var data []byte
+	pointers := make(map[string]uint)
+	for _, s := range shared {
+		pointers[s] = uint(len(data))
+		data = append(data, encode(s, nil)...)
+	}
+	offsets := make([]uint, len(networks))
+	for i, network := range networks {
+		offsets[i] = uint(len(data))
+		data = append(data, encode(network.data, pointers)...)
+	}
+
+	// the records of each node, where -1 is empty and below -1 is -2-i for the data of networks[i]
+	nodes := [][2]int{{-1, -1}}
+	for i, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network.cidr)
+		if err != nil {
+			panic(err)
+		}
+		ones, bits := ipNet.Mask.Size()
+		// IPv4 networks are under ::/96, as in MaxMind's databases
+		address := ipNet.IP.To16()
+		if bits == 32 {
+			address = append(make([]byte, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+		node := 0
+		for depth := 0; depth < ones; depth++ {
+			bit := (address[depth/8] >> (7 - uint(depth%8))) & 1
+			if depth == ones-1 {
+				nodes[node][bit] = -2 - i
+				break
+			}
+			if nodes[node][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var db []byte
+	nodeCount := len(nodes)
+	for _, node := range nodes {
+		for _, r := range node {
+			value := uint(r)
+			switch {
+			case r == -1:
+				value = uint(nodeCount)
+			case r < -1:
+				value = uint(nodeCount) + dataSectionSeparator + offsets[-2-r]
+			}
+			db = append(db, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	db = append(db, make([]byte, dataSectionSeparator)...)
+	db = append(db, data...)
+	db = append(db, metadataMarker...)
+	db = append(db, encode(map[string]interface{}{
+		"node_count":    uint32(nodeCount),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(6),
+		"database_type": "Test",
+	}, nil)...)
+	return db
+}
+
+func TestDB(t *testing.T) {
+	content := makeTestDB([]testNetwork{
+		{"1.2.3.0/24", map[string]interface{}{
+			"country":                  map[string]interface{}{"iso_code": "CN"},
+			"autonomous_system_number": uint32(4134),
+		}},
+		{"5.6.0.0/16", map[string]interface{}{
+			"registered_country": map[string]interface{}{"iso_code": "US"},
+			"is_anycast":         true,
+		}},
+		{"2001:db8::/32", map[string]interface{}{
+			"country_code": "IR",
+			"tags":         []interface{}{"a", "b"},
+		}},
+	}, []string{"iso_code", "CN"})
+
+	db, err := Parse(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Type != "Test" {
+		t.Errorf("expecting database type Test, got %v", db.Type)
+	}
+
+	countries := map[string]string{
+		"1.2.3.4":        "CN",
+		"5.6.7.8":        "US",
+		"2001:db8::1":    "IR",
+		"9.9.9.9":        "",
+		"2001:db9::1":    "",
+		"::ffff:1.2.3.5": "CN",
+	}
+	for ip, want := range countries {
+		got, err := db.Country(net.ParseIP(ip))
+		if err != nil {
+			t.Errorf("looking up %v: %v", ip, err)
+		}
+		if got != want {
+			t.Errorf("expecting country of %v to be %q, got %q", ip, want, got)
+		}
+	}
+
+	asn, err := db.ASN(net.ParseIP("1.2.3.4"))
+	if err != nil || asn != 4134 {
+		t.Errorf("expecting ASN 4134, got %v, %v", asn, err)
+	}
+	if asn, _ := db.ASN(net.ParseIP("5.6.7.8")); asn != 0 {
+		t.Errorf("expecting no ASN, got %v", asn)
+	}
+
+	value, err := db.Lookup(net.ParseIP("2001:db8::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := value.(map[string]interface{})["tags"].([]interface{})
+	if len(tags) != 2 || tags[0] != "a" || tags[1] != "b" {
+		t.Errorf("unexpected array %v", tags)
+	}
+	value, _ = db.Lookup(net.ParseIP("5.6.7.8"))
+	if value.(map[string]interface{})["is_anycast"] != true {
+		t.Errorf("unexpected boolean in %v", value)
+	}
+}
+
+func TestParse_bad(t *testing.T) {
+	good := makeTestDB([]testNetwork{{"1.2.3.0/24", map[string]interface{}{"country_code": "CN"}}}, nil)
+	markerAt := bytes.LastIndex(good, metadataMarker)
+
+	t.Run("no metadata", func(t *testing.T) {
+		if _, err := Parse([]byte("hello")); !errors.Is(err, ErrBadDatabase) {
+			t.Errorf("expecting %v, got %v", ErrBadDatabase, err)
+		}
+	})
+	t.Run("truncated metadata", func(t *testing.T) {
+		if _, err := Parse(good[:len(good)-5]); !errors.Is(err, ErrBadDatabase) {
+			t.Errorf("expecting %v, got %v", ErrBadDatabase, err)
+		}
+	})
+	t.Run("tree larger than the database", func(t *testing.T) {
+		bad := append(append([]byte{}, metadataMarker...), encode(map[string]interface{}{
+			"node_count":  uint32(1000),
+			"record_size": uint16(24),
+			"ip_version":  uint16(6),
+		}, nil)...)
+		if _, err := Parse(bad); !errors.Is(err, ErrBadDatabase) {
+			t.Errorf("expecting %v, got %v", ErrBadDatabase, err)
+		}
+	})
+	t.Run("truncated data", func(t *testing.T) {
+		// the data of the network is cut short, leaving the metadata intact
+		bad := append(append([]byte{}, good[:markerAt-3]...), good[markerAt:]...)
+		db, err := Parse(bad)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Lookup(net.ParseIP("1.2.3.4")); !errors.Is(err, ErrBadDatabase) {
+			t.Errorf("expecting %v, got %v", ErrBadDatabase, err)
+		}
+	})
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	content := makeTestDB([]testNetwork{{"10.0.0.0/8", map[string]interface{}{"country_code": "DE"}}}, nil)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if country, _ := db.Country(net.ParseIP("10.1.2.3")); country != "DE" {
+		t.Errorf("expecting DE, got %v", country)
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "nothing.mmdb")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expecting %v, got %v", os.ErrNotExist, err)
+	}
+}
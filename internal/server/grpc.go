@@ -0,0 +1,259 @@
+package server
+
+import (
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+// In gRPC mode, a CDN connects to us with cleartext HTTP/2 (i.e. prior knowledge h2c) and each Cloak connection is a
+// bidirectional gRPC stream on GRPCPath. Since a CDN may multiplex the streams of many clients onto the same HTTP/2
+// connection, authentication is done per stream rather than per connection. Requests that aren't on GRPCPath, or
+// that fail authentication, are proxied to the redirection server.
+
+var h2Preface = []byte(http2.ClientPreface)
+
+type GRPC struct{}
+
+func (GRPC) String() string { return "gRPC" }
+
+// reqPacket for gRPC is the content of the metadata "hidden", and the Responder must be called with a
+// *common.GRPCConn
+func (GRPC) processFirstPacket(reqPacket []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+	fragments, err = unmarshalHidden(reqPacket, staticPvs)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal hidden data from gRPC into authFragments: %v", err)
+		return
+	}
+
+	respond = GRPC{}.makeResponder(fragments.sharedSecret)
+	return
+}
+
+func (GRPC) makeResponder(sharedSecret [32]byte) Responder {
+	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
+		nonce := make([]byte, 12)
+		common.RandRead(randSource, nonce)
+
+		// reply: [12 bytes nonce][32 bytes encrypted session key][16 bytes authentication tag]
+		encryptedKey, err := common.AESGCMEncrypt(nonce, sharedSecret[:], sessionKey[:]) // 32 + 16 = 48 bytes
+		if err != nil {
+			err = fmt.Errorf("failed to encrypt reply: %v", err)
+			return
+		}
+		reply := append(nonce, encryptedKey...)
+		_, err = originalConn.Write(reply)
+		if err != nil {
+			err = fmt.Errorf("failed to write reply: %v", err)
+			originalConn.Close()
+			return
+		}
+		preparedConn = originalConn
+		return
+	}
+	return respond
+}
+
+// h2ServerStream is the HTTP/2 stream of a request as an io.ReadWriteCloser. The response is flushed after every
+// Write. Writing to an http.ResponseWriter after its handler has returned panics, so Close and Write are serialised
+// and nothing will be written once closed
+type h2ServerStream struct {
+	body    io.Reader
+	w       http.ResponseWriter
+	flusher http.Flusher
+	// whether the response is of gRPC, which ends with the trailer Grpc-Status
+	grpc bool
+
+	closeM      sync.Mutex
+	wroteHeader bool
+	closed      bool
+	done        chan struct{}
+}
+
+var errStreamClosed = errors.New("stream closed")
+
+func (s *h2ServerStream) Read(buf []byte) (int, error) { return s.body.Read(buf) }
+
+func (s *h2ServerStream) Write(data []byte) (int, error) {
+	s.closeM.Lock()
+	defer s.closeM.Unlock()
+	if s.closed {
+		return 0, errStreamClosed
+	}
+	if !s.wroteHeader {
+		s.wroteHeader = true
+		if s.grpc {
+			s.w.Header().Set("Content-Type", "application/grpc")
+			s.w.Header().Set("Trailer", "Grpc-Status")
+		} else {
+			s.w.Header().Set("Content-Type", h2ContentType)
+		}
+		s.w.WriteHeader(http.StatusOK)
+	}
+	n, err := s.w.Write(data)
+	s.flusher.Flush()
+	return n, err
+}
+
+func (s *h2ServerStream) Close() error {
+	s.closeM.Lock()
+	defer s.closeM.Unlock()
+	if !s.closed {
+		s.closed = true
+		if s.wroteHeader && s.grpc {
+			s.w.Header().Set("Grpc-Status", "0")
+		}
+		close(s.done)
+	}
+	return nil
+}
+
+// newDecoyProxy makes a reverse proxy to the redirection server of sni, or returns WebRoot if it's set. Standard ports
+// of https are spoken to in https
+func newDecoyProxy(localAddr net.Addr, sni string, sta *State) http.Handler {
+	if sta.webRoot != nil {
+		return sta.webRoot
+	}
+	_, localPort, _ := net.SplitHostPort(localAddr.String())
+	redirAddr, redirServerName := sta.redirAddr(sni, localPort)
+	target := &url.URL{Scheme: "http", Host: redirAddr}
+	if _, redirPort, _ := net.SplitHostPort(redirAddr); redirPort == "443" {
+		target.Scheme = "https"
+	}
+	if redirServerName == "" {
+		redirServerName = sni
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{
+		Dial:            sta.RedirDialer.Dial,
+		TLSClientConfig: &tls.Config{ServerName: redirServerName},
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		if redirServerName != "" {
+			r.Host = redirServerName
+		}
+	}
+	return proxy
+}
+
+// h2Handler serves the requests of clients in gRPC and HTTP/2 mode on an HTTP/2 connection, and proxies everything
+// else to the redirection server
+type h2Handler struct {
+	conn       net.Conn
+	sta        *State
+	transports transportSet
+	decoy      http.Handler
+}
+
+func (h *h2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method != http.MethodPost:
+	case len(h.sta.FrontingHosts) != 0 && !matchesHost(r.Host, h.sta.FrontingHosts):
+	case h.sta.GRPCPath != "" && r.URL.Path == h.sta.GRPCPath && h.transports.allows(GRPC{}.String()) &&
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc"):
+		h.serveStream(w, r, GRPC{})
+		return
+	case h.sta.H2Path != "" && r.URL.Path == h.sta.H2Path && h.transports.allows(HTTP2{}.String()):
+		h.serveStream(w, r, HTTP2{})
+		return
+	}
+	h.decoy.ServeHTTP(w, r)
+}
+
+// serveStream authenticates the request of a client in the mode of transport, whose stream is then the Cloak
+// connection
+func (h *h2Handler) serveStream(w http.ResponseWriter, r *http.Request, transport Transport) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.decoy.ServeHTTP(w, r)
+		return
+	}
+
+	_, isGRPC := transport.(GRPC)
+	stream := &h2ServerStream{body: r.Body, w: w, flusher: flusher, grpc: isGRPC, done: make(chan struct{})}
+	defer stream.Close()
+	var redirected bool
+	goWeb := func() {
+		redirected = true
+		stream.Close()
+		h.decoy.ServeHTTP(w, r)
+	}
+
+	var hidden []byte
+	var err error
+	if isGRPC {
+		hidden, err = base64.StdEncoding.DecodeString(r.Header.Get("hidden"))
+	} else {
+		hidden, err = parseBearerToken(r.Header.Get("Authorization"))
+	}
+	if err != nil {
+		log.WithField("remoteAddr", h.conn.RemoteAddr()).Debugf("failed to decode the authentication data: %v", err)
+		goWeb()
+		return
+	}
+	ci, finishHandshake, err := authenticate(hidden, transport, h.sta)
+	if errors.Is(err, ErrNotCloak) {
+		log.WithField("remoteAddr", h.conn.RemoteAddr()).Debug(err)
+		goWeb()
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"remoteAddr": h.conn.RemoteAddr(),
+			"UID":        b64(ci.UID),
+			"sessionId":  ci.SessionId,
+		}).Warn(err)
+		goWeb()
+		return
+	}
+
+	var conn net.Conn
+	if isGRPC {
+		conn = &common.GRPCConn{Stream: stream, Local: h.conn.LocalAddr(), Remote: h.conn.RemoteAddr()}
+	} else {
+		conn = &common.StreamConn{Stream: stream, Local: h.conn.LocalAddr(), Remote: h.conn.RemoteAddr()}
+	}
+	serveClient(conn, ci, finishHandshake, h.sta, goWeb)
+	if redirected {
+		return
+	}
+
+	// the stream is kept open until either the session or the peer closes it
+	select {
+	case <-stream.done:
+	case <-r.Context().Done():
+	}
+}
+
+// serveHTTP2 serves every request on an HTTP/2 connection whose first packet, if any, has already been read. sni is
+// that of the TLS it's inside, which is empty if a CDN has terminated TLS
+func serveHTTP2(conn net.Conn, firstPacket []byte, sni string, sta *State, transports transportSet) {
+	var h2Conn net.Conn = conn
+	if len(firstPacket) != 0 {
+		h2Conn = &firstBuffedConn{Conn: conn, firstPacket: firstPacket}
+	}
+	h2s := &http2.Server{}
+	h2s.ServeConn(h2Conn, &http2.ServeConnOpts{
+		Handler: &h2Handler{
+			conn:       conn,
+			sta:        sta,
+			transports: transports,
+			decoy:      newDecoyProxy(conn.LocalAddr(), sni, sta),
+		},
+	})
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestGRPCDecoyFallback(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("decoy " + r.URL.Path))
+	}))
+	defer web.Close()
+	webHost, webPort, _ := net.SplitHostPort(web.Listener.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+		GRPCPath:    "/stream.Service/Tunnel",
+		H2Path:      "/upload",
+	}
+
+	ckL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckL.Close()
+	go func() {
+		for {
+			conn, err := ckL.Accept()
+			if err != nil {
+				return
+			}
+			go dispatchConnection(conn, sta, nil)
+		}
+	}()
+
+	// prior knowledge h2c
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	t.Run("other path", func(t *testing.T) {
+		resp, err := client.Get("http://" + ckL.Addr().String() + "/index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "decoy /index.html" {
+			t.Errorf("expecting response from decoy, got %q", body)
+		}
+	})
+	t.Run("unauthenticated gRPC", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+ckL.Addr().String()+sta.GRPCPath, strings.NewReader(""))
+		req.Header.Set("Content-Type", "application/grpc")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "decoy "+sta.GRPCPath {
+			t.Errorf("expecting response from decoy, got %q", body)
+		}
+	})
+	t.Run("unauthenticated HTTP/2", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodPost, "http://"+ckL.Addr().String()+sta.H2Path, strings.NewReader("hello"))
+		req.Header.Set("Content-Type", h2ContentType)
+		req.Header.Set("Authorization", "Bearer AAEC_w")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "decoy "+sta.H2Path {
+			t.Errorf("expecting response from decoy, got %q", body)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/juju/ratelimit"
+)
+
+// Handshakes are limited in rate from each address and from all of them together before they're parsed, so that a
+// flood of connections can't run the CPU out on an ECDH for each. One over either limit is sent where a first packet
+// that isn't from a Cloak client would be, without being authenticated, so a client that's caught up in it only has
+// to try again. IPv6 addresses are limited by their /64, which a single host can easily have all of.
+//
+// The addresses that handshakes have come from most recently are kept in an LRU, each with a bucket of its own. One
+// that's forgotten starts again with a full bucket
+
+// beyond this many addresses, the one whose last handshake is the oldest is forgotten
+const maxHandshakeLimitAddrs = 1 << 16
+
+var ErrHandshakeRateLimited = errors.New("handshake rate is limited")
+
+// worldClock is the clock of a WorldState for ratelimit
+type worldClock struct{ common.WorldState }
+
+func (c worldClock) Now() time.Time { return c.WorldState.Now() }
+
+func (worldClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+type addrBucket struct {
+	addr   string
+	bucket *ratelimit.Bucket
+}
+
+type handshakeLimit struct {
+	clock ratelimit.Clock
+	// the rate from each address, unlimited if it's 0
+	perAddr int
+	// of all addresses, nil if it's unlimited
+	all *ratelimit.Bucket
+
+	m sync.Mutex
+	// of *addrBucket, the most recent first
+	lru   *list.List
+	addrs map[string]*list.Element
+}
+
+// newHandshakeLimit makes a handshakeLimit of perAddr handshakes a second from each address and all of them from all
+// addresses, each with a burst of as many. It's nil if neither is limited
+func newHandshakeLimit(perAddr int, all int, worldState common.WorldState) *handshakeLimit {
+	if perAddr <= 0 && all <= 0 {
+		return nil
+	}
+	limit := &handshakeLimit{
+		clock:   worldClock{worldState},
+		perAddr: perAddr,
+		lru:     list.New(),
+		addrs:   make(map[string]*list.Element),
+	}
+	if all > 0 {
+		limit.all = ratelimit.NewBucketWithRateAndClock(float64(all), int64(all), limit.clock)
+	}
+	return limit
+}
+
+// limitedAddrOf is what the address of a connection is limited by
+func limitedAddrOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// bucketOf returns the bucket of addr, making it if it has been forgotten
+func (limit *handshakeLimit) bucketOf(addr string) *ratelimit.Bucket {
+	limit.m.Lock()
+	defer limit.m.Unlock()
+	if elem, ok := limit.addrs[addr]; ok {
+		limit.lru.MoveToFront(elem)
+		return elem.Value.(*addrBucket).bucket
+	}
+	if limit.lru.Len() >= maxHandshakeLimitAddrs {
+		oldest := limit.lru.Back()
+		limit.lru.Remove(oldest)
+		delete(limit.addrs, oldest.Value.(*addrBucket).addr)
+	}
+	bucket := ratelimit.NewBucketWithRateAndClock(float64(limit.perAddr), int64(limit.perAddr), limit.clock)
+	limit.addrs[addr] = limit.lru.PushFront(&addrBucket{addr: addr, bucket: bucket})
+	return bucket
+}
+
+// allow takes a handshake from addr, returning false if it's over either limit. It's always true if limit is nil
+func (limit *handshakeLimit) allow(addr net.Addr) bool {
+	if limit == nil {
+		return true
+	}
+	// one address can't use up the handshakes of everyone else
+	if limit.perAddr > 0 && limit.bucketOf(limitedAddrOf(addr)).TakeAvailable(1) == 0 {
+		return false
+	}
+	return limit.all == nil || limit.all.TakeAvailable(1) != 0
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestHandshakeLimit(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	worldState := common.RealWorldState
+	worldState.Now = func() time.Time { return now }
+	addr := func(s string) net.Addr {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", s)
+		return tcpAddr
+	}
+	take := func(limit *handshakeLimit, a net.Addr, n int) (allowed int) {
+		for i := 0; i < n; i++ {
+			if limit.allow(a) {
+				allowed++
+			}
+		}
+		return
+	}
+
+	t.Run("unlimited", func(t *testing.T) {
+		limit := newHandshakeLimit(0, 0, worldState)
+		if limit != nil || take(limit, addr("1.2.3.4:443"), 100) != 100 {
+			t.Error("handshakes are limited")
+		}
+	})
+
+	t.Run("per address", func(t *testing.T) {
+		limit := newHandshakeLimit(2, 0, worldState)
+		if allowed := take(limit, addr("1.2.3.4:1000"), 5); allowed != 2 {
+			t.Errorf("expecting 2 handshakes allowed, got %v", allowed)
+		}
+		if allowed := take(limit, addr("1.2.3.4:1001"), 5); allowed != 0 {
+			t.Errorf("expecting the other port of the address to be limited, got %v allowed", allowed)
+		}
+		if allowed := take(limit, addr("5.6.7.8:1000"), 5); allowed != 2 {
+			t.Errorf("expecting another address to have its own limit, got %v allowed", allowed)
+		}
+		if allowed := take(limit, addr("[2001:db8::1]:1000"), 2) + take(limit, addr("[2001:db8::2]:1000"), 2); allowed != 2 {
+			t.Errorf("expecting the addresses of a /64 to be limited together, got %v allowed", allowed)
+		}
+		now = now.Add(time.Second)
+		if allowed := take(limit, addr("1.2.3.4:1000"), 5); allowed != 2 {
+			t.Errorf("expecting 2 handshakes allowed a second later, got %v", allowed)
+		}
+	})
+
+	t.Run("all addresses", func(t *testing.T) {
+		limit := newHandshakeLimit(2, 3, worldState)
+		allowed := take(limit, addr("1.2.3.4:1000"), 5) + take(limit, addr("5.6.7.8:1000"), 5)
+		if allowed != 3 {
+			t.Errorf("expecting 3 handshakes allowed in all, got %v", allowed)
+		}
+	})
+
+	t.Run("LRU", func(t *testing.T) {
+		limit := newHandshakeLimit(1, 0, worldState)
+		take(limit, addr("1.2.3.4:1000"), 1)
+		for i := 0; i < maxHandshakeLimitAddrs; i++ {
+			limit.allow(&net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1000})
+		}
+		if limit.lru.Len() != maxHandshakeLimitAddrs {
+			t.Errorf("expecting %v addresses to be kept, got %v", maxHandshakeLimitAddrs, limit.lru.Len())
+		}
+		if take(limit, addr("1.2.3.4:1000"), 1) != 1 {
+			t.Error("the least recent address isn't forgotten")
+		}
+	})
+}
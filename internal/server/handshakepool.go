@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+)
+
+// Under HandshakeWorkers, handshakes are authenticated on a fixed number of workers, so that however many connections
+// come in at once, only so many key exchanges and decryptions are done at a time and the rest of ck-server isn't
+// starved of CPU. Those that can't be started straight away wait in a queue of a fixed length. One that comes while
+// the queue is full is turned away as if it weren't from a Cloak client, without waiting
+
+// the length of the queue if HandshakeQueue isn't set
+const defaultHandshakeQueue = 1024
+
+// ErrHandshakeOverloaded is ErrNotCloak to whoever it's sent to, as the handshake hasn't been looked at
+var ErrHandshakeOverloaded = fmt.Errorf("%w: too many handshakes are waiting", ErrNotCloak)
+
+type handshakePool struct {
+	jobs chan func()
+}
+
+func newHandshakePool(workers int, queue int) *handshakePool {
+	if queue <= 0 {
+		queue = defaultHandshakeQueue
+	}
+	pool := &handshakePool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range pool.jobs {
+				job()
+			}
+		}()
+	}
+	return pool
+}
+
+// do runs f on a worker and waits for it to return. It returns false without running f if the queue is full. f is
+// run on the calling goroutine if pool is nil
+func (pool *handshakePool) do(f func()) bool {
+	if pool == nil {
+		f()
+		return true
+	}
+	done := make(chan struct{})
+	select {
+	case pool.jobs <- func() { f(); close(done) }:
+	default:
+		return false
+	}
+	<-done
+	return true
+}
+
+// queued is how many handshakes are waiting for a worker
+func (pool *handshakePool) queued() int {
+	if pool == nil {
+		return 0
+	}
+	return len(pool.jobs)
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandshakePool(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		var pool *handshakePool
+		ran := false
+		if !pool.do(func() { ran = true }) || !ran {
+			t.Error("handshake isn't run without a pool")
+		}
+		if pool.queued() != 0 {
+			t.Errorf("expecting nothing queued, got %v", pool.queued())
+		}
+	})
+
+	t.Run("bounded", func(t *testing.T) {
+		pool := newHandshakePool(1, 2)
+		block := make(chan struct{})
+		started := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.do(func() { close(started); <-block })
+		}()
+		<-started
+
+		results := make(chan bool, 2)
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results <- pool.do(func() {})
+			}()
+		}
+		for pool.queued() != 2 {
+			time.Sleep(time.Millisecond)
+		}
+		if pool.do(func() { t.Error("handshake is run when the queue is full") }) {
+			t.Error("handshake is accepted when the queue is full")
+		}
+
+		close(block)
+		wg.Wait()
+		for i := 0; i < 2; i++ {
+			if !<-results {
+				t.Error("queued handshake isn't run")
+			}
+		}
+		if pool.queued() != 0 {
+			t.Errorf("expecting nothing queued, got %v", pool.queued())
+		}
+	})
+}
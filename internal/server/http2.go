@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// In HTTP/2 mode, each Cloak connection is a long-lived POST request on H2Path, whose request and response bodies are
+// the two directions of the connection. Unlike gRPC mode, nothing about the requests says they aren't an ordinary
+// upload and download, so CDNs that only pass on HTTP they understand still let them through. The authentication
+// data is a bearer token in the Authorization header. Like gRPC mode, it's served on the prior knowledge h2c
+// connections of a CDN, and if ck-server holds a certificate, on HTTP/2 negotiated in real TLS.
+
+// the Content-Type of the request and response bodies in HTTP/2 mode
+const h2ContentType = "application/octet-stream"
+
+type HTTP2 struct{}
+
+func (HTTP2) String() string { return "HTTP2" }
+
+// reqPacket for HTTP/2 is the decoded bearer token, and the Responder must be called with a *common.StreamConn
+func (HTTP2) processFirstPacket(reqPacket []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+	fragments, err = unmarshalHidden(reqPacket, staticPvs)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal bearer token from HTTP/2 into authFragments: %v", err)
+		return
+	}
+
+	// the bodies are byte streams like TLS, so the frames are put in records the same way
+	respond = RealTLS{}.makeResponder(fragments.sharedSecret)
+	return
+}
+
+var errNoBearerToken = errors.New("no bearer token")
+
+// parseBearerToken decodes the token in the Authorization header of a request, which is in unpadded base64url
+func parseBearerToken(authorization string) ([]byte, error) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return nil, errNoBearerToken
+	}
+	return base64.RawURLEncoding.DecodeString(token)
+}
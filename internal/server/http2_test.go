@@ -0,0 +1,31 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestParseBearerToken(t *testing.T) {
+	t.Run("good", func(t *testing.T) {
+		token, err := parseBearerToken("Bearer AAEC_w")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(token, []byte{0, 1, 2, 0xff}) {
+			t.Errorf("unexpected token %x", token)
+		}
+	})
+	t.Run("no bearer", func(t *testing.T) {
+		for _, authorization := range []string{"", "Basic AAEC_w", "bearer AAEC_w"} {
+			if _, err := parseBearerToken(authorization); !errors.Is(err, errNoBearerToken) {
+				t.Errorf("%q: expecting %v, got %v", authorization, errNoBearerToken, err)
+			}
+		}
+	})
+	t.Run("padded", func(t *testing.T) {
+		if _, err := parseBearerToken("Bearer AAEC_w=="); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
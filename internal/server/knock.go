@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	log "github.com/sirupsen/logrus"
+)
+
+// A listener can be gated by knocks, so that it only serves addresses that have just sent a knock to KnockAddr.
+// Connections from anywhere else are reset, or sent to the redirection server, without being read
+//
+// Knock:
+// +--------------+--------------------------------------------+
+// | _randPubKey_ | _UID_ and _Timestamp_, encrypted           |
+// +--------------+--------------------------------------------+
+// | 32 bytes     | 16 bytes and 8 bytes, followed by the tag  |
+// +--------------+--------------------------------------------+
+const knockLength = 32 + 16 + 8 + 16
+
+// how long an address can connect for after knocking
+const knockAdmission = 30 * time.Second
+
+const (
+	KNOCK_RESET    = "reset"
+	KNOCK_REDIRECT = "redirect"
+)
+
+var ErrBadKnock = errors.New("not a knock")
+
+// knockGate remembers until when each address that has knocked is admitted
+type knockGate struct {
+	m        sync.Mutex
+	admitted map[string]time.Time
+}
+
+func (gate *knockGate) admit(host string, now time.Time) {
+	gate.m.Lock()
+	defer gate.m.Unlock()
+	if gate.admitted == nil {
+		gate.admitted = make(map[string]time.Time)
+	}
+	for h, until := range gate.admitted {
+		if now.After(until) {
+			delete(gate.admitted, h)
+		}
+	}
+	gate.admitted[host] = now.Add(knockAdmission)
+}
+
+func (gate *knockGate) isAdmitted(host string, now time.Time) bool {
+	gate.m.Lock()
+	defer gate.m.Unlock()
+	until, ok := gate.admitted[host]
+	return ok && !now.After(until)
+}
+
+// decryptKnock returns the UID of a knock and when it was sent, checking that it's within the timestamp window. It
+// doesn't check if the UID is authorised
+func decryptKnock(knock []byte, staticPvs []crypto.PrivateKey, serverTime time.Time) (UID []byte, randPubKey [32]byte, timestamp time.Time, err error) {
+	if len(knock) != knockLength {
+		err = ErrBadKnock
+		return
+	}
+	copy(randPubKey[:], knock[:32])
+	ephPub, _ := ecdh.Unmarshal(randPubKey[:])
+	// the knock may be made with any of the keys
+	var plaintext []byte
+	for _, staticPv := range staticPvs {
+		sharedSecret := ecdh.GenerateSharedSecret(staticPv, ephPub)
+		if plaintext, err = common.AESGCMDecrypt(randPubKey[:12], sharedSecret, knock[32:]); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrBadKnock, err)
+		return
+	}
+	UID = plaintext[:16]
+	timestamp = time.Unix(int64(binary.BigEndian.Uint64(plaintext[16:24])), 0)
+	if !(timestamp.After(serverTime.Truncate(TIMESTAMP_TOLERANCE)) && timestamp.Before(serverTime.Add(TIMESTAMP_TOLERANCE))) {
+		err = fmt.Errorf("%w: received timestamp %v", ErrTimestampOutOfWindow, timestamp.Unix())
+	}
+	return
+}
+
+// ServeKnocks receives knocks on conn until it's closed, admitting the address of each knock of an authorised user
+// to the listeners gated by knocks
+func (sta *State) ServeKnocks(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.Errorf("Failed to receive knocks: %v", err)
+			continue
+		}
+		if err := sta.acceptKnock(buf[:n], from); err != nil {
+			log.WithField("remoteAddr", from).Debugf("knock refused: %v", err)
+		}
+	}
+}
+
+// acceptKnock admits the address a knock is from if the knock is valid and from an authorised user
+func (sta *State) acceptKnock(knock []byte, from net.Addr) error {
+	UID, randPubKey, timestamp, err := decryptKnock(knock, sta.staticPvs(), sta.WorldState.Now())
+	if err != nil {
+		return err
+	}
+	if sta.registerRandom(randPubKey, timestamp) {
+		return ErrReplay
+	}
+	if !bytes.Equal(UID, sta.AdminUID) && !sta.IsBypass(UID) {
+		if _, _, err := sta.Panel.Manager.AuthenticateUser(UID); err != nil {
+			return err
+		}
+	}
+	host, _, err := net.SplitHostPort(from.String())
+	if err != nil {
+		return err
+	}
+	sta.knocks.admit(host, sta.WorldState.Now())
+	log.WithFields(log.Fields{
+		"UID":        b64(UID),
+		"remoteAddr": host,
+	}).Debug("admitted by knock")
+	return nil
+}
+
+// knocked returns whether addr has knocked recently enough to connect to listeners gated by knocks
+func (sta *State) knocked(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return sta.knocks.isAdmitted(host, sta.WorldState.Now())
+}
+
+// turnAway answers a connection on a listener gated by knocks from an address that hasn't knocked, as knock says
+func turnAway(conn net.Conn, knock string, sta *State) {
+	log.WithField("remoteAddr", conn.RemoteAddr()).Debug("connection without a knock")
+	if knock == KNOCK_REDIRECT {
+		redirectToWeb(conn, nil, sta)
+		return
+	}
+	resetConn(conn)
+}
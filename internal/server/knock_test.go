@@ -0,0 +1,227 @@
+package server
+
+import (
+	"crypto"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+func makeTestKnock(t *testing.T, serverPub interface{}, UID []byte, sent time.Time) []byte {
+	ephPv, ephPub, _ := ecdh.GenerateKey(common.RealWorldState.Rand)
+	randPubKey := ecdh.Marshal(ephPub)
+	plaintext := make([]byte, 24)
+	copy(plaintext, UID)
+	binary.BigEndian.PutUint64(plaintext[16:], uint64(sent.Unix()))
+	ciphertext, err := common.AESGCMEncrypt(randPubKey[:12], ecdh.GenerateSharedSecret(ephPv, serverPub), plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(append([]byte{}, randPubKey...), ciphertext...)
+}
+
+func TestKnockGate(t *testing.T) {
+	var gate knockGate
+	now := time.Unix(1600000000, 0)
+	if gate.isAdmitted("1.2.3.4", now) {
+		t.Error("admitted before knocking")
+	}
+	gate.admit("1.2.3.4", now)
+	if !gate.isAdmitted("1.2.3.4", now.Add(knockAdmission-time.Second)) {
+		t.Error("not admitted after knocking")
+	}
+	if gate.isAdmitted("5.6.7.8", now) {
+		t.Error("another address admitted")
+	}
+	if gate.isAdmitted("1.2.3.4", now.Add(knockAdmission+time.Second)) {
+		t.Error("still admitted after the admission has expired")
+	}
+	gate.admit("5.6.7.8", now.Add(knockAdmission+time.Second))
+	if _, ok := gate.admitted["1.2.3.4"]; ok {
+		t.Error("expired admission not forgotten")
+	}
+}
+
+func TestAcceptKnock(t *testing.T) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	manager, err := usermanager.MakeLocalManager(tmpDB.Name(), common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userUID := []byte("0123456789abcdef")
+	err = manager.WriteUserInfo(usermanager.UserInfo{
+		UID:         userUID,
+		SessionsCap: 1,
+		UpRate:      1e6,
+		DownRate:    1e6,
+		UpCredit:    1e9,
+		DownCredit:  1e9,
+		ExpiryTime:  time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pv, pub, _ := ecdh.GenerateKey(common.RealWorldState.Rand)
+	now := time.Unix(1600000000, 0)
+	worldState := common.WorldOfTime(now)
+	bypassUID := []byte("bypassbypassbyps")
+	var arrBypass [16]byte
+	copy(arrBypass[:], bypassUID)
+	sta := &State{
+		StaticPv:    pv,
+		WorldState:  worldState,
+		BypassUID:   map[[16]byte]struct{}{arrBypass: {}},
+		Panel:       MakeUserPanel(manager, worldState),
+		replayCache: newReplayCache(defaultReplayCacheCapacity, worldState),
+	}
+	from := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000} }
+
+	t.Run("user", func(t *testing.T) {
+		if err := sta.acceptKnock(makeTestKnock(t, pub, userUID, now), from("10.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+		if !sta.knocked(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}) {
+			t.Error("address of the knock not admitted")
+		}
+	})
+	t.Run("bypass user", func(t *testing.T) {
+		if err := sta.acceptKnock(makeTestKnock(t, pub, bypassUID, now), from("10.0.0.2")); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("unknown user", func(t *testing.T) {
+		err := sta.acceptKnock(makeTestKnock(t, pub, []byte("nobodynobodynobo"), now), from("10.0.0.3"))
+		if !errors.Is(err, usermanager.ErrUserNotFound) {
+			t.Errorf("expecting %v, got %v", usermanager.ErrUserNotFound, err)
+		}
+		if sta.knocked(from("10.0.0.3")) {
+			t.Error("address of an unknown user's knock admitted")
+		}
+	})
+	t.Run("replay", func(t *testing.T) {
+		knock := makeTestKnock(t, pub, userUID, now)
+		if err := sta.acceptKnock(knock, from("10.0.0.4")); err != nil {
+			t.Fatal(err)
+		}
+		if err := sta.acceptKnock(knock, from("10.0.0.5")); err != ErrReplay {
+			t.Errorf("expecting %v, got %v", ErrReplay, err)
+		}
+	})
+	t.Run("old knock", func(t *testing.T) {
+		err := sta.acceptKnock(makeTestKnock(t, pub, userUID, now.Add(-time.Hour)), from("10.0.0.6"))
+		if !errors.Is(err, ErrTimestampOutOfWindow) {
+			t.Errorf("expecting %v, got %v", ErrTimestampOutOfWindow, err)
+		}
+	})
+	t.Run("previous key", func(t *testing.T) {
+		previousPv, previousPub, _ := ecdh.GenerateKey(common.RealWorldState.Rand)
+		sta.PreviousStaticPvs = []crypto.PrivateKey{previousPv}
+		defer func() { sta.PreviousStaticPvs = nil }()
+		if err := sta.acceptKnock(makeTestKnock(t, previousPub, userUID, now), from("10.0.0.8")); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("not a knock", func(t *testing.T) {
+		_, otherPub, _ := ecdh.GenerateKey(common.RealWorldState.Rand)
+		for _, packet := range [][]byte{[]byte("hello"), makeTestKnock(t, otherPub, userUID, now)} {
+			if err := sta.acceptKnock(packet, from("10.0.0.7")); !errors.Is(err, ErrBadKnock) {
+				t.Errorf("expecting %v, got %v", ErrBadKnock, err)
+			}
+		}
+	})
+}
+
+func TestServe_Knock(t *testing.T) {
+	webL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webL.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := webL.Accept()
+			if err != nil {
+				return
+			}
+			req, _ := ioutil.ReadAll(conn)
+			received <- req
+			conn.Close()
+		}
+	}()
+	webHost, webPort, _ := net.SplitHostPort(webL.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+		WorldState:  common.RealWorldState,
+	}
+
+	serveWithKnock := func(knock string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serve(l, sta, func() listenerConfig { return listenerConfig{knock: knock} })
+		return l
+	}
+	send := func(l net.Listener, data []byte) ([]byte, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		conn.Write(data)
+		conn.(*net.TCPConn).CloseWrite()
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		return ioutil.ReadAll(conn)
+	}
+
+	t.Run("reset", func(t *testing.T) {
+		l := serveWithKnock(KNOCK_RESET)
+		defer l.Close()
+		if _, err := send(l, []byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+			t.Error("expecting the connection to be reset")
+		}
+	})
+	t.Run("redirect", func(t *testing.T) {
+		l := serveWithKnock(KNOCK_REDIRECT)
+		defer l.Close()
+		// a ClientHello of a Cloak client that hasn't knocked isn't even read
+		clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}
+		_, _ = send(l, clientHello)
+		select {
+		case req := <-received:
+			if string(req) != string(clientHello) {
+				t.Errorf("expecting the ClientHello to be redirected, got %v", req)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("connection without a knock wasn't redirected")
+		}
+	})
+	t.Run("knocked", func(t *testing.T) {
+		l := serveWithKnock(KNOCK_RESET)
+		defer l.Close()
+		sta.knocks.admit("127.0.0.1", time.Now())
+		// dispatched as usual, and sent to the redirection server as it's not from a Cloak client
+		if _, err := send(l, []byte("SSH-2.0\r\n")); err != nil {
+			t.Errorf("connection of an address that has knocked was reset: %v", err)
+		}
+		select {
+		case <-received:
+		case <-time.After(3 * time.Second):
+			t.Error("connection of an address that has knocked wasn't dispatched")
+		}
+	})
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the names of the transports a listener can be limited to, as in the Transports of a BindAddr entry
+var transportNames = []string{TLS{}.String(), RealTLS{}.String(), WebSocket{}.String(), GRPC{}.String(), HTTP2{}.String()}
+
+// transportSet is the transports accepted on a listener, by lower case name. Everything is accepted if it's nil
+type transportSet map[string]bool
+
+func parseTransportSet(names []string) (transportSet, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	set := make(transportSet)
+	for _, name := range names {
+		known := false
+		for _, transport := range transportNames {
+			if strings.EqualFold(name, transport) {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown transport %v, it must be one of %v", name, strings.Join(transportNames, ", "))
+		}
+		set[strings.ToLower(name)] = true
+	}
+	return set, nil
+}
+
+func (set transportSet) allows(transport string) bool {
+	return set == nil || set[strings.ToLower(transport)]
+}
+
+// allowsFirstPacket returns whether the mimicry transport that a first packet would be authenticated as is accepted.
+// Packets of no transport are allowed, as they're turned away by the authentication anyway
+func (set transportSet) allowsFirstPacket(firstPacket []byte) bool {
+	switch firstPacket[0] {
+	case 0x47:
+		return set.allows(WebSocket{}.String())
+	case 0x16:
+		return set.allows(TLS{}.String())
+	default:
+		return true
+	}
+}
+
+func (set transportSet) String() string {
+	if set == nil {
+		return "all transports"
+	}
+	var names []string
+	for _, transport := range transportNames {
+		if set.allows(transport) {
+			names = append(names, transport)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// listenerConfig is how a listener of BindAddr serves the connections it accepts
+type listenerConfig struct {
+	transports transportSet
+	// how connections from addresses that haven't knocked are turned away, one of the KNOCK_ constants. Empty if
+	// the listener isn't gated by knocks
+	knock string
+}
+
+func (config listenerConfig) String() string {
+	if config.knock == "" {
+		return config.transports.String()
+	}
+	return fmt.Sprintf("%v, gated by knocks", config.transports)
+}
+
+// parseListeners returns how each address of BindAddr is listened on
+func parseListeners(raw RawConfig) (map[string]listenerConfig, error) {
+	listeners := make(map[string]listenerConfig)
+	for _, addr := range raw.BindAddr {
+		transports, err := parseTransportSet(raw.BindTransports[addr])
+		if err != nil {
+			return nil, fmt.Errorf("BindAddr %v: %v", addr, err)
+		}
+		knock := strings.ToLower(raw.BindKnocks[addr])
+		switch knock {
+		case "", KNOCK_RESET, KNOCK_REDIRECT:
+		default:
+			return nil, fmt.Errorf("BindAddr %v: Knock must be either %v or %v", addr, KNOCK_RESET, KNOCK_REDIRECT)
+		}
+		if knock != "" && raw.KnockAddr == "" {
+			return nil, fmt.Errorf("BindAddr %v: gated by knocks but KnockAddr isn't set", addr)
+		}
+		listeners[addr] = listenerConfig{transports: transports, knock: knock}
+	}
+	return listeners, nil
+}
+
+type supervisedListener struct {
+	listener net.Listener
+	config   listenerConfig
+}
+
+// ListenerSupervisor keeps a listener on each address of BindAddr, serving it as its entry says. Listeners
+// are opened and closed as BindAddr is reloaded
+type ListenerSupervisor struct {
+	sta    *State
+	listen func(addr string) (net.Listener, error)
+
+	m         sync.Mutex
+	listeners map[string]*supervisedListener
+}
+
+// MakeListenerSupervisor makes a ListenerSupervisor that opens listeners with listen, and serves them with sta
+func MakeListenerSupervisor(sta *State, listen func(addr string) (net.Listener, error)) *ListenerSupervisor {
+	return &ListenerSupervisor{
+		sta:       sta,
+		listen:    listen,
+		listeners: make(map[string]*supervisedListener),
+	}
+}
+
+// Update listens on the addresses of BindAddr that aren't listened on yet and stops listening on the ones that
+// have been removed. If a new address can't be listened on, nothing is changed
+func (supervisor *ListenerSupervisor) Update(raw RawConfig) error {
+	configs, err := parseListeners(raw)
+	if err != nil {
+		return err
+	}
+
+	supervisor.m.Lock()
+	defer supervisor.m.Unlock()
+
+	opened := make(map[string]*supervisedListener)
+	for addr, config := range configs {
+		if _, ok := supervisor.listeners[addr]; ok {
+			continue
+		}
+		listener, err := supervisor.listen(addr)
+		if err != nil {
+			for _, l := range opened {
+				l.listener.Close()
+			}
+			return fmt.Errorf("unable to listen on %v: %v", addr, err)
+		}
+		opened[addr] = &supervisedListener{listener: listener, config: config}
+	}
+
+	for addr, l := range supervisor.listeners {
+		config, ok := configs[addr]
+		if !ok {
+			log.Infof("Stopped listening on %v", addr)
+			l.listener.Close()
+			delete(supervisor.listeners, addr)
+			continue
+		}
+		if config.String() != l.config.String() {
+			log.Infof("Accepting %v on %v", config, addr)
+		}
+		l.config = config
+	}
+	for addr, l := range opened {
+		log.Infof("Listening on %v for %v", addr, l.config)
+		supervisor.listeners[addr] = l
+		go serve(l.listener, supervisor.sta, supervisor.configOf(addr))
+	}
+	return nil
+}
+
+// configOf returns the current config of the listener on addr
+func (supervisor *ListenerSupervisor) configOf(addr string) func() listenerConfig {
+	return func() listenerConfig {
+		supervisor.m.Lock()
+		defer supervisor.m.Unlock()
+		if l, ok := supervisor.listeners[addr]; ok {
+			return l.config
+		}
+		// the listener has just been closed
+		return listenerConfig{transports: transportSet{}}
+	}
+}
+
+// Addrs returns the addresses that are listened on
+func (supervisor *ListenerSupervisor) Addrs() []string {
+	supervisor.m.Lock()
+	defer supervisor.m.Unlock()
+	var addrs []string
+	for addr := range supervisor.listeners {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Close stops listening on every address
+func (supervisor *ListenerSupervisor) Close() {
+	supervisor.m.Lock()
+	defer supervisor.m.Unlock()
+	for addr, l := range supervisor.listeners {
+		l.listener.Close()
+		delete(supervisor.listeners, addr)
+	}
+}
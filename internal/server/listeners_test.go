@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTransportSet(t *testing.T) {
+	set, err := parseTransportSet([]string{"websocket", "RealTLS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.allows("WebSocket") || !set.allows("RealTLS") || set.allows("TLS") || set.allows("gRPC") {
+		t.Errorf("unexpected transports %v", set)
+	}
+	if set.String() != "RealTLS, WebSocket" {
+		t.Errorf("unexpected string %q", set.String())
+	}
+
+	all, err := parseTransportSet(nil)
+	if err != nil || !all.allows("TLS") || all.String() != "all transports" {
+		t.Errorf("expecting all transports without any given, got %v and %v", all, err)
+	}
+
+	if _, err := parseTransportSet([]string{"QUIC"}); err == nil {
+		t.Error("expecting an error for an unknown transport")
+	}
+}
+
+func TestTransportSet_AllowsFirstPacket(t *testing.T) {
+	set, _ := parseTransportSet([]string{"WebSocket"})
+	if !set.allowsFirstPacket([]byte("GET / HTTP/1.1\r\n")) {
+		t.Error("WebSocket upgrade request not allowed")
+	}
+	if set.allowsFirstPacket([]byte{0x16, 0x03, 0x01}) {
+		t.Error("ClientHello allowed on a WebSocket only listener")
+	}
+	if !set.allowsFirstPacket([]byte("SSH-2.0")) {
+		t.Error("packets of no transport should be left to the authentication")
+	}
+}
+
+func TestRawConfig_BindAddrObjects(t *testing.T) {
+	var raw RawConfig
+	err := json.Unmarshal([]byte(`{"BindAddr": [":443", {"Addr": ":80", "Transports": ["WebSocket"]}, {"Addr": ":8443", "Knock": "reset"}]}`), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw.BindAddr, []string{":443", ":80", ":8443"}) {
+		t.Errorf("unexpected BindAddr %v", raw.BindAddr)
+	}
+	if !reflect.DeepEqual(raw.BindTransports, map[string][]string{":80": {"WebSocket"}}) {
+		t.Errorf("unexpected BindTransports %v", raw.BindTransports)
+	}
+	if !reflect.DeepEqual(raw.BindKnocks, map[string]string{":8443": "reset"}) {
+		t.Errorf("unexpected BindKnocks %v", raw.BindKnocks)
+	}
+
+	if err := json.Unmarshal([]byte(`{"BindAddr": [{"Transports": ["TLS"]}]}`), &raw); err == nil {
+		t.Error("expecting an error for an entry without Addr")
+	}
+}
+
+func TestParseListeners_Knock(t *testing.T) {
+	listeners, err := parseListeners(RawConfig{
+		BindAddr:   []string{":443", ":8443"},
+		BindKnocks: map[string]string{":8443": "Redirect"},
+		KnockAddr:  ":8443",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listeners[":443"].knock != "" || listeners[":8443"].knock != KNOCK_REDIRECT {
+		t.Errorf("unexpected listeners %v", listeners)
+	}
+
+	_, err = parseListeners(RawConfig{BindAddr: []string{":8443"}, BindKnocks: map[string]string{":8443": "reset"}})
+	if err == nil {
+		t.Error("expecting an error for a listener gated by knocks without KnockAddr")
+	}
+	_, err = parseListeners(RawConfig{BindAddr: []string{":8443"}, BindKnocks: map[string]string{":8443": "drop"}, KnockAddr: ":8443"})
+	if err == nil {
+		t.Error("expecting an error for an unknown Knock")
+	}
+}
+
+// fakeListen listens on a random port for any address, and fails for "bad"
+type fakeListen struct {
+	m      sync.Mutex
+	opened map[string]net.Listener
+}
+
+func (f *fakeListen) listen(addr string) (net.Listener, error) {
+	if addr == "bad" {
+		return nil, errors.New("address in use")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f.m.Lock()
+	f.opened[addr] = l
+	f.m.Unlock()
+	return l, nil
+}
+
+func (f *fakeListen) listener(addr string) net.Listener {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.opened[addr]
+}
+
+func TestListenerSupervisor(t *testing.T) {
+	webL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webL.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		for {
+			conn, err := webL.Accept()
+			if err != nil {
+				return
+			}
+			req, _ := ioutil.ReadAll(conn)
+			received <- req
+			conn.Close()
+		}
+	}()
+	webHost, webPort, _ := net.SplitHostPort(webL.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+	}
+
+	f := &fakeListen{opened: make(map[string]net.Listener)}
+	supervisor := MakeListenerSupervisor(sta, f.listen)
+	defer supervisor.Close()
+
+	t.Run("listen", func(t *testing.T) {
+		err := supervisor.Update(RawConfig{BindAddr: []string{"a", "b"}, BindTransports: map[string][]string{"b": {"WebSocket"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs := supervisor.Addrs(); !reflect.DeepEqual(addrs, []string{"a", "b"}) {
+			t.Errorf("unexpected addresses %v", addrs)
+		}
+	})
+	t.Run("transports", func(t *testing.T) {
+		conn, err := net.Dial("tcp", f.listener("b").Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}
+		conn.Write(clientHello)
+		conn.(*net.TCPConn).CloseWrite()
+		select {
+		case req := <-received:
+			if !reflect.DeepEqual(req, clientHello) {
+				t.Errorf("expecting the ClientHello to be redirected, got %v", req)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("ClientHello on a WebSocket only listener wasn't redirected")
+		}
+	})
+	t.Run("reload", func(t *testing.T) {
+		a, b := f.listener("a"), f.listener("b")
+		err := supervisor.Update(RawConfig{BindAddr: []string{"b", "c"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs := supervisor.Addrs(); !reflect.DeepEqual(addrs, []string{"b", "c"}) {
+			t.Errorf("unexpected addresses %v", addrs)
+		}
+		if f.listener("b") != b {
+			t.Error("listener of an address that's kept was opened again")
+		}
+		if !supervisor.configOf("b")().transports.allows("TLS") {
+			t.Error("transports of a kept listener weren't updated")
+		}
+		if _, err := a.Accept(); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("removed listener isn't closed: %v", err)
+		}
+	})
+	t.Run("failure", func(t *testing.T) {
+		err := supervisor.Update(RawConfig{BindAddr: []string{"d", "bad"}})
+		if err == nil {
+			t.Fatal("expecting an error for an address that can't be listened on")
+		}
+		if addrs := supervisor.Addrs(); !reflect.DeepEqual(addrs, []string{"b", "c"}) {
+			t.Errorf("listeners changed after failing: %v", addrs)
+		}
+		if d := f.listener("d"); d != nil {
+			if _, err := d.Accept(); !errors.Is(err, net.ErrClosed) {
+				t.Error("listener opened before the failure isn't closed")
+			}
+		}
+	})
+	t.Run("bad transports", func(t *testing.T) {
+		err := supervisor.Update(RawConfig{BindAddr: []string{"b"}, BindTransports: map[string][]string{"b": {"QUIC"}}})
+		if err == nil {
+			t.Error("expecting an error for an unknown transport")
+		}
+	})
+}
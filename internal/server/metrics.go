@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+)
+
+// Metrics are counted from when ck-server starts, and exposed in the text format of Prometheus by MetricsHandler
+
+// reasons that handshakes are rejected for, in the order they're exposed
+var rejectReasons = [...]struct {
+	label string
+	err   error
+}{
+	{"replay", ErrReplay},
+	// before not_cloak, which it's taken as
+	{"overloaded", ErrHandshakeOverloaded},
+	{"not_cloak", ErrNotCloak},
+	{"bad_proxy_method", ErrBadProxyMethod},
+	{"not_client_hello", ErrNotClientHello},
+	{"hello_truncated", ErrHelloTruncated},
+	{"hello_length", ErrHelloLength},
+	{"hello_trailing_data", ErrHelloTrailingData},
+	{"hello_duplicate_extension", ErrHelloDuplicateExtension},
+	{"hello_odd_field", ErrHelloOddField},
+	{"rate_limited", ErrHandshakeRateLimited},
+	{"other", nil},
+}
+
+type metrics struct {
+	handshakesAccepted atomic.Int64
+	// indexed the same as rejectReasons
+	handshakesRejected [len(rejectReasons)]atomic.Int64
+	streamsOpened      atomic.Int64
+	streamsClosed      atomic.Int64
+}
+
+// handshake counts the outcome of authenticating a connection
+func (m *metrics) handshake(err error) {
+	if m == nil {
+		return
+	}
+	if err == nil {
+		m.handshakesAccepted.Add(1)
+		return
+	}
+	for i, reason := range rejectReasons {
+		if reason.err == nil || errors.Is(err, reason.err) {
+			m.handshakesRejected[i].Add(1)
+			return
+		}
+	}
+}
+
+func (m *metrics) streamOpened() {
+	if m != nil {
+		m.streamsOpened.Add(1)
+	}
+}
+
+func (m *metrics) streamClosed() {
+	if m != nil {
+		m.streamsClosed.Add(1)
+	}
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeMetrics(w io.Writer, sta *State) {
+	m := sta.metrics
+	if m == nil {
+		m = &metrics{}
+	}
+	writeMetric(w, "cloak_handshakes_accepted_total", "counter", "Handshakes from Cloak clients that are authenticated.")
+	fmt.Fprintf(w, "cloak_handshakes_accepted_total %v\n", m.handshakesAccepted.Load())
+
+	writeMetric(w, "cloak_handshakes_rejected_total", "counter", "Handshakes that are redirected to the cover site, by reason.")
+	for i, reason := range rejectReasons {
+		fmt.Fprintf(w, "cloak_handshakes_rejected_total{reason=%q} %v\n", reason.label, m.handshakesRejected[i].Load())
+	}
+
+	writeMetric(w, "cloak_streams_opened_total", "counter", "Streams opened by clients.")
+	fmt.Fprintf(w, "cloak_streams_opened_total %v\n", m.streamsOpened.Load())
+	writeMetric(w, "cloak_streams_closed_total", "counter", "Streams that have finished.")
+	fmt.Fprintf(w, "cloak_streams_closed_total %v\n", m.streamsClosed.Load())
+
+	writeMetric(w, "cloak_replay_cache_entries", "gauge", "Randoms of recent handshakes kept to detect replays.")
+	fmt.Fprintf(w, "cloak_replay_cache_entries %v\n", sta.replayCache.size())
+
+	writeMetric(w, "cloak_handshake_queue_depth", "gauge", "Handshakes waiting for a worker to be authenticated.")
+	fmt.Fprintf(w, "cloak_handshake_queue_depth %v\n", sta.handshakes.queued())
+
+	if sta.Panel == nil {
+		return
+	}
+	// the users of tenants are counted with the ck-server's
+	panels := []*userPanel{sta.Panel}
+	for _, tenant := range sta.tenants {
+		panels = append(panels, tenant.Panel)
+	}
+	var users, sessions int
+	var buffered mux.BufferedBytes
+	traffic := make(map[[16]byte]userTraffic)
+	for _, panel := range panels {
+		u, s := panel.numActive()
+		users, sessions = users+u, sessions+s
+		b := panel.buffered()
+		buffered.Sending += b.Sending
+		buffered.Retained += b.Retained
+		buffered.Duplicating += b.Duplicating
+		buffered.Receiving += b.Receiving
+		for arrUID, total := range panel.Traffic() {
+			sum := traffic[arrUID]
+			sum.Up, sum.Down = sum.Up+total.Up, sum.Down+total.Down
+			traffic[arrUID] = sum
+		}
+	}
+	writeMetric(w, "cloak_active_users", "gauge", "Users with at least one session.")
+	fmt.Fprintf(w, "cloak_active_users %v\n", users)
+	writeMetric(w, "cloak_active_sessions", "gauge", "Sessions of all users.")
+	fmt.Fprintf(w, "cloak_active_sessions %v\n", sessions)
+
+	writeMetric(w, "cloak_session_buffered_bytes", "gauge", "Bytes held in memory by the sessions of all users, by what they're waiting on.")
+	fmt.Fprintf(w, "cloak_session_buffered_bytes{kind=\"sending\"} %v\n", buffered.Sending)
+	fmt.Fprintf(w, "cloak_session_buffered_bytes{kind=\"retained\"} %v\n", buffered.Retained)
+	fmt.Fprintf(w, "cloak_session_buffered_bytes{kind=\"duplicating\"} %v\n", buffered.Duplicating)
+	fmt.Fprintf(w, "cloak_session_buffered_bytes{kind=\"receiving\"} %v\n", buffered.Receiving)
+
+	UIDs := make([]string, 0, len(traffic))
+	byUID := make(map[string]userTraffic, len(traffic))
+	for arrUID, total := range traffic {
+		UID := base64.StdEncoding.EncodeToString(arrUID[:])
+		UIDs = append(UIDs, UID)
+		byUID[UID] = total
+	}
+	sort.Strings(UIDs)
+	writeMetric(w, "cloak_user_bytes_total", "counter", "Traffic of users subject to bandwidth and credit controls.")
+	for _, UID := range UIDs {
+		fmt.Fprintf(w, "cloak_user_bytes_total{uid=%q,direction=\"up\"} %v\n", UID, byUID[UID].Up)
+		fmt.Fprintf(w, "cloak_user_bytes_total{uid=%q,direction=\"down\"} %v\n", UID, byUID[UID].Down)
+	}
+}
+
+// MetricsHandler serves the metrics of ck-server to Prometheus on /metrics
+func MetricsHandler(sta *State) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, sta)
+	})
+	return mux
+}
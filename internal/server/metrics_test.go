@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	sta, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999"}, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sta.metrics.handshake(nil)
+	sta.metrics.handshake(nil)
+	sta.metrics.handshake(ErrReplay)
+	sta.metrics.handshake(fmt.Errorf("%w: bad ClientHello", ErrNotCloak))
+	sta.metrics.handshake(ErrBadProxyMethod)
+	sta.metrics.handshake(ErrHandshakeOverloaded)
+	sta.metrics.handshake(fmt.Errorf("%w: %w", ErrBadClientHello, ErrHelloTruncated))
+	sta.metrics.handshake(errors.New("something else"))
+	sta.metrics.streamsOpened.Add(3)
+	sta.metrics.streamsClosed.Add(1)
+	sta.registerRandom([32]byte{1}, mockWorldState.Now())
+
+	_ = sta.Panel.Manager.WriteUserInfo(validUserInfo)
+	user, err := sta.Panel.GetUser(validUserInfo.UID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = user.GetSession(1, "shadowsocks", "", getSeshConfig(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.valve.AddRx(10)
+	user.valve.AddTx(20)
+	sta.Panel.updateUsageQueue()
+	user.valve.AddRx(1)
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(sta).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expecting status 200, got %v", rec.Code)
+	}
+
+	UID := base64.StdEncoding.EncodeToString(validUserInfo.UID)
+	for _, expected := range []string{
+		"cloak_handshakes_accepted_total 2",
+		`cloak_handshakes_rejected_total{reason="replay"} 1`,
+		`cloak_handshakes_rejected_total{reason="overloaded"} 1`,
+		`cloak_handshakes_rejected_total{reason="not_cloak"} 1`,
+		`cloak_handshakes_rejected_total{reason="bad_proxy_method"} 1`,
+		`cloak_handshakes_rejected_total{reason="hello_truncated"} 1`,
+		`cloak_handshakes_rejected_total{reason="hello_odd_field"} 0`,
+		`cloak_handshakes_rejected_total{reason="rate_limited"} 0`,
+		`cloak_handshakes_rejected_total{reason="other"} 1`,
+		"cloak_streams_opened_total 3",
+		"cloak_streams_closed_total 1",
+		"cloak_replay_cache_entries 1",
+		"cloak_handshake_queue_depth 0",
+		"cloak_active_users 1",
+		"cloak_active_sessions 1",
+		`cloak_session_buffered_bytes{kind="sending"} 0`,
+		`cloak_session_buffered_bytes{kind="receiving"} 0`,
+		`cloak_user_bytes_total{uid="` + UID + `",direction="up"} 11`,
+		`cloak_user_bytes_total{uid="` + UID + `",direction="down"} 20`,
+	} {
+		if !strings.Contains(rec.Body.String(), expected+"\n") {
+			t.Errorf("%q isn't in the metrics:\n%v", expected, rec.Body.String())
+		}
+	}
+
+	t.Run("only on /metrics", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		MetricsHandler(sta).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("expecting status 404, got %v", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// probeWatch keeps statistics of the ClientHellos that aren't from Cloak clients in TLS mode. Most are from visitors
+// of the cover site, clients in real TLS or CDN mode, and scanners, but campaigns of active probing stand out in them.
+// They're logged and started over every interval
+type probeWatch struct {
+	interval time.Duration
+
+	m sync.Mutex
+	// when the statistics were started
+	since  time.Time
+	hellos int
+	// ClientHellos that can't be parsed, e.g. random bytes starting with 0x16
+	malformed int
+	// ClientHellos without an SNI. Browsers always send one to a domain, unlike scanners
+	noSNI int
+	// how many times each ClientHello has been seen, by its digest. Real clients never send one twice, as they have
+	// a new random every time, so a repeat is almost certainly a replay
+	digests  map[[32]byte]int
+	repeated int
+	// by JA3N hash, which sorts the extensions that Chrome shuffles
+	fingerprints map[string]int
+}
+
+const (
+	// the number of distinct ClientHellos and fingerprints remembered in an interval, beyond which new ones are only
+	// counted
+	maxProbeDigests      = 1 << 16
+	maxProbeFingerprints = 1 << 12
+	// the number of the most common fingerprints logged
+	topProbeFingerprints = 5
+)
+
+func newProbeWatch(interval time.Duration, now time.Time) *probeWatch {
+	return &probeWatch{
+		interval:     interval,
+		since:        now,
+		digests:      make(map[[32]byte]int),
+		fingerprints: make(map[string]int),
+	}
+}
+
+// record counts a ClientHello, including its record layer, that isn't from a Cloak client
+func (w *probeWatch) record(clientHello []byte, remoteAddr net.Addr) {
+	digest := sha256.Sum256(clientHello)
+	var fingerprint common.Fingerprint
+	var serverName string
+	parsed := false
+	if len(clientHello) >= 5 && int(binary.BigEndian.Uint16(clientHello[3:5])) == len(clientHello)-5 {
+		var err error
+		fingerprint, serverName, err = common.ParseFingerprint(clientHello[5:])
+		parsed = err == nil
+	}
+
+	w.m.Lock()
+	defer w.m.Unlock()
+	w.hellos++
+	if !parsed {
+		w.malformed++
+		return
+	}
+	if serverName == "" {
+		w.noSNI++
+	}
+	ja3n := fingerprint.JA3NHash()
+	if _, ok := w.fingerprints[ja3n]; ok || len(w.fingerprints) < maxProbeFingerprints {
+		w.fingerprints[ja3n]++
+	}
+	seen, ok := w.digests[digest]
+	if !ok && len(w.digests) >= maxProbeDigests {
+		return
+	}
+	w.digests[digest] = seen + 1
+	if seen > 0 {
+		w.repeated++
+	}
+	if seen == 1 {
+		log.WithFields(log.Fields{
+			"remoteAddr": remoteAddr,
+			"ja3n":       ja3n,
+			"SNI":        serverName,
+		}).Warn("A ClientHello has been seen again, which is likely replayed by a prober")
+	}
+}
+
+type probeFingerprint struct {
+	ja3n  string
+	count int
+}
+
+type probeSummary struct {
+	since     time.Time
+	hellos    int
+	malformed int
+	noSNI     int
+	repeated  int
+	// the most common fingerprints first
+	top          []probeFingerprint
+	fingerprints int
+}
+
+// flush returns the statistics since they were last flushed, and starts them over
+func (w *probeWatch) flush(now time.Time) probeSummary {
+	w.m.Lock()
+	defer w.m.Unlock()
+	summary := probeSummary{
+		since:        w.since,
+		hellos:       w.hellos,
+		malformed:    w.malformed,
+		noSNI:        w.noSNI,
+		repeated:     w.repeated,
+		fingerprints: len(w.fingerprints),
+	}
+	for ja3n, count := range w.fingerprints {
+		summary.top = append(summary.top, probeFingerprint{ja3n, count})
+	}
+	sort.Slice(summary.top, func(i, j int) bool {
+		if summary.top[i].count != summary.top[j].count {
+			return summary.top[i].count > summary.top[j].count
+		}
+		return summary.top[i].ja3n < summary.top[j].ja3n
+	})
+	if len(summary.top) > topProbeFingerprints {
+		summary.top = summary.top[:topProbeFingerprints]
+	}
+
+	w.since = now
+	w.hellos, w.malformed, w.noSNI, w.repeated = 0, 0, 0, 0
+	w.digests = make(map[[32]byte]int)
+	w.fingerprints = make(map[string]int)
+	return summary
+}
+
+func (summary probeSummary) log() {
+	if summary.hellos == 0 {
+		return
+	}
+	log.WithFields(log.Fields{
+		"hellos":       summary.hellos,
+		"noSNI":        summary.noSNI,
+		"malformed":    summary.malformed,
+		"repeated":     summary.repeated,
+		"fingerprints": summary.fingerprints,
+	}).Infof("ClientHellos not from Cloak clients since %v", summary.since.Format(time.RFC3339))
+	for _, f := range summary.top {
+		log.WithFields(log.Fields{
+			"ja3n":  f.ja3n,
+			"count": f.count,
+		}).Info("Common fingerprint of ClientHellos not from Cloak clients")
+	}
+	// a handful of hellos without SNI is normal from scanners that sweep IP addresses
+	if summary.hellos >= 20 && summary.noSNI*2 > summary.hellos {
+		log.Warnf("%v of %v ClientHellos have no SNI, which is typical of scanners and active probing", summary.noSNI, summary.hellos)
+	}
+}
+
+// logEvery logs and starts over the statistics every interval, forever
+func (w *probeWatch) logEvery(worldState common.WorldState) {
+	for {
+		time.Sleep(w.interval)
+		w.flush(worldState.Now()).log()
+	}
+}
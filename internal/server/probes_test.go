@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// makeTestHello makes the ClientHello of a uTLS preset, including its record layer
+func makeTestHello(t *testing.T, serverName string, helloID utls.ClientHelloID) []byte {
+	uconn := utls.UClient(&net.TCPConn{}, &utls.Config{ServerName: serverName, InsecureSkipVerify: true}, helloID)
+	if err := uconn.BuildHandshakeState(); err != nil {
+		t.Fatal(err)
+	}
+	ch := uconn.HandshakeState.Hello.Raw
+	record := []byte{0x16, 0x03, 0x01, 0x00, 0x00}
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(ch)))
+	return append(record, ch...)
+}
+
+func TestProbeWatch(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	remoteAddr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+	w := newProbeWatch(time.Minute, now)
+
+	replayed := makeTestHello(t, "www.example.com", utls.HelloChrome_Auto)
+	for i := 0; i < 3; i++ {
+		w.record(replayed, remoteAddr)
+	}
+	w.record(makeTestHello(t, "www.example.com", utls.HelloChrome_Auto), remoteAddr)
+	w.record(makeTestHello(t, "", utls.HelloFirefox_Auto), remoteAddr)
+	w.record([]byte{0x16, 0x03, 0x01, 0x00, 0x02, 0x01}, remoteAddr)
+
+	summary := w.flush(now.Add(time.Minute))
+	if !summary.since.Equal(now) {
+		t.Errorf("expecting the statistics since %v, got %v", now, summary.since)
+	}
+	if summary.hellos != 6 {
+		t.Errorf("expecting 6 hellos, got %v", summary.hellos)
+	}
+	if summary.malformed != 1 {
+		t.Errorf("expecting 1 malformed hello, got %v", summary.malformed)
+	}
+	if summary.noSNI != 1 {
+		t.Errorf("expecting 1 hello without SNI, got %v", summary.noSNI)
+	}
+	if summary.repeated != 2 {
+		t.Errorf("expecting 2 repeated hellos, got %v", summary.repeated)
+	}
+	if summary.fingerprints != 2 || len(summary.top) != 2 {
+		t.Fatalf("expecting 2 fingerprints, got %v", summary.top)
+	}
+	if summary.top[0].count != 4 || summary.top[1].count != 1 {
+		t.Errorf("expecting the most common fingerprint first, got %v", summary.top)
+	}
+
+	t.Run("started over", func(t *testing.T) {
+		summary := w.flush(now.Add(2 * time.Minute))
+		if summary.hellos != 0 || summary.fingerprints != 0 || !summary.since.Equal(now.Add(time.Minute)) {
+			t.Errorf("statistics not started over: %+v", summary)
+		}
+		w.record(replayed, remoteAddr)
+		if summary := w.flush(now.Add(3 * time.Minute)); summary.repeated != 0 {
+			t.Error("a ClientHello seen in the last interval is counted as repeated")
+		}
+	})
+}
+
+func TestProbeWatch_top(t *testing.T) {
+	w := newProbeWatch(time.Minute, time.Now())
+	for i := 0; i < topProbeFingerprints+3; i++ {
+		w.fingerprints[string(rune('a'+i))] = i
+	}
+	summary := w.flush(time.Now())
+	if len(summary.top) != topProbeFingerprints {
+		t.Fatalf("expecting %v fingerprints, got %v", topProbeFingerprints, len(summary.top))
+	}
+	for i := 1; i < len(summary.top); i++ {
+		if summary.top[i-1].count < summary.top[i].count {
+			t.Errorf("fingerprints not sorted: %v", summary.top)
+		}
+	}
+	if summary.fingerprints != topProbeFingerprints+3 {
+		t.Errorf("expecting %v fingerprints counted, got %v", topProbeFingerprints+3, summary.fingerprints)
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long the first retry of a proxy server waits, which doubles with each retry up to maxProxyRetryBackoff
+	proxyRetryBackoff    = 200 * time.Millisecond
+	maxProxyRetryBackoff = 5 * time.Second
+	maxProxyRetries      = 10
+)
+
+// ProxyDialPolicy is how the proxy server of a ProxyMethod, or the targets of a direct one, are connected to, so that
+// a server with several addresses can choose which its backend traffic goes from. In JSON, it's given as the entry of
+// ProxyBook being an object of Network, Addr and these
+type ProxyDialPolicy struct {
+	// how long each connection attempt has in seconds, 0 to leave it to the system
+	DialTimeout int
+	// the local IP address to connect from, empty for any
+	SourceAddr string
+	// 4 or 6 to connect over IPv4 or IPv6 only, empty for either
+	IPVersion string
+	// how many times a failed connection is tried again, waiting longer each time
+	Retries int
+}
+
+// proxyDialer connects as in a ProxyDialPolicy
+type proxyDialer struct {
+	dialer   net.Dialer
+	sourceIP net.IP
+	// the suffix of the networks connected over, "4", "6" or empty
+	ipVersion string
+	retries   int
+}
+
+func makeProxyDialer(policy ProxyDialPolicy, keepAlive time.Duration) (*proxyDialer, error) {
+	if policy.DialTimeout < 0 {
+		return nil, errors.New("DialTimeout can't be negative")
+	}
+	if policy.Retries < 0 || policy.Retries > maxProxyRetries {
+		return nil, fmt.Errorf("Retries must be between 0 and %v", maxProxyRetries)
+	}
+	switch policy.IPVersion {
+	case "", "4", "6":
+	default:
+		return nil, fmt.Errorf("unknown IPVersion %v", policy.IPVersion)
+	}
+	d := &proxyDialer{
+		dialer:    net.Dialer{Timeout: time.Duration(policy.DialTimeout) * time.Second, KeepAlive: keepAlive},
+		ipVersion: policy.IPVersion,
+		retries:   policy.Retries,
+	}
+	if policy.SourceAddr != "" {
+		d.sourceIP = net.ParseIP(policy.SourceAddr)
+		if d.sourceIP == nil {
+			return nil, fmt.Errorf("SourceAddr %v isn't an IP address", policy.SourceAddr)
+		}
+		if !d.allows(d.sourceIP) {
+			return nil, fmt.Errorf("SourceAddr %v isn't of IPv%v", policy.SourceAddr, policy.IPVersion)
+		}
+	}
+	return d, nil
+}
+
+// allows returns whether ip is of the IP version connected over
+func (d *proxyDialer) allows(ip net.IP) bool {
+	switch d.ipVersion {
+	case "4":
+		return ip.To4() != nil
+	case "6":
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// localUDPAddr is what UDP sockets are bound to, nil for any address
+func (d *proxyDialer) localUDPAddr() *net.UDPAddr {
+	if d.sourceIP == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: d.sourceIP}
+}
+
+func (d *proxyDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial that gives up, on the attempt or the wait before the next, once ctx is done
+func (d *proxyDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := d.dialer
+	// a Unix domain socket has no IP version or source address to connect from
+	if network != "unix" {
+		network += d.ipVersion
+		if d.sourceIP != nil {
+			if strings.HasPrefix(network, "udp") {
+				dialer.LocalAddr = &net.UDPAddr{IP: d.sourceIP}
+			} else {
+				dialer.LocalAddr = &net.TCPAddr{IP: d.sourceIP}
+			}
+		}
+	}
+	backoff := proxyRetryBackoff
+	for retry := 0; ; retry++ {
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err == nil || retry >= d.retries || ctx.Err() != nil {
+			return conn, err
+		}
+		log.Debugf("Failed to connect to %v, retrying in %v: %v", address, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		backoff = min(backoff*2, maxProxyRetryBackoff)
+	}
+}
+
+// parseProxyDialers makes the dialers of the ProxyMethods that have a ProxyDialPolicy
+func parseProxyDialers(policies map[string]ProxyDialPolicy, keepAlive time.Duration) (map[string]*proxyDialer, error) {
+	dialers := make(map[string]*proxyDialer)
+	for name, policy := range policies {
+		d, err := makeProxyDialer(policy, keepAlive)
+		if err != nil {
+			return nil, fmt.Errorf("bad dial policy of %v: %v", name, err)
+		}
+		dialers[strings.ToLower(name)] = d
+	}
+	return dialers, nil
+}
+
+// proxyDialer returns what connects to the proxy server of a ProxyMethod, and nil as the policy if it doesn't have one
+func (sta *State) proxyDialer(proxyMethod string) (dialer common.Dialer, policy *proxyDialer) {
+	sta.reloadM.RLock()
+	policy = sta.proxyDialers[proxyMethod]
+	sta.reloadM.RUnlock()
+	if policy == nil {
+		return sta.ProxyDialer, nil
+	}
+	return policy, policy
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMakeProxyDialer(t *testing.T) {
+	bad := map[string]ProxyDialPolicy{
+		"negative timeout":        {DialTimeout: -1},
+		"negative retries":        {Retries: -1},
+		"too many retries":        {Retries: maxProxyRetries + 1},
+		"unknown IP version":      {IPVersion: "5"},
+		"bad source address":      {SourceAddr: "10.0.0"},
+		"source of wrong version": {SourceAddr: "10.0.0.1", IPVersion: "6"},
+	}
+	for name, policy := range bad {
+		t.Run(name, func(t *testing.T) {
+			if _, err := makeProxyDialer(policy, -1); err == nil {
+				t.Error("expecting an error")
+			}
+		})
+	}
+}
+
+func TestProxyDialer_Dial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	t.Run("source address", func(t *testing.T) {
+		d, err := makeProxyDialer(ProxyDialPolicy{SourceAddr: "127.0.0.2", DialTimeout: 1}, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := d.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Skipf("127.0.0.2 can't be connected from: %v", err)
+		}
+		defer conn.Close()
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer accepted.Close()
+		if ip := accepted.RemoteAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.2")) {
+			t.Errorf("expecting the connection to be from 127.0.0.2, got %v", ip)
+		}
+	})
+	t.Run("IP version", func(t *testing.T) {
+		d, err := makeProxyDialer(ProxyDialPolicy{IPVersion: "6"}, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := d.Dial("tcp", l.Addr().String()); err == nil {
+			conn.Close()
+			t.Error("connected to IPv4 over IPv6 only")
+		}
+	})
+	t.Run("retries", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed.Close()
+		d, err := makeProxyDialer(ProxyDialPolicy{Retries: 2}, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if _, err := d.Dial("tcp", closed.Addr().String()); err == nil {
+			t.Fatal("expecting an error")
+		}
+		if elapsed := time.Since(start); elapsed < proxyRetryBackoff*3 {
+			t.Errorf("expecting to back off for at least %v, gave up after %v", proxyRetryBackoff*3, elapsed)
+		}
+	})
+	t.Run("cancelled retries", func(t *testing.T) {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed.Close()
+		d, err := makeProxyDialer(ProxyDialPolicy{Retries: maxProxyRetries}, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), proxyRetryBackoff/2)
+		defer cancel()
+		start := time.Now()
+		if _, err := d.DialContext(ctx, "tcp", closed.Addr().String()); err != context.DeadlineExceeded {
+			t.Errorf("expecting context.DeadlineExceeded, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > proxyRetryBackoff {
+			t.Errorf("kept retrying for %v after the context was done", elapsed)
+		}
+	})
+}
+
+func TestState_proxyDialer(t *testing.T) {
+	raw := RawConfig{
+		ProxyBook:         map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388"}, "openvpn": {"udp", "[::1]:1194"}},
+		ProxyDialPolicies: map[string]ProxyDialPolicy{"OpenVPN": {IPVersion: "6"}},
+	}
+	sta := &State{ProxyDialer: &net.Dialer{}}
+	if err := sta.Reload(raw); err != nil {
+		t.Fatal(err)
+	}
+	if dialer, policy := sta.proxyDialer("shadowsocks"); policy != nil || dialer != sta.ProxyDialer {
+		t.Error("expecting ProxyDialer for a proxy method without a dial policy")
+	}
+	if _, policy := sta.proxyDialer("openvpn"); policy == nil || policy.ipVersion != "6" {
+		t.Errorf("expecting the dial policy of openvpn, got %+v", policy)
+	}
+
+	raw.ProxyBook["shadowsocks"] = []string{"tcp", "127.0.0.1:8388"}
+	raw.ProxyDialPolicies = map[string]ProxyDialPolicy{"shadowsocks": {IPVersion: "6"}}
+	if err := sta.Reload(raw); err == nil {
+		t.Error("expecting an IPv4 address not to be resolved over IPv6 only")
+	}
+}
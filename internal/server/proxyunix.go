@@ -0,0 +1,55 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long the check of a Unix domain socket at startup waits to connect to it
+const unixSocketCheckTimeout = 2 * time.Second
+
+// parseUnixProxy makes the address of a ProxyMethod whose proxy server listens on the Unix domain socket at path, or
+// the abstract socket name if path is @name, and checks that ck-server is allowed to connect to it
+func parseUnixProxy(name string, path string, policy *proxyDialer) (*net.UnixAddr, error) {
+	if path == "" {
+		return nil, fmt.Errorf("the Unix domain socket of %v has no path", name)
+	}
+	if policy != nil && (policy.ipVersion != "" || policy.sourceIP != nil) {
+		return nil, fmt.Errorf("%v is a Unix domain socket, which can't have IPVersion or SourceAddr", name)
+	}
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	if strings.HasPrefix(path, "@") {
+		if !abstractUnixSockets {
+			return nil, fmt.Errorf("the abstract socket %v of %v is only supported on Linux", path, name)
+		}
+	} else {
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			// the proxy server may be started after ck-server
+			log.Warnf("%v of %v doesn't exist yet", path, name)
+			return addr, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%v of %v isn't a Unix domain socket", path, name)
+		}
+	}
+	conn, err := net.DialTimeout("unix", path, unixSocketCheckTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return nil, fmt.Errorf("ck-server isn't allowed to connect to %v of %v: %v", path, name, err)
+		}
+		log.Warnf("%v of %v can't be connected to yet: %v", path, name, err)
+		return addr, nil
+	}
+	conn.Close()
+	return addr, nil
+}
@@ -0,0 +1,4 @@
+package server
+
+// Linux has sockets in an abstract namespace, named @name in ProxyBook, which have no file
+const abstractUnixSockets = true
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseUnixProxy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix domain sockets aren't supported: %v", err)
+	}
+	defer l.Close()
+
+	t.Run("socket", func(t *testing.T) {
+		addr, err := parseUnixProxy("shadowsocks", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.Network() != "unix" || addr.String() != path {
+			t.Errorf("expecting unix %v, got %v %v", path, addr.Network(), addr)
+		}
+	})
+	t.Run("not yet created", func(t *testing.T) {
+		if _, err := parseUnixProxy("shadowsocks", filepath.Join(dir, "later.sock"), nil); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("not a socket", func(t *testing.T) {
+		file := filepath.Join(dir, "file")
+		if err := os.WriteFile(file, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parseUnixProxy("shadowsocks", file, nil); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("no path", func(t *testing.T) {
+		if _, err := parseUnixProxy("shadowsocks", "", nil); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("IP version", func(t *testing.T) {
+		if _, err := parseUnixProxy("shadowsocks", path, &proxyDialer{ipVersion: "6"}); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("permission denied", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can connect to any socket")
+		}
+		if err := os.Chmod(path, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(path, 0777)
+		if _, err := parseUnixProxy("shadowsocks", path, nil); err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("abstract", func(t *testing.T) {
+		name := fmt.Sprintf("@cloak-test-%v", os.Getpid())
+		if !abstractUnixSockets {
+			if _, err := parseUnixProxy("shadowsocks", name, nil); err == nil {
+				t.Error("expecting an error")
+			}
+			return
+		}
+		abstract, err := net.Listen("unix", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer abstract.Close()
+		if _, err := parseUnixProxy("shadowsocks", name, nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestProxyDialer_Dial_Unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix domain sockets aren't supported: %v", err)
+	}
+	defer l.Close()
+	d, err := makeProxyDialer(ProxyDialPolicy{DialTimeout: 1, Retries: 1}, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := d.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
+)
+
+// In real TLS mode, ck-server holds a genuine certificate of its domain and completes a real TLS handshake with every
+// ClientHello that isn't from a Cloak client in TLS mimicry mode. A Cloak client in realtls Transport mode then sends
+// its authentication data as the first application data inside the encrypted channel, in the same format as the
+// hidden data of gRPC mode. Anything else is a visitor of the cover site, whose decrypted traffic is proxied to the
+// redirection server. To an observer, ck-server is then an ordinary HTTPS server with a valid certificate. A CDN
+// that connects to us in TLS is served the same way, with the WebSocket upgrade requests of clients in CDN mode inside.
+
+// RealTLS is the Cloak authentication inside a TLS connection terminated with the certificate in TLSCert
+type RealTLS struct{}
+
+func (RealTLS) String() string { return "RealTLS" }
+
+// reqPacket for real TLS is the first application data received after the TLS handshake, and the Responder must be
+// called with the *tls.Conn
+func (RealTLS) processFirstPacket(reqPacket []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+	if len(reqPacket) != 96 {
+		err = fmt.Errorf("%w: first application data is %v bytes", ErrNotCloak, len(reqPacket))
+		return
+	}
+	fragments, err = unmarshalHidden(reqPacket, staticPvs)
+	if err != nil {
+		err = fmt.Errorf("failed to unmarshal first application data into authFragments: %v", err)
+		return
+	}
+
+	respond = RealTLS{}.makeResponder(fragments.sharedSecret)
+	return
+}
+
+func (RealTLS) makeResponder(sharedSecret [32]byte) Responder {
+	// the reply is the same as gRPC's, as both are written into a stream that's already encrypted
+	writeReply := GRPC{}.makeResponder(sharedSecret)
+	respond := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error) {
+		preparedConn, err = writeReply(originalConn, sessionKey, randSource)
+		if err != nil {
+			return
+		}
+		// TLS doesn't keep the boundaries of writes, so each frame is put in a record of its own inside the
+		// encrypted channel
+		preparedConn = &common.TLSConn{Conn: preparedConn}
+		return
+	}
+	return respond
+}
+
+// redirectDecryptedToWeb relays the decrypted traffic of a visitor to the redirection server of the SNI the visitor
+// asked for, or serves it with WebRoot if it's set. Standard ports of https are spoken to in TLS, as the traffic is
+// no longer encrypted
+func redirectDecryptedToWeb(conn *tls.Conn, firstData []byte, sta *State) {
+	if sta.webRoot != nil {
+		serveWebRoot(conn, firstData, sta)
+		return
+	}
+	sni := conn.ConnectionState().ServerName
+	redirAddr, redirServerName := sta.redirAddr(sni, "443")
+	webConn, err := sta.RedirDialer.Dial("tcp", redirAddr)
+	if err != nil {
+		log.Errorf("Making connection to redirection server: %v", err)
+		conn.Close()
+		return
+	}
+	if _, redirPort, _ := net.SplitHostPort(redirAddr); redirPort == "443" {
+		if redirServerName == "" {
+			redirServerName = sni
+		}
+		webConn = tls.Client(webConn, &tls.Config{
+			ServerName: redirServerName,
+			// an IP can't be verified without a name to go by
+			InsecureSkipVerify: redirServerName == "",
+			NextProtos:         realTLSNextProtos,
+		})
+	}
+	relayToWeb(conn, webConn, firstData, nil)
+}
+
+// the visitor is only offered HTTP/1.1 so that the decrypted traffic can be relayed as is to any redirection server
+var realTLSNextProtos = []string{"http/1.1"}
+
+// serveRealTLS terminates TLS on conn, whose ClientHello in firstPacket has already been read and isn't from a Cloak
+// client in TLS mimicry mode. What's inside is only served if its transport is one of transports
+func serveRealTLS(conn net.Conn, firstPacket []byte, sta *State, transports transportSet) {
+	remoteAddr := conn.RemoteAddr()
+	tlsConn := tls.Server(&firstBuffedConn{Conn: conn, firstPacket: firstPacket}, sta.realTLS)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	err := tlsConn.Handshake()
+	if err != nil {
+		log.WithField("remoteAddr", remoteAddr).Debugf("TLS handshake failed: %v", err)
+		conn.Close()
+		return
+	}
+	switch tlsConn.ConnectionState().NegotiatedProtocol {
+	case acme.ALPNProto:
+		// a TLS-ALPN-01 challenge, which is over once the handshake is done
+		tlsConn.Close()
+		return
+	case http2.NextProtoTLS:
+		// a client in HTTP/2 mode, or a visitor whose requests are proxied to the redirection server one by one
+		tlsConn.SetDeadline(time.Time{})
+		serveHTTP2(tlsConn, nil, tlsConn.ConnectionState().ServerName, sta, transports)
+		return
+	}
+
+	buf := make([]byte, 16384) // one maximum sized TLS record
+	tlsConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	i, err := tlsConn.Read(buf)
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// like in dispatchConnection, let the redirection server decide how long to wait for someone who
+			// sends nothing
+			log.WithField("remoteAddr", remoteAddr).Debug("nothing has been read after TLS handshake")
+			redirectDecryptedToWeb(tlsConn, nil, sta)
+			return
+		}
+		log.WithField("remoteAddr", remoteAddr).Infof("failed to read anything after TLS handshake: %v", err)
+		tlsConn.Close()
+		return
+	}
+	data := buf[:i]
+
+	goWeb := sta.decoy(tlsConn, func() { redirectDecryptedToWeb(tlsConn, data, sta) })
+
+	// a CDN that connects to us in TLS sends the WebSocket upgrade request of a client in CDN mode in it
+	var transport Transport = RealTLS{}
+	allowed := transports.allows(RealTLS{}.String())
+	if data[0] == 0x47 {
+		transport = &WebSocket{path: sta.WSPath, hosts: sta.webSocketHosts(), origins: sta.WSOrigins}
+		allowed = transports.allows(WebSocket{}.String())
+	}
+	if !allowed {
+		goWeb()
+		return
+	}
+	ci, finishHandshake, err := authenticate(data, transport, sta)
+	if errors.Is(err, ErrNotCloak) {
+		log.WithField("remoteAddr", remoteAddr).Debug(err)
+		goWeb()
+		return
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"remoteAddr": remoteAddr,
+			"UID":        b64(ci.UID),
+			"sessionId":  ci.SessionId,
+		}).Warn(err)
+		if sta.tarpitted(tlsConn, err) {
+			return
+		}
+		goWeb()
+		return
+	}
+	ci.SNI = tlsConn.ConnectionState().ServerName
+	serveClient(tlsConn, ci, finishHandshake, sta, goWeb)
+}
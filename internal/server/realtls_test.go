@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/test"
+)
+
+func TestRealTLS_processFirstPacket(t *testing.T) {
+	_, _, err := RealTLS{}.processFirstPacket([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"), nil)
+	if !errors.Is(err, ErrNotCloak) {
+		t.Errorf("expecting %v, got %v", ErrNotCloak, err)
+	}
+}
+
+func TestRealTLSDecoyFallback(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("decoy " + r.URL.Path))
+	}))
+	defer web.Close()
+
+	certPath, keyPath, pool := test.WriteSelfSignedCert(t, t.TempDir())
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	sta, err := InitState(RawConfig{
+		DatabasePath: tmpDB.Name(),
+		RedirAddr:    web.Listener.Addr().String(),
+		TLSCert:      certPath,
+		TLSKey:       keyPath,
+	}, mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ckL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ckL.Close()
+	go func() {
+		for {
+			conn, err := ckL.Accept()
+			if err != nil {
+				return
+			}
+			go dispatchConnection(conn, sta, nil)
+		}
+	}()
+
+	t.Run("visitor", func(t *testing.T) {
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, ckL.Addr().String())
+			},
+			TLSClientConfig: &tls.Config{RootCAs: pool, NextProtos: []string{"h2", "http/1.1"}},
+		}}
+		resp, err := client.Get("https://www.example.com/index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "decoy /index.html" {
+			t.Errorf("expecting response from decoy, got %q", body)
+		}
+		if resp.TLS.NegotiatedProtocol != "http/1.1" {
+			t.Errorf("expecting http/1.1 to be negotiated, got %q", resp.TLS.NegotiatedProtocol)
+		}
+	})
+
+	t.Run("without certificate", func(t *testing.T) {
+		sta.Reload(RawConfig{RedirAddr: web.Listener.Addr().String()})
+		defer sta.Reload(RawConfig{RedirAddr: web.Listener.Addr().String(), TLSCert: certPath, TLSKey: keyPath})
+		conn, err := tls.Dial("tcp", ckL.Addr().String(), &tls.Config{ServerName: "www.example.com", RootCAs: pool})
+		if err == nil {
+			conn.Close()
+			t.Error("TLS is still terminated after the certificate is removed")
+		}
+	})
+}
+
+func TestInitState_RealTLS(t *testing.T) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	_, err := InitState(RawConfig{
+		DatabasePath: tmpDB.Name(),
+		RedirAddr:    "127.0.0.1:9999",
+		TLSCert:      filepath.Join(t.TempDir(), "nonexistent.pem"),
+	}, mockWorldState)
+	if err == nil {
+		t.Error("expecting error for a certificate that can't be loaded")
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The replay cache remembers the random of every handshake in a Bloom filter per epoch of TIMESTAMP_TOLERANCE,
+// which the timestamp a client sends in its handshake falls into. Since a handshake is only accepted if its timestamp
+// is no earlier than the start of the current epoch, filters of past epochs are dropped, so at most two filters are
+// kept, and memory is bounded by the capacity regardless of how many handshakes are received. A filter that has taken
+// more than its capacity has a higher false positive rate, which rejects some genuine handshakes as replays.
+
+const defaultReplayCacheCapacity = 1 << 17
+
+// each filter has a false positive rate of 2^-bloomHashes (about one in a million) when it's at its capacity
+const bloomHashes = 20
+
+const replayCacheSaveInterval = 10 * time.Second
+
+var replayCacheMagic = []byte("CKRC\x01")
+
+var ErrReplayCacheMismatch = errors.New("replay cache is of a different capacity")
+
+type bloomFilter struct {
+	bits  []uint64
+	count uint64
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	// the optimal number of bits for bloomHashes at capacity is capacity*bloomHashes/ln2
+	numBits := uint64(capacity) * bloomHashes * 1443 / 1000
+	return &bloomFilter{bits: make([]uint64, numBits/64+1)}
+}
+
+// testAndAdd adds the element of digest, returning whether it might have been added before
+func (f *bloomFilter) testAndAdd(digest [32]byte) bool {
+	numBits := uint64(len(f.bits)) * 64
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	present := true
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % numBits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			present = false
+			f.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	if !present {
+		f.count++
+	}
+	return present
+}
+
+type replayCache struct {
+	m sync.Mutex
+	// the randoms are hashed with a secret salt so that nobody can choose randoms that share bits in the filters
+	salt     [32]byte
+	capacity int
+	filters  map[int64]*bloomFilter
+}
+
+func newReplayCache(capacity int, worldState common.WorldState) *replayCache {
+	c := &replayCache{
+		capacity: capacity,
+		filters:  make(map[int64]*bloomFilter),
+	}
+	common.RandRead(worldState.Rand, c.salt[:])
+	return c
+}
+
+func epochOf(t time.Time) int64 {
+	return t.Unix() / int64(TIMESTAMP_TOLERANCE/time.Second)
+}
+
+// register remembers random from a handshake with timestamp, returning whether it might have been seen before
+func (c *replayCache) register(random [32]byte, timestamp time.Time, now time.Time) bool {
+	digest := sha256.Sum256(append(c.salt[:], random[:]...))
+	c.m.Lock()
+	defer c.m.Unlock()
+	current := epochOf(now)
+	for epoch := range c.filters {
+		if epoch < current {
+			delete(c.filters, epoch)
+		}
+	}
+	epoch := epochOf(timestamp)
+	f := c.filters[epoch]
+	if f == nil {
+		f = newBloomFilter(c.capacity)
+		c.filters[epoch] = f
+	}
+	return f.testAndAdd(digest)
+}
+
+// size returns the number of randoms remembered
+func (c *replayCache) size() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	var n uint64
+	for _, f := range c.filters {
+		n += f.count
+	}
+	return int(n)
+}
+
+func (c *replayCache) writeTo(w io.Writer) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	bw := bufio.NewWriter(w)
+	bw.Write(replayCacheMagic)
+	bw.Write(c.salt[:])
+	binary.Write(bw, binary.BigEndian, uint64(c.capacity))
+	binary.Write(bw, binary.BigEndian, uint32(len(c.filters)))
+	for epoch, f := range c.filters {
+		binary.Write(bw, binary.BigEndian, epoch)
+		binary.Write(bw, binary.BigEndian, f.count)
+		binary.Write(bw, binary.BigEndian, f.bits)
+	}
+	return bw.Flush()
+}
+
+func readReplayCache(r io.Reader, capacity int) (*replayCache, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(replayCacheMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != string(replayCacheMagic) {
+		return nil, errors.New("not a replay cache")
+	}
+	c := &replayCache{capacity: capacity, filters: make(map[int64]*bloomFilter)}
+	if _, err := io.ReadFull(br, c.salt[:]); err != nil {
+		return nil, err
+	}
+	var savedCapacity uint64
+	var numFilters uint32
+	if err := binary.Read(br, binary.BigEndian, &savedCapacity); err != nil {
+		return nil, err
+	}
+	if savedCapacity != uint64(capacity) {
+		return nil, ErrReplayCacheMismatch
+	}
+	if err := binary.Read(br, binary.BigEndian, &numFilters); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < numFilters; i++ {
+		var epoch int64
+		f := newBloomFilter(capacity)
+		if err := binary.Read(br, binary.BigEndian, &epoch); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(br, binary.BigEndian, &f.count); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(br, binary.BigEndian, f.bits); err != nil {
+			return nil, err
+		}
+		c.filters[epoch] = f
+	}
+	return c, nil
+}
+
+// save writes the cache to path. It's replaced in one go so that a crash doesn't leave a corrupted cache behind
+func (c *replayCache) save(path string) error {
+	return common.WriteFileAtomic(path, 0600, c.writeTo)
+}
+
+// loadReplayCache reads the cache saved in path
+func loadReplayCache(path string, capacity int) (*replayCache, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := readReplayCache(f, capacity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay cache in %v: %w", path, err)
+	}
+	return c, nil
+}
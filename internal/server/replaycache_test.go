@@ -0,0 +1,122 @@
+package server
+
+import (
+	"errors"
+	"github.com/cbeuw/Cloak/internal/common"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func randomOf(r *rand.Rand) (random [32]byte) {
+	r.Read(random[:])
+	return
+}
+
+func TestReplayCache_Register(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	c := newReplayCache(1000, common.WorldOfTime(now))
+	r := rand.New(rand.NewSource(0))
+
+	t.Run("replay", func(t *testing.T) {
+		random := randomOf(r)
+		if c.register(random, now, now) {
+			t.Fatal("new random is registered as used")
+		}
+		if !c.register(random, now, now) {
+			t.Error("replayed random isn't detected")
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		random := randomOf(r)
+		c.register(random, now, now)
+		later := now.Add(2 * TIMESTAMP_TOLERANCE)
+		c.register(randomOf(r), later, later)
+		if c.size() != 1 {
+			t.Errorf("expecting only the random of the current epoch to be kept, got %v", c.size())
+		}
+		if len(c.filters) != 1 {
+			t.Errorf("expecting 1 filter, got %v", len(c.filters))
+		}
+	})
+
+	t.Run("false positive rate at capacity", func(t *testing.T) {
+		c := newReplayCache(10000, common.WorldOfTime(now))
+		for i := 0; i < 10000; i++ {
+			c.register(randomOf(r), now, now)
+		}
+		falsePositives := 0
+		for i := 0; i < 10000; i++ {
+			if c.register(randomOf(r), now.Add(TIMESTAMP_TOLERANCE), now) {
+				falsePositives++
+			}
+		}
+		// the second filter is filled up to capacity as well
+		if falsePositives > 2 {
+			t.Errorf("%v false positives in 10000", falsePositives)
+		}
+	})
+}
+
+func TestReplayCache_Persistence(t *testing.T) {
+	now := time.Unix(1565998966, 0)
+	path := filepath.Join(t.TempDir(), "replay.cache")
+	r := rand.New(rand.NewSource(0))
+	random := randomOf(r)
+
+	c := newReplayCache(1000, common.WorldOfTime(now))
+	c.register(random, now, now)
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("load", func(t *testing.T) {
+		loaded, err := loadReplayCache(path, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !loaded.register(random, now, now) {
+			t.Error("random from before saving isn't remembered")
+		}
+		if loaded.register(randomOf(r), now, now) {
+			t.Error("new random is registered as used")
+		}
+	})
+	t.Run("different capacity", func(t *testing.T) {
+		_, err := loadReplayCache(path, 2000)
+		if !errors.Is(err, ErrReplayCacheMismatch) {
+			t.Errorf("expecting %v, got %v", ErrReplayCacheMismatch, err)
+		}
+	})
+	t.Run("across restarts", func(t *testing.T) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		raw := RawConfig{
+			DatabasePath:    tmpDB.Name(),
+			RedirAddr:       "127.0.0.1:9999",
+			ReplayCachePath: filepath.Join(t.TempDir(), "replay.cache"),
+		}
+		ws := common.WorldOfTime(now)
+		sta, err := InitState(raw, ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sta.registerRandom(random, now)
+		if err = sta.SaveReplayCache(); err != nil {
+			t.Fatal(err)
+		}
+		sta.Panel.Manager.(interface{ Close() error }).Close()
+
+		restarted, err := InitState(raw, ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !restarted.registerRandom(random, now) {
+			t.Error("replay isn't detected after restarting")
+		}
+	})
+}
@@ -2,53 +2,353 @@ package server
 
 import (
 	"crypto"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/ecdh"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"strings"
 	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
 )
 
 type RawConfig struct {
-	ProxyBook     map[string][]string
-	BindAddr      []string
-	BypassUID     [][]byte
-	RedirAddr     string
-	PrivateKey    []byte
-	AdminUID      []byte
-	DatabasePath  string
-	StreamTimeout int
-	KeepAlive     int
-	CncMode       bool
+	ProxyBook map[string][]string
+	BindAddr  []string
+	BypassUID [][]byte
+	RedirAddr string
+	// the origin of the redirection server of each SNI that isn't RedirAddr. In JSON, they're given as RedirAddr
+	// being an object of SNI to origin, with RedirAddr itself under "*"
+	RedirAddrBySNI map[string]string `json:"-"`
+	// the transports accepted on each BindAddr that doesn't accept all of them. In JSON, they're given as the entry
+	// of BindAddr being an object of Addr and Transports
+	BindTransports map[string][]string `json:"-"`
+	// how the ProxyMethods that don't leave it to the defaults are connected to. In JSON, they're given as the entry
+	// of ProxyBook being an object of Network, Addr and the fields of ProxyDialPolicy
+	ProxyDialPolicies map[string]ProxyDialPolicy `json:"-"`
+	PrivateKey        []byte
+	AdminUID          []byte
+	DatabasePath      string
+	DatabaseURL       string
+	AuthWebhook       string
+	StreamTimeout     int
+	UDPTimeout        int
+	KeepAlive         int
+	ResumeGrace       int
+	RecordSizing      string
+	CncMode           bool
+	RateBurst         int
+	// the private keys that PrivateKey replaced, which clients that haven't been given the new public key yet still
+	// connect with
+	PreviousPrivateKeys [][]byte
+	// in bytes
+	LowCreditWarning int64
+	MetricsAddr      string
+	// sent to AuthWebhook as a bearer token
+	AuthWebhookToken string
+	// in seconds
+	AuthWebhookCacheTTL int
+
+	// where the usage of users is exported to each time it's uploaded: UsageWebhook, with UsageWebhookToken as a
+	// bearer token, and the CSV ledger at UsageLedgerPath, which is rotated once it's larger than UsageLedgerMaxSize
+	// bytes. It isn't exported to either that's empty
+	UsageWebhook       string
+	UsageWebhookToken  string
+	UsageLedgerPath    string
+	UsageLedgerMaxSize int64
+
+	// whether the streams of "direct" proxy methods can be connected to loopback, private and link-local addresses
+	AllowPrivateTargets bool
+
+	// how each BindAddr gated by knocks turns away connections from addresses that haven't knocked. In JSON, it's
+	// the Knock of the entry
+	BindKnocks map[string]string `json:"-"`
+	// the UDP address knocks are received on
+	KnockAddr string
+
+	ReplayCacheCapacity int
+	ReplayCachePath     string
+
+	// how often statistics of the ClientHellos that aren't from Cloak clients are logged, in seconds. They aren't
+	// kept if it's 0
+	ProbeStatsInterval int
+
+	// MaxMind databases that connections failing authentication are looked up in, for DecoyByCountry and DecoyByASN
+	GeoIPDatabases []string
+	// how connections that fail authentication are turned away if not to the redirection server, by the ISO code of
+	// the country or the number of the AS they're from. DecoyByASN takes precedence
+	DecoyByCountry map[string]string
+	DecoyByASN     map[string]string
+
+	// in seconds, how long the connections of probers are held open, rather than sent to the redirection server.
+	// They aren't if it's 0
+	TarpitDuration int
+	// the number of random bytes sent to a held connection every second
+	TarpitRate int
+	// the number of failed handshakes of an address in 10 minutes for it to be taken as a prober. A replayed
+	// handshake always is
+	TarpitAfter int
+
+	// how many handshakes a second are authenticated from each address, and from all of them together. They aren't
+	// limited if it's 0
+	HandshakeRatePerIP int
+	HandshakeRate      int
+	// how many handshakes are authenticated at a time, and how many can wait for their turn before more are turned
+	// away. They aren't bounded if HandshakeWorkers is 0
+	HandshakeWorkers int
+	HandshakeQueue   int
+
+	AdminAPIAddr  string
+	AdminAPIToken string
+	AdminAPICert  string
+	AdminAPIKey   string
+
+	TLSCert string
+	TLSKey  string
+
+	ACMEDomains      []string
+	ACMEEmail        string
+	ACMEDirectoryURL string
+	// where ck-server keeps the certificates from ACME
+	StateDir string
+	// the user, or user:group, that ck-server runs as once it has listened on BindAddr, if it's started as root
+	RunAs string
+	// whether ck-server is confined to StateDir along with RunAs
+	Chroot bool
+
+	// whether ClientHellos that are well-formed but that no TLS 1.3 client sends are redirected straight away
+	StrictClientHello bool
+	// whether the response to a first packet starts after about the same time whatever it turns out to be
+	EqualiseTiming bool
+
+	MimicTranscript bool
+	// whether the transcripts of MimicTranscript are learnt without holding up starting and reloading, in which case
+	// the connections of a session made meanwhile may be replied to with different transcripts
+	LearnTranscriptsInBackground bool
+	// the name of the TLS 1.3 cipher suite in crypto/tls, e.g. TLS_AES_256_GCM_SHA384, that ServerHellos choose if
+	// the client offers it. Otherwise they choose the one the redirection server does under MimicTranscript, or
+	// the first TLS 1.3 cipher suite the client offers
+	CipherSuite string
+	// the range of the length of the encrypted handshake record sent when no transcript is replayed, as "min-max"
+	HandshakeRecordLength string
+	GRPCPath              string
+	H2Path                string
+	// the UDP address to be the authoritative name server of DNSDomain on, for clients in DoH mode. DoH mode is
+	// disabled if it's empty
+	DNSAddr   string
+	DNSDomain string
+	// the addresses of servers that clients are told of when they ask, for them to move on to from DoH mode
+	ServerList []string
+
+	WSPath    string
+	WSHost    string
+	WSOrigins []string
+	// the hosts that requests through a CDN must be to, in any of the modes over HTTP. Anything goes if it's empty
+	FrontingHosts []string
+	// a directory or an http:// or https:// upstream that ck-server serves the HTTP requests of visitors with itself,
+	// instead of relaying them to RedirAddr
+	WebRoot string
+
+	// in seconds, how soon after one another sessions of a user made from two countries in GeoIPDatabases get it
+	// suspended. Not checked if it's 0
+	AbuseTravelWindow int
+	// the number of sessions of a user refused in 10 minutes that gets it suspended. Not checked if it's 0
+	AbuseHandshakeFailures int
+	// in bytes, how far either credit of a user overdrawn gets it suspended. Not checked if it's 0
+	AbuseOverdraft int64
+	// in seconds, how long users are suspended for. Suspensions last until they're lifted through the admin API if
+	// it's 0
+	AbuseSuspendFor int
+
+	// a redis:// or rediss:// URL of the Redis that ck-servers behind a load balancer share the replay cache and the sessions of
+	// users in. Nothing is shared if it's empty
+	ClusterRedisURL string
+	// in seconds, how long the randoms of handshakes are kept in Redis, at least and by default twice
+	// TIMESTAMP_TOLERANCE, for which a handshake can be replayed
+	ClusterReplayTTL int
+	// in seconds, how long the sessions of a ck-server that has gone away are still counted
+	ClusterSessionTTL int
+
+	// in seconds, how long ck-server waits for sessions to end when it's stopped, having stopped listening, before
+	// closing them. It stops right away if it's 0
+	DrainTimeout int
+	// whether clients are told to make new sessions elsewhere when draining starts, so that only their open streams
+	// are waited for
+	DrainNotify bool
+
+	// in bytes, how much a client can send on each stream of a session, and on all of them, that hasn't been read
+	// by the proxy servers yet. 0 for the defaults, negative for no limit
+	StreamWindow  int
+	SessionWindow int
+
+	// the ProxyMethods whose frames are compressed for the clients that ask for it. None are if it's empty
+	CompressProxyMethods []string
+
+	// the tenants served besides the ck-server's own clients, by the SNI of their clients
+	Tenants map[string]TenantConfig
 }
 
+// EnvPrefix is what the environment variables of the fields of RawConfig start with
+const EnvPrefix = "CK_SERVER_"
+
+// how long a resumable session waits for a connection if ResumeGrace isn't set
+const defaultResumeGrace = 60 * time.Second
+
+// how long the answer of AuthWebhook about a user is taken for if AuthWebhookCacheTTL isn't set
+const defaultAuthWebhookCacheTTL = 60 * time.Second
+
 // State type stores the global state of the program
 type State struct {
 	ProxyBook   map[string]net.Addr
 	ProxyDialer common.Dialer
+	// the dialers of the ProxyMethods that have a dial policy, which connect instead of ProxyDialer
+	proxyDialers map[string]*proxyDialer
 
 	WorldState common.WorldState
 	AdminUID   []byte
 	Timeout    time.Duration
+	// how long a UDP mapping to a proxy server lasts without datagrams either way
+	UDPTimeout time.Duration
 	//KeepAlive time.Duration
+	AllowPrivateTargets bool
+	// how long a session of a client that asked for resumption waits for a connection after losing all of them. 0
+	// if sessions aren't resumed
+	ResumeGrace time.Duration
+	// how the frames of the sessions of clients in TLS mode are sized into records, one of the mux.RECORD_SIZING_
+	// constants
+	RecordSizing byte
 
 	BypassUID map[[16]byte]struct{}
 	StaticPv  crypto.PrivateKey
+	// the static private keys that StaticPv replaced, which are still accepted
+	PreviousStaticPvs []crypto.PrivateKey
+	// the length of the fake session tickets issued to clients in TLS mode, which is worked out from our public key.
+	// 0 if none are issued
+	sessionTicketLength int
 
 	// TODO: this doesn't have to be a net.Addr; resolution is done in Dial automatically
 	RedirHost   net.Addr
 	RedirPort   string
 	RedirDialer common.Dialer
+	// the SNI to use when handshaking with the redirection server ourselves, empty if RedirAddr is an IP
+	redirServerName string
+	// the redirection servers of particular SNIs, by lower case SNI
+	redirBySNI map[string]redirOrigin
+
+	// how connections that fail authentication are turned away by where they're from, nil if they're all sent to
+	// the redirection server
+	decoyPolicy *decoyPolicy
+	// suspends users whose UIDs look to be abused
+	abuse *abuseMonitor
+
+	// reloadM guards ProxyBook, proxyDialers, BypassUID, the redirection server, the decoy policy, transcripts, serverHellos,
+	// realTLSCert and serverList, which are swapped by Reload
+	reloadM sync.RWMutex
+	// ConfigSource reads the configuration again for ReloadConfig. Reloading isn't supported if it's nil
+	ConfigSource func() (RawConfig, error)
+	// the listeners of BindAddr, which are changed by Reload. BindAddr isn't reloaded if it's nil
+	Listeners *ListenerSupervisor
+	// the addresses admitted to listeners gated by knocks
+	knocks knockGate
+
+	// the path of the gRPC method to accept gRPC mode clients on, gRPC mode is disabled if empty
+	GRPCPath string
+	// the path to accept the POST requests of HTTP/2 mode clients on, HTTP/2 mode is disabled if empty
+	H2Path string
+	// the domain the queries of DoH mode clients are under, in lower case without the dot of the root
+	DNSDomain string
+	// ServerList, which is swapped by Reload
+	serverList []string
 
-	usedRandomM sync.RWMutex
-	UsedRandom  map[[32]byte]int64
+	// WebSocket upgrade requests that don't match these are sent to the redirection server. Nothing is checked
+	// if they're empty
+	WSPath    string
+	WSHost    string
+	WSOrigins []string
+	// requests of the modes over HTTP that aren't to one of these are sent to the redirection server, unless it's
+	// empty
+	FrontingHosts []string
+	// serves the HTTP requests of visitors instead of the redirection server if WebRoot is set, nil otherwise
+	webRoot http.Handler
+
+	MimicTranscript              bool
+	LearnTranscriptsInBackground bool
+	// transcripts learnt from the redirection server by transcriptKey. It's only replaced as a whole, by Reload or
+	// once those of the redirection server of the latest Reload have been learnt in the background
+	transcripts map[string][][]int
+	// counts the Reloads that have started learning transcripts, so that only the latest one's are kept
+	transcriptsGeneration int
+	// the ServerHellos learnt from the redirection server along with transcripts, by cipherSuitesKey
+	serverHellos map[string]serverHelloTemplate
+	// CipherSuite, zero if it isn't set
+	cipherSuite [2]byte
+	// HandshakeRecordLength, zero if it isn't set
+	handshakeRecordLength [2]int
+	StrictClientHello     bool
+
+	replayCache *replayCache
+	// shares the replay cache and the sessions of users with other nodes, nil if they aren't shared
+	cluster *clusterRegistry
+	// where the replay cache is kept across restarts, it's only kept in memory if empty
+	ReplayCachePath string
 
 	Panel *userPanel
+
+	// how long sessions are waited for when draining, and whether their clients are told to go elsewhere
+	DrainTimeout time.Duration
+	DrainNotify  bool
+	drain        drainer
+
+	// the windows of flow control of each session, 0 if what clients send isn't limited
+	StreamWindow  int
+	SessionWindow int
+
+	// the ProxyMethods in CompressProxyMethods
+	compressProxyMethods map[string]bool
+
+	// shared with the tenants, whose handshakes and streams are counted with the ck-server's
+	metrics *metrics
+	// the statistics of ClientHellos that aren't from Cloak clients, nil if they aren't kept
+	probes *probeWatch
+	// holds the connections of probers, nil if they're turned away like anyone else
+	tarpit *tarpit
+	// holds the responses to first packets to equalise their timing, nil if they aren't held
+	timing *responseTiming
+	// limits the rate of handshakes, nil if it isn't limited
+	handshakeLimit *handshakeLimit
+	// authenticates handshakes, nil if they're authenticated on the goroutines of their connections
+	handshakes *handshakePool
+	// exports the usage of users, nil if it isn't exported
+	usage *usageExporter
+
+	// where the admin API v2 is served, it isn't served if empty
+	AdminAPIAddr  string
+	adminAPIToken []byte
+	// the admin API is served in cleartext if nil
+	adminAPITLS *tls.Config
+
+	// the States of Tenants, by lower case SNI
+	tenants map[string]*State
+
+	// the real certificate to terminate TLS with for clients in real TLS mode and visitors of the cover site. TLS
+	// isn't terminated if it's nil and ACME isn't used. It's swapped by Reload
+	realTLSCert *tls.Certificate
+	realTLS     *tls.Config
+	// obtains and renews certificates of ACMEDomains, nil if ACME isn't used
+	acme *autocert.Manager
 }
 
 func parseRedirAddr(redirAddr string) (net.Addr, string, error) {
@@ -83,24 +383,58 @@ func parseRedirAddr(redirAddr string) (net.Addr, string, error) {
 	return redirHost, port, nil
 }
 
-func parseProxyBook(bookEntries map[string][]string) (map[string]net.Addr, error) {
+// parseRedirServerName returns the domain name in redirAddr, or an empty string if redirAddr is an IP
+func parseRedirServerName(redirAddr string) string {
+	host, _, err := net.SplitHostPort(redirAddr)
+	if err != nil {
+		host = strings.Trim(redirAddr, "[]")
+	}
+	if net.ParseIP(host) != nil {
+		return ""
+	}
+	return host
+}
+
+// parseProxyBook resolves the address of each ProxyMethod, in the IP version of its dial policy in policies if it has
+// one, and checks that the Unix domain sockets among them can be connected to
+func parseProxyBook(bookEntries map[string][]string, policies map[string]*proxyDialer) (map[string]net.Addr, error) {
 	proxyBook := map[string]net.Addr{}
 	for name, pair := range bookEntries {
 		name = strings.ToLower(name)
+		if len(pair) == 1 && strings.ToLower(pair[0]) == "direct" {
+			proxyBook[name] = directAddr{}
+			continue
+		}
+		if len(pair) == 1 && (strings.ToLower(pair[0]) == "echo" || strings.ToLower(pair[0]) == "discard") {
+			proxyBook[name] = benchAddr(strings.ToLower(pair[0]))
+			continue
+		}
 		if len(pair) != 2 {
 			return nil, fmt.Errorf("invalid proxy endpoint and address pair for %v: %v", name, pair)
 		}
+		policy := policies[name]
+		var ipVersion string
+		if policy != nil {
+			ipVersion = policy.ipVersion
+		}
 		network := strings.ToLower(pair[0])
 		switch network {
+		case "unix":
+			addr, err := parseUnixProxy(name, pair[1], policy)
+			if err != nil {
+				return nil, err
+			}
+			proxyBook[name] = addr
+			continue
 		case "tcp":
-			addr, err := net.ResolveTCPAddr("tcp", pair[1])
+			addr, err := net.ResolveTCPAddr("tcp"+ipVersion, pair[1])
 			if err != nil {
 				return nil, err
 			}
 			proxyBook[name] = addr
 			continue
 		case "udp":
-			addr, err := net.ResolveUDPAddr("udp", pair[1])
+			addr, err := net.ResolveUDPAddr("udp"+ipVersion, pair[1])
 			if err != nil {
 				return nil, err
 			}
@@ -111,45 +445,291 @@ func parseProxyBook(bookEntries map[string][]string) (map[string]net.Addr, error
 	return proxyBook, nil
 }
 
-func ParseConfig(conf string) (raw RawConfig, err error) {
-	content, errPath := ioutil.ReadFile(conf)
-	if errPath != nil {
-		errJson := json.Unmarshal(content, &raw)
-		if errJson != nil {
-			err = fmt.Errorf("failed to read/unmarshal configuration, path is invalid or %v", errJson)
-			return
+// UnmarshalJSON takes RedirAddr as either a string or an object of SNI to origin, each entry of BindAddr as either a
+// string or an object of Addr, Transports and Knock, and each entry of ProxyBook as either a pair of network and
+// address, an object of Network, Addr and a ProxyDialPolicy, or a unix:// URL of a Unix domain socket
+func (raw *RawConfig) UnmarshalJSON(data []byte) error {
+	type plainRawConfig RawConfig
+	aux := struct {
+		*plainRawConfig
+		ProxyBook map[string]json.RawMessage
+		BindAddr  []json.RawMessage
+		RedirAddr json.RawMessage
+	}{plainRawConfig: (*plainRawConfig)(raw)}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+	if aux.ProxyBook != nil {
+		raw.ProxyBook = make(map[string][]string)
+	}
+	for name, entry := range aux.ProxyBook {
+		if len(entry) != 0 && entry[0] == '"' {
+			var socketURL string
+			if err = json.Unmarshal(entry, &socketURL); err != nil {
+				return err
+			}
+			if !strings.HasPrefix(strings.ToLower(socketURL), "unix://") {
+				return fmt.Errorf("ProxyBook entry of %v as a string must be a unix:// URL, got %v", name, socketURL)
+			}
+			raw.ProxyBook[name] = []string{"unix", socketURL[len("unix://"):]}
+			continue
 		}
-	} else {
-		errJson := json.Unmarshal(content, &raw)
-		if errJson != nil {
-			err = fmt.Errorf("failed to read configuration file: %v", errJson)
-			return
+		if len(entry) == 0 || entry[0] != '{' {
+			var pair []string
+			if err = json.Unmarshal(entry, &pair); err != nil {
+				return err
+			}
+			raw.ProxyBook[name] = pair
+			continue
+		}
+		var proxy struct {
+			Network string
+			Addr    string
+			ProxyDialPolicy
+		}
+		if err = json.Unmarshal(entry, &proxy); err != nil {
+			return err
+		}
+		if strings.ToLower(proxy.Network) == "direct" {
+			raw.ProxyBook[name] = []string{proxy.Network}
+		} else {
+			raw.ProxyBook[name] = []string{proxy.Network, proxy.Addr}
+		}
+		if raw.ProxyDialPolicies == nil {
+			raw.ProxyDialPolicies = make(map[string]ProxyDialPolicy)
+		}
+		raw.ProxyDialPolicies[name] = proxy.ProxyDialPolicy
+	}
+	for _, entry := range aux.BindAddr {
+		if len(entry) == 0 || entry[0] != '{' {
+			var addr string
+			if err = json.Unmarshal(entry, &addr); err != nil {
+				return err
+			}
+			raw.BindAddr = append(raw.BindAddr, addr)
+			continue
+		}
+		var listener struct {
+			Addr       string
+			Transports []string
+			Knock      string
+		}
+		if err = json.Unmarshal(entry, &listener); err != nil {
+			return err
+		}
+		if listener.Addr == "" {
+			return errors.New("an entry of BindAddr must have an Addr if it's an object")
+		}
+		raw.BindAddr = append(raw.BindAddr, listener.Addr)
+		if len(listener.Transports) != 0 {
+			if raw.BindTransports == nil {
+				raw.BindTransports = make(map[string][]string)
+			}
+			raw.BindTransports[listener.Addr] = listener.Transports
+		}
+		if listener.Knock != "" {
+			if raw.BindKnocks == nil {
+				raw.BindKnocks = make(map[string]string)
+			}
+			raw.BindKnocks[listener.Addr] = listener.Knock
+		}
+	}
+	if len(aux.RedirAddr) == 0 || aux.RedirAddr[0] != '{' {
+		if len(aux.RedirAddr) != 0 {
+			return json.Unmarshal(aux.RedirAddr, &raw.RedirAddr)
+		}
+		return nil
+	}
+	var bySNI map[string]string
+	err = json.Unmarshal(aux.RedirAddr, &bySNI)
+	if err != nil {
+		return err
+	}
+	def, ok := bySNI["*"]
+	if !ok {
+		return errors.New(`RedirAddr must have an origin for "*" if it's an object`)
+	}
+	delete(bySNI, "*")
+	raw.RedirAddr = def
+	raw.RedirAddrBySNI = bySNI
+	return nil
+}
+
+// rawCompanions are the fields of RawConfig that are set along with another in JSON
+var rawCompanions = map[string][]string{
+	"ProxyBook": {"ProxyDialPolicies"},
+	"BindAddr":  {"BindTransports", "BindKnocks"},
+	"RedirAddr": {"RedirAddrBySNI"},
+}
+
+// Override sets the fields of raw in values by name, each written as common.ConfigFields describes
+func (raw *RawConfig) Override(values map[string]string) error {
+	return common.OverrideConfig(raw, values, rawCompanions)
+}
+
+// ParseConfig reads the configuration from conf, which is either a path to a JSON, YAML or TOML file, by its
+// extension, or JSON itself, then sets the fields that have an environment variable of CK_SERVER_ and the upper
+// case field name. Nothing is read if conf is empty, so that the configuration can be entirely in the environment
+func ParseConfig(conf string) (raw RawConfig, err error) {
+	if conf != "" {
+		content, errPath := ioutil.ReadFile(conf)
+		if errPath != nil {
+			errJson := common.DecodeConfig([]byte(conf), "json", &raw)
+			if errJson != nil {
+				err = fmt.Errorf("failed to read/unmarshal configuration, path is invalid or %v", errJson)
+				return
+			}
+		} else {
+			errDecode := common.DecodeConfig(content, common.ConfigFormat(conf), &raw)
+			if errDecode != nil {
+				err = fmt.Errorf("failed to read configuration file: %v", errDecode)
+				return
+			}
 		}
 	}
+	if err = raw.Override(common.ConfigEnv(&raw, EnvPrefix, os.LookupEnv)); err != nil {
+		err = fmt.Errorf("failed to read configuration from the environment: %v", err)
+		return
+	}
 	if raw.ProxyBook == nil {
 		raw.ProxyBook = make(map[string][]string)
 	}
 	return
 }
 
+// checkPreviousKeys checks the lengths of the PreviousPrivateKeys of a configuration
+func checkPreviousKeys(keys [][]byte) error {
+	for i, key := range keys {
+		if len(key) != 32 {
+			return fmt.Errorf("PreviousPrivateKeys %v must be 32 bytes, got %v", i, len(key))
+		}
+	}
+	return nil
+}
+
+// parsePreviousKeys parses the PreviousPrivateKeys of a configuration into common.Secrets
+func parsePreviousKeys(keys [][]byte) ([]crypto.PrivateKey, error) {
+	if err := checkPreviousKeys(keys); err != nil {
+		return nil, err
+	}
+	var pvs []crypto.PrivateKey
+	for _, key := range keys {
+		pvs = append(pvs, common.NewSecret(key))
+	}
+	return pvs, nil
+}
+
+// staticPvs are the static private keys that clients can connect with, the current one first
+func (sta *State) staticPvs() []crypto.PrivateKey {
+	return append([]crypto.PrivateKey{sta.StaticPv}, sta.PreviousStaticPvs...)
+}
+
+// ValidateConfig checks preParse as far as it can be without starting: the lengths of the keys and UIDs, BindAddr,
+// RedirAddr and ProxyBook, whose addresses are resolved
+func ValidateConfig(preParse RawConfig) error {
+	if len(preParse.PrivateKey) != 32 {
+		return fmt.Errorf("PrivateKey must be 32 bytes, got %v", len(preParse.PrivateKey))
+	}
+	if len(preParse.AdminUID) != 0 && len(preParse.AdminUID) != 16 {
+		return fmt.Errorf("AdminUID must be 16 bytes, got %v", len(preParse.AdminUID))
+	}
+	for _, UID := range preParse.BypassUID {
+		if len(UID) != 16 {
+			return fmt.Errorf("BypassUID %v must be 16 bytes, got %v", b64(UID), len(UID))
+		}
+	}
+	if err := checkPreviousKeys(preParse.PreviousPrivateKeys); err != nil {
+		return err
+	}
+	if preParse.Chroot && (preParse.StateDir == "" || preParse.RunAs == "") {
+		return errors.New("Chroot needs StateDir and RunAs")
+	}
+	if _, err := parseListeners(preParse); err != nil {
+		return err
+	}
+	if _, _, err := parseRedirAddr(preParse.RedirAddr); err != nil {
+		return fmt.Errorf("unable to parse RedirAddr: %v", err)
+	}
+	for sni, origin := range preParse.RedirAddrBySNI {
+		if _, _, err := parseRedirAddr(origin); err != nil {
+			return fmt.Errorf("unable to parse RedirAddr of %v: %v", sni, err)
+		}
+	}
+	proxyDialers, err := parseProxyDialers(preParse.ProxyDialPolicies, -1)
+	if err != nil {
+		return fmt.Errorf("unable to parse ProxyBook: %v", err)
+	}
+	if _, err = parseProxyBook(preParse.ProxyBook, proxyDialers); err != nil {
+		return fmt.Errorf("unable to parse ProxyBook: %v", err)
+	}
+	return validateTenants(preParse)
+}
+
+// OpenUserManager opens the user database of preParse: AuthWebhook, DatabaseURL or userinfo.db at DatabasePath
+func OpenUserManager(preParse RawConfig, worldState common.WorldState) (manager usermanager.UserManager, err error) {
+	if preParse.AuthWebhook != "" {
+		if preParse.DatabaseURL != "" {
+			return nil, errors.New("AuthWebhook and DatabaseURL can't both be set")
+		}
+		if u, err := url.Parse(preParse.AuthWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("bad AuthWebhook %v", preParse.AuthWebhook)
+		}
+		if preParse.AuthWebhookCacheTTL < 0 {
+			return nil, errors.New("AuthWebhookCacheTTL can't be negative")
+		}
+		ttl := defaultAuthWebhookCacheTTL
+		if preParse.AuthWebhookCacheTTL > 0 {
+			ttl = time.Duration(preParse.AuthWebhookCacheTTL) * time.Second
+		}
+		manager = usermanager.MakeWebhookManager(preParse.AuthWebhook, preParse.AuthWebhookToken, ttl, worldState)
+	} else if preParse.DatabaseURL != "" {
+		backend, err := usermanager.OpenBackend(preParse.DatabaseURL)
+		if err != nil {
+			return nil, err
+		}
+		manager = usermanager.MakeBackendManager(backend, worldState)
+	} else {
+		manager, err = usermanager.MakeLocalManager(preParse.DatabasePath, worldState)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
 // ParseConfig parses the config (either a path to json or the json itself as argument) into a State variable
 func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, err error) {
 	sta = &State{
 		BypassUID:   make(map[[16]byte]struct{}),
 		ProxyBook:   map[string]net.Addr{},
-		UsedRandom:  map[[32]byte]int64{},
+		replayCache: newReplayCache(defaultReplayCacheCapacity, worldState),
+		metrics:     &metrics{},
 		RedirDialer: &net.Dialer{},
 		WorldState:  worldState,
 	}
+	if _, err = parseListeners(preParse); err != nil {
+		return
+	}
 	if preParse.CncMode {
 		err = errors.New("command & control mode not implemented")
 		return
 	} else {
-		manager, err := usermanager.MakeLocalManager(preParse.DatabasePath, worldState)
+		var manager usermanager.UserManager
+		manager, err = OpenUserManager(preParse, worldState)
 		if err != nil {
-			return sta, err
+			return
+		}
+		sta.Panel = MakeUserPanel(manager, worldState)
+		if preParse.RateBurst < 0 {
+			return sta, errors.New("RateBurst can't be negative")
+		}
+		if preParse.RateBurst > 0 {
+			sta.Panel.rateBurst = time.Duration(preParse.RateBurst) * time.Millisecond
+		}
+		if preParse.LowCreditWarning != 0 {
+			sta.Panel.lowCreditWarning = preParse.LowCreditWarning
 		}
-		sta.Panel = MakeUserPanel(manager)
 	}
 
 	if preParse.StreamTimeout == 0 {
@@ -157,6 +737,98 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 	} else {
 		sta.Timeout = time.Duration(preParse.StreamTimeout) * time.Second
 	}
+	if preParse.UDPTimeout < 0 {
+		return sta, errors.New("UDPTimeout can't be negative")
+	}
+	if preParse.UDPTimeout == 0 {
+		sta.UDPTimeout = defaultUDPTimeout
+	} else {
+		sta.UDPTimeout = time.Duration(preParse.UDPTimeout) * time.Second
+	}
+
+	sta.AllowPrivateTargets = preParse.AllowPrivateTargets
+
+	if preParse.ProbeStatsInterval < 0 {
+		return sta, errors.New("ProbeStatsInterval can't be negative")
+	}
+	if preParse.ProbeStatsInterval > 0 {
+		sta.probes = newProbeWatch(time.Duration(preParse.ProbeStatsInterval)*time.Second, worldState.Now())
+		go sta.probes.logEvery(worldState)
+	}
+
+	if preParse.TarpitDuration < 0 || preParse.TarpitRate < 0 || preParse.TarpitAfter < 0 {
+		return sta, errors.New("TarpitDuration, TarpitRate and TarpitAfter can't be negative")
+	}
+	if preParse.TarpitDuration > 0 {
+		sta.tarpit = newTarpit(time.Duration(preParse.TarpitDuration)*time.Second, preParse.TarpitRate, preParse.TarpitAfter)
+	}
+	if preParse.EqualiseTiming {
+		sta.timing = newResponseTiming()
+	}
+	if preParse.HandshakeRatePerIP < 0 || preParse.HandshakeRate < 0 {
+		return sta, errors.New("HandshakeRatePerIP and HandshakeRate can't be negative")
+	}
+	sta.handshakeLimit = newHandshakeLimit(preParse.HandshakeRatePerIP, preParse.HandshakeRate, worldState)
+	if preParse.HandshakeWorkers < 0 || preParse.HandshakeQueue < 0 {
+		return sta, errors.New("HandshakeWorkers and HandshakeQueue can't be negative")
+	}
+	if preParse.HandshakeWorkers > 0 {
+		sta.handshakes = newHandshakePool(preParse.HandshakeWorkers, preParse.HandshakeQueue)
+	}
+
+	detectors, err := parseAbuseDetectors(preParse)
+	if err != nil {
+		return
+	}
+	terminate := func(UID []byte, reason string) { sta.Panel.kick(UID, reason) }
+	sta.abuse = newAbuseMonitor(detectors, time.Duration(preParse.AbuseSuspendFor)*time.Second, terminate, worldState)
+	sta.Panel.observe = sta.abuse.observe
+
+	if sta.usage, err = parseUsageExporter(preParse, worldState); err != nil {
+		return
+	}
+	if sta.usage != nil {
+		sta.Panel.exportUsage = sta.usage.exporter("")
+	}
+
+	sta.cluster, err = parseCluster(preParse, worldState)
+	if err != nil {
+		return
+	}
+	if sta.cluster != nil {
+		sta.Panel.cluster = sta.cluster
+		// the cluster isn't changed by Reload, and there are no sessions left to renew once draining is done
+		go sta.cluster.regularRenew(sta.Panel, sta.Drained())
+	}
+
+	if preParse.DrainTimeout < 0 {
+		return sta, errors.New("DrainTimeout can't be negative")
+	}
+	sta.DrainTimeout = time.Duration(preParse.DrainTimeout) * time.Second
+	sta.DrainNotify = preParse.DrainNotify
+
+	sta.StreamWindow = flowWindow(preParse.StreamWindow, mux.DefaultStreamWindow)
+	sta.SessionWindow = flowWindow(preParse.SessionWindow, mux.DefaultSessionWindow)
+
+	sta.compressProxyMethods = make(map[string]bool, len(preParse.CompressProxyMethods))
+	for _, method := range preParse.CompressProxyMethods {
+		sta.compressProxyMethods[method] = true
+	}
+
+	if preParse.ResumeGrace == 0 {
+		sta.ResumeGrace = defaultResumeGrace
+	} else if preParse.ResumeGrace > 0 {
+		sta.ResumeGrace = time.Duration(preParse.ResumeGrace) * time.Second
+	}
+
+	switch strings.ToLower(preParse.RecordSizing) {
+	case "", "full":
+		sta.RecordSizing = mux.RECORD_SIZING_FULL
+	case "dynamic":
+		sta.RecordSizing = mux.RECORD_SIZING_DYNAMIC
+	default:
+		return sta, fmt.Errorf("unknown RecordSizing %v", preParse.RecordSizing)
+	}
 
 	if preParse.KeepAlive <= 0 {
 		sta.ProxyDialer = &net.Dialer{KeepAlive: -1}
@@ -164,66 +836,340 @@ func InitState(preParse RawConfig, worldState common.WorldState) (sta *State, er
 		sta.ProxyDialer = &net.Dialer{KeepAlive: time.Duration(preParse.KeepAlive) * time.Second}
 	}
 
-	sta.RedirHost, sta.RedirPort, err = parseRedirAddr(preParse.RedirAddr)
+	var pv [32]byte
+	copy(pv[:], preParse.PrivateKey)
+	sta.StaticPv = common.NewSecret(pv[:])
+	sta.sessionTicketLength = common.SessionTicketLength(ecdh.Marshal(ecdh.PublicKey(sta.StaticPv)))
+	sta.PreviousStaticPvs, err = parsePreviousKeys(preParse.PreviousPrivateKeys)
 	if err != nil {
-		err = fmt.Errorf("unable to parse RedirAddr: %v", err)
 		return
 	}
 
-	sta.ProxyBook, err = parseProxyBook(preParse.ProxyBook)
+	sta.AdminUID = preParse.AdminUID
+
+	sta.GRPCPath = preParse.GRPCPath
+	sta.H2Path = preParse.H2Path
+	if preParse.DNSAddr != "" {
+		sta.DNSDomain = strings.ToLower(strings.Trim(preParse.DNSDomain, "."))
+		if sta.DNSDomain == "" {
+			return sta, errors.New("DNSAddr needs DNSDomain")
+		}
+		if common.MaxDNSQueryData(sta.DNSDomain) < 1 {
+			return sta, fmt.Errorf("DNSDomain %v is too long", preParse.DNSDomain)
+		}
+	}
+	sta.WSPath = preParse.WSPath
+	sta.WSHost = preParse.WSHost
+	sta.WSOrigins = preParse.WSOrigins
+	sta.FrontingHosts = preParse.FrontingHosts
+	if preParse.WebRoot != "" {
+		sta.webRoot, err = sta.parseWebRoot(preParse.WebRoot)
+		if err != nil {
+			return
+		}
+	}
+	sta.MimicTranscript = preParse.MimicTranscript
+	sta.LearnTranscriptsInBackground = preParse.LearnTranscriptsInBackground
+	sta.StrictClientHello = preParse.StrictClientHello
+	if preParse.CipherSuite != "" {
+		sta.cipherSuite, err = parseCipherSuite(preParse.CipherSuite)
+		if err != nil {
+			return
+		}
+	}
+	if preParse.HandshakeRecordLength != "" {
+		length := &sta.handshakeRecordLength
+		_, err = fmt.Sscanf(preParse.HandshakeRecordLength, "%d-%d", &length[0], &length[1])
+		if err != nil || length[0] < 1 || length[0] > length[1] || length[1] > appDataMaxLength {
+			err = fmt.Errorf("HandshakeRecordLength %v isn't min-max of 1 to %v", preParse.HandshakeRecordLength, appDataMaxLength)
+			return
+		}
+	}
+
+	sta.AdminAPIAddr = preParse.AdminAPIAddr
+	if sta.AdminAPIAddr != "" {
+		if preParse.AdminAPIToken == "" {
+			err = ErrNoAdminAPIToken
+			return
+		}
+		sta.adminAPIToken = []byte(preParse.AdminAPIToken)
+		if preParse.AdminAPICert != "" || preParse.AdminAPIKey != "" {
+			var cert tls.Certificate
+			cert, err = tls.LoadX509KeyPair(preParse.AdminAPICert, preParse.AdminAPIKey)
+			if err != nil {
+				err = fmt.Errorf("unable to load the certificate of the admin API: %v", err)
+				return
+			}
+			sta.adminAPITLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+
+	sta.realTLS = &tls.Config{
+		GetCertificate: sta.getRealTLSCertificate,
+		NextProtos:     realTLSNextProtos,
+	}
+	if sta.H2Path != "" {
+		// HTTP/2 mode clients may come to us directly in real TLS
+		sta.realTLS.NextProtos = append([]string{http2.NextProtoTLS}, sta.realTLS.NextProtos...)
+	}
+	if len(preParse.ACMEDomains) != 0 {
+		sta.acme, err = newACMEManager(preParse)
+		if err != nil {
+			return
+		}
+		// TLS-ALPN-01 challenges are answered in the handshake
+		sta.realTLS.NextProtos = append(sta.realTLS.NextProtos, acme.ALPNProto)
+	}
+
+	err = sta.Reload(preParse)
 	if err != nil {
-		err = fmt.Errorf("unable to parse ProxyBook: %v", err)
+		return
+	}
+	if err = sta.initTenants(preParse, worldState); err != nil {
 		return
 	}
 
-	var pv [32]byte
-	copy(pv[:], preParse.PrivateKey)
-	sta.StaticPv = &pv
+	if preParse.ReplayCacheCapacity < 0 {
+		return sta, errors.New("ReplayCacheCapacity can't be negative")
+	}
+	if preParse.ReplayCacheCapacity > 0 {
+		sta.replayCache = newReplayCache(preParse.ReplayCacheCapacity, worldState)
+	}
+	sta.ReplayCachePath = preParse.ReplayCachePath
+	if sta.ReplayCachePath != "" {
+		saved, err := loadReplayCache(sta.ReplayCachePath, sta.replayCache.capacity)
+		if err == nil {
+			sta.replayCache = saved
+		} else if !errors.Is(err, os.ErrNotExist) {
+			// refusing to start would be worse than being open to replays of the last few minutes
+			log.Warnf("starting with an empty replay cache: %v", err)
+		}
+		go sta.replayCacheSaver()
+	}
 
-	sta.AdminUID = preParse.AdminUID
+	return sta, nil
+}
+
+// Reload applies ProxyBook, BypassUID, RedirAddr and the decoy policy of preParse. Nothing is changed if any of them is invalid.
+// Existing sessions keep running, and their new streams are connected with the new ProxyBook. If transcript mimicry
+// is enabled, transcripts are learnt again from the redirection server before anything is swapped, or in the background
+// under LearnTranscriptsInBackground, in which case the ones learnt before are replied with until then
+func (sta *State) Reload(preParse RawConfig) error {
+	redirHost, redirPort, err := parseRedirAddr(preParse.RedirAddr)
+	if err != nil {
+		return fmt.Errorf("unable to parse RedirAddr: %v", err)
+	}
+	redirServerName := parseRedirServerName(preParse.RedirAddr)
+
+	redirBySNI := make(map[string]redirOrigin)
+	for sni, origin := range preParse.RedirAddrBySNI {
+		host, port, err := parseRedirAddr(origin)
+		if err != nil {
+			return fmt.Errorf("unable to parse RedirAddr of %v: %v", sni, err)
+		}
+		redirBySNI[strings.ToLower(sni)] = redirOrigin{host: host, port: port, serverName: parseRedirServerName(origin)}
+	}
+
+	keepAlive := time.Duration(preParse.KeepAlive) * time.Second
+	if preParse.KeepAlive <= 0 {
+		keepAlive = -1
+	}
+	proxyDialers, err := parseProxyDialers(preParse.ProxyDialPolicies, keepAlive)
+	if err != nil {
+		return fmt.Errorf("unable to parse ProxyBook: %v", err)
+	}
+	proxyBook, err := parseProxyBook(preParse.ProxyBook, proxyDialers)
+	if err != nil {
+		return fmt.Errorf("unable to parse ProxyBook: %v", err)
+	}
 
+	// the databases are read again so that updated ones can be picked up without restarting
+	decoyPolicy, err := parseDecoyPolicy(preParse)
+	if err != nil {
+		return err
+	}
+
+	bypassUID := make(map[[16]byte]struct{})
 	var arrUID [16]byte
 	for _, UID := range preParse.BypassUID {
 		copy(arrUID[:], UID)
-		sta.BypassUID[arrUID] = struct{}{}
+		bypassUID[arrUID] = struct{}{}
 	}
 	copy(arrUID[:], sta.AdminUID)
-	sta.BypassUID[arrUID] = struct{}{}
+	bypassUID[arrUID] = struct{}{}
 
-	go sta.UsedRandomCleaner()
-	return sta, nil
+	var learner *State
+	if sta.MimicTranscript {
+		learner = &State{
+			RedirHost:       redirHost,
+			RedirPort:       redirPort,
+			RedirDialer:     sta.RedirDialer,
+			redirServerName: redirServerName,
+		}
+		if !sta.LearnTranscriptsInBackground {
+			learner.learnTranscripts()
+		}
+	}
+
+	// the certificate is loaded again so that a renewed one can be picked up without restarting
+	var realTLSCert *tls.Certificate
+	if preParse.TLSCert != "" || preParse.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(preParse.TLSCert, preParse.TLSKey)
+		if err != nil {
+			return fmt.Errorf("unable to load TLSCert and TLSKey: %v", err)
+		}
+		realTLSCert = &cert
+	}
+
+	// listening isn't resumed after draining has started
+	if sta.Listeners != nil && !sta.draining() {
+		if err = sta.Listeners.Update(preParse); err != nil {
+			return err
+		}
+	}
+
+	sta.reloadM.Lock()
+	sta.ProxyBook = proxyBook
+	sta.proxyDialers = proxyDialers
+	sta.BypassUID = bypassUID
+	sta.RedirHost, sta.RedirPort, sta.redirServerName = redirHost, redirPort, redirServerName
+	sta.redirBySNI = redirBySNI
+	sta.decoyPolicy = decoyPolicy
+	sta.transcriptsGeneration++
+	generation := sta.transcriptsGeneration
+	if learner != nil && !sta.LearnTranscriptsInBackground {
+		sta.transcripts = learner.transcripts
+		sta.serverHellos = learner.serverHellos
+	}
+	sta.realTLSCert = realTLSCert
+	sta.serverList = preParse.ServerList
+	sta.reloadM.Unlock()
+
+	if learner != nil && sta.LearnTranscriptsInBackground {
+		go func() {
+			learner.learnTranscripts()
+			sta.reloadM.Lock()
+			defer sta.reloadM.Unlock()
+			if sta.transcriptsGeneration == generation {
+				sta.transcripts = learner.transcripts
+				sta.serverHellos = learner.serverHellos
+			}
+		}()
+	}
+	return sta.reloadTenants(preParse)
+}
+
+var ErrReloadUnsupported = errors.New("configuration reloading isn't supported")
+
+// ReloadConfig reads the configuration from ConfigSource again and reloads it
+func (sta *State) ReloadConfig() error {
+	if sta.ConfigSource == nil {
+		return ErrReloadUnsupported
+	}
+	raw, err := sta.ConfigSource()
+	if err != nil {
+		return err
+	}
+	return sta.Reload(raw)
 }
 
 // IsBypass checks if a UID is a bypass user
 func (sta *State) IsBypass(UID []byte) bool {
 	var arrUID [16]byte
 	copy(arrUID[:], UID)
+	sta.reloadM.RLock()
 	_, exist := sta.BypassUID[arrUID]
+	sta.reloadM.RUnlock()
 	return exist
 }
 
-const TIMESTAMP_TOLERANCE = 180 * time.Second
+// proxyAddr returns the address of the proxy server of a ProxyMethod
+func (sta *State) proxyAddr(proxyMethod string) (addr net.Addr, ok bool) {
+	sta.reloadM.RLock()
+	addr, ok = sta.ProxyBook[proxyMethod]
+	sta.reloadM.RUnlock()
+	return
+}
+
+// realTLSCertificate returns the certificate to terminate TLS with, nil if TLS isn't terminated
+func (sta *State) realTLSCertificate() *tls.Certificate {
+	sta.reloadM.RLock()
+	defer sta.reloadM.RUnlock()
+	return sta.realTLSCert
+}
+
+type redirOrigin struct {
+	host       net.Addr
+	port       string
+	serverName string
+}
 
-const CACHE_CLEAN_INTERVAL = 12 * time.Hour
+// redirAddr returns the address of the redirection server of sni, which is that of RedirAddr if sni doesn't have its
+// own. If the redirection server has no port, port is defaultPort
+func (sta *State) redirAddr(sni string, defaultPort string) (addr string, serverName string) {
+	sta.reloadM.RLock()
+	defer sta.reloadM.RUnlock()
+	origin, ok := sta.redirBySNI[strings.ToLower(sni)]
+	if !ok {
+		origin = redirOrigin{host: sta.RedirHost, port: sta.RedirPort, serverName: sta.redirServerName}
+	}
+	port := origin.port
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(origin.host.String(), port), origin.serverName
+}
+
+const TIMESTAMP_TOLERANCE = 180 * time.Second
 
-// UsedRandomCleaner clears the cache of used random fields every CACHE_CLEAN_INTERVAL
-func (sta *State) UsedRandomCleaner() {
+// replayCacheSaver saves the replay cache every replayCacheSaveInterval
+func (sta *State) replayCacheSaver() {
 	for {
-		time.Sleep(CACHE_CLEAN_INTERVAL)
-		sta.usedRandomM.Lock()
-		for key, t := range sta.UsedRandom {
-			if time.Unix(t, 0).Before(sta.WorldState.Now().Add(TIMESTAMP_TOLERANCE)) {
-				delete(sta.UsedRandom, key)
-			}
+		time.Sleep(replayCacheSaveInterval)
+		if err := sta.SaveReplayCache(); err != nil {
+			log.Errorf("failed to save replay cache: %v", err)
 		}
-		sta.usedRandomM.Unlock()
 	}
 }
 
-func (sta *State) registerRandom(r [32]byte) bool {
-	sta.usedRandomM.Lock()
-	_, used := sta.UsedRandom[r]
-	sta.UsedRandom[r] = sta.WorldState.Now().Unix()
-	sta.usedRandomM.Unlock()
-	return used
+// SaveReplayCache saves the replay cache to ReplayCachePath, if it's set
+func (sta *State) SaveReplayCache() error {
+	if sta.ReplayCachePath == "" {
+		return nil
+	}
+	return sta.replayCache.save(sta.ReplayCachePath)
+}
+
+// registerRandom remembers the random of a handshake with timestamp, returning whether it has been used before, on
+// another node as well if they share the replay cache
+func (sta *State) registerRandom(r [32]byte, timestamp time.Time) bool {
+	if sta.replayCache.register(r, timestamp, sta.WorldState.Now()) {
+		return true
+	}
+	if sta.cluster == nil {
+		return false
+	}
+	seen, err := sta.cluster.registerRandom(r)
+	if err != nil {
+		log.Warnf("failed to check the shared replay cache: %v", err)
+		return false
+	}
+	return seen
+}
+
+// flowWindow is the window of flow control configured as raw, which is def if it's 0 and not limited if it's negative
+func flowWindow(raw int, def int) int {
+	switch {
+	case raw == 0:
+		return def
+	case raw < 0:
+		return 0
+	default:
+		return raw
+	}
+}
+
+// compresses is whether the frames of sessions of method are compressed for clients that ask for it
+func (sta *State) compresses(method string) bool {
+	return sta.compressProxyMethods[method]
 }
@@ -1,8 +1,18 @@
 package server
 
 import (
+	"encoding/json"
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseRedirAddr(t *testing.T) {
@@ -106,3 +116,485 @@ func TestParseRedirAddr(t *testing.T) {
 		}
 	})
 }
+
+func TestInitState_DatabaseURL(t *testing.T) {
+	if _, err := InitState(RawConfig{DatabaseURL: "mysql://localhost/ck", RedirAddr: "127.0.0.1:9999"}, common.RealWorldState); err == nil {
+		t.Error("expecting an error for an unknown user database")
+	}
+}
+
+func TestInitState_BindTransports(t *testing.T) {
+	raw := RawConfig{
+		BindAddr:       []string{":443"},
+		BindTransports: map[string][]string{":443": {"QUIC"}},
+		RedirAddr:      "127.0.0.1:9999",
+	}
+	if _, err := InitState(raw, common.RealWorldState); err == nil {
+		t.Error("expecting an error for an unknown transport")
+	}
+}
+
+func TestInitState_AuthWebhook(t *testing.T) {
+	for name, c := range map[string]struct {
+		raw RawConfig
+		ok  bool
+	}{
+		"valid":         {RawConfig{AuthWebhook: "https://billing.example.com/cloak", AuthWebhookCacheTTL: 30}, true},
+		"not http":      {RawConfig{AuthWebhook: "ftp://billing.example.com/cloak"}, false},
+		"negative TTL":  {RawConfig{AuthWebhook: "https://billing.example.com/cloak", AuthWebhookCacheTTL: -1}, false},
+		"with database": {RawConfig{AuthWebhook: "https://billing.example.com/cloak", DatabaseURL: "redis://localhost"}, false},
+	} {
+		c.raw.RedirAddr = "127.0.0.1:9999"
+		sta, err := InitState(c.raw, common.RealWorldState)
+		if c.ok != (err == nil) {
+			t.Errorf("%v: unexpected error %v", name, err)
+			continue
+		}
+		if c.ok {
+			if _, ok := sta.Panel.Manager.(usermanager.HandshakeAuthenticator); !ok {
+				t.Errorf("%v: users aren't authenticated by the webhook", name)
+			}
+		}
+	}
+}
+
+func TestInitState_LowCreditWarning(t *testing.T) {
+	initState := func(lowCreditWarning int64) (*State, error) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		return InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", LowCreditWarning: lowCreditWarning}, common.RealWorldState)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		sta, err := initState(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sta.Panel.lowCreditWarning != defaultLowCreditWarning {
+			t.Errorf("expecting the default of %v, got %v", defaultLowCreditWarning, sta.Panel.lowCreditWarning)
+		}
+	})
+	t.Run("disabled", func(t *testing.T) {
+		sta, err := initState(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sta.Panel.isLow(common.Quota{}) {
+			t.Error("warning with warnings disabled")
+		}
+	})
+}
+
+func TestInitState_RateBurst(t *testing.T) {
+	initState := func(rateBurst int) (*State, error) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		return InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", RateBurst: rateBurst}, common.RealWorldState)
+	}
+
+	t.Run("default", func(t *testing.T) {
+		sta, err := initState(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sta.Panel.rateBurst != time.Second {
+			t.Errorf("expecting a default burst of 1s, got %v", sta.Panel.rateBurst)
+		}
+	})
+	t.Run("set", func(t *testing.T) {
+		sta, err := initState(250)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sta.Panel.rateBurst != 250*time.Millisecond {
+			t.Errorf("expecting a burst of 250ms, got %v", sta.Panel.rateBurst)
+		}
+	})
+	t.Run("negative", func(t *testing.T) {
+		_, err := initState(-1)
+		if err == nil {
+			t.Error("expecting an error")
+		}
+	})
+}
+
+func TestInitState_ResumeGrace(t *testing.T) {
+	for name, c := range map[string]struct {
+		raw      int
+		expected time.Duration
+	}{
+		"default":  {0, 60 * time.Second},
+		"set":      {10, 10 * time.Second},
+		"disabled": {-1, 0},
+	} {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		sta, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", ResumeGrace: c.raw}, common.RealWorldState)
+		os.Remove(tmpDB.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sta.ResumeGrace != c.expected {
+			t.Errorf("%v: expecting %v, got %v", name, c.expected, sta.ResumeGrace)
+		}
+	}
+}
+
+func TestInitState_RecordSizing(t *testing.T) {
+	for name, c := range map[string]struct {
+		raw      string
+		expected byte
+	}{
+		"default": {"", mux.RECORD_SIZING_FULL},
+		"full":    {"full", mux.RECORD_SIZING_FULL},
+		"dynamic": {"Dynamic", mux.RECORD_SIZING_DYNAMIC},
+	} {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		sta, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", RecordSizing: c.raw}, common.RealWorldState)
+		os.Remove(tmpDB.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sta.RecordSizing != c.expected {
+			t.Errorf("%v: expecting %v, got %v", name, c.expected, sta.RecordSizing)
+		}
+	}
+
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	if _, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", RecordSizing: "tiny"}, common.RealWorldState); err == nil {
+		t.Error("expecting an error for an unknown sizing")
+	}
+}
+
+func TestInitState_CompressProxyMethods(t *testing.T) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	sta, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", CompressProxyMethods: []string{"http"}}, common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sta.compresses("http") {
+		t.Error("expecting http to be compressed")
+	}
+	if sta.compresses("shadowsocks") {
+		t.Error("expecting shadowsocks not to be compressed")
+	}
+}
+
+func TestInitState_HandshakeRecordLength(t *testing.T) {
+	initState := func(length string) (*State, error) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		return InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", HandshakeRecordLength: length}, common.RealWorldState)
+	}
+	sta, err := initState("3000-5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sta.handshakeRecordLength != [2]int{3000, 5000} {
+		t.Errorf("expecting 3000 to 5000, got %v", sta.handshakeRecordLength)
+	}
+	for _, bad := range []string{"3000", "5000-3000", "0-100", "100-20000", "a-b"} {
+		if _, err := initState(bad); err == nil {
+			t.Errorf("expecting an error for %v", bad)
+		}
+	}
+}
+
+func TestInitState_DNSDomain(t *testing.T) {
+	initState := func(domain string) (*State, error) {
+		tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+		defer os.Remove(tmpDB.Name())
+		return InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: "127.0.0.1:9999", DNSAddr: ":53",
+			DNSDomain: domain, ServerList: []string{"203.0.113.1:443"}}, common.RealWorldState)
+	}
+	sta, err := initState("T.Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sta.DNSDomain != "t.example.com" {
+		t.Errorf("expecting t.example.com, got %v", sta.DNSDomain)
+	}
+	if servers := sta.servers(); len(servers) != 1 {
+		t.Errorf("unexpected ServerList %v", servers)
+	}
+	for _, bad := range []string{"", ".", strings.Repeat("a.", 120)} {
+		if _, err := initState(bad); err == nil {
+			t.Errorf("expecting an error for %q", bad)
+		}
+	}
+}
+
+func TestState_Reload(t *testing.T) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	adminUID := []byte{0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f}
+	bypassUID := []byte{0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f}
+	raw := RawConfig{
+		ProxyBook:    map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388"}},
+		RedirAddr:    "127.0.0.1:9999",
+		DatabasePath: tmpDB.Name(),
+		AdminUID:     adminUID,
+	}
+	sta, err := InitState(raw, common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("swap", func(t *testing.T) {
+		reloaded := raw
+		reloaded.ProxyBook = map[string][]string{"openvpn": {"udp", "127.0.0.1:1194"}}
+		reloaded.BypassUID = [][]byte{bypassUID}
+		reloaded.RedirAddr = "127.0.0.2"
+		err := sta.Reload(reloaded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sta.proxyAddr("shadowsocks"); ok {
+			t.Error("removed proxy method still exists")
+		}
+		if addr, ok := sta.proxyAddr("openvpn"); !ok || addr.String() != "127.0.0.1:1194" {
+			t.Errorf("added proxy method: expecting 127.0.0.1:1194, got %v", addr)
+		}
+		if !sta.IsBypass(bypassUID) {
+			t.Error("added bypass user isn't bypassed")
+		}
+		if !sta.IsBypass(adminUID) {
+			t.Error("admin is no longer bypassed")
+		}
+		if addr, _ := sta.redirAddr("", "443"); addr != "127.0.0.2:443" {
+			t.Errorf("expecting RedirAddr 127.0.0.2:443, got %v", addr)
+		}
+	})
+
+	t.Run("invalid config changes nothing", func(t *testing.T) {
+		invalid := raw
+		invalid.ProxyBook = map[string][]string{"shadowsocks": {"tcp"}}
+		err := sta.Reload(invalid)
+		if err == nil {
+			t.Fatal("expecting an error")
+		}
+		if _, ok := sta.proxyAddr("openvpn"); !ok {
+			t.Error("ProxyBook is changed by an invalid config")
+		}
+		if !sta.IsBypass(bypassUID) {
+			t.Error("BypassUID is changed by an invalid config")
+		}
+	})
+
+	t.Run("from ConfigSource", func(t *testing.T) {
+		sta.ConfigSource = nil
+		if err := sta.ReloadConfig(); err != ErrReloadUnsupported {
+			t.Errorf("expecting %v, got %v", ErrReloadUnsupported, err)
+		}
+		sta.ConfigSource = func() (RawConfig, error) { return raw, nil }
+		if err := sta.ReloadConfig(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := sta.proxyAddr("shadowsocks"); !ok {
+			t.Error("config from ConfigSource isn't applied")
+		}
+	})
+}
+
+func TestRawConfig_UnmarshalJSON(t *testing.T) {
+	t.Run("RedirAddr as a string", func(t *testing.T) {
+		var raw RawConfig
+		err := json.Unmarshal([]byte(`{"RedirAddr": "204.79.197.200:443", "StreamTimeout": 1}`), &raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw.RedirAddr != "204.79.197.200:443" || raw.RedirAddrBySNI != nil || raw.StreamTimeout != 1 {
+			t.Errorf("unexpected config %+v", raw)
+		}
+	})
+	t.Run("RedirAddr by SNI", func(t *testing.T) {
+		var raw RawConfig
+		err := json.Unmarshal([]byte(`{"RedirAddr": {"*": "204.79.197.200:443", "www.example.com": "93.184.216.34"}, "StreamTimeout": 1}`), &raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw.RedirAddr != "204.79.197.200:443" || raw.StreamTimeout != 1 {
+			t.Errorf("unexpected config %+v", raw)
+		}
+		if len(raw.RedirAddrBySNI) != 1 || raw.RedirAddrBySNI["www.example.com"] != "93.184.216.34" {
+			t.Errorf("unexpected RedirAddrBySNI %v", raw.RedirAddrBySNI)
+		}
+	})
+	t.Run("RedirAddr by SNI without default", func(t *testing.T) {
+		var raw RawConfig
+		err := json.Unmarshal([]byte(`{"RedirAddr": {"www.example.com": "93.184.216.34"}}`), &raw)
+		if err == nil {
+			t.Error("expecting an error")
+		}
+	})
+	t.Run("ProxyBook with dial policies", func(t *testing.T) {
+		var raw RawConfig
+		err := json.Unmarshal([]byte(`{"ProxyBook": {"shadowsocks": ["tcp", "127.0.0.1:8388"],
+			"openvpn": {"Network": "udp", "Addr": "127.0.0.1:1194", "SourceAddr": "127.0.0.1", "Retries": 2},
+			"direct": {"Network": "direct", "IPVersion": "6"}}}`), &raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string][]string{
+			"shadowsocks": {"tcp", "127.0.0.1:8388"},
+			"openvpn":     {"udp", "127.0.0.1:1194"},
+			"direct":      {"direct"},
+		}
+		if !reflect.DeepEqual(raw.ProxyBook, expected) {
+			t.Errorf("expecting ProxyBook %v, got %v", expected, raw.ProxyBook)
+		}
+		policies := map[string]ProxyDialPolicy{
+			"openvpn": {SourceAddr: "127.0.0.1", Retries: 2},
+			"direct":  {IPVersion: "6"},
+		}
+		if !reflect.DeepEqual(raw.ProxyDialPolicies, policies) {
+			t.Errorf("expecting ProxyDialPolicies %v, got %v", policies, raw.ProxyDialPolicies)
+		}
+	})
+	t.Run("ProxyBook with a Unix domain socket", func(t *testing.T) {
+		var raw RawConfig
+		err := json.Unmarshal([]byte(`{"ProxyBook": {"shadowsocks": "unix:///run/shadowsocks.sock", "tor": "unix://@tor"}}`), &raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string][]string{
+			"shadowsocks": {"unix", "/run/shadowsocks.sock"},
+			"tor":         {"unix", "@tor"},
+		}
+		if !reflect.DeepEqual(raw.ProxyBook, expected) {
+			t.Errorf("expecting ProxyBook %v, got %v", expected, raw.ProxyBook)
+		}
+		if err := json.Unmarshal([]byte(`{"ProxyBook": {"shadowsocks": "127.0.0.1:8388"}}`), &raw); err == nil {
+			t.Error("expecting an error for a string that isn't a unix:// URL")
+		}
+	})
+}
+
+func TestState_RedirAddrBySNI(t *testing.T) {
+	sta := &State{RedirDialer: &net.Dialer{}}
+	err := sta.Reload(RawConfig{
+		RedirAddr:      "127.0.0.1",
+		RedirAddrBySNI: map[string]string{"www.Example.com": "127.0.0.2:8443"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sni, expected := range map[string]string{
+		"www.example.com": "127.0.0.2:8443",
+		"WWW.EXAMPLE.COM": "127.0.0.2:8443",
+		"www.bing.com":    "127.0.0.1:443",
+		"":                "127.0.0.1:443",
+	} {
+		if addr, _ := sta.redirAddr(sni, "443"); addr != expected {
+			t.Errorf("SNI %q: expecting %v, got %v", sni, expected, addr)
+		}
+	}
+
+	err = sta.Reload(RawConfig{RedirAddr: "127.0.0.1", RedirAddrBySNI: map[string]string{"www.example.com": "cover.invalid"}})
+	if err == nil {
+		t.Error("expecting an error for an invalid origin")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() RawConfig {
+		return RawConfig{
+			PrivateKey: make([]byte, 32),
+			AdminUID:   make([]byte, 16),
+			BindAddr:   []string{":443"},
+			RedirAddr:  "127.0.0.1:9999",
+			ProxyBook:  map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388"}},
+		}
+	}
+	if err := ValidateConfig(valid()); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, spoil := range map[string]func(*RawConfig){
+		"short PrivateKey": func(raw *RawConfig) { raw.PrivateKey = raw.PrivateKey[:31] },
+		"short AdminUID":   func(raw *RawConfig) { raw.AdminUID = raw.AdminUID[:15] },
+		"long BypassUID":   func(raw *RawConfig) { raw.BypassUID = [][]byte{make([]byte, 17)} },
+		"short PreviousPrivateKeys": func(raw *RawConfig) {
+			raw.PreviousPrivateKeys = [][]byte{make([]byte, 32), make([]byte, 16)}
+		},
+		"bad ProxyBook": func(raw *RawConfig) { raw.ProxyBook["openvpn"] = []string{"udp"} },
+		"bad ProxyAddr": func(raw *RawConfig) { raw.ProxyBook["openvpn"] = []string{"udp", "127.0.0.1:port"} },
+		"bad transport": func(raw *RawConfig) { raw.BindTransports = map[string][]string{":443": {"QUIC"}} },
+	} {
+		raw := valid()
+		spoil(&raw)
+		if err := ValidateConfig(raw); err == nil {
+			t.Errorf("%v: expecting an error", name)
+		}
+	}
+}
+
+func TestParseConfig_YAML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ck_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ckserver.yaml")
+	err = ioutil.WriteFile(path, []byte(`ProxyBook:
+  shadowsocks: [tcp, "127.0.0.1:8388"]
+  openvpn:
+    Network: udp
+    Addr: "127.0.0.1:1194"
+    Retries: 3
+BindAddr: [":443", {Addr: ":80", Transports: [WebSocket]}]
+RedirAddr: 127.0.0.1
+PrivateKey: AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ParseConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw.ProxyBook) != 2 || raw.ProxyDialPolicies["openvpn"].Retries != 3 || len(raw.BindTransports[":80"]) != 1 {
+		t.Errorf("wrong config %+v", raw)
+	}
+	if err = ValidateConfig(raw); err != nil {
+		t.Error(err)
+	}
+
+	if err = ioutil.WriteFile(path, []byte("RedirAddr: 127.0.0.1\nRedirAdr: 127.0.0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseConfig(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expecting an error on line 2, got %v", err)
+	}
+}
+
+func TestParseConfig_Environment(t *testing.T) {
+	os.Setenv("CK_SERVER_BINDADDR", `[":8443", {"Addr": ":80", "Transports": ["WebSocket"]}]`)
+	os.Setenv("CK_SERVER_REDIRADDR", "127.0.0.1:9999")
+	defer os.Unsetenv("CK_SERVER_BINDADDR")
+	defer os.Unsetenv("CK_SERVER_REDIRADDR")
+
+	raw, err := ParseConfig(`{"BindAddr": [{"Addr": ":443", "Transports": ["TLS"]}], "RedirAddr": {"*": "127.0.0.1", "a.com": "127.0.0.2"}, "StreamTimeout": 300}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(raw.BindAddr, []string{":8443", ":80"}) || len(raw.BindTransports) != 1 || raw.BindTransports[":80"][0] != "WebSocket" {
+		t.Errorf("BindAddr isn't replaced by the environment: %v %v", raw.BindAddr, raw.BindTransports)
+	}
+	if raw.RedirAddr != "127.0.0.1:9999" || len(raw.RedirAddrBySNI) != 0 {
+		t.Errorf("RedirAddr isn't replaced by the environment: %v %v", raw.RedirAddr, raw.RedirAddrBySNI)
+	}
+	if raw.StreamTimeout != 300 {
+		t.Errorf("StreamTimeout from the file is lost")
+	}
+
+	if err = raw.Override(map[string]string{"redirAddr": "127.0.0.3"}); err != nil || raw.RedirAddr != "127.0.0.3" {
+		t.Errorf("RedirAddr isn't overridden: %v %v", raw.RedirAddr, err)
+	}
+
+	raw, err = ParseConfig("")
+	if err != nil || raw.RedirAddr != "127.0.0.1:9999" || raw.ProxyBook == nil {
+		t.Errorf("the configuration isn't read from the environment alone: %+v %v", raw, err)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// A tarpit holds the connections of probers open for a while, sending them a few random bytes every second, rather
+// than closing them or sending them to the redirection server. It ties up their resources, and they don't see an
+// immediate close to tell Cloak by. Probers are those who replay a handshake, and addresses with a number of failed
+// handshakes in a short time
+
+// failed handshakes of an address are counted over this long
+const tarpitWindow = 10 * time.Minute
+
+const (
+	defaultTarpitRate  = 1
+	defaultTarpitAfter = 3
+	// beyond this many connections held at once, probers are turned away as usual so that they can't run us out of
+	// file descriptors
+	maxTarpitted = 1024
+	// beyond this many addresses with failed handshakes, the oldest counts are forgotten
+	maxTarpitAddrs = 1 << 16
+)
+
+type failedHandshakes struct {
+	count int
+	since time.Time
+}
+
+type tarpit struct {
+	duration time.Duration
+	// bytes sent every tick
+	rate int
+	tick time.Duration
+	// failed handshakes in tarpitWindow for an address to be taken as a prober
+	after int
+
+	m        sync.Mutex
+	failures map[string]failedHandshakes
+
+	held atomic.Int32
+}
+
+func newTarpit(duration time.Duration, rate int, after int) *tarpit {
+	if rate <= 0 {
+		rate = defaultTarpitRate
+	}
+	if after <= 0 {
+		after = defaultTarpitAfter
+	}
+	return &tarpit{
+		duration: duration,
+		rate:     rate,
+		tick:     time.Second,
+		after:    after,
+		failures: make(map[string]failedHandshakes),
+	}
+}
+
+// fail records a failed handshake from host, and returns whether host has failed enough of them to be a prober
+func (tp *tarpit) fail(host string, now time.Time) bool {
+	tp.m.Lock()
+	defer tp.m.Unlock()
+	if len(tp.failures) >= maxTarpitAddrs {
+		for h, f := range tp.failures {
+			if now.Sub(f.since) > tarpitWindow {
+				delete(tp.failures, h)
+			}
+		}
+		if len(tp.failures) >= maxTarpitAddrs {
+			tp.failures = make(map[string]failedHandshakes)
+		}
+	}
+	f, ok := tp.failures[host]
+	if !ok || now.Sub(f.since) > tarpitWindow {
+		f = failedHandshakes{since: now}
+	}
+	f.count++
+	tp.failures[host] = f
+	return f.count >= tp.after
+}
+
+// hold keeps conn open for the duration of the tarpit, or until the other side closes it, sending random bytes
+// every tick. Anything sent to it is thrown away. It returns false without doing anything if too many connections
+// are already held
+func (tp *tarpit) hold(conn net.Conn, worldState common.WorldState) bool {
+	if tp.held.Add(1) > maxTarpitted {
+		tp.held.Add(-1)
+		return false
+	}
+	go func() {
+		defer tp.held.Add(-1)
+		defer conn.Close()
+
+		closed := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, conn)
+			close(closed)
+		}()
+
+		ticker := time.NewTicker(tp.tick)
+		defer ticker.Stop()
+		end := time.After(tp.duration)
+		drip := make([]byte, tp.rate)
+		for {
+			select {
+			case <-closed:
+				return
+			case <-end:
+				return
+			case <-ticker.C:
+				common.RandRead(worldState.Rand, drip)
+				_ = conn.SetWriteDeadline(time.Now().Add(tp.tick + 5*time.Second))
+				if _, err := conn.Write(drip); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return true
+}
+
+// tarpitted records that authentication of conn has failed with err, and holds conn in the tarpit if it's from a
+// prober. It returns whether it's held, and if it isn't, conn is left to be turned away as usual
+func (sta *State) tarpitted(conn net.Conn, err error) bool {
+	if sta.tarpit == nil {
+		return false
+	}
+	host, _, splitErr := net.SplitHostPort(conn.RemoteAddr().String())
+	if splitErr != nil {
+		return false
+	}
+	// a replay is always from a prober, as a client never sends the same handshake twice
+	probe := sta.tarpit.fail(host, sta.WorldState.Now())
+	if !probe && !errors.Is(err, ErrReplay) {
+		return false
+	}
+	if !sta.tarpit.hold(conn, sta.WorldState) {
+		return false
+	}
+	log.WithField("remoteAddr", conn.RemoteAddr()).Info("holding a prober's connection in the tarpit")
+	return true
+}
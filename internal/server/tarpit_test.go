@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+func TestTarpit_fail(t *testing.T) {
+	tp := newTarpit(time.Minute, 0, 3)
+	now := time.Unix(1600000000, 0)
+	for i := 1; i <= 3; i++ {
+		if probe := tp.fail("1.2.3.4", now); probe != (i == 3) {
+			t.Errorf("failure %v: expecting prober to be %v", i, i == 3)
+		}
+	}
+	if tp.fail("5.6.7.8", now) {
+		t.Error("another address taken as a prober")
+	}
+	if tp.fail("1.2.3.4", now.Add(tarpitWindow+time.Second)) {
+		t.Error("failures older than the window still counted")
+	}
+}
+
+func TestTarpit_hold(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	connect := func() (client net.Conn, server net.Conn) {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err = l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client, server
+	}
+
+	tp := newTarpit(500*time.Millisecond, 3, 0)
+	tp.tick = 50 * time.Millisecond
+
+	t.Run("drip", func(t *testing.T) {
+		client, server := connect()
+		defer client.Close()
+		start := time.Now()
+		if !tp.hold(server, common.RealWorldState) {
+			t.Fatal("not held")
+		}
+		client.Write([]byte("thrown away"))
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		received, err := io.ReadAll(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+			t.Errorf("closed after only %v", elapsed)
+		}
+		if len(received) == 0 || len(received)%3 != 0 {
+			t.Errorf("expecting bytes in threes, got %v", len(received))
+		}
+	})
+	t.Run("closed by the other side", func(t *testing.T) {
+		tp := newTarpit(time.Hour, 1, 0)
+		client, server := connect()
+		if !tp.hold(server, common.RealWorldState) {
+			t.Fatal("not held")
+		}
+		client.Close()
+		deadline := time.Now().Add(3 * time.Second)
+		for tp.held.Load() != 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if tp.held.Load() != 0 {
+			t.Error("still held after the other side has closed")
+		}
+	})
+	t.Run("too many", func(t *testing.T) {
+		tp := newTarpit(time.Hour, 1, 0)
+		tp.held.Store(maxTarpitted)
+		client, server := connect()
+		defer client.Close()
+		defer server.Close()
+		if tp.hold(server, common.RealWorldState) {
+			t.Error("held beyond the limit")
+		}
+	})
+}
+
+func TestState_tarpitted(t *testing.T) {
+	from := func(ip string) net.Conn {
+		client, server := net.Pipe()
+		client.Close()
+		return &fakeAddrConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+	}
+	sta := &State{WorldState: common.RealWorldState}
+	if sta.tarpitted(from("1.2.3.4"), ErrReplay) {
+		t.Error("held without a tarpit")
+	}
+
+	sta.tarpit = newTarpit(time.Minute, 0, 2)
+	if !sta.tarpitted(from("1.2.3.4"), ErrReplay) {
+		t.Error("a replay isn't held")
+	}
+	otherErr := errors.New("bad timestamp")
+	if sta.tarpitted(from("5.6.7.8"), otherErr) {
+		t.Error("held after one failed handshake")
+	}
+	if !sta.tarpitted(from("5.6.7.8"), otherErr) {
+		t.Error("not held after two failed handshakes")
+	}
+}
+
+// fakeAddrConn is a net.Conn from any address
+type fakeAddrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *fakeAddrConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,144 @@
+package server
+
+// Tenants let one ck-server serve the clients of several operators who don't share keys or users, on the same
+// addresses. Each tenant is told apart by the SNI its clients put in the ClientHello, which is read before anything is
+// authenticated, and has its own static keys, user database, ProxyBook and redirection server. Everything else, such
+// as the transports and the timeouts, is as configured for the ck-server as a whole.
+//
+// A tenant is served by a State of its own, made from the configuration of the ck-server with what the tenant has of
+// its own in place of it, so that a ClientHello of its SNI goes through exactly what it would on a ck-server of its
+// own. It doesn't listen, serve metrics or the admin API v2, or terminate TLS itself, which are all of the ck-server
+// as a whole. The users of a tenant are managed by its AdminUID
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	log "github.com/sirupsen/logrus"
+)
+
+// TenantConfig is what a tenant has of its own
+type TenantConfig struct {
+	PrivateKey          []byte
+	PreviousPrivateKeys [][]byte
+	AdminUID            []byte
+	BypassUID           [][]byte
+	// one of these must be set, and DatabasePath mustn't be that of the ck-server
+	DatabasePath     string
+	DatabaseURL      string
+	AuthWebhook      string
+	AuthWebhookToken string
+	// each entry is a pair of network and address
+	ProxyBook map[string][]string
+	// that of the ck-server if it's empty
+	RedirAddr string
+}
+
+// tenantConfig returns the configuration of the State of a tenant
+func tenantConfig(preParse RawConfig, tenant TenantConfig) (RawConfig, error) {
+	if tenant.DatabasePath == "" && tenant.DatabaseURL == "" && tenant.AuthWebhook == "" {
+		return RawConfig{}, errors.New("one of DatabasePath, DatabaseURL and AuthWebhook must be set")
+	}
+	if tenant.DatabasePath != "" && tenant.DatabasePath == preParse.DatabasePath {
+		return RawConfig{}, errors.New("DatabasePath can't be the same as the ck-server's")
+	}
+	raw := preParse
+	raw.PrivateKey = tenant.PrivateKey
+	raw.PreviousPrivateKeys = tenant.PreviousPrivateKeys
+	raw.AdminUID = tenant.AdminUID
+	raw.BypassUID = tenant.BypassUID
+	raw.DatabasePath = tenant.DatabasePath
+	raw.DatabaseURL = tenant.DatabaseURL
+	raw.AuthWebhook = tenant.AuthWebhook
+	raw.AuthWebhookToken = tenant.AuthWebhookToken
+	raw.ProxyBook = tenant.ProxyBook
+	raw.ProxyDialPolicies = nil
+	if tenant.RedirAddr != "" {
+		raw.RedirAddr = tenant.RedirAddr
+		raw.RedirAddrBySNI = nil
+	}
+	// what's of the ck-server as a whole
+	raw.Tenants = nil
+	raw.BindAddr, raw.BindTransports, raw.BindKnocks = nil, nil, nil
+	raw.KnockAddr, raw.DNSAddr = "", ""
+	raw.MetricsAddr, raw.AdminAPIAddr = "", ""
+	raw.TLSCert, raw.TLSKey, raw.ACMEDomains = "", "", nil
+	raw.ClusterRedisURL = ""
+	raw.ReplayCachePath = ""
+	raw.ProbeStatsInterval = 0
+	raw.HandshakeRatePerIP, raw.HandshakeRate = 0, 0
+	raw.HandshakeWorkers, raw.HandshakeQueue = 0, 0
+	raw.UsageWebhook, raw.UsageWebhookToken, raw.UsageLedgerPath, raw.UsageLedgerMaxSize = "", "", "", 0
+	return raw, nil
+}
+
+// validateTenants checks the configuration of each tenant as ValidateConfig does
+func validateTenants(preParse RawConfig) error {
+	for sni, tenant := range preParse.Tenants {
+		raw, err := tenantConfig(preParse, tenant)
+		if err == nil {
+			err = ValidateConfig(raw)
+		}
+		if err != nil {
+			return fmt.Errorf("tenant %v: %v", sni, err)
+		}
+	}
+	return nil
+}
+
+// initTenants makes the States of the tenants in preParse
+func (sta *State) initTenants(preParse RawConfig, worldState common.WorldState) error {
+	sta.tenants = make(map[string]*State, len(preParse.Tenants))
+	for sni, tenant := range preParse.Tenants {
+		raw, err := tenantConfig(preParse, tenant)
+		if err != nil {
+			return fmt.Errorf("tenant %v: %v", sni, err)
+		}
+		tenantSta, err := InitState(raw, worldState)
+		if err != nil {
+			return fmt.Errorf("tenant %v: %v", sni, err)
+		}
+		// handshakes are bounded across tenants, and counted with the ck-server's metrics
+		tenantSta.handshakes = sta.handshakes
+		tenantSta.metrics = sta.metrics
+		if sta.usage != nil {
+			tenantSta.Panel.exportUsage = sta.usage.exporter(sni)
+		}
+		sta.tenants[strings.ToLower(sni)] = tenantSta
+	}
+	return nil
+}
+
+// reloadTenants reloads the tenants that are in preParse. Tenants can't be added or removed without restarting
+func (sta *State) reloadTenants(preParse RawConfig) error {
+	if sta.tenants == nil {
+		// they're being made by InitState
+		return nil
+	}
+	var firstErr error
+	for sni, tenant := range preParse.Tenants {
+		tenantSta, ok := sta.tenants[strings.ToLower(sni)]
+		if !ok {
+			log.Warnf("tenant %v can't be added without restarting", sni)
+			continue
+		}
+		raw, err := tenantConfig(preParse, tenant)
+		if err == nil {
+			err = tenantSta.Reload(raw)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("tenant %v: %v", sni, err)
+		}
+	}
+	return firstErr
+}
+
+// tenantOf returns the State of the tenant that the SNI of a ClientHello is of, nil if it isn't of one
+func (sta *State) tenantOf(firstPacket []byte) *State {
+	if len(sta.tenants) == 0 || len(firstPacket) == 0 || firstPacket[0] != 0x16 {
+		return nil
+	}
+	return sta.tenants[strings.ToLower(decoyNameOf(firstPacket))]
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	utls "github.com/refraction-networking/utls"
+)
+
+func TestTenants(t *testing.T) {
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	tenantDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tenantDB.Name())
+	tenantKey := make([]byte, 32)
+	tenantKey[0] = 1
+	raw := RawConfig{
+		DatabasePath: tmpDB.Name(),
+		RedirAddr:    "127.0.0.1:9999",
+		PrivateKey:   make([]byte, 32),
+		ProxyBook:    map[string][]string{"shadowsocks": {"tcp", "127.0.0.1:8388"}},
+		Tenants: map[string]TenantConfig{
+			"Tenant.example.com": {
+				PrivateKey:   tenantKey,
+				DatabasePath: tenantDB.Name(),
+				ProxyBook:    map[string][]string{"ssh": {"tcp", "127.0.0.1:22"}},
+			},
+		},
+	}
+	sta, err := InitState(raw, common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenant := sta.tenantOf(makeTestHello(t, "tenant.example.com", utls.HelloChrome_Auto))
+	if tenant == nil {
+		t.Fatal("the ClientHello of the tenant's SNI isn't of the tenant")
+	}
+	if sta.tenantOf(makeTestHello(t, "www.example.com", utls.HelloChrome_Auto)) != nil {
+		t.Error("the ClientHello of another SNI is of the tenant")
+	}
+	if _, ok := tenant.proxyAddr("ssh"); !ok {
+		t.Error("the tenant doesn't have its own ProxyBook")
+	}
+	if _, ok := tenant.proxyAddr("shadowsocks"); ok {
+		t.Error("the tenant has the ProxyBook of the ck-server")
+	}
+	keyOf := func(sta *State) (key []byte) {
+		sta.StaticPv.(*common.Secret).Use(func(b []byte) { key = append(key, b...) })
+		return
+	}
+	if bytes.Equal(keyOf(tenant), keyOf(sta)) {
+		t.Error("the tenant doesn't have its own static key")
+	}
+	if tenant.Panel == sta.Panel {
+		t.Error("the tenant doesn't have its own users")
+	}
+	tenant.metrics.handshake(nil)
+	if sta.metrics.handshakesAccepted.Load() != 1 {
+		t.Error("the handshakes of the tenant aren't counted in the ck-server's metrics")
+	}
+
+	raw.Tenants["Tenant.example.com"] = TenantConfig{
+		PrivateKey:   tenantKey,
+		DatabasePath: tenantDB.Name(),
+		ProxyBook:    map[string][]string{"http": {"tcp", "127.0.0.1:80"}},
+	}
+	if err = sta.Reload(raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tenant.proxyAddr("http"); !ok {
+		t.Error("the ProxyBook of the tenant isn't reloaded")
+	}
+}
+
+func TestTenantConfig(t *testing.T) {
+	raw := RawConfig{DatabasePath: "userinfo.db", MetricsAddr: "127.0.0.1:9100"}
+	if _, err := tenantConfig(raw, TenantConfig{}); err == nil {
+		t.Error("expecting an error for a tenant without a user database")
+	}
+	if _, err := tenantConfig(raw, TenantConfig{DatabasePath: "userinfo.db"}); err == nil {
+		t.Error("expecting an error for a tenant with the ck-server's user database")
+	}
+	tenantRaw, err := tenantConfig(raw, TenantConfig{DatabasePath: "tenant.db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tenantRaw.MetricsAddr != "" {
+		t.Error("the tenant serves metrics of its own")
+	}
+}
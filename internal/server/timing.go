@@ -0,0 +1,136 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Under EqualiseTiming, the response to a first packet starts after about the same time whatever it turns out to be.
+// Otherwise a prober could tell a first packet that can't be decoded, one that isn't from a Cloak client, a replay and
+// the handshake of a UID that's refused apart by how soon each is redirected, as each stops at a different point of
+// authentication, and tell the handshake of a client from all of them by the ServerHello coming sooner than the
+// redirection server could answer.
+//
+// So every outcome is held until the slowest of them would usually be done: the smoothed time that each takes plus 4
+// times its deviation, as TCP works out its retransmission timeout from round trip times. The handshakes of clients are
+// then held for as long as the redirection server takes on average to answer what's relayed to it, so that their
+// ServerHellos come when the cover site's would. An outcome that's slower than usual, such as when the user database
+// is, still shows
+
+const (
+	timingUndecodable = iota
+	timingNotCloak
+	timingReplay
+	timingRefused
+	timingCloak
+	timingOutcomes
+)
+
+// the longest an outcome is held, so that a slow user database or webhook doesn't hold everything up for long
+const maxTimingHold = time.Second
+
+// smoothedDuration is the smoothed mean and deviation of a duration, as in RFC 6298
+type smoothedDuration struct {
+	mean, dev time.Duration
+}
+
+func (s *smoothedDuration) update(sample time.Duration) {
+	if s.mean == 0 {
+		s.mean, s.dev = sample, sample/2
+		return
+	}
+	diff := s.mean - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	s.dev += (diff - s.dev) / 4
+	s.mean += (sample - s.mean) / 8
+}
+
+// bound is how long it usually takes at most
+func (s smoothedDuration) bound() time.Duration { return s.mean + 4*s.dev }
+
+type responseTiming struct {
+	m        sync.Mutex
+	outcomes [timingOutcomes]smoothedDuration
+	// from dialing the redirection server to its first answer
+	redirect smoothedDuration
+
+	sleep func(time.Duration)
+}
+
+func newResponseTiming() *responseTiming {
+	return &responseTiming{sleep: time.Sleep}
+}
+
+// timingOutcomeOf is the outcome of a first packet that authenticating it failed with err
+func timingOutcomeOf(err error) int {
+	switch {
+	case err == nil:
+		return timingCloak
+	case errors.Is(err, ErrReplay):
+		return timingReplay
+	case errors.Is(err, ErrNotCloak):
+		return timingNotCloak
+	case errors.Is(err, ErrBadClientHello), errors.Is(err, ErrUnrecognisedProtocol):
+		return timingUndecodable
+	default:
+		return timingRefused
+	}
+}
+
+// hold takes the time since start for outcome, then waits until the slowest outcome would usually be done. It does
+// nothing if t is nil
+func (t *responseTiming) hold(start time.Time, outcome int) {
+	if t == nil {
+		return
+	}
+	took := time.Since(start)
+	t.m.Lock()
+	t.outcomes[outcome].update(took)
+	var slowest time.Duration
+	for _, s := range t.outcomes {
+		if bound := s.bound(); bound > slowest {
+			slowest = bound
+		}
+	}
+	if outcome == timingCloak {
+		slowest += t.redirect.mean
+	}
+	t.m.Unlock()
+
+	if slowest > maxTimingHold {
+		slowest = maxTimingHold
+	}
+	if wait := slowest - took; wait > 0 {
+		t.sleep(wait)
+	}
+}
+
+// redirected takes how long the redirection server took to answer since it started being dialled. It does nothing if
+// t is nil
+func (t *responseTiming) redirected(took time.Duration) {
+	if t == nil {
+		return
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.redirect.update(took)
+}
+
+// heldClient makes goWeb and finishHandshake of an authenticated first packet, read at start, hold until the slowest
+// outcome would usually be done
+func (t *responseTiming) heldClient(start time.Time, goWeb func(), finishHandshake Responder) (func(), Responder) {
+	heldWeb := func() {
+		t.hold(start, timingRefused)
+		goWeb()
+	}
+	heldHandshake := func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (net.Conn, error) {
+		t.hold(start, timingCloak)
+		return finishHandshake(originalConn, sessionKey, randSource)
+	}
+	return heldWeb, heldHandshake
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimingOutcomeOf(t *testing.T) {
+	for err, exp := range map[error]int{
+		nil:               timingCloak,
+		ErrReplay:         timingReplay,
+		ErrNotCloak:       timingNotCloak,
+		ErrBadClientHello: timingUndecodable,
+		fmt.Errorf("%w: %w", ErrBadClientHello, ErrHelloTruncated): timingUndecodable,
+		ErrUnrecognisedProtocol: timingUndecodable,
+		ErrBadProxyMethod:       timingRefused,
+	} {
+		if outcome := timingOutcomeOf(err); outcome != exp {
+			t.Errorf("%v: expecting outcome %v, got %v", err, exp, outcome)
+		}
+	}
+}
+
+func TestResponseTiming(t *testing.T) {
+	var waited time.Duration
+	timing := newResponseTiming()
+	timing.sleep = func(d time.Duration) { waited = d }
+	// how long an outcome is held for to within the time the test takes
+	expectHeld := func(exp time.Duration) {
+		t.Helper()
+		if waited > exp+10*time.Millisecond || waited < exp-10*time.Millisecond {
+			t.Errorf("expecting to be held for %v, got %v", exp, waited)
+		}
+		waited = 0
+	}
+
+	timing.hold(time.Now().Add(-40*time.Millisecond), timingReplay)
+	// 40ms + 4*20ms
+	expectHeld(80 * time.Millisecond)
+	timing.hold(time.Now().Add(-time.Millisecond), timingUndecodable)
+	expectHeld(119 * time.Millisecond)
+
+	timing.redirected(50 * time.Millisecond)
+	timing.hold(time.Now().Add(-20*time.Millisecond), timingCloak)
+	expectHeld(150 * time.Millisecond)
+
+	timing.hold(time.Now().Add(-10*time.Second), timingRefused)
+	if waited != 0 {
+		t.Errorf("an outcome slower than the slowest is held for %v", waited)
+	}
+	timing.hold(time.Now(), timingNotCloak)
+	expectHeld(maxTimingHold)
+
+	var none *responseTiming
+	none.hold(time.Now(), timingCloak)
+	none.redirected(time.Second)
+}
+
+func TestRedirectToWeb_Timed(t *testing.T) {
+	webL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer webL.Close()
+	go func() {
+		conn, err := webL.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req := make([]byte, 5)
+		io.ReadFull(conn, req)
+		time.Sleep(20 * time.Millisecond)
+		conn.Write([]byte("reply"))
+		io.Copy(conn, conn)
+	}()
+
+	webHost, webPort, _ := net.SplitHostPort(webL.Addr().String())
+	webAddr, _ := net.ResolveIPAddr("ip", webHost)
+	sta := &State{
+		RedirHost:   webAddr,
+		RedirPort:   webPort,
+		RedirDialer: &net.Dialer{},
+		timing:      newResponseTiming(),
+	}
+
+	prober, ckConn := net.Pipe()
+	defer prober.Close()
+	redirectToWeb(ckConn, []byte("first"), sta)
+
+	reply := make([]byte, 5)
+	if _, err = io.ReadFull(prober, reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("expecting the reply, got %q, %v", reply, err)
+	}
+	prober.Write([]byte("again"))
+	if _, err = io.ReadFull(prober, reply); err != nil || string(reply) != "again" {
+		t.Errorf("expecting the rest to be relayed, got %q, %v", reply, err)
+	}
+
+	sta.timing.m.Lock()
+	defer sta.timing.m.Unlock()
+	if sta.timing.redirect.mean < 20*time.Millisecond {
+		t.Errorf("expecting the redirection server to be timed at 20ms or more, got %v", sta.timing.redirect.mean)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	utls "github.com/refraction-networking/utls"
+	log "github.com/sirupsen/logrus"
+)
+
+// A transcript is the lengths of the encrypted handshake records (EncryptedExtensions, Certificate,
+// CertificateVerify and Finished, possibly coalesced) a TLS 1.3 server sends after its ServerHello and
+// ChangeCipherSpec. When transcript mimicry is enabled, these are learnt from the redirection server so that the
+// record lengths in our reply are the same as the ones sent by the cover site.
+
+// defaultTranscript is used before a transcript has been learnt from the redirection server, or if learning failed.
+// It's what a server with an RSA 2048 certificate chain that sends each handshake message in its own record
+// would produce
+var defaultTranscript = []int{32, 2870, 281, 53}
+
+const (
+	numTranscriptSamples   = 3
+	transcriptProbeTimeout = 10 * time.Second
+)
+
+// recordReader returns at most one TLS record per Read call so that the tls client never reads past the
+// handshake, and it records the length of every ApplicationData record read as well as the first Handshake record,
+// which is the ServerHello
+type recordReader struct {
+	net.Conn
+	pending     []byte
+	appData     []int
+	serverHello []byte
+}
+
+func (r *recordReader) Read(b []byte) (int, error) {
+	if len(r.pending) == 0 {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(r.Conn, header); err != nil {
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		record := make([]byte, 5+length)
+		copy(record, header)
+		if _, err := io.ReadFull(r.Conn, record[5:]); err != nil {
+			return 0, err
+		}
+		if header[0] == common.ApplicationData {
+			r.appData = append(r.appData, length)
+		}
+		if header[0] == common.Handshake && r.serverHello == nil {
+			r.serverHello = record[5:]
+		}
+		r.pending = record
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+var errNoEncryptedHandshake = errors.New("no encrypted handshake records received")
+
+// transcriptKey identifies the parts of a ClientHello that change the lengths of the encrypted handshake records a
+// server responds with: compress_certificate changes the length of Certificate, and ALPN that of EncryptedExtensions
+func transcriptKey(ch *ClientHello) string {
+	return string(ch.extensions[[2]byte{0x00, 0x1b}]) + "|" + string(ch.extensions[[2]byte{0x00, 0x10}])
+}
+
+// probeTranscript performs a TLS 1.3 handshake with the server at addr using the uTLS preset helloID, and returns
+// the ClientHello we sent, the server's transcript and the template of its ServerHello. The template is only
+// learnt if parsing the ServerHello succeeds
+func probeTranscript(dialer common.Dialer, addr string, serverName string, helloID utls.ClientHelloID) (ch *ClientHello, transcript []int, serverHello *serverHelloTemplate, err error) {
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(transcriptProbeTimeout))
+
+	rr := &recordReader{Conn: conn}
+	uconn := utls.UClient(rr, &utls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}, helloID)
+	if err = uconn.BuildHandshakeState(); err != nil {
+		return
+	}
+	hello := uconn.HandshakeState.Hello.Raw
+	ch, err = parseClientHello(common.AddRecordLayer(append([]byte{}, hello...), common.Handshake, common.VersionTLS11))
+	if err != nil {
+		return
+	}
+
+	if err = uconn.Handshake(); err != nil {
+		return
+	}
+	if len(rr.appData) == 0 {
+		err = errNoEncryptedHandshake
+		return
+	}
+	transcript = rr.appData
+	if len(transcript) > common.MaxTranscriptRecords {
+		transcript = transcript[:common.MaxTranscriptRecords]
+	}
+	if template, parseErr := parseServerHelloTemplate(rr.serverHello); parseErr == nil {
+		serverHello = &template
+	} else {
+		log.Debugf("failed to learn the ServerHello from %v: %v", addr, parseErr)
+	}
+	return
+}
+
+// learnTranscripts probes the redirection server a few times with each browser a client may pretend to be and keeps
+// what it has seen as transcripts to be replayed. If a probe fails, the samples learnt so far are kept. This is done
+// before serving so that all connections in a session are replied to with the same transcript, unless
+// LearnTranscriptsInBackground is set. The cipher suite and the extension order of the ServerHello are learnt along
+// the way
+func (sta *State) learnTranscripts() {
+	addr, serverName := sta.redirAddr("", "443")
+
+	log.Infof("transcript mimicry is enabled, learning handshake transcripts from %v. Clients that don't support it "+
+		"will still receive the legacy reply", addr)
+	sta.transcripts = make(map[string][][]int)
+	sta.serverHellos = make(map[string]serverHelloTemplate)
+	for browser, helloID := range common.Parrots {
+		for i := 0; i < numTranscriptSamples; i++ {
+			ch, transcript, serverHello, err := probeTranscript(sta.RedirDialer, addr, serverName, helloID)
+			if err != nil {
+				log.Warnf("failed to learn handshake transcript of %v from %v: %v", browser, addr, err)
+				break
+			}
+			key := transcriptKey(ch)
+			sta.transcripts[key] = append(sta.transcripts[key], transcript)
+			if serverHello != nil {
+				sta.serverHellos[cipherSuitesKey(ch)] = *serverHello
+			}
+		}
+	}
+	log.Debugf("learnt handshake transcripts %v and ServerHellos %v from %v", sta.transcripts, sta.serverHellos, addr)
+}
+
+// Transcripts returns the transcripts to be replayed in replies by transcriptKey, or nil if transcript mimicry isn't
+// enabled. ClientHellos that no transcript has been learnt for are replied to with the default transcript
+func (sta *State) Transcripts() map[string][][]int {
+	if !sta.MimicTranscript {
+		return nil
+	}
+	sta.reloadM.RLock()
+	defer sta.reloadM.RUnlock()
+	if sta.transcripts == nil {
+		return map[string][][]int{}
+	}
+	return sta.transcripts
+}
+
+// ServerHellos returns the templates of the ServerHellos the redirection server replies with by cipherSuitesKey, or
+// nil if transcript mimicry isn't enabled
+func (sta *State) ServerHellos() map[string]serverHelloTemplate {
+	if !sta.MimicTranscript {
+		return nil
+	}
+	sta.reloadM.RLock()
+	defer sta.reloadM.RUnlock()
+	return sta.serverHellos
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/test"
+)
+
+func TestProbeTranscript(t *testing.T) {
+	cert, _ := test.SelfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	for browser, helloID := range common.Parrots {
+		t.Run(browser, func(t *testing.T) {
+			ch, transcript, serverHello, err := probeTranscript(&net.Dialer{}, l.Addr().String(), "www.example.com", helloID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if transcriptKey(ch) == "|" {
+				t.Error("ClientHello has neither compress_certificate nor ALPN")
+			}
+			// crypto/tls sends EncryptedExtensions, Certificate, CertificateVerify and Finished in separate records
+			if len(transcript) != 4 {
+				t.Errorf("expecting 4 encrypted handshake records, got %v", transcript)
+			}
+			// crypto/tls puts supported_versions before key_share
+			if serverHello == nil {
+				t.Fatal("ServerHello not learnt")
+			}
+			if serverHello.cipherSuite[0] != 0x13 || !offersCipherSuite(ch, serverHello.cipherSuite) {
+				t.Errorf("unexpected cipher suite %x", serverHello.cipherSuite)
+			}
+			expected := [][2]byte{supportedVersionsExtensionType, keyShareExtensionType}
+			if !reflect.DeepEqual(serverHello.extensions, expected) {
+				t.Errorf("expecting extensions %x, got %x", expected, serverHello.extensions)
+			}
+			if serverHello.keyShareGroup != x25519Group && serverHello.keyShareGroup != x25519MLKEM768Group {
+				t.Errorf("unexpected key share group %x", serverHello.keyShareGroup)
+			}
+		})
+	}
+}
+
+func TestLearnTranscripts(t *testing.T) {
+	cert, _ := test.SelfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the redirection server goes away after two handshakes
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+		l.Close()
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	redirHost, _ := net.ResolveIPAddr("ip", host)
+	sta := &State{
+		RedirHost:       redirHost,
+		RedirPort:       port,
+		RedirDialer:     &net.Dialer{},
+		MimicTranscript: true,
+	}
+	sta.learnTranscripts()
+
+	var numSamples int
+	for _, transcripts := range sta.Transcripts() {
+		numSamples += len(transcripts)
+	}
+	if numSamples != 2 {
+		t.Errorf("expecting the 2 successful samples to be kept, got %v", sta.Transcripts())
+	}
+	if len(sta.ServerHellos()) == 0 {
+		t.Error("no ServerHello learnt")
+	}
+}
+
+func TestReload_LearnsTranscriptsInBackground(t *testing.T) {
+	cert, _ := test.SelfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the redirection server doesn't reply until it's let to
+	let := make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				<-let
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	sta, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: l.Addr().String(), MimicTranscript: true,
+		LearnTranscriptsInBackground: true}, common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sta.Transcripts()) != 0 {
+		t.Error("transcripts learnt before the redirection server has replied")
+	}
+
+	close(let)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sta.Transcripts()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("transcripts aren't learnt in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReload_LearnsTranscriptsBeforeServing(t *testing.T) {
+	cert, _ := test.SelfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	tmpDB, _ := ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	sta, err := InitState(RawConfig{DatabasePath: tmpDB.Name(), RedirAddr: l.Addr().String(), MimicTranscript: true}, common.RealWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sta.Transcripts()) == 0 {
+		t.Error("transcripts aren't learnt by the time InitState returns")
+	}
+}
+
+func TestParseRedirServerName(t *testing.T) {
+	pairs := map[string]string{
+		"www.example.com":     "www.example.com",
+		"www.example.com:443": "www.example.com",
+		"1.2.3.4":             "",
+		"1.2.3.4:443":         "",
+		"::1":                 "",
+		"[::1]:443":           "",
+	}
+	for addr, expected := range pairs {
+		if got := parseRedirServerName(addr); got != expected {
+			t.Errorf("for %v expecting %v, got %v", addr, expected, got)
+		}
+	}
+}
@@ -9,7 +9,7 @@ import (
 
 type Responder = func(originalConn net.Conn, sessionKey [32]byte, randSource io.Reader) (preparedConn net.Conn, err error)
 type Transport interface {
-	processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey) (authFragments, Responder, error)
+	processFirstPacket(reqPacket []byte, staticPvs []crypto.PrivateKey) (authFragments, Responder, error)
 }
 
 var ErrInvalidPubKey = errors.New("public key has invalid format")
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultUDPTimeout = 60 * time.Second
+
+// relayUDP relays datagrams between a stream and the UDP socket to the proxy server, like a NAT mapping: both are
+// closed once nothing has been relayed either way for timeout. It returns once both directions have finished
+func relayUDP(proxyConn net.Conn, stream net.Conn, timeout time.Duration) {
+	expiry := time.AfterFunc(timeout, func() {
+		log.Tracef("UDP mapping to %v expired", proxyConn.RemoteAddr())
+		proxyConn.Close()
+		stream.Close()
+	})
+	defer expiry.Stop()
+
+	relay := func(dst net.Conn, src net.Conn) {
+		buf := make([]byte, 65536)
+		for {
+			n, err := src.Read(buf)
+			if err != nil {
+				log.Tracef("relaying UDP: %v", err)
+				break
+			}
+			expiry.Reset(timeout)
+			if _, err = dst.Write(buf[:n]); err != nil {
+				log.Tracef("relaying UDP: %v", err)
+				break
+			}
+		}
+		proxyConn.Close()
+		stream.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		relay(proxyConn, stream)
+		close(done)
+	}()
+	relay(stream, proxyConn)
+	<-done
+}
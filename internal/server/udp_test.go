@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRelayUDP(t *testing.T) {
+	proxyConn, proxyServer := net.Pipe()
+	stream, streamClient := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		relayUDP(proxyConn, stream, 100*time.Millisecond)
+		close(done)
+	}()
+
+	t.Run("relay", func(t *testing.T) {
+		go streamClient.Write([]byte("ping"))
+		buf := make([]byte, 16)
+		n, err := proxyServer.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "ping" {
+			t.Errorf("expecting ping, got %q", buf[:n])
+		}
+		go proxyServer.Write([]byte("pong"))
+		n, err = streamClient.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "pong" {
+			t.Errorf("expecting pong, got %q", buf[:n])
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("mapping hasn't expired")
+		}
+		if _, err := streamClient.Read(make([]byte, 16)); err == nil {
+			t.Error("stream isn't closed after expiry")
+		}
+	})
+}
@@ -0,0 +1,214 @@
+package server
+
+// The usage of users can be exported every time it's uploaded to the user database, so that they can be billed
+// without the admin API being scraped. Each export is of what each user has used since the one before, and is
+// POSTed to UsageWebhook as JSON, appended to the CSV ledger at UsageLedgerPath, or both. An export that the webhook
+// doesn't take is sent again along with the next, up to maxPendingUsage records, so that nothing is lost while it's
+// down for a while. Once the ledger is larger than UsageLedgerMaxSize, it's renamed with the time appended and a new
+// one is started. Old ledgers are never removed, as what's billed from them is for the operator to archive.
+//
+// The users of tenants are exported along with the ck-server's own, with the SNI of their tenant
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+	log "github.com/sirupsen/logrus"
+)
+
+const usageWebhookTimeout = 5 * time.Second
+
+// the size the ledger is rotated at if UsageLedgerMaxSize isn't set
+const defaultUsageLedgerMaxSize = 64 << 20
+
+// beyond this many records that the webhook hasn't taken, the oldest are dropped
+const maxPendingUsage = 1 << 16
+
+var usageLedgerHeader = []string{"Timestamp", "Tenant", "UID", "UpUsage", "DownUsage"}
+
+// UsageRecord is what a user has used since the usage before was exported
+type UsageRecord struct {
+	Timestamp int64
+	// the SNI of the tenant the user is of, empty if it's one of the ck-server's own
+	Tenant    string `json:",omitempty"`
+	UID       []byte
+	UpUsage   int64
+	DownUsage int64
+}
+
+type usageExporter struct {
+	world common.WorldState
+
+	// empty if usage isn't POSTed
+	webhook string
+	// nil if there's none
+	token  *common.Secret
+	client *http.Client
+
+	// empty if there's no ledger
+	ledgerPath    string
+	ledgerMaxSize int64
+
+	m sync.Mutex
+	// what the webhook hasn't taken yet
+	pending []UsageRecord
+	// nil until it's first written to
+	ledger     *os.File
+	ledgerSize int64
+}
+
+// parseUsageExporter makes the usageExporter of preParse, nil if usage isn't exported
+func parseUsageExporter(preParse RawConfig, worldState common.WorldState) (*usageExporter, error) {
+	if preParse.UsageWebhook == "" && preParse.UsageLedgerPath == "" {
+		return nil, nil
+	}
+	exporter := &usageExporter{
+		world:         worldState,
+		webhook:       preParse.UsageWebhook,
+		client:        &http.Client{Timeout: usageWebhookTimeout},
+		ledgerPath:    preParse.UsageLedgerPath,
+		ledgerMaxSize: defaultUsageLedgerMaxSize,
+	}
+	if exporter.webhook != "" {
+		if u, err := url.Parse(exporter.webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("bad UsageWebhook %v", exporter.webhook)
+		}
+	}
+	if preParse.UsageWebhookToken != "" {
+		exporter.token = common.NewSecret([]byte(preParse.UsageWebhookToken))
+	}
+	if preParse.UsageLedgerMaxSize < 0 {
+		return nil, errors.New("UsageLedgerMaxSize can't be negative")
+	}
+	if preParse.UsageLedgerMaxSize > 0 {
+		exporter.ledgerMaxSize = preParse.UsageLedgerMaxSize
+	}
+	return exporter, nil
+}
+
+// exporter returns what the userPanel of tenant, empty if it's the ck-server's own, exports its usage with
+func (exporter *usageExporter) exporter(tenant string) func([]usermanager.StatusUpdate) {
+	return func(statuses []usermanager.StatusUpdate) {
+		var records []UsageRecord
+		for _, status := range statuses {
+			if status.UpUsage == 0 && status.DownUsage == 0 {
+				continue
+			}
+			records = append(records, UsageRecord{
+				Timestamp: status.Timestamp,
+				Tenant:    tenant,
+				UID:       status.UID,
+				UpUsage:   status.UpUsage,
+				DownUsage: status.DownUsage,
+			})
+		}
+		if len(records) != 0 {
+			exporter.export(records)
+		}
+	}
+}
+
+func (exporter *usageExporter) export(records []UsageRecord) {
+	exporter.m.Lock()
+	defer exporter.m.Unlock()
+	if exporter.ledgerPath != "" {
+		if err := exporter.appendLedger(records); err != nil {
+			log.Errorf("failed to write usage to %v: %v", exporter.ledgerPath, err)
+		}
+	}
+	if exporter.webhook == "" {
+		return
+	}
+	exporter.pending = append(exporter.pending, records...)
+	if dropped := len(exporter.pending) - maxPendingUsage; dropped > 0 {
+		log.Warnf("usage webhook has been down for too long, %v records of usage are dropped", dropped)
+		exporter.pending = append([]UsageRecord{}, exporter.pending[dropped:]...)
+	}
+	if err := exporter.post(exporter.pending); err != nil {
+		log.Warnf("failed to export usage to the webhook, it'll be sent again with the next: %v", err)
+		return
+	}
+	exporter.pending = nil
+}
+
+// post sends records to the webhook
+func (exporter *usageExporter) post(records []UsageRecord) error {
+	body, err := json.Marshal(struct{ Usage []UsageRecord }{records})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, exporter.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if exporter.token != nil {
+		if !exporter.token.Use(func(token []byte) { req.Header.Set("Authorization", "Bearer "+string(token)) }) {
+			return errors.New("UsageWebhookToken has been wiped")
+		}
+	}
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("usage webhook answered %v", resp.Status)
+	}
+	return nil
+}
+
+// appendLedger appends records to the ledger, rotating it first if it has grown too large. exporter.m must be held
+func (exporter *usageExporter) appendLedger(records []UsageRecord) error {
+	if exporter.ledger != nil && exporter.ledgerSize >= exporter.ledgerMaxSize {
+		exporter.ledger.Close()
+		exporter.ledger = nil
+		rotated := exporter.ledgerPath + "." + exporter.world.Now().UTC().Format("20060102T150405Z")
+		if err := os.Rename(exporter.ledgerPath, rotated); err != nil {
+			return err
+		}
+	}
+	if exporter.ledger == nil {
+		ledger, err := os.OpenFile(exporter.ledgerPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		info, err := ledger.Stat()
+		if err != nil {
+			ledger.Close()
+			return err
+		}
+		exporter.ledger, exporter.ledgerSize = ledger, info.Size()
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if exporter.ledgerSize == 0 {
+		w.Write(usageLedgerHeader)
+	}
+	for _, record := range records {
+		w.Write([]string{
+			strconv.FormatInt(record.Timestamp, 10),
+			record.Tenant,
+			base64.StdEncoding.EncodeToString(record.UID),
+			strconv.FormatInt(record.UpUsage, 10),
+			strconv.FormatInt(record.DownUsage, 10),
+		})
+	}
+	w.Flush()
+	n, err := exporter.ledger.Write(buf.Bytes())
+	exporter.ledgerSize += int64(n)
+	return err
+}
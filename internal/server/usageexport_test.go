@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
+)
+
+func TestUsageExporter(t *testing.T) {
+	worldState := common.WorldOfTime(time.Unix(1600000000, 0))
+	statuses := []usermanager.StatusUpdate{
+		{UID: []byte{1}, UpUsage: 10, DownUsage: 20, Timestamp: 1600000000},
+		{UID: []byte{2}, Timestamp: 1600000000},
+	}
+
+	t.Run("nothing exported", func(t *testing.T) {
+		exporter, err := parseUsageExporter(RawConfig{}, worldState)
+		if err != nil || exporter != nil {
+			t.Errorf("expecting no exporter, got %v, %v", exporter, err)
+		}
+	})
+
+	t.Run("bad config", func(t *testing.T) {
+		for name, raw := range map[string]RawConfig{
+			"webhook":  {UsageWebhook: "ftp://example.com"},
+			"max size": {UsageLedgerPath: "usage.csv", UsageLedgerMaxSize: -1},
+		} {
+			if _, err := parseUsageExporter(raw, worldState); err == nil {
+				t.Errorf("%v: expecting an error", name)
+			}
+		}
+	})
+
+	t.Run("webhook", func(t *testing.T) {
+		var m sync.Mutex
+		var received [][]UsageRecord
+		down := true
+		webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.Lock()
+			defer m.Unlock()
+			if r.Header.Get("Authorization") != "Bearer token" {
+				t.Errorf("expecting the token, got %q", r.Header.Get("Authorization"))
+			}
+			if down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var body struct{ Usage []UsageRecord }
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			received = append(received, body.Usage)
+		}))
+		defer webhook.Close()
+
+		exporter, err := parseUsageExporter(RawConfig{UsageWebhook: webhook.URL, UsageWebhookToken: "token"}, worldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter.exporter("")(statuses)
+		m.Lock()
+		down = false
+		m.Unlock()
+		exporter.exporter("tenant.example.com")(statuses)
+
+		m.Lock()
+		defer m.Unlock()
+		if len(received) != 1 || len(received[0]) != 2 {
+			t.Fatalf("expecting what the webhook didn't take to be sent again with the next, got %v", received)
+		}
+		first, second := received[0][0], received[0][1]
+		if first.Tenant != "" || first.UpUsage != 10 || first.DownUsage != 20 || second.Tenant != "tenant.example.com" {
+			t.Errorf("wrong usage exported: %+v", received[0])
+		}
+		if len(exporter.pending) != 0 {
+			t.Errorf("expecting nothing pending, got %v", exporter.pending)
+		}
+	})
+
+	t.Run("ledger", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "usage.csv")
+		exporter, err := parseUsageExporter(RawConfig{UsageLedgerPath: path, UsageLedgerMaxSize: 1}, worldState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exporter.exporter("")(statuses)
+		exporter.exporter("tenant.example.com")(statuses)
+
+		read := func(path string) [][]string {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			rows, err := csv.NewReader(f).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return rows
+		}
+		rotated := read(path + ".20200913T122640Z")
+		if len(rotated) != 2 || rotated[0][0] != "Timestamp" || rotated[1][2] != "AQ==" || rotated[1][3] != "10" || rotated[1][4] != "20" {
+			t.Errorf("wrong rotated ledger: %v", rotated)
+		}
+		current := read(path)
+		if len(current) != 2 || current[1][1] != "tenant.example.com" {
+			t.Errorf("wrong ledger: %v", current)
+		}
+	})
+}
@@ -12,11 +12,14 @@ import (
 type APIRouter struct {
 	*gmux.Router
 	manager UserManager
+	reload  func() error
 }
 
-func APIRouterOf(manager UserManager) *APIRouter {
+// APIRouterOf makes the admin API of manager. reload is called to reload the server configuration
+func APIRouterOf(manager UserManager, reload func() error) *APIRouter {
 	ret := &APIRouter{
 		manager: manager,
+		reload:  reload,
 	}
 	ret.registerMux()
 	return ret
@@ -35,6 +38,7 @@ func (ar *APIRouter) registerMux() {
 	ar.HandleFunc("/admin/users/{UID}", ar.getUserInfoHlr).Methods("GET")
 	ar.HandleFunc("/admin/users/{UID}", ar.writeUserInfoHlr).Methods("POST")
 	ar.HandleFunc("/admin/users/{UID}", ar.deleteUserHlr).Methods("DELETE")
+	ar.HandleFunc("/admin/reload", ar.reloadHlr).Methods("POST")
 	ar.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,DELETE,OPTIONS")
 	})
@@ -132,3 +136,16 @@ func (ar *APIRouter) deleteUserHlr(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+func (ar *APIRouter) reloadHlr(w http.ResponseWriter, r *http.Request) {
+	if ar.reload == nil {
+		http.Error(w, "configuration reloading isn't supported", http.StatusNotImplemented)
+		return
+	}
+	err := ar.reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
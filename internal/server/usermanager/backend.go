@@ -0,0 +1,162 @@
+package usermanager
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// Backend is a store of users that a backendManager makes a UserManager of. Unlike the bolt database of the
+// localManager, which only one ck-server can have open, a Backend such as Redis or PostgreSQL can be shared by
+// several ck-servers, which is why credit is taken off in one step with ConsumeCredit rather than read and written
+// back.
+type Backend interface {
+	// GetUser returns ErrUserNotFound if there's no such user
+	GetUser(UID []byte) (UserInfo, error)
+	// PutUser creates the user, or replaces it if it exists
+	PutUser(UserInfo) error
+	DeleteUser(UID []byte) error
+	ListUsers() ([]UserInfo, error)
+	// ConsumeCredit atomically takes up and down off the credits of a user and returns the user as it is after.
+	// It returns ErrUserNotFound if there's no such user
+	ConsumeCredit(UID []byte, up, down int64) (UserInfo, error)
+	Close() error
+}
+
+// OpenBackend opens the Backend at databaseURL, whose scheme is redis, rediss, postgres, mysql or sqlite
+func OpenBackend(databaseURL string) (Backend, error) {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad DatabaseURL: %v", err)
+	}
+	if u.Scheme == "redis" || u.Scheme == "rediss" {
+		return openRedisBackend(u)
+	}
+	return openSQLBackend(u)
+}
+
+// backendManager is a UserManager of the users in a Backend
+type backendManager struct {
+	backend Backend
+	world   common.WorldState
+}
+
+func MakeBackendManager(backend Backend, worldState common.WorldState) *backendManager {
+	return &backendManager{backend: backend, world: worldState}
+}
+
+// usable returns why a user can't connect, nil if it can
+func (manager *backendManager) usable(uinfo UserInfo) error {
+	if uinfo.UpCredit <= 0 {
+		return ErrNoUpCredit
+	}
+	if uinfo.DownCredit <= 0 {
+		return ErrNoDownCredit
+	}
+	if uinfo.ExpiryTime < manager.world.Now().Unix() {
+		return ErrUserExpired
+	}
+	return nil
+}
+
+// AuthenticateUser checks the same as the localManager does
+func (manager *backendManager) AuthenticateUser(UID []byte) (int64, int64, error) {
+	uinfo, err := manager.backend.GetUser(UID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = manager.usable(uinfo); err != nil {
+		return 0, 0, err
+	}
+	return uinfo.UpRate, uinfo.DownRate, nil
+}
+
+// AuthoriseNewSession checks the same as the localManager does
+func (manager *backendManager) AuthoriseNewSession(UID []byte, ainfo AuthorisationInfo) error {
+	uinfo, err := manager.backend.GetUser(UID)
+	if err != nil {
+		return err
+	}
+	if err = manager.usable(uinfo); err != nil {
+		return err
+	}
+	if ainfo.NumExistingSessions >= int(uinfo.SessionsCap) {
+		return ErrSessionsCapReached
+	}
+	if sourceIPsCapReached(uinfo.MaxSourceIPs, ainfo) {
+		return ErrSourceIPsCapReached
+	}
+	if len(uinfo.ProxyMethods) == 0 {
+		return nil
+	}
+	for _, method := range uinfo.ProxyMethods {
+		if method == ainfo.ProxyMethod {
+			return nil
+		}
+	}
+	return ErrProxyMethodNotAllowed
+}
+
+// UploadStatus takes the usage of each user off its credit in the Backend, and responds in the same way as the
+// localManager does
+func (manager *backendManager) UploadStatus(uploads []StatusUpdate) ([]StatusResponse, error) {
+	var responses []StatusResponse
+	for _, status := range uploads {
+		uinfo, err := manager.backend.ConsumeCredit(status.UID, status.UpUsage, status.DownUsage)
+		if err == ErrUserNotFound {
+			responses = append(responses, StatusResponse{status.UID, TERMINATE, "User no longer exists"})
+			continue
+		} else if errors.Is(err, ErrDeniedByWebhook) {
+			responses = append(responses, StatusResponse{status.UID, TERMINATE, err.Error()})
+			continue
+		} else if err != nil {
+			return responses, err
+		}
+		if uinfo.UpCredit <= 0 {
+			responses = append(responses, StatusResponse{status.UID, TERMINATE, ErrNoUpCredit.Error()})
+		}
+		if uinfo.DownCredit <= 0 {
+			responses = append(responses, StatusResponse{status.UID, TERMINATE, ErrNoDownCredit.Error()})
+		}
+		if manager.world.Now().Unix() > uinfo.ExpiryTime {
+			responses = append(responses, StatusResponse{status.UID, TERMINATE, ErrUserExpired.Error()})
+		}
+	}
+	return responses, nil
+}
+
+func (manager *backendManager) ListAllUsers() ([]UserInfo, error) {
+	return manager.backend.ListUsers()
+}
+
+func (manager *backendManager) GetUserInfo(UID []byte) (UserInfo, error) {
+	return manager.backend.GetUser(UID)
+}
+
+func (manager *backendManager) WriteUserInfo(uinfo UserInfo) error {
+	return manager.backend.PutUser(uinfo)
+}
+
+func (manager *backendManager) DeleteUser(UID []byte) error {
+	return manager.backend.DeleteUser(UID)
+}
+
+func (manager *backendManager) Close() error {
+	return manager.backend.Close()
+}
+
+// MigrateUsers copies all the users of a UserManager into a Backend, and returns how many there were
+func MigrateUsers(from UserManager, to Backend) (int, error) {
+	infos, err := from.ListAllUsers()
+	if err != nil {
+		return 0, err
+	}
+	for i, uinfo := range infos {
+		if err = to.PutUser(uinfo); err != nil {
+			return i, err
+		}
+	}
+	return len(infos), nil
+}
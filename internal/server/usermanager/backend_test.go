@@ -0,0 +1,215 @@
+package usermanager
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// memoryBackend keeps users in a map
+type memoryBackend struct {
+	m     sync.Mutex
+	users map[string]UserInfo
+}
+
+func (backend *memoryBackend) GetUser(UID []byte) (UserInfo, error) {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+	uinfo, ok := backend.users[string(UID)]
+	if !ok {
+		return UserInfo{}, ErrUserNotFound
+	}
+	return uinfo, nil
+}
+
+func (backend *memoryBackend) PutUser(uinfo UserInfo) error {
+	backend.m.Lock()
+	backend.users[string(uinfo.UID)] = uinfo
+	backend.m.Unlock()
+	return nil
+}
+
+func (backend *memoryBackend) DeleteUser(UID []byte) error {
+	backend.m.Lock()
+	delete(backend.users, string(UID))
+	backend.m.Unlock()
+	return nil
+}
+
+func (backend *memoryBackend) ListUsers() (infos []UserInfo, err error) {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+	for _, uinfo := range backend.users {
+		infos = append(infos, uinfo)
+	}
+	return
+}
+
+func (backend *memoryBackend) ConsumeCredit(UID []byte, up, down int64) (UserInfo, error) {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+	uinfo, ok := backend.users[string(UID)]
+	if !ok {
+		return UserInfo{}, ErrUserNotFound
+	}
+	uinfo.UpCredit -= up
+	uinfo.DownCredit -= down
+	backend.users[string(UID)] = uinfo
+	return uinfo, nil
+}
+
+func (backend *memoryBackend) Close() error { return nil }
+
+func makeMemoryManager() *backendManager {
+	return MakeBackendManager(&memoryBackend{users: make(map[string]UserInfo)}, mockWorldState)
+}
+
+func TestBackendManager_AuthoriseNewSession(t *testing.T) {
+	mgr := makeMemoryManager()
+	validUserInfo := UserInfo{
+		UID:         mockUID,
+		SessionsCap: 10,
+		UpRate:      100,
+		DownRate:    1000,
+		UpCredit:    10000,
+		DownCredit:  100000,
+		ExpiryTime:  1000000,
+	}
+
+	t.Run("normal auth", func(t *testing.T) {
+		_ = mgr.WriteUserInfo(validUserInfo)
+		upRate, downRate, err := mgr.AuthenticateUser(validUserInfo.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upRate != validUserInfo.UpRate || downRate != validUserInfo.DownRate {
+			t.Errorf("wrong rates %v and %v", upRate, downRate)
+		}
+		if err = mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{NumExistingSessions: 0}); err != nil {
+			t.Error(err)
+		}
+	})
+	t.Run("non existent user", func(t *testing.T) {
+		if err := mgr.AuthoriseNewSession(make([]byte, 16), AuthorisationInfo{}); err != ErrUserNotFound {
+			t.Errorf("expecting error %v, got %v", ErrUserNotFound, err)
+		}
+	})
+	t.Run("expired user", func(t *testing.T) {
+		expiredUserInfo := validUserInfo
+		expiredUserInfo.ExpiryTime = mockWorldState.Now().Add(-10).Unix()
+		_ = mgr.WriteUserInfo(expiredUserInfo)
+		if err := mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{}); err != ErrUserExpired {
+			t.Errorf("expecting error %v, got %v", ErrUserExpired, err)
+		}
+	})
+	t.Run("too many sessions", func(t *testing.T) {
+		_ = mgr.WriteUserInfo(validUserInfo)
+		err := mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{NumExistingSessions: int(validUserInfo.SessionsCap)})
+		if err != ErrSessionsCapReached {
+			t.Errorf("expecting error %v, got %v", ErrSessionsCapReached, err)
+		}
+	})
+	t.Run("proxy method", func(t *testing.T) {
+		restricted := validUserInfo
+		restricted.ProxyMethods = []string{"shadowsocks"}
+		_ = mgr.WriteUserInfo(restricted)
+		if err := mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{ProxyMethod: "shadowsocks"}); err != nil {
+			t.Error(err)
+		}
+		if err := mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{ProxyMethod: "openvpn"}); err != ErrProxyMethodNotAllowed {
+			t.Errorf("expecting error %v, got %v", ErrProxyMethodNotAllowed, err)
+		}
+	})
+	t.Run("too many source IPs", func(t *testing.T) {
+		limited := validUserInfo
+		limited.MaxSourceIPs = 1
+		_ = mgr.WriteUserInfo(limited)
+		ainfo := AuthorisationInfo{SourceIP: "192.0.2.1", ExistingSourceIPs: []string{"192.0.2.1"}}
+		if err := mgr.AuthoriseNewSession(validUserInfo.UID, ainfo); err != nil {
+			t.Error(err)
+		}
+		ainfo.SourceIP = "192.0.2.2"
+		if err := mgr.AuthoriseNewSession(validUserInfo.UID, ainfo); err != ErrSourceIPsCapReached {
+			t.Errorf("expecting error %v, got %v", ErrSourceIPsCapReached, err)
+		}
+	})
+}
+
+func TestBackendManager_UploadStatus(t *testing.T) {
+	mgr := makeMemoryManager()
+	uinfo := UserInfo{UID: mockUID, SessionsCap: 10, UpCredit: 1000, DownCredit: 1000, ExpiryTime: 1000000}
+	_ = mgr.WriteUserInfo(uinfo)
+
+	t.Run("simple update", func(t *testing.T) {
+		responses, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, Active: true, UpUsage: 10, DownUsage: 20}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 0 {
+			t.Errorf("unexpected responses %v", responses)
+		}
+		updated, _ := mgr.GetUserInfo(mockUID)
+		if updated.UpCredit != 990 || updated.DownCredit != 980 {
+			t.Errorf("expecting 990 and 980 left, got %v and %v", updated.UpCredit, updated.DownCredit)
+		}
+	})
+	t.Run("credit used up", func(t *testing.T) {
+		responses, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, Active: true, DownUsage: 1000}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 1 || responses[0].Action != TERMINATE || responses[0].Message != ErrNoDownCredit.Error() {
+			t.Errorf("unexpected responses %v", responses)
+		}
+	})
+	t.Run("deleted user", func(t *testing.T) {
+		_ = mgr.DeleteUser(mockUID)
+		responses, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, Active: true, UpUsage: 10}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 1 || responses[0].Action != TERMINATE {
+			t.Errorf("unexpected responses %v", responses)
+		}
+	})
+}
+
+func TestOpenBackend(t *testing.T) {
+	for _, databaseURL := range []string{"mysql://localhost/ck", "postgres://localhost/ck", "redis://localhost:6379/notanumber"} {
+		if _, err := OpenBackend(databaseURL); err == nil {
+			t.Errorf("expecting an error for %v", databaseURL)
+		}
+	}
+}
+
+func TestMigrateUsers(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	local, err := MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	uinfo := UserInfo{UID: mockUID, SessionsCap: 10, UpCredit: 1000, DownCredit: 1000, ExpiryTime: 1000000,
+		ProxyMethods: []string{"shadowsocks"}}
+	other := UserInfo{UID: make([]byte, 16), SessionsCap: 1, ExpiryTime: 1000000}
+	_ = local.WriteUserInfo(uinfo)
+	_ = local.WriteUserInfo(other)
+
+	backend := &memoryBackend{users: make(map[string]UserInfo)}
+	n, err := MigrateUsers(local, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expecting 2 users migrated, got %v", n)
+	}
+	migrated, err := backend.GetUser(mockUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.UpCredit != uinfo.UpCredit || len(migrated.ProxyMethods) != 1 {
+		t.Errorf("expecting %+v, got %+v", uinfo, migrated)
+	}
+}
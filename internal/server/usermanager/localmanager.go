@@ -1,7 +1,13 @@
 package usermanager
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/cbeuw/Cloak/internal/common"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
@@ -21,17 +27,67 @@ func i32ToB(value int32) []byte {
 	return nib
 }
 
+// proxyMethodsOf reads the ProxyMethods of a user's bucket, which it doesn't have if the user can use any
+func proxyMethodsOf(bucket *bolt.Bucket) ([]string, error) {
+	raw := bucket.Get([]byte("ProxyMethods"))
+	if raw == nil {
+		return nil, nil
+	}
+	var methods []string
+	err := json.Unmarshal(raw, &methods)
+	return methods, err
+}
+
+func putProxyMethods(bucket *bolt.Bucket, methods []string) error {
+	if len(methods) == 0 {
+		return bucket.Delete([]byte("ProxyMethods"))
+	}
+	raw, err := json.Marshal(methods)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte("ProxyMethods"), raw)
+}
+
+// maxSourceIPsOf reads the MaxSourceIPs of a user's bucket, which users written before it existed don't have
+func maxSourceIPsOf(bucket *bolt.Bucket) int32 {
+	raw := bucket.Get([]byte("MaxSourceIPs"))
+	if raw == nil {
+		return 0
+	}
+	return int32(Uint32(raw))
+}
+
 // localManager is responsible for managing the local user database
 type localManager struct {
 	db    *bolt.DB
 	world common.WorldState
 }
 
+// how long MakeLocalManager waits for another process, like another ck-server, to let go of the database
+const localDBLockTimeout = 3 * time.Second
+
+// the version of how users are laid out in the database, which is kept in schemaBucket. One of a later version has
+// been written by a newer ck-server, and isn't opened so that it's not corrupted
+const localSchemaVersion = 1
+
+// the bucket the version of the schema is kept in, which isn't a user as UIDs are 16 bytes
+var schemaBucket = []byte("cloak-schema")
+
+var ErrNewerSchema = errors.New("the user database was written by a newer ck-server")
+
 func MakeLocalManager(dbPath string, worldState common.WorldState) (*localManager, error) {
-	db, err := bolt.Open(dbPath, 0600, nil)
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: localDBLockTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%v is in use by another process, such as a running ck-server", dbPath)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if err = checkSchema(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %w", dbPath, err)
+	}
 	ret := &localManager{
 		db:    db,
 		world: worldState,
@@ -39,6 +95,25 @@ func MakeLocalManager(dbPath string, worldState common.WorldState) (*localManage
 	return ret, nil
 }
 
+// checkSchema makes sure the database isn't of a later schema, and records the version of one that has none yet.
+// Databases written before the schema was versioned are of version 1
+func checkSchema(db *bolt.DB) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(schemaBucket)
+		if err != nil {
+			return err
+		}
+		raw := bucket.Get([]byte("Version"))
+		if raw == nil {
+			return bucket.Put([]byte("Version"), i32ToB(localSchemaVersion))
+		}
+		if version := Uint32(raw); version > localSchemaVersion {
+			return fmt.Errorf("%w: it's of version %v, this ck-server only knows up to %v", ErrNewerSchema, version, localSchemaVersion)
+		}
+		return nil
+	})
+}
+
 // Authenticate user returns err==nil along with the users' up and down bandwidths if the UID is allowed to connect
 // More specifically it checks that the user exists, that it has positive credit and that it hasn't expired
 func (manager *localManager) AuthenticateUser(UID []byte) (int64, int64, error) {
@@ -72,22 +147,28 @@ func (manager *localManager) AuthenticateUser(UID []byte) (int64, int64, error)
 }
 
 // AuthoriseNewSession returns err==nil when the user is allowed to make a new session
-// More specifically it checks that the user exists, has credit, hasn't expired and hasn't reached sessionsCap
+// More specifically it checks that the user exists, has credit, hasn't expired, hasn't reached sessionsCap or
+// maxSourceIPs and can use the proxy method
 func (manager *localManager) AuthoriseNewSession(UID []byte, ainfo AuthorisationInfo) error {
 	var arrUID [16]byte
 	copy(arrUID[:], UID)
 	var sessionsCap int
+	var maxSourceIPs int32
 	var upCredit, downCredit, expiryTime int64
+	var proxyMethods []string
 	err := manager.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(arrUID[:])
 		if bucket == nil {
 			return ErrUserNotFound
 		}
 		sessionsCap = int(Uint32(bucket.Get([]byte("SessionsCap"))))
+		maxSourceIPs = maxSourceIPsOf(bucket)
 		upCredit = int64(Uint64(bucket.Get([]byte("UpCredit"))))
 		downCredit = int64(Uint64(bucket.Get([]byte("DownCredit"))))
 		expiryTime = int64(Uint64(bucket.Get([]byte("ExpiryTime"))))
-		return nil
+		var err error
+		proxyMethods, err = proxyMethodsOf(bucket)
+		return err
 	})
 	if err != nil {
 		return err
@@ -105,7 +186,18 @@ func (manager *localManager) AuthoriseNewSession(UID []byte, ainfo Authorisation
 	if ainfo.NumExistingSessions >= sessionsCap {
 		return ErrSessionsCapReached
 	}
-	return nil
+	if sourceIPsCapReached(maxSourceIPs, ainfo) {
+		return ErrSourceIPsCapReached
+	}
+	if len(proxyMethods) == 0 {
+		return nil
+	}
+	for _, method := range proxyMethods {
+		if method == ainfo.ProxyMethod {
+			return nil
+		}
+	}
+	return ErrProxyMethodNotAllowed
 }
 
 // UploadStatus gets StatusUpdates representing the recent status of each user, and update them in the database
@@ -177,6 +269,9 @@ func (manager *localManager) UploadStatus(uploads []StatusUpdate) ([]StatusRespo
 func (manager *localManager) ListAllUsers() (infos []UserInfo, err error) {
 	err = manager.db.View(func(tx *bolt.Tx) error {
 		err = tx.ForEach(func(UID []byte, bucket *bolt.Bucket) error {
+			if bytes.Equal(UID, schemaBucket) {
+				return nil
+			}
 			var uinfo UserInfo
 			uinfo.UID = UID
 			uinfo.SessionsCap = int32(Uint32(bucket.Get([]byte("SessionsCap"))))
@@ -185,6 +280,11 @@ func (manager *localManager) ListAllUsers() (infos []UserInfo, err error) {
 			uinfo.UpCredit = int64(Uint64(bucket.Get([]byte("UpCredit"))))
 			uinfo.DownCredit = int64(Uint64(bucket.Get([]byte("DownCredit"))))
 			uinfo.ExpiryTime = int64(Uint64(bucket.Get([]byte("ExpiryTime"))))
+			uinfo.MaxSourceIPs = maxSourceIPsOf(bucket)
+			uinfo.ProxyMethods, err = proxyMethodsOf(bucket)
+			if err != nil {
+				return err
+			}
 			infos = append(infos, uinfo)
 			return nil
 		})
@@ -206,7 +306,9 @@ func (manager *localManager) GetUserInfo(UID []byte) (uinfo UserInfo, err error)
 		uinfo.UpCredit = int64(Uint64(bucket.Get([]byte("UpCredit"))))
 		uinfo.DownCredit = int64(Uint64(bucket.Get([]byte("DownCredit"))))
 		uinfo.ExpiryTime = int64(Uint64(bucket.Get([]byte("ExpiryTime"))))
-		return nil
+		uinfo.MaxSourceIPs = maxSourceIPsOf(bucket)
+		uinfo.ProxyMethods, err = proxyMethodsOf(bucket)
+		return err
 	})
 	return
 }
@@ -235,7 +337,10 @@ func (manager *localManager) WriteUserInfo(uinfo UserInfo) (err error) {
 		if err = bucket.Put([]byte("ExpiryTime"), i64ToB(uinfo.ExpiryTime)); err != nil {
 			return err
 		}
-		return nil
+		if err = bucket.Put([]byte("MaxSourceIPs"), i32ToB(uinfo.MaxSourceIPs)); err != nil {
+			return err
+		}
+		return putProxyMethods(bucket, uinfo.ProxyMethods)
 	})
 	return
 }
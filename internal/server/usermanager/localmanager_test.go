@@ -2,6 +2,7 @@ package usermanager
 
 import (
 	"encoding/binary"
+	"errors"
 	"github.com/cbeuw/Cloak/internal/common"
 	"io/ioutil"
 	"math/rand"
@@ -11,6 +12,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	bolt "go.etcd.io/bbolt"
 )
 
 var mockUID = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
@@ -59,6 +62,19 @@ func TestLocalManager_GetUserInfo(t *testing.T) {
 		}
 	})
 
+	t.Run("with proxy methods", func(t *testing.T) {
+		restricted := mockUserInfo
+		restricted.ProxyMethods = []string{"shadowsocks"}
+		_ = mgr.WriteUserInfo(restricted)
+		gotInfo, err := mgr.GetUserInfo(mockUID)
+		if err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(gotInfo, restricted) {
+			t.Errorf("got wrong user info: %v", gotInfo)
+		}
+	})
+
 	t.Run("update a field", func(t *testing.T) {
 		_ = mgr.WriteUserInfo(mockUserInfo)
 		updatedUserInfo := mockUserInfo
@@ -202,6 +218,28 @@ func TestLocalManager_AuthoriseNewSession(t *testing.T) {
 		}
 	})
 
+	t.Run("proxy method", func(t *testing.T) {
+		restrictedUserInfo := validUserInfo
+		restrictedUserInfo.ProxyMethods = []string{"shadowsocks", "tor"}
+		_ = mgr.WriteUserInfo(restrictedUserInfo)
+
+		err := mgr.AuthoriseNewSession(restrictedUserInfo.UID, AuthorisationInfo{ProxyMethod: "tor"})
+		if err != nil {
+			t.Error(err)
+		}
+		err = mgr.AuthoriseNewSession(restrictedUserInfo.UID, AuthorisationInfo{ProxyMethod: "openvpn"})
+		if err != ErrProxyMethodNotAllowed {
+			t.Errorf("expecting %v, got %v", ErrProxyMethodNotAllowed, err)
+		}
+
+		// and with the restriction lifted
+		_ = mgr.WriteUserInfo(validUserInfo)
+		err = mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{ProxyMethod: "openvpn"})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
 	t.Run("too many sessions", func(t *testing.T) {
 		_ = mgr.WriteUserInfo(validUserInfo)
 		err := mgr.AuthoriseNewSession(validUserInfo.UID, AuthorisationInfo{NumExistingSessions: int(validUserInfo.SessionsCap + 1)})
@@ -209,6 +247,25 @@ func TestLocalManager_AuthoriseNewSession(t *testing.T) {
 			t.Error("session cap not reached")
 		}
 	})
+
+	t.Run("too many source IPs", func(t *testing.T) {
+		limitedUserInfo := validUserInfo
+		limitedUserInfo.MaxSourceIPs = 2
+		_ = mgr.WriteUserInfo(limitedUserInfo)
+		if uinfo, _ := mgr.GetUserInfo(limitedUserInfo.UID); uinfo.MaxSourceIPs != 2 {
+			t.Errorf("expecting MaxSourceIPs 2, got %v", uinfo.MaxSourceIPs)
+		}
+
+		existing := []string{"192.0.2.1", "192.0.2.2"}
+		err := mgr.AuthoriseNewSession(limitedUserInfo.UID, AuthorisationInfo{SourceIP: "192.0.2.2", ExistingSourceIPs: existing})
+		if err != nil {
+			t.Errorf("a session from an address already in use should be allowed: %v", err)
+		}
+		err = mgr.AuthoriseNewSession(limitedUserInfo.UID, AuthorisationInfo{SourceIP: "192.0.2.3", ExistingSourceIPs: existing})
+		if err != ErrSourceIPsCapReached {
+			t.Errorf("expecting %v, got %v", ErrSourceIPsCapReached, err)
+		}
+	})
 }
 
 func TestLocalManager_UploadStatus(t *testing.T) {
@@ -366,3 +423,20 @@ func TestLocalManager_ListAllUsers(t *testing.T) {
 		t.Error("listed users deviates from uploaded ones")
 	}
 }
+
+func TestLocalManager_Schema(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	mgr, err := MakeLocalManager(tmpDB.Name(), mockWorldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = mgr.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(schemaBucket).Put([]byte("Version"), i32ToB(localSchemaVersion+1))
+	})
+	mgr.Close()
+
+	if _, err = MakeLocalManager(tmpDB.Name(), mockWorldState); !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("expecting %v for a database of a later schema, got %v", ErrNewerSchema, err)
+	}
+}
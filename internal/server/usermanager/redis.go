@@ -0,0 +1,436 @@
+package usermanager
+
+// The Redis backend speaks RESP to the server itself through RedisClient, which takes far less than a client
+// library would for the handful of commands it sends. Each user is a hash at ck:user:<UID in base64> with a field for
+// each of the UserInfo, and the set ck:users has the UIDs of all of them.
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const redisUsersKey = "ck:users"
+const redisDialTimeout = 5 * time.Second
+
+// how long a command, or a transaction, can take before the connection is taken to be dead and dropped
+const redisCommandTimeout = 5 * time.Second
+
+// consumeCreditScript takes the usage off a user if it exists, and returns the user as it is after
+const consumeCreditScript = `if redis.call('EXISTS', KEYS[1]) == 0 then return false end
+redis.call('HINCRBY', KEYS[1], 'UpCredit', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'DownCredit', ARGV[2])
+return redis.call('HGETALL', KEYS[1])`
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+var errRedisReply = errors.New("redis: unexpected reply")
+
+// RedisClient sends commands to a Redis server on one connection, which they take turns on. A command that isn't
+// answered within redisCommandTimeout, or the deadline of its context, drops the connection, which is dialled again
+// by the next one. It's also used by ck-servers in a cluster to share state
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	// nil unless it's rediss://
+	tlsConfig *tls.Config
+
+	// holds a token while a command has its turn on conn
+	turn chan struct{}
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// OpenRedis connects to redis://[:password@]host:port[/db], or rediss:// for Redis over TLS
+func OpenRedis(redisURL string) (*RedisClient, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("%v isn't a redis:// or rediss:// URL", redisURL)
+	}
+	return openRedis(u)
+}
+
+func openRedis(u *url.URL) (*RedisClient, error) {
+	client := &RedisClient{addr: u.Host, turn: make(chan struct{}, 1)}
+	if u.Port() == "" {
+		client.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.Scheme == "rediss" {
+		client.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+	}
+	if u.User != nil {
+		client.password, _ = u.User.Password()
+	}
+	if path := strings.TrimPrefix(u.Path, "/"); path != "" {
+		db, err := strconv.Atoi(path)
+		if err != nil {
+			return nil, fmt.Errorf("bad redis database %v", path)
+		}
+		client.db = db
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisDialTimeout)
+	defer cancel()
+	if err := client.take(ctx); err != nil {
+		return nil, err
+	}
+	defer client.give()
+	if err := client.connect(ctx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// take waits for the turn on the connection, or for ctx to be done
+func (client *RedisClient) take(ctx context.Context) error {
+	select {
+	case client.turn <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (client *RedisClient) give() { <-client.turn }
+
+func (client *RedisClient) connect(ctx context.Context) error {
+	dialCtx, cancel := context.WithTimeout(ctx, redisDialTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if client.tlsConfig != nil {
+		conn, err = (&tls.Dialer{Config: client.tlsConfig}).DialContext(dialCtx, "tcp", client.addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(dialCtx, "tcp", client.addr)
+	}
+	if err != nil {
+		return err
+	}
+	client.conn = conn
+	client.r = bufio.NewReader(conn)
+	client.setDeadline(ctx)
+	if client.password != "" {
+		if _, err = client.roundTrip("AUTH", client.password); err != nil {
+			client.drop()
+			return err
+		}
+	}
+	if client.db != 0 {
+		if _, err = client.roundTrip("SELECT", strconv.Itoa(client.db)); err != nil {
+			client.drop()
+			return err
+		}
+	}
+	return nil
+}
+
+// setDeadline bounds what's sent and read on the connection by redisCommandTimeout, or ctx's deadline if it's sooner
+func (client *RedisClient) setDeadline(ctx context.Context) {
+	deadline := time.Now().Add(redisCommandTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	client.conn.SetDeadline(deadline)
+}
+
+func (client *RedisClient) drop() {
+	client.conn.Close()
+	client.conn = nil
+}
+
+// Do sends a command and returns its reply, reconnecting first if the connection was lost. The reply is a string,
+// an int64, a []byte, nil or an []interface{} of them
+func (client *RedisClient) Do(args ...string) (interface{}, error) {
+	return client.DoContext(context.Background(), args...)
+}
+
+// DoContext is Do that gives up once ctx is done, including while waiting for its turn
+func (client *RedisClient) DoContext(ctx context.Context, args ...string) (interface{}, error) {
+	if err := client.take(ctx); err != nil {
+		return nil, err
+	}
+	defer client.give()
+	if client.conn == nil {
+		if err := client.connect(ctx); err != nil {
+			return nil, err
+		}
+	}
+	client.setDeadline(ctx)
+	reply, err := client.roundTrip(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		client.drop()
+	}
+	return reply, err
+}
+
+// Transact runs commands in a MULTI transaction
+func (client *RedisClient) Transact(cmds ...[]string) error {
+	return client.TransactContext(context.Background(), cmds...)
+}
+
+// TransactContext is Transact that gives up once ctx is done, including while waiting for its turn
+func (client *RedisClient) TransactContext(ctx context.Context, cmds ...[]string) error {
+	if err := client.take(ctx); err != nil {
+		return err
+	}
+	defer client.give()
+	if client.conn == nil {
+		if err := client.connect(ctx); err != nil {
+			return err
+		}
+	}
+	client.setDeadline(ctx)
+	err := func() error {
+		if _, err := client.roundTrip("MULTI"); err != nil {
+			return err
+		}
+		for _, cmd := range cmds {
+			if _, err := client.roundTrip(cmd...); err != nil {
+				client.roundTrip("DISCARD")
+				return err
+			}
+		}
+		reply, err := client.roundTrip("EXEC")
+		if err != nil {
+			return err
+		}
+		results, _ := reply.([]interface{})
+		for _, result := range results {
+			if e, ok := result.(redisError); ok {
+				return e
+			}
+		}
+		return nil
+	}()
+	if _, ok := err.(redisError); err != nil && !ok {
+		client.drop()
+	}
+	return err
+}
+
+func (client *RedisClient) Close() error {
+	client.turn <- struct{}{}
+	defer client.give()
+	if client.conn == nil {
+		return nil
+	}
+	err := client.conn.Close()
+	client.conn = nil
+	return err
+}
+
+// redisBackend keeps users in Redis
+type redisBackend struct {
+	*RedisClient
+}
+
+func openRedisBackend(u *url.URL) (*redisBackend, error) {
+	client, err := openRedis(u)
+	if err != nil {
+		return nil, err
+	}
+	return &redisBackend{client}, nil
+}
+
+func (client *RedisClient) roundTrip(args ...string) (interface{}, error) {
+	if err := writeRedisCommand(client.conn, args); err != nil {
+		return nil, err
+	}
+	return readRedisReply(client.r)
+}
+
+func writeRedisCommand(w io.Writer, args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// readRedisReply reads a reply, which is a string, an int64, a []byte, nil or an []interface{} of them. An error
+// reply is returned as a redisError, or is one in an array
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errRedisReply
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, errRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil {
+			return nil, errRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		elems := make([]interface{}, n)
+		for i := range elems {
+			elems[i], err = readRedisReply(r)
+			if e, ok := err.(redisError); ok {
+				// the rest of the array is still to be read
+				elems[i] = e
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	default:
+		return nil, errRedisReply
+	}
+}
+
+func redisUserKey(UID []byte) string {
+	return "ck:user:" + base64.StdEncoding.EncodeToString(UID)
+}
+
+// userOfHash makes a UserInfo of the reply to HGETALL, ErrUserNotFound if it's empty
+func userOfHash(UID []byte, reply interface{}) (uinfo UserInfo, err error) {
+	elems, ok := reply.([]interface{})
+	if !ok && reply != nil {
+		return uinfo, errRedisReply
+	}
+	if len(elems) == 0 {
+		return uinfo, ErrUserNotFound
+	}
+	uinfo.UID = UID
+	for i := 0; i+1 < len(elems); i += 2 {
+		field, _ := elems[i].([]byte)
+		value, _ := elems[i+1].([]byte)
+		if string(field) == "ProxyMethods" {
+			if err = json.Unmarshal(value, &uinfo.ProxyMethods); err != nil {
+				return
+			}
+			continue
+		}
+		n, _ := strconv.ParseInt(string(value), 10, 64)
+		switch string(field) {
+		case "SessionsCap":
+			uinfo.SessionsCap = int32(n)
+		case "UpRate":
+			uinfo.UpRate = n
+		case "DownRate":
+			uinfo.DownRate = n
+		case "UpCredit":
+			uinfo.UpCredit = n
+		case "DownCredit":
+			uinfo.DownCredit = n
+		case "ExpiryTime":
+			uinfo.ExpiryTime = n
+		case "MaxSourceIPs":
+			uinfo.MaxSourceIPs = int32(n)
+		}
+	}
+	return
+}
+
+func (backend *redisBackend) GetUser(UID []byte) (UserInfo, error) {
+	reply, err := backend.Do("HGETALL", redisUserKey(UID))
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return userOfHash(UID, reply)
+}
+
+func (backend *redisBackend) PutUser(uinfo UserInfo) error {
+	key := redisUserKey(uinfo.UID)
+	hset := []string{"HSET", key,
+		"SessionsCap", strconv.FormatInt(int64(uinfo.SessionsCap), 10),
+		"UpRate", strconv.FormatInt(uinfo.UpRate, 10),
+		"DownRate", strconv.FormatInt(uinfo.DownRate, 10),
+		"UpCredit", strconv.FormatInt(uinfo.UpCredit, 10),
+		"DownCredit", strconv.FormatInt(uinfo.DownCredit, 10),
+		"ExpiryTime", strconv.FormatInt(uinfo.ExpiryTime, 10),
+		"MaxSourceIPs", strconv.FormatInt(int64(uinfo.MaxSourceIPs), 10),
+	}
+	proxyMethods := []string{"HDEL", key, "ProxyMethods"}
+	if len(uinfo.ProxyMethods) != 0 {
+		raw, err := json.Marshal(uinfo.ProxyMethods)
+		if err != nil {
+			return err
+		}
+		proxyMethods = []string{"HSET", key, "ProxyMethods", string(raw)}
+	}
+	sadd := []string{"SADD", redisUsersKey, base64.StdEncoding.EncodeToString(uinfo.UID)}
+	return backend.Transact(hset, proxyMethods, sadd)
+}
+
+func (backend *redisBackend) DeleteUser(UID []byte) error {
+	return backend.Transact(
+		[]string{"DEL", redisUserKey(UID)},
+		[]string{"SREM", redisUsersKey, base64.StdEncoding.EncodeToString(UID)},
+	)
+}
+
+func (backend *redisBackend) ListUsers() ([]UserInfo, error) {
+	reply, err := backend.Do("SMEMBERS", redisUsersKey)
+	if err != nil {
+		return nil, err
+	}
+	members, _ := reply.([]interface{})
+	var infos []UserInfo
+	for _, member := range members {
+		b64UID, _ := member.([]byte)
+		UID, err := base64.StdEncoding.DecodeString(string(b64UID))
+		if err != nil {
+			continue
+		}
+		uinfo, err := backend.GetUser(UID)
+		if err == ErrUserNotFound {
+			// deleted since
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		infos = append(infos, uinfo)
+	}
+	return infos, nil
+}
+
+func (backend *redisBackend) ConsumeCredit(UID []byte, up, down int64) (UserInfo, error) {
+	reply, err := backend.Do("EVAL", consumeCreditScript, "1", redisUserKey(UID),
+		strconv.FormatInt(-up, 10), strconv.FormatInt(-down, 10))
+	if err != nil {
+		return UserInfo{}, err
+	}
+	return userOfHash(UID, reply)
+}
@@ -0,0 +1,316 @@
+package usermanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/test"
+)
+
+// fakeRedis serves the commands the Redis backend sends, on one connection at a time
+type fakeRedis struct {
+	m      sync.Mutex
+	hashes map[string]map[string]string
+	sets   map[string]map[string]bool
+}
+
+func startFakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startFakeRedisOn(t, l)
+}
+
+func startFakeRedisOn(t *testing.T, l net.Listener) string {
+	t.Cleanup(func() { l.Close() })
+	fake := &fakeRedis{hashes: make(map[string]map[string]string), sets: make(map[string]map[string]bool)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func (fake *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+		switch {
+		case args[0] == "MULTI":
+			inMulti = true
+			io.WriteString(conn, "+OK\r\n")
+		case args[0] == "EXEC":
+			var b bytes.Buffer
+			fmt.Fprintf(&b, "*%d\r\n", len(queued))
+			for _, cmd := range queued {
+				b.WriteString(fake.do(cmd))
+			}
+			queued, inMulti = nil, false
+			conn.Write(b.Bytes())
+		case inMulti:
+			queued = append(queued, args)
+			io.WriteString(conn, "+QUEUED\r\n")
+		default:
+			io.WriteString(conn, fake.do(args))
+		}
+	}
+}
+
+func bulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func (fake *fakeRedis) hgetall(key string) string {
+	hash := fake.hashes[key]
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	reply := fmt.Sprintf("*%d\r\n", 2*len(hash))
+	for _, field := range fields {
+		reply += bulk(field) + bulk(hash[field])
+	}
+	return reply
+}
+
+func (fake *fakeRedis) do(args []string) string {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	switch args[0] {
+	case "HGETALL":
+		return fake.hgetall(args[1])
+	case "HSET":
+		if fake.hashes[args[1]] == nil {
+			fake.hashes[args[1]] = make(map[string]string)
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			fake.hashes[args[1]][args[i]] = args[i+1]
+		}
+		return ":1\r\n"
+	case "HDEL":
+		delete(fake.hashes[args[1]], args[2])
+		return ":1\r\n"
+	case "DEL":
+		delete(fake.hashes, args[1])
+		return ":1\r\n"
+	case "SADD":
+		if fake.sets[args[1]] == nil {
+			fake.sets[args[1]] = make(map[string]bool)
+		}
+		fake.sets[args[1]][args[2]] = true
+		return ":1\r\n"
+	case "SREM":
+		delete(fake.sets[args[1]], args[2])
+		return ":1\r\n"
+	case "SMEMBERS":
+		reply := fmt.Sprintf("*%d\r\n", len(fake.sets[args[1]]))
+		for member := range fake.sets[args[1]] {
+			reply += bulk(member)
+		}
+		return reply
+	case "EVAL":
+		if args[1] != consumeCreditScript {
+			return "-ERR unknown script\r\n"
+		}
+		hash, ok := fake.hashes[args[3]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		for i, field := range []string{"UpCredit", "DownCredit"} {
+			n, _ := strconv.ParseInt(hash[field], 10, 64)
+			by, _ := strconv.ParseInt(args[4+i], 10, 64)
+			hash[field] = strconv.FormatInt(n+by, 10)
+		}
+		return fake.hgetall(args[3])
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	for raw, expected := range map[string]interface{}{
+		"+OK\r\n":                       "OK",
+		":-12\r\n":                      int64(-12),
+		"$5\r\nhello\r\n":               []byte("hello"),
+		"$-1\r\n":                       nil,
+		"*2\r\n$1\r\na\r\n:1\r\n":       []interface{}{[]byte("a"), int64(1)},
+		"*2\r\n-ERR bad\r\n+QUEUED\r\n": []interface{}{redisError("ERR bad"), "QUEUED"},
+	} {
+		reply, err := readRedisReply(bufio.NewReader(bytes.NewBufferString(raw)))
+		if err != nil {
+			t.Errorf("%q: %v", raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(reply, expected) {
+			t.Errorf("%q: expecting %#v, got %#v", raw, expected, reply)
+		}
+	}
+
+	if _, err := readRedisReply(bufio.NewReader(bytes.NewBufferString("-ERR bad\r\n"))); err != redisError("ERR bad") {
+		t.Errorf("expecting the error reply, got %v", err)
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	addr := startFakeRedis(t)
+	backend, err := OpenBackend("redis://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	uinfo := UserInfo{
+		UID:          mockUID,
+		SessionsCap:  10,
+		UpRate:       100,
+		DownRate:     1000,
+		UpCredit:     10000,
+		DownCredit:   100000,
+		ExpiryTime:   1000000,
+		ProxyMethods: []string{"shadowsocks"},
+	}
+
+	t.Run("put and get", func(t *testing.T) {
+		if err := backend.PutUser(uinfo); err != nil {
+			t.Fatal(err)
+		}
+		got, err := backend.GetUser(mockUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, uinfo) {
+			t.Errorf("expecting %+v, got %+v", uinfo, got)
+		}
+	})
+	t.Run("clear proxy methods", func(t *testing.T) {
+		unrestricted := uinfo
+		unrestricted.ProxyMethods = nil
+		_ = backend.PutUser(unrestricted)
+		got, _ := backend.GetUser(mockUID)
+		if len(got.ProxyMethods) != 0 {
+			t.Errorf("proxy methods %v left", got.ProxyMethods)
+		}
+	})
+	t.Run("consume credit", func(t *testing.T) {
+		got, err := backend.ConsumeCredit(mockUID, 10, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.UpCredit != uinfo.UpCredit-10 || got.DownCredit != uinfo.DownCredit-20 {
+			t.Errorf("unexpected credits %v and %v", got.UpCredit, got.DownCredit)
+		}
+		if _, err := backend.ConsumeCredit(make([]byte, 16), 10, 20); err != ErrUserNotFound {
+			t.Errorf("expecting error %v, got %v", ErrUserNotFound, err)
+		}
+	})
+	t.Run("list", func(t *testing.T) {
+		infos, err := backend.ListUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || !bytes.Equal(infos[0].UID, mockUID) {
+			t.Errorf("unexpected users %+v", infos)
+		}
+	})
+	t.Run("delete", func(t *testing.T) {
+		if err := backend.DeleteUser(mockUID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := backend.GetUser(mockUID); err != ErrUserNotFound {
+			t.Errorf("expecting error %v, got %v", ErrUserNotFound, err)
+		}
+		if infos, _ := backend.ListUsers(); len(infos) != 0 {
+			t.Errorf("deleted user listed: %+v", infos)
+		}
+	})
+	t.Run("reconnect", func(t *testing.T) {
+		rb := backend.(*redisBackend)
+		rb.turn <- struct{}{}
+		rb.conn.Close()
+		rb.give()
+		// the first command finds the connection closed
+		backend.GetUser(mockUID)
+		if _, err := backend.GetUser(mockUID); err != ErrUserNotFound {
+			t.Errorf("expecting error %v after reconnecting, got %v", ErrUserNotFound, err)
+		}
+	})
+}
+
+func TestRedisClient_Timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// a Redis that takes connections and never answers
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client, err := OpenRedis("redis://" + l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = client.DoContext(ctx, "GET", "key"); err == nil {
+		t.Fatal("expecting an error from a Redis that doesn't answer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the command took %v to give up", elapsed)
+	}
+	if client.conn != nil {
+		t.Error("the connection that timed out isn't dropped")
+	}
+}
+
+func TestRedisClient_TLS(t *testing.T) {
+	cert, pool := test.SelfSignedCert(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startFakeRedisOn(t, l)
+
+	if _, err = OpenRedis("rediss://" + addr); err == nil {
+		t.Error("expecting an error from a Redis whose certificate isn't trusted")
+	}
+	client := &RedisClient{addr: addr, turn: make(chan struct{}, 1), tlsConfig: &tls.Config{ServerName: "www.example.com", RootCAs: pool}}
+	defer client.Close()
+	if reply, err := client.Do("SMEMBERS", redisUsersKey); err != nil || !reflect.DeepEqual(reply, []interface{}{}) {
+		t.Errorf("unexpected reply %#v over TLS, error %v", reply, err)
+	}
+}
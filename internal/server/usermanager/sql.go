@@ -0,0 +1,284 @@
+package usermanager
+
+// The SQL backend keeps the users in the table ck_users of a PostgreSQL, MySQL or SQLite database. It goes through
+// database/sql, so the driver of the database has to be linked into ck-server, which it is when built with the
+// postgres, mysql or sqlite tag.
+//
+// The schema is changed through sqlMigrations, which are applied in order to a database that doesn't have them yet.
+// Each one applied is recorded in ck_schema_migrations, so a migration must never be changed once it's released;
+// a new one is added to the end instead.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// sqlDialect is how the SQL of a kind of database differs from the others
+type sqlDialect struct {
+	driver string
+	// the type of uid
+	blob string
+	// whether UPDATE can have RETURNING
+	returning bool
+	// whether placeholders are numbered as $1, $2 and so on rather than all being ?
+	numbered bool
+	// whether an upsert is INSERT ... ON DUPLICATE KEY UPDATE rather than INSERT ... ON CONFLICT
+	onDuplicateKey bool
+}
+
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {driver: "postgres", blob: "bytea", returning: true, numbered: true},
+	"mysql":    {driver: "mysql", blob: "VARBINARY(16)", onDuplicateKey: true},
+	"sqlite":   {driver: "sqlite", blob: "BLOB", returning: true},
+}
+
+// placeholders returns the placeholders of n arguments
+func (d sqlDialect) placeholders(n int) []string {
+	ret := make([]string, n)
+	for i := range ret {
+		if d.numbered {
+			ret[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			ret[i] = "?"
+		}
+	}
+	return ret
+}
+
+// upsert returns an INSERT of all of ck_users' columns that updates the row if the uid is already there
+func (d sqlDialect) upsert() string {
+	var updates []string
+	for _, column := range sqlColumns[1:] {
+		if d.onDuplicateKey {
+			updates = append(updates, fmt.Sprintf("%v = VALUES(%v)", column, column))
+		} else {
+			updates = append(updates, fmt.Sprintf("%v = excluded.%v", column, column))
+		}
+	}
+	query := fmt.Sprintf("INSERT INTO ck_users (%v) VALUES (%v) ", strings.Join(sqlColumns, ", "),
+		strings.Join(d.placeholders(len(sqlColumns)), ", "))
+	if d.onDuplicateKey {
+		return query + "ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	}
+	return query + "ON CONFLICT (uid) DO UPDATE SET " + strings.Join(updates, ", ")
+}
+
+var sqlColumns = []string{"uid", "sessions_cap", "up_rate", "down_rate", "up_credit", "down_credit", "expiry_time", "proxy_methods",
+	"max_source_ips"}
+
+var sqlColumnList = strings.Join(sqlColumns, ", ")
+
+var sqlMigrations = []func(d sqlDialect) string{
+	func(d sqlDialect) string {
+		return `CREATE TABLE IF NOT EXISTS ck_users (
+	uid ` + d.blob + ` PRIMARY KEY,
+	sessions_cap integer NOT NULL,
+	up_rate bigint NOT NULL,
+	down_rate bigint NOT NULL,
+	up_credit bigint NOT NULL,
+	down_credit bigint NOT NULL,
+	expiry_time bigint NOT NULL,
+	proxy_methods varchar(4096) NOT NULL DEFAULT ''
+)`
+	},
+	func(d sqlDialect) string {
+		return "ALTER TABLE ck_users ADD COLUMN max_source_ips integer NOT NULL DEFAULT 0"
+	},
+}
+
+type sqlBackend struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+// SQLitePath returns the file of a DatabaseURL of SQLite, or empty if it isn't of SQLite
+func SQLitePath(databaseURL string) string {
+	u, err := url.Parse(databaseURL)
+	if err != nil || (u.Scheme != "sqlite" && u.Scheme != "sqlite3") {
+		return ""
+	}
+	_, path, _ := sqlDataSource(u)
+	return path
+}
+
+// sqlDataSource returns the dialect of a DatabaseURL and what its driver is to open
+func sqlDataSource(u *url.URL) (sqlDialect, string, error) {
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		return sqlDialects["postgres"], u.String(), nil
+	case "mysql":
+		// the driver takes user:password@tcp(host:port)/database
+		dsn := ""
+		if u.User != nil {
+			dsn = u.User.String() + "@"
+		}
+		dsn += fmt.Sprintf("tcp(%v)%v", u.Host, u.Path)
+		if u.RawQuery != "" {
+			dsn += "?" + u.RawQuery
+		}
+		return sqlDialects["mysql"], dsn, nil
+	case "sqlite", "sqlite3":
+		// sqlite:path/to/file relative to the working directory, or sqlite:///path/to/file
+		path := u.Opaque
+		if path == "" {
+			path = u.Host + u.Path
+		}
+		if path == "" {
+			return sqlDialect{}, "", fmt.Errorf("no path in %v", u.Redacted())
+		}
+		return sqlDialects["sqlite"], path, nil
+	default:
+		return sqlDialect{}, "", fmt.Errorf("unknown user database %v", u.Scheme)
+	}
+}
+
+func openSQLBackend(u *url.URL) (*sqlBackend, error) {
+	dialect, dsn, err := sqlDataSource(u)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(dialect.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the user database: %v", err)
+	}
+	backend := &sqlBackend{db: db, dialect: dialect}
+	if err = backend.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate the user database: %v", err)
+	}
+	return backend, nil
+}
+
+// migrate applies the migrations the database doesn't have yet
+func (backend *sqlBackend) migrate() error {
+	_, err := backend.db.Exec("CREATE TABLE IF NOT EXISTS ck_schema_migrations (version integer PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	var version sql.NullInt64
+	if err = backend.db.QueryRow("SELECT MAX(version) FROM ck_schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	for i := int(version.Int64); i < len(sqlMigrations); i++ {
+		tx, err := backend.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqlMigrations[i](backend.dialect)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %v: %v", i+1, err)
+		}
+		insert := "INSERT INTO ck_schema_migrations (version) VALUES (" + backend.dialect.placeholders(1)[0] + ")"
+		if _, err = tx.Exec(insert, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// where returns " WHERE uid = " and the placeholder of the argument after n others
+func (backend *sqlBackend) where(n int) string {
+	return " WHERE uid = " + backend.dialect.placeholders(n + 1)[n]
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanUser(row rowScanner) (uinfo UserInfo, err error) {
+	var proxyMethods string
+	err = row.Scan(&uinfo.UID, &uinfo.SessionsCap, &uinfo.UpRate, &uinfo.DownRate, &uinfo.UpCredit, &uinfo.DownCredit,
+		&uinfo.ExpiryTime, &proxyMethods, &uinfo.MaxSourceIPs)
+	if err == sql.ErrNoRows {
+		return uinfo, ErrUserNotFound
+	} else if err != nil {
+		return
+	}
+	if proxyMethods != "" {
+		err = json.Unmarshal([]byte(proxyMethods), &uinfo.ProxyMethods)
+	}
+	return
+}
+
+func (backend *sqlBackend) GetUser(UID []byte) (UserInfo, error) {
+	row := backend.db.QueryRow("SELECT "+sqlColumnList+" FROM ck_users"+backend.where(0), UID)
+	return scanUser(row)
+}
+
+func (backend *sqlBackend) PutUser(uinfo UserInfo) error {
+	var proxyMethods string
+	if len(uinfo.ProxyMethods) != 0 {
+		raw, err := json.Marshal(uinfo.ProxyMethods)
+		if err != nil {
+			return err
+		}
+		proxyMethods = string(raw)
+	}
+	_, err := backend.db.Exec(backend.dialect.upsert(), uinfo.UID, uinfo.SessionsCap, uinfo.UpRate, uinfo.DownRate,
+		uinfo.UpCredit, uinfo.DownCredit, uinfo.ExpiryTime, proxyMethods, uinfo.MaxSourceIPs)
+	return err
+}
+
+func (backend *sqlBackend) DeleteUser(UID []byte) error {
+	_, err := backend.db.Exec("DELETE FROM ck_users"+backend.where(0), UID)
+	return err
+}
+
+func (backend *sqlBackend) ListUsers() ([]UserInfo, error) {
+	rows, err := backend.db.Query("SELECT " + sqlColumnList + " FROM ck_users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var infos []UserInfo
+	for rows.Next() {
+		uinfo, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, uinfo)
+	}
+	return infos, rows.Err()
+}
+
+// ConsumeCredit takes the usage off in a single UPDATE, which is atomic however many ck-servers share the table.
+// Without RETURNING, the row is locked by a SELECT ... FOR UPDATE in the same transaction instead
+func (backend *sqlBackend) ConsumeCredit(UID []byte, up, down int64) (UserInfo, error) {
+	p := backend.dialect.placeholders(2)
+	update := "UPDATE ck_users SET up_credit = up_credit - " + p[0] + ", down_credit = down_credit - " + p[1] +
+		backend.where(2)
+	if backend.dialect.returning {
+		row := backend.db.QueryRow(update+" RETURNING "+sqlColumnList, up, down, UID)
+		return scanUser(row)
+	}
+
+	tx, err := backend.db.Begin()
+	if err != nil {
+		return UserInfo{}, err
+	}
+	defer tx.Rollback()
+	uinfo, err := scanUser(tx.QueryRow("SELECT "+sqlColumnList+" FROM ck_users"+backend.where(0)+" FOR UPDATE", UID))
+	if err != nil {
+		return UserInfo{}, err
+	}
+	if _, err = tx.Exec(update, up, down, UID); err != nil {
+		return UserInfo{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return UserInfo{}, err
+	}
+	uinfo.UpCredit -= up
+	uinfo.DownCredit -= down
+	return uinfo, nil
+}
+
+func (backend *sqlBackend) Close() error {
+	return backend.db.Close()
+}
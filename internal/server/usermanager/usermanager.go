@@ -22,6 +22,10 @@ type UserInfo struct {
 	UpCredit    int64
 	DownCredit  int64
 	ExpiryTime  int64
+	// the ProxyBook entries the user's sessions can be for, any of them if it's empty
+	ProxyMethods []string
+	// how many IP addresses the user's sessions can be from at once, any number if it's 0
+	MaxSourceIPs int32
 }
 
 type StatusResponse struct {
@@ -32,6 +36,26 @@ type StatusResponse struct {
 
 type AuthorisationInfo struct {
 	NumExistingSessions int
+	// the ProxyMethod the new session is for
+	ProxyMethod string
+	// the IP address the new session is from
+	SourceIP string
+	// the IP addresses the existing sessions are from, each once
+	ExistingSourceIPs []string
+}
+
+// sourceIPsCapReached is whether a new session of ainfo would make the sessions of a user come from more than
+// maxSourceIPs addresses
+func sourceIPsCapReached(maxSourceIPs int32, ainfo AuthorisationInfo) bool {
+	if maxSourceIPs <= 0 {
+		return false
+	}
+	for _, ip := range ainfo.ExistingSourceIPs {
+		if ip == ainfo.SourceIP {
+			return false
+		}
+	}
+	return len(ainfo.ExistingSourceIPs) >= int(maxSourceIPs)
 }
 
 const (
@@ -40,10 +64,12 @@ const (
 
 var ErrUserNotFound = errors.New("UID does not correspond to a user")
 var ErrSessionsCapReached = errors.New("Sessions cap has reached")
+var ErrSourceIPsCapReached = errors.New("Source IPs cap has reached")
 
 var ErrNoUpCredit = errors.New("No upload credit left")
 var ErrNoDownCredit = errors.New("No download credit left")
 var ErrUserExpired = errors.New("User has expired")
+var ErrProxyMethodNotAllowed = errors.New("User isn't allowed to use this proxy method")
 
 type UserManager interface {
 	AuthenticateUser([]byte) (int64, int64, error)
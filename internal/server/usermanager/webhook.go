@@ -0,0 +1,277 @@
+package usermanager
+
+// With an auth webhook, the users aren't kept by Cloak at all. The server asks the webhook about a user when the
+// user makes a handshake, and takes its answer, which is whether the user is allowed and what quota it has, for
+// the cache TTL. The usage of users is reported to the webhook as it's uploaded, and its answer to that is taken
+// as the user's new quota, so that an existing billing system can be the one that keeps track of credit.
+//
+// The webhook is sent a webhookRequest in a POST and answers with a webhookResponse, both in JSON.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+const (
+	WEBHOOK_EVENT_HANDSHAKE = "handshake"
+	WEBHOOK_EVENT_USAGE     = "usage"
+)
+
+const webhookTimeout = 5 * time.Second
+
+var ErrDeniedByWebhook = errors.New("User is denied by the auth webhook")
+var ErrManagedByWebhook = errors.New("Users are managed by the auth webhook")
+var errWebhookClosed = errors.New("auth webhook manager has been closed")
+
+// HandshakeInfo is what's known of the connection a user makes a handshake on
+type HandshakeInfo struct {
+	// the SNI of the ClientHello, or the Host of the HTTP request
+	SNI         string
+	Transport   string
+	ProxyMethod string
+}
+
+// HandshakeAuthenticator is a UserManager that has a say in whether a user is allowed to make a handshake by what
+// the handshake is, before it's authenticated
+type HandshakeAuthenticator interface {
+	AuthenticateHandshake(UID []byte, hinfo HandshakeInfo) error
+}
+
+type webhookRequest struct {
+	Event string
+	UID   []byte
+	HandshakeInfo
+	// the usage being reported in a WEBHOOK_EVENT_USAGE
+	UpUsage   int64 `json:",omitempty"`
+	DownUsage int64 `json:",omitempty"`
+}
+
+type webhookResponse struct {
+	Allow bool
+	// why the user isn't allowed
+	Message string
+	UserInfo
+}
+
+type webhookUser struct {
+	allowed bool
+	message string
+	uinfo   UserInfo
+	hinfo   HandshakeInfo
+	fetched time.Time
+}
+
+// webhookBackend is a Backend of the users the webhook has been asked about
+type webhookBackend struct {
+	url string
+	// nil if there's none
+	token  *common.Secret
+	ttl    time.Duration
+	world  common.WorldState
+	client *http.Client
+
+	usersM sync.Mutex
+	users  map[[16]byte]*webhookUser
+}
+
+type webhookManager struct {
+	*backendManager
+	webhook *webhookBackend
+}
+
+// MakeWebhookManager makes a UserManager that asks url about users, with token as a bearer token if it isn't
+// empty, and takes the answers for ttl
+func MakeWebhookManager(url string, token string, ttl time.Duration, worldState common.WorldState) *webhookManager {
+	webhook := &webhookBackend{
+		url:    url,
+		ttl:    ttl,
+		world:  worldState,
+		client: &http.Client{Timeout: webhookTimeout},
+		users:  make(map[[16]byte]*webhookUser),
+	}
+	if token != "" {
+		webhook.token = common.NewSecret([]byte(token))
+	}
+	return &webhookManager{
+		backendManager: MakeBackendManager(webhook, worldState),
+		webhook:        webhook,
+	}
+}
+
+// AuthenticateHandshake asks the webhook about the user, unless it has been asked about the same handshake within
+// the TTL
+func (manager *webhookManager) AuthenticateHandshake(UID []byte, hinfo HandshakeInfo) error {
+	cached, ok := manager.webhook.cached(UID)
+	var user webhookUser
+	if ok && cached.hinfo == hinfo && manager.webhook.fresh(cached) {
+		user = cached
+	} else {
+		var err error
+		user, err = manager.webhook.ask(webhookRequest{Event: WEBHOOK_EVENT_HANDSHAKE, UID: UID, HandshakeInfo: hinfo})
+		if err != nil {
+			return err
+		}
+	}
+	if !user.allowed {
+		return user.denial()
+	}
+	return nil
+}
+
+// cached returns a copy of what the webhook last said of a user
+func (webhook *webhookBackend) cached(UID []byte) (webhookUser, bool) {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	webhook.usersM.Lock()
+	defer webhook.usersM.Unlock()
+	user, ok := webhook.users[arrUID]
+	if !ok {
+		return webhookUser{}, false
+	}
+	return *user, true
+}
+
+func (webhook *webhookBackend) fresh(user webhookUser) bool {
+	return webhook.world.Now().Sub(user.fetched) < webhook.ttl
+}
+
+func (user webhookUser) denial() error {
+	if user.message == "" {
+		return ErrDeniedByWebhook
+	}
+	return fmt.Errorf("%w: %v", ErrDeniedByWebhook, user.message)
+}
+
+// ask sends a request to the webhook and caches the user it answers with
+func (webhook *webhookBackend) ask(request webhookRequest) (webhookUser, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return webhookUser{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.url, bytes.NewReader(body))
+	if err != nil {
+		return webhookUser{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if webhook.token != nil {
+		if !webhook.token.Use(func(token []byte) { req.Header.Set("Authorization", "Bearer "+string(token)) }) {
+			return webhookUser{}, errWebhookClosed
+		}
+	}
+	resp, err := webhook.client.Do(req)
+	if err != nil {
+		return webhookUser{}, fmt.Errorf("failed to ask the auth webhook: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return webhookUser{}, fmt.Errorf("auth webhook answered %v", resp.Status)
+	}
+	var answer webhookResponse
+	if err = json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return webhookUser{}, fmt.Errorf("bad answer from the auth webhook: %v", err)
+	}
+
+	answer.UserInfo.UID = request.UID
+	user := webhookUser{
+		allowed: answer.Allow,
+		message: answer.Message,
+		uinfo:   answer.UserInfo,
+		hinfo:   request.HandshakeInfo,
+		fetched: webhook.world.Now(),
+	}
+	var arrUID [16]byte
+	copy(arrUID[:], request.UID)
+	webhook.usersM.Lock()
+	if cached, ok := webhook.users[arrUID]; ok && request.Event == WEBHOOK_EVENT_USAGE {
+		// a usage report doesn't say what the handshake was
+		user.hinfo = cached.hinfo
+	}
+	webhook.users[arrUID] = &user
+	webhook.usersM.Unlock()
+	return user, nil
+}
+
+// GetUser returns the user as the webhook last said, asking it again if that's older than the TTL
+func (webhook *webhookBackend) GetUser(UID []byte) (UserInfo, error) {
+	user, ok := webhook.cached(UID)
+	if !ok || !webhook.fresh(user) {
+		var hinfo HandshakeInfo
+		if ok {
+			hinfo = user.hinfo
+		}
+		var err error
+		user, err = webhook.ask(webhookRequest{Event: WEBHOOK_EVENT_HANDSHAKE, UID: UID, HandshakeInfo: hinfo})
+		if err != nil {
+			return UserInfo{}, err
+		}
+	}
+	if !user.allowed {
+		return UserInfo{}, user.denial()
+	}
+	return user.uinfo, nil
+}
+
+func (webhook *webhookBackend) PutUser(UserInfo) error {
+	return ErrManagedByWebhook
+}
+
+// DeleteUser forgets what the webhook said of the user, so that it's asked again
+func (webhook *webhookBackend) DeleteUser(UID []byte) error {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	webhook.usersM.Lock()
+	delete(webhook.users, arrUID)
+	webhook.usersM.Unlock()
+	return nil
+}
+
+// ListUsers lists the allowed users the webhook has been asked about
+func (webhook *webhookBackend) ListUsers() ([]UserInfo, error) {
+	webhook.usersM.Lock()
+	defer webhook.usersM.Unlock()
+	var infos []UserInfo
+	for _, user := range webhook.users {
+		if user.allowed {
+			infos = append(infos, user.uinfo)
+		}
+	}
+	return infos, nil
+}
+
+// ConsumeCredit reports the usage to the webhook and takes its answer as the user's quota. If the webhook can't be
+// reached, the usage is taken off what it last said
+func (webhook *webhookBackend) ConsumeCredit(UID []byte, up, down int64) (UserInfo, error) {
+	user, err := webhook.ask(webhookRequest{Event: WEBHOOK_EVENT_USAGE, UID: UID, UpUsage: up, DownUsage: down})
+	if err == nil {
+		if !user.allowed {
+			return UserInfo{}, user.denial()
+		}
+		return user.uinfo, nil
+	}
+
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	webhook.usersM.Lock()
+	defer webhook.usersM.Unlock()
+	cached, ok := webhook.users[arrUID]
+	if !ok {
+		return UserInfo{}, err
+	}
+	cached.uinfo.UpCredit -= up
+	cached.uinfo.DownCredit -= down
+	return cached.uinfo, nil
+}
+
+func (webhook *webhookBackend) Close() error {
+	if webhook.token != nil {
+		webhook.token.Wipe()
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package usermanager
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+)
+
+// fakeWebhook allows the users with credit, and takes off the usage reported to it
+type fakeWebhook struct {
+	m        sync.Mutex
+	requests []webhookRequest
+	credit   int64
+}
+
+func (fake *fakeWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	fake.requests = append(fake.requests, req)
+	fake.credit -= req.UpUsage + req.DownUsage
+	resp := webhookResponse{Allow: fake.credit > 0, UserInfo: UserInfo{
+		SessionsCap: 2,
+		UpRate:      100,
+		DownRate:    1000,
+		UpCredit:    fake.credit,
+		DownCredit:  fake.credit,
+		ExpiryTime:  1000000,
+	}}
+	if req.SNI == "banned.com" {
+		resp = webhookResponse{Allow: false, Message: "banned"}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (fake *fakeWebhook) numRequests() int {
+	fake.m.Lock()
+	defer fake.m.Unlock()
+	return len(fake.requests)
+}
+
+func TestWebhookManager(t *testing.T) {
+	fake := &fakeWebhook{credit: 10000}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	var now int64 = 1000
+	var nowM sync.Mutex
+	worldState := common.WorldState{Rand: mockWorldState.Rand, Now: func() time.Time {
+		nowM.Lock()
+		defer nowM.Unlock()
+		return time.Unix(now, 0)
+	}}
+	mgr := MakeWebhookManager(server.URL, "token", time.Minute, worldState)
+	hinfo := HandshakeInfo{SNI: "example.com", Transport: "TLS", ProxyMethod: "shadowsocks"}
+
+	t.Run("handshake", func(t *testing.T) {
+		if err := mgr.AuthenticateHandshake(mockUID, hinfo); err != nil {
+			t.Fatal(err)
+		}
+		upRate, downRate, err := mgr.AuthenticateUser(mockUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upRate != 100 || downRate != 1000 {
+			t.Errorf("wrong rates %v and %v", upRate, downRate)
+		}
+		if err = mgr.AuthoriseNewSession(mockUID, AuthorisationInfo{NumExistingSessions: 2}); err != ErrSessionsCapReached {
+			t.Errorf("expecting error %v, got %v", ErrSessionsCapReached, err)
+		}
+		if fake.numRequests() != 1 {
+			t.Errorf("expecting the webhook to be asked once, it's been asked %v times", fake.numRequests())
+		}
+		if req := fake.requests[0]; req.Event != WEBHOOK_EVENT_HANDSHAKE || req.HandshakeInfo != hinfo {
+			t.Errorf("unexpected request %+v", req)
+		}
+	})
+	t.Run("cached", func(t *testing.T) {
+		_ = mgr.AuthenticateHandshake(mockUID, hinfo)
+		if fake.numRequests() != 1 {
+			t.Error("webhook asked again within the TTL")
+		}
+		nowM.Lock()
+		now += 60
+		nowM.Unlock()
+		_ = mgr.AuthenticateHandshake(mockUID, hinfo)
+		if fake.numRequests() != 2 {
+			t.Error("webhook not asked again after the TTL")
+		}
+	})
+	t.Run("denied", func(t *testing.T) {
+		banned := hinfo
+		banned.SNI = "banned.com"
+		err := mgr.AuthenticateHandshake(mockUID, banned)
+		if !errors.Is(err, ErrDeniedByWebhook) {
+			t.Fatalf("expecting error %v, got %v", ErrDeniedByWebhook, err)
+		}
+		if _, _, err := mgr.AuthenticateUser(mockUID); !errors.Is(err, ErrDeniedByWebhook) {
+			t.Errorf("denied user authenticated: %v", err)
+		}
+		_ = mgr.AuthenticateHandshake(mockUID, hinfo)
+	})
+	t.Run("usage", func(t *testing.T) {
+		responses, err := mgr.UploadStatus([]StatusUpdate{{UID: mockUID, Active: true, UpUsage: 1000, DownUsage: 2000}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(responses) != 0 {
+			t.Errorf("unexpected responses %v", responses)
+		}
+		uinfo, _ := mgr.GetUserInfo(mockUID)
+		if uinfo.UpCredit != 7000 {
+			t.Errorf("expecting the webhook's 7000 of credit, got %v", uinfo.UpCredit)
+		}
+
+		responses, _ = mgr.UploadStatus([]StatusUpdate{{UID: mockUID, Active: true, DownUsage: 7000}})
+		if len(responses) != 1 || responses[0].Action != TERMINATE {
+			t.Errorf("user without credit not terminated: %v", responses)
+		}
+	})
+	t.Run("webhook down", func(t *testing.T) {
+		fake.m.Lock()
+		fake.credit = 10000
+		fake.m.Unlock()
+		_ = mgr.DeleteUser(mockUID)
+		nowM.Lock()
+		now += 60
+		nowM.Unlock()
+		if err := mgr.AuthenticateHandshake(mockUID, hinfo); err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		uinfo, err := mgr.webhook.ConsumeCredit(mockUID, 100, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uinfo.UpCredit != 9900 {
+			t.Errorf("expecting the usage taken off the last answer, got %v", uinfo.UpCredit)
+		}
+	})
+	t.Run("users can't be written", func(t *testing.T) {
+		if err := mgr.WriteUserInfo(UserInfo{UID: mockUID}); err != ErrManagedByWebhook {
+			t.Errorf("expecting error %v, got %v", ErrManagedByWebhook, err)
+		}
+	})
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/base64"
+	"fmt"
+	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"sync"
 	"sync/atomic"
@@ -12,27 +14,54 @@ import (
 )
 
 const defaultUploadInterval = 1 * time.Minute
+const defaultRateBurst = 1 * time.Second
+
+// how often users are checked for having expired or run out of credit between uploads
+const enforceInterval = 1 * time.Second
 
 // userPanel is used to authenticate new users and book keep active users
 type userPanel struct {
 	Manager usermanager.UserManager
+	// the time ExpiryTime is compared with
+	world common.WorldState
 
 	activeUsersM      sync.RWMutex
 	activeUsers       map[[16]byte]*ActiveUser
 	usageUpdateQueueM sync.Mutex
 	usageUpdateQueue  map[[16]byte]*usagePair
+	// traffic of each user since starting, excluding what's still accumulated in their valves
+	trafficM sync.Mutex
+	traffic  map[[16]byte]userTraffic
 
 	uploadInterval time.Duration
+	// how much of a user's traffic at its rates can go through at once before being throttled
+	rateBurst time.Duration
+	// users with less than this much of either credit left are warned on their control streams, never if negative
+	lowCreditWarning int64
+	// how often the credit of a user with a control stream open is checked for being low
+	lowCreditCheckInterval time.Duration
+	// told of the credit of each user whenever it's read, if set
+	observe func(UserActivity)
+	// given the usage of users each time it's uploaded, if set
+	exportUsage func([]usermanager.StatusUpdate)
+	// where the sessions of users are shared with other nodes, nil if they aren't
+	cluster *clusterRegistry
 }
 
-func MakeUserPanel(manager usermanager.UserManager) *userPanel {
+func MakeUserPanel(manager usermanager.UserManager, worldState common.WorldState) *userPanel {
 	ret := &userPanel{
-		Manager:          manager,
-		activeUsers:      make(map[[16]byte]*ActiveUser),
-		usageUpdateQueue: make(map[[16]byte]*usagePair),
-		uploadInterval:   defaultUploadInterval,
+		Manager:                manager,
+		world:                  worldState,
+		activeUsers:            make(map[[16]byte]*ActiveUser),
+		usageUpdateQueue:       make(map[[16]byte]*usagePair),
+		traffic:                make(map[[16]byte]userTraffic),
+		uploadInterval:         defaultUploadInterval,
+		rateBurst:              defaultRateBurst,
+		lowCreditWarning:       defaultLowCreditWarning,
+		lowCreditCheckInterval: defaultLowCreditCheckInterval,
 	}
 	go ret.regularQueueUpload()
+	go ret.regularEnforce()
 	return ret
 }
 
@@ -46,16 +75,32 @@ func (panel *userPanel) GetBypassUser(UID []byte) (*ActiveUser, error) {
 		return user, nil
 	}
 	user := &ActiveUser{
-		panel:    panel,
-		valve:    mux.UNLIMITED_VALVE,
-		sessions: make(map[uint32]*mux.Session),
-		bypass:   true,
+		panel:          panel,
+		valve:          mux.UNLIMITED_VALVE,
+		sessions:       make(map[uint32]*mux.Session),
+		sessionIPs:     make(map[uint32]string),
+		sessionDetails: make(map[uint32]sessionDetail),
+		bypass:         true,
 	}
 	copy(user.arrUID[:], UID)
 	panel.activeUsers[user.arrUID] = user
 	return user, nil
 }
 
+// authenticateHandshake lets a UserManager that authenticates handshakes have a say in whether the user of one
+// is allowed
+func (panel *userPanel) authenticateHandshake(ci ClientInfo) error {
+	authenticator, ok := panel.Manager.(usermanager.HandshakeAuthenticator)
+	if !ok {
+		return nil
+	}
+	return authenticator.AuthenticateHandshake(ci.UID, usermanager.HandshakeInfo{
+		SNI:         ci.SNI,
+		Transport:   fmt.Sprint(ci.Transport),
+		ProxyMethod: ci.ProxyMethod,
+	})
+}
+
 // GetUser retrieves the reference to an ActiveUser if it's already active, or creates a new ActiveUser of specified
 // UID with UserInfo queried from the UserManger, should the particular UID is allowed to connect
 func (panel *userPanel) GetUser(UID []byte) (*ActiveUser, error) {
@@ -71,14 +116,17 @@ func (panel *userPanel) GetUser(UID []byte) (*ActiveUser, error) {
 	if err != nil {
 		return nil, err
 	}
-	valve := mux.MakeValve(upRate, downRate)
+	valve := mux.MakeValveWithBurst(upRate, downRate, panel.rateBurst)
 	user := &ActiveUser{
-		panel:    panel,
-		valve:    valve,
-		sessions: make(map[uint32]*mux.Session),
+		panel:          panel,
+		valve:          valve,
+		sessions:       make(map[uint32]*mux.Session),
+		sessionIPs:     make(map[uint32]string),
+		sessionDetails: make(map[uint32]sessionDetail),
 	}
 
 	copy(user.arrUID[:], UID)
+	panel.refreshLimits(user)
 	panel.activeUsers[user.arrUID] = user
 	log.WithFields(log.Fields{
 		"UID": base64.StdEncoding.EncodeToString(UID),
@@ -122,7 +170,7 @@ func (panel *userPanel) updateUsageQueue() {
 			continue
 		}
 
-		upIncured, downIncured := user.valve.Nullify()
+		upIncured, downIncured := panel.takeUsage(user)
 		if usage, ok := panel.usageUpdateQueue[user.arrUID]; ok {
 			atomic.AddInt64(usage.up, upIncured)
 			atomic.AddInt64(usage.down, downIncured)
@@ -143,7 +191,7 @@ func (panel *userPanel) updateUsageQueueForOne(user *ActiveUser) {
 	if user.bypass {
 		return
 	}
-	upIncured, downIncured := user.valve.Nullify()
+	upIncured, downIncured := panel.takeUsage(user)
 	panel.usageUpdateQueueM.Lock()
 	if usage, ok := panel.usageUpdateQueue[user.arrUID]; ok {
 		atomic.AddInt64(usage.up, upIncured)
@@ -156,6 +204,157 @@ func (panel *userPanel) updateUsageQueueForOne(user *ActiveUser) {
 
 }
 
+type userTraffic struct {
+	Up   int64
+	Down int64
+}
+
+// takeUsage zeroes the accumulated usage in a user's valve and adds it to the user's traffic
+func (panel *userPanel) takeUsage(user *ActiveUser) (up, down int64) {
+	panel.trafficM.Lock()
+	up, down = user.valve.Nullify()
+	total := panel.traffic[user.arrUID]
+	total.Up += up
+	total.Down += down
+	panel.traffic[user.arrUID] = total
+	panel.trafficM.Unlock()
+	return
+}
+
+// Traffic returns the traffic of each user subject to bandwidth and credit controls since starting, including
+// what's yet to be uploaded to the UserManager. It never decreases
+func (panel *userPanel) Traffic() map[[16]byte]userTraffic {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	panel.trafficM.Lock()
+	defer panel.trafficM.Unlock()
+	ret := make(map[[16]byte]userTraffic, len(panel.traffic))
+	for arrUID, total := range panel.traffic {
+		ret[arrUID] = total
+	}
+	for arrUID, user := range panel.activeUsers {
+		if user.bypass {
+			continue
+		}
+		total := ret[arrUID]
+		total.Up += user.valve.GetRx()
+		total.Down += user.valve.GetTx()
+		ret[arrUID] = total
+	}
+	return ret
+}
+
+// numActive returns the number of active users and the number of their sessions
+func (panel *userPanel) numActive() (users int, sessions int) {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	for _, user := range panel.activeUsers {
+		sessions += user.NumSession()
+	}
+	return len(panel.activeUsers), sessions
+}
+
+// buffered returns how many bytes the sessions of all active users hold in memory together
+func (panel *userPanel) buffered() mux.BufferedBytes {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	var total mux.BufferedBytes
+	for _, user := range panel.activeUsers {
+		for _, b := range user.buffered() {
+			total.Sending += b.Sending
+			total.Retained += b.Retained
+			total.Duplicating += b.Duplicating
+			total.Receiving += b.Receiving
+		}
+	}
+	return total
+}
+
+// activeUserInfos returns the users with live sessions
+func (panel *userPanel) activeUserInfos() []ActiveUserInfo {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	infos := make([]ActiveUserInfo, 0, len(panel.activeUsers))
+	for arrUID, user := range panel.activeUsers {
+		UID := arrUID
+		infos = append(infos, ActiveUserInfo{
+			UID:        UID[:],
+			Bypass:     user.bypass,
+			SessionIDs: user.sessionIDs(),
+			SourceIPs:  user.sourceIPs(),
+			Buffered:   user.buffered(),
+		})
+	}
+	return infos
+}
+
+// sessionIPs returns the IP address each session of each user subject to credit controls was made from
+func (panel *userPanel) sessionIPs() map[[16]byte]map[uint32]string {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	ret := make(map[[16]byte]map[uint32]string, len(panel.activeUsers))
+	for arrUID, user := range panel.activeUsers {
+		if user.bypass {
+			continue
+		}
+		user.sessionsM.RLock()
+		sessionIPs := make(map[uint32]string, len(user.sessionIPs))
+		for sessionID, ip := range user.sessionIPs {
+			sessionIPs[sessionID] = ip
+		}
+		user.sessionsM.RUnlock()
+		ret[arrUID] = sessionIPs
+	}
+	return ret
+}
+
+// activeUser returns the user of UID, nil if it isn't active
+func (panel *userPanel) activeUser(UID []byte) *ActiveUser {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	return panel.activeUsers[arrUID]
+}
+
+// hasSession returns whether the user of UID is active with the session of sessionID, without making it active
+func (panel *userPanel) hasSession(UID []byte, sessionID uint32) bool {
+	user := panel.activeUser(UID)
+	return user != nil && user.hasSession(sessionID)
+}
+
+// kick terminates a user if it's active, returning whether it was
+func (panel *userPanel) kick(UID []byte, reason string) bool {
+	user := panel.activeUser(UID)
+	if user == nil {
+		return false
+	}
+	panel.TerminateActiveUser(user, reason)
+	return true
+}
+
+// drainSessions tells the clients of all active users that the server is draining
+func (panel *userPanel) drainSessions() {
+	panel.activeUsersM.RLock()
+	defer panel.activeUsersM.RUnlock()
+	for _, user := range panel.activeUsers {
+		user.drainSessions()
+	}
+}
+
+// terminateAll terminates all active users
+func (panel *userPanel) terminateAll(reason string) {
+	panel.activeUsersM.RLock()
+	users := make([]*ActiveUser, 0, len(panel.activeUsers))
+	for _, user := range panel.activeUsers {
+		users = append(users, user)
+	}
+	panel.activeUsersM.RUnlock()
+	for _, user := range users {
+		panel.TerminateActiveUser(user, reason)
+	}
+}
+
 // commitUpdate put all usageUpdates into a slice of StatusUpdate, calls Manager.UploadStatus, gets the responses
 // and act to each user according to the responses
 func (panel *userPanel) commitUpdate() error {
@@ -185,10 +384,16 @@ func (panel *userPanel) commitUpdate() error {
 	panel.usageUpdateQueue = make(map[[16]byte]*usagePair)
 	panel.usageUpdateQueueM.Unlock()
 
+	if panel.exportUsage != nil {
+		panel.exportUsage(statuses)
+	}
 	responses, err := panel.Manager.UploadStatus(statuses)
 	if err != nil {
 		return err
 	}
+	for _, status := range statuses {
+		panel.refreshUser(status.UID)
+	}
 	for _, resp := range responses {
 		var arrUID [16]byte
 		copy(arrUID[:], resp.UID)
@@ -217,3 +422,101 @@ func (panel *userPanel) regularQueueUpload() {
 		}()
 	}
 }
+
+// refreshLimits reads the credit and expiry of a user from the UserManager again, after its usage has been uploaded
+// or it has been changed
+func (panel *userPanel) refreshLimits(user *ActiveUser) {
+	if user.bypass {
+		return
+	}
+	uinfo, err := panel.Manager.GetUserInfo(user.arrUID[:])
+	if err != nil {
+		log.WithFields(log.Fields{
+			"UID":   base64.StdEncoding.EncodeToString(user.arrUID[:]),
+			"error": err,
+		}).Warn("failed to read the limits of an active user")
+		return
+	}
+	user.limits.Store(userLimits{
+		upCredit:   uinfo.UpCredit,
+		downCredit: uinfo.DownCredit,
+		expiryTime: uinfo.ExpiryTime,
+	})
+	if panel.observe != nil {
+		panel.observe(UserActivity{
+			Kind:       ACTIVITY_CREDIT,
+			UID:        user.arrUID[:],
+			Time:       panel.world.Now(),
+			UpCredit:   uinfo.UpCredit,
+			DownCredit: uinfo.DownCredit,
+		})
+	}
+}
+
+// refreshUser refreshes the limits of a user if it's active
+func (panel *userPanel) refreshUser(UID []byte) {
+	var arrUID [16]byte
+	copy(arrUID[:], UID)
+	panel.activeUsersM.RLock()
+	user := panel.activeUsers[arrUID]
+	panel.activeUsersM.RUnlock()
+	if user != nil {
+		panel.refreshLimits(user)
+	}
+}
+
+// pendingUsage is what a user has used that's yet to be uploaded to the UserManager
+func (panel *userPanel) pendingUsage(user *ActiveUser) (up, down int64) {
+	up, down = user.valve.GetRx(), user.valve.GetTx()
+	panel.usageUpdateQueueM.Lock()
+	if usage, ok := panel.usageUpdateQueue[user.arrUID]; ok {
+		up += atomic.LoadInt64(usage.up)
+		down += atomic.LoadInt64(usage.down)
+	}
+	panel.usageUpdateQueueM.Unlock()
+	return
+}
+
+// exceededLimit returns why a user can't carry on, empty if it can
+func (panel *userPanel) exceededLimit(user *ActiveUser) string {
+	limits, ok := user.limits.Load().(userLimits)
+	if !ok {
+		return ""
+	}
+	if panel.world.Now().Unix() > limits.expiryTime {
+		return usermanager.ErrUserExpired.Error()
+	}
+	up, down := panel.pendingUsage(user)
+	if limits.upCredit-up <= 0 {
+		return usermanager.ErrNoUpCredit.Error()
+	}
+	if limits.downCredit-down <= 0 {
+		return usermanager.ErrNoDownCredit.Error()
+	}
+	return ""
+}
+
+// enforceLimits terminates the active users that have expired or run out of credit since their limits were read,
+// without waiting for the next upload
+func (panel *userPanel) enforceLimits() {
+	panel.activeUsersM.RLock()
+	users := make([]*ActiveUser, 0, len(panel.activeUsers))
+	for _, user := range panel.activeUsers {
+		if !user.bypass {
+			users = append(users, user)
+		}
+	}
+	panel.activeUsersM.RUnlock()
+	for _, user := range users {
+		if reason := panel.exceededLimit(user); reason != "" {
+			panel.TerminateActiveUser(user, reason)
+		}
+	}
+}
+
+func (panel *userPanel) regularEnforce() {
+	for {
+		time.Sleep(enforceInterval)
+		panel.enforceLimits()
+	}
+}
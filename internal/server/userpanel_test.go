@@ -6,6 +6,7 @@ import (
 	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -18,7 +19,7 @@ func TestUserPanel_BypassUser(t *testing.T) {
 	if err != nil {
 		t.Error("failed to make local manager", err)
 	}
-	panel := MakeUserPanel(manager)
+	panel := MakeUserPanel(manager, common.RealWorldState)
 	UID, _ := base64.StdEncoding.DecodeString("u97xvcc5YoQA8obCyt9q/w==")
 	user, _ := panel.GetBypassUser(UID)
 	user.valve.AddRx(10)
@@ -81,7 +82,7 @@ func TestUserPanel_GetUser(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	panel := MakeUserPanel(mgr)
+	panel := MakeUserPanel(mgr, mockWorldState)
 
 	t.Run("normal user", func(t *testing.T) {
 		_ = mgr.WriteUserInfo(validUserInfo)
@@ -115,7 +116,7 @@ func TestUserPanel_UpdateUsageQueue(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	panel := MakeUserPanel(mgr)
+	panel := MakeUserPanel(mgr, mockWorldState)
 
 	t.Run("normal update", func(t *testing.T) {
 		_ = mgr.WriteUserInfo(validUserInfo)
@@ -187,3 +188,70 @@ func TestUserPanel_UpdateUsageQueue(t *testing.T) {
 		}
 	})
 }
+
+func TestUserPanel_EnforceLimits(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	// the enforcing goroutine reads it too
+	var now int64 = 1000
+	worldState := common.WorldState{Rand: mockWorldState.Rand, Now: func() time.Time { return time.Unix(atomic.LoadInt64(&now), 0) }}
+	mgr, err := usermanager.MakeLocalManager(tmpDB.Name(), worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panel := MakeUserPanel(mgr, worldState)
+	uinfo := validUserInfo
+	uinfo.ExpiryTime = 2000
+
+	t.Run("expiry", func(t *testing.T) {
+		_ = mgr.WriteUserInfo(uinfo)
+		if _, err := panel.GetUser(uinfo.UID); err != nil {
+			t.Fatal(err)
+		}
+		panel.enforceLimits()
+		if !panel.isActive(uinfo.UID) {
+			t.Fatal("user terminated before expiring")
+		}
+		atomic.StoreInt64(&now, 2001)
+		defer atomic.StoreInt64(&now, 1000)
+		panel.enforceLimits()
+		if panel.isActive(uinfo.UID) {
+			t.Error("expired user not terminated")
+		}
+	})
+
+	t.Run("credit used up before upload", func(t *testing.T) {
+		_ = mgr.WriteUserInfo(uinfo)
+		user, err := panel.GetUser(uinfo.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.valve.AddTx(uinfo.DownCredit / 2)
+		panel.enforceLimits()
+		if !panel.isActive(uinfo.UID) {
+			t.Fatal("user terminated with credit left")
+		}
+		user.valve.AddTx(uinfo.DownCredit / 2)
+		panel.enforceLimits()
+		if panel.isActive(uinfo.UID) {
+			t.Error("user without credit not terminated")
+		}
+	})
+
+	t.Run("changed user", func(t *testing.T) {
+		_ = mgr.WriteUserInfo(uinfo)
+		user, err := panel.GetUser(uinfo.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.valve.AddRx(10)
+		lowered := uinfo
+		lowered.UpCredit = 10
+		_ = mgr.WriteUserInfo(lowered)
+		panel.refreshUser(uinfo.UID)
+		panel.enforceLimits()
+		if panel.isActive(uinfo.UID) {
+			t.Error("user not terminated after its credit is lowered")
+		}
+	})
+}
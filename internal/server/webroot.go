@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long a visitor has to send the headers of each request to WebRoot
+	webRootReadHeaderTimeout = 10 * time.Second
+	// how long a connection to WebRoot is kept open between requests
+	webRootIdleTimeout = 60 * time.Second
+)
+
+// parseWebRoot makes the handler of WebRoot, which serves the files in a directory, or reverse proxies every request
+// to an http:// or https:// upstream with RedirDialer, keeping the Host the visitor asked for
+func (sta *State) parseWebRoot(webRoot string) (http.Handler, error) {
+	if strings.HasPrefix(webRoot, "http://") || strings.HasPrefix(webRoot, "https://") {
+		upstream, err := url.Parse(webRoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse WebRoot: %v", err)
+		}
+		if upstream.Host == "" {
+			return nil, fmt.Errorf("WebRoot %v has no host", webRoot)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(upstream)
+		proxy.Transport = &http.Transport{
+			Dial: func(network, address string) (net.Conn, error) {
+				return sta.RedirDialer.Dial(network, address)
+			},
+			TLSHandshakeTimeout: webRootReadHeaderTimeout,
+			IdleConnTimeout:     webRootIdleTimeout,
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("Failed to proxy a request to WebRoot: %v", err)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return proxy, nil
+	}
+	info, err := os.Stat(webRoot)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open WebRoot: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("WebRoot %v is neither a directory nor an http:// or https:// URL", webRoot)
+	}
+	return http.FileServer(http.Dir(webRoot)), nil
+}
+
+// serveWebRoot serves the HTTP requests of a visitor on conn with WebRoot, of which firstPacket has already been read
+func serveWebRoot(conn net.Conn, firstPacket []byte, sta *State) {
+	srv := &http.Server{
+		Handler:           sta.webRoot,
+		ReadHeaderTimeout: webRootReadHeaderTimeout,
+		IdleTimeout:       webRootIdleTimeout,
+	}
+	// Serve returns once the connection is accepted, which is then served on its own until either side closes it
+	_ = srv.Serve(newWsAcceptor(conn, firstPacket))
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// visitWebRoot sends request to serveWebRoot in one packet and returns the response, whose body is read in full
+func visitWebRoot(t *testing.T, sta *State, request string) (*http.Response, string) {
+	visitor, conn := net.Pipe()
+	defer visitor.Close()
+	go serveWebRoot(conn, []byte(request), sta)
+	resp, err := http.ReadResponse(bufio.NewReader(visitor), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestParseWebRoot(t *testing.T) {
+	sta := &State{RedirDialer: &net.Dialer{}}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "index.html")
+	if err := os.WriteFile(file, []byte("<p>hello</p>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, good := range []string{dir, "http://127.0.0.1:8080", "https://www.example.com/blog/"} {
+		if _, err := sta.parseWebRoot(good); err != nil {
+			t.Errorf("%v: %v", good, err)
+		}
+	}
+	for _, bad := range []string{file, filepath.Join(dir, "nonexistent"), "http:///index.html"} {
+		if _, err := sta.parseWebRoot(bad); err == nil {
+			t.Errorf("expecting an error for %v", bad)
+		}
+	}
+}
+
+func TestServeWebRoot(t *testing.T) {
+	t.Run("directory", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>hello</p>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sta := &State{RedirDialer: &net.Dialer{}}
+		var err error
+		sta.webRoot, err = sta.parseWebRoot(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, body := visitWebRoot(t, sta, "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		if resp.StatusCode != http.StatusOK || body != "<p>hello</p>" {
+			t.Errorf("expecting index.html, got %v %q", resp.Status, body)
+		}
+		resp, _ = visitWebRoot(t, sta, "GET /secret HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expecting 404, got %v", resp.Status)
+		}
+	})
+	t.Run("upstream", func(t *testing.T) {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.Host+r.URL.Path)
+		}))
+		defer upstream.Close()
+		sta := &State{RedirDialer: &net.Dialer{}}
+		var err error
+		sta.webRoot, err = sta.parseWebRoot(upstream.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, body := visitWebRoot(t, sta, "GET /about HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		if resp.StatusCode != http.StatusOK || body != "www.example.com/about" {
+			t.Errorf("expecting the request to be proxied with its Host, got %v %q", resp.Status, body)
+		}
+	})
+	t.Run("upstream down", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+		sta := &State{RedirDialer: &net.Dialer{}}
+		sta.webRoot, err = sta.parseWebRoot("http://" + l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, _ := visitWebRoot(t, sta, "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("expecting 502, got %v", resp.Status)
+		}
+	})
+}
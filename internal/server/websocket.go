@@ -9,26 +9,83 @@ import (
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/common"
 	"github.com/cbeuw/Cloak/internal/ecdh"
+	"github.com/gorilla/websocket"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 )
 
-type WebSocket struct{}
+// WebSocket only accepts upgrade requests on path, to one of hosts and from one of origins, if they're set
+type WebSocket struct {
+	path    string
+	hosts   []string
+	origins []string
+}
 
 func (WebSocket) String() string { return "WebSocket" }
 
-func (WebSocket) processFirstPacket(reqPacket []byte, privateKey crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
+// checkRequest returns an error if req isn't what a Cloak client in CDN mode sends, in which case it's probably
+// someone visiting the cover site
+func (ws WebSocket) checkRequest(req *http.Request) error {
+	if !websocket.IsWebSocketUpgrade(req) {
+		return fmt.Errorf("%w: not a WebSocket upgrade request", ErrNotCloak)
+	}
+	if ws.path != "" && req.URL.Path != ws.path {
+		return fmt.Errorf("%w: wrong WebSocket path %v", ErrNotCloak, req.URL.Path)
+	}
+	if len(ws.hosts) != 0 && !matchesHost(req.Host, ws.hosts) {
+		return fmt.Errorf("%w: wrong WebSocket host %v", ErrNotCloak, req.Host)
+	}
+	if len(ws.origins) != 0 {
+		origin := req.Header.Get("Origin")
+		for _, o := range ws.origins {
+			if o == origin {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: WebSocket origin %v not allowed", ErrNotCloak, origin)
+	}
+	return nil
+}
+
+// matchesHost returns whether host, which is the Host of a request, is one of hosts with its port aside
+func matchesHost(host string, hosts []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(host, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// webSocketHosts are the hosts that WebSocket upgrade requests may be to, which are WSHost and FrontingHosts. Any
+// host is accepted if it's empty
+func (sta *State) webSocketHosts() []string {
+	if sta.WSHost == "" {
+		return sta.FrontingHosts
+	}
+	return append([]string{sta.WSHost}, sta.FrontingHosts...)
+}
+
+func (ws WebSocket) processFirstPacket(reqPacket []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, respond Responder, err error) {
 	var req *http.Request
 	req, err = http.ReadRequest(bufio.NewReader(bytes.NewBuffer(reqPacket)))
 	if err != nil {
 		err = fmt.Errorf("failed to parse first HTTP GET: %v", err)
 		return
 	}
+	err = ws.checkRequest(req)
+	if err != nil {
+		return
+	}
 	var hiddenData []byte
 	hiddenData, err = base64.StdEncoding.DecodeString(req.Header.Get("hidden"))
 
-	fragments, err = WebSocket{}.unmarshalHidden(hiddenData, privateKey)
+	fragments, err = unmarshalHidden(hiddenData, staticPvs)
 	if err != nil {
 		err = fmt.Errorf("failed to unmarshal hidden data from WS into authFragments: %v", err)
 		return
@@ -71,7 +128,9 @@ func (WebSocket) makeResponder(reqPacket []byte, sharedSecret [32]byte) Responde
 
 var ErrBadGET = errors.New("non (or malformed) HTTP GET")
 
-func (WebSocket) unmarshalHidden(hidden []byte, staticPv crypto.PrivateKey) (fragments authFragments, err error) {
+// unmarshalHidden extracts the authFragments from the hidden data carried in HTTP headers. This is shared by the
+// transports over HTTP
+func unmarshalHidden(hidden []byte, staticPvs []crypto.PrivateKey) (fragments authFragments, err error) {
 	if len(hidden) < 96 {
 		err = ErrBadGET
 		return
@@ -84,13 +143,12 @@ func (WebSocket) unmarshalHidden(hidden []byte, staticPv crypto.PrivateKey) (fra
 		return
 	}
 
-	copy(fragments.sharedSecret[:], ecdh.GenerateSharedSecret(staticPv, ephPub))
-
 	if len(hidden[32:]) != 64 {
 		err = fmt.Errorf("%v: %v", ErrCiphertextLength, len(hidden[32:]))
 		return
 	}
 
 	copy(fragments.ciphertextWithTag[:], hidden[32:])
+	fragments.findSharedSecret(staticPvs, ephPub)
 	return
 }
@@ -65,7 +65,8 @@ import (
 
 // since we need to read the first packet from the client to identify its protocol, the first packet will no longer
 // be in Conn's buffer. However, websocket.Upgrade relies on reading the first packet for handshake, so we must
-// fake a conn that returns the first packet on first read
+// fake a conn that returns the first packet on first read. If buf is smaller than the first packet (e.g. HTTP/2 reads
+// its preface on its own), the rest is returned in subsequent reads
 type firstBuffedConn struct {
 	net.Conn
 	firstRead   bool
@@ -74,10 +75,11 @@ type firstBuffedConn struct {
 
 func (c *firstBuffedConn) Read(buf []byte) (int, error) {
 	if !c.firstRead {
-		c.firstRead = true
-		copy(buf, c.firstPacket)
-		n := len(c.firstPacket)
-		c.firstPacket = []byte{}
+		n := copy(buf, c.firstPacket)
+		c.firstPacket = c.firstPacket[n:]
+		if len(c.firstPacket) == 0 {
+			c.firstRead = true
+		}
 		return n, nil
 	}
 	return c.Conn.Read(buf)
@@ -126,7 +128,11 @@ func newWsHandshakeHandler() *wsHandshakeHandler {
 }
 
 func (ws *wsHandshakeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	upgrader := websocket.Upgrader{}
+	upgrader := websocket.Upgrader{
+		// the origin has already been checked against WSOrigins, and pages of the cover site may well be on
+		// another domain
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Errorf("failed to upgrade connection to ws: %v", err)
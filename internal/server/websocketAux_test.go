@@ -40,6 +40,27 @@ func TestFirstBuffedConn_Read(t *testing.T) {
 	}
 }
 
+func TestFirstBuffedConn_ShortRead(t *testing.T) {
+	mockConn, _ := connutil.AsyncPipe()
+	firstBuffedConn := &firstBuffedConn{
+		Conn:        mockConn,
+		firstPacket: []byte{1, 2, 3, 4, 5},
+	}
+
+	buf := make([]byte, 2)
+	var read []byte
+	for len(read) < 5 {
+		n, err := firstBuffedConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, buf[:n]...)
+	}
+	if !bytes.Equal([]byte{1, 2, 3, 4, 5}, read) {
+		t.Errorf("first packet read in pieces is %v", read)
+	}
+}
+
 func TestWsAcceptor(t *testing.T) {
 	mockConn := connutil.Discard()
 	expectedFirstPacket := []byte{1, 2, 3}
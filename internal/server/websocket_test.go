@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestWebSocketCheckRequest(t *testing.T) {
+	ws := WebSocket{path: "/ws", hosts: []string{"cdn.example.com", "hidden.example.com"}, origins: []string{"https://www.example.com"}}
+	makeReq := func(path, host, origin string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+
+	t.Run("correct", func(t *testing.T) {
+		err := ws.checkRequest(makeReq("/ws", "cdn.example.com:443", "https://www.example.com"))
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+	t.Run("another host", func(t *testing.T) {
+		err := ws.checkRequest(makeReq("/ws", "Hidden.example.com", "https://www.example.com"))
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+	t.Run("nothing to check", func(t *testing.T) {
+		err := WebSocket{}.checkRequest(makeReq("/anything", "anywhere.com", ""))
+		if err != nil {
+			t.Errorf("expecting no error, got %v", err)
+		}
+	})
+
+	bad := map[string]*http.Request{
+		"wrong path":   makeReq("/", "cdn.example.com", "https://www.example.com"),
+		"wrong host":   makeReq("/ws", "www.example.com", "https://www.example.com"),
+		"wrong origin": makeReq("/ws", "cdn.example.com", "https://evil.com"),
+		"no origin":    makeReq("/ws", "cdn.example.com", ""),
+	}
+	notUpgrade, _ := http.NewRequest(http.MethodGet, "http://cdn.example.com/ws", nil)
+	notUpgrade.Header.Set("Origin", "https://www.example.com")
+	bad["not upgrade"] = notUpgrade
+
+	for name, req := range bad {
+		t.Run(name, func(t *testing.T) {
+			err := ws.checkRequest(req)
+			if !errors.Is(err, ErrNotCloak) {
+				t.Errorf("expecting %v, got %v", ErrNotCloak, err)
+			}
+		})
+	}
+}
@@ -1,18 +1,27 @@
 package test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"github.com/cbeuw/Cloak/internal/client"
 	"github.com/cbeuw/Cloak/internal/common"
 	mux "github.com/cbeuw/Cloak/internal/multiplex"
 	"github.com/cbeuw/Cloak/internal/server"
+	"github.com/cbeuw/Cloak/internal/server/usermanager"
 	"github.com/cbeuw/connutil"
+	"golang.org/x/net/proxy"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"sync"
 	"testing"
@@ -136,7 +145,7 @@ func establishSession(lcc client.LocalConnConfig, rcc client.RemoteConnConfig, a
 	// transport
 	ckClientDialer, ckServerListener := connutil.DialerListener(10 * 1024)
 	clientSeshMaker := func() *mux.Session {
-		return client.MakeSession(rcc, ai, ckClientDialer, false)
+		return client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
 	}
 
 	useSessionPerConnection := rcc.NumConn == 0
@@ -152,7 +161,7 @@ func establishSession(lcc client.LocalConnConfig, rcc client.RemoteConnConfig, a
 			addrCh <- conn.LocalAddr().(*net.UDPAddr)
 			return conn, err
 		}
-		go client.RouteUDP(acceptor, lcc.Timeout, clientSeshMaker, useSessionPerConnection)
+		go client.RouteUDP(acceptor, lcc.UDPTimeout, clientSeshMaker, useSessionPerConnection)
 		proxyToCkClientD = mDialer
 	} else {
 		var proxyToCkClientL *connutil.PipeListener
@@ -260,6 +269,74 @@ func TestUDP(t *testing.T) {
 
 }
 
+func TestUDPOverTCP(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	_, rcc, ai := basicClientConfigs(worldState)
+	sta := basicServerState(worldState, tmpDB)
+	ckClientDialer, ckServerListener := connutil.DialerListener(10 * 1024)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	go server.Serve(ckServerListener, sta)
+	// the tcp entry of the ProxyBook is dialed with udp for datagram streams
+	go serveUDPEcho(ckServerToProxyL)
+
+	addrCh := make(chan *net.UDPAddr, 1)
+	acceptor := func() (*net.UDPConn, error) {
+		laddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+		conn, err := net.ListenUDP("udp", laddr)
+		addrCh <- conn.LocalAddr().(*net.UDPAddr)
+		return conn, err
+	}
+	seshMaker := func() *mux.Session {
+		return client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
+	}
+	const udpTimeout = 200 * time.Millisecond
+	go client.RouteUDPOverTCP(acceptor, udpTimeout, seshMaker, false)
+
+	pxyClientConn, err := (&mockUDPDialer{addrCh: addrCh}).Dial("udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// datagrams must come back whole, even though the session is ordered
+	for _, dataLen := range []int{1, 1500, 3, 8000} {
+		testData := make([]byte, dataLen)
+		rand.Read(testData)
+		_, err = pxyClientConn.Write(testData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recvBuf := make([]byte, 10240)
+		pxyClientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := pxyClientConn.Read(recvBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(testData, recvBuf[:n]) {
+			t.Errorf("expecting a datagram of %v bytes, got %v", dataLen, n)
+		}
+	}
+
+	// the source gets a new stream after its mapping has expired
+	time.Sleep(2 * udpTimeout)
+	_, err = pxyClientConn.Write([]byte("after expiry"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recvBuf := make([]byte, 1024)
+	pxyClientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := pxyClientConn.Read(recvBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(recvBuf[:n]) != "after expiry" {
+		t.Errorf("expecting echo after expiry, got %q", recvBuf[:n])
+	}
+}
+
 func TestTCP(t *testing.T) {
 	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
 	defer os.Remove(tmpDB.Name())
@@ -332,6 +409,1073 @@ func TestTCP(t *testing.T) {
 	})
 }
 
+func TestMultipath(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	for name, duplicate := range map[string]bool{"stripe": false, "duplicate": true} {
+		t.Run(name, func(t *testing.T) {
+			var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+			defer os.Remove(tmpDB.Name())
+
+			lcc, rcc, ai := basicClientConfigs(worldState)
+			ai.Multipath = true
+			ai.Duplicate = duplicate
+			sta := basicServerState(worldState, tmpDB)
+
+			pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go serveTCPEcho(pxyServerL)
+			var conns [numConns]net.Conn
+			for i := 0; i < numConns; i++ {
+				conns[i], err = pxyClientD.Dial("", "")
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			runEchoTest(t, conns[:], 65536)
+		})
+	}
+}
+
+func TestEncryptionMethods(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	for _, method := range []string{"plain", "aes-gcm", "chacha20-poly1305", "xchacha20-poly1305", "aes-128-gcm"} {
+		t.Run(method, func(t *testing.T) {
+			var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+			defer os.Remove(tmpDB.Name())
+
+			clientConfig := client.RawConfig{
+				ServerName:       "www.example.com",
+				ProxyMethod:      "tcp",
+				EncryptionMethod: method,
+				UID:              bypassUID[:],
+				PublicKey:        publicKey,
+				NumConn:          4,
+				Transport:        "direct",
+				RemoteHost:       "fake.com",
+				RemotePort:       "9999",
+				LocalHost:        "127.0.0.1",
+				LocalPort:        "9999",
+			}
+			lcc, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sta := basicServerState(worldState, tmpDB)
+
+			pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go serveTCPEcho(pxyServerL)
+			conns := make([]net.Conn, 10)
+			for i := range conns {
+				conns[i], err = pxyClientD.Dial("", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			runEchoTest(t, conns, 65536)
+		})
+	}
+}
+
+func TestFEC(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	ai.FECDataShards, ai.FECParityShards = 10, 3
+	sta := basicServerState(worldState, tmpDB)
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	var conns [numConns]net.Conn
+	for i := 0; i < numConns; i++ {
+		conns[i], err = pxyClientD.Dial("", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestHeartbeat(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	ai.Heartbeat = time.Second
+	sta := basicServerState(worldState, tmpDB)
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	var conns [numConns]net.Conn
+	for i := 0; i < numConns; i++ {
+		conns[i], err = pxyClientD.Dial("", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+	// the session is kept through being idle for longer than it takes to find a dead connection
+	time.Sleep(4 * time.Second)
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestTrafficProfile(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	for name, profile := range map[string]byte{"browsing": mux.PROFILE_BROWSING, "streaming": mux.PROFILE_STREAMING} {
+		t.Run(name, func(t *testing.T) {
+			var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+			defer os.Remove(tmpDB.Name())
+			lcc, rcc, ai := basicClientConfigs(worldState)
+			ai.TrafficProfile = profile
+			sta := basicServerState(worldState, tmpDB)
+
+			pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go serveTCPEcho(pxyServerL)
+			var conns [numConns]net.Conn
+			for i := 0; i < numConns; i++ {
+				conns[i], err = pxyClientD.Dial("", "")
+				if err != nil {
+					t.Error(err)
+				}
+			}
+			runEchoTest(t, conns[:], 65536)
+		})
+	}
+}
+
+func TestRecordSizing(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	rcc.RecordSizing = mux.RECORD_SIZING_DYNAMIC
+	sta := basicServerState(worldState, tmpDB)
+	sta.RecordSizing = mux.RECORD_SIZING_DYNAMIC
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	var conns [numConns]net.Conn
+	for i := 0; i < numConns; i++ {
+		conns[i], err = pxyClientD.Dial("", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestCreditEnforcement(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	ai.UID = []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	sta := basicServerState(worldState, tmpDB)
+	err := sta.Panel.Manager.WriteUserInfo(usermanager.UserInfo{
+		UID:         ai.UID,
+		SessionsCap: 10,
+		UpRate:      1e9,
+		DownRate:    1e9,
+		UpCredit:    1e9,
+		DownCredit:  1e5,
+		ExpiryTime:  1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	conn, err := pxyClientD.Dial("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// well within the credit
+	runEchoTest(t, []net.Conn{conn}, 1024)
+
+	// and then past it, long before the usage is uploaded
+	data := make([]byte, 1e5)
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("stream of a user without credit isn't closed")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	ai.UID = []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	rcc.Quota = &client.QuotaWatcher{}
+	sta := basicServerState(worldState, tmpDB)
+	uinfo := usermanager.UserInfo{
+		UID:         ai.UID,
+		SessionsCap: 10,
+		UpRate:      1e9,
+		DownRate:    1e9,
+		UpCredit:    1e9,
+		DownCredit:  1e9,
+		ExpiryTime:  1000,
+	}
+	if err := sta.Panel.Manager.WriteUserInfo(uinfo); err != nil {
+		t.Fatal(err)
+	}
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	conn, err := pxyClientD.Dial("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEchoTest(t, []net.Conn{conn}, 1024)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if quota, ok := rcc.Quota.Quota(); ok {
+			if quota.ExpiryTime != uinfo.ExpiryTime || quota.UpCredit > uinfo.UpCredit || quota.UpCredit <= 0 {
+				t.Errorf("unexpected quota %+v", quota)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("quota isn't known")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuthWebhook(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	ai.UID = []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+
+	handshakes := make(chan map[string]interface{}, 16)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["Event"] == usermanager.WEBHOOK_EVENT_HANDSHAKE {
+			handshakes <- req
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Allow":       req["UID"] == base64.StdEncoding.EncodeToString(ai.UID),
+			"SessionsCap": 10,
+			"UpRate":      1e9,
+			"DownRate":    1e9,
+			"UpCredit":    1e9,
+			"DownCredit":  1e9,
+			"ExpiryTime":  1000,
+		})
+	}))
+	defer webhook.Close()
+	sta := basicServerState(worldState, tmpDB)
+	sta.Panel = server.MakeUserPanel(usermanager.MakeWebhookManager(webhook.URL, "", time.Minute, worldState), worldState)
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	conn, err := pxyClientD.Dial("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runEchoTest(t, []net.Conn{conn}, 1024)
+
+	req := <-handshakes
+	if req["SNI"] != ai.MockDomain || req["Transport"] != "TLS" || req["ProxyMethod"] != ai.ProxyMethod {
+		t.Errorf("webhook not told of the handshake: %v", req)
+	}
+}
+
+// droppingDialer keeps the connections it makes, so that they can be dropped as they would be by a network change
+type droppingDialer struct {
+	common.Dialer
+	connsM sync.Mutex
+	conns  []net.Conn
+}
+
+func (d *droppingDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.Dial(network, address)
+	if err == nil {
+		d.connsM.Lock()
+		d.conns = append(d.conns, conn)
+		d.connsM.Unlock()
+	}
+	return conn, err
+}
+
+func (d *droppingDialer) dropAll() {
+	d.connsM.Lock()
+	defer d.connsM.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.conns = nil
+}
+
+func TestResumption(t *testing.T) {
+	log.SetLevel(log.ErrorLevel)
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+
+	_, rcc, ai := basicClientConfigs(worldState)
+	rcc.ResumeGrace = time.Minute
+	ai.Resumable = true
+	sta := basicServerState(worldState, tmpDB)
+
+	ckClientDialer, ckServerListener := connutil.DialerListener(10 * 1024)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	go server.Serve(ckServerListener, sta)
+	go serveTCPEcho(ckServerToProxyL)
+
+	dialer := &droppingDialer{Dialer: ckClientDialer}
+	sesh := client.MakeSession(context.Background(), rcc, ai, dialer, false)
+	defer sesh.Close()
+	streams := make([]net.Conn, 10)
+	for i := range streams {
+		stream, err := sesh.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams[i] = stream
+	}
+	runEchoTest(t, streams, 65536)
+
+	// with all the connections gone at once, as when moving between networks
+	dialer.dropAll()
+	runEchoTest(t, streams, 65536)
+	if sesh.IsClosed() {
+		t.Error("session closed after being resumed")
+	}
+}
+
+func TestEarlyData(t *testing.T) {
+	// chrome's ML-KEM key share is sent but not taken up with early data
+	for _, browser := range []string{"chrome", "firefox"} {
+		t.Run(browser, func(t *testing.T) {
+			log.SetLevel(log.ErrorLevel)
+			worldState := common.WorldOfTime(time.Unix(10, 0))
+			var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+			defer os.Remove(tmpDB.Name())
+
+			clientConfig := client.RawConfig{
+				ServerName:       "www.example.com",
+				ProxyMethod:      "tcp",
+				EncryptionMethod: "aes-gcm",
+				UID:              bypassUID[:],
+				PublicKey:        publicKey,
+				NumConn:          1,
+				EarlyData:        true,
+				ResumeGrace:      60,
+				BrowserSig:       browser,
+				RemoteHost:       "fake.com",
+				RemotePort:       "9999",
+				LocalHost:        "127.0.0.1",
+				LocalPort:        "9999",
+			}
+			_, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sta := basicServerState(worldState, tmpDB)
+
+			ckClientDialer, ckServerListener := connutil.DialerListener(10 * 1024)
+			ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+			sta.ProxyDialer = ckServerToProxyD
+			go server.Serve(ckServerListener, sta)
+			go serveTCPEcho(ckServerToProxyL)
+
+			dialer := &droppingDialer{Dialer: ckClientDialer}
+			sesh := client.MakeSession(context.Background(), rcc, ai, dialer, false)
+			defer sesh.Close()
+			streams := make([]net.Conn, 4)
+			for i := range streams {
+				stream, err := sesh.OpenStream()
+				if err != nil {
+					t.Fatal(err)
+				}
+				streams[i] = stream
+			}
+			runEchoTest(t, streams, 65536)
+
+			// the session is resumed with a handshake that has no early data
+			dialer.dropAll()
+			runEchoTest(t, streams, 65536)
+			if sesh.IsClosed() {
+				t.Error("session closed after being resumed")
+			}
+		})
+	}
+}
+
+func TestBrowserSig(t *testing.T) {
+	// chrome offers the hybrid key exchange with ML-KEM, the others don't
+	for _, browser := range []string{"chrome", "firefox", "safari"} {
+		t.Run(browser, func(t *testing.T) {
+			var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+			defer os.Remove(tmpDB.Name())
+			log.SetLevel(log.ErrorLevel)
+
+			worldState := common.WorldOfTime(time.Unix(10, 0))
+			clientConfig := client.RawConfig{
+				ServerName:       "www.example.com",
+				ProxyMethod:      "tcp",
+				EncryptionMethod: "plain",
+				UID:              bypassUID[:],
+				PublicKey:        publicKey,
+				NumConn:          1,
+				Transport:        "direct",
+				BrowserSig:       browser,
+				RemoteHost:       "fake.com",
+				RemotePort:       "9999",
+				LocalHost:        "127.0.0.1",
+				LocalPort:        "9999",
+			}
+			lcc, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sta := basicServerState(worldState, tmpDB)
+			pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go serveTCPEcho(pxyServerL)
+			var conns [1]net.Conn
+			conns[0], err = pxyClientD.Dial("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			runEchoTest(t, conns[:], 65536)
+		})
+	}
+}
+
+func TestSessionTickets(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	clientConfig := client.RawConfig{
+		ServerName:       "www.example.com",
+		ProxyMethod:      "tcp",
+		EncryptionMethod: "plain",
+		UID:              bypassUID[:],
+		PublicKey:        publicKey,
+		// a session for every connection, all but the first of which look resumed
+		NumConn:        0,
+		Transport:      "direct",
+		SessionTickets: true,
+		RemoteHost:     "fake.com",
+		RemotePort:     "9999",
+		LocalHost:      "127.0.0.1",
+		LocalPort:      "9999",
+	}
+	lcc, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := basicServerState(worldState, tmpDB)
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveTCPEcho(pxyServerL)
+	for i := 0; i < 3; i++ {
+		var conns [1]net.Conn
+		conns[0], err = pxyClientD.Dial("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		runEchoTest(t, conns[:], 65536)
+		conns[0].Close()
+	}
+}
+
+func TestTranscriptMimicry(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	lcc, rcc, ai := basicClientConfigs(worldState)
+	sta := basicServerState(worldState, tmpDB)
+	// nothing has been learnt from the redirection server, so the default transcript is used
+	sta.MimicTranscript = true
+
+	pxyClientD, pxyServerL, _, _, err := establishSession(lcc, rcc, ai, sta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go serveTCPEcho(pxyServerL)
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = pxyClientD.Dial("", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestGRPC(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	clientConfig := client.RawConfig{
+		ServerName:       "www.example.com",
+		ProxyMethod:      "tcp",
+		EncryptionMethod: "plain",
+		UID:              bypassUID[:],
+		PublicKey:        publicKey,
+		NumConn:          4,
+		Transport:        "grpc",
+		GRPCPath:         "/stream.Service/Tunnel",
+		RemoteHost:       "fake.com",
+		RemotePort:       "443",
+		LocalHost:        "127.0.0.1",
+		LocalPort:        "9999",
+	}
+	_, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := basicServerState(worldState, tmpDB)
+	sta.GRPCPath = clientConfig.GRPCPath
+
+	ckClientDialer, cdnListener := connutil.DialerListener(10 * 1024)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	cert, _ := SelfSignedCert(t)
+	// the CDN terminates TLS and passes HTTP/2 on to the Cloak server
+	go server.Serve(tls.NewListener(cdnListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}), sta)
+
+	sesh := client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
+	defer sesh.Close()
+
+	go serveTCPEcho(ckServerToProxyL)
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = sesh.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestHTTP2(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	clientConfig := client.RawConfig{
+		ServerName:       "www.example.com",
+		ProxyMethod:      "tcp",
+		EncryptionMethod: "plain",
+		UID:              bypassUID[:],
+		PublicKey:        publicKey,
+		NumConn:          4,
+		Transport:        "h2",
+		H2Path:           "/upload",
+		RemoteHost:       "fake.com",
+		RemotePort:       "443",
+		LocalHost:        "127.0.0.1",
+		LocalPort:        "9999",
+	}
+	_, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := basicServerState(worldState, tmpDB)
+	sta.H2Path = clientConfig.H2Path
+
+	ckClientDialer, cdnListener := connutil.DialerListener(10 * 1024)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	cert, _ := SelfSignedCert(t)
+	// the CDN terminates TLS and passes HTTP/2 on to the Cloak server
+	go server.Serve(tls.NewListener(cdnListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}), sta)
+
+	sesh := client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
+	defer sesh.Close()
+
+	go serveTCPEcho(ckServerToProxyL)
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = sesh.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestDomainFronting(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	clientConfig := client.RawConfig{
+		ServerName:       "www.example.com",
+		ProxyMethod:      "tcp",
+		EncryptionMethod: "plain",
+		UID:              bypassUID[:],
+		PublicKey:        publicKey,
+		NumConn:          4,
+		Transport:        "h2",
+		H2Path:           "/upload",
+		FrontingHosts:    []string{"hidden.example.com", "other.example.com"},
+		RemoteHost:       "fake.com",
+		RemotePort:       "443",
+		LocalHost:        "127.0.0.1",
+		LocalPort:        "9999",
+	}
+	_, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := basicServerState(worldState, tmpDB)
+	sta.H2Path = clientConfig.H2Path
+	sta.FrontingHosts = clientConfig.FrontingHosts
+
+	ckClientDialer, cdnListener := connutil.DialerListener(10 * 1024)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	cert, _ := SelfSignedCert(t)
+	// the CDN is reached with the SNI of ServerName, and passes requests on by their Host
+	go server.Serve(tls.NewListener(cdnListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}), sta)
+
+	sesh := client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
+	defer sesh.Close()
+
+	go serveTCPEcho(ckServerToProxyL)
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = sesh.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+// fixedDialer dials the same address whatever it's asked to dial
+type fixedDialer string
+
+func (d fixedDialer) Dial(network, _ string) (net.Conn, error) { return net.Dial(network, string(d)) }
+
+func TestWebSocket(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	clientConfig := client.RawConfig{
+		ServerName:       "www.example.com",
+		ProxyMethod:      "tcp",
+		EncryptionMethod: "plain",
+		UID:              bypassUID[:],
+		PublicKey:        publicKey,
+		NumConn:          4,
+		Transport:        "cdn",
+		WSPath:           "/ws",
+		WSHeaders:        map[string]string{"Origin": "https://www.example.com"},
+		WSUserAgents:     []string{"Mozilla/5.0"},
+		RemoteHost:       "fake.com",
+		RemotePort:       "443",
+		LocalHost:        "127.0.0.1",
+		LocalPort:        "9999",
+	}
+	_, rcc, ai, err := clientConfig.SplitConfigs(worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sta := basicServerState(worldState, tmpDB)
+	sta.WSPath = "/ws"
+	sta.WSHost = "fake.com"
+	sta.WSOrigins = []string{"https://www.example.com"}
+
+	// net/http aborts its background read with a deadline when the connection is hijacked. Deadline errors of
+	// connutil aren't temporary, which crypto/tls treats as fatal, so a real TCP connection is needed here
+	cdnListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cdnListener.Close()
+	ckClientDialer := fixedDialer(cdnListener.Addr().String())
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	cert, _ := SelfSignedCert(t)
+	// the CDN terminates TLS and passes the WebSocket on to the Cloak server
+	go server.Serve(tls.NewListener(cdnListener, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}), sta)
+
+	sesh := client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
+	defer sesh.Close()
+
+	go serveTCPEcho(ckServerToProxyL)
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = sesh.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+func TestPT(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	sta := basicServerState(worldState, tmpDB)
+	ckClientDialer, ckServerListener := connutil.DialerListener(10 * 1024)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	go server.Serve(ckServerListener, sta)
+	go serveTCPEcho(ckServerToProxyL)
+
+	// Tor connects to our SOCKS5 server on loopback
+	torL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer torL.Close()
+	base := client.RawConfig{
+		EncryptionMethod: "plain",
+		PublicKey:        publicKey,
+		NumConn:          4,
+	}
+	go client.ServePT(context.Background(), torL, base, ckClientDialer, worldState)
+
+	bridgeArgs := "ServerName=www.example.com;ProxyMethod=tcp;UID=" + base64.StdEncoding.EncodeToString(bypassUID[:])
+	socks, err := proxy.SOCKS5("tcp", torL.Addr().String(), &proxy.Auth{User: bridgeArgs, Password: "\x00"}, proxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = socks.Dial("tcp", "fake.com:9999")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
+// directServer serves a Cloak server whose only proxy method is direct. It returns the maker of sessions to it
+func directServer(t *testing.T, db *os.File, worldState common.WorldState) (func() *mux.Session, *server.State) {
+	sta, err := server.InitState(server.RawConfig{
+		ProxyBook:           map[string][]string{"direct": {"direct"}},
+		BypassUID:           [][]byte{bypassUID[:]},
+		RedirAddr:           "fake.com:9999",
+		PrivateKey:          privateKey,
+		DatabasePath:        db.Name(),
+		AllowPrivateTargets: true,
+	}, worldState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ckClientDialer, ckServerListener := connutil.DialerListener(10 * 1024)
+	go server.Serve(ckServerListener, sta)
+
+	_, rcc, ai := basicClientConfigs(worldState)
+	ai.ProxyMethod = "direct"
+	return func() *mux.Session {
+		return client.MakeSession(context.Background(), rcc, ai, ckClientDialer, false)
+	}, sta
+}
+
+func TestSOCKS5(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	seshMaker, sta := directServer(t, tmpDB, worldState)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	go serveTCPEcho(ckServerToProxyL)
+
+	socksL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksL.Close()
+	go client.ServeSOCKS5(socksL, 300*time.Second, seshMaker, false)
+
+	t.Run("CONNECT", func(t *testing.T) {
+		socks, err := proxy.SOCKS5("tcp", socksL.Addr().String(), nil, proxy.Direct)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var conns [10]net.Conn
+		for i := 0; i < len(conns); i++ {
+			conns[i], err = socks.Dial("tcp", "127.0.0.1:9999")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		runEchoTest(t, conns[:], 65536)
+	})
+
+	t.Run("UDP ASSOCIATE", func(t *testing.T) {
+		// datagram streams of direct proxy methods are sent from ck-server itself
+		echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echo.Close()
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, from, err := echo.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				echo.WriteTo(buf[:n], from)
+			}
+		}()
+
+		ctrlConn, err := net.Dial("tcp", socksL.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ctrlConn.Close()
+		ctrlConn.Write([]byte{0x05, 0x01, 0x00, 0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		reply := make([]byte, 2+10)
+		if _, err = io.ReadFull(ctrlConn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply[3] != 0x00 {
+			t.Fatalf("UDP ASSOCIATE failed with %x", reply)
+		}
+		bound, err := common.ReadTarget(bytes.NewReader(reply[5:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pxyClientConn, err := net.Dial("udp", bound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pxyClientConn.Close()
+
+		target, _ := common.MarshalTarget(echo.LocalAddr().String())
+		header := append([]byte{0, 0, 0}, target...)
+		for _, dataLen := range []int{1, 1500, 8000} {
+			testData := make([]byte, dataLen)
+			rand.Read(testData)
+			if _, err = pxyClientConn.Write(append(header, testData...)); err != nil {
+				t.Fatal(err)
+			}
+			recvBuf := make([]byte, 10240)
+			pxyClientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := pxyClientConn.Read(recvBuf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// replies come from the echo server
+			if !bytes.Equal(recvBuf[:len(header)], header) || !bytes.Equal(recvBuf[len(header):n], testData) {
+				t.Errorf("expecting a datagram of %v bytes from %v, got %x", dataLen, echo.LocalAddr(), recvBuf[:n])
+			}
+		}
+	})
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	seshMaker, _ := directServer(t, tmpDB, worldState)
+	// the origin closes the connection after each response, which needs a real connection to not lose the response
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%v %v", r.Host, r.RequestURI)
+	}))
+	defer web.Close()
+	webAddr := web.Listener.Addr().String()
+
+	proxyL, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyL.Close()
+	go client.ServeHTTPProxy(proxyL, 300*time.Second, seshMaker, false)
+
+	t.Run("absolute URI", func(t *testing.T) {
+		proxyURL, _ := url.Parse("http://" + proxyL.Addr().String())
+		httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		for i := 0; i < 3; i++ {
+			resp, err := httpClient.Get("http://" + webAddr + "/path?q=1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			// the request is sent in origin form
+			if string(body) != webAddr+" /path?q=1" {
+				t.Errorf("unexpected response %q", body)
+			}
+		}
+	})
+
+	t.Run("CONNECT", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyL.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", webAddr, webAddr)
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expecting 200, got %v", resp.Status)
+		}
+		// the tunnel is kept alive
+		for i := 0; i < 3; i++ {
+			fmt.Fprint(conn, "GET /tunnelled HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+			resp, err = http.ReadResponse(r, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "www.example.com /tunnelled" {
+				t.Errorf("unexpected response %q", body)
+			}
+		}
+	})
+
+	t.Run("origin form", func(t *testing.T) {
+		conn, err := net.Dial("tcp", proxyL.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n")
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expecting 400, got %v", resp.Status)
+		}
+	})
+}
+
+func TestTUN(t *testing.T) {
+	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
+	defer os.Remove(tmpDB.Name())
+	log.SetLevel(log.ErrorLevel)
+
+	ip, tunNet, _ := net.ParseCIDR("198.18.0.1/16")
+	tunNet.IP = ip.To4()
+	dev, err := client.OpenTUN("cktest0", tunNet, 1500)
+	if err != nil {
+		t.Skipf("can't create TUN device: %v", err)
+	}
+	defer dev.Close()
+
+	worldState := common.WorldOfTime(time.Unix(10, 0))
+	seshMaker, sta := directServer(t, tmpDB, worldState)
+	ckServerToProxyD, ckServerToProxyL := connutil.DialerListener(10 * 1024)
+	sta.ProxyDialer = ckServerToProxyD
+	go serveTCPEcho(ckServerToProxyL)
+	go client.ServeTUN(dev, tunNet, 300*time.Second, 60*time.Second, seshMaker, false)
+
+	// anything in the subnet of the device is routed to it
+	var conns [10]net.Conn
+	for i := 0; i < len(conns); i++ {
+		conns[i], err = net.DialTimeout("tcp", fmt.Sprintf("198.18.1.%v:80", i+1), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runEchoTest(t, conns[:], 65536)
+}
+
 func TestClosingStreamsFromProxy(t *testing.T) {
 	var tmpDB, _ = ioutil.TempFile("", "ck_user_info")
 	defer os.Remove(tmpDB.Name())
@@ -401,9 +1545,11 @@ func BenchmarkThroughput(b *testing.B) {
 	const bufSize = 16 * 1024
 
 	encryptionMethods := map[string]byte{
-		"plain":             mux.E_METHOD_PLAIN,
-		"chacha20-poly1305": mux.E_METHOD_CHACHA20_POLY1305,
-		"aes-gcm":           mux.E_METHOD_AES_GCM,
+		"plain":              mux.E_METHOD_PLAIN,
+		"chacha20-poly1305":  mux.E_METHOD_CHACHA20_POLY1305,
+		"aes-gcm":            mux.E_METHOD_AES_GCM,
+		"xchacha20-poly1305": mux.E_METHOD_XCHACHA20_POLY1305,
+		"aes-128-gcm":        mux.E_METHOD_AES_128_GCM,
 	}
 
 	for name, method := range encryptionMethods {
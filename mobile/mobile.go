@@ -0,0 +1,347 @@
+// Package mobile is ck-client for Android and iOS apps to embed, through gomobile bind. What it exports only uses
+// the types gomobile can bind: strings, integers, bools, errors, and interfaces of those that the apps implement.
+//
+// A client is started with the same JSON as ckclient.json, and listens on LocalHost:LocalPort like ck-client does,
+// for the app's proxy client to connect to. Only one client runs at a time.
+package mobile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/client"
+	"github.com/cbeuw/Cloak/internal/common"
+	mux "github.com/cbeuw/Cloak/internal/multiplex"
+	log "github.com/sirupsen/logrus"
+)
+
+const statsInterval = time.Second
+
+var ErrAlreadyRunning = errors.New("a client is already running")
+var ErrNotRunning = errors.New("no client is running")
+var ErrNotProtected = errors.New("the socket couldn't be protected")
+
+// StatsCallback is told how many bytes the client has sent to and received from the server since it started, every
+// second and once more when it stops
+type StatsCallback interface {
+	OnStats(sent int64, received int64)
+}
+
+// Protector keeps the sockets of the client out of the app's VPN, e.g. with VpnService.protect on Android. Protect
+// returns whether it has
+type Protector interface {
+	Protect(fd int) bool
+}
+
+type instance struct {
+	listener net.Listener
+	udpConn  *net.UDPConn
+	quota    *http.Server
+	stats    *http.Server
+
+	valve    *mux.CountingValve
+	callback StatsCallback
+
+	// ctx is cancelled when the client stops
+	ctx  context.Context
+	stop context.CancelFunc
+	// done is closed when the client has finished stopping
+	done chan struct{}
+
+	sessionsM sync.Mutex
+	sessions  []*mux.Session
+}
+
+var (
+	currentM sync.Mutex
+	current  *instance
+
+	protectorM sync.Mutex
+	protector  Protector
+)
+
+// SetProtector sets what protects the sockets of clients started after, nil for them not to be protected
+func SetProtector(p Protector) {
+	protectorM.Lock()
+	protector = p
+	protectorM.Unlock()
+}
+
+// SetLogLevel sets the verbosity of the logs, which is one of panic, fatal, error, warn, info, debug and trace
+func SetLogLevel(level string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(lvl)
+	return nil
+}
+
+// IsRunning returns whether a client is running
+func IsRunning() bool {
+	currentM.Lock()
+	defer currentM.Unlock()
+	return current != nil
+}
+
+// parseConfig parses a ckclient.json, with the defaults of ck-client's commandline for LocalHost, LocalPort and
+// RemotePort
+func parseConfig(configJSON string) (*client.RawConfig, error) {
+	raw := new(client.RawConfig)
+	if err := json.Unmarshal([]byte(configJSON), raw); err != nil {
+		return nil, fmt.Errorf("failed to parse the config: %v", err)
+	}
+	if raw.LocalHost == "" {
+		raw.LocalHost = "127.0.0.1"
+	}
+	if raw.LocalPort == "" {
+		raw.LocalPort = "1984"
+	}
+	if raw.RemotePort == "" {
+		raw.RemotePort = "443"
+	}
+	return raw, nil
+}
+
+// ImportConfig turns a share of a server, such as a cloak:// link or an ss:// link with Cloak as its plugin, into the
+// JSON of a ckclient.json to be given to StartClient
+func ImportConfig(share string) (string, error) {
+	raw, _, err := client.ImportShare(share)
+	if err != nil {
+		return "", err
+	}
+	configJSON, err := client.MarshalConfig(raw)
+	if err != nil {
+		return "", err
+	}
+	return string(configJSON), nil
+}
+
+// StartClient starts a client with the JSON of a ckclient.json, and returns once it's listening. callback can be
+// nil if the app doesn't need the traffic stats
+func StartClient(configJSON string, callback StatsCallback) error {
+	currentM.Lock()
+	defer currentM.Unlock()
+	if current != nil {
+		return ErrAlreadyRunning
+	}
+
+	raw, err := parseConfig(configJSON)
+	if err != nil {
+		return err
+	}
+	localConfig, remoteConfig, authInfo, err := raw.SplitConfigs(common.RealWorldState)
+	if err != nil {
+		return err
+	}
+	switch localConfig.LocalProxy {
+	case "", "socks5", "http":
+	default:
+		return fmt.Errorf("LocalProxy %v isn't supported on mobile", localConfig.LocalProxy)
+	}
+
+	inst := &instance{
+		callback: callback,
+		done:     make(chan struct{}),
+	}
+	inst.ctx, inst.stop = context.WithCancel(context.Background())
+	// with StatsAddr, the traffic is already counted in the valve of its stats
+	if valve, ok := remoteConfig.Valve.(*mux.CountingValve); ok {
+		inst.valve = valve
+	} else {
+		inst.valve = &mux.CountingValve{}
+		remoteConfig.Valve = inst.valve
+	}
+
+	protectorM.Lock()
+	p := protector
+	protectorM.Unlock()
+	d := &net.Dialer{KeepAlive: remoteConfig.KeepAlive}
+	if p != nil {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			return protect(p, c)
+		}
+	}
+	seshMaker := func() *mux.Session {
+		return inst.track(client.MakeSession(inst.ctx, remoteConfig, authInfo, d, false))
+	}
+	useSessionPerConnection := remoteConfig.NumConn == 0
+
+	var serve func()
+	if authInfo.Unordered {
+		udpAddr, err := net.ResolveUDPAddr("udp", localConfig.LocalAddr)
+		if err != nil {
+			return err
+		}
+		inst.udpConn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return err
+		}
+		acceptor := func() (*net.UDPConn, error) { return inst.udpConn, nil }
+		serve = func() { client.RouteUDP(acceptor, localConfig.UDPTimeout, seshMaker, useSessionPerConnection) }
+	} else {
+		inst.listener, err = net.Listen("tcp", localConfig.LocalAddr)
+		if err != nil {
+			return err
+		}
+		if localConfig.UDPRelay && localConfig.LocalProxy == "" {
+			udpAddr, _ := net.ResolveUDPAddr("udp", localConfig.LocalAddr)
+			inst.udpConn, err = net.ListenUDP("udp", udpAddr)
+			if err != nil {
+				inst.listener.Close()
+				return err
+			}
+			acceptor := func() (*net.UDPConn, error) { return inst.udpConn, nil }
+			go client.RouteUDPOverTCP(acceptor, localConfig.UDPTimeout, seshMaker, useSessionPerConnection)
+		}
+		serve = func() {
+			var err error
+			switch localConfig.LocalProxy {
+			case "socks5":
+				err = client.ServeSOCKS5(inst.listener, localConfig.Timeout, seshMaker, useSessionPerConnection)
+			case "http":
+				err = client.ServeHTTPProxy(inst.listener, localConfig.Timeout, seshMaker, useSessionPerConnection)
+			default:
+				client.RouteTCP(inst.listener, localConfig.Timeout, seshMaker, useSessionPerConnection)
+			}
+			if err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Stopped serving %v: %v", localConfig.LocalProxy, err)
+			}
+		}
+	}
+
+	if remoteConfig.Stats != nil {
+		statsListener, err := client.ListenStats(localConfig.StatsAddr)
+		if err != nil {
+			if inst.listener != nil {
+				inst.listener.Close()
+			}
+			if inst.udpConn != nil {
+				inst.udpConn.Close()
+			}
+			return err
+		}
+		inst.stats = &http.Server{Handler: client.StatsHandler(remoteConfig.Stats)}
+		go func() {
+			if err := inst.stats.Serve(statsListener); err != http.ErrServerClosed {
+				log.Errorf("Failed to serve the stats: %v", err)
+			}
+		}()
+	}
+
+	if remoteConfig.Quota != nil {
+		inst.quota = &http.Server{Addr: localConfig.QuotaAddr, Handler: client.QuotaHandler(remoteConfig.Quota)}
+		go func() {
+			if err := inst.quota.ListenAndServe(); err != http.ErrServerClosed {
+				log.Errorf("Failed to serve the quota: %v", err)
+			}
+		}()
+	}
+
+	if remoteConfig.Endpoints != nil {
+		go remoteConfig.Endpoints.Watch(inst.ctx, d)
+	}
+
+	log.Infof("Listening on %v for %v client", localConfig.LocalAddr, authInfo.ProxyMethod)
+	go serve()
+	go inst.reportStats()
+	current = inst
+	return nil
+}
+
+// StopClient stops the running client, closing its sessions and what it listens on
+func StopClient() error {
+	currentM.Lock()
+	inst := current
+	current = nil
+	currentM.Unlock()
+	if inst == nil {
+		return ErrNotRunning
+	}
+
+	inst.stop()
+	if inst.listener != nil {
+		inst.listener.Close()
+	}
+	if inst.udpConn != nil {
+		inst.udpConn.Close()
+	}
+	if inst.quota != nil {
+		inst.quota.Close()
+	}
+	if inst.stats != nil {
+		inst.stats.Close()
+	}
+	inst.sessionsM.Lock()
+	for _, sesh := range inst.sessions {
+		sesh.Close()
+	}
+	inst.sessions = nil
+	inst.sessionsM.Unlock()
+	<-inst.done
+	log.Info("Client stopped")
+	return nil
+}
+
+func protect(p Protector, c syscall.RawConn) error {
+	var ok bool
+	err := c.Control(func(fd uintptr) {
+		ok = p.Protect(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotProtected
+	}
+	return nil
+}
+
+func (inst *instance) isStopped() bool {
+	return inst.ctx.Err() != nil
+}
+
+// track keeps a session to be closed when the client stops, or closes it if it already has
+func (inst *instance) track(sesh *mux.Session) *mux.Session {
+	inst.sessionsM.Lock()
+	defer inst.sessionsM.Unlock()
+	if inst.isStopped() {
+		sesh.Close()
+		return sesh
+	}
+	// the sessions that have closed on their own are forgotten
+	open := inst.sessions[:0]
+	for _, s := range inst.sessions {
+		if !s.IsClosed() {
+			open = append(open, s)
+		}
+	}
+	inst.sessions = append(open, sesh)
+	return sesh
+}
+
+func (inst *instance) reportStats() {
+	defer close(inst.done)
+	if inst.callback == nil {
+		<-inst.ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			inst.callback.OnStats(inst.valve.GetTx(), inst.valve.GetRx())
+		case <-inst.ctx.Done():
+			inst.callback.OnStats(inst.valve.GetTx(), inst.valve.GetRx())
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package mobile
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingCallback struct {
+	m     sync.Mutex
+	calls int
+}
+
+func (cb *recordingCallback) OnStats(sent int64, received int64) {
+	cb.m.Lock()
+	cb.calls++
+	cb.m.Unlock()
+}
+
+type recordingProtector struct {
+	m   sync.Mutex
+	fds []int
+}
+
+func (p *recordingProtector) Protect(fd int) bool {
+	p.m.Lock()
+	p.fds = append(p.fds, fd)
+	p.m.Unlock()
+	return true
+}
+
+func (p *recordingProtector) protected() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.fds)
+}
+
+// freePort returns a port on 127.0.0.1 that nothing listens on
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func testConfig(t *testing.T) (string, string) {
+	localPort := freePort(t)
+	return fmt.Sprintf(`{
+		"Transport": "direct",
+		"ProxyMethod": "shadowsocks",
+		"EncryptionMethod": "plain",
+		"UID": "5nneblJy6lniPJfr81LuYQ==",
+		"PublicKey": "IYoUzkle/T/kriE+Ufdm7AHQtIeGnBWbhhlTbmDpUUI=",
+		"ServerName": "www.bing.com",
+		"NumConn": 1,
+		"BrowserSig": "chrome",
+		"RemoteHost": "127.0.0.1",
+		"RemotePort": "%v",
+		"LocalPort": "%v"
+	}`, freePort(t), localPort), localPort
+}
+
+func TestParseConfig(t *testing.T) {
+	raw, err := parseConfig(`{"ServerName": "www.bing.com"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.LocalHost != "127.0.0.1" || raw.LocalPort != "1984" || raw.RemotePort != "443" {
+		t.Errorf("unexpected defaults %v %v %v", raw.LocalHost, raw.LocalPort, raw.RemotePort)
+	}
+	if _, err := parseConfig("not json"); err == nil {
+		t.Error("expecting an error for a config that isn't JSON")
+	}
+}
+
+func TestStartClient(t *testing.T) {
+	config, localPort := testConfig(t)
+
+	t.Run("bad config", func(t *testing.T) {
+		if err := StartClient(`{"ProxyMethod": "shadowsocks"}`, nil); err == nil {
+			t.Error("expecting an error for a config without ServerName")
+		}
+		if IsRunning() {
+			t.Error("client running after failing to start")
+		}
+	})
+	t.Run("already running", func(t *testing.T) {
+		if err := StartClient(config, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := StartClient(config, nil); err != ErrAlreadyRunning {
+			t.Errorf("expecting error %v, got %v", ErrAlreadyRunning, err)
+		}
+		if err := StopClient(); err != nil {
+			t.Fatal(err)
+		}
+		if err := StopClient(); err != ErrNotRunning {
+			t.Errorf("expecting error %v, got %v", ErrNotRunning, err)
+		}
+	})
+	t.Run("restart", func(t *testing.T) {
+		if err := StartClient(config, nil); err != nil {
+			t.Fatalf("failed to start again on the same port: %v", err)
+		}
+		_ = StopClient()
+	})
+	t.Run("stop while connecting", func(t *testing.T) {
+		cb := &recordingCallback{}
+		p := &recordingProtector{}
+		SetProtector(p)
+		defer SetProtector(nil)
+		if err := StartClient(config, cb); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", localPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// the session keeps trying to connect to the server, which isn't there
+		_, _ = conn.Write([]byte("hello"))
+		time.Sleep(100 * time.Millisecond)
+		if err := StopClient(); err != nil {
+			t.Fatal(err)
+		}
+		if p.protected() == 0 {
+			t.Error("the sockets to the server weren't protected")
+		}
+		cb.m.Lock()
+		if cb.calls == 0 {
+			t.Error("stats not reported on stopping")
+		}
+		cb.m.Unlock()
+
+		// the session gives up on connecting, and the proxy client's connection is closed
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("read from a connection that should have been closed")
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Error("the connection wasn't closed after stopping")
+		}
+	})
+}
@@ -34,3 +34,9 @@ arch="amd64 386 arm arm64"
 pushd ../ck-server || exit 1
 gox -ldflags "-X main.version=${v}" -os="$os" -arch="$arch" -osarch="$osarch" -output="$output"
 mv ck-server-* ../../release
+
+os="windows linux darwin"
+arch="amd64 arm64"
+pushd ../ck-audit || exit 1
+gox -ldflags "-X main.version=${v}" -os="$os" -arch="$arch" -osarch="$osarch" -output="$output"
+mv ck-audit-* ../../release
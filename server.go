@@ -0,0 +1,75 @@
+package cloak
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cbeuw/Cloak/internal/common"
+	"github.com/cbeuw/Cloak/internal/server"
+)
+
+// ServerConfig is the config of a server, as in ckserver.json. BindAddr, AdminAPIAddr and the other addresses ck-server
+// listens on aren't listened on
+type ServerConfig = server.RawConfig
+
+var ErrServerClosed = errors.New("server closed")
+
+// Server serves Cloak on the listeners it's given, and what isn't Cloak as its config says, e.g. by redirecting it to
+// RedirAddr. It's safe for concurrent use
+type Server struct {
+	sta    *server.State
+	closed atomic.Bool
+}
+
+// NewServer makes a server with config
+func NewServer(config ServerConfig) (*Server, error) {
+	sta, err := server.InitState(config, common.RealWorldState)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{sta: sta}, nil
+}
+
+// Serve accepts connections on l until it's closed, which it is once the server is shut down. It returns
+// ErrServerClosed if it's been shut down, and nil if l was closed otherwise
+func (s *Server) Serve(l net.Listener) error {
+	server.Serve(l, s.sta)
+	if s.closed.Load() {
+		return ErrServerClosed
+	}
+	return nil
+}
+
+// Reload applies config to the server, as ck-server does on SIGHUP. The sessions already made carry on as they were
+func (s *Server) Reload(config ServerConfig) error {
+	return s.sta.Reload(config)
+}
+
+// Shutdown stops accepting connections, tells the clients of the sessions open to go elsewhere, and waits for the
+// sessions to end. The sessions left when ctx's deadline passes are closed, and it returns ctx.Err() if ctx is done
+// before they have been
+func (s *Server) Shutdown(ctx context.Context) error {
+	timeout := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	s.closed.Store(true)
+	select {
+	case <-s.sta.Drain(timeout, true):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	// so that handshakes seen already can't be replayed on the server that takes over
+	return s.sta.SaveReplayCache()
+}
+
+// Close stops accepting connections and closes the sessions open straight away
+func (s *Server) Close() error {
+	s.closed.Store(true)
+	<-s.sta.Drain(0, false)
+	return s.sta.SaveReplayCache()
+}